@@ -12,6 +12,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/demisto/alfred/bot"
 	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/metrics"
 	"github.com/demisto/alfred/queue"
 	"github.com/demisto/alfred/repo"
 	"github.com/demisto/alfred/web"
@@ -36,6 +37,15 @@ func (b *botCloser) Close() error {
 	return nil
 }
 
+type workerCloser struct {
+	*bot.Worker
+}
+
+func (w *workerCloser) Close() error {
+	w.Stop()
+	return nil
+}
+
 func run(signalCh chan os.Signal) {
 	var closers []closer
 	// If we are on DEV, let's use embedded DB. On test and prod we will use MySQL
@@ -52,6 +62,15 @@ func run(signalCh chan os.Signal) {
 	}
 	closers = append(closers, q)
 
+	metrics.PerTeam = conf.Options.Metrics.PerTeam
+	if conf.Options.Metrics.Address != "" {
+		go func() {
+			if err := metrics.Serve(conf.Options.Metrics.Address); err != nil {
+				logrus.WithError(err).Error("Unable to serve metrics")
+			}
+		}()
+	}
+
 	serviceChannel := make(chan bool)
 	if conf.Options.Web {
 		b, err := bot.New(r, q)
@@ -75,7 +94,7 @@ func run(signalCh chan os.Signal) {
 	}
 
 	if conf.Options.Worker {
-		worker, err := bot.NewWorker(q)
+		worker, err := bot.NewWorker(q, r)
 		if err != nil {
 			logrus.Fatal(err)
 		}
@@ -83,6 +102,7 @@ func run(signalCh chan os.Signal) {
 			worker.Start()
 			serviceChannel <- true
 		}()
+		closers = append(closers, &workerCloser{worker})
 	}
 
 	// Block until one of the signals above is received
@@ -94,7 +114,8 @@ func run(signalCh chan os.Signal) {
 	}
 	closeChannel := make(chan bool)
 	go func() {
-		for i := range closers {
+		// Close in the reverse order so the bot flushes its statistics before the queue and the DB go away
+		for i := len(closers) - 1; i >= 0; i-- {
 			closers[i].Close()
 		}
 		closeChannel <- true
@@ -0,0 +1,232 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+const (
+	// abuseIPDBScoreToConvict is the abuse confidence (0-100) from which an IP is malicious
+	abuseIPDBScoreToConvict = 75
+	// abuseIPDBMaxAge is how many days of reports we ask for
+	abuseIPDBMaxAge = 90
+	// abuseIPDBLimitReached is the error of the result when the key has no checks left for the day
+	abuseIPDBLimitReached = "the daily AbuseIPDB limit of the key was reached"
+)
+
+// abuseIPDBCategories are the names of the report categories
+var abuseIPDBCategories = map[int]string{
+	1: "DNS Compromise", 2: "DNS Poisoning", 3: "Fraud Orders", 4: "DDoS Attack", 5: "FTP Brute-Force", 6: "Ping of Death",
+	7: "Phishing", 8: "Fraud VoIP", 9: "Open Proxy", 10: "Web Spam", 11: "Email Spam", 12: "Blog Spam", 13: "VPN IP",
+	14: "Port Scan", 15: "Hacking", 16: "SQL Injection", 17: "Spoofing", 18: "Brute-Force", 19: "Bad Web Bot",
+	20: "Exploited Host", 21: "Web App Attack", 22: "SSH", 23: "IoT Targeted",
+}
+
+// errAbuseIPDBKey is returned if AbuseIPDB does not accept the key
+var errAbuseIPDBKey = errors.New("AbuseIPDB did not accept the key")
+
+// abuseIPDBBudget is what a key has left of its daily checks. AbuseIPDB resets the limits at midnight UTC.
+type abuseIPDBBudget struct {
+	day  string
+	used int
+	done bool // AbuseIPDB told us the key is out of checks for the day
+}
+
+// abuseIPDBBudgets are the budgets of the keys, shared by the scanners since every request creates its own
+var abuseIPDBBudgets = struct {
+	sync.Mutex
+	keys map[string]*abuseIPDBBudget
+}{keys: make(map[string]*abuseIPDBBudget)}
+
+// budget of the key for the day of now
+func abuseIPDBBudgetOf(key string, now time.Time) *abuseIPDBBudget {
+	day := now.UTC().Format("2006-01-02")
+	b := abuseIPDBBudgets.keys[key]
+	if b == nil || b.day != day {
+		b = &abuseIPDBBudget{day: day}
+		abuseIPDBBudgets.keys[key] = b
+	}
+	return b
+}
+
+// abuseIPDBSpend takes a check from the budget of the key, false if it has none left
+func abuseIPDBSpend(key string, limit int, now time.Time) bool {
+	abuseIPDBBudgets.Lock()
+	defer abuseIPDBBudgets.Unlock()
+	b := abuseIPDBBudgetOf(key, now)
+	if b.done || limit > 0 && b.used >= limit {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// abuseIPDBRemaining updates the budget of the key with what AbuseIPDB says is left
+func abuseIPDBRemaining(key string, remaining int, now time.Time) {
+	abuseIPDBBudgets.Lock()
+	defer abuseIPDBBudgets.Unlock()
+	if remaining <= 0 {
+		abuseIPDBBudgetOf(key, now).done = true
+	}
+}
+
+// abuseIPDBScanner checks IPs with AbuseIPDB using the key of the team
+type abuseIPDBScanner struct {
+	url   string
+	key   string
+	limit int
+	c     *http.Client
+}
+
+// newAbuseIPDBScanner skips the source for teams without a key
+func newAbuseIPDBScanner(creds domain.Credentials) (Scanner, error) {
+	if creds.Key == "" {
+		return nil, nil
+	}
+	return &abuseIPDBScanner{url: conf.Options.AbuseIPDB.URL, key: creds.Key, limit: conf.Options.AbuseIPDB.DailyLimit,
+		c: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (a *abuseIPDBScanner) Name() string {
+	return domain.SourceAbuseIPDB
+}
+
+func (a *abuseIPDBScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeIP
+}
+
+// breakerKey is per key so a team with a bad key does not stop the checks of the others
+func (a *abuseIPDBScanner) breakerKey() string {
+	return domain.SourceAbuseIPDB + ":" + a.key
+}
+
+// abuseIPDBCheck is the data of the check endpoint
+type abuseIPDBCheck struct {
+	IPAddress            string `json:"ipAddress"`
+	AbuseConfidenceScore int    `json:"abuseConfidenceScore"`
+	CountryCode          string `json:"countryCode"`
+	UsageType            string `json:"usageType"`
+	ISP                  string `json:"isp"`
+	TotalReports         int    `json:"totalReports"`
+	LastReportedAt       string `json:"lastReportedAt"`
+	Reports              []struct {
+		Categories []int `json:"categories"`
+	} `json:"reports"`
+}
+
+// check returns the reports of the IP
+func (a *abuseIPDBScanner) check(ctx context.Context, ip string) (*abuseIPDBCheck, error) {
+	q := url.Values{"ipAddress": {ip}, "maxAgeInDays": {strconv.Itoa(abuseIPDBMaxAge)}, "verbose": {""}}
+	req, err := http.NewRequest("GET", a.url+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Key", a.key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		abuseIPDBRemaining(a.key, remaining, time.Now())
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusTooManyRequests:
+		abuseIPDBRemaining(a.key, 0, time.Now())
+		return nil, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errAbuseIPDBKey
+	default:
+		return nil, fmt.Errorf("AbuseIPDB returned %s", resp.Status)
+	}
+	var res struct {
+		Data abuseIPDBCheck `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res.Data, nil
+}
+
+// categories are the names of the categories the IP was reported for
+func (c *abuseIPDBCheck) categories() []string {
+	seen := make(map[int]bool)
+	var ids []int
+	for _, r := range c.Reports {
+		for _, id := range r.Categories {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Ints(ids)
+	var names []string
+	for _, id := range ids {
+		if name, ok := abuseIPDBCategories[id]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// lastReported is the date of the last report
+func (c *abuseIPDBCheck) lastReported() string {
+	if t, err := time.Parse(time.RFC3339, c.LastReportedAt); err == nil {
+		return t.UTC().Format("2006-01-02")
+	}
+	return c.LastReportedAt
+}
+
+// Scan an IP. Checks over the daily limit of the key are no data and not an error so they do not open the breaker.
+func (a *abuseIPDBScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res := domain.SourceResult{Result: domain.ResultUnknown, NotFound: true}
+	if !abuseIPDBSpend(a.key, a.limit, time.Now()) {
+		res.Error = abuseIPDBLimitReached
+		return res, nil
+	}
+	c, err := a.check(ctx, indicator.Value)
+	if err != nil {
+		return res, err
+	}
+	// Too many requests
+	if c == nil {
+		res.Error = abuseIPDBLimitReached
+		return res, nil
+	}
+	// An IP nobody reported is no data rather than clean
+	if c.TotalReports == 0 {
+		return res, nil
+	}
+	res.NotFound, res.Result, res.Value = false, domain.ResultClean, float64(c.AbuseConfidenceScore)
+	if c.AbuseConfidenceScore >= abuseIPDBScoreToConvict {
+		res.Result = domain.ResultDirty
+	}
+	res.Score = fmt.Sprintf("%d%% confidence, last reported %s", c.AbuseConfidenceScore, c.lastReported())
+	res.Link = "https://www.abuseipdb.com/check/" + indicator.Value
+	lines := []string{fmt.Sprintf("Confidence: %d%%", c.AbuseConfidenceScore), fmt.Sprintf("Reports: %d", c.TotalReports),
+		"Last Reported: " + c.lastReported()}
+	if categories := c.categories(); len(categories) > 0 {
+		lines = append(lines, "Categories: "+strings.Join(categories, ", "))
+	}
+	if c.ISP != "" {
+		lines = append(lines, "ISP: "+c.ISP)
+	}
+	res.Detail = strings.Join(lines, "\n")
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestAbuseIPDBScan(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Key") != "test-key" || r.URL.Query().Get("maxAgeInDays") != "90" {
+			t.Errorf("unexpected request %s with key %q", r.URL, r.Header.Get("Key"))
+		}
+		switch r.URL.Query().Get("ipAddress") {
+		case "1.2.3.4":
+			w.Write([]byte(`{"data":{"ipAddress":"1.2.3.4","abuseConfidenceScore":85,"totalReports":12,"isp":"Evil Hosting",
+"lastReportedAt":"2020-01-02T10:00:00+00:00","reports":[{"categories":[18,22]},{"categories":[14,18]}]}}`))
+		case "5.6.7.8":
+			w.Write([]byte(`{"data":{"ipAddress":"5.6.7.8","abuseConfidenceScore":10,"totalReports":1,"lastReportedAt":"2020-01-03T10:00:00+00:00"}}`))
+		default:
+			w.Write([]byte(`{"data":{"ipAddress":"8.8.8.8","abuseConfidenceScore":0,"totalReports":0}}`))
+		}
+	}))
+	defer srv.Close()
+	a := &abuseIPDBScanner{url: srv.URL, key: "test-key", c: http.DefaultClient}
+	res, err := a.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "1.2.3.4"})
+	if err != nil || res.NotFound || res.Result != domain.ResultDirty || res.Value != 85 ||
+		res.Score != "85% confidence, last reported 2020-01-02" || res.Link != "https://www.abuseipdb.com/check/1.2.3.4" {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	if !strings.Contains(res.Detail, "Categories: Port Scan, Brute-Force, SSH") || !strings.Contains(res.Detail, "Reports: 12") {
+		t.Errorf("unexpected detail %s", res.Detail)
+	}
+	res, err = a.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "5.6.7.8"})
+	if err != nil || res.NotFound || res.Result != domain.ResultClean {
+		t.Errorf("expected clean but got %+v - %v", res, err)
+	}
+	// Nobody reported it
+	res, err = a.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "8.8.8.8"})
+	if err != nil || !res.NotFound || res.Result != domain.ResultUnknown {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+}
+
+func TestAbuseIPDBBudget(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Key") == "busy-key" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"data":{"totalReports":0}}`))
+	}))
+	defer srv.Close()
+	abuseIPDBBudgets.Lock()
+	delete(abuseIPDBBudgets.keys, "budget-key")
+	delete(abuseIPDBBudgets.keys, "busy-key")
+	abuseIPDBBudgets.Unlock()
+	a := &abuseIPDBScanner{url: srv.URL, key: "budget-key", limit: 2, c: http.DefaultClient}
+	for i := 0; i < 3; i++ {
+		res, err := a.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "1.2.3.4"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 && res.Error != abuseIPDBLimitReached {
+			t.Errorf("expected the limit to be reached but got %+v", res)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls within the budget but got %d", calls)
+	}
+	// A new day is a new budget
+	if !abuseIPDBSpend("budget-key", 2, time.Now().Add(24*time.Hour)) {
+		t.Error("expected the budget to reset the next day")
+	}
+	// Too many requests stops the key for the day and is not an error that opens the breaker
+	busy := &abuseIPDBScanner{url: srv.URL, key: "busy-key", c: http.DefaultClient}
+	calls = 0
+	for i := 0; i < 2; i++ {
+		res, err := busy.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "1.2.3.4"})
+		if err != nil || res.Error != abuseIPDBLimitReached || !res.NotFound {
+			t.Errorf("unexpected result %+v - %v", res, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected only one call after too many requests but got %d", calls)
+	}
+}
+
+func TestNewAbuseIPDBScanner(t *testing.T) {
+	// No key skips the source
+	s, err := newAbuseIPDBScanner(domain.Credentials{})
+	if err != nil || s != nil {
+		t.Errorf("expected no scanner without a key but got %v - %v", s, err)
+	}
+	s, err = newAbuseIPDBScanner(domain.Credentials{Key: "team-key"})
+	if err != nil || s == nil || !s.Supports(domain.ReplyTypeIP) || s.Supports(domain.ReplyTypeURL) {
+		t.Errorf("unexpected scanner %v - %v", s, err)
+	}
+	if scanBreaker(s) != "abuseipdb:team-key" {
+		t.Errorf("expected a breaker per key but got %s", scanBreaker(s))
+	}
+}
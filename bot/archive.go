@@ -0,0 +1,356 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/demisto/alfred/metrics"
+)
+
+var encryptedArchivesTotal = metrics.NewCounter("alfred_encrypted_archives_total",
+	"Password-protected archives shared in the channels by the format", "format")
+
+const (
+	// maxArchiveMembers is how many member names we keep for the reply
+	maxArchiveMembers = 20
+	// maxArchiveNameLength cuts long member names
+	maxArchiveNameLength = 100
+	// maxArchiveEntries bounds the headers we walk, archives with more entries are counted up to here
+	maxArchiveEntries = 10000
+	// max7zHeaderSize bounds the header of 7z archives we look at
+	max7zHeaderSize = 1024 * 1024
+)
+
+// Signatures of the archives we parse
+var (
+	zipSignature  = []byte("PK\x03\x04")
+	rar4Signature = []byte("Rar!\x1a\x07\x00")
+	rar5Signature = []byte("Rar!\x1a\x07\x01\x00")
+	sevenZipMagic = []byte("7z\xbc\xaf\x27\x1c")
+	// sevenZipAES is the ID of the 7zAES coder
+	sevenZipAES = []byte{0x06, 0xf1, 0x07, 0x01}
+)
+
+// archiveInfo is what the headers of an archive tell us. Nothing is ever decompressed so archive bombs do not matter,
+// the names come from the directory of the archive and we only decrypt the 12 bytes that check a zip password.
+type archiveInfo struct {
+	format          string   // zip, rar or 7z, empty if the file is not an archive we parse
+	encrypted       bool     // Some members or the headers are encrypted
+	namesHidden     bool     // The headers are encrypted so we do not know the members
+	packed          bool     // The headers are compressed so we do not know the members or if they are encrypted
+	members         []string // Up to maxArchiveMembers names
+	count           int      // Members we saw, directories are not counted
+	passwordMatches bool     // One of the passwords from the message opens the archive
+}
+
+// addMember keeps the name if we do not have enough names yet
+func (a *archiveInfo) addMember(name string) {
+	a.count++
+	if len(a.members) >= maxArchiveMembers {
+		return
+	}
+	name = strings.ToValidUTF8(name, "?")
+	if utf8.RuneCountInString(name) > maxArchiveNameLength {
+		name = string([]rune(name)[:maxArchiveNameLength]) + "..."
+	}
+	a.members = append(a.members, name)
+}
+
+// inspectArchive parses the headers of zip, rar and 7z archives to see if they are encrypted and what is in them.
+// The passwords are tried on zip archives with the traditional encryption.
+func inspectArchive(data []byte, passwords []string) archiveInfo {
+	switch {
+	case bytes.HasPrefix(data, zipSignature):
+		return inspectZip(data, passwords)
+	case bytes.HasPrefix(data, rar5Signature):
+		return inspectRAR5(data[len(rar5Signature):])
+	case bytes.HasPrefix(data, rar4Signature):
+		return inspectRAR4(data[len(rar4Signature):])
+	case bytes.HasPrefix(data, sevenZipMagic):
+		return inspect7z(data)
+	}
+	return archiveInfo{}
+}
+
+// inspectZip reads the central directory, bit 0 of the flags of a member is set if it is encrypted
+func inspectZip(data []byte, passwords []string) archiveInfo {
+	info := archiveInfo{format: "zip"}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return info
+	}
+	var locked *zip.File
+	for i, f := range r.File {
+		if i >= maxArchiveEntries {
+			break
+		}
+		if f.Flags&0x1 != 0 {
+			info.encrypted = true
+			// Method 99 is AES which we do not check passwords for
+			if locked == nil && f.Method != 99 {
+				locked = f
+			}
+		}
+		if !strings.HasSuffix(f.Name, "/") {
+			info.addMember(f.Name)
+		}
+	}
+	if locked != nil {
+		for _, password := range passwords {
+			if zipPasswordMatches(data, locked, password) {
+				info.passwordMatches = true
+				break
+			}
+		}
+	}
+	return info
+}
+
+// zipCrypto is the traditional PKWARE encryption of zip files
+type zipCrypto struct {
+	k0, k1, k2 uint32
+}
+
+func newZipCrypto(password string) *zipCrypto {
+	z := &zipCrypto{k0: 0x12345678, k1: 0x23456789, k2: 0x34567890}
+	for i := 0; i < len(password); i++ {
+		z.update(password[i])
+	}
+	return z
+}
+
+func (z *zipCrypto) update(c byte) {
+	z.k0 = crc32.IEEETable[byte(z.k0)^c] ^ (z.k0 >> 8)
+	z.k1 = (z.k1+(z.k0&0xff))*134775813 + 1
+	z.k2 = crc32.IEEETable[byte(z.k2)^byte(z.k1>>24)] ^ (z.k2 >> 8)
+}
+
+func (z *zipCrypto) decrypt(c byte) byte {
+	t := (z.k2 | 2) & 0xffff
+	p := c ^ byte((t*(t^1))>>8)
+	z.update(p)
+	return p
+}
+
+// zipPasswordMatches decrypts the 12 byte encryption header of the member, its last byte is the high byte of the CRC
+// (or of the modification time when the sizes come after the data) if the password is right
+func zipPasswordMatches(data []byte, f *zip.File, password string) bool {
+	offset, err := f.DataOffset()
+	if err != nil || offset < 0 || offset+12 > int64(len(data)) {
+		return false
+	}
+	z := newZipCrypto(password)
+	var last byte
+	for _, c := range data[offset : offset+12] {
+		last = z.decrypt(c)
+	}
+	if f.Flags&0x8 != 0 {
+		return last == byte(f.ModifiedTime>>8)
+	}
+	return last == byte(f.CRC32>>24)
+}
+
+// inspectRAR4 walks the blocks of a RAR 4 archive. The main header says if the headers are encrypted and the file
+// headers if the file is.
+func inspectRAR4(data []byte) archiveInfo {
+	info := archiveInfo{format: "rar"}
+	for pos, n := 0, 0; pos+7 <= len(data) && n < maxArchiveEntries; n++ {
+		kind, flags, size := data[pos+2], binary.LittleEndian.Uint16(data[pos+3:]), int(binary.LittleEndian.Uint16(data[pos+5:]))
+		if size < 7 || pos+size > len(data) {
+			break
+		}
+		next := pos + size
+		switch kind {
+		case 0x73: // Main header
+			if flags&0x0080 != 0 {
+				info.encrypted, info.namesHidden = true, true
+				return info
+			}
+		case 0x74: // File header
+			if size < 32 {
+				return info
+			}
+			next += int(binary.LittleEndian.Uint32(data[pos+7:]))
+			if flags&0x0004 != 0 {
+				info.encrypted = true
+			}
+			nameStart := pos + 32
+			if flags&0x0100 != 0 {
+				nameStart += 8
+			}
+			nameEnd := nameStart + int(binary.LittleEndian.Uint16(data[pos+26:]))
+			// Directories have all the dictionary bits set
+			if nameEnd <= pos+size && flags&0x00e0 != 0x00e0 {
+				name := data[nameStart:nameEnd]
+				// Unicode names follow the ASCII one after a zero byte
+				if i := bytes.IndexByte(name, 0); i >= 0 {
+					name = name[:i]
+				}
+				info.addMember(string(name))
+			}
+		case 0x7b: // End of archive
+			return info
+		default:
+			if flags&0x8000 != 0 && pos+11 <= len(data) {
+				next += int(binary.LittleEndian.Uint32(data[pos+7:]))
+			}
+		}
+		pos = next
+	}
+	return info
+}
+
+// rarReader reads the variable length integers of RAR 5 headers, it stops at the end of the data
+type rarReader struct {
+	data []byte
+	pos  int
+	bad  bool
+}
+
+func (r *rarReader) vint() uint64 {
+	var v uint64
+	for i := uint(0); i < 10; i++ {
+		if r.pos >= len(r.data) {
+			break
+		}
+		c := r.data[r.pos]
+		r.pos++
+		v |= uint64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	r.bad = true
+	return 0
+}
+
+func (r *rarReader) skip(n uint64) {
+	if n > uint64(len(r.data)-r.pos) {
+		r.bad, r.pos = true, len(r.data)
+		return
+	}
+	r.pos += int(n)
+}
+
+func (r *rarReader) bytes(n uint64) []byte {
+	start := r.pos
+	r.skip(n)
+	if r.bad {
+		return nil
+	}
+	return r.data[start:r.pos]
+}
+
+// inspectRAR5 walks the headers of a RAR 5 archive. An archive encryption header means the headers are encrypted,
+// an encryption record in the extra area of a file header means the file is.
+func inspectRAR5(data []byte) archiveInfo {
+	info := archiveInfo{format: "rar"}
+	r := &rarReader{data: data}
+	for n := 0; r.pos < len(data) && n < maxArchiveEntries; n++ {
+		r.skip(4) // CRC32
+		size := r.vint()
+		header := &rarReader{data: r.bytes(size)}
+		if r.bad {
+			return info
+		}
+		kind, flags := header.vint(), header.vint()
+		var extraSize, dataSize uint64
+		if flags&0x1 != 0 {
+			extraSize = header.vint()
+		}
+		if flags&0x2 != 0 {
+			dataSize = header.vint()
+		}
+		switch kind {
+		case 2: // File header
+			fileFlags := header.vint()
+			header.vint() // Unpacked size
+			header.vint() // Attributes
+			if fileFlags&0x2 != 0 {
+				header.skip(4) // Modification time
+			}
+			if fileFlags&0x4 != 0 {
+				header.skip(4) // CRC32
+			}
+			header.vint() // Compression
+			header.vint() // Host OS
+			name := header.bytes(header.vint())
+			if header.bad {
+				return info
+			}
+			if fileFlags&0x1 == 0 {
+				info.addMember(string(name))
+			}
+			if extraSize > 0 && extraSize <= uint64(len(header.data)) {
+				extra := &rarReader{data: header.data[uint64(len(header.data))-extraSize:]}
+				for extra.pos < len(extra.data) && !extra.bad {
+					record := &rarReader{data: extra.bytes(extra.vint())}
+					if record.vint() == 0x01 && !record.bad {
+						info.encrypted = true
+					}
+				}
+			}
+		case 4: // Archive encryption header
+			info.encrypted, info.namesHidden = true, true
+			return info
+		case 5: // End of archive
+			return info
+		}
+		r.skip(dataSize)
+		if r.bad {
+			return info
+		}
+	}
+	return info
+}
+
+// inspect7z looks for the AES coder in the header of a 7z archive. An encoded header with the coder is an encrypted
+// header. 7-Zip compresses the header by default and we do not decompress, so an encoded header without the coder is
+// packed - the files behind it may be encrypted and we cannot tell.
+func inspect7z(data []byte) archiveInfo {
+	info := archiveInfo{format: "7z"}
+	if len(data) < 32 {
+		return info
+	}
+	offset, size := binary.LittleEndian.Uint64(data[12:]), binary.LittleEndian.Uint64(data[20:])
+	if offset > uint64(len(data)) || size > max7zHeaderSize || 32+offset+size > uint64(len(data)) || size == 0 {
+		return info
+	}
+	header := data[32+offset : 32+offset+size]
+	if !bytes.Contains(header, sevenZipAES) {
+		// 0x17 is an encoded header, only the coders of the header itself are readable
+		info.packed = header[0] == 0x17
+		return info
+	}
+	info.encrypted = true
+	// The names are behind the encryption of an encoded header
+	info.namesHidden = header[0] == 0x17
+	return info
+}
+
+// archivePasswordPattern finds passwords the way they are shared with archives - "password: infected", "the
+// password is 1234", "pw=abc"
+var archivePasswordPattern = regexp.MustCompile("(?i)(?:\\b(?:password|passwd|passcode|passphrase|kennwort|contraseña|senha)(?:\\s+is)?\\s*[:=]?|\\b(?:pass|pwd|pw)\\s*[:=])\\s*[`\"'*_“]*([^\\s`\"'*_”-][^\\s`\"'*_”]{1,63})")
+
+// notPasswords are the words that follow "password" in sentences about it
+var notPasswords = map[string]bool{"protected": true, "for": true, "of": true, "to": true, "in": true, "and": true, "the": true, "is": true}
+
+// maxArchivePasswords we try from one message
+const maxArchivePasswords = 3
+
+// archivePasswords finds the likely passwords of an archive in the text of the message it was shared with
+func archivePasswords(text string) []string {
+	var passwords []string
+	for _, m := range archivePasswordPattern.FindAllStringSubmatch(text, maxArchivePasswords) {
+		// Sentences end with a dot or a comma
+		if password := strings.TrimRight(m[1], ".,;!?)"); password != "" && !notPasswords[strings.ToLower(password)] {
+			passwords = append(passwords, password)
+		}
+	}
+	return passwords
+}
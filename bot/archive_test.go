@@ -0,0 +1,216 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// encrypt is the inverse of decrypt for building test archives
+func (z *zipCrypto) encrypt(p byte) byte {
+	t := (z.k2 | 2) & 0xffff
+	c := p ^ byte((t*(t^1))>>8)
+	z.update(p)
+	return c
+}
+
+// encryptedZip stores the files with the traditional zip encryption
+func encryptedZip(t *testing.T, password string, files ...string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range files {
+		content := []byte("content of " + name)
+		crc := crc32.ChecksumIEEE(content)
+		z := newZipCrypto(password)
+		var data []byte
+		for _, p := range append([]byte("0123456789a"), byte(crc>>24)) {
+			data = append(data, z.encrypt(p))
+		}
+		for _, p := range content {
+			data = append(data, z.encrypt(p))
+		}
+		f, err := w.CreateRaw(&zip.FileHeader{Name: name, Method: zip.Store, Flags: 0x1, CRC32: crc,
+			CompressedSize64: uint64(len(data)), UncompressedSize64: uint64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// rar5Header frames the fields of a RAR 5 header, the CRC is not checked
+func rar5Header(fields ...byte) []byte {
+	return append([]byte{0, 0, 0, 0, byte(len(fields))}, fields...)
+}
+
+// rar5File is a file header with the data and an encryption record if encrypted
+func rar5File(name string, encrypted bool) []byte {
+	extra := []byte{}
+	flags := byte(0x2)
+	if encrypted {
+		extra, flags = []byte{3, 0x01, 0, 0}, 0x3
+	}
+	fields := []byte{2, flags}
+	if encrypted {
+		fields = append(fields, byte(len(extra)))
+	}
+	fields = append(fields, 4, 0, 4, 0, 0, 0, byte(len(name)))
+	fields = append(append(fields, name...), extra...)
+	return append(rar5Header(fields...), "data"...)
+}
+
+// rar4File is a file header with the data
+func rar4File(name string, flags uint16) []byte {
+	h := make([]byte, 32)
+	binary.LittleEndian.PutUint16(h[3:], flags|0x8000)
+	h[2] = 0x74
+	binary.LittleEndian.PutUint16(h[5:], uint16(32+len(name)))
+	binary.LittleEndian.PutUint32(h[7:], 4)
+	binary.LittleEndian.PutUint16(h[26:], uint16(len(name)))
+	return append(append(h, name...), "data"...)
+}
+
+// rar4Main is the main header with the flags
+func rar4Main(flags uint16) []byte {
+	h := make([]byte, 13)
+	h[2] = 0x73
+	binary.LittleEndian.PutUint16(h[3:], flags)
+	binary.LittleEndian.PutUint16(h[5:], 13)
+	return h
+}
+
+// sevenZip puts the header after some packed data
+func sevenZip(header ...byte) []byte {
+	start := make([]byte, 32)
+	copy(start, sevenZipMagic)
+	binary.LittleEndian.PutUint64(start[12:], 8)
+	binary.LittleEndian.PutUint64(start[20:], uint64(len(header)))
+	return append(append(start, "packed.."...), header...)
+}
+
+func TestInspectArchive(t *testing.T) {
+	var rar5, rar5Encrypted, rar4, rar4Encrypted []byte
+	rar5 = append(append(append(append([]byte{}, rar5Signature...), rar5Header(1, 0, 0)...), rar5File("invoice.pdf", false)...), rar5Header(5, 0, 0)...)
+	rar5Encrypted = append(append(append([]byte{}, rar5Signature...), rar5Header(1, 0, 0)...), rar5File("invoice.exe", true)...)
+	rar5Hidden := append(append([]byte{}, rar5Signature...), rar5Header(4, 0, 0, 15)...)
+	rar4 = append(append(append([]byte{}, rar4Signature...), rar4Main(0)...), rar4File("a.doc", 0)...)
+	rar4Encrypted = append(append(append(append([]byte{}, rar4Signature...), rar4Main(0)...), rar4File("dir", 0xe0)...), rar4File("b.js", 0x4)...)
+	rar4Hidden := append(append([]byte{}, rar4Signature...), rar4Main(0x80)...)
+	plainZip := &bytes.Buffer{}
+	w := zip.NewWriter(plainZip)
+	w.Create("docs/")
+	w.Create("docs/readme.txt")
+	w.Close()
+	tests := []struct {
+		name     string
+		data     []byte
+		expected archiveInfo
+	}{
+		{"zip", plainZip.Bytes(), archiveInfo{format: "zip", members: []string{"docs/readme.txt"}, count: 1}},
+		{"encrypted zip", encryptedZip(t, "infected", "invoice.exe", "readme.txt"),
+			archiveInfo{format: "zip", encrypted: true, members: []string{"invoice.exe", "readme.txt"}, count: 2, passwordMatches: true}},
+		{"rar5", rar5, archiveInfo{format: "rar", members: []string{"invoice.pdf"}, count: 1}},
+		{"encrypted rar5", rar5Encrypted, archiveInfo{format: "rar", encrypted: true, members: []string{"invoice.exe"}, count: 1}},
+		{"rar5 encrypted headers", rar5Hidden, archiveInfo{format: "rar", encrypted: true, namesHidden: true}},
+		{"rar4", rar4, archiveInfo{format: "rar", members: []string{"a.doc"}, count: 1}},
+		{"encrypted rar4", rar4Encrypted, archiveInfo{format: "rar", encrypted: true, members: []string{"b.js"}, count: 1}},
+		{"rar4 encrypted headers", rar4Hidden, archiveInfo{format: "rar", encrypted: true, namesHidden: true}},
+		{"7z encrypted headers", sevenZip(0x17, 0x06, 0x01, 0x24, 0x06, 0xf1, 0x07, 0x01), archiveInfo{format: "7z", encrypted: true, namesHidden: true}},
+		{"7z packed headers", sevenZip(0x17, 0x06, 0x01, 0x23, 0x03, 0x01, 0x01), archiveInfo{format: "7z", packed: true}},
+		{"7z", sevenZip(0x01, 0x04, 0x06, 0x00), archiveInfo{format: "7z"}},
+		{"truncated 7z", sevenZip(0x17)[:40], archiveInfo{format: "7z"}},
+		{"truncated rar5", rar5Encrypted[:20], archiveInfo{format: "rar"}},
+		{"text", []byte("PK is not enough"), archiveInfo{}},
+	}
+	for _, test := range tests {
+		if info := inspectArchive(test.data, []string{"secret", "infected"}); !reflect.DeepEqual(info, test.expected) {
+			t.Errorf("%s: expected %+v but got %+v", test.name, test.expected, info)
+		}
+	}
+	// The wrong password does not open it
+	if info := inspectArchive(encryptedZip(t, "infected", "a.exe"), []string{"wrong"}); info.passwordMatches || !info.encrypted {
+		t.Errorf("unexpected %+v", info)
+	}
+	// Only some of the names are kept
+	var names []string
+	for i := 0; i < maxArchiveMembers+5; i++ {
+		names = append(names, strings.Repeat("x", i+1))
+	}
+	if info := inspectArchive(encryptedZip(t, "x", names...), nil); len(info.members) != maxArchiveMembers || info.count != maxArchiveMembers+5 {
+		t.Errorf("expected %d names of %d but got %d of %d", maxArchiveMembers, maxArchiveMembers+5, len(info.members), info.count)
+	}
+}
+
+func TestArchivePasswords(t *testing.T) {
+	tests := []struct {
+		text      string
+		passwords []string
+	}{
+		{"Please see the attached invoice, password: infected", []string{"infected"}},
+		{"The password is *1234*.", []string{"1234"}},
+		{"pw=abc and Passwort", []string{"abc"}},
+		{"a password-protected file, pass the word", nil},
+		{"Contraseña: \"Hola2024\"", []string{"Hola2024"}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if passwords := archivePasswords(test.text); !reflect.DeepEqual(passwords, test.passwords) {
+			t.Errorf("%q: expected %v but got %v", test.text, test.passwords, passwords)
+		}
+	}
+}
+
+func TestHandleEncryptedArchive(t *testing.T) {
+	data := encryptedZip(t, "infected", "invoice.exe")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+	s := &fakeScanner{name: domain.SourceURLhaus, types: []int{domain.ReplyTypeHash}, res: domain.SourceResult{Result: domain.ResultClean}}
+	w := &Worker{scanners: map[string]Scanner{domain.SourceURLhaus: s}}
+	reply := &domain.WorkReply{}
+	// Named as a document, the headers say otherwise
+	w.handleFile(&domain.WorkRequest{Type: "file", File: domain.File{Name: "invoice.pdf", FileType: "pdf", Size: len(data), URL: srv.URL,
+		Message: "Your invoice, password: infected"}}, reply)
+	if !reply.File.Archive || !reply.File.Encrypted || !reply.File.PasswordMatches || reply.File.MemberCount != 1 ||
+		reply.File.Result != domain.ResultSuspicious {
+		t.Errorf("unexpected reply %+v", reply.File)
+	}
+	f := fileFinding(defaultLocale, reply, "https://example.com/details")
+	if f.verdict != "Password-protected" || !strings.Contains(f.comment, "treat it as suspicious") || strings.Contains(f.comment, "files inside it were not scanned") {
+		t.Errorf("unexpected finding %+v", f)
+	}
+	last := f.sources[len(f.sources)-1]
+	if last.name != "Archive" || last.score != "password-protected, 1 file, password in the message" || last.detail != "Files: invoice.exe" {
+		t.Errorf("unexpected archive source %+v", last)
+	}
+	if severity := f.severity(nil); severity != domain.SeverityWarning {
+		t.Errorf("expected a warning but got %s", severity)
+	}
+}
+
+func TestArchiveSummary(t *testing.T) {
+	tests := []struct {
+		file     domain.FileReply
+		expected string
+	}{
+		{domain.FileReply{MemberCount: 2, Encrypted: true, PasswordMatches: true}, "password-protected, 2 files, password in the message"},
+		{domain.FileReply{Encrypted: true}, "password-protected, file names encrypted"},
+		{domain.FileReply{Packed: true}, "file list compressed, not inspected"},
+	}
+	for _, test := range tests {
+		if summary := archiveSummary(&test.file); summary != test.expected {
+			t.Errorf("expected %q for %+v but got %q", test.expected, test.file, summary)
+		}
+	}
+}
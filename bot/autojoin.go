@@ -0,0 +1,111 @@
+package bot
+
+import "github.com/Sirupsen/logrus"
+
+// autoJoin joins a public channel on its own if the team monitors all public channels or the name matches a channel pattern.
+// Without the name we resolve it only if the patterns need it.
+func (b *Bot) autoJoin(team, channel, name string, sub *subscription) {
+	b.mu.RLock()
+	known := sub.joined[channel]
+	needName := name == "" && !sub.configuration.AllPublicChannels && len(sub.configuration.ChannelPatterns) > 0
+	b.mu.RUnlock()
+	if known {
+		return
+	}
+	if needName {
+		if name = b.channelName(team, channel, sub); name == "" {
+			return
+		}
+	}
+	b.mu.RLock()
+	join := sub.configuration.ShouldJoin(channel, name) && !sub.joined[channel]
+	b.mu.RUnlock()
+	if !join {
+		return
+	}
+	if _, err := sub.s.Do("POST", "conversations.join", map[string]interface{}{"channel": channel}); err != nil {
+		logrus.WithError(err).Warnf("Unable to join channel %s of team %s", channel, team)
+		return
+	}
+	logrus.Debugf("Joined channel %s of team %s", channel, team)
+	b.markJoined(sub, channel)
+}
+
+// channelName resolves the name of the channel with conversations.info and caches it for the subscription
+func (b *Bot) channelName(team, channel string, sub *subscription) string {
+	b.mu.RLock()
+	name, ok := sub.names[channel]
+	b.mu.RUnlock()
+	if ok {
+		return name
+	}
+	info, err := sub.s.Do("GET", "conversations.info", map[string]string{"channel": channel})
+	if err != nil {
+		logrus.WithError(err).Debugf("Unable to get the info of channel %s of team %s", channel, team)
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub.names == nil {
+		sub.names = make(map[string]string)
+	}
+	sub.names[channel] = info.S("channel.name")
+	if info.B("channel.is_member") {
+		if sub.joined == nil {
+			sub.joined = make(map[string]bool)
+		}
+		sub.joined[channel] = true
+	}
+	return info.S("channel.name")
+}
+
+// markJoined remembers that we are in the channel so member events do not join it again
+func (b *Bot) markJoined(sub *subscription, channel string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub.joined == nil {
+		sub.joined = make(map[string]bool)
+	}
+	sub.joined[channel] = true
+}
+
+// joinPublicChannels is the sweep that joins the public channels we are not in yet when the team monitors all of them
+// or has channel patterns.
+// Big workspaces have hundreds of channels so the list is paged and the client waits when Slack rate limits us.
+func (b *Bot) joinPublicChannels(team string, sub *subscription) {
+	b.mu.Lock()
+	if b.sweeping[team] {
+		b.mu.Unlock()
+		return
+	}
+	b.sweeping[team] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.sweeping, team)
+		b.mu.Unlock()
+	}()
+	channels, err := sub.s.Conversations("public_channel")
+	if err != nil {
+		logrus.WithError(err).Warnf("Unable to list the public channels of team %s", team)
+		return
+	}
+	joined, failed := 0, 0
+	for _, c := range channels {
+		if c.B("is_member") {
+			b.markJoined(sub, c.S("id"))
+			continue
+		}
+		if !sub.configuration.ShouldJoin(c.S("id"), c.S("name")) {
+			continue
+		}
+		if _, err = sub.s.Do("POST", "conversations.join", map[string]interface{}{"channel": c.S("id")}); err != nil {
+			logrus.WithError(err).Infof("Unable to join channel %s of team %s", c.S("id"), team)
+			failed++
+			continue
+		}
+		b.markJoined(sub, c.S("id"))
+		joined++
+	}
+	logrus.Infof("Joined %d public channels of team %s, %d failed", joined, team, failed)
+}
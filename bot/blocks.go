@@ -0,0 +1,546 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+	"github.com/demisto/alfred/util"
+)
+
+// finding is what we say about a single indicator in a reply, laid out as blocks by replyBlocks
+type finding struct {
+	kind    string // What the indicator is, e.g. URL or Hash
+	value   string // The indicator the way we show it
+	verdict string // Shown in the header, e.g. Malicious
+	result  int    // One of the domain results, findings other than clean make the reply worth posting
+	comment string // A sentence about the verdict
+	link    string // The full details, empty if there is nothing more to show
+	sources []source
+	vt      int     // VirusTotal positives, they are part of the severity along with the result
+	xfe     float64 // X-Force Exchange score
+}
+
+// source is what one reputation service said about the indicator
+type source struct {
+	name   string
+	score  string // Short enough for the context line, e.g. 5 / 70
+	link   string
+	detail string // Only shown in the full layout
+	// private is only shown to the user who asked for the details, e.g. the breaches of an email
+	private string
+}
+
+// verdictNames are the default verdict of each result in the header
+var verdictNames = map[int]string{
+	domain.ResultClean:      "Clean",
+	domain.ResultUnknown:    "Unknown",
+	domain.ResultSuspicious: "Suspicious",
+	domain.ResultDirty:      "Malicious",
+}
+
+// newFinding with the default verdict of the result
+func newFinding(kind, value string, result int, comment, link string) finding {
+	return finding{kind: kind, value: value, verdict: verdictNames[result], result: result, comment: comment, link: link}
+}
+
+// add the source to the finding
+func (f *finding) add(name, score, link, detail string) {
+	f.sources = append(f.sources, source{name: name, score: score, link: link, detail: detail})
+}
+
+// severity of the finding with the thresholds of the team
+func (f *finding) severity(c *domain.Configuration) string {
+	return c.Severity(domain.Scores{Result: f.result, VTPositives: f.vt, XFEScore: f.xfe})
+}
+
+// replySeverity is the worst severity of the findings - the color of the reply
+func replySeverity(findings []finding, c *domain.Configuration) string {
+	var severities []string
+	for i := range findings {
+		severities = append(severities, findings[i].severity(c))
+	}
+	return domain.WorstSeverity(severities...)
+}
+
+// setReply sets the text of the message and the blocks in an attachment colored by the severity of the findings
+func setReply(message map[string]interface{}, blocks []slack.Block, findings []finding, c *domain.Configuration) {
+	text := replyText(findings)
+	message["text"] = text
+	message["attachments"] = []map[string]interface{}{slack.BlocksAttachment(replySeverity(findings, c), text, blocks)}
+}
+
+// scores is the context line with the score of each source
+func (f *finding) scores() []string {
+	var elements []string
+	for _, s := range f.sources {
+		name := "*" + s.name + "*"
+		if s.link != "" {
+			name = fmt.Sprintf("*<%s|%s>*", s.link, s.name)
+		}
+		elements = append(elements, fmt.Sprintf("%s: %s", name, s.score))
+	}
+	return elements
+}
+
+// details of the sources for the full layout
+func (f *finding) details() string {
+	var lines []string
+	for _, s := range f.sources {
+		if s.detail != "" {
+			lines = append(lines, fmt.Sprintf("*%s*\n%s", s.name, s.detail))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// privateDetails are the private details of the sources of the findings for the user who asked for them
+func privateDetails(findings []finding) string {
+	var lines []string
+	for i := range findings {
+		for _, s := range findings[i].sources {
+			if s.private != "" {
+				lines = append(lines, fmt.Sprintf("*%s %s - %s*\n%s", findings[i].kind, findings[i].value, s.name, s.private))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// section is the comment with a button to the details
+func (f *finding) section(text string) slack.Block {
+	block := slack.SectionBlock(text)
+	if f.link != "" {
+		block = block.WithButton("Details", f.link)
+	}
+	return block
+}
+
+// blocks of the finding - a header, the comment, the scores and the details in the full layout and a single line
+// with the scores under it in the compact one
+func (f *finding) blocks(full bool) []slack.Block {
+	emoji := ":" + verdictEmoji[f.result] + ":"
+	var blocks []slack.Block
+	if full {
+		blocks = append(blocks, slack.HeaderBlock(fmt.Sprintf("%s %s %s: %s", emoji, f.verdict, f.kind, f.value)), f.section(f.comment))
+	} else {
+		blocks = append(blocks, f.section(emoji+" "+f.comment))
+	}
+	if scores := f.scores(); len(scores) > 0 {
+		blocks = append(blocks, slack.ContextBlock(scores...))
+	}
+	if details := f.details(); full && details != "" {
+		blocks = append(blocks, slack.SectionBlock(details))
+	}
+	return blocks
+}
+
+// showDetailsAction is the action of the button that posts the full report of a compact reply
+const showDetailsAction = "show_details"
+
+// withShowDetails adds the button that posts the full report of the stored reply before the footer
+func withShowDetails(blocks []slack.Block, id string) []slack.Block {
+	footer := blocks[len(blocks)-1]
+	button := slack.ActionsBlock(slack.ActionButton("Show details", showDetailsAction, id))
+	return append(append(blocks[:len(blocks)-1:len(blocks)-1], button), footer)
+}
+
+// clean checks if all the findings are clean
+func clean(findings []finding) bool {
+	for i := range findings {
+		if findings[i].result != domain.ResultClean {
+			return false
+		}
+	}
+	return true
+}
+
+// replyText is the fallback text of the reply for notifications and clients that cannot render blocks
+func replyText(findings []finding) string {
+	switch len(findings) {
+	case 0:
+		return "I did not find anything suspicious."
+	case 1:
+		return findings[0].comment
+	}
+	counts := make(map[int]int)
+	for i := range findings {
+		counts[findings[i].result]++
+	}
+	var parts []string
+	for _, result := range []int{domain.ResultDirty, domain.ResultSuspicious, domain.ResultUnknown, domain.ResultClean} {
+		if counts[result] > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", verdictNames[result], counts[result]))
+		}
+	}
+	return strings.Join(parts, ", ") + "."
+}
+
+// replyBlocks lays out the findings with the quote of the attachment they came from before them and the notes
+// (e.g. what we skipped) after them.
+// Verbose channels get the full layout and the rest a compact one. If we have more than Slack allows in a single
+// message we point to the details page for the rest.
+func replyBlocks(locale string, findings []finding, quote string, notes []string, full bool, link string) []slack.Block {
+	// Room for the quote, the notes, the line about what we left out, the footer and the re-scan note
+	room := slack.MaxBlocks - len(notes) - 4
+	var blocks []slack.Block
+	if quote != "" {
+		blocks = append(blocks, slack.SectionBlock(quote))
+	}
+	shown := 0
+	for i := range findings {
+		fb := findings[i].blocks(full)
+		if full && shown > 0 {
+			fb = append([]slack.Block{slack.DividerBlock()}, fb...)
+		}
+		if len(blocks)+len(fb) > room {
+			break
+		}
+		blocks = append(blocks, fb...)
+		shown++
+	}
+	if left := len(findings) - shown; left > 0 {
+		blocks = append(blocks, slack.ContextBlock(messages.render(locale, "more_results", msgArgs{"Count": left, "Link": link})))
+	}
+	for _, note := range notes {
+		blocks = append(blocks, slack.ContextBlock(note))
+	}
+	return append(blocks, slack.ContextBlock(messages.render(locale, "footer", msgArgs{"Address": conf.Options.ExternalAddress})))
+}
+
+// fileLink is the details page of a shared file
+func fileLink(reply *domain.WorkReply, team string) string {
+	text := ""
+	if len(reply.Hashes) > 0 {
+		text = reply.Hashes[0].Details
+	}
+	return fmt.Sprintf("%s/details?f=%s&t=%s&text=%s", conf.Options.ExternalAddress, reply.File.Details.ID, team, url.QueryEscape(text))
+}
+
+// messageLink is the details page of the indicators in a message, each finding adds its indicator
+func messageLink(channel, messageID, team string) string {
+	return fmt.Sprintf("%s/details?c=%s&m=%s&t=%s", conf.Options.ExternalAddress, channel, messageID, team)
+}
+
+// fileFinding is what we say about a shared file
+func fileFinding(locale string, reply *domain.WorkReply, link string) finding {
+	id := "file_warning"
+	// The hash of a file we did not download can still convict it
+	if reply.File.Result == domain.ResultDirty {
+		id = "file_bad"
+	} else if reply.File.Encrypted {
+		id = "file_encrypted"
+	} else if reply.File.FileTooLarge {
+		id = "file_big"
+	} else if reply.File.Excluded {
+		id = "file_excluded"
+	} else if reply.File.Result == domain.ResultClean {
+		// At least one of reputation services found this to be known good
+		id = "file_good"
+	}
+	text := messages.render(locale, id, msgArgs{"Indicator": reply.File.Details.Name, "Link": "<" + link + "|Details>"})
+	if reply.File.Archive && !reply.File.Encrypted {
+		text += " " + messages.render(locale, "file_archive", nil)
+	}
+	if reply.File.Sandboxed {
+		text += " " + messages.render(locale, "file_sandboxed", nil)
+	}
+	f := newFinding("File", reply.File.Details.Name, reply.File.Result, text, link)
+	if reply.File.Result != domain.ResultDirty {
+		if reply.File.Encrypted {
+			f.verdict = "Password-protected"
+		} else if reply.File.FileTooLarge {
+			f.verdict = "Too large"
+		} else if reply.File.Excluded {
+			f.verdict = "Not analyzed"
+		}
+	}
+	if len(reply.Hashes) > 0 {
+		f.addSources(reply.Hashes[0].Sources)
+	}
+	if reply.File.Virus != "" {
+		f.add("ClamAV", reply.File.Virus, "", "")
+	}
+	if reply.File.MemberCount > 0 || reply.File.Encrypted || reply.File.Packed {
+		f.add("Archive", archiveSummary(&reply.File), "", archiveMembers(&reply.File))
+	}
+	return f
+}
+
+// archiveSummary says how many files the archive has and if the password from the message opens it
+func archiveSummary(r *domain.FileReply) string {
+	var parts []string
+	if r.Encrypted {
+		parts = append(parts, "password-protected")
+	}
+	if r.MemberCount == 1 {
+		parts = append(parts, "1 file")
+	} else if r.MemberCount > 0 {
+		parts = append(parts, fmt.Sprintf("%d files", r.MemberCount))
+	} else if r.Encrypted {
+		parts = append(parts, "file names encrypted")
+	} else if r.Packed {
+		parts = append(parts, "file list compressed, not inspected")
+	}
+	if r.PasswordMatches {
+		parts = append(parts, "password in the message")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// archiveMembers lists the names of the files in the archive
+func archiveMembers(r *domain.FileReply) string {
+	if len(r.Members) == 0 {
+		return ""
+	}
+	names := strings.Join(r.Members, ", ")
+	if more := r.MemberCount - len(r.Members); more > 0 {
+		names += fmt.Sprintf(" and %d more", more)
+	}
+	return "Files: " + names
+}
+
+// addSources adds what each reputation source that knows the indicator said about it
+func (f *finding) addSources(sources []domain.SourceResult) {
+	for i := range sources {
+		s := &sources[i]
+		// Say why the source is missing instead of leaving it out
+		if s.Unavailable {
+			f.add(scannerTitle(s.Source), "source unavailable", "", s.Error)
+			continue
+		}
+		if s.Pending {
+			f.add(scannerTitle(s.Source), "pending (rate limit)", "", "")
+			continue
+		}
+		if !found(s) {
+			continue
+		}
+		// The severity thresholds of the team are on these sources
+		switch s.Source {
+		case domain.SourceVT:
+			f.vt = int(s.Value)
+		case domain.SourceXFE:
+			f.xfe = s.Value
+		}
+		score := s.Score
+		if !s.Cached.IsZero() {
+			score += " (cached result from " + cachedAgo(s.Cached, time.Now()) + ")"
+		}
+		f.add(scannerTitle(s.Source), score, s.Link, s.Detail)
+		f.sources[len(f.sources)-1].private = s.PrivateDetail
+	}
+}
+
+// replyFindings are the findings of the indicators in the reply in the locale of the team. Clean findings, hashes and
+// custom matches are only shown in verbose channels.
+func replyFindings(locale string, reply *domain.WorkReply, link string, verbose bool) []finding {
+	details := func(text string) string { return fmt.Sprintf("%s&text=%s", link, url.QueryEscape(text)) }
+	// comment renders the comment about the indicator with a link to its details
+	comment := func(id, indicator, detailsLink string) string {
+		return messages.render(locale, id, msgArgs{"Indicator": indicator, "Link": "<" + detailsLink + "|Details>"})
+	}
+	var findings []finding
+	for i := range reply.URLs {
+		u := &reply.URLs[i]
+		id := "url_warning"
+		if u.Result == domain.ResultDirty {
+			id = "url_bad"
+		} else if u.Result == domain.ResultClean {
+			id = "url_good"
+		}
+		urlDisplay := defangURL(u.Details)
+		if original, ok := reply.Original[u.Details]; ok {
+			urlDisplay = original
+		}
+		urlLink := details("<" + u.Details + ">")
+		if u.Internal {
+			id = "url_internal"
+		}
+		f := newFinding("URL", urlDisplay, u.Result, comment(id, urlDisplay, urlLink), urlLink)
+		if u.Internal {
+			f.verdict = "Internal"
+		}
+		f.addSources(u.Sources)
+		// Internal URLs are shown in every channel so the team knows they were not checked
+		if verbose || f.result != domain.ResultClean || u.Internal {
+			findings = append(findings, f)
+		}
+	}
+	for i := range reply.IPs {
+		ip := &reply.IPs[i]
+		id := "ip_warning"
+		if ip.Private {
+			id = "ip_private"
+		} else if ip.Result == domain.ResultDirty {
+			id = "ip_bad"
+		} else if ip.Result == domain.ResultClean {
+			id = "ip_good"
+		}
+		ipLink := details(ip.Details)
+		f := newFinding("IP", displayIndicator(reply, ip.Details), ip.Result, comment(id, displayIndicator(reply, ip.Details), ipLink), ipLink)
+		if ip.Private {
+			f.result, f.verdict = domain.ResultClean, "Private"
+		}
+		f.addSources(ip.Sources)
+		if verbose || f.result != domain.ResultClean {
+			findings = append(findings, f)
+		}
+	}
+	for i := range reply.Domains {
+		d := &reply.Domains[i]
+		id := "domain_warning"
+		if d.Result == domain.ResultDirty {
+			id = "domain_bad"
+		} else if d.Result == domain.ResultClean {
+			id = "domain_good"
+		}
+		domainDisplay := defangURL(d.Details)
+		if original, ok := reply.Original[d.Details]; ok {
+			domainDisplay = original
+		}
+		domainLink := details(d.Details)
+		if d.Internal {
+			id = "domain_internal"
+		}
+		text := comment(id, domainDisplay, domainLink)
+		if note := registeredNote(locale, d.Sources, time.Now()); note != "" {
+			text += " " + note
+		}
+		f := newFinding("Domain", domainDisplay, d.Result, text, domainLink)
+		if d.Internal {
+			f.verdict = "Internal"
+		}
+		f.addSources(d.Sources)
+		if verbose || f.result != domain.ResultClean || d.Internal {
+			findings = append(findings, f)
+		}
+	}
+	for i := range reply.Emails {
+		e := &reply.Emails[i]
+		emailLink := details(e.Domain)
+		text := comment("email_warning", e.Details, emailLink)
+		if e.LookAlike != "" {
+			text = messages.render(locale, "email_lookalike", msgArgs{"Indicator": e.Details, "LookAlike": e.LookAlike, "Link": "<" + emailLink + "|Details>"})
+		} else if e.Internal {
+			text = comment("email_internal", e.Details, emailLink)
+		} else if e.Result == domain.ResultDirty {
+			text = comment("email_bad", e.Details, emailLink)
+		} else if e.Result == domain.ResultClean {
+			text = comment("email_good", e.Details, emailLink)
+		}
+		f := newFinding("Email", e.Details, e.Result, text, emailLink)
+		if e.LookAlike != "" {
+			f.result, f.verdict = domain.ResultDirty, "Look-alike"
+		} else if e.Internal {
+			f.verdict = "Internal"
+		}
+		f.addSources(e.Sources)
+		if verbose || f.result != domain.ResultClean || e.Internal {
+			findings = append(findings, f)
+		}
+	}
+	for i := range reply.Wallets {
+		wallet := &reply.Wallets[i]
+		chain := strings.ToUpper(wallet.Type)
+		id := "wallet_warning"
+		if wallet.Result == domain.ResultDirty {
+			id = "wallet_bad"
+		} else if wallet.Result == domain.ResultClean {
+			id = "wallet_good"
+		}
+		text := messages.render(locale, id, msgArgs{"Chain": chain, "Indicator": wallet.Details, "Reports": wallet.Reports, "Categories": strings.Join(wallet.Categories, ", ")})
+		f := newFinding(chain+" wallet", wallet.Details, wallet.Result, text, "")
+		if wallet.Result != domain.ResultUnknown {
+			f.add("Chainabuse", fmt.Sprintf("%d reports", wallet.Reports), "", strings.Join(wallet.Categories, ", "))
+		}
+		if verbose || f.result != domain.ResultClean {
+			findings = append(findings, f)
+		}
+	}
+	// CVEs are informational so they are never clean
+	for i := range reply.CVEs {
+		cve := &reply.CVEs[i]
+		if cve.NotFound || cve.Error != "" {
+			if verbose {
+				findings = append(findings, newFinding("CVE", cve.Details, domain.ResultUnknown, messages.render(locale, "cve_warning", msgArgs{"Indicator": cve.Details}), ""))
+			}
+			continue
+		}
+		summary := cve.Summary
+		if !verbose {
+			if s := util.Substr(summary, 0, 300); s != summary {
+				summary = s + "..."
+			}
+		}
+		severity := cve.Severity
+		if severity == "" {
+			severity = "Unknown"
+		}
+		nvdLink := "https://nvd.nist.gov/vuln/detail/" + cve.Details
+		f := newFinding("CVE", cve.Details, domain.ResultUnknown, messages.render(locale, "cve", msgArgs{"Indicator": cve.Details, "Score": cve.Score, "Severity": severity, "Summary": summary}), nvdLink)
+		f.verdict = strings.Title(strings.ToLower(severity)) + " severity"
+		products := cve.Products
+		if len(products) > 20 {
+			products = append(products[:20:20], fmt.Sprintf("and %d more", len(cve.Products)-20))
+		}
+		f.add("NVD", fmt.Sprintf("CVSS %v", cve.Score), nvdLink,
+			fmt.Sprintf("Published: %s\nVector: %s\nAffected Products: %s", cve.Published, cve.Vector, strings.Join(products, ", ")))
+		findings = append(findings, f)
+	}
+	// Custom matches are forwarded to the team webhook so we only mention them in verbose channels
+	if verbose {
+		for i := range reply.Custom {
+			c := &reply.Custom[i]
+			f := newFinding("Pattern match", c.Details, domain.ResultClean, messages.render(locale, "custom", msgArgs{"Indicator": c.Details, "Pattern": c.Pattern}), "")
+			f.verdict = "Forwarded"
+			if !c.Forwarded {
+				f.result, f.verdict, f.comment = domain.ResultUnknown, "Not forwarded", messages.render(locale, "custom_error", msgArgs{"Indicator": c.Details, "Pattern": c.Pattern, "Error": c.Error})
+			}
+			findings = append(findings, f)
+		}
+	}
+	// We will handle hashes only for verbose channels
+	if verbose {
+		for i := range reply.Hashes {
+			h := &reply.Hashes[i]
+			id := "hash_warning"
+			if h.Unsupported {
+				id = "hash_unsupported"
+			} else if h.Result == domain.ResultDirty {
+				id = "hash_bad"
+			} else if h.Result == domain.ResultClean {
+				id = "hash_good"
+			}
+			hashLink := details(h.Details)
+			f := newFinding("Hash", displayIndicator(reply, h.Details), h.Result, comment(id, displayIndicator(reply, h.Details), hashLink), hashLink)
+			if h.Unsupported {
+				f.verdict = "Unsupported"
+			}
+			f.addSources(h.Sources)
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// registeredNote warns about domains registered less than RDAP.YoungDays ago, empty for older domains or if we do not
+// know when they were registered
+func registeredNote(locale string, sources []domain.SourceResult, now time.Time) string {
+	for i := range sources {
+		registered := sources[i].Registered
+		if sources[i].Source != domain.SourceRDAP || registered.IsZero() {
+			continue
+		}
+		days := int(now.Sub(registered).Hours() / 24)
+		if days < 0 || days >= conf.Options.RDAP.YoungDays {
+			return ""
+		}
+		return messages.render(locale, "domain_young", msgArgs{"Days": days})
+	}
+	return ""
+}
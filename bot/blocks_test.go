@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+func TestReplyBlocks(t *testing.T) {
+	f := newFinding("URL", "http[://]evil[.]com", domain.ResultDirty, "Warning: URL (http[://]evil[.]com) is malicious.", "https://example.com/details")
+	f.add("VirusTotal", "5 / 70", "https://www.virustotal.com", "Scan Date: 2020-01-01")
+	f.add("IBM X-Force Exchange", "10", "", "")
+	full := replyBlocks("", []finding{f}, "", []string{"The message is too long so only its beginning was checked."}, true, "https://example.com/details")
+	types := func(blocks []slack.Block) string {
+		var t []string
+		for _, b := range blocks {
+			t = append(t, b["type"].(string))
+		}
+		return strings.Join(t, ",")
+	}
+	if got := types(full); got != "header,section,context,section,context,context" {
+		t.Errorf("unexpected full layout %s", got)
+	}
+	if text := full[0]["text"].(map[string]interface{})["text"].(string); !strings.Contains(text, "Malicious URL: http[://]evil[.]com") {
+		t.Errorf("expected the verdict and indicator in the header but got %s", text)
+	}
+	if full[1]["accessory"] == nil {
+		t.Error("expected a details button")
+	}
+	compact := replyBlocks("", []finding{f, f}, "", nil, false, "https://example.com/details")
+	if got := types(compact); got != "section,context,section,context,context" {
+		t.Errorf("unexpected compact layout %s", got)
+	}
+	// Too many findings for a single message
+	var many []finding
+	for i := 0; i < 30; i++ {
+		many = append(many, f)
+	}
+	blocks := replyBlocks("", many, "quote", nil, true, "https://example.com/details")
+	if len(blocks) > slack.MaxBlocks {
+		t.Errorf("expected at most %d blocks but got %d", slack.MaxBlocks, len(blocks))
+	}
+	if text := blocks[len(blocks)-2]["elements"].([]map[string]interface{})[0]["text"].(string); !strings.Contains(text, "more results") {
+		t.Errorf("expected a pointer to the rest of the results but got %s", text)
+	}
+}
+
+func TestWithShowDetails(t *testing.T) {
+	f := newFinding("IP", "1.2.3.4", domain.ResultDirty, "Warning: IP (1.2.3.4) is malicious.", "")
+	blocks := withShowDetails(replyBlocks("", []finding{f}, "", nil, false, ""), "abc")
+	actions := blocks[len(blocks)-2]
+	if actions["type"] != "actions" || blocks[len(blocks)-1]["type"] != "context" {
+		t.Fatalf("expected the button before the footer but got %v", blocks)
+	}
+	button := actions["elements"].([]map[string]interface{})[0]
+	if button["action_id"] != showDetailsAction || button["value"] != "abc" {
+		t.Errorf("unexpected button %v", button)
+	}
+}
+
+func TestReplyText(t *testing.T) {
+	dirty := newFinding("IP", "1.2.3.4", domain.ResultDirty, "Warning: IP (1.2.3.4) is malicious.", "")
+	cleanIP := newFinding("IP", "8.8.8.8", domain.ResultClean, "IP (8.8.8.8) is clean.", "")
+	if text := replyText([]finding{dirty}); text != dirty.comment {
+		t.Errorf("expected the comment of a single finding but got %s", text)
+	}
+	if text := replyText([]finding{dirty, cleanIP, cleanIP}); text != "Malicious: 1, Clean: 2." {
+		t.Errorf("unexpected summary %s", text)
+	}
+	if replyText(nil) == "" {
+		t.Error("expected a text even without findings")
+	}
+}
+
+func TestSetReply(t *testing.T) {
+	unknown := newFinding("URL", "http[://]example[.]com", domain.ResultUnknown, "URL is unknown.", "")
+	flagged := newFinding("URL", "http[://]evil[.]com", domain.ResultClean, "URL is clean.", "")
+	flagged.vt = 5
+	message := map[string]interface{}{}
+	setReply(message, replyBlocks("", []finding{unknown, flagged}, "", nil, false, ""), []finding{unknown, flagged}, &domain.Configuration{})
+	attachment := message["attachments"].([]map[string]interface{})[0]
+	if attachment["color"] != domain.SeverityDanger || attachment["fallback"] != message["text"] {
+		t.Errorf("expected a danger attachment with the fallback text but got %v", attachment)
+	}
+	setReply(message, nil, []finding{unknown, flagged}, &domain.Configuration{SeverityVTPositives: 10})
+	if color := message["attachments"].([]map[string]interface{})[0]["color"]; color != domain.SeverityWarning {
+		t.Errorf("expected a warning below the team threshold but got %v", color)
+	}
+}
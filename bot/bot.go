@@ -1,13 +1,18 @@
 package bot
 
 import (
+	"context"
+	"fmt"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
 	"github.com/demisto/alfred/queue"
 	"github.com/demisto/alfred/repo"
 	"github.com/demisto/alfred/slack"
@@ -18,32 +23,133 @@ import (
 type subscription struct {
 	team          *domain.Team          // the team we are subscribed to
 	configuration *domain.Configuration // The configuration of channels, mainly for verbose
+	webhook       *domain.Webhook       // Where we push the verdicts, nil if the team has no webhook
+	emails        *domain.EmailAlerts   // Who we email the verdicts to, nil if nobody
+	sandbox       *domain.Sandbox       // Runs the files no source knows, nil if the team has no sandbox
 	s             *slack.Client         // the slack client on the bot token
-	started       bool                  // did we start subscription for this guy
-	ts            time.Time             // When did we start the WS
+	patterns      []*regexp.Regexp      // compiled custom patterns of the team
+	botID         string                // the bot_id of our bot user, resolved when first needed
+	joined        map[string]bool       // public channels we know we are in, for the all public channels mode and the channel patterns
+	names         map[string]string     // channel names resolved with conversations.info, for the channel patterns
+	ts            time.Time             // When did we load the subscription
+	active        int64                 // UnixNano of the last time the team needed us, accessed atomically
+	lastEvent     int64                 // UnixNano of the last event Slack sent us for the team, accessed atomically
+}
+
+// touch marks the subscription as used now
+func (s *subscription) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+// eventSeen marks that Slack sent us an event for the team now
+func (s *subscription) eventSeen() {
+	atomic.StoreInt64(&s.lastEvent, time.Now().UnixNano())
+}
+
+// quietFor returns how long ago Slack last sent us an event for the team
+func (s *subscription) quietFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastEvent)))
+}
+
+// idleFor returns how long ago the team last needed us
+func (s *subscription) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.active)))
 }
 
 // Bot iterates on all subscriptions and listens / responds to messages
 type Bot struct {
-	stop          chan bool
-	r             *repo.MySQL
-	mu            sync.RWMutex // Guards the subscriptions
+	ctx           context.Context       // Done when the bot is stopped
+	cancel        context.CancelFunc    // Stops the bot
+	wg            sync.WaitGroup        // The Start loop, the monitors and the background posts that Stop waits for
+	dispatch      []chan slack.Response // Events waiting for each dispatch worker
+	dispatching   sync.WaitGroup        // The dispatch workers, Stop waits for them to drain the events
+	panics        int64                 // Panics recovered while handling events and replies, accessed atomically
+	r             repo.Repo
+	store         subscriptionStore // Loads single subscriptions, the repo in production
+	lmu           sync.Mutex        // Guards the subscription loads
+	loading       map[string]*loadCall
+	failedLoads   map[string]loadFailure
+	reloading     map[string]int // Changes waiting for the running reload of each team, guarded by lmu
+	mu            sync.RWMutex   // Guards the subscriptions
 	subscriptions map[string]*subscription
-	q             queue.Queue // Message queue for configuration updates
-	smu           sync.Mutex  // Guards the statistics
+	channelTeams  map[string]string // The team we are installed in for each channel we saw, for Slack Connect channels
+	q             queue.Queue       // Message queue for configuration updates
+	smu           sync.Mutex        // Guards the statistics
 	stats         map[string]*domain.Statistics
-	firstMessages map[string]bool
+	statsFailures map[string]int             // Consecutive ticks the statistics of a team failed to store, guarded by smu
+	statsActive   map[string]time.Time       // Last tick the statistics of a team had counters, guarded by smu
+	welcomed      *welcomedCache             // Users we know were welcomed, backed by the repo
+	dmu           sync.Mutex                 // Guards the scanned messages
+	scanned       map[string]*scannedMessage // Indicators already pushed per message so edits do not repeat them
+	cache         *verdictCache              // Recent verdicts so duplicates across channels are not looked up again
+	limiter       *rateLimiter               // Work requests per team so a noisy team does not starve the others
+	leases        map[string]bool            // The periodic jobs this instance holds the lease of, only used by the Start loop
+	lapsed        bool                       // The last heartbeat failed, only used by the Start loop
+	latencies     latencies                  // How long the replies of the last hour took per team
+	webhooks      *webhooks                  // Verdicts waiting for the team webhooks
+	mailer        *mailer                    // Email alerts waiting to be sent
+	syslog        *syslogForwarder           // CEF events waiting for the syslog server, nil if it is not configured
+	checkingStale int32                      // Set while the stale subscriptions are checked, accessed atomically
+	amu           sync.Mutex                 // Guards the workspace admins
+	admins        map[string]*workspaceAdmin // Recent users.info answers per team and user
+	digested      map[string]time.Time       // When we last posted the digest per team, only used by the Start loop
+	reported      map[string]time.Time       // When we last sent the weekly report per team, only used by the Start loop
+	sweeping      map[string]bool            // Teams we are joining all the public channels of, guarded by mu
+	pruned        time.Time                  // When we last deleted the expired stored replies, only used by the Start loop
+	prunedScans   time.Time                  // When we last deleted the expired scan history, only used by the Start loop
+	pending       pendingReplies             // The messages of the replies the worker still sends results for
+}
+
+// workspaceAdmin caches if a user is an admin or owner of the workspace
+type workspaceAdmin struct {
+	admin bool
+	ts    time.Time
+}
+
+// adminTTL is how long we trust users.info before asking again
+const adminTTL = 10 * time.Minute
+
+// scannedMessage holds the indicators we pushed for a message
+type scannedMessage struct {
+	keys map[string]bool
+	ts   time.Time
 }
 
+// scannedTTL is how long we remember the indicators of a message for edits
+const scannedTTL = 24 * time.Hour
+
 // New returns a new bot
-func New(r *repo.MySQL, q queue.Queue) (*Bot, error) {
+func New(r repo.Repo, q queue.Queue) (*Bot, error) {
+	forwarder, err := newSyslogForwarder(conf.Options.Syslog.Protocol, conf.Options.Syslog.Address, conf.Options.Syslog.Facility)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Bot{
-		stop:          make(chan bool, 1),
+		ctx:           ctx,
+		cancel:        cancel,
+		dispatch:      newDispatch(conf.Options.Dispatch.Workers, conf.Options.Dispatch.Queue),
 		r:             r,
+		store:         r,
+		loading:       make(map[string]*loadCall),
+		failedLoads:   make(map[string]loadFailure),
 		subscriptions: make(map[string]*subscription),
+		channelTeams:  make(map[string]string),
 		q:             q,
 		stats:         make(map[string]*domain.Statistics),
-		firstMessages: make(map[string]bool),
+		statsFailures: make(map[string]int),
+		statsActive:   make(map[string]time.Time),
+		welcomed:      newWelcomedCache(welcomedCacheSize),
+		scanned:       make(map[string]*scannedMessage),
+		admins:        make(map[string]*workspaceAdmin),
+		digested:      make(map[string]time.Time),
+		reported:      make(map[string]time.Time),
+		sweeping:      make(map[string]bool),
+		limiter:       newRateLimiter(conf.Options.Limits.WorkPerMinute),
+		cache:         newVerdictCache(conf.Options.Cache.Size, time.Duration(conf.Options.Cache.Window)*time.Minute),
+		webhooks:      newWebhooks(),
+		mailer:        newMailer(),
+		syslog:        forwarder,
 	}, nil
 }
 
@@ -56,110 +162,285 @@ func (b *Bot) loadSubscriptions() error {
 		return err
 	}
 	for i := range teams {
-		teamSub := &subscription{team: &teams[i]}
+		if !teams[i].Installed() {
+			continue
+		}
+		teamSub := &subscription{team: &teams[i], ts: time.Now()}
 		teamSub.configuration, err = b.r.ChannelsAndGroups(teams[i].ID)
 		if err != nil {
 			logrus.Warnf("Error loading team configuration - %v\n", err)
 			continue
 		}
-		teamSub.s = &slack.Client{Token: teams[i].BotToken}
+		teamSub.webhook, err = b.r.Webhook(teams[i].ID)
+		if err != nil {
+			logrus.Warnf("Error loading team webhook - %v\n", err)
+			continue
+		}
+		teamSub.emails, err = b.r.EmailAlerts(teams[i].ID)
+		if err != nil {
+			logrus.Warnf("Error loading team email alerts - %v\n", err)
+			continue
+		}
+		teamSub.sandbox, err = b.r.Sandbox(teams[i].ID)
+		if err != nil {
+			logrus.Warnf("Error loading team sandbox - %v\n", err)
+			continue
+		}
+		teamSub.patterns = compilePatterns(teamSub.configuration)
+		teamSub.s = &slack.Client{Token: teams[i].BotToken, Context: b.ctx}
+		teamSub.touch()
+		teamSub.eventSeen()
 		b.subscriptions[teams[i].ExternalID] = teamSub
+		if teamSub.configuration.AllPublicChannels || len(teamSub.configuration.ChannelPatterns) > 0 {
+			go b.joinPublicChannels(teams[i].ExternalID, teamSub)
+		}
 	}
 	return nil
 }
 
-func (b *Bot) loadSubscription(team string) (*subscription, error) {
-	t, err := b.r.TeamByExternalID(team)
+// compilePatterns compiles the custom patterns of the team skipping invalid ones
+func compilePatterns(configuration *domain.Configuration) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, p := range configuration.CustomPatterns {
+		if len(res) >= domain.MaxCustomPatterns {
+			logrus.Warnf("Too many custom patterns for team %s", configuration.Team)
+			break
+		}
+		re, err := domain.CompileCustomPattern(p)
+		if err != nil {
+			logrus.WithError(err).Warnf("Ignoring invalid custom pattern %s for team %s", p, configuration.Team)
+			continue
+		}
+		res = append(res, re)
+	}
+	return res
+}
+
+// fetchSubscription loads the team and its configuration from the repo, use loadSubscription
+func (b *Bot) fetchSubscription(team string) (*subscription, error) {
+	t, err := b.store.TeamByExternalID(team)
+	if err != nil {
+		return nil, err
+	}
+	if !t.Installed() {
+		return nil, errUninstalled
+	}
+	teamSub := &subscription{team: t, ts: time.Now()}
+	teamSub.configuration, err = b.store.ChannelsAndGroups(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	teamSub.webhook, err = b.store.Webhook(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	teamSub.emails, err = b.store.EmailAlerts(t.ID)
 	if err != nil {
 		return nil, err
 	}
-	teamSub := &subscription{team: t}
-	teamSub.configuration, err = b.r.ChannelsAndGroups(t.ID)
+	teamSub.sandbox, err = b.store.Sandbox(t.ID)
 	if err != nil {
 		return nil, err
 	}
-	teamSub.s = &slack.Client{Token: t.BotToken}
+	teamSub.patterns = compilePatterns(teamSub.configuration)
+	teamSub.s = &slack.Client{Token: t.BotToken, Context: b.ctx}
+	teamSub.touch()
+	// A fresh subscription gets a full period before we suspect it is stale
+	teamSub.eventSeen()
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	// A reload does not make the team active
+	if old, ok := b.subscriptions[team]; ok {
+		atomic.StoreInt64(&teamSub.active, atomic.LoadInt64(&old.active))
+	}
 	b.subscriptions[team] = teamSub
+	// The mode was probably just turned on, or we missed channels while it was off
+	if teamSub.configuration.AllPublicChannels || len(teamSub.configuration.ChannelPatterns) > 0 {
+		go b.joinPublicChannels(team, teamSub)
+	}
 	return teamSub, nil
 }
 
 var (
 	ipReg     = regexp.MustCompile("\\b\\d{1,3}\\.\\d{1,3}\\.\\d{1,3}\\.\\d{1,3}\\b")
+	cveReg    = regexp.MustCompile("(?i)\\bCVE-\\d{4}-\\d{4,7}\\b")
 	md5Reg    = regexp.MustCompile("\\b[a-fA-F\\d]{32}\\b")
 	sha1Reg   = regexp.MustCompile("\\b[a-fA-F\\d]{40}\\b")
 	sha256Reg = regexp.MustCompile("\\b[a-fA-F\\d]{64}\\b")
+	sha512Reg = regexp.MustCompile("\\b[a-fA-F\\d]{128}\\b")
+	btcReg    = regexp.MustCompile("\\b[13][1-9A-HJ-NP-Za-km-z]{25,34}\\b")
+	ethReg    = regexp.MustCompile("\\b0x[a-fA-F\\d]{40}\\b")
+	emailReg  = regexp.MustCompile("(?i)\\b[a-z0-9._%+-]+@(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\\.)+[a-z]{2,63}\\b")
 )
 
-func (b *Bot) HandleMessage(msg slack.Response) {
+// handleMessage does the real work for an event, called by the dispatch workers
+func (b *Bot) handleMessage(msg slack.Response) {
+	defer b.recoverEvent("event", msg)
 	if msg == nil {
 		return
 	}
-	team := msg.S("team_id")
-	if team == "" {
-		logrus.Warnf("got empty team in message %s", util.ToJSONString(msg))
+	outcome, teamID := "ignored", msg.S("team_id")
+	defer func() { messagesTotal.Inc(outcome, metrics.Team(teamID)) }()
+	if teamID == "" {
+		outcome = "no_team"
+		logrus.WithField("type", msg.S("event.type")).Warn("Got an event without a team")
+		if debugEnabled() {
+			logrus.Debugf("Event without a team - %s", util.ToJSONString(msg))
+		}
 		return
 	}
-	sub := b.relevantTeam(team)
+	team, sub := b.subscriptionForEvent(msg)
 	if sub == nil {
-		var err error
-		if sub, err = b.loadSubscription(team); err != nil {
-			logrus.WithError(err).Warnf("Error loading team configuration for new team - %v", team)
-			return
-		}
+		outcome = "unknown_team"
+		logrus.WithFields(logrus.Fields{"teams": eventTeams(msg), "channel": msg.S("event.channel")}).Warn("Error loading team configuration for new team")
+		return
 	}
+	sub.eventSeen()
 	msg = msg.R("event")
+	if msg.S("type") == "link_shared" {
+		msg = linkSharedMessage(msg)
+	}
 	msgType := msg.S("type")
 	switch msgType {
 	case "message":
-		msgUser := msg.S("user")
-		// If it's our message - no need to do anything
-		if msgUser == sub.team.BotUserID {
+		subtype := msg.S("subtype")
+		// Edits carry the full edited message under message
+		edited := subtype == "message_changed"
+		content := msg
+		if edited {
+			content = msg.R("message")
+			if content == nil || content.S("subtype") != "" {
+				return
+			}
+		}
+		msgUser := content.S("user")
+		// If it's our message or a user the team asked us to ignore - no need to do anything
+		if msgUser == sub.team.BotUserID || sub.configuration.IsIgnored(msgUser) {
 			return
 		}
-		text := msg.S("text")
+		// Other bots (SIEM alerts, etc.) are scanned only where the team asked for it and never our own
+		scanBot := subtype == "bot_message" && sub.configuration.ScansBotMessages(msg.S("channel")) &&
+			content.S("bot_id") != "" && content.S("bot_id") != b.ourBotID(sub)
+		text := content.S("text")
 		ltext := strings.ToLower(text)
 		channel := msg.S("channel")
+		// A channel we hear about that matches the patterns of the team is one we should be in
+		if len(sub.configuration.ChannelPatterns) > 0 && channel != "" && channel[0] == 'C' {
+			b.autoJoin(team, channel, "", sub)
+		}
+		// Users talk to us in channels with a mention, e.g. "@dbot scan 8.8.8.8", commands are not scanned
+		if subtype == "" && channel != "" && channel[0] != 'D' && msgUser != "" {
+			if rest, ok := stripMention(text, sub.team.BotUserID); ok && b.handleMention(team, rest, content, channel, sub) {
+				outcome = "mention"
+				return
+			}
+		}
+		// The first DM of a user gets a short introduction before we answer it
+		if subtype == "" && channel != "" && channel[0] == 'D' && msgUser != "" && content.S("bot_id") == "" {
+			b.welcomeUser(team, msgUser, channel, sub)
+		}
 		push := false
+		var found *indicators
+		attachment, quote := 0, ""
+		skipped, truncated := 0, false
 		// If this is an internal command to us we should not check hashes, etc.
-		if !(msg.S("subtype") == "" && channel != "" && channel[0] == 'D' &&
-			(strings.HasPrefix(ltext, "join ") || strings.HasPrefix(ltext, "verbose ") || ltext == "config" ||
-				text == "?" || strings.HasPrefix(ltext, "help") || strings.HasPrefix(ltext, "vt ") ||
-				strings.HasPrefix(ltext, "xfe "))) {
-			if msg.S("subtype") == "" {
-				push = strings.Contains(ltext, "<http") || ipReg.MatchString(text) || md5Reg.MatchString(text) || sha1Reg.MatchString(text) || sha256Reg.MatchString(text)
+		if !((subtype == "" || edited) && channel != "" && channel[0] == 'D' && findCommand(ltext) != nil) {
+			// /me messages and thread replies that are also sent to the channel have the text in the same place
+			if subtype == "" || subtype == "me_message" || subtype == "thread_broadcast" || subtype == "link_shared" || edited || scanBot {
+				var attachments []string
+				if !sub.configuration.DisableAttachments {
+					attachments = attachmentTexts(content)
+				}
+				// Code and quotes are usually examples and not something we should check unless the channel wants them
+				prepare := stripCode
+				if sub.configuration.ScansCode(channel) {
+					prepare = func(s string) string { return s }
+				}
+				var scanned string
+				scanned, truncated = truncateText(strings.Join(append([]string{text}, attachments...), "\n"), conf.Options.Limits.MessageSize)
+				found = findIndicators(sub, prepare(scanned))
+				push = found.found()
+				skipped = found.limit(conf.Options.Limits.Indicators)
+				// If the indicators are not in the text itself, find the attachment we should quote in the reply
+				if push && len(attachments) > 0 && !findIndicators(sub, prepare(text)).found() {
+					for i := range attachments {
+						if piece, _ := truncateText(attachments[i], conf.Options.Limits.MessageSize); findIndicators(sub, prepare(piece)).found() {
+							attachment, quote = i+1, attachments[i]
+							break
+						}
+					}
+				}
+				if found.skippedIPs > 0 || found.whitelisted > 0 || skipped > 0 || truncated {
+					b.countFiltered(team, sub, found, skipped > 0 || truncated)
+				}
+				// Only push what we did not already check for this message (edits, link unfurls)
+				if push {
+					push = b.dedup(channel+":"+content.S("ts"), found)
+				}
 			}
-			if msg.S("subtype") == "file_share" {
+			if subtype == "file_share" {
 				push = true
 			}
 		}
 		// If we need to handle the message, pass it to the queue
 		if push {
-			logrus.Debugf("Handling message - %+v\n", util.ToJSONString(msg))
-			workReq := domain.WorkRequestFromMessage(msg, sub.team.BotToken, sub.team.VTKey, sub.team.XFEKey, sub.team.XFEPass)
-			logrus.Debug("Pushing to queue")
-			ctx := &domain.Context{Team: team, User: msgUser, Type: msgType, Channel: channel, OriginalUser: msgUser}
+			workReq := domain.WorkRequestFromMessage(msg, sub.team.BotToken, sub.team.Credentials(), sub.configuration.SkippedSources(), sub.configuration.Scoring)
+			if found != nil {
+				found.apply(workReq, sub.configuration)
+			}
+			workReq.Quote = util.Substr(quote, 0, 300)
+			workReq.Skipped, workReq.Truncated = skipped, truncated
+			if workReq.Type == "file" {
+				workReq.Sandbox, workReq.ScanSettings = sub.sandbox, sub.configuration.ScanSettings()
+			}
+			ctx := &domain.Context{Team: team, User: msgUser, Type: msgType, Channel: channel, OriginalUser: msgUser, Attachment: attachment, TS: content.S("ts")}
+			if subtype == "thread_broadcast" {
+				ctx.ThreadTS = content.S("thread_ts")
+			}
+			if debugEnabled() {
+				contextLog(ctx).WithField("indicator_type", found.types()).Debug("Pushing to queue")
+				logrus.Debugf("Handling message - %s", util.ToJSONString(msg))
+			}
 			workReq.ReplyQueue, workReq.Context = util.Hostname, ctx
-			if err := b.q.PushWork(workReq); err != nil {
-				logrus.WithError(err).Warnf("Unable to push work request %s", util.ToJSONStringNoIndent(workReq))
+			if found != nil {
+				// Answer from the cache if we recently checked all of these for the team
+				if cached := b.cache.get(team, found); cached != nil {
+					ctx.Cached = true
+					cached.MessageID, cached.Context, cached.Original, cached.Quote = workReq.MessageID, ctx, workReq.Original, workReq.Quote
+					cached.Skipped, cached.Truncated = workReq.Skipped, workReq.Truncated
+					b.countCacheHits(team, sub, cached)
+					b.handleReply(cached)
+					outcome = "cached"
+					return
+				}
+			}
+			switch err := b.pushWork(team, sub, workReq); err {
+			case nil:
+				outcome = "pushed"
+			case errRateLimited:
+				outcome = "rate_limited"
+			default:
+				outcome = "push_failed"
+				contextLog(ctx).WithField("indicator_type", found.types()).WithError(err).Warn("Unable to push work request")
 			}
-		} else {
+		} else if !edited && subtype != "link_shared" {
 			// Handle some internal commands
 			if channel != "" && channel[0] == 'D' {
-				switch {
-				case strings.HasPrefix(text, "join "):
-					b.joinChannels(team, text, channel, sub)
-				case strings.HasPrefix(text, "verbose "):
-					b.handleVerbose(team, text, channel, sub) // Need the actual channel IDs
-				case text == "config":
-					b.handleConfig(team, msg, sub)
-				case text == "?" || strings.HasPrefix(text, "help"):
-					b.showHelp(team, channel)
-				case strings.HasPrefix(text, "vt "):
-					b.handleVT(team, text, channel, sub)
-				case strings.HasPrefix(text, "xfe "):
-					b.handleXFE(team, text, channel, sub)
+				if c := findCommand(ltext); c != nil {
+					commandsTotal.Inc(c.name, "dm")
+					if c.configures && !b.canConfigure(team, sub, msgUser) {
+						outcome = "refused"
+						b.refuseConfiguration(team, channel, sub)
+					} else if c.admins && !b.isWorkspaceAdmin(team, sub, msgUser) {
+						outcome = "refused"
+						b.refuseAdminCommand(team, channel, sub)
+					} else {
+						outcome = "command"
+						c.run(b, team, msg, sub)
+					}
+				} else if subtype == "" && content.S("bot_id") == "" && strings.TrimSpace(text) != "" && (found == nil || !found.found()) {
+					// Not a command and nothing to check - let the user know we are here and how to talk to us
+					b.handleUnknown(team, text, channel, sub)
 				}
 			}
 			b.smu.Lock()
@@ -169,23 +450,327 @@ func (b *Bot) HandleMessage(msg slack.Response) {
 				stats = &domain.Statistics{Team: sub.team.ID}
 				b.stats[team] = stats
 			}
-			stats.Messages++
+			stats.CountMessage(channel)
+		}
+	case "app_uninstalled", "tokens_revoked":
+		outcome = "uninstall"
+		b.handleUninstall(team, msg, sub)
+	case "channel_created", "member_joined_channel", "channel_archive", "channel_deleted", "group_archive", "group_deleted", "channel_rename", "group_rename":
+		outcome = "channel_event"
+		b.handleChannelEvent(team, msg, sub)
+	}
+}
+
+// changesConfiguration checks if the DM command changes the configuration of the whole team
+func changesConfiguration(ltext string) bool {
+	c := findCommand(ltext)
+	return c != nil && c.configures
+}
+
+// canConfigure checks if the user is allowed to change the configuration of the team.
+// Workspace admins and owners always can, other users only if they are listed as config admins.
+func (b *Bot) canConfigure(team string, sub *subscription, user string) bool {
+	return sub.team.IsConfigAdmin(user) || b.isWorkspaceAdmin(team, sub, user)
+}
+
+// isWorkspaceAdmin checks with Slack if the user is an admin or owner of the workspace, caching the answer for a while
+func (b *Bot) isWorkspaceAdmin(team string, sub *subscription, user string) bool {
+	key := team + ":" + user
+	b.amu.Lock()
+	cached, ok := b.admins[key]
+	b.amu.Unlock()
+	if ok && time.Since(cached.ts) < adminTTL {
+		return cached.admin
+	}
+	info, err := sub.s.Do("GET", "users.info", map[string]string{"user": user})
+	if err != nil {
+		contextLog(&domain.Context{Team: team, User: user}).WithError(err).Warn("Unable to check if the user is an admin")
+		return false
+	}
+	admin := info.B("user.is_admin") || info.B("user.is_owner")
+	b.amu.Lock()
+	if b.admins == nil {
+		b.admins = make(map[string]*workspaceAdmin)
+	}
+	b.admins[key] = &workspaceAdmin{admin: admin, ts: time.Now()}
+	b.amu.Unlock()
+	return admin
+}
+
+// linkSharedMessage turns a link_shared event into a message with the canonical URLs of the links.
+// It keeps the ts of the message the links were posted in so both share the dedup of that message
+// and whichever arrives second only pushes what the first did not.
+func linkSharedMessage(event slack.Response) slack.Response {
+	var urls []string
+	links, _ := event.Get("links").([]interface{})
+	for _, l := range links {
+		if link, ok := l.(map[string]interface{}); ok {
+			if u := slack.Response(link).S("url"); u != "" {
+				urls = append(urls, "<"+u+">")
+			}
+		}
+	}
+	return slack.Response{"type": "message", "subtype": "link_shared", "channel": event.S("channel"), "user": event.S("user"),
+		"ts": event.S("message_ts"), "text": strings.Join(urls, "\n")}
+}
+
+// ourBotID returns the bot_id of our bot user in the team
+func (b *Bot) ourBotID(sub *subscription) string {
+	b.mu.RLock()
+	botID := sub.botID
+	b.mu.RUnlock()
+	if botID != "" {
+		return botID
+	}
+	res, err := sub.s.Do("POST", "auth.test", nil)
+	if err != nil {
+		teamLog(sub.team.ExternalID, "").WithError(err).Warn("Unable to resolve our bot ID")
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub.botID = res.S("bot_id")
+	return sub.botID
+}
+
+// maxChannelTeams bounds the channel to team mapping, it is rebuilt from the events when cleared
+const maxChannelTeams = 10000
+
+// eventTeams returns the teams an event might belong to. In Slack Connect channels team_id can be the team
+// of the original poster while we are installed in another workspace so the authorizations come first.
+func eventTeams(msg slack.Response) []string {
+	var res []string
+	add := func(team string) {
+		if team != "" && !util.In(res, team) {
+			res = append(res, team)
+		}
+	}
+	if authorizations, ok := msg["authorizations"].([]interface{}); ok {
+		for _, a := range authorizations {
+			if authorization, ok := a.(map[string]interface{}); ok {
+				add(slack.Response(authorization).S("team_id"))
+			}
+		}
+	}
+	add(msg.S("team_id"))
+	add(msg.S("event.user_team"))
+	add(msg.S("event.team"))
+	return res
+}
+
+// subscriptionForEvent finds the team we are installed in for the event.
+// Teams we already know are preferred so events from the other side of a shared channel do not hit the repo.
+func (b *Bot) subscriptionForEvent(msg slack.Response) (string, *subscription) {
+	channel := msg.S("event.channel")
+	teams := eventTeams(msg)
+	b.mu.RLock()
+	if team, ok := b.channelTeams[channel]; ok {
+		teams = append([]string{team}, teams...)
+	}
+	b.mu.RUnlock()
+	for _, team := range teams {
+		if sub := b.relevantTeam(team); sub != nil {
+			b.rememberChannel(channel, team)
+			return team, sub
+		}
+	}
+	for _, team := range teams {
+		sub, err := b.loadSubscription(team)
+		if err == nil {
+			b.rememberChannel(channel, team)
+			return team, sub
+		}
+		teamLog(team, channel).WithError(err).Debug("Team of the event is not one of ours")
+	}
+	return "", nil
+}
+
+// setConfiguration stores the changed copy of the configuration of the team and swaps it in. The subscription is
+// replaced rather than changed so the replies that are running keep reading the configuration they started with.
+func (b *Bot) setConfiguration(sub *subscription, c *domain.Configuration) error {
+	if err := b.r.SetChannelsAndGroups(c); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if current, ok := b.subscriptions[sub.team.ExternalID]; ok && current == sub {
+		updated := &subscription{team: sub.team, configuration: c, webhook: sub.webhook, emails: sub.emails, sandbox: sub.sandbox, s: sub.s,
+			patterns: sub.patterns, botID: sub.botID, joined: sub.joined, names: sub.names, ts: sub.ts,
+			active: atomic.LoadInt64(&sub.active), lastEvent: atomic.LoadInt64(&sub.lastEvent)}
+		b.subscriptions[sub.team.ExternalID] = updated
+	}
+	return nil
+}
+
+// rememberChannel records the team we are installed in for the channel
+func (b *Bot) rememberChannel(channel, team string) {
+	if channel == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.channelTeams[channel] == team {
+		return
+	}
+	if len(b.channelTeams) >= maxChannelTeams {
+		b.channelTeams = make(map[string]string)
+	}
+	b.channelTeams[channel] = team
+}
+
+// countFiltered adds the indicators we did not push to the team statistics
+func (b *Bot) countFiltered(team string, sub *subscription, found *indicators, limited bool) {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	stats, ok := b.stats[team]
+	if !ok {
+		stats = &domain.Statistics{Team: sub.team.ID}
+		b.stats[team] = stats
+	}
+	stats.IPsSkipped += int64(found.skippedIPs)
+	stats.Whitelisted += int64(found.whitelisted)
+	if limited {
+		stats.Truncated++
+	}
+}
+
+// dedup removes the indicators already pushed for the message and remembers the rest.
+// Returns false if there is nothing new to push.
+func (b *Bot) dedup(key string, found *indicators) bool {
+	b.dmu.Lock()
+	defer b.dmu.Unlock()
+	scanned, ok := b.scanned[key]
+	if !ok {
+		scanned = &scannedMessage{keys: make(map[string]bool), ts: time.Now()}
+		b.scanned[key] = scanned
+	}
+	found.removeSeen(scanned.keys)
+	if !found.found() {
+		return false
+	}
+	for _, k := range found.keys() {
+		scanned.keys[k] = true
+	}
+	return true
+}
+
+// expireScanned forgets messages that are too old to be edited in a meaningful way
+func (b *Bot) expireScanned() {
+	b.dmu.Lock()
+	defer b.dmu.Unlock()
+	for k, v := range b.scanned {
+		if time.Since(v.ts) > scannedTTL {
+			delete(b.scanned, k)
 		}
 	}
 }
 
+// countCacheHits adds the indicators answered from the cache to the team statistics
+func (b *Bot) countCacheHits(team string, sub *subscription, reply *domain.WorkReply) {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	stats, ok := b.stats[team]
+	if !ok {
+		stats = &domain.Statistics{Team: sub.team.ID}
+		b.stats[team] = stats
+	}
+	stats.CacheHits += int64(len(reply.URLs) + len(reply.Domains) + len(reply.Emails) + len(reply.IPs) + len(reply.CVEs) + len(reply.Hashes) + len(reply.Wallets))
+}
+
+// statisticsStore persists the statistics of a team, the repo in production
+type statisticsStore interface {
+	UpdateStatistics(stats *domain.Statistics) error
+}
+
+// maxStatisticsRetries is how many ticks we keep the counters of a team we fail to store before dropping them
+const maxStatisticsRetries = 10
+
 func (b *Bot) storeStatistics() {
+	b.flushStatistics(b.r)
+}
+
+// flushStatistics tries to store the statistics of every team. Counters that failed are kept and added to
+// until the next tick, and dropped after maxStatisticsRetries consecutive failures.
+func (b *Bot) flushStatistics(store statisticsStore) {
 	b.smu.Lock()
 	defer b.smu.Unlock()
-	for _, v := range b.stats {
-		err := b.r.UpdateStatistics(v)
+	if b.statsFailures == nil {
+		b.statsFailures = make(map[string]int)
+	}
+	if b.statsActive == nil {
+		b.statsActive = make(map[string]time.Time)
+	}
+	now := time.Now()
+	var failed []string
+	for k, v := range b.stats {
+		if v.HasSomething() {
+			b.statsActive[k] = now
+		}
+		err := store.UpdateStatistics(v)
 		if err == nil {
 			v.Reset()
-		} else {
-			logrus.Warnf("Unable to store statistics - %v\n", err)
-			return
+			delete(b.statsFailures, k)
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", k, err))
+		b.statsFailures[k]++
+		if b.statsFailures[k] >= maxStatisticsRetries {
+			logrus.Errorf("Dropping statistics of team %s after %d failures\n", k, b.statsFailures[k])
+			v.Reset()
+			delete(b.statsFailures, k)
+		}
+	}
+	if len(failed) > 0 {
+		logrus.Warnf("Unable to store statistics of %d out of %d teams - %s\n", len(failed), len(b.stats), strings.Join(failed, "; "))
+	}
+}
+
+// statsTTL is how long we keep the empty statistics entry of a quiet team
+const statsTTL = time.Hour
+
+// sweepStatistics removes the entries of teams that had no counters for statsTTL. Entries still holding
+// counters the repo refused are kept for the retries.
+func (b *Bot) sweepStatistics() {
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	for k, v := range b.stats {
+		if !v.HasSomething() && time.Since(b.statsActive[k]) > statsTTL {
+			delete(b.stats, k)
+			delete(b.statsActive, k)
+			delete(b.statsFailures, k)
+		}
+	}
+}
+
+// sweepSubscriptions drops the subscriptions of teams that did not need us for the idle period.
+// They are loaded again with the next message of the team.
+func (b *Bot) sweepSubscriptions(idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	var candidates []string
+	b.mu.RLock()
+	for k, sub := range b.subscriptions {
+		if !b.sweeping[k] && sub.idleFor() > idle {
+			candidates = append(candidates, k)
+		}
+	}
+	b.mu.RUnlock()
+	if len(candidates) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dropped := 0
+	for _, k := range candidates {
+		// The team might have been active since we looked
+		if sub, ok := b.subscriptions[k]; ok && sub.idleFor() > idle {
+			delete(b.subscriptions, k)
+			b.limiter.forget(k)
+			dropped++
 		}
 	}
+	logrus.Debugf("Dropped %d idle subscriptions", dropped)
 }
 
 // Start the monitoring process - will start a separate Go routine
@@ -198,52 +783,121 @@ func (b *Bot) Start() error {
 	if err != nil {
 		return err
 	}
-	go b.monitorChanges()
-	go b.monitorReplies()
+	b.wg.Add(1)
+	defer b.wg.Done()
+	b.startMonitors()
+	b.startDispatch()
+	b.startWebhooks()
+	b.startEmails()
+	b.startSyslog()
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-b.stop:
+		case <-b.ctx.Done():
+			// Flush the counters of the last minute including the events the workers drained
+			b.dispatching.Wait()
+			b.storeStatistics()
+			b.releaseLeases(b.r)
 			return nil
 		case <-ticker.C:
-			err := b.r.BotHeartbeat()
-			if err != nil {
-				logrus.Errorf("Unable to update heartbeat - %v\n", err)
-			}
+			b.heartbeat(b.r)
 			b.storeStatistics()
+			b.sweepStatistics()
+			b.sweepSubscriptions(time.Duration(conf.Options.SubscriptionIdle) * time.Minute)
+			b.expireScanned()
+			b.mailer.expire(time.Now())
+			b.expireFailedLoads()
+			b.checkStaleSubscriptions(time.Duration(conf.Options.StaleSubscription) * time.Minute)
+			b.collectQueueLanes()
+			// Only one instance sends the reports and cleans the DB
+			b.runLeased(b.r, "digests", b.sendDigests)
+			b.runLeased(b.r, "weekly_reports", b.sendWeeklyReports)
+			b.runLeased(b.r, "stored_replies", b.expireStoredReplies)
+			b.runLeased(b.r, "scan_history", b.expireScanHistory)
+			b.runLeased(b.r, "reply_queues", func() { b.cleanReplyQueues(b.r) })
 		}
 	}
 }
 
-// Stop the monitoring process
+// stopTimeout is how long Stop waits for the Start loop, the monitors and the dispatch workers to finish
+const stopTimeout = 10 * time.Second
+
+// Stop the monitoring process and wait for the Start loop, the monitors and the dispatch workers to finish
 func (b *Bot) Stop() {
-	b.stop <- true
+	b.cancel()
+	done := make(chan struct{})
+	go func() {
+		b.dispatching.Wait()
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		logrus.Warnf("The bot did not stop within %v", stopTimeout)
+	}
+}
+
+// startMonitors of the configuration changes and the work replies. They return when the bot is stopped.
+func (b *Bot) startMonitors() {
+	b.wg.Add(2)
+	go func() {
+		defer b.wg.Done()
+		b.monitorChanges(b.ctx)
+	}()
+	go func() {
+		defer b.wg.Done()
+		b.monitorReplies(b.ctx)
+	}()
 }
 
-// subscriptionChanged updates the subscriptions if a user changes them
-func (b *Bot) subscriptionChanged(team string) {
+// dropSubscription removes the subscription of the team, it will be loaded again when needed
+func (b *Bot) dropSubscription(team string) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	// Remove the subscription, it will be reloaded when needed
 	delete(b.subscriptions, team)
+	b.mu.Unlock()
+	b.limiter.forget(team)
+	b.lmu.Lock()
+	delete(b.failedLoads, team)
+	b.lmu.Unlock()
+}
+
+// handleUninstall deactivates the team when it uninstalls us or revokes the bot token so we stop using a dead token.
+// Revoked user tokens alone do not stop the bot.
+func (b *Bot) handleUninstall(team string, msg slack.Response, sub *subscription) {
+	if msg.S("type") == "tokens_revoked" {
+		if bots, _ := msg.Get("tokens.bot").([]interface{}); len(bots) == 0 {
+			teamLog(team, "").Info("User tokens revoked")
+			return
+		}
+	}
+	teamLog(team, "").WithFields(logrus.Fields{"name": sub.team.Name, "type": msg.S("type")}).Info("Team uninstalled us")
+	if err := b.r.SetTeamStatus(sub.team.ID, domain.UserStatusInactive); err != nil {
+		teamLog(team, "").WithError(err).Warn("Unable to deactivate team")
+	}
+	b.dropSubscription(team)
+	// Let the other instances drop the team as well
+	if err := b.q.PushConf(team); err != nil {
+		teamLog(team, "").WithError(err).Warn("Error pushing configuration message")
+	}
 }
 
-func (b *Bot) monitorChanges() {
+func (b *Bot) monitorChanges(ctx context.Context) {
 	for {
-		team, err := b.q.PopConf(0)
+		team, err := b.q.PopConf(ctx)
 		if err != nil || team == "" {
 			logrus.WithError(err).Info("Quiting monitoring changes")
 			break
 		}
-		logrus.Debugf("Configuration change received for team: [%s]", team)
+		teamLog(team, "").Debug("Configuration change received")
 		b.subscriptionChanged(team)
 	}
 }
 
-func (b *Bot) monitorReplies() {
+func (b *Bot) monitorReplies(ctx context.Context) {
 	for {
-		reply, err := b.q.PopWorkReply(util.Hostname, 0)
+		reply, err := b.q.PopWorkReply(ctx, util.Hostname)
 		if err != nil || reply == nil {
 			logrus.Infof("Quiting monitoring replies - %v\n", err)
 			break
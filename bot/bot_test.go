@@ -0,0 +1,392 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/queue"
+	"github.com/demisto/alfred/slack"
+	"github.com/demisto/alfred/util"
+)
+
+func sharedChannelBot() *Bot {
+	b := &Bot{subscriptions: make(map[string]*subscription), channelTeams: make(map[string]string)}
+	b.subscriptions["T1"] = &subscription{team: &domain.Team{ExternalID: "T1"}}
+	return b
+}
+
+func TestEventTeams(t *testing.T) {
+	msg := slack.Response{
+		"team_id":        "T2",
+		"authorizations": []interface{}{map[string]interface{}{"team_id": "T1"}},
+		"event":          map[string]interface{}{"user_team": "T2", "team": "T3"},
+	}
+	teams := eventTeams(msg)
+	if len(teams) != 3 || teams[0] != "T1" || teams[1] != "T2" || teams[2] != "T3" {
+		t.Errorf("unexpected teams %v", teams)
+	}
+}
+
+func TestSubscriptionForEventSharedChannel(t *testing.T) {
+	b := sharedChannelBot()
+	// A message posted by a user of the other workspace into a channel shared with us
+	team, sub := b.subscriptionForEvent(slack.Response{
+		"team_id":        "T2",
+		"authorizations": []interface{}{map[string]interface{}{"team_id": "T1"}},
+		"event":          map[string]interface{}{"channel": "C1", "user_team": "T2"},
+	})
+	if team != "T1" || sub == nil {
+		t.Fatalf("expected our team but got %s", team)
+	}
+	if b.channelTeams["C1"] != "T1" {
+		t.Errorf("expected the channel to be mapped to our team but got %v", b.channelTeams)
+	}
+	// Our user posting in a channel hosted by the other workspace
+	team, sub = b.subscriptionForEvent(slack.Response{
+		"team_id": "T1",
+		"event":   map[string]interface{}{"channel": "C2", "user_team": "T1", "team": "T2"},
+	})
+	if team != "T1" || sub == nil {
+		t.Fatalf("expected our team but got %s", team)
+	}
+	// Only the channel tells us who we are
+	team, sub = b.subscriptionForEvent(slack.Response{"team_id": "T2", "event": map[string]interface{}{"channel": "C1"}})
+	if team != "T1" || sub == nil {
+		t.Errorf("expected the cached channel team but got %s", team)
+	}
+}
+
+// testQueue is the in-memory queue the bot and the worker of the tests share
+func testQueue() queue.Queue {
+	return queue.NewMemoryQueue(0)
+}
+
+// pushedWork pops the work pushed to the queue so far with the indicators unbatched like the workers do
+func pushedWork(q queue.Queue) []*domain.WorkRequest {
+	var work []*domain.WorkRequest
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		w, err := q.PopWork(ctx)
+		cancel()
+		if err != nil {
+			return work
+		}
+		w.Unbatch()
+		work = append(work, w)
+	}
+}
+
+// pushedReplies pops the replies pushed to the bot of this host so far
+func pushedReplies(q queue.Queue) []*domain.WorkReply {
+	var replies []*domain.WorkReply
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		r, err := q.PopWorkReply(ctx, util.Hostname)
+		cancel()
+		if err != nil {
+			return replies
+		}
+		replies = append(replies, r)
+	}
+}
+
+// queueBot returns a bot of a single team that pushes its work to the queue
+func queueBot(q queue.Queue) *Bot {
+	b := &Bot{q: q, subscriptions: make(map[string]*subscription), channelTeams: make(map[string]string),
+		scanned: make(map[string]*scannedMessage), stats: make(map[string]*domain.Statistics), webhooks: newWebhooks(), mailer: newMailer()}
+	b.subscriptions["T1"] = &subscription{team: &domain.Team{ID: "1", ExternalID: "T1", BotUserID: "UBOT"}, configuration: &domain.Configuration{}}
+	// Our test user was already welcomed so DMs do not need the repo
+	b.welcomed = newWelcomedCache(welcomedCacheSize)
+	b.welcomed.add(welcomedKey("1", "U1"))
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return b
+}
+
+func TestStopWaitsForMonitors(t *testing.T) {
+	b := queueBot(testQueue())
+	b.startMonitors()
+	stopped := make(chan struct{})
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(stopTimeout / 2):
+		t.Fatal("Stop did not return after the monitors finished")
+	}
+}
+
+// fakeStatisticsStore fails for the given teams and records what it stored for the others
+type fakeStatisticsStore struct {
+	fail   map[string]bool
+	stored map[string]int64
+}
+
+func (f *fakeStatisticsStore) UpdateStatistics(stats *domain.Statistics) error {
+	if f.fail[stats.Team] {
+		return errors.New("store failed")
+	}
+	f.stored[stats.Team] += stats.Messages
+	return nil
+}
+
+func TestFlushStatistics(t *testing.T) {
+	b := queueBot(testQueue())
+	for _, team := range []string{"A", "B", "C"} {
+		b.stats["T"+team] = &domain.Statistics{Team: team, Messages: 3}
+	}
+	store := &fakeStatisticsStore{fail: map[string]bool{"A": true}, stored: make(map[string]int64)}
+	b.flushStatistics(store)
+	if store.stored["B"] != 3 || store.stored["C"] != 3 {
+		t.Errorf("other teams were not flushed - %v", store.stored)
+	}
+	if b.stats["TA"].Messages != 3 || b.stats["TB"].Messages != 0 {
+		t.Errorf("failed counters should be kept and stored ones reset - %d, %d", b.stats["TA"].Messages, b.stats["TB"].Messages)
+	}
+	// Recovers on the next tick with what accumulated meanwhile
+	b.stats["TA"].Messages++
+	store.fail["A"] = false
+	b.flushStatistics(store)
+	if store.stored["A"] != 4 || b.statsFailures["TA"] != 0 {
+		t.Errorf("expected the kept counters to be stored - %v, %d failures", store.stored, b.statsFailures["TA"])
+	}
+}
+
+func TestFlushStatisticsDropsAfterRetries(t *testing.T) {
+	b := queueBot(testQueue())
+	b.stats["TA"] = &domain.Statistics{Team: "A", Messages: 3}
+	store := &fakeStatisticsStore{fail: map[string]bool{"A": true}, stored: make(map[string]int64)}
+	for i := 1; i < maxStatisticsRetries; i++ {
+		b.flushStatistics(store)
+	}
+	if b.stats["TA"].Messages != 3 {
+		t.Fatal("counters dropped before reaching the retry cap")
+	}
+	b.flushStatistics(store)
+	if b.stats["TA"].Messages != 0 || b.statsFailures["TA"] != 0 {
+		t.Errorf("counters should be dropped after %d failures", maxStatisticsRetries)
+	}
+}
+
+func TestSweepStatistics(t *testing.T) {
+	b := queueBot(testQueue())
+	b.stats["TA"] = &domain.Statistics{Team: "A", Messages: 1}
+	b.stats["TB"] = &domain.Statistics{Team: "B", Messages: 1}
+	store := &fakeStatisticsStore{fail: map[string]bool{"B": true}, stored: make(map[string]int64)}
+	b.flushStatistics(store)
+	b.statsActive["TA"] = time.Now().Add(-2 * statsTTL)
+	b.statsActive["TB"] = time.Now().Add(-2 * statsTTL)
+	b.sweepStatistics()
+	if _, ok := b.stats["TA"]; ok {
+		t.Error("the empty entry of a quiet team should be removed")
+	}
+	if _, ok := b.stats["TB"]; !ok {
+		t.Error("an entry with counters waiting for a retry should be kept")
+	}
+}
+
+func TestSweepSubscriptions(t *testing.T) {
+	b := queueBot(testQueue())
+	b.sweeping = make(map[string]bool)
+	b.subscriptions["T2"] = &subscription{team: &domain.Team{ID: "2", ExternalID: "T2"}}
+	b.relevantTeam("T2")
+	b.sweepSubscriptions(time.Hour)
+	if b.relevantTeam("T1") != nil {
+		t.Error("the idle subscription should be dropped")
+	}
+	if b.relevantTeam("T2") == nil {
+		t.Error("the active subscription should be kept")
+	}
+	b.sweepSubscriptions(0)
+	if b.relevantTeam("T2") == nil {
+		t.Error("a zero idle period should keep the subscriptions")
+	}
+}
+
+// event wraps the raw event JSON the way the events API delivers it
+func event(t *testing.T, raw string) slack.Response {
+	msg := slack.Response{}
+	if err := json.Unmarshal([]byte(`{"team_id":"T1","event":`+raw+`}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestHandleMessageSubtypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    string
+		pushed   bool
+		text     string
+		ts       string
+		threadTS string
+	}{
+		{"message", `{"type":"message","channel":"C1","user":"U1","text":"check 8.8.8.8","ts":"1.1"}`, true, "check 8.8.8.8", "1.1", ""},
+		{"me_message", `{"type":"message","subtype":"me_message","channel":"C1","user":"U1","text":"is checking 8.8.8.8","ts":"1.2"}`, true, "is checking 8.8.8.8", "1.2", ""},
+		{"thread_broadcast", `{"type":"message","subtype":"thread_broadcast","channel":"C1","user":"U1","text":"see 8.8.8.8","ts":"1.4","thread_ts":"1.3"}`, true, "see 8.8.8.8", "1.4", "1.3"},
+		{"message_changed", `{"type":"message","subtype":"message_changed","channel":"C1","message":{"user":"U1","text":"now 8.8.8.8","ts":"1.5"}}`, true, "now 8.8.8.8", "1.5", ""},
+		{"channel_join", `{"type":"message","subtype":"channel_join","channel":"C1","user":"U1","text":"<@U1> has joined 8.8.8.8","ts":"1.6"}`, false, "", "", ""},
+		{"our own message", `{"type":"message","channel":"C1","user":"UBOT","text":"8.8.8.8","ts":"1.7"}`, false, "", "", ""},
+	}
+	for _, test := range tests {
+		q := testQueue()
+		b := queueBot(q)
+		b.handleMessage(event(t, test.event))
+		work := pushedWork(q)
+		if !test.pushed {
+			if len(work) != 0 {
+				t.Errorf("%s: expected nothing pushed but got %d", test.name, len(work))
+			}
+			continue
+		}
+		if len(work) != 1 {
+			t.Errorf("%s: expected a single work request but got %d", test.name, len(work))
+			continue
+		}
+		w := work[0]
+		if w.Text != test.text || len(w.IPs) != 1 || w.IPs[0] != "8.8.8.8" {
+			t.Errorf("%s: unexpected request %s %v", test.name, w.Text, w.IPs)
+		}
+		ctx := w.Context.(*domain.Context)
+		if ctx.Channel != "C1" || ctx.TS != test.ts || ctx.ThreadTS != test.threadTS {
+			t.Errorf("%s: unexpected context %+v", test.name, ctx)
+		}
+	}
+}
+
+func TestHandleLinkShared(t *testing.T) {
+	message := `{"type":"message","channel":"C1","user":"U1","text":"look <https://evil.com/a> and 8.8.8.8","ts":"1.1"}`
+	link := `{"type":"link_shared","channel":"C1","user":"U1","message_ts":"1.1","links":[{"domain":"evil.com","url":"https://evil.com/a"}]}`
+	for _, order := range [][]string{{message, link}, {link, message}} {
+		q := testQueue()
+		b := queueBot(q)
+		for _, raw := range order {
+			b.handleMessage(event(t, raw))
+		}
+		var urls, ips []string
+		for _, w := range pushedWork(q) {
+			if w.MessageID != "1.1" {
+				t.Errorf("unexpected message ID %s", w.MessageID)
+			}
+			urls, ips = append(urls, w.URLs...), append(ips, w.IPs...)
+		}
+		if len(urls) != 1 || urls[0] != "https://evil.com/a" || len(ips) != 1 {
+			t.Errorf("expected the URL and IP to be pushed once but got %v and %v", urls, ips)
+		}
+	}
+	// Links in a message we did not see are pushed on their own
+	q := testQueue()
+	queueBot(q).handleMessage(event(t, `{"type":"link_shared","channel":"C1","user":"U1","message_ts":"1.2","links":[{"url":"https://evil.com/b"}]}`))
+	if work := pushedWork(q); len(work) != 1 || len(work[0].URLs) != 1 || work[0].URLs[0] != "https://evil.com/b" {
+		t.Errorf("expected the link to be pushed but got %+v", work)
+	}
+}
+
+func TestHandleScan(t *testing.T) {
+	q := testQueue()
+	queueBot(q).handleMessage(event(t, "{\"type\":\"message\",\"channel\":\"D1\",\"user\":\"U1\",\"text\":\"scan 8.8.8.8 and ```1.1.1.1 https://evil.com/a```\",\"ts\":\"1.1\"}"))
+	work := pushedWork(q)
+	if len(work) != 1 {
+		t.Fatalf("expected a single work request but got %d", len(work))
+	}
+	w := work[0]
+	if len(w.IPs) != 2 || len(w.URLs) != 1 || w.URLs[0] != "https://evil.com/a" {
+		t.Errorf("unexpected indicators %v %v", w.IPs, w.URLs)
+	}
+	if ctx := w.Context.(*domain.Context); ctx.Channel != "D1" {
+		t.Errorf("expected the reply to go to the DM but got %s", ctx.Channel)
+	}
+}
+
+func TestHandleMentionScan(t *testing.T) {
+	q := testQueue()
+	queueBot(q).handleMessage(event(t, `{"type":"message","channel":"C1","user":"U1","text":"<@UBOT> scan 8.8.8.8","ts":"1.1"}`))
+	// The command is run once and the message itself is not scanned again
+	work := pushedWork(q)
+	if len(work) != 1 || len(work[0].IPs) != 1 {
+		t.Fatalf("expected a single scan request but got %+v", work)
+	}
+	if ctx := work[0].Context.(*domain.Context); ctx.Channel != "C1" || ctx.ThreadTS != "1.1" || !ctx.Mention {
+		t.Errorf("expected the reply in the thread of the mention but got %+v", ctx)
+	}
+}
+
+func TestChangesConfiguration(t *testing.T) {
+	for text, expected := range map[string]bool{
+		"join all": true, "leave #general": true, "verbose on #general": true, "whitelist add example.com": true,
+		"whitelist list": false, "ignore list": false, "mute #general 2h": true, "config mode reaction #general": true,
+		"config": false, "status": false, "stats": false, "scan 8.8.8.8": false, "vt key": false, "xfe key pass": false, "help": false,
+	} {
+		if changesConfiguration(text) != expected {
+			t.Errorf("changesConfiguration(%s) expected %v", text, expected)
+		}
+	}
+}
+
+func TestCanConfigure(t *testing.T) {
+	b := queueBot(testQueue())
+	sub := b.subscriptions["T1"]
+	sub.team.ConfigAdmins = []string{"U1"}
+	if !b.canConfigure("T1", sub, "U1") {
+		t.Error("expected a config admin to be allowed")
+	}
+	// Answers of users.info are cached
+	b.admins = map[string]*workspaceAdmin{"T1:U2": {admin: true, ts: time.Now()}, "T1:U3": {admin: false, ts: time.Now()}}
+	if !b.canConfigure("T1", sub, "U2") || b.canConfigure("T1", sub, "U3") {
+		t.Error("expected the cached admin state to be used")
+	}
+}
+
+func TestHandleChannelEvent(t *testing.T) {
+	b := queueBot(testQueue())
+	sub := b.subscriptions["T1"]
+	b.handleMessage(event(t, `{"type":"member_joined_channel","channel":"C5","channel_type":"C","user":"UBOT"}`))
+	if !sub.joined["C5"] {
+		t.Errorf("expected our own join to be remembered but got %v", sub.joined)
+	}
+	// Not in all public channels mode - nothing to join so no Slack calls
+	b.handleMessage(event(t, `{"type":"channel_created","channel":{"id":"C6","name":"new"}}`))
+	if sub.joined["C6"] {
+		t.Errorf("did not expect to join without all public channels mode")
+	}
+	b.handleMessage(event(t, `{"type":"channel_rename","channel":{"id":"C5","name":"renamed"}}`))
+	if sub.names["C5"] != "renamed" {
+		t.Errorf("expected the new name but got %v", sub.names)
+	}
+	// Nothing configured for the channel - only our own state is forgotten
+	b.handleMessage(event(t, `{"type":"channel_archive","channel":"C5","user":"U1"}`))
+	if sub.joined["C5"] || sub.names["C5"] != "" {
+		t.Errorf("expected the archived channel to be forgotten but got %v %v", sub.joined, sub.names)
+	}
+}
+
+func BenchmarkHandleMessage(b *testing.B) {
+	logrus.SetLevel(logrus.InfoLevel)
+	q := testQueue()
+	bot := queueBot(q)
+	raw := `{"type":"message","channel":"C1","user":"U1","ts":"1.1","text":"Seeing beacons to <http://evil.example.com/gate.php?id=1|evil.example.com/gate.php> from 8.8.8.8, ` +
+		`dropper 44d88612fea8a8f36de82e1f9a1d2f9e - see <https://blog.example.org/writeup|the writeup> for details",` +
+		`"blocks":[{"type":"rich_text","elements":[{"type":"rich_text_section","elements":[{"type":"text","text":"Seeing beacons"}]}]}]}`
+	msg := slack.Response{}
+	if err := json.Unmarshal([]byte(`{"team_id":"T1","event":`+raw+`}`), &msg); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bot.handleMessage(msg)
+		b.StopTimer()
+		if len(pushedWork(q)) != 1 {
+			b.Fatal("expected the message to be pushed")
+		}
+		// Forget the message so the next round pushes it again
+		bot.scanned = make(map[string]*scannedMessage)
+		b.StartTimer()
+	}
+}
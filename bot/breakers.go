@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// sourceBreakerStore loads the breakers the workers stored when their sources tripped
+type sourceBreakerStore interface {
+	SourceBreakers(since time.Time) ([]domain.SourceBreaker, error)
+}
+
+// teamBreakers are the breakers that affect the team sorted by the source. With several workers the breaker is the
+// one retried last.
+func teamBreakers(store sourceBreakerStore, team *domain.Team, now time.Time) ([]domain.SourceBreaker, error) {
+	// A probe takes up to the timeout of a scan so the breaker it retries still counts while it runs
+	grace := 2 * time.Duration(conf.Options.Sources.Timeout) * time.Second
+	all, err := store.SourceBreakers(now.Add(-grace))
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]domain.SourceBreaker)
+	for _, br := range domain.TeamBreakers(all, team) {
+		if cur, ok := latest[br.Breaker]; !ok || br.OpenUntil.After(cur.OpenUntil) {
+			latest[br.Breaker] = br
+		}
+	}
+	var res []domain.SourceBreaker
+	for _, br := range latest {
+		if !now.Before(br.OpenUntil) {
+			br.State = domain.BreakerHalfOpen
+		}
+		res = append(res, br)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Source != res[j].Source {
+			return res[i].Source < res[j].Source
+		}
+		return res[i].Breaker < res[j].Breaker
+	})
+	return res, nil
+}
+
+// SourceBreakers returns the breakers of the sources we do not check the indicators of the team with right now
+func (b *Bot) SourceBreakers(team *domain.Team) ([]domain.SourceBreaker, error) {
+	return teamBreakers(b.r, team, time.Now())
+}
+
+// breakersText tells the users which sources are missing from the replies and why
+func breakersText(breakers []domain.SourceBreaker, now time.Time) string {
+	if len(breakers) == 0 {
+		return "All sources are available"
+	}
+	var lines []string
+	for _, br := range breakers {
+		when := "retrying now"
+		if br.State == domain.BreakerOpen {
+			when = fmt.Sprintf("retrying in %v", br.OpenUntil.Sub(now).Round(time.Second))
+		}
+		lines = append(lines, fmt.Sprintf("%s unavailable, %s - %s", scannerTitle(br.Source), when, br.Error))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// fakeSourceBreakers are the breakers stored by the workers
+type fakeSourceBreakers []domain.SourceBreaker
+
+func (f fakeSourceBreakers) SourceBreakers(since time.Time) ([]domain.SourceBreaker, error) {
+	var res []domain.SourceBreaker
+	for _, b := range f {
+		if b.OpenUntil.After(since) {
+			res = append(res, b)
+		}
+	}
+	return res, nil
+}
+
+func TestTeamBreakers(t *testing.T) {
+	defer func(timeout int) { conf.Options.Sources.Timeout = timeout }(conf.Options.Sources.Timeout)
+	conf.Options.Sources.Timeout = 30
+	now := time.Now()
+	team := &domain.Team{SourceKeys: map[string]string{domain.SourceOTX: "mine"}}
+	store := fakeSourceBreakers{
+		{Worker: "w1", Breaker: "vt", Source: "vt", State: domain.BreakerOpen, OpenUntil: now.Add(time.Minute), Error: "did not answer"},
+		{Worker: "w2", Breaker: "vt", Source: "vt", State: domain.BreakerOpen, OpenUntil: now.Add(2 * time.Minute), Error: "quota"},
+		{Worker: "w1", Breaker: "xfe", Source: "xfe", State: domain.BreakerOpen, OpenUntil: now.Add(-time.Second)},
+		{Worker: "w1", Breaker: domain.BreakerName("otx", "mine"), Source: "otx", State: domain.BreakerOpen, OpenUntil: now.Add(time.Minute)},
+		{Worker: "w1", Breaker: domain.BreakerName("otx", "theirs"), Source: "otx", State: domain.BreakerOpen, OpenUntil: now.Add(time.Minute)},
+		// A worker that went away long ago
+		{Worker: "w3", Breaker: "urlhaus", Source: "urlhaus", State: domain.BreakerOpen, OpenUntil: now.Add(-time.Hour)},
+	}
+	breakers, err := teamBreakers(store, team, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breakers) != 3 || breakers[0].Source != "otx" || breakers[1].Source != "vt" || breakers[2].Source != "xfe" {
+		t.Fatalf("unexpected breakers %+v", breakers)
+	}
+	if breakers[1].Error != "quota" || breakers[2].State != domain.BreakerHalfOpen {
+		t.Errorf("expected the latest breaker of the workers and the retried one to be half-open but got %+v", breakers)
+	}
+	text := breakersText(breakers, now)
+	if !strings.Contains(text, "VirusTotal unavailable, retrying in 2m0s - quota") || !strings.Contains(text, "retrying now") {
+		t.Errorf("unexpected text %s", text)
+	}
+	if breakersText(nil, now) != "All sources are available" {
+		t.Error("expected all the sources to be available")
+	}
+}
+
+func TestUnavailableSource(t *testing.T) {
+	var f finding
+	f.addSources([]domain.SourceResult{
+		{Source: domain.SourceVT, Result: domain.ResultUnknown, Unavailable: true, Error: "VirusTotal keeps failing"},
+		{Source: domain.SourceXFE, Result: domain.ResultUnknown, Error: "timeout"},
+	})
+	if len(f.sources) != 1 || f.sources[0].score != "source unavailable" {
+		t.Errorf("expected only the tripped source to be shown as unavailable but got %+v", f.sources)
+	}
+}
@@ -0,0 +1,221 @@
+package bot
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// verdictCache is a bounded LRU of the recent verdicts per team and indicator.
+// It lets us answer the same indicator pasted again within the window without new lookups.
+type verdictCache struct {
+	mu      sync.Mutex // Guards the entries and order
+	size    int
+	window  time.Duration
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+// cachedVerdict is a single entry in the cache holding one of the reply types
+type cachedVerdict struct {
+	key     string
+	ts      time.Time
+	verdict interface{}
+}
+
+func newVerdictCache(size int, window time.Duration) *verdictCache {
+	return &verdictCache{size: size, window: window, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func cacheKey(team, kind, indicator string) string {
+	return team + "\x00" + kind + "\x00" + indicator
+}
+
+// put stores the verdict unless a fresh one is already there so the window is counted from the actual lookup
+func (c *verdictCache) put(key string, verdict interface{}) {
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		entry := e.Value.(*cachedVerdict)
+		if time.Since(entry.ts) <= c.window {
+			return
+		}
+		entry.ts, entry.verdict = time.Now(), verdict
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedVerdict{key: key, ts: time.Now(), verdict: verdict})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedVerdict).key)
+	}
+}
+
+// lookup returns the verdict if it is still fresh
+func (c *verdictCache) lookup(key string) (interface{}, bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cachedVerdict)
+	if time.Since(entry.ts) > c.window {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.verdict, true
+}
+
+// add the verdicts of the reply to the cache. Verdicts with source errors are not cached.
+func (c *verdictCache) add(team string, reply *domain.WorkReply) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range reply.URLs {
+		if sourceErrors(r.Sources) == "" {
+			c.put(cacheKey(team, "url", r.Details), r)
+		}
+	}
+	for _, r := range reply.Domains {
+		if sourceErrors(r.Sources) == "" {
+			c.put(cacheKey(team, "domain", r.Details), r)
+		}
+	}
+	for _, r := range reply.Emails {
+		if sourceErrors(r.Sources) == "" {
+			c.put(cacheKey(team, "email", r.Details), r)
+		}
+	}
+	for _, r := range reply.IPs {
+		if sourceErrors(r.Sources) == "" {
+			c.put(cacheKey(team, "ip", r.Details), r)
+		}
+	}
+	for _, r := range reply.CVEs {
+		if r.Error == "" {
+			c.put(cacheKey(team, "cve", r.Details), r)
+		}
+	}
+	for _, r := range reply.Wallets {
+		if r.Error == "" {
+			c.put(cacheKey(team, "wallet", r.Details), r)
+		}
+	}
+	for _, r := range reply.Hashes {
+		if sourceErrors(r.Sources) == "" {
+			c.put(cacheKey(team, "hash", r.Details), r)
+		}
+	}
+}
+
+// get builds a reply for the indicators if all of them have a fresh verdict.
+// Custom matches are never answered from the cache since they need to be forwarded.
+func (c *verdictCache) get(team string, found *indicators) *domain.WorkReply {
+	if c == nil || c.size <= 0 || len(found.custom) > 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply := &domain.WorkReply{}
+	for _, u := range found.urls {
+		v, ok := c.lookup(cacheKey(team, "url", u))
+		if !ok {
+			return nil
+		}
+		reply.URLs, reply.Type = append(reply.URLs, v.(domain.URLReply)), reply.Type|domain.ReplyTypeURL
+	}
+	for _, d := range found.domains {
+		v, ok := c.lookup(cacheKey(team, "domain", d))
+		if !ok {
+			return nil
+		}
+		reply.Domains, reply.Type = append(reply.Domains, v.(domain.DomainReply)), reply.Type|domain.ReplyTypeDomain
+	}
+	for _, e := range found.emails {
+		v, ok := c.lookup(cacheKey(team, "email", e))
+		if !ok {
+			return nil
+		}
+		reply.Emails, reply.Type = append(reply.Emails, v.(domain.EmailReply)), reply.Type|domain.ReplyTypeEmail
+	}
+	for _, ip := range found.ips {
+		v, ok := c.lookup(cacheKey(team, "ip", ip))
+		if !ok {
+			return nil
+		}
+		reply.IPs, reply.Type = append(reply.IPs, v.(domain.IPReply)), reply.Type|domain.ReplyTypeIP
+	}
+	for _, cve := range found.cves {
+		v, ok := c.lookup(cacheKey(team, "cve", cve))
+		if !ok {
+			return nil
+		}
+		reply.CVEs, reply.Type = append(reply.CVEs, v.(domain.CVEReply)), reply.Type|domain.ReplyTypeCVE
+	}
+	for _, w := range found.wallets {
+		v, ok := c.lookup(cacheKey(team, "wallet", w.Value))
+		if !ok {
+			return nil
+		}
+		reply.Wallets, reply.Type = append(reply.Wallets, v.(domain.WalletReply)), reply.Type|domain.ReplyTypeWallet
+	}
+	for _, h := range found.hashes {
+		v, ok := c.lookup(cacheKey(team, "hash", h.Value))
+		if !ok {
+			return nil
+		}
+		reply.Hashes, reply.Type = append(reply.Hashes, v.(domain.HashReply)), reply.Type|domain.ReplyTypeHash
+	}
+	return reply
+}
+
+// welcomedCacheSize is how many welcomed users we remember before asking the repo again
+const welcomedCacheSize = 10000
+
+// welcomedCache is a bounded LRU of the team users we know were welcomed.
+// The repo is the source of truth so an evicted user costs one query and is never welcomed twice.
+type welcomedCache struct {
+	mu      sync.Mutex // Guards the entries and order
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+func newWelcomedCache(size int) *welcomedCache {
+	return &welcomedCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func welcomedKey(team, user string) string {
+	return team + "\x00" + user
+}
+
+// has checks if the user is known to be welcomed
+func (c *welcomedCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// add remembers the user and evicts the least recently used ones above the size
+func (c *welcomedCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(key)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+	}
+}
@@ -0,0 +1,90 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo/repotest"
+)
+
+func TestVerdictCache(t *testing.T) {
+	c := newVerdictCache(2, time.Minute)
+	c.add("T1", &domain.WorkReply{
+		IPs:    []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}},
+		Hashes: []domain.HashReply{{Details: "d41d8cd98f00b204e9800998ecf8427e", Result: domain.ResultDirty}},
+		URLs: []domain.URLReply{{Details: "http://evil.com",
+			Sources: []domain.SourceResult{{Source: domain.SourceVT, Result: domain.ResultUnknown, Error: "rate limited"}}}},
+	})
+	reply := c.get("T1", &indicators{ips: []string{"8.8.8.8"}, hashes: []domain.Hash{{Value: "d41d8cd98f00b204e9800998ecf8427e", Type: domain.HashMD5}}})
+	if reply == nil || len(reply.IPs) != 1 || len(reply.Hashes) != 1 || reply.Hashes[0].Result != domain.ResultDirty {
+		t.Fatalf("expected a cached reply but got %+v", reply)
+	}
+	if reply.Type != domain.ReplyTypeIP|domain.ReplyTypeHash {
+		t.Errorf("unexpected reply type %d", reply.Type)
+	}
+	if c.get("T2", &indicators{ips: []string{"8.8.8.8"}}) != nil {
+		t.Error("verdicts must not leak between teams")
+	}
+	if c.get("T1", &indicators{urls: []string{"http://evil.com"}}) != nil {
+		t.Error("verdicts with errors must not be cached")
+	}
+	if c.get("T1", &indicators{ips: []string{"8.8.8.8", "1.1.1.1"}}) != nil {
+		t.Error("expected a miss when one of the indicators is not cached")
+	}
+	if c.get("T1", &indicators{ips: []string{"8.8.8.8"}, custom: []domain.CustomMatch{{Pattern: "x", Value: "x"}}}) != nil {
+		t.Error("custom matches must not be answered from the cache")
+	}
+	// The least recently used entry is evicted
+	c.add("T1", &domain.WorkReply{IPs: []domain.IPReply{{Details: "1.1.1.1"}}})
+	if c.get("T1", &indicators{hashes: []domain.Hash{{Value: "d41d8cd98f00b204e9800998ecf8427e"}}}) != nil {
+		t.Error("expected the hash to be evicted")
+	}
+	if c.get("T1", &indicators{ips: []string{"8.8.8.8", "1.1.1.1"}}) == nil {
+		t.Error("expected both IPs to be cached")
+	}
+	c.window = 0
+	if c.get("T1", &indicators{ips: []string{"8.8.8.8"}}) != nil || len(c.entries) != 1 {
+		t.Error("expected expired verdicts to be removed")
+	}
+}
+
+func TestWelcomedCache(t *testing.T) {
+	c := newWelcomedCache(2)
+	c.add(welcomedKey("T1", "U1"))
+	c.add(welcomedKey("T1", "U2"))
+	if !c.has(welcomedKey("T1", "U1")) || c.has(welcomedKey("T2", "U1")) {
+		t.Error("users must be remembered per team")
+	}
+	// U1 was just used so U2 is the one evicted
+	c.add(welcomedKey("T1", "U3"))
+	if c.has(welcomedKey("T1", "U2")) || !c.has(welcomedKey("T1", "U1")) || !c.has(welcomedKey("T1", "U3")) {
+		t.Error("expected the least recently used user to be evicted")
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Errorf("expected the cache to stay bounded but got %d entries", len(c.entries))
+	}
+}
+
+func TestCachedReplyIsOnlyPosted(t *testing.T) {
+	s, done := newFakeSlack()
+	defer done()
+	r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Status: domain.UserStatusActive, BotUserID: "UBOT", BotToken: "xoxb-1"},
+		&domain.User{ID: "u1", ExternalID: "U1"})
+	b := repoBot(r)
+	b.cache = newVerdictCache(10, time.Minute)
+	b.cache.add("T1", &domain.WorkReply{IPs: []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}})
+	b.handleMessage(event(t, `{"type":"message","channel":"D1","user":"U1","text":"8.8.8.8","ts":"1.1"}`))
+	// The reply is posted before handleMessage returns
+	if len(s.posted) != 1 || !strings.Contains(s.posted[0], "8.8.8.8") {
+		t.Fatalf("expected the cached verdict to be posted - %q", s.posted)
+	}
+	stats := b.stats["T1"]
+	if stats == nil || stats.CacheHits != 1 {
+		t.Fatalf("expected the cache hit to be counted - %+v", stats)
+	}
+	if stats.IPsClean != 0 {
+		t.Errorf("expected the cached verdict not to be counted again - %+v", stats)
+	}
+}
@@ -0,0 +1,264 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/slack"
+)
+
+// defaultLocale has every message and is used for teams without a locale and for messages that are not translated
+const defaultLocale = "en"
+
+// catalogSources are the message templates of each locale keyed by message ID.
+// A locale only needs the messages it translates, the rest fall back to English.
+var catalogSources = map[string]map[string]string{
+	defaultLocale: {
+		// Replies
+		"file_good":          "File ({{.Indicator}}) is clean. Click {{.Link}} for more details.",
+		"file_big":           "File ({{.Indicator}}) is too large to scan. Click {{.Link}} for more details.",
+		"file_excluded":      "File ({{.Indicator}}) is of a type we do not analyze. Click {{.Link}} for more details.",
+		"file_archive":       "It is an archive, the files inside it were not scanned.",
+		"file_encrypted":     "Warning: File ({{.Indicator}}) is a password-protected archive - treat it as suspicious, the scanners cannot look inside. Click {{.Link}} for more details.",
+		"file_bad":           "Warning: File ({{.Indicator}}) is malicious. Click {{.Link}} for more details.",
+		"file_warning":       "Unable to find details regarding this file ({{.Indicator}}). Click {{.Link}} for more details.",
+		"file_sandboxed":     "It was submitted to the sandbox of the team, its behavioral verdict follows in the thread.",
+		"sandbox_bad":        "Warning: the sandbox saw File ({{.Indicator}}) behave maliciously - it scored {{.Score}} / 10.",
+		"sandbox_suspicious": "The sandbox saw File ({{.Indicator}}) behave suspiciously - it scored {{.Score}} / 10.",
+		"sandbox_good":       "The sandbox did not see File ({{.Indicator}}) behave maliciously - it scored {{.Score}} / 10.",
+		"sandbox_failed":     "The sandbox could not analyze File ({{.Indicator}}): {{.Error}}.",
+		"sandbox_signatures": "What it did: {{.Signatures}}.",
+		"sandbox_coalesced":  "The same file was analyzed recently, this is that analysis.",
+		"analysis_failed":    "Sorry, I was unable to analyze this message. The administrators of the team can try it again.",
+		"url_good":           "URL ({{.Indicator}}) is clean: {{.Link}}.",
+		"url_bad":            "Warning: URL ({{.Indicator}}) is malicious: {{.Link}}.",
+		"url_warning":        "Unable to find details regarding this URL ({{.Indicator}}): {{.Link}}.",
+		"url_internal":       "URL ({{.Indicator}}) is internal, not submitted externally: {{.Link}}.",
+		"ip_good":            "IP ({{.Indicator}}) is clean: {{.Link}}.",
+		"ip_bad":             "Warning: IP ({{.Indicator}}) is malicious: {{.Link}}.",
+		"ip_warning":         "Unable to find details regarding this IP ({{.Indicator}}): {{.Link}}.",
+		"ip_private":         "IP ({{.Indicator}}) is a private (internal) IP so we cannot provide reputation information: {{.Link}}.",
+		"hash_good":          "Hash ({{.Indicator}}) is clean: {{.Link}}.",
+		"hash_bad":           "Warning: hash ({{.Indicator}}) is malicious: {{.Link}}.",
+		"hash_warning":       "Unable to find details regarding this hash ({{.Indicator}}): {{.Link}}.",
+		"hash_unsupported":   "Hash ({{.Indicator}}) is a SHA-512 hash which the reputation services do not index and we did not see the file: {{.Link}}.",
+		"domain_good":        "Domain ({{.Indicator}}) is clean: {{.Link}}.",
+		"domain_bad":         "Warning: domain ({{.Indicator}}) is malicious: {{.Link}}.",
+		"domain_warning":     "Unable to find details regarding this domain ({{.Indicator}}): {{.Link}}.",
+		"domain_internal":    "Domain ({{.Indicator}}) is internal, not submitted externally: {{.Link}}.",
+		"domain_young":       "It was registered {{.Days}} days ago - newly registered domains are often used for phishing.",
+		"email_good":         "Email domain reputation for ({{.Indicator}}) is clean: {{.Link}}.",
+		"email_bad":          "Warning: email domain reputation for ({{.Indicator}}) is malicious: {{.Link}}.",
+		"email_lookalike":    "Warning: the email domain of ({{.Indicator}}) looks like a spoof of {{.LookAlike}}: {{.Link}}.",
+		"email_internal":     "Email domain of ({{.Indicator}}) is internal, not submitted externally: {{.Link}}.",
+		"email_warning":      "Unable to find the email domain reputation for ({{.Indicator}}): {{.Link}}.",
+		"wallet_good":        "No abuse reports for {{.Chain}} wallet ({{.Indicator}}).",
+		"wallet_bad":         "Warning: {{.Chain}} wallet ({{.Indicator}}) was reported for abuse {{.Reports}} times ({{.Categories}}).",
+		"wallet_warning":     "Unable to find abuse reports for {{.Chain}} wallet ({{.Indicator}}).",
+		"cve":                "{{.Indicator}} - CVSS {{.Score}} ({{.Severity}}): {{.Summary}}",
+		"cve_warning":        "Unable to find details regarding this vulnerability ({{.Indicator}}).",
+		"custom":             "{{.Indicator}} matched pattern {{.Pattern}} and was forwarded to your webhook.",
+		"custom_error":       "{{.Indicator}} matched pattern {{.Pattern}} but forwarding to your webhook failed: {{.Error}}.",
+		"skipped":            "{{.Count}} more indicators in this message were not checked to stay within the lookup limits.",
+		"truncated":          "The message is too long so only its beginning was checked.",
+		"pending":            "{{.Pending}} of {{.Total}} results pending - the rate limit of a key is spacing the lookups, I will update this message as they complete.",
+		"xsoar_incident":     "Opened XSOAR incident {{.Incident}}.",
+		"more_results":       "{{.Count}} more results are on the <{{.Link}}|details page>.",
+		"footer":             "Security check by DBot - Demisto Bot. Click <{{.Address}}|here> for configuration and details.",
+		// Help
+		"help_intro": "Here are the commands I understand when you send me a DIRECT MESSAGE here:",
+		"help_notes": `- Commands that change the configuration (join, leave, verbose, whitelist, ignore, mute, config mode, digest, weekly, lang and setkey) are limited to workspace admins and the users they allow on the configuration page.
+- It's important to specify your own keys to get reliable results as our public API keys are rate limited.
+- Send *help command* (e.g. *help verbose*) to see the details and examples of a single command.
+- In a channel, mention me with scan, vt, xfe, help or status (e.g. *@dbot scan 8.8.8.8*) and I will reply in a thread.`,
+		"help_unknown":    "I don't know the command *{{.Topic}}*.",
+		"help_suggestion": " Did you mean *{{.Suggestion}}*? Send *help {{.Suggestion}}* to see how to use it.",
+		"help_all":        " Send *help* to see all the commands I understand.",
+		// Configuration
+		"config_error":       "Error retrieving current configuration. Rest assured we are looking into the issue.",
+		"config_save_error":  "I had an issue saving the configuration.",
+		"channels_unmatched": "I could not find channels matching: {{.Channels}}",
+		"join_started":       "I've started monitoring the following channels: {{.Channels}}",
+		"join_invite_failed": "I could not invite myself to the public channels, rest assured we are looking into the issue.",
+		"join_already":       "I was already monitoring these channels: {{.Channels}}",
+		"join_nothing":       "I was already monitoring all public channels but thanks for thinking of me.",
+		"leave_usage":        "I could not understand your command. Leave command is:\nleave all/#channel1,#channel2,eng-* - to stop monitoring the channels.",
+		"leave_stopped":      "I've stopped monitoring the following channels: {{.Channels}}",
+		"leave_failed":       "I could not leave the following channels, please remove me from them: {{.Channels}}",
+		"leave_unmonitored":  "I was not monitoring these channels in the first place: {{.Channels}}",
+		"verbose_usage": `I could not understand your command. Verbose command is:
+verbose on #channel1,#channel2 - to turn on verbose mode on for a list of channels.
+verbose off #channel1,#channel2 - to turn off verbose mode on for a list of channels.
+Instead of channels you can use all or a pattern like eng-* to match the channels I monitor.
+Add all, suspicious, malicious or default at the end to set which results I reply on in these channels.`,
+		"verbose_save_error": "I had an issue saving the verbose state.",
+		"verbose_changed":    "Verbose mode is {{.State}} for: {{.Channels}}{{if .Threshold}} (reply threshold {{.Threshold}}){{end}}",
+		"verbose_unchanged":  "Nothing changed for: {{.Channels}}",
+		"verbose_nothing":    "Verbose state did not change - could not find anything new to change",
+		"lang_usage":         "I could not understand your command. Lang command is:\nlang <code> - to reply in the language. I speak: {{.Locales}}.",
+		"lang_current":       "I reply in English. Send *lang <code>* to change it, I speak: {{.Locales}}.",
+		"lang_set":           "I will reply in English from now on.",
+		"lang_save_error":    "I had an issue saving the language.",
+		"thread_usage": `I could not understand your command. Verbose thread command is:
+verbose thread on #channel1,#channel2 - to reply in a thread on the original message.
+verbose thread off #channel1,#channel2 - to reply in the channel itself.`,
+		"thread_save_error": "I had an issue saving the thread state.",
+		"thread_changed":    "Thread state was changed.",
+		"thread_nothing":    "Thread state did not change - could not find anything new to change",
+		"whitelist_usage": `I could not understand your command. Whitelist command is:
+whitelist add indicator - to stop checking a domain, IP, CIDR, URL or hash.
+whitelist remove indicator - to check it again.
+whitelist list - to show the current whitelist.`,
+		"whitelist_empty":      "The whitelist is empty.",
+		"whitelist_list":       "Whitelisted indicators: {{.Indicators}}",
+		"whitelist_bad_cidr":   "{{.Indicator}} is not a valid CIDR.",
+		"whitelist_too_long":   "This indicator is too long to whitelist.",
+		"whitelist_already":    "{{.Indicator}} is already whitelisted.",
+		"whitelist_missing":    "{{.Indicator}} is not whitelisted.",
+		"whitelist_save_error": "I had an issue saving the whitelist.",
+		"whitelist_changed":    "Whitelist was changed.",
+		"ignore_usage": `I could not understand your command. Ignore command is:
+ignore add @user - to stop checking the messages of the user.
+ignore remove @user - to check them again.
+ignore list - to show the ignored users.`,
+		"ignore_empty":      "I am not ignoring anyone.",
+		"ignore_list":       "Ignored users: {{.Users}}",
+		"ignore_no_user":    "I could not find the user {{.User}}.",
+		"ignore_self":       "I already ignore myself.",
+		"ignore_already":    "<@{{.User}}> is already ignored.",
+		"ignore_missing":    "<@{{.User}}> is not ignored.",
+		"ignore_save_error": "I had an issue saving the ignored users.",
+		"ignore_changed":    "Ignored users were changed.",
+	},
+	"es": {
+		"url_good":       "La URL ({{.Indicator}}) está limpia: {{.Link}}.",
+		"url_bad":        "Atención: la URL ({{.Indicator}}) es maliciosa: {{.Link}}.",
+		"url_warning":    "No encontré detalles sobre esta URL ({{.Indicator}}): {{.Link}}.",
+		"ip_good":        "La IP ({{.Indicator}}) está limpia: {{.Link}}.",
+		"ip_bad":         "Atención: la IP ({{.Indicator}}) es maliciosa: {{.Link}}.",
+		"ip_warning":     "No encontré detalles sobre esta IP ({{.Indicator}}): {{.Link}}.",
+		"file_good":      "El archivo ({{.Indicator}}) está limpio. Haz clic en {{.Link}} para más detalles.",
+		"file_bad":       "Atención: el archivo ({{.Indicator}}) es malicioso. Haz clic en {{.Link}} para más detalles.",
+		"file_encrypted": "Atención: el archivo ({{.Indicator}}) es un archivo comprimido protegido con contraseña - trátalo como sospechoso, los escáneres no pueden ver su contenido. Haz clic en {{.Link}} para más detalles.",
+		"file_warning":   "No encontré detalles sobre este archivo ({{.Indicator}}). Haz clic en {{.Link}} para más detalles.",
+		"footer":         "Revisión de seguridad de DBot - Demisto Bot. Haz clic <{{.Address}}|aquí> para la configuración y los detalles.",
+		"help_intro":     "Estos son los comandos que entiendo cuando me envías un MENSAJE DIRECTO aquí:",
+		"lang_current":   "Respondo en español. Envía *lang <código>* para cambiarlo, hablo: {{.Locales}}.",
+		"lang_set":       "A partir de ahora responderé en español.",
+	},
+}
+
+// catalog holds the parsed templates of each locale keyed by message ID
+type catalog map[string]map[string]*template.Template
+
+// msgArgs are the arguments of a message template
+type msgArgs map[string]interface{}
+
+// messages is the catalog we render the replies with. A malformed template fails the startup.
+var messages = mustLoadCatalog(catalogSources)
+
+// loadCatalog parses the templates of all the locales. Every message must have an English version.
+func loadCatalog(sources map[string]map[string]string) (catalog, error) {
+	c := make(catalog)
+	for locale, templates := range sources {
+		c[locale] = make(map[string]*template.Template)
+		for id, text := range templates {
+			if _, ok := sources[defaultLocale][id]; !ok {
+				return nil, fmt.Errorf("message %s of locale %s has no English version", id, locale)
+			}
+			t, err := template.New(locale + "/" + id).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return nil, err
+			}
+			c[locale][id] = t
+		}
+	}
+	return c, nil
+}
+
+// mustLoadCatalog panics if the catalog cannot be loaded
+func mustLoadCatalog(sources map[string]map[string]string) catalog {
+	c, err := loadCatalog(sources)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// render the message in the locale, falling back to English if it is not translated or cannot be rendered
+func (c catalog) render(locale, id string, data msgArgs) string {
+	for _, l := range []string{locale, defaultLocale} {
+		t, ok := c[l][id]
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			logrus.WithError(err).Warnf("Unable to render message %s in locale %s", id, l)
+			continue
+		}
+		return buf.String()
+	}
+	return id
+}
+
+// locales we speak, sorted
+func (c catalog) locales() []string {
+	var locales []string
+	for l := range c {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// ValidLocale checks that we speak the locale
+func ValidLocale(locale string) bool {
+	_, ok := messages[locale]
+	return ok
+}
+
+// msg renders the message in the locale of the team
+func (s *subscription) msg(id string, data msgArgs) string {
+	locale := ""
+	if s != nil && s.team != nil {
+		locale = s.team.Locale
+	}
+	return messages.render(locale, id, data)
+}
+
+// handleLang shows the language we reply in (lang) or changes it (lang es)
+func (b *Bot) handleLang(team string, msg slack.Response, sub *subscription) {
+	channel := msg.S("channel")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	locales := strings.Join(messages.locales(), ", ")
+	fields := strings.Fields(strings.ToLower(msg.S("text")))
+	switch {
+	case len(fields) == 1:
+		postMessage["text"] = sub.msg("lang_current", msgArgs{"Locales": locales})
+	case len(fields) != 2 || !ValidLocale(fields[1]):
+		postMessage["text"] = sub.msg("lang_usage", msgArgs{"Locales": locales})
+	default:
+		if err := b.r.SetTeamLocale(sub.team.ID, fields[1]); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing locale")
+			postMessage["text"] = sub.msg("lang_save_error", nil)
+			break
+		}
+		sub.team.Locale = fields[1]
+		// Other bot instances reload the team with the configuration
+		if err := b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+		}
+		postMessage["text"] = sub.msg("lang_set", nil)
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting lang message to Slack")
+	}
+}
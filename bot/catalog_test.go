@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadCatalog(t *testing.T) {
+	if _, err := loadCatalog(map[string]map[string]string{defaultLocale: {"bad": "{{.Unclosed"}}); err == nil {
+		t.Error("expected an error for a malformed template")
+	}
+	if _, err := loadCatalog(map[string]map[string]string{defaultLocale: {"a": "a"}, "es": {"b": "b"}}); err == nil {
+		t.Error("expected an error for a message without an English version")
+	}
+	for locale, templates := range messages {
+		if len(templates) == 0 {
+			t.Errorf("locale %s has no messages", locale)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	es := messages.render("es", "url_bad", msgArgs{"Indicator": "evil.com", "Link": "details"})
+	if !strings.HasPrefix(es, "Atención") || !strings.Contains(es, "evil.com") {
+		t.Errorf("unexpected Spanish message %s", es)
+	}
+	// Not translated so we fall back to English
+	if text := messages.render("es", "truncated", nil); text != "The message is too long so only its beginning was checked." {
+		t.Errorf("expected the English message but got %s", text)
+	}
+	if text := messages.render("xx", "url_good", msgArgs{"Indicator": "a.com", "Link": "b"}); text != "URL (a.com) is clean: b." {
+		t.Errorf("expected English for an unknown locale but got %s", text)
+	}
+	// A missing argument fails the template so we fall back to English, which fails as well
+	if text := messages.render("es", "url_good", nil); text != "url_good" {
+		t.Errorf("expected the message ID when nothing renders but got %s", text)
+	}
+	if text := messages.render("", "verbose_changed", msgArgs{"State": "on", "Channels": "#a", "Threshold": ""}); text != "Verbose mode is on for: #a" {
+		t.Errorf("unexpected verbose message %s", text)
+	}
+	if text := messages.render("", "ignore_already", msgArgs{"User": "U1"}); text != "<@U1> is already ignored." {
+		t.Errorf("unexpected ignore message %s", text)
+	}
+	if !ValidLocale("es") || ValidLocale("xx") {
+		t.Error("unexpected locale validation")
+	}
+}
@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+// abuseClient queries the Chainabuse reports of wallet addresses
+type abuseClient struct {
+	url string
+	key string
+	c   *http.Client
+}
+
+type abuseReport struct {
+	ScamCategory string `json:"scamCategory"`
+}
+
+func newAbuseClient(u, key string) *abuseClient {
+	return &abuseClient{url: u, key: key, c: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Wallet returns the abuse reports for the given address
+func (a *abuseClient) Wallet(wallet domain.Wallet) (*domain.WalletReply, error) {
+	if a.key == "" {
+		return nil, errors.New("blockchain abuse lookups are not configured")
+	}
+	req, err := http.NewRequest("GET", a.url+"?address="+url.QueryEscape(wallet.Value)+"&chain="+strings.ToUpper(wallet.Type), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(a.key, a.key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &domain.WalletReply{Details: wallet.Value, Type: wallet.Type}
+	if resp.StatusCode == http.StatusNotFound {
+		res.NotFound = true
+		return res, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from Chainabuse - %s", resp.Status)
+	}
+	var reports []abuseReport
+	if err = json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+		return nil, err
+	}
+	res.Reports = len(reports)
+	for _, r := range reports {
+		if r.ScamCategory != "" && !util.In(res.Categories, r.ScamCategory) {
+			res.Categories = append(res.Categories, r.ScamCategory)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package bot
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/slack"
+)
+
+// handleChannelEvent keeps up with the channels of the team - joining new public channels (or the ones matching the patterns),
+// joining the ones we missed when a member joins them, forgetting archived and deleted channels and following renames
+func (b *Bot) handleChannelEvent(team string, msg slack.Response, sub *subscription) {
+	switch msg.S("type") {
+	case "channel_created":
+		b.autoJoin(team, msg.S("channel.id"), msg.S("channel.name"), sub)
+	case "member_joined_channel":
+		if msg.S("user") == sub.team.BotUserID {
+			b.markJoined(sub, msg.S("channel"))
+			// Channels we join on our own have no inviter and are not greeted
+			if msg.S("inviter") != "" {
+				b.greetChannel(team, msg.S("channel"), msg.S("inviter"), sub)
+			}
+			return
+		}
+		if msg.S("channel_type") == "C" {
+			b.autoJoin(team, msg.S("channel"), "", sub)
+		}
+	case "channel_archive", "channel_deleted", "group_archive", "group_deleted":
+		b.removeChannel(team, msg.S("channel"), msg.S("type"), sub)
+	case "channel_rename", "group_rename":
+		b.renameChannel(team, msg.S("channel.id"), msg.S("channel.name"), sub)
+	}
+}
+
+// removeChannel drops the settings of an archived or deleted channel from the configuration and lets the other instances know.
+// The statistics of the channel are kept.
+func (b *Bot) removeChannel(team, channel, event string, sub *subscription) {
+	if channel == "" {
+		return
+	}
+	b.mu.Lock()
+	delete(sub.joined, channel)
+	delete(sub.names, channel)
+	changed := sub.configuration.RemoveChannel(channel)
+	b.mu.Unlock()
+	if !changed {
+		return
+	}
+	logrus.WithFields(logrus.Fields{"team": team, "channel": channel, "event": event}).Info("Removed channel from the configuration")
+	if err := b.r.SetChannelsAndGroups(sub.configuration); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error storing configuration")
+		return
+	}
+	if err := b.q.PushConf(team); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+	}
+}
+
+// renameChannel refreshes the name we know for the channel. The configuration holds only IDs so it does not change,
+// but a new name can match the channel patterns of the team.
+func (b *Bot) renameChannel(team, channel, name string, sub *subscription) {
+	if channel == "" || name == "" {
+		return
+	}
+	b.mu.Lock()
+	old := sub.names[channel]
+	if sub.names == nil {
+		sub.names = make(map[string]string)
+	}
+	sub.names[channel] = name
+	b.mu.Unlock()
+	logrus.WithFields(logrus.Fields{"team": team, "channel": channel, "old": old, "name": name}).Info("Channel renamed")
+	b.autoJoin(team, channel, name, sub)
+}
+
+// greetChannel tells the channel we were invited to that it is monitored, once per channel even across restarts.
+// If the team adds invited channels to the configuration we do it here, otherwise we explain how to.
+func (b *Bot) greetChannel(team, channel, inviter string, sub *subscription) {
+	first, err := b.r.MarkGreeted(sub.team.ID, channel)
+	if err != nil {
+		teamLog(team, channel).WithError(err).Warn("Unable to mark channel as greeted")
+		return
+	}
+	if !first {
+		return
+	}
+	text := fmt.Sprintf("Thanks for inviting me <@%s>. This channel is now monitored - I will check the URLs, IPs, hashes and files posted here. "+
+		"Send me *help* in a direct message to see what else I can do.", inviter)
+	auto := sub.configuration.AutoMonitorOnInvite
+	// The messages are dispatched with the configuration while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	if auto && c.AddChannel(channel) {
+		if err = b.setConfiguration(sub, c); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing configuration")
+		} else if err = b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+		}
+	}
+	if !auto {
+		text = fmt.Sprintf("Thanks for inviting me <@%s>. This team adds channels to the monitoring configuration by hand - "+
+			"a workspace admin can send me *join <#%s>* in a direct message to add this one.", inviter, channel)
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", map[string]interface{}{"channel": channel, "as_user": true, "text": text}); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting greeting to Slack")
+	}
+}
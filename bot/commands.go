@@ -0,0 +1,336 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+// How a command accepts arguments after its name
+const (
+	noArgs       = iota // Only the name itself, e.g. "status"
+	optionalArgs        // The name with or without arguments, e.g. "help" and "help join"
+	requiredArgs        // The name followed by arguments, e.g. "join all"
+)
+
+// command describes a DM command - how we recognize it, how we run it and how we explain it.
+// The dispatcher only runs commands from the registry so every command has its help text.
+type command struct {
+	name        string   // The words the command starts with
+	aliases     []string // Other names for the command, e.g. "?" for help
+	args        int      // One of noArgs, optionalArgs or requiredArgs
+	configures  bool     // Changes the configuration of the team so limited to admins
+	admins      bool     // Shows what was seen in every channel of the team so limited to workspace admins
+	mention     bool     // Safe to run when mentioned in a channel, the reply goes to a thread
+	syntax      string
+	description string
+	examples    []string
+	run         func(b *Bot, team string, msg slack.Response, sub *subscription)
+}
+
+// commands is the registry of the DM commands in the order we show them in the help.
+// It is built in init since the help command refers back to the registry.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "config", args: noArgs,
+			syntax:      "config",
+			description: "list the current channels I'm listening on",
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleConfig(team, msg, sub) }},
+		{name: "status", args: noArgs, mention: true,
+			syntax:      "status",
+			description: "check that I'm connected and see what I'm monitoring",
+			run: func(b *Bot, team string, msg slack.Response, sub *subscription) {
+				b.handleStatus(team, msg.S("channel"), msg.S("thread_ts"), sub)
+			}},
+		{name: "stats", args: optionalArgs,
+			syntax:      "stats [#channel]",
+			description: "show what I checked for you today and in the last week, for the whole team or a single channel",
+			examples:    []string{"stats", "stats #security"},
+			run: func(b *Bot, team string, msg slack.Response, sub *subscription) {
+				b.handleStats(team, msg.S("channel"), msg.S("text"), sub)
+			}},
+		{name: "config mode", args: requiredArgs, configures: true,
+			syntax:      "config mode message/reaction/both #channel1,#channel2",
+			description: "reply with a message, a colored reaction on the original message or both",
+			examples:    []string{"config mode reaction #general", "config mode both #security,#soc"},
+			run:         textCommand((*Bot).handleMode)},
+		{name: "join", args: requiredArgs, configures: true,
+			syntax:      "join all/#channel1,#channel2,pattern...",
+			description: "I will join all/specified public channels and start monitoring them. Patterns like eng-* match the channel names.",
+			examples:    []string{"join all", "join #general,#random", "join eng-*"},
+			run:         textCommand((*Bot).joinChannels)},
+		{name: "leave", args: requiredArgs, configures: true,
+			syntax:      "leave all/#channel1,#channel2,pattern...",
+			description: "I will stop monitoring the specified channels and leave them. Patterns like eng-* match the channels I monitor.",
+			examples:    []string{"leave #random", "leave test-*"},
+			run:         textCommand((*Bot).leaveChannels)},
+		{name: "verbose", args: requiredArgs, configures: true,
+			syntax: "verbose on/off all/#channel1,#channel2,private1,pattern... [all/suspicious/malicious/default]",
+			description: "turn on verbose mode on the specified channels or private groups. " +
+				"Verbose mode is usually used by security professionals. When in verbose mode, dbot will display reputation details about any URL, IP or file including clean ones. " +
+				"Use all or a pattern like eng-* to change the channels dbot monitors at once. " +
+				"The optional last argument sets which results dbot replies on in the channels, e.g. only malicious ones.\n" +
+				"*verbose thread on/off #channel1,#channel2,private1...* - reply in a thread on the original message instead of in the channel",
+			examples: []string{"verbose on #security", "verbose off #general malicious", "verbose on #soc suspicious", "verbose eng-* on", "verbose thread on #general"},
+			run:      textCommand((*Bot).handleVerbose)},
+		{name: "vt", args: requiredArgs, mention: true,
+			syntax:      "vt hash/URL/domain/IP...",
+			description: "look up the values directly on VirusTotal and get one reply with all the results.",
+			examples:    []string{"vt 44d88612fea8a8f36de82e1278abb02f", "vt http://example.com/login 8.8.8.8 example.com"},
+			run:         lookupCommand(domain.SourceVT)},
+		{name: "seen", args: requiredArgs, admins: true,
+			syntax:      "seen hash/URL/domain/IP/email",
+			description: "list where and when I saw the value before and what the verdict was.",
+			examples:    []string{"seen 44d88612fea8a8f36de82e1278abb02f", "seen hxxp://evil[.]com/login"},
+			run:         threadCommand((*Bot).handleSeen)},
+		{name: "vt -", args: noArgs, configures: true,
+			syntax:      "vt -",
+			description: "stop using your own VirusTotal key and return to the default one. You can get a key at https://www.virustotal.com/en/documentation/public-api/ and set it with setkey.",
+			run:         threadCommand((*Bot).handleVT)},
+		{name: "xfe", args: requiredArgs, mention: true,
+			syntax:      "xfe hash/URL/domain/IP...",
+			description: "look up the values directly on IBM X-Force Exchange and get one reply with all the results.",
+			examples:    []string{"xfe 44d88612fea8a8f36de82e1278abb02f", "xfe http://example.com/login 8.8.8.8 example.com"},
+			run:         lookupCommand(domain.SourceXFE)},
+		{name: "xfe -", args: noArgs, configures: true,
+			syntax:      "xfe -",
+			description: "stop using your own IBM X-Force Exchange credentials and return to the default ones. You can get credentials at https://exchange.xforce.ibmcloud.com/ and set them with setkey.",
+			run:         threadCommand((*Bot).handleXFE)},
+		{name: "setkey", args: requiredArgs, configures: true,
+			syntax:      "setkey vt the-api-key | setkey xfe the-api-key the-password | setkey abuseipdb the-api-key | setkey otx the-api-key | setkey hibp the-api-key",
+			description: "check and set your own keys. I will try to delete your message so the key does not stay in the conversation.",
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleSetKey(team, msg, sub) }},
+		{name: "whitelist list", args: noArgs,
+			syntax:      "whitelist list",
+			description: "show the current whitelist.",
+			run:         textCommand((*Bot).handleWhitelist)},
+		{name: "whitelist", args: requiredArgs, configures: true,
+			syntax:      "whitelist add/remove indicator",
+			description: "never check the given domain, IP, CIDR (e.g. 52.0.0.0/8), URL or hash.",
+			examples:    []string{"whitelist add example.com", "whitelist add 52.0.0.0/8", "whitelist remove example.com"},
+			run:         textCommand((*Bot).handleWhitelist)},
+		{name: "fp", args: requiredArgs,
+			syntax:      "fp indicator optional comment [--whitelist]",
+			description: "let us know a verdict was wrong so we can review it. Add --whitelist to also stop checking the indicator (workspace admins and the users they allow).",
+			examples:    []string{"fp example.com our marketing site", "fp 10.1.2.3 scanner --whitelist"},
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleFP(team, msg, sub) }},
+		{name: "ignore list", args: noArgs,
+			syntax:      "ignore list",
+			description: "show the ignored users.",
+			run:         textCommand((*Bot).handleIgnore)},
+		{name: "ignore", args: requiredArgs, configures: true,
+			syntax:      "ignore add/remove @user",
+			description: "never check the messages of the given user (e.g. automation that echoes threat feeds).",
+			examples:    []string{"ignore add @feedbot", "ignore remove @feedbot"},
+			run:         textCommand((*Bot).handleIgnore)},
+		{name: "mute", args: requiredArgs, configures: true,
+			syntax:      "mute #channel1,#channel2 duration",
+			description: "stop replying on the channels for a while (e.g. 30m or 2h, up to a week). I will still check the messages.",
+			examples:    []string{"mute #general 2h", "mute #random,#soc 30m"},
+			run:         textCommand((*Bot).handleMute)},
+		{name: "unmute", args: requiredArgs, configures: true,
+			syntax:      "unmute #channel1,#channel2",
+			description: "reply on the channels again.",
+			examples:    []string{"unmute #general"},
+			run:         textCommand((*Bot).handleUnmute)},
+		{name: "scan", args: requiredArgs, mention: true,
+			syntax:      "scan text",
+			description: "check every indicator in the text and reply with the verdict of each one, e.g. paste a log or an email here.",
+			examples:    []string{"scan 8.8.8.8 http://example.com/login"},
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleScan(team, msg, sub) }},
+		{name: "digest", args: requiredArgs, configures: true,
+			syntax:      "digest #channel hour [timezone] | digest off",
+			description: "post a daily summary of what I checked to the channel at the hour (0-23). Without a timezone I use yours.",
+			examples:    []string{"digest #security 9", "digest #soc 17 Europe/London", "digest off"},
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleDigest(team, msg, sub) }},
+		{name: "weekly", args: requiredArgs, configures: true,
+			syntax:      "weekly on | weekly off",
+			description: "turn the weekly trends I send the configuration admins every Monday on or off.",
+			examples:    []string{"weekly off"},
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleWeekly(team, msg, sub) }},
+		{name: "lang", args: optionalArgs, configures: true,
+			syntax:      "lang [code]",
+			description: "show the language I reply in or change it, e.g. es for Spanish. Untranslated messages stay in English.",
+			examples:    []string{"lang es", "lang en"},
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleLang(team, msg, sub) }},
+		{name: "rescan", args: requiredArgs,
+			syntax:      "rescan message-link",
+			description: "check a message again, e.g. when a new sample was not found the first time. Use Copy link on the message to get the link. You need to be a member of the channel.",
+			examples:    []string{"rescan https://example.slack.com/archives/C01234567/p1514764800000100"},
+			run:         func(b *Bot, team string, msg slack.Response, sub *subscription) { b.handleRescan(team, msg, sub) }},
+		{name: "help", aliases: []string{"?"}, args: optionalArgs, mention: true,
+			syntax:      "help [command]",
+			description: "list the commands or show the detailed usage of a single command.",
+			examples:    []string{"help verbose", "? join"},
+			run: func(b *Bot, team string, msg slack.Response, sub *subscription) {
+				b.showHelp(team, msg.S("channel"), msg.S("thread_ts"), helpTopic(msg.S("text")))
+			}},
+	}
+}
+
+// textCommand adapts the handlers that work on the text and channel of the message
+func textCommand(handler func(b *Bot, team, text, channel string, sub *subscription)) func(b *Bot, team string, msg slack.Response, sub *subscription) {
+	return func(b *Bot, team string, msg slack.Response, sub *subscription) {
+		handler(b, team, msg.S("text"), msg.S("channel"), sub)
+	}
+}
+
+// threadCommand adapts the handlers that work on the text and channel of the message and reply in its thread
+func threadCommand(handler func(b *Bot, team, text, channel, thread string, sub *subscription)) func(b *Bot, team string, msg slack.Response, sub *subscription) {
+	return func(b *Bot, team string, msg slack.Response, sub *subscription) {
+		handler(b, team, msg.S("text"), msg.S("channel"), msg.S("thread_ts"), sub)
+	}
+}
+
+// lookupCommand checks the indicators after the command only with the given source
+func lookupCommand(source string) func(b *Bot, team string, msg slack.Response, sub *subscription) {
+	return func(b *Bot, team string, msg slack.Response, sub *subscription) {
+		b.handleLookup(team, msg, sub, source)
+	}
+}
+
+// matches checks if the lower cased text invokes the command under the given name
+func (c *command) matches(ltext, name string) bool {
+	switch c.args {
+	case noArgs:
+		return ltext == name
+	case optionalArgs:
+		return ltext == name || strings.HasPrefix(ltext, name+" ")
+	default:
+		return strings.HasPrefix(ltext, name+" ")
+	}
+}
+
+// findCommand returns the command the lower cased text invokes or nil if it is not a command.
+// The longest name wins so "config mode ..." is not taken as "config".
+func findCommand(ltext string) *command {
+	var found *command
+	longest := 0
+	for _, c := range commands {
+		for _, name := range append([]string{c.name}, c.aliases...) {
+			if len(name) > longest && c.matches(ltext, name) {
+				found, longest = c, len(name)
+			}
+		}
+	}
+	return found
+}
+
+// mentionCommands lists the names of the commands that can be run by mentioning us in a channel
+func mentionCommands() []string {
+	var names []string
+	for _, c := range commands {
+		if c.mention {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// stripMention returns the text after a leading mention of our bot user, e.g. "<@U123> scan 8.8.8.8" or "<@U123|dbot>: help"
+func stripMention(text, botUser string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if botUser == "" || !strings.HasPrefix(text, "<@"+botUser) {
+		return "", false
+	}
+	rest := text[len("<@"+botUser):]
+	if !strings.HasPrefix(rest, ">") && !strings.HasPrefix(rest, "|") {
+		return "", false
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest[end+1:]), ":")), true
+}
+
+// helpTopic returns the command the user asks about in "help verbose" or "? join"
+func helpTopic(text string) string {
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) < 2 {
+		return ""
+	}
+	return strings.Join(fields[1:], " ")
+}
+
+// HelpMessage is the full help listing all the commands
+func HelpMessage() string {
+	return helpMessage(defaultLocale)
+}
+
+// helpMessage is the full help in the locale. The syntax and description of the commands are not translated.
+func helpMessage(locale string) string {
+	lines := []string{messages.render(locale, "help_intro", nil)}
+	for _, c := range commands {
+		lines = append(lines, fmt.Sprintf("*%s*: %s", c.syntax, c.description))
+	}
+	return strings.Join(append(lines, messages.render(locale, "help_notes", nil)), "\n")
+}
+
+// commandHelp returns the detailed usage of the commands under the topic (e.g. "whitelist" covers "whitelist list")
+// or an empty string if there is no such command
+func commandHelp(topic string) string {
+	var parts []string
+	for _, c := range commands {
+		if c.name != topic && !strings.HasPrefix(c.name, topic+" ") && !contains(c.aliases, topic) {
+			continue
+		}
+		usage := fmt.Sprintf("*%s*: %s", c.syntax, c.description)
+		if c.configures {
+			usage += "\nThis command is limited to workspace admins and the users they allow on the configuration page."
+		}
+		if c.admins {
+			usage += "\nThis command is limited to workspace admins and owners."
+		}
+		if len(c.examples) > 0 {
+			usage += "\nExamples:\n" + strings.Join(c.examples, "\n")
+		}
+		parts = append(parts, usage)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// suggestCommand returns the name of the command closest to the given one or an empty string if none is close enough
+func suggestCommand(name string) string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	best, bestDistance := "", 3 // Anything further than 2 edits is not a typo
+	for _, n := range names {
+		if strings.HasPrefix(n, name) {
+			return n
+		}
+		if d := editDistance(name, n); d < bestDistance {
+			best, bestDistance = n, d
+		}
+	}
+	return best
+}
+
+// unknownCommandReply points the user to the help and to the command they probably meant
+func unknownCommandReply(text string) string {
+	reply := "I did not find anything to check in your message and it is not a command I know."
+	if fields := strings.Fields(strings.ToLower(text)); len(fields) > 0 {
+		if suggestion := suggestCommand(fields[0]); suggestion != "" {
+			reply += fmt.Sprintf(" Did you mean *%s*? Send *help %s* to see how to use it.", suggestion, suggestion)
+			return reply
+		}
+	}
+	return reply + " Send *help* to see all the commands I understand."
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
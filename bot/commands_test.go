@@ -0,0 +1,346 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo/repotest"
+	"github.com/demisto/alfred/slack"
+)
+
+func TestCommandsHaveHelp(t *testing.T) {
+	names := make(map[string]bool)
+	for _, c := range commands {
+		if c.name == "" || c.syntax == "" || c.description == "" || c.run == nil {
+			t.Errorf("command %q must have a name, syntax, description and handler", c.name)
+		}
+		if names[c.name] {
+			t.Errorf("command %q is registered twice", c.name)
+		}
+		names[c.name] = true
+		if commandHelp(c.name) == "" {
+			t.Errorf("no help for command %q", c.name)
+		}
+		if !strings.Contains(HelpMessage(), c.syntax) {
+			t.Errorf("command %q is missing from the help", c.name)
+		}
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	for text, expected := range map[string]string{
+		"config": "config", "config mode reaction #general": "config mode", "configure": "", "status": "status",
+		"status please": "", "join all": "join", "join": "", "whitelist list": "whitelist list", "whitelist add a.com": "whitelist",
+		"help": "help", "help verbose": "help", "?": "help", "? join": "help", "helpme": "", "8.8.8.8": "",
+	} {
+		c := findCommand(text)
+		switch {
+		case c == nil && expected != "":
+			t.Errorf("findCommand(%s) expected %s but got nothing", text, expected)
+		case c != nil && c.name != expected:
+			t.Errorf("findCommand(%s) expected %q but got %s", text, expected, c.name)
+		}
+	}
+}
+
+func TestStripMention(t *testing.T) {
+	for text, expected := range map[string]string{
+		"<@UBOT> scan 8.8.8.8": "scan 8.8.8.8", "<@UBOT|dbot>: help": "help", "  <@UBOT>": "", "<@UBOT2> help": "-",
+		"hey <@UBOT> help": "-", "scan 8.8.8.8": "-",
+	} {
+		rest, ok := stripMention(text, "UBOT")
+		switch {
+		case expected == "-" && ok:
+			t.Errorf("stripMention(%s) expected no mention but got %q", text, rest)
+		case expected != "-" && (!ok || rest != expected):
+			t.Errorf("stripMention(%s) expected %q but got %q", text, expected, rest)
+		}
+	}
+}
+
+func TestMentionCommandsAreSafe(t *testing.T) {
+	for _, c := range commands {
+		if c.mention && c.configures {
+			t.Errorf("command %q changes the configuration and must not run from a mention", c.name)
+		}
+	}
+}
+
+func TestCommandHelp(t *testing.T) {
+	if h := commandHelp("verbose"); !strings.Contains(h, "verbose on #security") || !strings.Contains(h, "limited to workspace admins") {
+		t.Errorf("expected examples and the admin note in the verbose help but got %s", h)
+	}
+	if h := commandHelp("whitelist"); !strings.Contains(h, "whitelist list") || !strings.Contains(h, "whitelist add/remove") {
+		t.Errorf("expected both whitelist commands but got %s", h)
+	}
+	if h := commandHelp("?"); !strings.Contains(h, "help [command]") {
+		t.Errorf("expected the help for the alias but got %s", h)
+	}
+	if h := commandHelp("jion"); h != "" {
+		t.Errorf("expected no help for an unknown command but got %s", h)
+	}
+}
+
+func TestSuggestCommand(t *testing.T) {
+	for name, expected := range map[string]string{
+		"jion": "join", "verb": "verbose", "whitelst": "whitelist", "stat": "stats", "config modes": "config mode", "firewall": "",
+	} {
+		if s := suggestCommand(name); s != expected {
+			t.Errorf("suggestCommand(%s) = %q, expected %q", name, s, expected)
+		}
+	}
+}
+
+func TestUnknownCommandReply(t *testing.T) {
+	for text, expected := range map[string]string{
+		"joni #general": "Did you mean *join*?", "Verbos on #general": "Did you mean *verbose*?", "what is this?": "Send *help* to see all",
+	} {
+		if r := unknownCommandReply(text); !strings.Contains(r, expected) {
+			t.Errorf("unknownCommandReply(%s) = %q, expected it to contain %q", text, r, expected)
+		}
+	}
+}
+
+// fakeSlack answers the Web API calls of the commands and records the messages we posted
+type fakeSlack struct {
+	mux           sync.Mutex
+	posted        []string
+	admins        map[string]bool
+	conversations []interface{}
+}
+
+// newFakeSlack points the Slack client at a fake of the Web API, call the returned function to restore it
+func newFakeSlack(admins ...string) (*fakeSlack, func()) {
+	f := &fakeSlack{admins: make(map[string]bool)}
+	for _, admin := range admins {
+		f.admins[admin] = true
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]interface{}{"ok": true}
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "chat.postMessage":
+			var msg map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&msg)
+			f.mux.Lock()
+			f.posted = append(f.posted, fmt.Sprint(msg["text"]))
+			f.mux.Unlock()
+			res["ts"] = "9.9"
+		case "users.info":
+			res["user"] = map[string]interface{}{"is_admin": f.admins[r.URL.Query().Get("user")]}
+		case "conversations.list":
+			f.mux.Lock()
+			res["channels"] = append([]interface{}{}, f.conversations...)
+			f.mux.Unlock()
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	saved := slack.APIURL
+	slack.APIURL = srv.URL + "/"
+	return f, func() {
+		slack.APIURL = saved
+		srv.Close()
+	}
+}
+
+// repoBot is a bot that loads the team T1 from the repo
+func repoBot(r *repotest.Fake) *Bot {
+	b := queueBot(testQueue())
+	delete(b.subscriptions, "T1")
+	b.r, b.store = r, r
+	return b
+}
+
+func TestHandleMessageCommands(t *testing.T) {
+	s, done := newFakeSlack()
+	defer done()
+	r := repotest.New().
+		SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Status: domain.UserStatusActive, BotUserID: "UBOT", BotToken: "xoxb-1", ConfigAdmins: []string{"U1"}},
+			&domain.User{ID: "u1", ExternalID: "U1"}, &domain.User{ID: "u2", ExternalID: "U2"}).
+		SeedStatistics(time.Now(), &domain.Statistics{Team: "1", Messages: 7, URLsClean: 2})
+	b := repoBot(r)
+	b.dispatch = newDispatch(2, 10)
+	for _, e := range []string{
+		`{"type":"message","channel":"D1","user":"U1","text":"stats","ts":"1.1"}`,
+		`{"type":"message","channel":"D1","user":"U1","text":"mute <#C2|random> 2h","ts":"1.2"}`,
+		`{"type":"message","channel":"D2","user":"U2","text":"mute <#C3|soc> 2h","ts":"1.3"}`,
+		`{"type":"message","channel":"D2","user":"U2","text":"stats","ts":"1.4"}`,
+	} {
+		b.HandleMessage(event(t, e))
+	}
+	b.cancel()
+	b.startDispatch()
+	b.dispatching.Wait()
+
+	// The events of the team are handled in order so the replies are as well
+	expected := []string{"Here is what I checked for you", "Muted until", "Hi, I am dbot", "Sorry, only workspace admins", "Here is what I checked for you"}
+	if len(s.posted) != len(expected) {
+		t.Fatalf("expected %d replies but got %d - %q", len(expected), len(s.posted), s.posted)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(s.posted[i], prefix) {
+			t.Errorf("reply %d should start with %q - %s", i, prefix, s.posted[i])
+		}
+	}
+	if !strings.Contains(s.posted[0], "Messages            7") {
+		t.Errorf("expected the stats of the repo - %s", s.posted[0])
+	}
+	configuration, err := r.ChannelsAndGroups("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := configuration.Muted["C2"]; !ok || len(configuration.Muted) != 1 {
+		t.Errorf("expected only the mute of the admin to be stored - %v", configuration.Muted)
+	}
+	// U2 got the introduction with the first DM
+	if first, _ := r.MarkWelcomed("1", "U2"); first {
+		t.Error("expected U2 to be welcomed")
+	}
+}
+
+func TestConfigCommandsSwapConfiguration(t *testing.T) {
+	s, done := newFakeSlack()
+	defer done()
+	s.conversations = []interface{}{
+		map[string]interface{}{"id": "C1", "name": "general", "is_channel": true, "is_member": true},
+		map[string]interface{}{"id": "C2", "name": "random", "is_channel": true},
+	}
+	tests := []struct {
+		command string
+		run     func(b *Bot, team, text, channel string, sub *subscription)
+		check   func(c *domain.Configuration) bool
+	}{
+		{"verbose on <#C1|general> malicious", (*Bot).handleVerbose, func(c *domain.Configuration) bool {
+			return c.IsVerbose("C1") && c.Threshold("C1") == domain.ThresholdMalicious
+		}},
+		{"config mode reaction <#C1|general>", (*Bot).handleMode, func(c *domain.Configuration) bool {
+			return c.Mode("C1") == domain.ModeReaction
+		}},
+		{"mute <#C1|general> 2h", (*Bot).handleMute, func(c *domain.Configuration) bool {
+			return c.IsMuted("C1")
+		}},
+		{"unmute <#C2|random>", func(b *Bot, team, text, channel string, sub *subscription) {
+			b.handleMute(team, "mute <#C1|general>,<#C2|random> 2h", channel, sub)
+			b.handleUnmute(team, text, channel, b.relevantTeam(team))
+		}, func(c *domain.Configuration) bool {
+			return c.IsMuted("C1") && !c.IsMuted("C2")
+		}},
+		{"whitelist remove a.com", func(b *Bot, team, text, channel string, sub *subscription) {
+			b.handleWhitelist(team, "whitelist add a.com", channel, sub)
+			b.handleWhitelist(team, "whitelist add b.com", channel, b.relevantTeam(team))
+			b.handleWhitelist(team, text, channel, b.relevantTeam(team))
+		}, func(c *domain.Configuration) bool {
+			return reflect.DeepEqual(c.Whitelist, []string{"b.com"})
+		}},
+		{"verbose thread off <#C1|general>", func(b *Bot, team, text, channel string, sub *subscription) {
+			b.handleThread(team, "verbose thread on <#C1|general>,<#C2|random>", channel, sub)
+			b.handleThread(team, text, channel, b.relevantTeam(team))
+		}, func(c *domain.Configuration) bool {
+			return !c.IsThreaded("C1") && c.IsThreaded("C2")
+		}},
+		{"ignore remove <@U2>", func(b *Bot, team, text, channel string, sub *subscription) {
+			b.handleIgnore(team, "ignore add <@U2>", channel, sub)
+			b.handleIgnore(team, "ignore add <@U3>", channel, b.relevantTeam(team))
+			b.handleIgnore(team, text, channel, b.relevantTeam(team))
+		}, func(c *domain.Configuration) bool {
+			return !c.IsIgnored("U2") && c.IsIgnored("U3")
+		}},
+		{"fp a.com wrong --whitelist", func(b *Bot, team, text, channel string, sub *subscription) {
+			b.handleFP(team, slack.Response{"channel": channel, "user": "U1", "text": text}, sub)
+		}, func(c *domain.Configuration) bool {
+			return reflect.DeepEqual(c.Whitelist, []string{"a.com"})
+		}},
+		{"join <#C1|general>,<#C2|random>", (*Bot).joinChannels, func(c *domain.Configuration) bool {
+			return reflect.DeepEqual(c.Channels, []string{"C1", "C2"})
+		}},
+	}
+	for _, test := range tests {
+		r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Status: domain.UserStatusActive, BotUserID: "UBOT", BotToken: "xoxb-1", ConfigAdmins: []string{"U1"}},
+			&domain.User{ID: "u1", ExternalID: "U1"})
+		b := repoBot(r)
+		sub, err := b.loadSubscription("T1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A reply that started before the command keeps its configuration
+		old := sub.configuration.Clone()
+		test.run(b, "T1", test.command, "D1", sub)
+		if !reflect.DeepEqual(old, sub.configuration) {
+			t.Errorf("%s: the configuration the replies read was changed - %+v", test.command, sub.configuration)
+		}
+		if !test.check(b.relevantTeam("T1").configuration) {
+			t.Errorf("%s: expected the new configuration to be swapped in", test.command)
+		}
+		if stored, _ := r.ChannelsAndGroups("1"); !test.check(stored) {
+			t.Errorf("%s: expected the new configuration to be stored", test.command)
+		}
+	}
+}
+
+func TestExcludedChannelsSwapConfiguration(t *testing.T) {
+	s, done := newFakeSlack()
+	defer done()
+	s.conversations = []interface{}{
+		map[string]interface{}{"id": "C1", "name": "general", "is_channel": true, "is_member": true},
+		map[string]interface{}{"id": "C2", "name": "random", "is_channel": true},
+	}
+	r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Status: domain.UserStatusActive, BotUserID: "UBOT", BotToken: "xoxb-1"},
+		&domain.User{ID: "u1", ExternalID: "U1"}).
+		SeedConfiguration(&domain.Configuration{Team: "1", Channels: []string{"C1"}, AllPublicChannels: true, ExcludedChannels: []string{"C2"}})
+	b := repoBot(r)
+	// The sweep of the all public channels mode is not what we test
+	b.sweeping = map[string]bool{"T1": true}
+	sub, err := b.loadSubscription("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leaving excludes the channel and joining includes it again, a reply that started before keeps its configuration
+	old := sub.configuration.Clone()
+	b.leaveChannels("T1", "leave <#C1|general>", "D1", sub)
+	if !reflect.DeepEqual(old, sub.configuration) {
+		t.Errorf("leave: the configuration the replies read was changed - %+v", sub.configuration)
+	}
+	left := b.relevantTeam("T1")
+	if c := left.configuration; len(c.Channels) != 0 || !reflect.DeepEqual(c.ExcludedChannels, []string{"C2", "C1"}) {
+		t.Errorf("leave: expected the channel to be excluded - %+v", c)
+	}
+	old = left.configuration.Clone()
+	b.joinChannels("T1", "join <#C2|random>", "D1", left)
+	if !reflect.DeepEqual(old, left.configuration) {
+		t.Errorf("join: the configuration the replies read was changed - %+v", left.configuration)
+	}
+	if stored, _ := r.ChannelsAndGroups("1"); !reflect.DeepEqual(stored.Channels, []string{"C2"}) || !reflect.DeepEqual(stored.ExcludedChannels, []string{"C1"}) {
+		t.Errorf("join: expected the channel to be included again - %+v", stored)
+	}
+}
+
+func TestGreetChannelSwapConfiguration(t *testing.T) {
+	s, done := newFakeSlack()
+	defer done()
+	r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Status: domain.UserStatusActive, BotUserID: "UBOT", BotToken: "xoxb-1"},
+		&domain.User{ID: "u1", ExternalID: "U1"}).
+		SeedConfiguration(&domain.Configuration{Team: "1", AutoMonitorOnInvite: true})
+	b := repoBot(r)
+	sub, err := b.loadSubscription("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := sub.configuration.Clone()
+	b.greetChannel("T1", "C1", "U1", sub)
+	if !reflect.DeepEqual(old, sub.configuration) {
+		t.Errorf("the configuration the replies read was changed - %+v", sub.configuration)
+	}
+	if c := b.relevantTeam("T1").configuration; !reflect.DeepEqual(c.Channels, []string{"C1"}) {
+		t.Errorf("expected the invited channel to be monitored - %+v", c)
+	}
+	if len(s.posted) != 1 || !strings.HasPrefix(s.posted[0], "Thanks for inviting me") {
+		t.Errorf("expected a greeting but got %q", s.posted)
+	}
+}
@@ -0,0 +1,73 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/infinigo"
+)
+
+// cyScanner checks hashes with Cylance Infinity
+type cyScanner struct {
+	c       *infinigo.Client
+	teamKey string // Set if the key is the one of the team
+}
+
+// newCyScanner uses the team key if it has one, ours otherwise
+func newCyScanner(creds domain.Credentials) (Scanner, error) {
+	key := creds.Key
+	if key == "" {
+		key = conf.Options.Cy
+	}
+	c, err := infinigo.New(infinigo.SetKey(key), infinigo.SetErrorLog(log.New(conf.LogWriter, "CY:", log.Lshortfile)))
+	if err != nil {
+		return nil, err
+	}
+	return &cyScanner{c: c, teamKey: creds.Key}, nil
+}
+
+func (s *cyScanner) Name() string {
+	return domain.SourceCy
+}
+
+// breakerKey is per team key so a team with a bad key does not stop the checks of the others
+func (s *cyScanner) breakerKey() string {
+	return teamBreakerKey(domain.SourceCy, s.teamKey)
+}
+
+func (s *cyScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeHash
+}
+
+func (s *cyScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	rep := &domain.CyHashReply{}
+	res := domain.SourceResult{Result: domain.ResultUnknown, Report: rep}
+	resp, err := s.c.Query("", indicator.Value)
+	if err != nil {
+		rep.Error = err.Error()
+		return res, err
+	}
+	// Should be only one
+	for k := range resp {
+		rep.Result = resp[k]
+	}
+	setCyResult(&res, &rep.Result)
+	return res, nil
+}
+
+// setCyResult sets the result of the source from the Cylance reply, we upload the files it does not know yet
+func setCyResult(res *domain.SourceResult, r *infinigo.QueryResponse) {
+	if r.StatusCode != 1 {
+		res.NotFound, res.Result = true, domain.ResultUnknown
+		return
+	}
+	res.NotFound, res.Result = false, domain.ResultClean
+	if r.GeneralScore < cyScoreToConvict {
+		res.Result = domain.ResultDirty
+	}
+	res.Score, res.Link = fmt.Sprintf("%v", r.GeneralScore), "https://www.cylance.com"
+	res.Detail = "Classifiers: " + joinMapFloat32(r.Classifiers)
+}
@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+// digestTypes names the types of the convicted content in the digest
+var digestTypes = map[int]string{
+	domain.ReplyTypeHash:   "Hash",
+	domain.ReplyTypeURL:    "URL",
+	domain.ReplyTypeIP:     "IP",
+	domain.ReplyTypeFile:   "File",
+	domain.ReplyTypeDomain: "Domain",
+	domain.ReplyTypeEmail:  "Email",
+	domain.ReplyTypeWallet: "Wallet",
+}
+
+// formatDigest renders the daily summary. The permalink of the original message is optional.
+func formatDigest(d *domain.Digest, permalink func(channel, ts string) string) string {
+	s := d.Stats
+	lines := []string{
+		"*Daily dbot digest*",
+		fmt.Sprintf("Messages checked: %d", s.Messages),
+		fmt.Sprintf("URLs: %d (%d malicious)", s.URLsClean+s.URLsDirty+s.URLsUnknown, s.URLsDirty),
+		fmt.Sprintf("IPs: %d (%d malicious)", s.IPsClean+s.IPsDirty+s.IPsUnknown, s.IPsDirty),
+		fmt.Sprintf("Hashes: %d (%d malicious)", s.HashesClean+s.HashesDirty+s.HashesUnknown, s.HashesDirty),
+		fmt.Sprintf("Files: %d (%d malicious)", s.FilesClean+s.FilesDirty+s.FilesUnknown, s.FilesDirty),
+	}
+	if len(d.Malicious) == 0 {
+		return strings.Join(append(lines, "Nothing malicious was found."), "\n")
+	}
+	lines = append(lines, "*Top malicious findings:*")
+	for _, f := range d.Malicious {
+		kind, ok := digestTypes[f.ContentType]
+		if !ok {
+			kind = "Indicator"
+		}
+		content := f.Content
+		if f.ContentType == domain.ReplyTypeURL {
+			content = defangURL(content)
+		}
+		line := fmt.Sprintf("• %s %s seen %d time(s)", kind, content, f.Count)
+		if link := permalink(f.Channel, f.MessageID); link != "" {
+			line += fmt.Sprintf(" - <%s|last message>", link)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendDigests posts the daily digest of the teams that are due. It runs from the Start loop.
+func (b *Bot) sendDigests() {
+	now := time.Now()
+	var subs []*subscription
+	b.mu.RLock()
+	for _, sub := range b.subscriptions {
+		// Check what we know before going to the DB, a digest is due at most once a day
+		if sub.configuration.DigestDue(now, b.digested[sub.team.ID]) {
+			subs = append(subs, sub)
+		}
+	}
+	b.mu.RUnlock()
+	for _, sub := range subs {
+		last, err := b.r.LastDigest(sub.team.ID)
+		if err != nil {
+			teamLog(sub.team.ID, "").WithError(err).Warn("Unable to load the last digest")
+			continue
+		}
+		b.digested[sub.team.ID] = last
+		if !sub.configuration.DigestDue(now, last) {
+			continue
+		}
+		// Record it before posting so a restart or a failure never posts the digest twice
+		if err = b.r.SetLastDigest(sub.team.ID, now); err != nil {
+			teamLog(sub.team.ID, "").WithError(err).Warn("Unable to record the digest")
+			continue
+		}
+		b.digested[sub.team.ID] = now
+		digest, err := b.r.DigestForTeamSince(sub.team.ID, now.Add(-24*time.Hour))
+		if err != nil {
+			teamLog(sub.team.ID, "").WithError(err).Warn("Unable to load the digest")
+			continue
+		}
+		if !digest.Stats.HasSomething() && len(digest.Malicious) == 0 {
+			continue
+		}
+		text := formatDigest(digest, func(channel, ts string) string {
+			res, err := sub.s.Do("GET", "chat.getPermalink", map[string]string{"channel": channel, "message_ts": ts})
+			if err != nil {
+				return ""
+			}
+			return res.S("permalink")
+		})
+		color := sub.configuration.Severity(domain.Scores{Result: digest.Stats.Result()})
+		postMessage := map[string]interface{}{
+			"channel":     sub.configuration.DigestChannel,
+			"as_user":     true,
+			"text":        "Here is what I checked in the last day.",
+			"attachments": []map[string]interface{}{{"color": color, "text": text, "fallback": text, "mrkdwn_in": []string{"text"}}},
+		}
+		if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(sub.team.ID, sub.configuration.DigestChannel).WithError(err).Warn("Error posting digest to Slack")
+		}
+	}
+}
+
+// handleDigest sets the daily digest (digest #channel hour timezone) or turns it off (digest off).
+// Without a timezone we use the one of the user.
+func (b *Bot) handleDigest(team string, msg slack.Response, sub *subscription) {
+	channel := msg.S("channel")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	fields := strings.Fields(msg.S("text"))
+	c := *sub.configuration
+	understood := false
+	switch {
+	case len(fields) == 2 && strings.ToLower(fields[1]) == "off":
+		c.DigestChannel, c.DigestHour, c.DigestTimezone = "", 0, ""
+		understood = true
+	case len(fields) == 3 || len(fields) == 4:
+		_, channels, err := parseChannels(sub, fields[0]+" "+fields[1], 1)
+		hour, hourErr := strconv.Atoi(fields[2])
+		if err != nil || len(channels) != 1 || hourErr != nil {
+			break
+		}
+		c.DigestChannel, c.DigestHour, c.DigestTimezone = channels[0], hour, "UTC"
+		if len(fields) == 4 {
+			c.DigestTimezone = fields[3]
+		} else if info, err := sub.s.Do("GET", "users.info", map[string]string{"user": msg.S("user")}); err == nil && info.S("user.tz") != "" {
+			c.DigestTimezone = info.S("user.tz")
+		}
+		understood = true
+	}
+	var err error
+	switch {
+	case !understood:
+		postMessage["text"] = "I could not understand your command. Digest command is:\ndigest #channel hour timezone - to post a daily summary to the channel at the hour (0-23), e.g. digest #security 9 Europe/London. Without a timezone I use yours.\ndigest off - to stop the daily summary."
+	case c.ValidDigest() != nil:
+		postMessage["text"] = fmt.Sprintf("I could not set the digest - %v.", c.ValidDigest())
+	default:
+		*sub.configuration = c
+		if err = b.r.SetChannelsAndGroups(sub.configuration); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing digest")
+			postMessage["text"] = "I had an issue saving the digest."
+			break
+		}
+		if err = b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+		}
+		if c.DigestChannel == "" {
+			postMessage["text"] = "Daily digest is off."
+		} else {
+			postMessage["text"] = fmt.Sprintf("I will post a daily digest to <#%s> at %d:00 %s.", c.DigestChannel, c.DigestHour, c.DigestTimezone)
+		}
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting digest message to Slack")
+	}
+}
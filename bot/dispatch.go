@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"hash/fnv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/slack"
+)
+
+// newDispatch returns the event queues of the workers
+func newDispatch(workers, size int) []chan slack.Response {
+	if workers < 1 {
+		workers = 1
+	}
+	res := make([]chan slack.Response, workers)
+	for i := range res {
+		res[i] = make(chan slack.Response, size)
+	}
+	return res
+}
+
+// startDispatch starts a worker per event queue. They return when the bot is stopped and the queue is empty.
+func (b *Bot) startDispatch() {
+	b.dispatching.Add(len(b.dispatch))
+	for _, events := range b.dispatch {
+		go b.dispatchWorker(events)
+	}
+}
+
+func (b *Bot) dispatchWorker(events chan slack.Response) {
+	defer b.dispatching.Done()
+	for {
+		select {
+		case msg := <-events:
+			b.handleMessage(msg)
+		case <-b.ctx.Done():
+			// Handle what we already accepted
+			for {
+				select {
+				case msg := <-events:
+					b.handleMessage(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatchWorkerOf returns the worker handling the events of the team so they are handled in order
+func dispatchWorkerOf(team string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(team))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// HandleMessage queues the event for the worker of its team. If the worker is too far behind the event is dropped
+// so the Slack event source is never blocked.
+func (b *Bot) HandleMessage(msg slack.Response) {
+	if msg == nil {
+		return
+	}
+	team := msg.S("team_id")
+	if b.ctx.Err() != nil || len(b.dispatch) == 0 {
+		logrus.Warnf("Bot is not running, dropping event of team %s", team)
+		messagesTotal.Inc("dropped", metrics.Team(team))
+		return
+	}
+	select {
+	case b.dispatch[dispatchWorkerOf(team, len(b.dispatch))] <- msg:
+	default:
+		logrus.Warnf("Too many events waiting, dropping event of team %s", team)
+		messagesTotal.Inc("dropped", metrics.Team(team))
+		b.countDropped(team)
+	}
+}
+
+// countDropped adds the dropped event to the team statistics if we know the team
+func (b *Bot) countDropped(team string) {
+	sub := b.relevantTeam(team)
+	if sub == nil {
+		return
+	}
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	if stats, ok := b.stats[team]; ok {
+		stats.Dropped++
+	} else {
+		b.stats[team] = &domain.Statistics{Team: sub.team.ID, Dropped: 1}
+	}
+}
+
+// countExpired adds the work request the workers dropped from the queue to the team statistics if we know the team
+func (b *Bot) countExpired(team string) {
+	sub := b.relevantTeam(team)
+	if sub == nil {
+		return
+	}
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	if stats, ok := b.stats[team]; ok {
+		stats.Expired++
+	} else {
+		b.stats[team] = &domain.Statistics{Team: sub.team.ID, Expired: 1}
+	}
+}
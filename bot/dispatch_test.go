@@ -0,0 +1,46 @@
+package bot
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDispatchDrainsInOrder(t *testing.T) {
+	q := testQueue()
+	b := queueBot(q)
+	b.dispatch = newDispatch(3, 10)
+	for i := 0; i < 5; i++ {
+		b.HandleMessage(event(t, fmt.Sprintf(`{"type":"message","channel":"C1","user":"U1","text":"check 8.8.8.%d","ts":"1.%d"}`, i, i)))
+	}
+	// Stopped before the workers even started, they should still handle everything we accepted
+	b.cancel()
+	b.startDispatch()
+	b.dispatching.Wait()
+	work := pushedWork(q)
+	if len(work) != 5 {
+		t.Fatalf("expected all the events to be handled, got %d", len(work))
+	}
+	for i, w := range work {
+		if w.Text != fmt.Sprintf("check 8.8.8.%d", i) {
+			t.Errorf("event %d handled out of order - %s", i, w.Text)
+		}
+	}
+	b.HandleMessage(event(t, `{"type":"message","channel":"C1","user":"U1","text":"check 8.8.4.4","ts":"2.1"}`))
+	if len(b.dispatch[dispatchWorkerOf("T1", 3)]) != 0 {
+		t.Error("events should not be accepted after the bot stopped")
+	}
+}
+
+func TestDispatchDropsWhenFull(t *testing.T) {
+	b := queueBot(testQueue())
+	b.dispatch = newDispatch(1, 1)
+	msg := event(t, `{"type":"message","channel":"C1","user":"U1","text":"check 8.8.8.8","ts":"1.1"}`)
+	b.HandleMessage(msg)
+	b.HandleMessage(msg)
+	if len(b.dispatch[0]) != 1 {
+		t.Errorf("expected a single queued event, got %d", len(b.dispatch[0]))
+	}
+	if stats := b.stats["T1"]; stats == nil || stats.Dropped != 1 {
+		t.Errorf("expected the dropped event to be counted - %+v", stats)
+	}
+}
@@ -0,0 +1,227 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+)
+
+const (
+	// emailInterval is how often we email about the same indicator of a team so an incident does not become a storm
+	emailInterval = time.Hour
+	// emailQueueSize bounds the emails waiting to be sent, more are dropped
+	emailQueueSize = 100
+	// emailAttempts is how many times we try to send an email
+	emailAttempts = 3
+)
+
+// emailBackoff is the wait before the first retry, it doubles with every retry. Replaced by the tests.
+var emailBackoff = 5 * time.Second
+
+var emailsTotal = metrics.NewCounter("alfred_email_alerts_total", "Email alerts by the result of sending them", "result")
+
+// emailIndicator is a verdict in the email
+type emailIndicator struct {
+	Indicator string
+	Type      string
+	Verdict   string
+	Sources   map[string]string
+}
+
+// emailData is what the email template renders
+type emailData struct {
+	Team       string
+	Channel    string
+	User       string
+	Permalink  string
+	Indicators []emailIndicator
+}
+
+var emailTemplate = template.Must(template.New("email").Parse(`<html>
+<body style="font-family: sans-serif">
+<p>Alfred checked these indicators in a Slack message of {{.Team}}{{if .Channel}} in channel {{.Channel}}{{end}}{{if .User}} posted by {{.User}}{{end}}.</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Indicator</th><th>Type</th><th>Verdict</th><th>Sources</th></tr>
+{{range .Indicators}}<tr><td>{{.Indicator}}</td><td>{{.Type}}</td><td>{{.Verdict}}</td><td>{{range $name, $score := .Sources}}{{$name}}: {{$score}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{if .Permalink}}<p><a href="{{.Permalink}}">Open the message in Slack</a></p>{{end}}
+<p>You get this email because an admin of {{.Team}} added you to the Alfred email alerts.</p>
+</body>
+</html>
+`))
+
+// emailAlert is an email waiting to be sent
+type emailAlert struct {
+	team    string
+	to      []string
+	subject string
+	html    []byte
+}
+
+// mailer sends the email alerts in the background and limits them per indicator
+type mailer struct {
+	queue chan *emailAlert
+	mu    sync.Mutex
+	sent  map[string]time.Time // When we last emailed each team and indicator
+}
+
+func newMailer() *mailer {
+	return &mailer{queue: make(chan *emailAlert, emailQueueSize), sent: make(map[string]time.Time)}
+}
+
+// allow checks we did not email about the indicator of the team in the last interval and marks it sent
+func (m *mailer) allow(team, indicator string, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := team + "|" + indicator
+	if last, ok := m.sent[key]; ok && now.Sub(last) < emailInterval {
+		return false
+	}
+	m.sent[key] = now
+	return true
+}
+
+// expire forgets the indicators we can email about again
+func (m *mailer) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, last := range m.sent {
+		if now.Sub(last) >= emailInterval {
+			delete(m.sent, key)
+		}
+	}
+}
+
+// emailDisplay defangs the indicators mail clients would turn into links
+func emailDisplay(rec *domain.ScanRecord) string {
+	switch rec.IndicatorType {
+	case domain.ReplyTypeURL, domain.ReplyTypeDomain, domain.ReplyTypeIP, domain.ReplyTypeEmail:
+		return defangURL(rec.Indicator)
+	}
+	return rec.Indicator
+}
+
+// newEmailAlert renders the email about the records, they are all for the same message
+func newEmailAlert(records []domain.ScanRecord, alerts *domain.EmailAlerts, sub *subscription) (*emailAlert, error) {
+	data := emailData{Team: sub.team.Name, Channel: records[0].Channel, User: records[0].User, Permalink: records[0].Permalink}
+	for i := range records {
+		data.Indicators = append(data.Indicators, emailIndicator{Indicator: emailDisplay(&records[i]),
+			Type: indicatorTypeNames[records[i].IndicatorType], Verdict: verdictNames[records[i].Verdict], Sources: records[i].Scores})
+	}
+	var html bytes.Buffer
+	if err := emailTemplate.Execute(&html, &data); err != nil {
+		return nil, err
+	}
+	first := data.Indicators[0]
+	subject := fmt.Sprintf("Alfred: %s %s %s", first.Verdict, first.Type, first.Indicator)
+	if len(records) > 1 {
+		subject += fmt.Sprintf(" and %d more", len(records)-1)
+	}
+	return &emailAlert{team: sub.team.ExternalID, to: alerts.Recipients, subject: subject, html: html.Bytes()}, nil
+}
+
+// queueEmail queues an email about the verdicts of the reply that cross the threshold of the team, leaving out the
+// indicators we already emailed about in the last interval
+func (b *Bot) queueEmail(reply *domain.WorkReply, ctx *domain.Context, sub *subscription) {
+	if sub.emails == nil || conf.Options.SMTP.Host == "" {
+		return
+	}
+	now := time.Now()
+	var records []domain.ScanRecord
+	for _, rec := range scanRecords(reply, ctx, sub) {
+		if !sub.emails.Sends(rec.Verdict) {
+			continue
+		}
+		if !b.mailer.allow(sub.team.ExternalID, rec.Normalized, now) {
+			emailsTotal.Inc("rate_limited")
+			continue
+		}
+		records = append(records, rec)
+	}
+	if len(records) == 0 {
+		return
+	}
+	alert, err := newEmailAlert(records, sub.emails, sub)
+	if err != nil {
+		replyLog(reply, ctx).WithError(err).Warn("Unable to render email alert")
+		return
+	}
+	select {
+	case b.mailer.queue <- alert:
+	default:
+		emailsTotal.Inc("dropped")
+		replyLog(reply, ctx).Warn("Too many emails waiting, dropping email alert")
+	}
+}
+
+// startEmails starts the worker sending the emails. It returns when the bot is stopped.
+func (b *Bot) startEmails() {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			select {
+			case alert := <-b.mailer.queue:
+				b.sendEmail(alert)
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// sendEmail tries to send the email with exponential backoff
+func (b *Bot) sendEmail(alert *emailAlert) {
+	wait := emailBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = smtpSend(alert); err == nil || attempt == emailAttempts {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-b.ctx.Done():
+			return
+		}
+		wait *= 2
+	}
+	if err != nil {
+		emailsTotal.Inc("failed")
+		teamLog(alert.team, "").WithError(err).Warn("Unable to send email alert")
+		return
+	}
+	emailsTotal.Inc("sent")
+}
+
+// smtpSend sends the HTML email through the configured server
+func smtpSend(alert *emailAlert) error {
+	from, err := mail.ParseAddress(conf.Options.SMTP.From)
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(alert.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", alert.subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=\"utf-8\"\r\n\r\n")
+	msg.Write(alert.html)
+	var auth smtp.Auth
+	if conf.Options.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", conf.Options.SMTP.Username, conf.Options.SMTP.Password, conf.Options.SMTP.Host)
+	}
+	addr := net.JoinHostPort(conf.Options.SMTP.Host, strconv.Itoa(conf.Options.SMTP.Port))
+	return smtp.SendMail(addr, auth, from.Address, alert.to, msg.Bytes())
+}
@@ -0,0 +1,146 @@
+package bot
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// smtpServer is a minimal local SMTP server that records the messages and rejects the first given number of them
+type smtpServer struct {
+	ln       net.Listener
+	messages chan string
+	failures int32
+	calls    int32
+}
+
+func newSMTPServer(t *testing.T, failures int32) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln, messages: make(chan string, 10), failures: failures}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(textproto.NewConn(conn))
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) handle(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("220 localhost ESMTP test")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			if atomic.AddInt32(&s.calls, 1) <= s.failures {
+				c.PrintfLine("451 try again later")
+				continue
+			}
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(data)
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+// useSMTP points the configuration to the server until the returned function is called
+func useSMTP(addr string) func() {
+	saved := conf.Options.SMTP
+	host, port, _ := net.SplitHostPort(addr)
+	conf.Options.SMTP.Host, conf.Options.SMTP.From = host, "Alfred <alfred@example.com>"
+	conf.Options.SMTP.Port, _ = strconv.Atoi(port)
+	return func() { conf.Options.SMTP = saved }
+}
+
+func emailSub() *subscription {
+	return &subscription{team: &domain.Team{ID: "1", ExternalID: "T1", Name: "acme", Domain: "acme"}, configuration: &domain.Configuration{},
+		emails: &domain.EmailAlerts{Recipients: []string{"ciso@example.com"}, Threshold: domain.ThresholdMalicious}}
+}
+
+func TestSendEmail(t *testing.T) {
+	defer func(backoff time.Duration) { emailBackoff = backoff }(emailBackoff)
+	emailBackoff = time.Millisecond
+	srv := newSMTPServer(t, 1)
+	defer srv.ln.Close()
+	defer useSMTP(srv.ln.Addr().String())()
+	b := queueBot(testQueue())
+	reply := &domain.WorkReply{Type: domain.ReplyTypeURL, URLs: []domain.URLReply{{Details: "http://evil.com", Result: domain.ResultDirty}}}
+	b.queueEmail(reply, &domain.Context{Team: "T1", Channel: "C1", OriginalUser: "U1", TS: "1514764800.000100"}, emailSub())
+	if len(b.mailer.queue) != 1 {
+		t.Fatalf("expected an email but got %d", len(b.mailer.queue))
+	}
+	b.sendEmail(<-b.mailer.queue)
+	if atomic.LoadInt32(&srv.calls) != 2 {
+		t.Errorf("expected a retry after the rejection but got %d attempts", atomic.LoadInt32(&srv.calls))
+	}
+	select {
+	case msg := <-srv.messages:
+		for _, expected := range []string{"To: ciso@example.com", "Subject: Alfred: Malicious url http[://]evil[.]com", "Content-Type: text/html",
+			"https://acme.slack.com/archives/C1/p1514764800000100", "<td>Malicious</td>"} {
+			if !strings.Contains(msg, expected) {
+				t.Errorf("expected %q in the email:\n%s", expected, msg)
+			}
+		}
+		if strings.Contains(msg, "http://evil.com") {
+			t.Error("the indicator should be defanged")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the email was not sent")
+	}
+}
+
+func TestQueueEmailRateLimit(t *testing.T) {
+	defer useSMTP("127.0.0.1:25")()
+	b := queueBot(testQueue())
+	sub := emailSub()
+	ctx := &domain.Context{Team: "T1", Channel: "C1"}
+	dirty := func(indicator string) *domain.WorkReply {
+		return &domain.WorkReply{Type: domain.ReplyTypeURL, URLs: []domain.URLReply{{Details: indicator, Result: domain.ResultDirty}}}
+	}
+	b.queueEmail(dirty("http://evil.com"), ctx, sub)
+	// The same indicator in another form is limited as well
+	b.queueEmail(dirty("HTTP://EVIL.COM/"), ctx, sub)
+	b.queueEmail(&domain.WorkReply{Type: domain.ReplyTypeIP, IPs: []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}}, ctx, sub)
+	if len(b.mailer.queue) != 1 {
+		t.Fatalf("expected a single email but got %d", len(b.mailer.queue))
+	}
+	b.queueEmail(dirty("http://other.com"), ctx, sub)
+	if len(b.mailer.queue) != 2 {
+		t.Errorf("another indicator should be emailed but got %d emails", len(b.mailer.queue))
+	}
+	b.mailer.expire(time.Now().Add(emailInterval))
+	b.queueEmail(dirty("http://evil.com"), ctx, sub)
+	if len(b.mailer.queue) != 3 {
+		t.Errorf("the indicator should be emailed again after the interval but got %d emails", len(b.mailer.queue))
+	}
+}
@@ -0,0 +1,57 @@
+package bot
+
+import (
+	"path"
+	"strings"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// defaultMaxFileSize we are willing to download if it is not configured
+const defaultMaxFileSize = 30 * 1024 * 1024
+
+// maxFileSize we are willing to download
+func maxFileSize() int {
+	if conf.Options.Files.MaxSize > 0 {
+		return conf.Options.Files.MaxSize
+	}
+	return defaultMaxFileSize
+}
+
+// archiveTypes are the Slack file types and mime types of archives
+var archiveTypes = map[string]bool{
+	"zip": true, "rar": true, "7z": true, "gzip": true, "tar": true, "bz2": true, "xz": true, "cab": true, "iso": true,
+	"application/zip": true, "application/x-zip-compressed": true, "application/vnd.rar": true, "application/x-rar-compressed": true,
+	"application/x-7z-compressed": true, "application/gzip": true, "application/x-gzip": true, "application/x-tar": true,
+	"application/x-bzip2": true, "application/x-xz": true, "application/vnd.ms-cab-compressed": true, "application/x-iso9660-image": true,
+}
+
+// isArchive checks the type of the file, the contents of archives are not scanned
+func isArchive(f domain.File) bool {
+	return archiveTypes[strings.ToLower(f.FileType)] || archiveTypes[strings.ToLower(f.MimeType)]
+}
+
+// matchesFileType checks the Slack file type and the mime type of the file against the types, mime types can have
+// wildcards (video/*)
+func matchesFileType(f domain.File, types []string) bool {
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == strings.ToLower(f.FileType) {
+			return true
+		}
+		if ok, _ := path.Match(t, strings.ToLower(f.MimeType)); ok && f.MimeType != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// fileExcluded checks if the type of the file is denied or not allowed
+func fileExcluded(f domain.File) bool {
+	if matchesFileType(f, conf.Options.Files.DeniedTypes) {
+		return true
+	}
+	allowed := conf.Options.Files.AllowedTypes
+	return len(allowed) > 0 && !matchesFileType(f, allowed)
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"crypto/md5"
+	"crypto/sha512"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+func TestFileTypes(t *testing.T) {
+	saved := conf.Options.Files
+	defer func() { conf.Options.Files = saved }()
+	conf.Options.Files.DeniedTypes, conf.Options.Files.AllowedTypes = []string{"video/*", "exe"}, nil
+	tests := []struct {
+		file     domain.File
+		excluded bool
+		archive  bool
+	}{
+		{domain.File{FileType: "mp4", MimeType: "video/mp4"}, true, false},
+		{domain.File{FileType: "exe"}, true, false},
+		{domain.File{FileType: "pdf", MimeType: "application/pdf"}, false, false},
+		{domain.File{FileType: "zip", MimeType: "application/zip"}, false, true},
+		{domain.File{FileType: "binary", MimeType: "application/x-rar-compressed"}, false, true},
+		{domain.File{}, false, false},
+	}
+	for _, test := range tests {
+		if excluded, archive := fileExcluded(test.file), isArchive(test.file); excluded != test.excluded || archive != test.archive {
+			t.Errorf("%+v: expected excluded %v and archive %v but got %v and %v", test.file, test.excluded, test.archive, excluded, archive)
+		}
+	}
+	// Only the allowed types are downloaded if there are any
+	conf.Options.Files.AllowedTypes = []string{"application/*"}
+	if fileExcluded(domain.File{MimeType: "application/pdf"}) || !fileExcluded(domain.File{FileType: "png", MimeType: "image/png"}) {
+		t.Error("expected only the allowed types")
+	}
+}
+
+func TestHandleSkippedFile(t *testing.T) {
+	saved := conf.Options.Files
+	defer func() { conf.Options.Files = saved }()
+	conf.Options.Files.MaxSize, conf.Options.Files.DeniedTypes = 1024, []string{"video/*"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected download of %s", r.URL.Path)
+	}))
+	defer srv.Close()
+	s := &fakeScanner{name: domain.SourceURLhaus, types: []int{domain.ReplyTypeHash}, res: domain.SourceResult{Result: domain.ResultDirty, Score: "Emotet"}}
+	w := &Worker{scanners: map[string]Scanner{domain.SourceURLhaus: s}}
+	// Too large, the hash from the event convicts it
+	reply := &domain.WorkReply{}
+	w.handleFile(&domain.WorkRequest{Type: "file", File: domain.File{Name: "big.zip", FileType: "zip", Size: 2048, URL: srv.URL + "/big",
+		Hash: "44d88612fea8a8f36de82e1278abb02f"}}, reply)
+	if !reply.File.FileTooLarge || !reply.File.Archive || len(reply.Hashes) != 1 || reply.File.Result != domain.ResultDirty {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	f := fileFinding(defaultLocale, reply, "https://example.com/details")
+	if !strings.Contains(f.comment, "is malicious") || !strings.Contains(f.comment, "archive") || len(f.sources) != 1 {
+		t.Errorf("unexpected finding %+v", f)
+	}
+	// Excluded without a hash, there is nothing to look up
+	reply = &domain.WorkReply{}
+	w.handleFile(&domain.WorkRequest{Type: "file", File: domain.File{Name: "movie.mp4", FileType: "mp4", MimeType: "video/mp4", Size: 100,
+		URL: srv.URL + "/movie"}}, reply)
+	if !reply.File.Excluded || reply.File.FileTooLarge || len(reply.Hashes) != 0 || reply.File.Result != domain.ResultUnknown {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	f = fileFinding(defaultLocale, reply, fileLink(reply, "T1"))
+	if f.verdict != "Not analyzed" || !strings.Contains(f.comment, "type we do not analyze") || len(f.sources) != 0 {
+		t.Errorf("unexpected finding %+v", f)
+	}
+}
+
+func TestSHA512OfDownloadedFile(t *testing.T) {
+	defer withScanCache()()
+	content := []byte("MZ not really an executable")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer srv.Close()
+	s := &recordingScanner{fakeScanner: fakeScanner{name: domain.SourceURLhaus, types: []int{domain.ReplyTypeHash},
+		res: domain.SourceResult{Result: domain.ResultDirty, Score: "Emotet"}}}
+	w := &Worker{scanners: map[string]Scanner{domain.SourceURLhaus: s}}
+	sha := fmt.Sprintf("%x", sha512.Sum512(content))
+	// Before we see the file there is nothing to look it up with
+	reply := &domain.WorkReply{}
+	w.handleHashes(&domain.WorkRequest{Hashes: []domain.Hash{{Value: sha, Type: domain.HashSHA512}}}, reply)
+	if len(reply.Hashes) != 1 || !reply.Hashes[0].Unsupported || len(s.values) != 0 {
+		t.Fatalf("expected an unsupported hash but got %+v", reply.Hashes)
+	}
+	w.handleFile(&domain.WorkRequest{Type: "file", File: domain.File{Name: "a.bin", Size: len(content), URL: srv.URL + "/a"}}, &domain.WorkReply{})
+	reply = &domain.WorkReply{}
+	w.handleHashes(&domain.WorkRequest{Hashes: []domain.Hash{{Value: sha, Type: domain.HashSHA512}}}, reply)
+	md5sum := fmt.Sprintf("%x", md5.Sum(content))
+	if len(reply.Hashes) != 1 || reply.Hashes[0].Unsupported || reply.Hashes[0].Result != domain.ResultDirty || reply.Hashes[0].Details != sha {
+		t.Errorf("expected the SHA-512 to be looked up by the MD5 of the file but got %+v", reply.Hashes)
+	}
+	// The result of the MD5 from the file is cached so the sources were only asked once
+	if len(s.values) != 1 || s.values[0] != md5sum {
+		t.Errorf("expected the sources to get the MD5 but got %v", s.values)
+	}
+}
+
+func TestSnippetScanSettings(t *testing.T) {
+	s := &fakeScanner{name: domain.SourceURLhaus, types: []int{domain.ReplyTypeIP, domain.ReplyTypeDomain}, res: domain.SourceResult{Result: domain.ResultClean}}
+	w := &Worker{scanners: map[string]Scanner{domain.SourceURLhaus: s}}
+	content := "seen 8.8.8.8 and 1.1.1.1 on evil.com"
+	reply := w.handleSnippet(&domain.WorkRequest{Type: "file"}, content)
+	if reply == nil || len(reply.IPs) != 2 || len(reply.Domains) != 1 {
+		t.Fatalf("expected the defaults to find both IPs and the domain - %+v", reply)
+	}
+	settings := (&domain.Configuration{Whitelist: []string{"1.1.1.1"}, DisableDomains: true, ReplyMode: map[string]string{"C1": "reaction"}}).ScanSettings()
+	reply = w.handleSnippet(&domain.WorkRequest{Type: "file", ScanSettings: settings}, content)
+	if reply == nil || len(reply.IPs) != 1 || reply.IPs[0].Details != "8.8.8.8" || len(reply.Domains) != 0 {
+		t.Errorf("expected the whitelist and the disabled domains of the team - %+v", reply)
+	}
+	if settings.ReplyMode != nil {
+		t.Error("expected only the scan settings to be sent to the workers")
+	}
+}
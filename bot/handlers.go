@@ -2,11 +2,13 @@ package bot
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha512"
 	"debug/pe"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"runtime"
@@ -18,7 +20,8 @@ import (
 	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
 	"github.com/demisto/alfred/queue"
-	"github.com/demisto/goxforce"
+	"github.com/demisto/alfred/repo"
+	"github.com/demisto/alfred/util"
 	"github.com/demisto/infinigo"
 	stackerr "github.com/go-errors/errors"
 	"github.com/slavikm/govt"
@@ -31,47 +34,76 @@ const (
 	cyScoreToConvict                = -0.5
 )
 
+// webhookClient is used to forward custom pattern matches and verdicts to the webhooks of the teams
+var webhookClient = util.PublicClient(10 * time.Second)
+
+// customPayload is posted to the team webhook when custom patterns match
+type customPayload struct {
+	Team      string               `json:"team"`
+	Channel   string               `json:"channel"`
+	User      string               `json:"user"`
+	MessageID string               `json:"message_id"`
+	Matches   []domain.CustomMatch `json:"matches"`
+}
+
 // Worker reads messages from the queue and does the actual work
 type Worker struct {
-	q    queue.Queue
-	c    chan *domain.WorkRequest
-	xfe  *goxforce.Client
-	vt   *govt.Client
-	cy   *infinigo.Client
-	clam *clamEngine
+	q        queue.Queue
+	c        chan *domain.WorkRequest
+	scanners map[string]Scanner // The reputation sources with our credentials by name
+	cy       *infinigo.Client   // Uploads the files Cylance does not know yet
+	nvd      *nvdClient
+	abuse    *abuseClient
+	clam     *clamEngine
+	dead     deadLetterStore
+	runs     sandboxStore
+	// ctx is done when the worker stops, the sandbox analyses stop waiting for their verdicts
+	ctx    context.Context
+	cancel context.CancelFunc
+	// sandboxSlots bound the files the worker runs in the sandboxes at the same time, sandboxes waits for them to stop
+	sandboxSlots chan struct{}
+	sandboxes    sync.WaitGroup
 }
 
 // NewWorker that loads work messages from the queue
-func NewWorker(q queue.Queue) (*Worker, error) {
-	xfe, err := goxforce.New(
-		goxforce.SetCredentials(conf.Options.XFE.Key, conf.Options.XFE.Password),
-		goxforce.SetErrorLog(log.New(conf.LogWriter, "XFE:", log.Lshortfile)))
+func NewWorker(q queue.Queue, r repo.Repo) (*Worker, error) {
+	defaults, err := defaultScanners()
 	if err != nil {
 		return nil, err
 	}
-	vt, err := govt.New(
-		govt.SetApikey(conf.Options.VT),
-		govt.SetErrorLog(log.New(conf.LogWriter, "VT:", log.Lshortfile)))
-	if err != nil {
+	if scanResults, err = newScanCache(); err != nil {
 		return nil, err
 	}
-	cy, err := infinigo.New(
-		infinigo.SetKey(conf.Options.Cy),
-		infinigo.SetErrorLog(log.New(conf.LogWriter, "VT:", log.Lshortfile)))
-	if err != nil {
-		return nil, err
+	// A nil repository must not turn into a store that is not nil
+	var store breakerStore
+	var dead deadLetterStore
+	var runs sandboxStore
+	if r != nil {
+		store, dead, runs = r, r, r
 	}
+	configureSources(store)
 	clam, err := newClamEngine()
 	if err != nil {
 		return nil, err
 	}
+	concurrency := conf.Options.Sandbox.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Worker{
-		q:    q,
-		c:    make(chan *domain.WorkRequest, runtime.NumCPU()),
-		xfe:  xfe,
-		vt:   vt,
-		cy:   cy,
-		clam: clam,
+		q:            q,
+		c:            make(chan *domain.WorkRequest, runtime.NumCPU()),
+		scanners:     defaults,
+		cy:           defaults[domain.SourceCy].(*cyScanner).c,
+		nvd:          newNVDClient(conf.Options.NVD.URL, conf.Options.NVD.Key),
+		abuse:        newAbuseClient(conf.Options.ChainAbuse.URL, conf.Options.ChainAbuse.Key),
+		clam:         clam,
+		dead:         dead,
+		runs:         runs,
+		ctx:          ctx,
+		cancel:       cancel,
+		sandboxSlots: make(chan struct{}, concurrency),
 	}, nil
 }
 
@@ -83,37 +115,104 @@ func (w *Worker) handle() {
 		}
 		if msg.ReplyQueue == "" {
 			logrus.Warnf("got message without a reply queue destination %+v", msg)
+			w.ack(msg)
 			continue
 		}
-		reply := &domain.WorkReply{Context: msg.Context, MessageID: msg.MessageID}
-		switch msg.Type {
-		case "message":
-			if strings.Contains(msg.Text, "<http") {
-				w.handleURL(msg, reply)
-			}
-			if ipReg.MatchString(msg.Text) {
-				w.handleIP(msg, reply)
-			}
-			if md5Reg.MatchString(msg.Text) || sha1Reg.MatchString(msg.Text) || sha256Reg.MatchString(msg.Text) {
-				w.handleHashes(msg, reply)
+		if msg.Type == "sandbox" {
+			// The sandbox takes minutes so it replies on its own and the rest of the work does not wait for it. The
+			// analysis outlives the reservation, it is acknowledged once it starts and pushed again if the worker stops.
+			if !w.startSandbox(msg) {
+				w.nack(msg, 0)
+				continue
 			}
-		case "file":
-			w.handleFile(msg, reply)
+			w.ack(msg)
+			continue
 		}
-		if err := w.q.PushWorkReply(msg.ReplyQueue, reply); err != nil {
-			logrus.WithError(err).Warnf("error pushing message to reply queue %+v", msg)
+		if now := time.Now(); msg.Expired(now) {
+			w.expired(msg, now)
+			continue
+		}
+		if msg.Attempts > 0 && msg.Attempts >= conf.Options.Retries.MaxAttempts {
+			w.crashed(msg)
+			continue
+		}
+		if err := w.work(msg); err != nil {
+			w.failed(msg, err)
+			continue
+		}
+		w.ack(msg)
+	}
+}
+
+// textFileTypes are the Slack file types we scan for indicators in addition to the hash checks
+var textFileTypes = map[string]bool{"text": true, "csv": true, "log": true}
+
+// handleMessage checks the indicators of each type at the same time and merges their results into the single reply
+// in a fixed order. A panic of a check is raised again once they are all done so work returns it.
+func (w *Worker) handleMessage(msg *domain.WorkRequest, reply *domain.WorkReply) {
+	var checks []func(*domain.WorkRequest, *domain.WorkReply)
+	if len(msg.URLs) > 0 || msg.Online && len(extractURLs(msg.Text)) > 0 {
+		checks = append(checks, w.handleURL)
+	}
+	// Requests from the details page do not go through the bot so the IPs are not extracted
+	if len(msg.IPs) > 0 || msg.Online && ipReg.MatchString(msg.Text) {
+		checks = append(checks, w.handleIP)
+	}
+	if len(msg.Hashes) > 0 || msg.Online && len(extractHashes(msg.Text)) > 0 {
+		checks = append(checks, w.handleHashes)
+	}
+	if len(msg.Domains) > 0 {
+		checks = append(checks, w.handleDomains)
+	}
+	if len(msg.Emails) > 0 {
+		checks = append(checks, w.handleEmails)
+	}
+	if len(msg.CVEs) > 0 {
+		checks = append(checks, w.handleCVEs)
+	}
+	if len(msg.Wallets) > 0 {
+		checks = append(checks, w.handleWallets)
+	}
+	if len(msg.Custom) > 0 {
+		checks = append(checks, w.handleCustom)
+	}
+	parts := make([]*domain.WorkReply, len(checks))
+	panics := make([]interface{}, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		parts[i] = &domain.WorkReply{}
+		wg.Add(1)
+		go func(i int, check func(*domain.WorkRequest, *domain.WorkReply)) {
+			defer wg.Done()
+			defer func() { panics[i] = recover() }()
+			check(msg, parts[i])
+		}(i, check)
+	}
+	wg.Wait()
+	for i, part := range parts {
+		if panics[i] != nil {
+			panic(panics[i])
 		}
+		reply.Type |= part.Type
+		reply.URLs = append(reply.URLs, part.URLs...)
+		reply.IPs = append(reply.IPs, part.IPs...)
+		reply.Hashes = append(reply.Hashes, part.Hashes...)
+		reply.Domains = append(reply.Domains, part.Domains...)
+		reply.Emails = append(reply.Emails, part.Emails...)
+		reply.CVEs = append(reply.CVEs, part.CVEs...)
+		reply.Wallets = append(reply.Wallets, part.Wallets...)
+		reply.Custom = append(reply.Custom, part.Custom...)
 	}
 }
 
-// Start the worker process. To stop, just close the queue.
+// Start the worker process. To stop, call Stop or close the queue.
 func (w *Worker) Start() {
 	// Right now, just use the number of CPUs
 	for i := 0; i < runtime.NumCPU(); i++ {
 		go w.handle()
 	}
 	for {
-		msg, err := w.q.PopWork(0)
+		msg, err := w.q.PopWork(w.ctx)
 		if err != nil || msg == nil {
 			logrus.Infof("stopping WorkManager process - %v, %v", err, msg)
 			close(w.c)
@@ -124,251 +223,283 @@ func (w *Worker) Start() {
 	}
 }
 
-func (w *Worker) localVTXfe(request *domain.WorkRequest) (*goxforce.Client, *govt.Client) {
-	vt := w.vt
-	if request.VTKey != "" {
-		vtTmp, err := govt.New(
-			govt.SetApikey(request.VTKey),
-			govt.SetErrorLog(log.New(conf.LogWriter, "VT:", log.Lshortfile)))
-		if err == nil {
-			vt = vtTmp
-		}
-	}
-	xfe := w.xfe
-	if request.XFEKey != "" && request.XFEPass != "" {
-		xfeTmp, err := goxforce.New(
-			goxforce.SetCredentials(request.XFEKey, request.XFEPass),
-			goxforce.SetErrorLog(log.New(conf.LogWriter, "XFE:", log.Lshortfile)))
-		if err == nil {
-			xfe = xfeTmp
-		}
-	}
-	return xfe, vt
+// Stop the worker, it stops taking work and waits for the sandbox analyses to push their requests again
+func (w *Worker) Stop() {
+	w.cancel()
+	w.sandboxes.Wait()
 }
 
 func (w *Worker) handleURL(request *domain.WorkRequest, reply *domain.WorkReply) {
-	text := request.Text
-	online := request.Online
-	xfe, vt := w.localVTXfe(request)
-	for {
-		start := strings.Index(text, "<http")
-		if start < 0 {
-			break
-		}
-		end := strings.Index(text[start:], ">")
-		if end < start {
-			break
-		}
-		end = end + start
-		realEnd := end
-		filter := strings.Index(text[start:end], "|")
-		if filter > 0 {
-			end = start + filter
+	set := w.scanSet(request)
+	urls := request.URLs
+	if len(urls) == 0 {
+		urls = extractURLs(request.Text)
+	}
+	// Internal URLs never leave the team so the sources do not learn the internal host names
+	internal := make([]bool, len(urls))
+	var indicators []scanIndicator
+	for i, url := range urls {
+		if internal[i] = internalURL(url, request.InternalDomains); !internal[i] {
+			indicators = append(indicators, newScanIndicator(request, domain.ReplyTypeURL, url))
 		}
-		url := text[start+1 : end]
+	}
+	sources := scanAll(set, domain.ReplyTypeURL, indicators)
+	for i, url := range urls {
 		logrus.Debugf("URL found - %s\n", url)
-		text = text[realEnd:]
-		reply.URLs = append(reply.URLs, domain.URLReply{})
-		counter := len(reply.URLs) - 1
-		reply.URLs[counter].Details = url
 		reply.Type |= domain.ReplyTypeURL
-		// Do the network commands in parallel
-		var wg sync.WaitGroup
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			urlResp, err := xfe.URL(url)
-			if err != nil {
-				// Small hack - see if the URL was not found
-				if strings.Contains(err.Error(), "404") {
-					reply.URLs[counter].XFE.NotFound = true
-				} else {
-					reply.URLs[counter].XFE.Error = err.Error()
-				}
-			} else {
-				reply.URLs[counter].XFE.URLDetails = urlResp.Result
-			}
-			resolve, err := xfe.Resolve(url)
-			if err == nil {
-				reply.URLs[counter].XFE.Resolve = *resolve
-			}
-			if online {
-				malware, err := xfe.URLMalware(url)
-				if err == nil {
-					reply.URLs[counter].XFE.URLMalware = *malware
-				}
-			}
-		}()
-		go func() {
-			defer wg.Done()
-			vtResp, err := vt.GetUrlReport(url)
-			if err != nil {
-				reply.URLs[counter].VT.Error = err.Error()
-			} else {
-				reply.URLs[counter].VT.URLReport = *vtResp
-			}
-		}()
-		wg.Wait()
-		if reply.URLs[counter].XFE.URLDetails.Score >= xfeScoreToConvict || reply.URLs[counter].VT.URLReport.Positives >= numOfPositivesToConvict {
-			// This is known bad scenario
-			reply.URLs[counter].Result = domain.ResultDirty
-		} else if !reply.URLs[counter].XFE.NotFound || reply.URLs[counter].VT.URLReport.ResponseCode == 1 {
-			// At least one of reputation services found this to be known good
-			// Keep the default
-			reply.URLs[counter].Result = domain.ResultClean
+		res := domain.URLReply{Details: url, Internal: internal[i]}
+		if res.Internal {
+			res.Result, res.XFE.NotFound = domain.ResultClean, true
+			reply.URLs = append(reply.URLs, res)
+			continue
+		}
+		res.Sources, sources = sources[0], sources[1:]
+		scoreURL(&request.Scoring, &res)
+		reply.URLs = append(reply.URLs, res)
+	}
+}
+
+// scoreURL sets the verdict of the URL and the reports of the sources from its results
+func scoreURL(scoring *domain.ScoringProfile, res *domain.URLReply) {
+	// URLs none of the sources know are clean
+	res.Result = scoring.Verdict(res.Sources, domain.ResultClean)
+	res.XFE.NotFound = true
+	for _, s := range res.Sources {
+		switch r := s.Report.(type) {
+		case *domain.XfeURLReply:
+			res.XFE = *r
+		case *domain.VtURLReply:
+			res.VT = *r
 		}
 	}
 }
 
 func (w *Worker) handleIP(request *domain.WorkRequest, reply *domain.WorkReply) {
-	text := request.Text
-	online := request.Online
-	xfe, vt := w.localVTXfe(request)
-	ips := ipReg.FindAllString(text, -1)
+	set := w.scanSet(request)
+	ips := request.IPs
+	if len(ips) == 0 {
+		ips = ipReg.FindAllString(request.Text, -1)
+	}
 	for _, ip := range ips {
-		reply.IPs = append(reply.IPs, domain.IPReply{})
-		counter := len(reply.IPs) - 1
-		reply.IPs[counter].Details = ip
 		reply.Type |= domain.ReplyTypeIP
+		res := domain.IPReply{Details: ip}
+		res.XFE.NotFound = true
 		// First, let's check if IP is globally unicast addressable and is public
-		ipData := net.ParseIP(ip)
-		ipv4 := ipData.To4()
-		if ipv4 == nil {
-			// If not IPv4 then return - by default it will be marked clean
-			reply.IPs[counter].XFE.NotFound = true
-			return
+		if net.ParseIP(ip).To4() == nil {
+			// If not IPv4 then skip - by default it will be marked clean
+			reply.IPs = append(reply.IPs, res)
+			continue
 		}
-		if !ipv4.IsGlobalUnicast() {
-			// If not global unicast ignore
-			reply.IPs[counter].XFE.NotFound = true
-			return
+		// Private and reserved networks - we only get here if the team asked for internal IPs
+		if !util.IsRoutableIP(ip) {
+			res.Private = true
+			reply.IPs = append(reply.IPs, res)
+			continue
 		}
-		// Private networks
-		if ipv4[0] == 10 || ipv4[0] == 172 && ipv4[1] >= 16 && ipv4[1] <= 31 || ipv4[0] == 192 && ipv4[1] == 168 {
-			reply.IPs[counter].XFE.NotFound = true
-			reply.IPs[counter].Private = true
-			return
+		res.Sources = scan(set, newScanIndicator(request, domain.ReplyTypeIP, ip))
+		scoreIP(&request.Scoring, &res)
+		reply.IPs = append(reply.IPs, res)
+	}
+}
+
+// scoreIP sets the verdict of the IP and the reports of the sources from its results
+func scoreIP(scoring *domain.ScoringProfile, res *domain.IPReply) {
+	res.Result = scoring.Verdict(res.Sources, domain.ResultUnknown)
+	for _, s := range res.Sources {
+		switch r := s.Report.(type) {
+		case *domain.XfeIPReply:
+			res.XFE = *r
+		case *domain.VtIPReply:
+			res.VT = *r
 		}
-		var wg sync.WaitGroup
-		wg.Add(2)
-		go func() {
-			defer wg.Done()
-			ipResp, err := xfe.IPR(ip)
-			if err != nil {
-				// Small hack - see if the URL was not found
-				if strings.Contains(err.Error(), "404") {
-					reply.IPs[counter].XFE.NotFound = true
-				} else {
-					reply.IPs[counter].XFE.Error = err.Error()
-				}
-			} else {
-				reply.IPs[counter].XFE.IPReputation = *ipResp
-				if online {
-					hist, err := xfe.IPRHistory(ip)
-					if err == nil {
-						reply.IPs[counter].XFE.IPHistory = *hist
-					}
-				}
-			}
-		}()
-		go func() {
-			defer wg.Done()
-			vtResp, err := vt.GetIpReport(ip)
-			if err != nil {
-				reply.IPs[counter].VT.Error = err.Error()
-			} else {
-				reply.IPs[counter].VT.IPReport = *vtResp
-			}
-		}()
-		wg.Wait()
-		var vtPositives uint16
-		now := time.Now()
-		for i := range reply.IPs[counter].VT.IPReport.DetectedUrls {
-			t, err := time.Parse("2006-01-02 15:04:05", reply.IPs[counter].VT.IPReport.DetectedUrls[i].ScanDate)
-			if err != nil {
-				logrus.Debugf("Error parsing scan date - %v", err)
-				continue
-			}
-			if reply.IPs[counter].VT.IPReport.DetectedUrls[i].Positives > vtPositives && t.Add(365*24*time.Hour).After(now) {
-				vtPositives = reply.IPs[counter].VT.IPReport.DetectedUrls[i].Positives
-			}
+	}
+}
+
+// recentPositives returns the highest number of positives for URLs detected in the last year
+func recentPositives(detected []govt.DetectedUrl) uint16 {
+	var vtPositives uint16
+	now := time.Now()
+	for i := range detected {
+		t, err := time.Parse("2006-01-02 15:04:05", detected[i].ScanDate)
+		if err != nil {
+			logrus.Debugf("Error parsing scan date - %v", err)
+			continue
 		}
-		reply.IPs[counter].Result = domain.ResultUnknown
-		if reply.IPs[counter].XFE.IPReputation.Score >= xfeScoreToConvict || vtPositives >= numOfPositivesToConvict && reply.IPs[counter].XFE.NotFound {
-			// This is known bad scenario
-			reply.IPs[counter].Result = domain.ResultDirty
-		} else if !reply.IPs[counter].XFE.NotFound || reply.IPs[counter].VT.IPReport.ResponseCode == 1 {
-			// At least one of reputation services found this to be known good
-			// Keep the default
-			reply.IPs[counter].Result = domain.ResultClean
+		if detected[i].Positives > vtPositives && t.Add(365*24*time.Hour).After(now) {
+			vtPositives = detected[i].Positives
 		}
 	}
+	return vtPositives
+}
+
+func (w *Worker) handleDomains(request *domain.WorkRequest, reply *domain.WorkReply) {
+	set := w.scanSet(request)
+	for _, d := range request.Domains {
+		reply.Type |= domain.ReplyTypeDomain
+		res := domain.DomainReply{Details: d}
+		if internalName(d, request.InternalDomains) {
+			res.Result, res.XFE.NotFound, res.Internal = domain.ResultClean, true, true
+			reply.Domains = append(reply.Domains, res)
+			continue
+		}
+		res.Sources = scan(set, newScanIndicator(request, domain.ReplyTypeDomain, d))
+		scoreDomain(&request.Scoring, &res)
+		reply.Domains = append(reply.Domains, res)
+	}
+}
+
+// scoreDomain sets the verdict of the domain and the reports of the sources from its results
+func scoreDomain(scoring *domain.ScoringProfile, res *domain.DomainReply) {
+	res.Result = scoring.Verdict(res.Sources, domain.ResultUnknown)
+	res.XFE.NotFound = true
+	for _, s := range res.Sources {
+		switch r := s.Report.(type) {
+		case *domain.XfeURLReply:
+			res.XFE = *r
+		case *domain.VtDomainReply:
+			res.VT = *r
+		}
+	}
+}
+
+// handleEmails checks the reputation of the email domains, flags look-alikes of commonly spoofed domains and the sources
+// that know addresses, e.g. HIBP, check the address itself
+func (w *Worker) handleEmails(request *domain.WorkRequest, reply *domain.WorkReply) {
+	set := w.scanSet(request)
+	for _, e := range request.Emails {
+		reply.Type |= domain.ReplyTypeEmail
+		res := domain.EmailReply{Details: e, Domain: e[strings.LastIndex(e, "@")+1:]}
+		if internalName(res.Domain, request.InternalDomains) {
+			res.Result, res.XFE.NotFound, res.Internal = domain.ResultClean, true, true
+			reply.Emails = append(reply.Emails, res)
+			continue
+		}
+		res.LookAlike = lookAlike(res.Domain)
+		res.Sources = scan(set, newScanIndicator(request, domain.ReplyTypeEmail, e))
+		scoreEmail(&request.Scoring, &res)
+		reply.Emails = append(reply.Emails, res)
+	}
+}
+
+// scoreEmail sets the verdict of the email and the reports of the sources from its results, look-alikes are malicious
+func scoreEmail(scoring *domain.ScoringProfile, res *domain.EmailReply) {
+	res.Result = scoring.Verdict(res.Sources, domain.ResultUnknown)
+	if res.LookAlike != "" {
+		res.Result = domain.ResultDirty
+	}
+	res.XFE.NotFound = true
+	for _, s := range res.Sources {
+		if r, ok := s.Report.(*domain.XfeURLReply); ok {
+			res.XFE = *r
+		}
+	}
+}
+
+// handleWallets looks up the abuse reports of crypto currency addresses
+func (w *Worker) handleWallets(request *domain.WorkRequest, reply *domain.WorkReply) {
+	for _, wallet := range request.Wallets {
+		reply.Type |= domain.ReplyTypeWallet
+		res, err := w.abuse.Wallet(wallet)
+		if err != nil {
+			res = &domain.WalletReply{Details: wallet.Value, Type: wallet.Type, Error: err.Error()}
+		}
+		switch {
+		case res.Reports > 0:
+			res.Result = domain.ResultDirty
+		case res.Error == "" && !res.NotFound:
+			res.Result = domain.ResultClean
+		default:
+			res.Result = domain.ResultUnknown
+		}
+		reply.Wallets = append(reply.Wallets, *res)
+	}
+}
+
+func (w *Worker) handleCVEs(request *domain.WorkRequest, reply *domain.WorkReply) {
+	for _, id := range request.CVEs {
+		reply.Type |= domain.ReplyTypeCVE
+		res, err := w.nvd.CVE(id)
+		if err != nil {
+			res = &domain.CVEReply{Details: id, Error: err.Error()}
+		}
+		reply.CVEs = append(reply.CVEs, *res)
+	}
+}
+
+func (w *Worker) handleCustom(request *domain.WorkRequest, reply *domain.WorkReply) {
+	reply.Type |= domain.ReplyTypeCustom
+	errMsg := ""
+	payload := &customPayload{MessageID: request.MessageID, Matches: request.Custom}
+	if ctx, err := domain.GetContext(request.Context); err == nil {
+		payload.Team, payload.Channel, payload.User = ctx.Team, ctx.Channel, ctx.User
+	}
+	body, err := json.Marshal(payload)
+	if err == nil {
+		var req *http.Request
+		var resp *http.Response
+		if req, err = http.NewRequest("POST", request.CustomWebhook, bytes.NewReader(body)); err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			resp, err = util.DoPublic(webhookClient, req)
+		}
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				errMsg = fmt.Sprintf("webhook returned %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		errMsg = err.Error()
+	}
+	if errMsg != "" {
+		logrus.Infof("Unable to forward custom matches for message %s - %s", request.MessageID, errMsg)
+	}
+	for _, m := range request.Custom {
+		reply.Custom = append(reply.Custom, domain.CustomReply{Details: m.Value, Pattern: m.Pattern, Forwarded: errMsg == "", Error: errMsg})
+	}
 }
 
 func (w *Worker) handleHashes(request *domain.WorkRequest, reply *domain.WorkReply) {
-	text := request.Text
-	xfe, vt := w.localVTXfe(request)
-	hashes := md5Reg.FindAllString(text, -1)
-	hashes = append(hashes, sha1Reg.FindAllString(text, -1)...)
-	hashes = append(hashes, sha256Reg.FindAllString(text, -1)...)
-	for _, hash := range hashes {
-		var res domain.HashReply
+	set := w.scanSet(request)
+	hashes := request.Hashes
+	if len(hashes) == 0 {
+		hashes = extractHashes(request.Text)
+	}
+	for _, h := range hashes {
 		reply.Type |= domain.ReplyTypeHash
-		res.Details = hash
-		var wg sync.WaitGroup
-		wg.Add(3)
-		go func() {
-			defer wg.Done()
-			xfeResp, err := xfe.MalwareDetails(hash)
-			if err != nil {
-				// Small hack - see if the file was not found
-				if strings.Contains(err.Error(), "404") {
-					res.XFE.NotFound = true
-				} else {
-					res.XFE.Error = err.Error()
-				}
-			} else {
-				res.XFE.Malware = xfeResp.Malware
-			}
-		}()
-		go func() {
-			defer wg.Done()
-			vtResp, err := vt.GetFileReport(hash)
-			if err != nil {
-				res.VT.Error = err.Error()
-			} else {
-				res.VT.FileReport = *vtResp
-			}
-		}()
-		go func() {
-			defer wg.Done()
-			cyResp, err := w.cy.Query("", hash)
-			if err != nil {
-				res.Cy.Error = err.Error()
-			} else {
-				// Should be only one
-				for k := range cyResp {
-					res.Cy.Result = cyResp[k]
-				}
+		res := domain.HashReply{Details: h.Value, Type: h.Type}
+		value := h.Value
+		// The sources only index MD5, SHA-1 and SHA-256 so a SHA-512 is looked up by the MD5 of the file if we saw it
+		if h.Type == domain.HashSHA512 {
+			if value = resolveSHA512(h.Value); value == "" {
+				res.Unsupported, res.Result = true, domain.ResultUnknown
+				reply.Hashes = append(reply.Hashes, res)
+				continue
 			}
-		}()
-		wg.Wait()
-		res.Result = domain.ResultUnknown
-		if len(res.XFE.Malware.Family) > 0 || len(res.XFE.Malware.Origins.External.Family) > 0 ||
-			res.VT.FileReport.Positives >= numOfPositivesToConvictForFiles ||
-			res.Cy.Result.GeneralScore < cyScoreToConvict {
-			// This is known bad scenario
-			res.Result = domain.ResultDirty
-		} else if !res.XFE.NotFound || res.VT.FileReport.ResponseCode == 1 || res.Cy.Result.StatusCode == 1 {
-			// At least one of reputation services found this to be known good
-			// Keep the default
-			res.Result = domain.ResultClean
 		}
+		res.Sources = scan(set, newScanIndicator(request, domain.ReplyTypeHash, value))
+		scoreHash(&request.Scoring, &res)
 		reply.Hashes = append(reply.Hashes, res)
 	}
 }
 
-func (w *Worker) uploadToCylance(reply *domain.WorkReply, buf *bytes.Buffer) {
+// scoreHash sets the verdict of the hash and the reports of the sources from its results
+func scoreHash(scoring *domain.ScoringProfile, res *domain.HashReply) {
+	res.Result = scoring.Verdict(res.Sources, domain.ResultUnknown)
+	res.XFE.NotFound = true
+	for _, s := range res.Sources {
+		switch r := s.Report.(type) {
+		case *domain.XfeHashReply:
+			res.XFE = *r
+		case *domain.VtHashReply:
+			res.VT = *r
+		case *domain.CyHashReply:
+			res.Cy = *r
+		}
+	}
+}
+
+func (w *Worker) uploadToCylance(reply *domain.WorkReply, buf *bytes.Buffer, scoring *domain.ScoringProfile) {
 	// For now, just check Windows executables
 	_, err := pe.NewFile(bytes.NewReader(buf.Bytes()))
 	if err != nil {
@@ -394,7 +525,7 @@ func (w *Worker) uploadToCylance(reply *domain.WorkReply, buf *bytes.Buffer) {
 					// Should be only one
 					for k := range cyResp {
 						if cyResp[k].StatusCode == 1 {
-							reply.Hashes[0].Cy.Result = cyResp[k]
+							updateCyResult(&reply.Hashes[0], cyResp[k], scoring)
 							return
 						} else if cyResp[k].StatusCode != 2 {
 							// If there is an error it means Cylance does not handle the file so no point in waiting
@@ -409,32 +540,59 @@ func (w *Worker) uploadToCylance(reply *domain.WorkReply, buf *bytes.Buffer) {
 	}
 }
 
+// updateCyResult keeps the Cylance reply we got after the upload and scores the hash again with it
+func updateCyResult(h *domain.HashReply, r infinigo.QueryResponse, scoring *domain.ScoringProfile) {
+	h.Cy.Result = r
+	for i := range h.Sources {
+		if h.Sources[i].Source == domain.SourceCy {
+			setCyResult(&h.Sources[i], &h.Cy.Result)
+		}
+	}
+	h.Result = scoring.Verdict(h.Sources, domain.ResultUnknown)
+}
+
 func (w *Worker) handleFile(request *domain.WorkRequest, reply *domain.WorkReply) {
 	reply.Type |= domain.ReplyTypeFile
 	reply.File.Details = request.File
-	if request.File.Size > 30*1024*1024 {
-		logrus.Infof("File %s is bigger than 30M, skipping\n", request.File.Name)
+	reply.File.Archive = isArchive(request.File)
+	limit := maxFileSize()
+	if request.File.Size > limit {
+		logrus.Infof("File %s is bigger than %d bytes, skipping\n", request.File.Name, limit)
 		reply.File.FileTooLarge = true
+		w.handleFileHash(request, reply)
 		return
 	}
-	hash := md5.New()
-	req, err := http.NewRequest("GET", request.File.URL, nil)
-	if err != nil {
-		logrus.Errorf("Unable to create request for download file - %v\n", err)
+	if fileExcluded(request.File) {
+		logrus.Infof("File %s is of an excluded type %s (%s), skipping\n", request.File.Name, request.File.FileType, request.File.MimeType)
+		reply.File.Excluded = true
+		w.handleFileHash(request, reply)
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+request.File.Token)
-	resp, err := http.DefaultClient.Do(req)
+	hash, sha := md5.New(), sha512.New()
+	buf, tooLarge, err := downloadFile(request.File, limit)
 	if err != nil {
 		logrus.Errorf("Unable to download file - %v\n", err)
 		return
 	}
-	defer resp.Body.Close()
-	buf := &bytes.Buffer{}
-	io.Copy(buf, resp.Body)
-	io.Copy(hash, bytes.NewReader(buf.Bytes()))
+	if tooLarge {
+		logrus.Infof("File %s is bigger than %d bytes, skipping\n", request.File.Name, limit)
+		reply.File.FileTooLarge = true
+		w.handleFileHash(request, reply)
+		return
+	}
+	io.Copy(io.MultiWriter(hash, sha), bytes.NewReader(buf.Bytes()))
 	h := fmt.Sprintf("%x", hash.Sum(nil))
 	logrus.Debugf("MD5 for file %s is %s\n", request.File.Name, h)
+	rememberSHA512(fmt.Sprintf("%x", sha.Sum(nil)), h)
+	// The headers tell if it is an archive, whatever the name says
+	if archive := inspectArchive(buf.Bytes(), archivePasswords(request.File.Message)); archive.format != "" {
+		reply.File.Archive, reply.File.Encrypted = true, archive.encrypted
+		reply.File.Members, reply.File.MemberCount, reply.File.PasswordMatches = archive.members, archive.count, archive.passwordMatches
+		reply.File.Packed = archive.packed
+		if archive.encrypted {
+			encryptedArchivesTotal.Inc(archive.format)
+		}
+	}
 	// Do the network commands in parallel
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -463,7 +621,7 @@ func (w *Worker) handleFile(request *domain.WorkRequest, reply *domain.WorkReply
 	}
 	// If Cylance does not know about the file but can handle it then handle it...
 	if reply.Hashes[0].Cy.Result.StatusCode == 3 {
-		w.uploadToCylance(reply, buf)
+		w.uploadToCylance(reply, buf, &request.Scoring)
 	}
 	if reply.File.Virus != "" || reply.Hashes[0].Result == domain.ResultDirty {
 		// This is known bad scenario
@@ -473,4 +631,77 @@ func (w *Worker) handleFile(request *domain.WorkRequest, reply *domain.WorkReply
 		// Keep the default
 		reply.File.Result = domain.ResultClean
 	}
+	if reply.File.Encrypted && reply.File.Result != domain.ResultDirty {
+		// The scanners cannot look inside so no detections means nothing
+		reply.File.Result = domain.ResultSuspicious
+	}
+	// Only the behavior of a file no source knows can tell us more, the sandbox cannot open encrypted archives
+	if reply.Hashes[0].Result == domain.ResultUnknown && reply.File.Virus == "" && !reply.File.Encrypted && !request.Online &&
+		request.Sandbox.Submits(buf.Len()) {
+		reply.File.Sandboxed = w.queueSandbox(request, h)
+	}
+	if textFileTypes[request.File.FileType] && request.File.Size <= conf.Options.Limits.SnippetSize && buf.Len() <= conf.Options.Limits.SnippetSize {
+		reply.Snippet = w.handleSnippet(request, buf.String())
+	}
+}
+
+// downloadFile downloads the shared file with the token of the team, tooLarge if it has more than limit bytes
+func downloadFile(f domain.File, limit int) (buf *bytes.Buffer, tooLarge bool, err error) {
+	downloadURL := f.DownloadURL
+	if downloadURL == "" {
+		downloadURL = f.URL
+	}
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	// Do not trust the size from the event, make sure we never read more than the cap
+	if resp.ContentLength > int64(limit) {
+		return nil, true, nil
+	}
+	buf = &bytes.Buffer{}
+	io.Copy(buf, io.LimitReader(resp.Body, int64(limit)+1))
+	if buf.Len() > limit {
+		return nil, true, nil
+	}
+	return buf, false, nil
+}
+
+// handleFileHash looks up the hash of a file we do not download if the event has one, the verdict is the one of the
+// hash
+func (w *Worker) handleFileHash(request *domain.WorkRequest, reply *domain.WorkReply) {
+	reply.File.Result = domain.ResultUnknown
+	hashes := extractHashes(request.File.Hash)
+	if len(hashes) != 1 {
+		return
+	}
+	request.Hashes = hashes
+	w.handleHashes(request, reply)
+	reply.File.Result = reply.Hashes[0].Result
+}
+
+// handleSnippet checks the indicators in the content of a shared text file with the scan settings of the team.
+// The content is plain text so the URLs are wrapped the same way Slack formats them in messages.
+func (w *Worker) handleSnippet(request *domain.WorkRequest, content string) *domain.WorkReply {
+	c := request.ScanSettings
+	if c == nil {
+		c = &domain.Configuration{}
+	}
+	found := findIndicators(&subscription{configuration: c, patterns: compilePatterns(c)}, linkify(content))
+	reply := &domain.WorkReply{Skipped: found.limit(conf.Options.Limits.Indicators)}
+	if !found.found() {
+		return nil
+	}
+	snippet := &domain.WorkRequest{Type: "message", Credentials: request.Credentials, DisabledSources: request.DisabledSources, Scoring: request.Scoring,
+		InternalDomains: request.InternalDomains}
+	found.apply(snippet, c)
+	w.handleMessage(snippet, reply)
+	reply.Original = found.original
+	return reply
 }
@@ -0,0 +1,195 @@
+package bot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// errHIBPKey is returned if HIBP does not accept the key
+var errHIBPKey = errors.New("HIBP did not accept the key")
+
+// hibpAccount is how the email shows in our logs and errors - a hash, the address is personal data
+func hibpAccount(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// hibpQueue lets the checks of a key through one at a time and no faster than the rate limit of the key
+type hibpQueue struct {
+	slot chan struct{}
+	next time.Time // When the next check can go, only used by the holder of the slot
+}
+
+// hibpQueues are the queues of the keys, shared by the scanners since every request creates its own
+var hibpQueues = struct {
+	sync.Mutex
+	keys map[string]*hibpQueue
+}{keys: make(map[string]*hibpQueue)}
+
+// hibpQueueOf returns the queue of the key
+func hibpQueueOf(key string) *hibpQueue {
+	hibpQueues.Lock()
+	defer hibpQueues.Unlock()
+	q := hibpQueues.keys[key]
+	if q == nil {
+		q = &hibpQueue{slot: make(chan struct{}, 1)}
+		hibpQueues.keys[key] = q
+	}
+	return q
+}
+
+// wait for the turn of the check, the caller must release the slot after it
+func (q *hibpQueue) wait(ctx context.Context) error {
+	select {
+	case q.slot <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if d := q.next.Sub(time.Now()); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			q.release()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release the slot to the next check
+func (q *hibpQueue) release() {
+	<-q.slot
+}
+
+// hibpScanner checks the breaches of emails with Have I Been Pwned using the key of the team. Breaches are about the
+// person and not the reputation of the email so they never change the verdict. Only the count is shown in the channel.
+type hibpScanner struct {
+	url      string
+	key      string
+	interval time.Duration
+	c        *http.Client
+}
+
+// newHIBPScanner skips the source for teams without a key
+func newHIBPScanner(creds domain.Credentials) (Scanner, error) {
+	if creds.Key == "" {
+		return nil, nil
+	}
+	interval := time.Minute
+	if rpm := conf.Options.HIBP.RequestsPerMinute; rpm > 0 {
+		interval = time.Minute / time.Duration(rpm)
+	}
+	return &hibpScanner{url: conf.Options.HIBP.URL, key: creds.Key, interval: interval, c: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (h *hibpScanner) Name() string {
+	return domain.SourceHIBP
+}
+
+func (h *hibpScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeEmail
+}
+
+// breakerKey is per key so a team with a bad key does not stop the checks of the others
+func (h *hibpScanner) breakerKey() string {
+	return domain.SourceHIBP + ":" + h.key
+}
+
+// hibpBreach is a breach the account is in
+type hibpBreach struct {
+	Name       string `json:"Name"`
+	Title      string `json:"Title"`
+	BreachDate string `json:"BreachDate"`
+}
+
+// breaches of the email, none if HIBP does not know it. Too many requests waits for the key like the next check.
+func (h *hibpScanner) breaches(ctx context.Context, email string) ([]hibpBreach, error) {
+	q := hibpQueueOf(h.key)
+	if err := q.wait(ctx); err != nil {
+		return nil, err
+	}
+	defer q.release()
+	req, err := http.NewRequest("GET", h.url+url.PathEscape(email)+"?truncateResponse=false", nil)
+	if err != nil {
+		return nil, fmt.Errorf("HIBP check of %s failed", hibpAccount(email))
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("hibp-api-key", h.key)
+	req.Header.Set("User-Agent", "alfred")
+	resp, err := h.c.Do(req)
+	q.next = time.Now().Add(h.interval)
+	if err != nil {
+		// The error has the URL with the address
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("HIBP check of %s failed - %v", hibpAccount(email), err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	case http.StatusTooManyRequests:
+		retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		q.next = time.Now().Add(time.Duration(retry+1) * time.Second)
+		return nil, fmt.Errorf("HIBP rate limit of the key reached, retrying in %d seconds", retry+1)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, errHIBPKey
+	default:
+		return nil, fmt.Errorf("HIBP returned %s", resp.Status)
+	}
+	var breaches []hibpBreach
+	if err = json.NewDecoder(resp.Body).Decode(&breaches); err != nil {
+		return nil, err
+	}
+	return breaches, nil
+}
+
+func (h *hibpScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res := domain.SourceResult{Result: domain.ResultUnknown, NotFound: true, Info: true}
+	breaches, err := h.breaches(ctx, indicator.Value)
+	if err != nil {
+		logrus.WithError(err).Debugf("Unable to check account %s with HIBP", hibpAccount(indicator.Value))
+		return res, err
+	}
+	if len(breaches) == 0 {
+		return res, nil
+	}
+	// Most recent first
+	sort.SliceStable(breaches, func(i, j int) bool { return breaches[i].BreachDate > breaches[j].BreachDate })
+	var names []string
+	for _, b := range breaches {
+		names = append(names, fmt.Sprintf("%s (%s)", b.Title, b.BreachDate))
+	}
+	res.NotFound, res.Value = false, float64(len(breaches))
+	res.Score = fmt.Sprintf("%d breaches", len(breaches))
+	if len(breaches) == 1 {
+		res.Score = "1 breach"
+	}
+	detail := fmt.Sprintf("Breaches: %d\nMost Recent: %s\nAll: %s", len(breaches), names[0], strings.Join(names, ", "))
+	// The details page is only seen by who opened it, replies in the channel only get the count
+	if indicator.Online {
+		res.Detail = detail
+	} else {
+		res.PrivateDetail = detail
+	}
+	return res, nil
+}
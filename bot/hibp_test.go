@@ -0,0 +1,96 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestHIBPScan(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("hibp-api-key") != "test-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/breachedaccount/john@example.com" {
+			w.Write([]byte(`[{"Name":"Adobe","Title":"Adobe","BreachDate":"2013-10-04"},
+{"Name":"LinkedIn","Title":"LinkedIn","BreachDate":"2016-05-18"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	h := &hibpScanner{url: srv.URL + "/breachedaccount/", key: "test-key", c: http.DefaultClient}
+	indicator := scanIndicator{Type: domain.ReplyTypeEmail, Value: "john@example.com"}
+	res, err := h.Scan(context.Background(), indicator)
+	if err != nil || res.NotFound || !res.Info || res.Score != "2 breaches" || res.Detail != "" {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	if !strings.Contains(res.PrivateDetail, "Most Recent: LinkedIn (2016-05-18)") || !strings.Contains(res.PrivateDetail, "Adobe") {
+		t.Errorf("unexpected private detail %s", res.PrivateDetail)
+	}
+	// Breaches are not a verdict
+	if new(domain.ScoringProfile).Verdict([]domain.SourceResult{res}, domain.ResultUnknown) != domain.ResultUnknown {
+		t.Error("breaches should not change the verdict")
+	}
+	// Only the count is in the channel, the breaches go to who asks for the details
+	var f finding
+	f.addSources([]domain.SourceResult{res})
+	if strings.Contains(f.details(), "LinkedIn") || !strings.Contains(privateDetails([]finding{f}), "LinkedIn") {
+		t.Errorf("expected the breaches only in the private details but got %q", f.details())
+	}
+	// The details page is seen only by who opened it
+	indicator.Online = true
+	if res, err = h.Scan(context.Background(), indicator); err != nil || !strings.Contains(res.Detail, "LinkedIn") {
+		t.Errorf("expected the breaches in the detail of the details page but got %+v - %v", res, err)
+	}
+	res, err = h.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeEmail, Value: "jane@example.com"})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no breaches but got %+v - %v", res, err)
+	}
+	h.key = "bad-key"
+	if _, err = h.Scan(context.Background(), indicator); err != errHIBPKey {
+		t.Errorf("expected the key error but got %v", err)
+	}
+}
+
+func TestHIBPQueue(t *testing.T) {
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	// The queues of the keys outlive the test, start over with the next run
+	defer func() {
+		hibpQueues.Lock()
+		delete(hibpQueues.keys, "queue-key")
+		hibpQueues.Unlock()
+	}()
+	h := &hibpScanner{url: srv.URL + "/", key: "queue-key", interval: 50 * time.Millisecond, c: http.DefaultClient}
+	for i := 0; i < 2; i++ {
+		if _, err := h.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeEmail, Value: "john@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(times) != 2 || times[1].Sub(times[0]) < 50*time.Millisecond {
+		t.Errorf("expected the checks of a key to be spaced by the interval but got %v", times)
+	}
+	// The key is busy so a check that cannot wait gives up
+	q := hibpQueueOf("queue-key")
+	q.next = time.Now().Add(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := h.Scan(ctx, scanIndicator{Type: domain.ReplyTypeEmail, Value: "john@example.com"})
+	if err == nil || strings.Contains(err.Error(), "john") {
+		t.Errorf("expected an error without the address but got %v", err)
+	}
+	if len(q.slot) != 0 {
+		t.Error("expected the slot to be released")
+	}
+}
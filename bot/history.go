@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// slackPermalink links to the message the indicators were in, empty if we do not know the workspace or the message
+func slackPermalink(workspace string, ctx *domain.Context) string {
+	if workspace == "" || ctx.Channel == "" || ctx.TS == "" {
+		return ""
+	}
+	link := fmt.Sprintf("https://%s.slack.com/archives/%s/p%s", workspace, ctx.Channel, strings.Replace(ctx.TS, ".", "", 1))
+	if ctx.ThreadTS != "" {
+		link += "?thread_ts=" + ctx.ThreadTS
+	}
+	return link
+}
+
+// scanRecords turns the verdicts of the reply into the scan history of the team
+func scanRecords(reply *domain.WorkReply, ctx *domain.Context, sub *subscription) []domain.ScanRecord {
+	permalink := slackPermalink(sub.team.Domain, ctx)
+	var records []domain.ScanRecord
+	add := func(indicator string, indicatorType, verdict int, scores map[string]string) {
+		records = append(records, domain.ScanRecord{Team: sub.team.ID, Channel: ctx.Channel, User: ctx.OriginalUser,
+			Indicator: indicator, Normalized: NormalizeIndicator(indicator), IndicatorType: indicatorType, Scores: scores,
+			Verdict: verdict, Permalink: permalink})
+	}
+	if reply.Type&domain.ReplyTypeFile > 0 {
+		scores := make(map[string]string)
+		if len(reply.Hashes) == 1 {
+			scores = sourceScores(reply.Hashes[0].Sources)
+		}
+		scores["clamav"] = reply.File.Virus
+		add(reply.File.Details.Name, domain.ReplyTypeFile, reply.File.Result, scores)
+		return records
+	}
+	for _, h := range reply.Hashes {
+		add(h.Details, domain.ReplyTypeHash, h.Result, sourceScores(h.Sources))
+	}
+	for _, u := range reply.URLs {
+		add(u.Details, domain.ReplyTypeURL, u.Result, sourceScores(u.Sources))
+	}
+	for _, ip := range reply.IPs {
+		add(ip.Details, domain.ReplyTypeIP, ip.Result, sourceScores(ip.Sources))
+	}
+	for _, d := range reply.Domains {
+		add(d.Details, domain.ReplyTypeDomain, d.Result, sourceScores(d.Sources))
+	}
+	for _, e := range reply.Emails {
+		add(e.Details, domain.ReplyTypeEmail, e.Result, sourceScores(e.Sources))
+	}
+	for _, w := range reply.Wallets {
+		add(w.Details, domain.ReplyTypeWallet, w.Result, map[string]string{"chainabuse": fmt.Sprintf("%v", w.Reports)})
+	}
+	for _, c := range reply.CVEs {
+		add(c.Details, domain.ReplyTypeCVE, domain.ResultUnknown, map[string]string{"nvd": fmt.Sprintf("%v", c.Score)})
+	}
+	return records
+}
+
+// storeScans keeps the verdicts of the reply in the scan history of the team
+func (b *Bot) storeScans(reply *domain.WorkReply, ctx *domain.Context, sub *subscription) {
+	if err := b.r.StoreScans(scanRecords(reply, ctx, sub)); err != nil {
+		replyLog(reply, ctx).WithError(err).Warn("Unable to store scan history")
+	}
+}
+
+// expireScanHistory deletes the scan history that is past the retention. It runs hourly from the Start loop.
+func (b *Bot) expireScanHistory() {
+	if conf.Options.ScanHistory <= 0 || time.Since(b.prunedScans) < time.Hour {
+		return
+	}
+	b.prunedScans = time.Now()
+	if err := b.r.DeleteScansBefore(time.Now().AddDate(0, 0, -conf.Options.ScanHistory)); err != nil {
+		logrus.WithError(err).Warn("Unable to delete expired scan history")
+	}
+}
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestScanRecords(t *testing.T) {
+	sub := &subscription{team: &domain.Team{ID: "1", ExternalID: "T1", Domain: "acme"}}
+	ctx := &domain.Context{Team: "T1", Channel: "C1", OriginalUser: "U1", TS: "1514764800.000100"}
+	reply := &domain.WorkReply{Type: domain.ReplyTypeURL | domain.ReplyTypeIP,
+		URLs: []domain.URLReply{{Details: "http://evil.com", Result: domain.ResultDirty,
+			Sources: []domain.SourceResult{{Source: domain.SourceVT, Result: domain.ResultDirty, Score: "9 / 70"},
+				{Source: domain.SourceXFE, NotFound: true}}}},
+		IPs: []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}}
+	records := scanRecords(reply, ctx, sub)
+	if len(records) != 2 {
+		t.Fatalf("expected a record per indicator but got %d", len(records))
+	}
+	r := records[0]
+	if r.Team != "1" || r.Channel != "C1" || r.User != "U1" || r.Indicator != "http://evil.com" || r.IndicatorType != domain.ReplyTypeURL ||
+		r.Verdict != domain.ResultDirty || r.Scores["vt"] != "9 / 70" || len(r.Scores) != 1 {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r.Permalink != "https://acme.slack.com/archives/C1/p1514764800000100" {
+		t.Errorf("unexpected permalink %s", r.Permalink)
+	}
+	if records[1].Indicator != "8.8.8.8" || records[1].Verdict != domain.ResultClean {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+}
+
+func TestSlackPermalink(t *testing.T) {
+	if link := slackPermalink("", &domain.Context{Channel: "C1", TS: "1.2"}); link != "" {
+		t.Errorf("expected no link without the workspace but got %s", link)
+	}
+	link := slackPermalink("acme", &domain.Context{Channel: "C1", TS: "1514764900.000200", ThreadTS: "1514764800.000100"})
+	if link != "https://acme.slack.com/archives/C1/p1514764900000200?thread_ts=1514764800.000100" {
+		t.Errorf("unexpected link %s", link)
+	}
+}
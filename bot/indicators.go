@@ -0,0 +1,472 @@
+package bot
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+	"github.com/demisto/alfred/util"
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	// defangReg matches whitespace delimited tokens containing one of the common defang markers
+	defangReg = regexp.MustCompile(`\S*(?i:hxxps?|\[\.\]|\(\.\)|\{\.\}|\[dot\]|\(dot\)|\[:\]|\[://\])\S*`)
+	hxxpReg   = regexp.MustCompile(`(?i)hxxps?`)
+	dotReg    = regexp.MustCompile(`(?i)\[\.\]|\(\.\)|\{\.\}|\[dot\]|\(dot\)`)
+)
+
+var (
+	// domainReg matches bare host names - the TLD is validated separately against the public suffix list
+	domainReg = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}\b`)
+	// codeReg matches inline code and code blocks which usually contain file names, packages, etc.
+	codeReg = regexp.MustCompile("(?s)```.*?```|`[^`]*`")
+	// linkReg matches Slack formatted links which are handled as URLs
+	linkReg = regexp.MustCompile(`<[^>]*>`)
+	// urlReg matches Slack formatted http(s) links, the first group is the URL without the label
+	urlReg = regexp.MustCompile(`<(https?://[^|>]+)(?:\|[^>]*)?>`)
+	// rawURLReg matches http(s) URLs in plain text which is not formatted by Slack
+	rawURLReg = regexp.MustCompile("(?i)\\bhttps?://[^\\s<>\"'|`]+")
+	// stripReg matches fenced code blocks, inline code on a single line and quoted lines (Slack escapes the >).
+	// Unbalanced backticks do not match so the rest of the message is still scanned.
+	stripReg = regexp.MustCompile("(?s:```.*?```)|`[^`\n]+`|(?m:^[ \t]*(?:&gt;|>).*$)")
+)
+
+// fileExtensions that look like a domain when preceded by a file name. Some of them are valid TLDs as well
+// (.zip, .py, .sh, .md) but in a chat message they are way more likely to be files.
+var fileExtensions = map[string]bool{
+	"apk": true, "app": true, "asp": true, "aspx": true, "bak": true, "bat": true, "bin": true, "bz2": true,
+	"cc": true, "cfg": true, "class": true, "cmd": true, "conf": true, "cpp": true, "cs": true, "css": true,
+	"csv": true, "dat": true, "db": true, "dll": true, "dmg": true, "doc": true, "docx": true, "exe": true,
+	"gif": true, "go": true, "gz": true, "htm": true, "html": true, "ini": true, "iso": true, "jar": true,
+	"java": true, "jpeg": true, "jpg": true, "js": true, "json": true, "jsp": true, "log": true, "md": true,
+	"mov": true, "mp3": true, "mp4": true, "msi": true, "pdf": true, "php": true, "pl": true, "png": true,
+	"ppt": true, "pptx": true, "ps1": true, "py": true, "rar": true, "rb": true, "rs": true, "rtf": true,
+	"scr": true, "sh": true, "so": true, "sql": true, "svg": true, "swift": true, "tar": true, "tgz": true,
+	"tmp": true, "ts": true, "txt": true, "vbs": true, "xls": true, "xlsx": true, "xml": true, "yaml": true,
+	"yml": true, "zip": true,
+}
+
+var colonReplacer = strings.NewReplacer("[://]", "://", "[:]", ":")
+
+// entityReplacer reverts the escaping Slack does to the message text
+var entityReplacer = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// refang normalizes defanged indicators (hxxp://evil[.]com, 8.8.8[.]8) so the regular detection picks them up.
+// URLs are wrapped with angle brackets the same way Slack formats links.
+// The returned map holds the defanged form of every indicator that was changed, keyed by the normalized indicator.
+func refang(text string) (string, map[string]string) {
+	var original map[string]string
+	res := defangReg.ReplaceAllStringFunc(text, func(token string) string {
+		trimmed := strings.TrimRight(token, ".,;:!?'\"")
+		suffix := token[len(trimmed):]
+		clean := hxxpReg.ReplaceAllStringFunc(trimmed, func(s string) string { return "http" + strings.ToLower(s[4:]) })
+		clean = colonReplacer.Replace(dotReg.ReplaceAllString(clean, "."))
+		clean = strings.TrimSuffix(strings.TrimPrefix(clean, "<"), ">")
+		if clean == trimmed {
+			return token
+		}
+		if original == nil {
+			original = make(map[string]string)
+		}
+		original[clean] = trimmed
+		lclean := strings.ToLower(clean)
+		if strings.HasPrefix(lclean, "http://") || strings.HasPrefix(lclean, "https://") {
+			clean = "<" + clean + ">"
+		}
+		return clean + suffix
+	})
+	return res, original
+}
+
+// stripCode removes code blocks, inline code and quoted lines from the text
+func stripCode(text string) string {
+	return stripReg.ReplaceAllString(text, " ")
+}
+
+// linkify wraps the plain text URLs with angle brackets the same way Slack formats links in messages
+func linkify(text string) string {
+	var res []byte
+	last := 0
+	for _, loc := range rawURLReg.FindAllStringIndex(text, -1) {
+		// Already formatted
+		if loc[0] > 0 && text[loc[0]-1] == '<' {
+			continue
+		}
+		u := strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)]}")
+		res = append(res, text[last:loc[0]]...)
+		res = append(res, '<')
+		res = append(res, u...)
+		res = append(res, '>')
+		last = loc[0] + len(u)
+	}
+	return string(append(res, text[last:]...))
+}
+
+// validDomain checks that the domain ends with a known TLD that is not a common file extension
+func validDomain(d string) bool {
+	tld := d[strings.LastIndex(d, ".")+1:]
+	if fileExtensions[tld] {
+		return false
+	}
+	// Unknown TLDs fall back to the default rule which is not an ICANN suffix
+	_, icann := publicsuffix.PublicSuffix(tld)
+	return icann
+}
+
+// extractDomains returns the unique bare domains in the text, skipping code snippets, links and email addresses
+func extractDomains(text string) []string {
+	text = linkReg.ReplaceAllString(codeReg.ReplaceAllString(text, " "), " ")
+	var res []string
+	for _, loc := range domainReg.FindAllStringIndex(text, -1) {
+		// Part of an email, path or a longer token
+		if loc[0] > 0 && strings.ContainsRune("@./\\-_", rune(text[loc[0]-1])) {
+			continue
+		}
+		if loc[1] < len(text) && strings.ContainsRune("@-_", rune(text[loc[1]])) {
+			continue
+		}
+		d := strings.ToLower(text[loc[0]:loc[1]])
+		if validDomain(d) && !util.In(res, d) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// routableIPs filters out private and reserved IPs and returns the number of IPs that were removed
+func routableIPs(ips []string) ([]string, int) {
+	var res []string
+	for _, ip := range ips {
+		if util.IsRoutableIP(ip) {
+			res = append(res, ip)
+		}
+	}
+	return res, len(ips) - len(res)
+}
+
+// extractCVEs returns the unique CVE identifiers in the text in upper case
+func extractCVEs(text string) []string {
+	var res []string
+	for _, cve := range cveReg.FindAllString(text, -1) {
+		cve = strings.ToUpper(cve)
+		if !util.In(res, cve) {
+			res = append(res, cve)
+		}
+	}
+	return res
+}
+
+// extractHashes returns the unique hashes in the text with their type.
+// Longer hashes are matched first so a hash is never reported as a shorter type as well.
+func extractHashes(text string) []domain.Hash {
+	var res []domain.Hash
+	var taken [][]int
+	for _, h := range []struct {
+		re       *regexp.Regexp
+		hashType string
+	}{{sha512Reg, domain.HashSHA512}, {sha256Reg, domain.HashSHA256}, {sha1Reg, domain.HashSHA1}, {md5Reg, domain.HashMD5}} {
+	next:
+		for _, loc := range h.re.FindAllStringIndex(text, -1) {
+			for _, t := range taken {
+				if loc[0] < t[1] && t[0] < loc[1] {
+					continue next
+				}
+			}
+			taken = append(taken, loc)
+			hash := domain.Hash{Value: strings.ToLower(text[loc[0]:loc[1]]), Type: h.hashType}
+			for i := range res {
+				if res[i] == hash {
+					continue next
+				}
+			}
+			res = append(res, hash)
+		}
+	}
+	return res
+}
+
+// extractEmails returns the unique email addresses in the text in lower case, skipping code snippets
+func extractEmails(text string) []string {
+	var res []string
+	for _, e := range emailReg.FindAllString(codeReg.ReplaceAllString(text, " "), -1) {
+		e = strings.ToLower(e)
+		if validDomain(e[strings.LastIndex(e, "@")+1:]) && !util.In(res, e) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// extractCustom returns the unique matches of the team custom patterns
+func extractCustom(text string, patterns []*regexp.Regexp) []domain.CustomMatch {
+	var res []domain.CustomMatch
+	seen := make(map[domain.CustomMatch]bool)
+	for _, re := range patterns {
+		for _, m := range re.FindAllString(text, -1) {
+			match := domain.CustomMatch{Pattern: re.String(), Value: m}
+			if !seen[match] {
+				seen[match] = true
+				res = append(res, match)
+			}
+		}
+	}
+	return res
+}
+
+// extractURLs returns the unique URLs from the Slack formatted links in the text without the labels
+// and with the HTML entities Slack escaped (&amp; in query strings) decoded
+func extractURLs(text string) []string {
+	var res []string
+	for _, m := range urlReg.FindAllStringSubmatch(text, -1) {
+		u := strings.TrimSpace(entityReplacer.Replace(m[1]))
+		if !util.In(res, u) {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// unwrapLink returns the label (or the link itself) of a Slack formatted link so commands get what the user typed
+func unwrapLink(s string) string {
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = s[1 : len(s)-1]
+		if i := strings.Index(s, "|"); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	return s
+}
+
+// indicators found in a message based on the team configuration
+type indicators struct {
+	text        string            // the text after refanging
+	original    map[string]string // the defanged form of refanged indicators
+	urls        []string
+	domains     []string
+	emails      []string
+	ips         []string
+	cves        []string
+	hashes      []domain.Hash
+	wallets     []domain.Wallet
+	custom      []domain.CustomMatch
+	skippedIPs  int // private IPs we did not push
+	whitelisted int // indicators removed because of the team whitelist
+}
+
+// filterWhitelisted removes whitelisted values and counts them
+func (in *indicators) filterWhitelisted(c *domain.Configuration, values []string) []string {
+	var res []string
+	for _, v := range values {
+		if c.IsWhitelisted(v) {
+			in.whitelisted++
+		} else {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// findIndicators runs the detection the team configured on the text
+func findIndicators(sub *subscription, text string) *indicators {
+	c := sub.configuration
+	in := &indicators{text: text}
+	if !c.DisableRefang {
+		in.text, in.original = refang(text)
+	}
+	in.urls = in.filterWhitelisted(c, extractURLs(in.text))
+	if !c.DisableDomains {
+		in.domains = in.filterWhitelisted(c, extractDomains(in.text))
+	}
+	if c.ScanEmails {
+		for _, e := range extractEmails(in.text) {
+			if c.IsWhitelisted(e) || c.IsWhitelisted(e[strings.LastIndex(e, "@")+1:]) {
+				in.whitelisted++
+			} else {
+				in.emails = append(in.emails, e)
+			}
+		}
+	}
+	in.ips = ipReg.FindAllString(in.text, -1)
+	if !c.InternalIPs {
+		in.ips, in.skippedIPs = routableIPs(in.ips)
+	}
+	in.ips = in.filterWhitelisted(c, in.ips)
+	in.cves = in.filterWhitelisted(c, extractCVEs(in.text))
+	for _, h := range extractHashes(in.text) {
+		if c.IsWhitelisted(h.Value) {
+			in.whitelisted++
+		} else {
+			in.hashes = append(in.hashes, h)
+		}
+	}
+	for _, w := range extractWallets(in.text) {
+		if c.IsWhitelisted(w.Value) {
+			in.whitelisted++
+		} else {
+			in.wallets = append(in.wallets, w)
+		}
+	}
+	if c.CustomWebhook != "" {
+		in.custom = extractCustom(in.text, sub.patterns)
+	}
+	return in
+}
+
+// found returns true if there is anything worth pushing to the worker
+func (in *indicators) found() bool {
+	return len(in.urls) > 0 || len(in.domains) > 0 || len(in.emails) > 0 || len(in.ips) > 0 || len(in.cves) > 0 || len(in.hashes) > 0 || len(in.wallets) > 0 || len(in.custom) > 0
+}
+
+// types returns the kinds of indicators we found for the logs, file for a message without any
+func (in *indicators) types() string {
+	if in == nil {
+		return "file"
+	}
+	var res []string
+	for _, t := range []struct {
+		name  string
+		count int
+	}{{"url", len(in.urls)}, {"domain", len(in.domains)}, {"email", len(in.emails)}, {"ip", len(in.ips)}, {"hash", len(in.hashes)},
+		{"cve", len(in.cves)}, {"wallet", len(in.wallets)}, {"custom", len(in.custom)}} {
+		if t.count > 0 {
+			res = append(res, t.name)
+		}
+	}
+	return strings.Join(res, ",")
+}
+
+// keys returns a unique key for each of the indicators
+func (in *indicators) keys() []string {
+	var res []string
+	for _, values := range [][]string{in.urls, in.domains, in.emails, in.ips, in.cves} {
+		res = append(res, values...)
+	}
+	for _, h := range in.hashes {
+		res = append(res, h.Value)
+	}
+	for _, w := range in.wallets {
+		res = append(res, w.Value)
+	}
+	for _, c := range in.custom {
+		res = append(res, c.Pattern+"\x00"+c.Value)
+	}
+	return res
+}
+
+// unseen returns the values that are not in seen
+func unseen(values []string, seen map[string]bool) []string {
+	var res []string
+	for _, v := range values {
+		if !seen[v] {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// removeSeen removes the indicators that were already pushed
+func (in *indicators) removeSeen(seen map[string]bool) {
+	in.urls, in.domains, in.ips, in.cves = unseen(in.urls, seen), unseen(in.domains, seen), unseen(in.ips, seen), unseen(in.cves, seen)
+	in.emails = unseen(in.emails, seen)
+	var hashes []domain.Hash
+	for _, h := range in.hashes {
+		if !seen[h.Value] {
+			hashes = append(hashes, h)
+		}
+	}
+	in.hashes = hashes
+	var wallets []domain.Wallet
+	for _, w := range in.wallets {
+		if !seen[w.Value] {
+			wallets = append(wallets, w)
+		}
+	}
+	in.wallets = wallets
+	var custom []domain.CustomMatch
+	for _, c := range in.custom {
+		if !seen[c.Pattern+"\x00"+c.Value] {
+			custom = append(custom, c)
+		}
+	}
+	in.custom = custom
+}
+
+// limit keeps at most max indicators (0 for no limit) and returns how many were dropped
+func (in *indicators) limit(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	left, dropped := max, 0
+	keep := func(n int) int {
+		if n <= left {
+			left -= n
+			return n
+		}
+		kept := left
+		dropped += n - left
+		left = 0
+		return kept
+	}
+	in.urls = in.urls[:keep(len(in.urls))]
+	in.domains = in.domains[:keep(len(in.domains))]
+	in.emails = in.emails[:keep(len(in.emails))]
+	in.ips = in.ips[:keep(len(in.ips))]
+	in.cves = in.cves[:keep(len(in.cves))]
+	in.hashes = in.hashes[:keep(len(in.hashes))]
+	in.wallets = in.wallets[:keep(len(in.wallets))]
+	in.custom = in.custom[:keep(len(in.custom))]
+	return dropped
+}
+
+// truncateText cuts the text to at most size bytes (0 for no limit) without breaking a UTF-8 character
+func truncateText(text string, size int) (string, bool) {
+	if size <= 0 || len(text) <= size {
+		return text, false
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size], true
+}
+
+// apply the indicators to the work request
+func (in *indicators) apply(workReq *domain.WorkRequest, c *domain.Configuration) {
+	if in.original != nil {
+		workReq.Text, workReq.Original = in.text, in.original
+	}
+	workReq.URLs, workReq.Domains, workReq.IPs, workReq.CVEs, workReq.Hashes = in.urls, in.domains, in.ips, in.cves, in.hashes
+	workReq.Emails, workReq.Wallets = in.emails, in.wallets
+	workReq.InternalDomains = c.InternalDomains
+	if len(in.custom) > 0 {
+		workReq.Custom, workReq.CustomWebhook = in.custom, c.CustomWebhook
+	}
+}
+
+// attachmentTexts returns the scannable content (pretext, text and field values) of each message attachment
+func attachmentTexts(msg slack.Response) []string {
+	attachments, ok := msg["attachments"].([]interface{})
+	if !ok {
+		return nil
+	}
+	var res []string
+	for _, a := range attachments {
+		attachment, ok := a.(map[string]interface{})
+		if !ok {
+			res = append(res, "")
+			continue
+		}
+		parts := []string{slack.Response(attachment).S("pretext"), slack.Response(attachment).S("text")}
+		if fields, ok := attachment["fields"].([]interface{}); ok {
+			for _, f := range fields {
+				if field, ok := f.(map[string]interface{}); ok {
+					parts = append(parts, slack.Response(field).S("value"))
+				}
+			}
+		}
+		res = append(res, strings.Join(parts, "\n"))
+	}
+	return res
+}
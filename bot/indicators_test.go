@@ -0,0 +1,271 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+func TestRefang(t *testing.T) {
+	tests := []struct {
+		in       string
+		out      string
+		original map[string]string
+	}{
+		{"nothing to see here", "nothing to see here", nil},
+		{"check hxxp://evil[.]com/payload now", "check <http://evil.com/payload> now",
+			map[string]string{"http://evil.com/payload": "hxxp://evil[.]com/payload"}},
+		{"HXXPS[://]evil(.)com", "<https://evil.com>", map[string]string{"https://evil.com": "HXXPS[://]evil(.)com"}},
+		{"dns 8.8.8[.]8, and 1.1{.}1[dot]1.", "dns 8.8.8.8, and 1.1.1.1.",
+			map[string]string{"8.8.8.8": "8.8.8[.]8", "1.1.1.1": "1.1{.}1[dot]1"}},
+		{"evil(dot)com", "evil.com", map[string]string{"evil.com": "evil(dot)com"}},
+		{"hxxp://host[:]8080/x", "<http://host:8080/x>", map[string]string{"http://host:8080/x": "hxxp://host[:]8080/x"}},
+	}
+	for _, test := range tests {
+		out, original := refang(test.in)
+		if out != test.out {
+			t.Errorf("refang(%q) = %q, expected %q", test.in, out, test.out)
+		}
+		if len(original) != len(test.original) {
+			t.Errorf("refang(%q) original = %v, expected %v", test.in, original, test.original)
+			continue
+		}
+		for k, v := range test.original {
+			if original[k] != v {
+				t.Errorf("refang(%q) original[%s] = %q, expected %q", test.in, k, original[k], v)
+			}
+		}
+	}
+}
+
+func TestExtractDomains(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{"we saw traffic to badguy-domain.xyz yesterday", []string{"badguy-domain.xyz"}},
+		{"check Evil.COM and evil.com and sub.evil.co.uk", []string{"evil.com", "sub.evil.co.uk"}},
+		{"edit config.yaml and file.txt then run setup.py", nil},
+		{"the archive invoice.zip came from mail.example.org", []string{"mail.example.org"}},
+		{"run `curl bad.example.com` or ```wget other.example.com```", nil},
+		{"link <http://evil.com/x|evil.com> and mail <mailto:a@b.com|a@b.com>", nil},
+		{"mail me at someone@evil.com", nil},
+		{"ip 8.8.8.8 and version 1.2.3", nil},
+		{"e.g. this is fine", nil},
+	}
+	for _, test := range tests {
+		out := extractDomains(test.in)
+		if len(out) != len(test.out) {
+			t.Errorf("extractDomains(%q) = %v, expected %v", test.in, out, test.out)
+			continue
+		}
+		for i := range out {
+			if out[i] != test.out[i] {
+				t.Errorf("extractDomains(%q) = %v, expected %v", test.in, out, test.out)
+				break
+			}
+		}
+	}
+}
+
+func TestRoutableIPs(t *testing.T) {
+	ips, skipped := routableIPs([]string{"10.0.0.5", "8.8.8.8", "192.168.1.1", "127.0.0.1", "1.1.1.1"})
+	if skipped != 3 {
+		t.Errorf("expected 3 skipped IPs but got %d", skipped)
+	}
+	if len(ips) != 2 || ips[0] != "8.8.8.8" || ips[1] != "1.1.1.1" {
+		t.Errorf("unexpected routable IPs %v", ips)
+	}
+}
+
+func TestExtractCVEs(t *testing.T) {
+	cves := extractCVEs("patch cve-2021-44228 and CVE-2023-1234567, again CVE-2021-44228 but not CVE-21-1")
+	if len(cves) != 2 || cves[0] != "CVE-2021-44228" || cves[1] != "CVE-2023-1234567" {
+		t.Errorf("unexpected CVEs %v", cves)
+	}
+}
+
+func TestExtractHashes(t *testing.T) {
+	sha512 := "CF83E1357EEFB8BDF1542850D66D8007D620E4050B5715DC83F4A921D36CE9CE47D0D13C5D85F2B0FF8318D2877EEC2F63B931BD47417A81A538327AF927DA3E"
+	sha256 := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	md5 := "d41d8cd98f00b204e9800998ecf8427e"
+	tests := []struct {
+		in  string
+		out []domain.Hash
+	}{
+		{"hash " + sha512, []domain.Hash{{Value: strings.ToLower(sha512), Type: domain.HashSHA512}}},
+		{sha512[:64] + " " + sha512[64:], []domain.Hash{{Value: strings.ToLower(sha512[:64]), Type: domain.HashSHA256}, {Value: strings.ToLower(sha512[64:]), Type: domain.HashSHA256}}},
+		{sha256 + " and " + md5 + " and " + sha512 + " again " + strings.ToUpper(md5), []domain.Hash{
+			{Value: strings.ToLower(sha512), Type: domain.HashSHA512},
+			{Value: sha256, Type: domain.HashSHA256},
+			{Value: md5, Type: domain.HashMD5}}},
+		{sha512 + "0", nil},
+	}
+	for _, test := range tests {
+		out := extractHashes(test.in)
+		if len(out) != len(test.out) {
+			t.Errorf("extractHashes(%q) = %v, expected %v", test.in, out, test.out)
+			continue
+		}
+		for i := range out {
+			if out[i] != test.out[i] {
+				t.Errorf("extractHashes(%q) = %v, expected %v", test.in, out, test.out)
+				break
+			}
+		}
+	}
+}
+
+func TestExtractCustom(t *testing.T) {
+	c := &domain.Configuration{CustomPatterns: []string{`\bSEC-\d+\b`, `(?i)emotet`, `(broken`}}
+	patterns := compilePatterns(c)
+	if len(patterns) != 2 {
+		t.Fatalf("expected the invalid pattern to be skipped but got %d patterns", len(patterns))
+	}
+	matches := extractCustom("SEC-12 and SEC-13 look like Emotet, again SEC-12", patterns)
+	expected := []domain.CustomMatch{{Pattern: `\bSEC-\d+\b`, Value: "SEC-12"}, {Pattern: `\bSEC-\d+\b`, Value: "SEC-13"}, {Pattern: `(?i)emotet`, Value: "Emotet"}}
+	if len(matches) != len(expected) {
+		t.Fatalf("extractCustom = %v, expected %v", matches, expected)
+	}
+	for i := range matches {
+		if matches[i] != expected[i] {
+			t.Errorf("extractCustom = %v, expected %v", matches, expected)
+			break
+		}
+	}
+}
+
+func TestFindIndicatorsWhitelist(t *testing.T) {
+	sub := &subscription{configuration: &domain.Configuration{Whitelist: []string{"52.0.0.0/8", "example.com"}}}
+	found := findIndicators(sub, "see <http://www.example.com/a> and <http://evil.com/b|evil.com/b>, 52.1.2.3, 8.8.8.8, 10.0.0.1 and mail.example.com")
+	if len(found.urls) != 1 || found.urls[0] != "http://evil.com/b" {
+		t.Errorf("unexpected URLs %v", found.urls)
+	}
+	if len(found.ips) != 1 || found.ips[0] != "8.8.8.8" {
+		t.Errorf("unexpected IPs %v", found.ips)
+	}
+	if len(found.domains) != 0 {
+		t.Errorf("unexpected domains %v", found.domains)
+	}
+	if found.whitelisted != 3 || found.skippedIPs != 1 {
+		t.Errorf("expected 3 whitelisted and 1 skipped but got %d and %d", found.whitelisted, found.skippedIPs)
+	}
+}
+
+func TestUnwrapLink(t *testing.T) {
+	for in, out := range map[string]string{"example.com": "example.com", "<http://example.com|example.com>": "example.com", "<http://example.com/a>": "http://example.com/a"} {
+		if res := unwrapLink(in); res != out {
+			t.Errorf("unwrapLink(%s) = %s, expected %s", in, res, out)
+		}
+	}
+}
+
+func TestAttachmentTexts(t *testing.T) {
+	msg := slack.Response{"attachments": []interface{}{
+		map[string]interface{}{"pretext": "alert", "text": "host 8.8.8.8", "fields": []interface{}{map[string]interface{}{"title": "hash", "value": "d41d8cd98f00b204e9800998ecf8427e"}}},
+		"not an attachment",
+		map[string]interface{}{"text": "second"},
+	}}
+	texts := attachmentTexts(msg)
+	if len(texts) != 3 || texts[0] != "alert\nhost 8.8.8.8\nd41d8cd98f00b204e9800998ecf8427e" || texts[1] != "" || texts[2] != "\nsecond" {
+		t.Errorf("unexpected attachment texts %q", texts)
+	}
+	if attachmentTexts(slack.Response{"text": "no attachments"}) != nil {
+		t.Error("expected no attachment texts")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	b := &Bot{scanned: make(map[string]*scannedMessage)}
+	sub := &subscription{configuration: &domain.Configuration{}}
+	if !b.dedup("C1:1", findIndicators(sub, "check 8.8.8.8")) {
+		t.Error("expected the first scan to be pushed")
+	}
+	if b.dedup("C1:1", findIndicators(sub, "please check 8.8.8.8")) {
+		t.Error("expected an edit with the same indicators to be skipped")
+	}
+	found := findIndicators(sub, "please check 8.8.8.8 and 1.1.1.1")
+	if !b.dedup("C1:1", found) || len(found.ips) != 1 || found.ips[0] != "1.1.1.1" {
+		t.Errorf("expected only the new IP to be pushed but got %v", found.ips)
+	}
+	if !b.dedup("C1:2", findIndicators(sub, "check 8.8.8.8")) {
+		t.Error("expected another message to be pushed")
+	}
+}
+
+func TestExtractURLs(t *testing.T) {
+	urls := extractURLs("see <https://evil.com/a?x=1&amp;y=2|click here> and <http://evil.com/b> again <https://evil.com/a?x=1&amp;y=2> not <mailto:a@b.com|a@b.com>")
+	if len(urls) != 2 || urls[0] != "https://evil.com/a?x=1&y=2" || urls[1] != "http://evil.com/b" {
+		t.Errorf("unexpected URLs %v", urls)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	in := &indicators{urls: []string{"http://a.com", "http://b.com"}, ips: []string{"8.8.8.8", "1.1.1.1"}, cves: []string{"CVE-2021-44228"}}
+	if dropped := in.limit(3); dropped != 2 || len(in.urls) != 2 || len(in.ips) != 1 || len(in.cves) != 0 {
+		t.Errorf("unexpected limit result %d %+v", dropped, in)
+	}
+	if dropped := in.limit(0); dropped != 0 || len(in.urls) != 2 {
+		t.Error("0 should not limit the indicators")
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	if text, truncated := truncateText("short", 10); text != "short" || truncated {
+		t.Error("short text should not be truncated")
+	}
+	if text, truncated := truncateText("abcdéf", 5); text != "abcd" || !truncated {
+		t.Errorf("expected the text to be cut before the multi byte character but got %q", text)
+	}
+	if _, truncated := truncateText("no limit", 0); truncated {
+		t.Error("0 should not truncate the text")
+	}
+}
+
+func TestExtractEmails(t *testing.T) {
+	emails := extractEmails("from Billing@PaypaI-secure.com and <mailto:billing@paypai-secure.com|billing@paypai-secure.com>, not `ops@internal.example.com` or someone@config.yaml")
+	if len(emails) != 1 || emails[0] != "billing@paypai-secure.com" {
+		t.Errorf("unexpected emails %v", emails)
+	}
+	sub := &subscription{configuration: &domain.Configuration{Whitelist: []string{"example.com"}}}
+	if found := findIndicators(sub, "mail a@evil.com"); len(found.emails) != 0 {
+		t.Error("emails should only be scanned when the team turned them on")
+	}
+	sub.configuration.ScanEmails = true
+	found := findIndicators(sub, "mail a@evil.com and b@mail.example.com")
+	if len(found.emails) != 1 || found.emails[0] != "a@evil.com" || found.whitelisted != 1 || len(found.domains) != 0 {
+		t.Errorf("unexpected indicators %+v", found)
+	}
+}
+
+func TestStripCode(t *testing.T) {
+	tests := map[string]string{
+		"check 8.8.8.8": "check 8.8.8.8",
+		"example ```ping 1.1.1.1``` real 8.8.8.8":    "example   real 8.8.8.8",
+		"run `dig 1.1.1.1` on 8.8.8.8":               "run   on 8.8.8.8",
+		"&gt; 1.1.1.1 was in the quote\nbut 8.8.8.8": " \nbut 8.8.8.8",
+		"unbalanced ``` fence 8.8.8.8":               "unbalanced ``` fence 8.8.8.8",
+		"odd ` tick 8.8.8.8":                         "odd ` tick 8.8.8.8",
+		"ticks `on\ntwo` lines 8.8.8.8":              "ticks `on\ntwo` lines 8.8.8.8",
+		"a > b 8.8.8.8":                              "a > b 8.8.8.8",
+	}
+	for in, out := range tests {
+		if res := stripCode(in); res != out {
+			t.Errorf("stripCode(%q) = %q, expected %q", in, res, out)
+		}
+	}
+}
+
+func TestLinkify(t *testing.T) {
+	text := linkify("phish at https://evil.com/login?a=1, and (http://other.com/x) but <https://slack.com/y>")
+	expected := "phish at <https://evil.com/login?a=1>, and (<http://other.com/x>) but <https://slack.com/y>"
+	if text != expected {
+		t.Errorf("linkify = %q, expected %q", text, expected)
+	}
+	urls := extractURLs(text)
+	if len(urls) != 3 || urls[0] != "https://evil.com/login?a=1" || urls[1] != "http://other.com/x" {
+		t.Errorf("unexpected URLs %v", urls)
+	}
+}
@@ -0,0 +1,119 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo"
+	"github.com/demisto/alfred/slack"
+)
+
+// storedReplyRetention is how long the Show details button of a compact reply keeps working
+const storedReplyRetention = 7 * 24 * time.Hour
+
+// compactDetails stores the reply of a compact layout and adds the button that shows its full report.
+// Full layouts already have everything and if we cannot store the reply we post it without the button.
+func (b *Bot) compactDetails(blocks []slack.Block, reply *domain.WorkReply, sub *subscription, verbose bool) []slack.Block {
+	if verbose {
+		return blocks
+	}
+	id, err := b.r.StoreReply(sub.team.ID, reply)
+	if err != nil {
+		logrus.WithError(err).Warnf("Unable to store reply %s of team %s", reply.MessageID, sub.team.ID)
+		return blocks
+	}
+	return withShowDetails(blocks, id)
+}
+
+// expireStoredReplies deletes the replies that are past the retention. It runs hourly from the Start loop.
+func (b *Bot) expireStoredReplies() {
+	if time.Since(b.pruned) < time.Hour {
+		return
+	}
+	b.pruned = time.Now()
+	if err := b.r.DeleteStoredReplies(time.Now().Add(-storedReplyRetention)); err != nil {
+		logrus.WithError(err).Warn("Unable to delete expired stored replies")
+	}
+}
+
+// HandleInteraction handles the buttons users click on our messages
+func (b *Bot) HandleInteraction(payload slack.Response) {
+	if payload.S("type") != "block_actions" {
+		return
+	}
+	team := payload.S("team.id")
+	sub := b.relevantTeam(team)
+	if sub == nil {
+		var err error
+		if sub, err = b.loadSubscription(team); err != nil {
+			teamLog(team, "").WithError(err).Warn("Team not found for interaction")
+			return
+		}
+	}
+	actions, _ := payload["actions"].([]interface{})
+	for _, a := range actions {
+		action, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if slack.Response(action).S("action_id") == showDetailsAction {
+			b.showDetails(team, slack.Response(action).S("value"), payload, sub)
+		}
+	}
+}
+
+// showDetails posts the full report of a stored reply in the thread of the message with the button.
+// If we cannot post there the user who clicked still gets it as an ephemeral message. The private details, e.g. the
+// breaches of an email, only go to the user who clicked.
+func (b *Bot) showDetails(team, id string, payload slack.Response, sub *subscription) {
+	channel, user := payload.S("channel.id"), payload.S("user.id")
+	thread := payload.S("message.thread_ts")
+	if thread == "" {
+		thread = payload.S("container.message_ts")
+	}
+	message := map[string]interface{}{
+		"channel":   channel,
+		"as_user":   true,
+		"thread_ts": thread,
+	}
+	reply, err := b.r.StoredReply(sub.team.ID, id)
+	if err != nil {
+		if err != repo.ErrNotFound {
+			logrus.WithError(err).Warnf("Unable to load stored reply %s of team %s", id, team)
+		}
+		message["user"], message["text"] = user, "Sorry, the details of this reply are no longer available. Use the Details link to check the indicators again."
+		if _, err = sub.s.Do("POST", "chat.postEphemeral", message); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting ephemeral message to Slack")
+		}
+		return
+	}
+	var findings []finding
+	var link string
+	if reply.Type&domain.ReplyTypeFile > 0 && len(reply.Hashes) == 1 {
+		link = fileLink(reply, sub.team.ID)
+		findings = []finding{fileFinding(sub.team.Locale, reply, link)}
+	} else {
+		data, err := domain.GetContext(reply.Context)
+		if err != nil {
+			logrus.WithError(err).Warnf("Stored reply %s of team %s has no context", id, team)
+			return
+		}
+		link = messageLink(data.Channel, reply.MessageID, sub.team.ID)
+		findings = replyFindings(sub.team.Locale, reply, link, true)
+	}
+	setReply(message, replyBlocks(sub.team.Locale, findings, "", nil, true, link), findings, sub.configuration)
+	if _, err = sub.s.PostMessage(message); err != nil {
+		teamLog(team, channel).WithError(err).Info("Unable to post details in the thread, sending to the user")
+		message["user"] = user
+		if _, err = sub.s.Do("POST", "chat.postEphemeral", message); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting details to Slack")
+		}
+	}
+	if private := privateDetails(findings); private != "" {
+		ephemeral := map[string]interface{}{"channel": channel, "user": user, "as_user": true, "thread_ts": thread, "text": private}
+		if _, err = sub.s.Do("POST", "chat.postEphemeral", ephemeral); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting private details to Slack")
+		}
+	}
+}
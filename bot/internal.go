@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/util"
+)
+
+var internalURLsTotal = metrics.NewCounter("alfred_internal_urls_total",
+	"URLs we did not send to the sources because their host is internal by the reason", "reason")
+
+const (
+	// internalResolveTimeout bounds the lookup of the host, hosts we cannot resolve in time are not internal
+	internalResolveTimeout = 2 * time.Second
+	// internalHostTTL is how long we keep if a host resolves to private addresses
+	internalHostTTL = 10 * time.Minute
+	// internalHostsSize bounds the hosts we keep, the cache starts over when it is full
+	internalHostsSize = 10000
+)
+
+// internalHost is if the host resolved to private addresses and until when we trust it
+type internalHost struct {
+	private bool
+	expires time.Time
+}
+
+// hostResolver checks if hosts resolve to private addresses and caches the answers
+type hostResolver struct {
+	mu     sync.Mutex
+	hosts  map[string]internalHost
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error) // Replaced by the tests
+}
+
+var internalHosts = &hostResolver{lookup: net.DefaultResolver.LookupIPAddr}
+
+// private checks if any of the addresses of the host is private, loopback or link-local
+func (r *hostResolver) private(host string, now time.Time) bool {
+	r.mu.Lock()
+	if h, ok := r.hosts[host]; ok && now.Before(h.expires) {
+		r.mu.Unlock()
+		return h.private
+	}
+	r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), internalResolveTimeout)
+	defer cancel()
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		// We try again next time, the host might be public and the DNS slow
+		return false
+	}
+	private := false
+	for _, addr := range addrs {
+		if !util.IsRoutableIP(addr.IP.String()) {
+			private = true
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil || len(r.hosts) >= internalHostsSize {
+		r.hosts = make(map[string]internalHost)
+	}
+	r.hosts[host] = internalHost{private: private, expires: now.Add(internalHostTTL)}
+	return private
+}
+
+// internalURL checks if the host of the URL is internal so the URL must not leave the team
+func internalURL(raw string, internalDomains []string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return internalName(u.Hostname(), internalDomains)
+}
+
+// internalName checks if the host is internal - a private IP, a host that resolves to one or one of the internal
+// domains of the team - so the domains and email addresses with the host must not leave the team either
+func internalName(host string, internalDomains []string) bool {
+	host = strings.ToLower(host)
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		if !util.IsRoutableIP(host) {
+			internalURLsTotal.Inc("private_ip")
+			return true
+		}
+		return false
+	}
+	if domain.IsInternalHost(host, internalDomains) {
+		internalURLsTotal.Inc("internal_domain")
+		return true
+	}
+	if internalHosts.private(host, time.Now()) {
+		internalURLsTotal.Inc("resolves_private")
+		return true
+	}
+	return false
+}
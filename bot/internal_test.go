@@ -0,0 +1,145 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// fakeLookup answers with the addresses of the hosts and counts the lookups
+func fakeLookup(addrs map[string]string, lookups *int) func(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		*lookups++
+		if addr, ok := addrs[host]; ok {
+			return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+}
+
+func TestInternalURL(t *testing.T) {
+	saved := internalHosts
+	defer func() { internalHosts = saved }()
+	lookups := 0
+	internalHosts = &hostResolver{lookup: fakeLookup(map[string]string{"jira.example.com": "10.0.0.5", "example.com": "93.184.216.34"}, &lookups)}
+	tests := []struct {
+		url      string
+		internal bool
+	}{
+		{"http://10.1.2.3/admin", true},
+		{"http://[::1]:8080/", true},
+		{"http://localhost:8080", true},
+		{"https://wiki.corp.example.org/page", true},
+		{"https://jira.example.com/browse/X-1", true},
+		{"https://example.com/login", false},
+		{"http://8.8.8.8/", false},
+		{"http://unknown.example.net/", false},
+	}
+	for _, test := range tests {
+		if res := internalURL(test.url, []string{"corp.example.org"}); res != test.internal {
+			t.Errorf("internalURL(%s) = %v, expected %v", test.url, res, test.internal)
+		}
+	}
+	// The answers are cached, failed lookups are not
+	lookups = 0
+	internalURL("https://jira.example.com/other", nil)
+	internalURL("https://example.com/other", nil)
+	internalURL("http://unknown.example.net/", nil)
+	if lookups != 1 {
+		t.Errorf("expected only the failed lookup again but got %d lookups", lookups)
+	}
+	// The cache expires
+	if !internalHosts.private("jira.example.com", time.Now().Add(internalHostTTL)) || lookups != 2 {
+		t.Errorf("expected the host to be looked up again but got %d lookups", lookups)
+	}
+}
+
+// recordingScanner remembers what it scanned
+type recordingScanner struct {
+	fakeScanner
+	mu     sync.Mutex
+	values []string
+}
+
+func (r *recordingScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	r.mu.Lock()
+	r.values = append(r.values, indicator.Value)
+	r.mu.Unlock()
+	return r.fakeScanner.Scan(ctx, indicator)
+}
+
+func TestHandleInternalURL(t *testing.T) {
+	saved := internalHosts
+	defer func() { internalHosts = saved }()
+	lookups := 0
+	internalHosts = &hostResolver{lookup: fakeLookup(map[string]string{"evil.com": "1.2.3.4"}, &lookups)}
+	s := &recordingScanner{fakeScanner: fakeScanner{name: domain.SourceURLhaus, types: []int{domain.ReplyTypeURL},
+		res: domain.SourceResult{Result: domain.ResultDirty}}}
+	w := &Worker{scanners: map[string]Scanner{domain.SourceURLhaus: s}}
+	reply := &domain.WorkReply{}
+	w.handleURL(&domain.WorkRequest{URLs: []string{"http://localhost:8080/x", "http://evil.com/x", "https://git.corp.io/y"},
+		InternalDomains: []string{"corp.io"}}, reply)
+	if len(reply.URLs) != 3 || !reply.URLs[0].Internal || reply.URLs[0].Result != domain.ResultClean || len(reply.URLs[0].Sources) != 0 ||
+		reply.URLs[1].Internal || reply.URLs[1].Result != domain.ResultDirty || !reply.URLs[2].Internal {
+		t.Errorf("unexpected reply %+v", reply.URLs)
+	}
+	if len(s.values) != 1 || s.values[0] != "http://evil.com/x" {
+		t.Errorf("expected only the external URL to be scanned but got %v", s.values)
+	}
+	findings := replyFindings(defaultLocale, reply, "https://example.com/details?x=1", true)
+	if len(findings) != 3 || findings[0].verdict != "Internal" || findings[0].comment == "" {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+	// Channels that only see the findings that are not clean still see the internal ones
+	findings = replyFindings(defaultLocale, reply, "https://example.com/details?x=1", false)
+	if len(findings) != 3 || findings[0].verdict != "Internal" || findings[2].verdict != "Internal" {
+		t.Errorf("expected the internal URLs in a channel that is not verbose but got %+v", findings)
+	}
+	// Internal URLs were not checked so they are not counted as clean
+	b := queueBot(testQueue())
+	b.handleReplyStats(reply, &domain.Context{Team: "T1", Channel: "C1"}, b.subscriptions["T1"])
+	if stats := b.stats["T1"]; stats.URLsClean != 0 || stats.URLsUnknown != 2 || stats.URLsDirty != 1 {
+		t.Errorf("expected the internal URLs to be counted as unknown %+v", stats)
+	}
+}
+
+func TestHandleInternalDomainsAndEmails(t *testing.T) {
+	saved := internalHosts
+	defer func() { internalHosts = saved }()
+	lookups := 0
+	internalHosts = &hostResolver{lookup: fakeLookup(map[string]string{"evil.com": "1.2.3.4"}, &lookups)}
+	s := &recordingScanner{fakeScanner: fakeScanner{name: domain.SourceXFE, types: []int{domain.ReplyTypeDomain, domain.ReplyTypeEmail},
+		res: domain.SourceResult{Result: domain.ResultDirty}}}
+	w := &Worker{scanners: map[string]Scanner{domain.SourceXFE: s}}
+	reply := &domain.WorkReply{}
+	request := &domain.WorkRequest{Domains: []string{"git.corp.io", "intranet", "evil.com"}, Emails: []string{"bob@corp.io", "eve@evil.com"},
+		InternalDomains: []string{"corp.io"}}
+	w.handleDomains(request, reply)
+	w.handleEmails(request, reply)
+	if len(reply.Domains) != 3 || !reply.Domains[0].Internal || !reply.Domains[1].Internal || reply.Domains[2].Internal ||
+		len(reply.Domains[0].Sources) != 0 || reply.Domains[2].Result != domain.ResultDirty {
+		t.Errorf("unexpected domains %+v", reply.Domains)
+	}
+	if len(reply.Emails) != 2 || !reply.Emails[0].Internal || reply.Emails[1].Internal || len(reply.Emails[0].Sources) != 0 {
+		t.Errorf("unexpected emails %+v", reply.Emails)
+	}
+	if strings.Join(s.values, ",") != "evil.com,eve@evil.com" {
+		t.Errorf("expected only the external domain and email to be scanned but got %v", s.values)
+	}
+	findings := replyFindings(defaultLocale, reply, "https://example.com/details?x=1", false)
+	internal := 0
+	for _, f := range findings {
+		if f.verdict == "Internal" {
+			internal++
+		}
+	}
+	if internal != 3 {
+		t.Errorf("expected the internal domains and email in a channel that is not verbose but got %+v", findings)
+	}
+}
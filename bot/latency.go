@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+)
+
+// latencyWindow is the period the status command and the web API report the latency percentiles for
+const latencyWindow = time.Hour
+
+// maxLatencySamples bounds the memory of the window, the oldest samples go first
+const maxLatencySamples = 10000
+
+var replyLatencySeconds = metrics.NewHistogram("alfred_reply_latency_seconds",
+	"Time from pushing the work until the reply reached the bot, queue and worker included",
+	[]float64{1, 2.5, 5, 10, 15, 20, 30, 45, 60, 120, 300})
+
+// latencySample is the latency of a single reply
+type latencySample struct {
+	team    string
+	ts      time.Time
+	latency time.Duration
+}
+
+// latencies keeps the latencies of the replies of the last window in the order they arrived
+type latencies struct {
+	mu      sync.Mutex
+	samples []latencySample
+}
+
+// add the latency of a reply of the team and forget what is out of the window
+func (l *latencies) add(team string, latency time.Duration, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples = append(l.samples, latencySample{team: team, ts: now, latency: latency})
+	l.expire(now)
+}
+
+func (l *latencies) expire(now time.Time) {
+	drop := len(l.samples) - maxLatencySamples
+	if drop < 0 {
+		drop = 0
+	}
+	for drop < len(l.samples) && now.Sub(l.samples[drop].ts) > latencyWindow {
+		drop++
+	}
+	if drop > 0 {
+		l.samples = append(l.samples[:0], l.samples[drop:]...)
+	}
+}
+
+// percentiles returns the p50 and p95 of the team in the window and how many replies they are based on
+func (l *latencies) percentiles(team string, now time.Time) (p50, p95 time.Duration, count int) {
+	l.mu.Lock()
+	l.expire(now)
+	var values []time.Duration
+	for _, s := range l.samples {
+		if s.team == team {
+			values = append(values, s.latency)
+		}
+	}
+	l.mu.Unlock()
+	if len(values) == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return percentile(values, 50), percentile(values, 95), len(values)
+}
+
+// percentile of the sorted values using the nearest rank
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// observeLatency records how long the reply took if the context tells us when the work was pushed
+func (b *Bot) observeLatency(ctx *domain.Context) {
+	now := time.Now()
+	latency, ok := ctx.Latency(now)
+	if !ok {
+		return
+	}
+	replyLatencySeconds.Observe(latency.Seconds())
+	b.latencies.add(ctx.Team, latency, now)
+}
+
+// ReplyLatency returns the p50 and p95 of the time the replies of the team took in the last hour
+// and how many replies they are based on
+func (b *Bot) ReplyLatency(team string) (p50, p95 time.Duration, count int) {
+	return b.latencies.percentiles(team, time.Now())
+}
@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	var l latencies
+	now := time.Now()
+	for i := 1; i <= 100; i++ {
+		l.add("T1", time.Duration(i)*time.Second, now)
+	}
+	l.add("T2", time.Hour, now)
+	p50, p95, count := l.percentiles("T1", now)
+	if p50 != 50*time.Second || p95 != 95*time.Second || count != 100 {
+		t.Errorf("unexpected percentiles %v %v %d", p50, p95, count)
+	}
+	if _, _, count = l.percentiles("T3", now); count != 0 {
+		t.Errorf("expected no replies for an unknown team")
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	var l latencies
+	now := time.Now()
+	l.add("T1", time.Minute, now.Add(-2*latencyWindow))
+	l.add("T1", time.Second, now)
+	if p50, _, count := l.percentiles("T1", now); p50 != time.Second || count != 1 {
+		t.Errorf("expected only the recent reply but got %v of %d", p50, count)
+	}
+	for i := 0; i < maxLatencySamples+10; i++ {
+		l.add("T1", time.Second, now)
+	}
+	if len(l.samples) != maxLatencySamples {
+		t.Errorf("expected the samples to be capped but got %d", len(l.samples))
+	}
+}
+
+func TestObserveLatency(t *testing.T) {
+	b := &Bot{}
+	now := time.Now()
+	// Queue times win over the push time of a host with a wrong clock
+	b.observeLatency(&domain.Context{Team: "T1", Pushed: now.Add(time.Hour), Enqueued: now.Add(-3 * time.Second), Replied: now})
+	// Without a push time there is nothing to measure, e.g. answers from the cache
+	b.observeLatency(&domain.Context{Team: "T1"})
+	if p50, _, count := b.ReplyLatency("T1"); p50 != 3*time.Second || count != 1 {
+		t.Errorf("unexpected latency %v of %d", p50, count)
+	}
+}
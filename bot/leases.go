@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/util"
+)
+
+// leaseTTL is how long a lease is held without renewal. A few ticks so a slow tick does not lose it but another
+// instance takes over quickly if the owner dies.
+const leaseTTL = 3 * time.Minute
+
+// leaseStore hands out the leases of the periodic jobs between the instances, the repo in production
+type leaseStore interface {
+	AcquireLease(job, owner string, ttl time.Duration) (bool, error)
+	RenewLease(job, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(job, owner string) error
+}
+
+// runLeased runs the job only if this instance holds its lease, taking or renewing the lease as needed.
+// Only jobs that work on the shared DB are leased, the counters and caches in memory belong to every instance.
+func (b *Bot) runLeased(store leaseStore, job string, run func()) {
+	var ok bool
+	var err error
+	if b.leases[job] {
+		ok, err = store.RenewLease(job, util.Hostname, leaseTTL)
+	}
+	// The lease might have expired while we were busy, try to take it again
+	if !ok && err == nil {
+		ok, err = store.AcquireLease(job, util.Hostname, leaseTTL)
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("job", job).Warn("Unable to get the lease of the job")
+		return
+	}
+	if ok != b.leases[job] {
+		logrus.WithField("job", job).Infof("Holding the lease of the job - %v", ok)
+	}
+	if b.leases == nil {
+		b.leases = make(map[string]bool)
+	}
+	b.leases[job] = ok
+	if ok {
+		run()
+	}
+}
+
+// releaseLeases gives up the leases we hold so other instances do not wait for them to expire
+func (b *Bot) releaseLeases(store leaseStore) {
+	for job, held := range b.leases {
+		if !held {
+			continue
+		}
+		if err := store.ReleaseLease(job, util.Hostname); err != nil {
+			logrus.WithError(err).WithField("job", job).Warn("Unable to release the lease of the job")
+		}
+		delete(b.leases, job)
+	}
+}
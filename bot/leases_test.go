@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeLeaseStore hands the lease to us while free is set
+type fakeLeaseStore struct {
+	free     bool
+	err      error
+	renews   int
+	released []string
+}
+
+func (s *fakeLeaseStore) AcquireLease(job, owner string, ttl time.Duration) (bool, error) {
+	return s.free, s.err
+}
+
+func (s *fakeLeaseStore) RenewLease(job, owner string, ttl time.Duration) (bool, error) {
+	s.renews++
+	return s.free, s.err
+}
+
+func (s *fakeLeaseStore) ReleaseLease(job, owner string) error {
+	s.released = append(s.released, job)
+	return nil
+}
+
+func TestRunLeased(t *testing.T) {
+	b := &Bot{}
+	store := &fakeLeaseStore{}
+	runs := 0
+	run := func() { runs++ }
+	b.runLeased(store, "job", run)
+	if runs != 0 {
+		t.Fatal("expected the job not to run without the lease")
+	}
+	store.free = true
+	b.runLeased(store, "job", run)
+	b.runLeased(store, "job", run)
+	if runs != 2 || store.renews != 1 {
+		t.Errorf("expected the job to run while we hold the lease, runs %d renews %d", runs, store.renews)
+	}
+	// Another instance took over
+	store.free = false
+	b.runLeased(store, "job", run)
+	if runs != 2 || b.leases["job"] {
+		t.Errorf("expected the job to stop once the lease is lost")
+	}
+	store.err = errors.New("db down")
+	store.free = true
+	b.runLeased(store, "job", run)
+	if runs != 2 {
+		t.Errorf("expected the job not to run when the lease is unknown")
+	}
+}
+
+func TestReleaseLeases(t *testing.T) {
+	b := &Bot{leases: map[string]bool{"digests": true, "weekly_reports": false}}
+	store := &fakeLeaseStore{}
+	b.releaseLeases(store)
+	if len(store.released) != 1 || store.released[0] != "digests" || len(b.leases) != 1 {
+		t.Errorf("expected only the held lease to be released but got %v", store.released)
+	}
+}
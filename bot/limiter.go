@@ -0,0 +1,118 @@
+package bot
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+)
+
+// errRateLimited is returned when the team sent more work requests than it is allowed to
+var errRateLimited = errors.New("too many work requests")
+
+// limitWindow is the period of the work rate and how often we log that a team is limited
+const limitWindow = time.Minute
+
+// tokenBucket holds the work requests a team can still send
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when we last added tokens
+	warned time.Time // when we last logged that the team is limited
+}
+
+// rateLimiter limits the work requests per team with a token bucket. A nil limiter allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per limitWindow, also the size of the bucket
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter allows perWindow work requests per team, 0 for no limit
+func newRateLimiter(perWindow int) *rateLimiter {
+	if perWindow <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(perWindow), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token of the team if it has one. warn is true for the first refusal in the window.
+func (l *rateLimiter) allow(team string, now time.Time) (ok, warn bool) {
+	if l == nil {
+		return true, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, found := l.buckets[team]
+	if !found {
+		bucket = &tokenBucket{tokens: l.rate, last: now}
+		l.buckets[team] = bucket
+	}
+	bucket.tokens += l.rate * float64(now.Sub(bucket.last)) / float64(limitWindow)
+	if bucket.tokens > l.rate {
+		bucket.tokens = l.rate
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, false
+	}
+	if now.Sub(bucket.warned) >= limitWindow {
+		bucket.warned = now
+		return false, true
+	}
+	return false, false
+}
+
+// forget the bucket of the team
+func (l *rateLimiter) forget(team string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, team)
+}
+
+// pushWork pushes the work request unless the team is over its rate, those are counted in the team statistics
+func (b *Bot) pushWork(team string, sub *subscription, workReq *domain.WorkRequest) error {
+	ok, warn := b.limiter.allow(team, time.Now())
+	if !ok {
+		workPushesTotal.Inc("rate_limited", metrics.Team(team))
+		if warn {
+			logrus.Warnf("Team %s sent more than %d work requests in a minute, dropping them", team, conf.Options.Limits.WorkPerMinute)
+		}
+		b.smu.Lock()
+		defer b.smu.Unlock()
+		if stats, found := b.stats[team]; found {
+			stats.RateLimited++
+		} else {
+			b.stats[team] = &domain.Statistics{Team: sub.team.ID, RateLimited: 1}
+		}
+		return errRateLimited
+	}
+	start := time.Now()
+	if ctx, ok := workReq.Context.(*domain.Context); ok {
+		ctx.Pushed = start
+	}
+	workReq.Enqueued = start
+	if workReq.TTL == 0 {
+		workReq.TTL = conf.Options.Limits.WorkTTL
+	}
+	workReq.Batch()
+	err := b.q.PushWork(workReq)
+	workPushSeconds.Since(start, result(err))
+	workPushesTotal.Inc(result(err), metrics.Team(team))
+	return err
+}
+
+// commandTTL of the work requests the users asked for with a command, -1 if they never expire
+func commandTTL() int {
+	if conf.Options.Limits.CommandTTL <= 0 {
+		return -1
+	}
+	return conf.Options.Limits.CommandTTL
+}
@@ -0,0 +1,85 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("T1", now); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	if ok, warn := l.allow("T1", now); ok || !warn {
+		t.Errorf("the third request should be refused with a warning - %v, %v", ok, warn)
+	}
+	if ok, warn := l.allow("T1", now.Add(time.Second)); ok || warn {
+		t.Errorf("expected a silent refusal in the same window - %v, %v", ok, warn)
+	}
+	if ok, _ := l.allow("T2", now); !ok {
+		t.Error("other teams have their own bucket")
+	}
+	// Half a window refills one token
+	if ok, _ := l.allow("T1", now.Add(limitWindow/2+time.Second)); !ok {
+		t.Error("the bucket should refill over time")
+	}
+	l.forget("T1")
+	if _, ok := l.buckets["T1"]; ok {
+		t.Error("the bucket should be forgotten")
+	}
+	var none *rateLimiter
+	if ok, _ := none.allow("T1", now); !ok || newRateLimiter(0) != nil {
+		t.Error("no limit should allow everything")
+	}
+}
+
+func TestPushWorkTTL(t *testing.T) {
+	saved := conf.Options.Limits
+	defer func() { conf.Options.Limits = saved }()
+	conf.Options.Limits.WorkTTL, conf.Options.Limits.CommandTTL = 600, 0
+	q := testQueue()
+	b := queueBot(q)
+	sub := b.relevantTeam("T1")
+	ctx := &domain.Context{Team: "T1", Channel: "C1"}
+	b.pushWork("T1", sub, &domain.WorkRequest{Context: ctx})
+	b.pushWork("T1", sub, &domain.WorkRequest{Context: ctx, TTL: commandTTL()})
+	work := pushedWork(q)
+	if len(work) != 2 || work[0].Enqueued.IsZero() || work[0].TTL != 600 || work[1].TTL != -1 {
+		t.Fatalf("unexpected requests %+v", work)
+	}
+	if work[1].Expired(time.Now().Add(24 * time.Hour)) {
+		t.Error("commands should be exempt without a command TTL")
+	}
+	conf.Options.Limits.CommandTTL = 3600
+	if ttl := commandTTL(); ttl != 3600 {
+		t.Errorf("expected the command TTL but got %d", ttl)
+	}
+}
+
+func TestPushWorkRateLimited(t *testing.T) {
+	q := testQueue()
+	b := queueBot(q)
+	b.limiter = newRateLimiter(1)
+	sub := b.relevantTeam("T1")
+	ctx := &domain.Context{Team: "T1", Channel: "C1"}
+	if err := b.pushWork("T1", sub, &domain.WorkRequest{Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.pushWork("T1", sub, &domain.WorkRequest{Context: ctx}); err != errRateLimited {
+		t.Errorf("expected the second request to be limited, got %v", err)
+	}
+	if work := pushedWork(q); len(work) != 1 || b.stats["T1"].RateLimited != 1 {
+		t.Errorf("expected a single pushed request and a counted drop - %d, %+v", len(work), b.stats["T1"])
+	}
+	b.sweeping = make(map[string]bool)
+	b.sweepSubscriptions(time.Nanosecond)
+	if _, ok := b.limiter.buckets["T1"]; ok {
+		t.Error("the bucket should be removed with the idle subscription")
+	}
+}
@@ -0,0 +1,172 @@
+package bot
+
+import (
+	"errors"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// subscriptionStore is the part of the repo needed to load a subscription
+type subscriptionStore interface {
+	TeamByExternalID(team string) (*domain.Team, error)
+	ChannelsAndGroups(team string) (*domain.Configuration, error)
+	Webhook(team string) (*domain.Webhook, error)
+	EmailAlerts(team string) (*domain.EmailAlerts, error)
+	Sandbox(team string) (*domain.Sandbox, error)
+}
+
+// loadCall is a subscription load shared by everyone asking for the team while it runs
+type loadCall struct {
+	done chan struct{}
+	sub  *subscription
+	err  error
+}
+
+// loadFailure remembers why a team failed to load
+type loadFailure struct {
+	err error
+	ts  time.Time
+}
+
+// loadFailureTTL is how long we answer with the last error before trying to load the team again
+const loadFailureTTL = 30 * time.Second
+
+// loadSubscription loads the subscription of the team. Concurrent callers for the same team share one
+// round trip to the repo and teams that just failed get the same error without hitting the repo.
+func (b *Bot) loadSubscription(team string) (*subscription, error) {
+	b.lmu.Lock()
+	if b.loading == nil {
+		b.loading = make(map[string]*loadCall)
+		b.failedLoads = make(map[string]loadFailure)
+	}
+	if failure, ok := b.failedLoads[team]; ok && time.Since(failure.ts) < loadFailureTTL {
+		b.lmu.Unlock()
+		loadsTotal.Inc("cached_failure")
+		return nil, failure.err
+	}
+	if call, ok := b.loading[team]; ok {
+		b.lmu.Unlock()
+		<-call.done
+		loadsTotal.Inc("shared")
+		return call.sub, call.err
+	}
+	// A load might have finished since the caller looked
+	if sub := b.relevantTeam(team); sub != nil {
+		b.lmu.Unlock()
+		return sub, nil
+	}
+	call := &loadCall{done: make(chan struct{})}
+	b.loading[team] = call
+	b.lmu.Unlock()
+
+	start := time.Now()
+	call.sub, call.err = b.fetchSubscription(team)
+	loadSeconds.Since(start, result(call.err))
+	loadsTotal.Inc(result(call.err))
+
+	b.lmu.Lock()
+	delete(b.loading, team)
+	if call.err != nil {
+		b.failedLoads[team] = loadFailure{err: call.err, ts: time.Now()}
+	} else {
+		delete(b.failedLoads, team)
+	}
+	b.lmu.Unlock()
+	close(call.done)
+	return call.sub, call.err
+}
+
+// expireFailedLoads forgets the failures we would not answer with anymore
+func (b *Bot) expireFailedLoads() {
+	b.lmu.Lock()
+	defer b.lmu.Unlock()
+	for k, v := range b.failedLoads {
+		if time.Since(v.ts) >= loadFailureTTL {
+			delete(b.failedLoads, k)
+		}
+	}
+}
+
+// errUninstalled is returned when loading a team that uninstalled us
+var errUninstalled = errors.New("team uninstalled us")
+
+// reloadAttempts is how many times we try to reload a changed subscription before giving up
+const reloadAttempts = 5
+
+// reloadBackoff is the wait before the first retry of a reload, doubled for every retry
+var reloadBackoff = time.Second
+
+// subscriptionChanged reloads the subscription of the team in the background. The current subscription keeps
+// serving the messages of the team until the new one is ready and is kept if the reload fails.
+func (b *Bot) subscriptionChanged(team string) {
+	b.mu.RLock()
+	_, ok := b.subscriptions[team]
+	b.mu.RUnlock()
+	b.lmu.Lock()
+	defer b.lmu.Unlock()
+	// The team might have just installed us
+	delete(b.failedLoads, team)
+	if !ok {
+		// Nothing to refresh, it will be loaded with the next message
+		return
+	}
+	if b.reloading == nil {
+		b.reloading = make(map[string]int)
+	}
+	b.reloading[team]++
+	if b.reloading[team] > 1 {
+		// The running reload will pick up this change as well
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.reloadSubscription(team)
+	}()
+}
+
+// reloadSubscription reloads the team until it has the latest change
+func (b *Bot) reloadSubscription(team string) {
+	for {
+		b.lmu.Lock()
+		changes := b.reloading[team]
+		b.lmu.Unlock()
+		b.reloadWithRetries(team)
+		b.lmu.Lock()
+		if b.reloading[team] == changes {
+			delete(b.reloading, team)
+			b.lmu.Unlock()
+			return
+		}
+		b.lmu.Unlock()
+	}
+}
+
+// reloadWithRetries swaps the subscription of the team with a fresh one, retrying with a backoff
+func (b *Bot) reloadWithRetries(team string) {
+	wait := reloadBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := b.fetchSubscription(team)
+		switch {
+		case err == nil:
+			loadsTotal.Inc("reloaded")
+			return
+		case err == errUninstalled:
+			teamLog(team, "").Info("Team uninstalled us, dropping the subscription")
+			b.dropSubscription(team)
+			return
+		case attempt == reloadAttempts:
+			loadsTotal.Inc("reload_failed")
+			teamLog(team, "").WithError(err).Error("Unable to reload team, keeping the current configuration")
+			return
+		}
+		teamLog(team, "").WithError(err).Warnf("Unable to reload team, retrying in %v", wait)
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
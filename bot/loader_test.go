@@ -0,0 +1,140 @@
+package bot
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+// countingStore counts the team loads, holds them until released and fails for the given teams
+type countingStore struct {
+	loads       int32
+	release     chan struct{}
+	fail        map[string]bool
+	uninstalled bool
+}
+
+func (s *countingStore) TeamByExternalID(team string) (*domain.Team, error) {
+	atomic.AddInt32(&s.loads, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	if s.fail[team] {
+		return nil, errors.New("no such team")
+	}
+	if s.uninstalled {
+		return &domain.Team{ID: "9", ExternalID: team, Status: domain.UserStatusInactive}, nil
+	}
+	return &domain.Team{ID: "9", ExternalID: team, BotUserID: "UBOT9"}, nil
+}
+
+func (s *countingStore) ChannelsAndGroups(team string) (*domain.Configuration, error) {
+	return &domain.Configuration{Team: team}, nil
+}
+
+func (s *countingStore) Webhook(team string) (*domain.Webhook, error) {
+	return nil, nil
+}
+
+func (s *countingStore) EmailAlerts(team string) (*domain.EmailAlerts, error) {
+	return nil, nil
+}
+
+func (s *countingStore) Sandbox(team string) (*domain.Sandbox, error) {
+	return nil, nil
+}
+
+func TestLoadSubscriptionConcurrent(t *testing.T) {
+	b := queueBot(testQueue())
+	store := &countingStore{release: make(chan struct{})}
+	b.store = store
+	const n = 20
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			// Our own message so the bot stops right after finding the team
+			b.handleMessage(slack.Response{"team_id": "T9",
+				"event": map[string]interface{}{"type": "message", "channel": "C9", "user": "UBOT9", "text": "hi"}})
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+	if loads := atomic.LoadInt32(&store.loads); loads != 1 {
+		t.Errorf("expected a single load, got %d", loads)
+	}
+	if b.relevantTeam("T9") == nil {
+		t.Error("the team should be subscribed")
+	}
+}
+
+func TestLoadSubscriptionFailure(t *testing.T) {
+	b := queueBot(testQueue())
+	store := &countingStore{fail: map[string]bool{"T9": true}}
+	b.store = store
+	for i := 0; i < 3; i++ {
+		if _, err := b.loadSubscription("T9"); err == nil {
+			t.Fatal("expected the load to fail")
+		}
+	}
+	if store.loads != 1 {
+		t.Errorf("failed team should be cached, got %d loads", store.loads)
+	}
+	store.fail["T9"] = false
+	b.subscriptionChanged("T9")
+	if _, err := b.loadSubscription("T9"); err != nil || store.loads != 2 {
+		t.Errorf("a changed team should be loaded again - %v, %d loads", err, store.loads)
+	}
+}
+
+func TestSubscriptionChangedReloads(t *testing.T) {
+	b := queueBot(testQueue())
+	b.store = &countingStore{}
+	old := b.relevantTeam("T1")
+	b.subscriptionChanged("T1")
+	b.wg.Wait()
+	sub := b.relevantTeam("T1")
+	if sub == old || sub.configuration.Team != "9" {
+		t.Errorf("expected the subscription to be swapped, got %+v", sub.configuration)
+	}
+	// Teams we do not serve are loaded lazily
+	b.subscriptionChanged("T2")
+	b.wg.Wait()
+	if b.relevantTeam("T2") != nil {
+		t.Error("an unknown team should not be loaded by a change")
+	}
+}
+
+func TestSubscriptionChangedKeepsOldOnFailure(t *testing.T) {
+	defer func(backoff time.Duration) { reloadBackoff = backoff }(reloadBackoff)
+	reloadBackoff = time.Millisecond
+	b := queueBot(testQueue())
+	store := &countingStore{fail: map[string]bool{"T1": true}}
+	b.store = store
+	old := b.relevantTeam("T1")
+	b.subscriptionChanged("T1")
+	b.wg.Wait()
+	if store.loads != reloadAttempts {
+		t.Errorf("expected %d attempts, got %d", reloadAttempts, store.loads)
+	}
+	if b.relevantTeam("T1") != old {
+		t.Error("the old subscription should keep serving the team")
+	}
+}
+
+func TestSubscriptionChangedUninstalled(t *testing.T) {
+	b := queueBot(testQueue())
+	b.store = &countingStore{uninstalled: true}
+	b.subscriptionChanged("T1")
+	b.wg.Wait()
+	if b.relevantTeam("T1") != nil {
+		t.Error("a team that uninstalled us should be dropped")
+	}
+}
@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+)
+
+// debugEnabled checks the log level before we serialize something only the debug logs need
+func debugEnabled() bool {
+	return logrus.GetLevel() >= logrus.DebugLevel
+}
+
+// logFields returns the fields identifying the message of the context in the logs, empty values are left out
+func logFields(ctx *domain.Context) logrus.Fields {
+	fields := logrus.Fields{}
+	if ctx == nil {
+		return fields
+	}
+	for k, v := range map[string]string{"team": ctx.Team, "channel": ctx.Channel, "user": ctx.User, "msg_ts": ctx.TS} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// contextLog returns a log entry with the fields of the context
+func contextLog(ctx *domain.Context) *logrus.Entry {
+	return logrus.WithFields(logFields(ctx))
+}
+
+// teamLog returns a log entry for a command of the team in the channel
+func teamLog(team, channel string) *logrus.Entry {
+	return contextLog(&domain.Context{Team: team, Channel: channel})
+}
+
+// replyTypeNames are the indicator_type values of the reply types
+var replyTypeNames = []struct {
+	t    int
+	name string
+}{
+	{domain.ReplyTypeFile, "file"},
+	{domain.ReplyTypeURL, "url"},
+	{domain.ReplyTypeDomain, "domain"},
+	{domain.ReplyTypeEmail, "email"},
+	{domain.ReplyTypeIP, "ip"},
+	{domain.ReplyTypeHash, "hash"},
+	{domain.ReplyTypeCVE, "cve"},
+	{domain.ReplyTypeWallet, "wallet"},
+	{domain.ReplyTypeCustom, "custom"},
+}
+
+// replyLog returns a log entry for the reply with the context fields and the types of indicators in it
+func replyLog(reply *domain.WorkReply, ctx *domain.Context) *logrus.Entry {
+	var types []string
+	for _, t := range replyTypeNames {
+		if reply.Type&t.t > 0 {
+			types = append(types, t.name)
+		}
+	}
+	return contextLog(ctx).WithField("indicator_type", strings.Join(types, ","))
+}
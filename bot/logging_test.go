@@ -0,0 +1,35 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestLogFields(t *testing.T) {
+	fields := logFields(&domain.Context{Team: "T1", Channel: "C1", User: "U1", TS: "1.1", OriginalUser: "U2"})
+	if len(fields) != 4 || fields["team"] != "T1" || fields["channel"] != "C1" || fields["user"] != "U1" || fields["msg_ts"] != "1.1" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+	if fields = logFields(&domain.Context{Team: "T1"}); len(fields) != 1 {
+		t.Errorf("empty values should be left out - %v", fields)
+	}
+	if fields = logFields(nil); len(fields) != 0 {
+		t.Errorf("expected no fields for a nil context - %v", fields)
+	}
+}
+
+func TestReplyLogTypes(t *testing.T) {
+	entry := replyLog(&domain.WorkReply{Type: domain.ReplyTypeURL | domain.ReplyTypeIP}, &domain.Context{Team: "T1"})
+	if entry.Data["indicator_type"] != "url,ip" || entry.Data["team"] != "T1" {
+		t.Errorf("unexpected fields %v", entry.Data)
+	}
+	found := &indicators{ips: []string{"8.8.8.8"}, cves: []string{"CVE-2020-0001"}}
+	if types := found.types(); types != "ip,cve" {
+		t.Errorf("unexpected types %s", types)
+	}
+	var none *indicators
+	if none.types() != "file" {
+		t.Error("a message without indicators is a file")
+	}
+}
@@ -0,0 +1,77 @@
+package bot
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// spoofTargets are the domains phishing emails impersonate the most
+var spoofTargets = []string{
+	"adobe.com", "amazon.com", "apple.com", "bankofamerica.com", "chase.com", "docusign.com", "dropbox.com",
+	"facebook.com", "github.com", "google.com", "icloud.com", "linkedin.com", "microsoft.com", "netflix.com",
+	"office.com", "outlook.com", "paypal.com", "slack.com", "wellsfargo.com", "yahoo.com",
+}
+
+// homoglyphReplacer maps characters (and pairs) that are commonly used to imitate letters
+var homoglyphReplacer = strings.NewReplacer("rn", "m", "vv", "w", "0", "o", "1", "l", "3", "e", "5", "s", "$", "s")
+
+// lookAlike returns the spoof target the domain imitates or an empty string if it does not look like one.
+// The target itself and its subdomains are never look-alikes.
+func lookAlike(d string) string {
+	d = strings.ToLower(d)
+	registered, err := publicsuffix.EffectiveTLDPlusOne(d)
+	if err != nil {
+		return ""
+	}
+	suffix, _ := publicsuffix.PublicSuffix(d)
+	name := strings.TrimSuffix(registered, "."+suffix)
+	for _, target := range spoofTargets {
+		if registered == target {
+			return ""
+		}
+	}
+	for _, target := range spoofTargets {
+		targetName := target[:strings.Index(target, ".")]
+		switch {
+		case strings.HasPrefix(d, target+"."): // paypal.com.account-verify.net
+			return target
+		case homoglyphReplacer.Replace(name) == targetName: // paypa1.com, rnicrosoft.com
+			return target
+		case len(targetName) >= 6 && editDistance(name, targetName) == 1: // paypall.com, amazom.com
+			return target
+		}
+	}
+	return ""
+}
+
+// editDistance is the Levenshtein distance between the two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
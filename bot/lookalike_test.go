@@ -0,0 +1,24 @@
+package bot
+
+import "testing"
+
+func TestLookAlike(t *testing.T) {
+	tests := map[string]string{
+		"paypal.com":                 "",
+		"mail.paypal.com":            "",
+		"example.com":                "",
+		"paypa1.com":                 "paypal.com",
+		"paypall.com":                "paypal.com",
+		"rnicrosoft.com":             "microsoft.com",
+		"secure.amaz0n.co.uk":        "amazon.com",
+		"paypal.com.verify-acct.net": "paypal.com",
+		"apple.net":                  "apple.com",
+		"chase.org":                  "chase.com",
+		"chose.com":                  "",
+	}
+	for d, expected := range tests {
+		if res := lookAlike(d); res != expected {
+			t.Errorf("lookAlike(%s) = %q, expected %q", d, res, expected)
+		}
+	}
+}
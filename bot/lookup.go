@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+	"github.com/demisto/alfred/util"
+	"github.com/demisto/goxforce"
+)
+
+// The types of arguments the direct vt and xfe lookups understand
+const (
+	lookupHash   = "hash"
+	lookupURL    = "url"
+	lookupIP     = "ip"
+	lookupDomain = "domain"
+)
+
+// lookupKind detects the type of a lookup argument and returns it normalized.
+// The kind is empty if we do not recognize the argument.
+func lookupKind(arg string) (string, string) {
+	arg, _ = refang(arg)
+	arg = strings.TrimSpace(unwrapLink(arg))
+	larg := strings.ToLower(arg)
+	for _, re := range []*regexp.Regexp{sha256Reg, sha1Reg, md5Reg} {
+		if re.FindString(arg) == arg {
+			return lookupHash, larg
+		}
+	}
+	switch {
+	case strings.HasPrefix(larg, "http://") || strings.HasPrefix(larg, "https://"):
+		return lookupURL, arg
+	case net.ParseIP(arg).To4() != nil:
+		return lookupIP, arg
+	case domainReg.FindString(larg) == larg && validDomain(larg):
+		return lookupDomain, larg
+	}
+	return "", arg
+}
+
+// lookupIndicators sorts the arguments of a direct lookup into the indicators we check and the ones we do not recognize
+func lookupIndicators(args []string) (*indicators, []string) {
+	found, unknown := &indicators{}, []string(nil)
+	for _, arg := range args {
+		kind, value := lookupKind(arg)
+		switch kind {
+		case lookupHash:
+			found.hashes = append(found.hashes, extractHashes(value)...)
+		case lookupURL:
+			found.urls = append(found.urls, value)
+		case lookupIP:
+			found.ips = append(found.ips, value)
+		case lookupDomain:
+			found.domains = append(found.domains, value)
+		default:
+			unknown = append(unknown, value)
+		}
+	}
+	return found, unknown
+}
+
+// lookupSkipped are the sources a direct lookup on the given one does not check
+func lookupSkipped(source string) []string {
+	var skipped []string
+	for _, s := range domain.Sources {
+		if s != source {
+			skipped = append(skipped, s)
+		}
+	}
+	return skipped
+}
+
+// handleLookup checks the hashes, URLs, domains and IPs after the vt or xfe command only with that source. The work
+// goes through the queue like any scan and the reply comes in the DM or in the thread we were mentioned in.
+func (b *Bot) handleLookup(team string, msg slack.Response, sub *subscription, source string) {
+	channel := msg.S("channel")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	inThread(postMessage, msg.S("thread_ts"))
+	usage := vtUsage
+	if source == domain.SourceXFE {
+		usage = xfeUsage
+	}
+	found, unknown := lookupIndicators(strings.Fields(msg.S("text"))[1:])
+	switch {
+	case !found.found():
+		postMessage["text"] = usage
+	case len(unknown) > 0:
+		postMessage["text"] = fmt.Sprintf("I could not recognize %s as a hash, URL, domain or IP.", strings.Join(unknown, ", "))
+	}
+	if _, ok := postMessage["text"]; ok {
+		if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting lookup message to Slack")
+		}
+	}
+	if !found.found() {
+		return
+	}
+	skipped := found.limit(conf.Options.Limits.Indicators)
+	workReq := domain.WorkRequestFromMessage(msg, sub.team.BotToken, sub.team.Credentials(), lookupSkipped(source), sub.configuration.Scoring)
+	found.apply(workReq, sub.configuration)
+	workReq.Skipped = skipped
+	workReq.ReplyQueue, workReq.TTL = util.Hostname, commandTTL()
+	workReq.Context = &domain.Context{Team: team, User: msg.S("user"), Type: "message", Channel: channel, OriginalUser: msg.S("user"), TS: msg.S("ts"),
+		ThreadTS: msg.S("thread_ts"), Mention: channel != "" && channel[0] != 'D'}
+	if err := b.pushWork(team, sub, workReq); err != nil && err != errRateLimited {
+		contextLog(workReq.Context.(*domain.Context)).WithError(err).Warn("Unable to push lookup request")
+		if debugEnabled() {
+			logrus.Debugf("Lookup request - %s", util.ToJSONStringNoIndent(workReq))
+		}
+	}
+}
+
+// newXFEClient returns an IBM X-Force Exchange client with the given credentials
+func newXFEClient(key, pass string) (*goxforce.Client, error) {
+	return goxforce.New(goxforce.SetCredentials(key, pass), goxforce.SetErrorLog(log.New(conf.LogWriter, "XFE:", log.Lshortfile)))
+}
@@ -0,0 +1,56 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+	"github.com/demisto/alfred/util"
+)
+
+func TestLookupKind(t *testing.T) {
+	tests := []struct {
+		arg, kind, value string
+	}{
+		{"44D88612FEA8A8F36DE82E1278ABB02F", lookupHash, "44d88612fea8a8f36de82e1278abb02f"},
+		{"3395856ce81f2b7382dee72602f798b642f14140", lookupHash, "3395856ce81f2b7382dee72602f798b642f14140"},
+		{"<http://example.com/login>", lookupURL, "http://example.com/login"},
+		{"hxxp://evil[.]com/x", lookupURL, "http://evil.com/x"},
+		{"8.8.8.8", lookupIP, "8.8.8.8"},
+		{"<http://Example.com|Example.com>", lookupDomain, "example.com"},
+		{"example[.]com", lookupDomain, "example.com"},
+		{"readme.txt", "", "readme.txt"},
+		{"hello", "", "hello"},
+	}
+	for _, test := range tests {
+		if kind, value := lookupKind(test.arg); kind != test.kind || value != test.value {
+			t.Errorf("lookupKind(%s) = %s, %s, expected %s, %s", test.arg, kind, value, test.kind, test.value)
+		}
+	}
+}
+
+func TestHandleLookup(t *testing.T) {
+	s, done := newFakeSlack()
+	defer done()
+	b := queueBot(testQueue())
+	sub := b.subscriptions["T1"]
+	sub.team.BotToken, sub.s = "xoxb-1", &slack.Client{Token: "xoxb-1"}
+	b.handleLookup("T1", slack.Response{"type": "message", "channel": "D1", "user": "U1", "ts": "1.1",
+		"text": "vt 8.8.8.8 hello <http://example.com|example.com>"}, sub, domain.SourceVT)
+	if len(s.posted) != 1 || !strings.Contains(s.posted[0], "could not recognize hello") {
+		t.Errorf("expected the unrecognized argument to be reported - %q", s.posted)
+	}
+	work := pushedWork(b.q)
+	if len(work) != 1 {
+		t.Fatalf("expected the lookup to be pushed but got %d requests", len(work))
+	}
+	if len(work[0].IPs) != 1 || len(work[0].Domains) != 1 || util.In(work[0].DisabledSources, domain.SourceVT) ||
+		!util.In(work[0].DisabledSources, domain.SourceXFE) {
+		t.Errorf("expected the indicators to be checked only with VirusTotal - %+v", work[0])
+	}
+	b.handleLookup("T1", slack.Response{"type": "message", "channel": "D1", "user": "U1", "ts": "1.2", "text": "xfe my-key"}, sub, domain.SourceXFE)
+	if len(s.posted) != 2 || s.posted[1] != xfeUsage || len(pushedWork(b.q)) != 0 {
+		t.Errorf("expected only the usage for unrecognized arguments - %q", s.posted)
+	}
+}
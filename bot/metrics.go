@@ -0,0 +1,30 @@
+package bot
+
+import (
+	"github.com/demisto/alfred/metrics"
+)
+
+var (
+	messagesTotal = metrics.NewCounter("alfred_messages_total",
+		"Slack events we received by what we did with them", "outcome", "team")
+	workPushSeconds = metrics.NewHistogram("alfred_work_push_seconds",
+		"Time it took to push a work request to the queue", metrics.DefaultBuckets, "result")
+	workPushesTotal = metrics.NewCounter("alfred_work_pushes_total",
+		"Work requests we tried to push to the queue", "result", "team")
+	repliesTotal = metrics.NewCounter("alfred_replies_total",
+		"Work replies we handled by what we did with them", "outcome", "team")
+	loadsTotal = metrics.NewCounter("alfred_subscription_loads_total",
+		"Subscription loads by result", "result")
+	loadSeconds = metrics.NewHistogram("alfred_subscription_load_seconds",
+		"Time it took to load a subscription from the database", metrics.DefaultBuckets, "result")
+	commandsTotal = metrics.NewCounter("alfred_commands_total",
+		"Commands users sent us by command and whether it was a DM or a mention", "command", "via")
+)
+
+// result of an operation for the metric labels
+func result(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
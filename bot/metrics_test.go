@@ -0,0 +1,25 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/demisto/alfred/metrics"
+)
+
+func TestHandleMessageMetrics(t *testing.T) {
+	q := testQueue()
+	b := queueBot(q)
+	pushed, ignored := messagesTotal.Value("pushed", metrics.Team("T1")), messagesTotal.Value("ignored", metrics.Team("T1"))
+	pushes := workPushSeconds.Count("ok")
+	b.handleMessage(event(t, `{"type":"message","channel":"C1","user":"U1","text":"check 8.8.8.8","ts":"2.1"}`))
+	b.handleMessage(event(t, `{"type":"message","channel":"C1","user":"UBOT","text":"8.8.8.8","ts":"2.2"}`))
+	if messagesTotal.Value("pushed", metrics.Team("T1")) != pushed+1 {
+		t.Error("expected the pushed message to be counted")
+	}
+	if messagesTotal.Value("ignored", metrics.Team("T1")) != ignored+1 {
+		t.Error("expected our own message to be counted as ignored")
+	}
+	if workPushSeconds.Count("ok") != pushes+1 {
+		t.Error("expected the push to be timed")
+	}
+}
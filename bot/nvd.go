@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+// nvdClient queries the NVD CVE API for vulnerability details
+type nvdClient struct {
+	url string
+	key string
+	c   *http.Client
+}
+
+type nvdCVSS struct {
+	CVSSData struct {
+		BaseScore    float64 `json:"baseScore"`
+		BaseSeverity string  `json:"baseSeverity"`
+		VectorString string  `json:"vectorString"`
+	} `json:"cvssData"`
+	BaseSeverity string `json:"baseSeverity"` // CVSS v2 keeps the severity outside the data
+}
+
+type nvdResponse struct {
+	Vulnerabilities []struct {
+		CVE struct {
+			ID           string `json:"id"`
+			Published    string `json:"published"`
+			Descriptions []struct {
+				Lang  string `json:"lang"`
+				Value string `json:"value"`
+			} `json:"descriptions"`
+			Metrics struct {
+				V31 []nvdCVSS `json:"cvssMetricV31"`
+				V30 []nvdCVSS `json:"cvssMetricV30"`
+				V2  []nvdCVSS `json:"cvssMetricV2"`
+			} `json:"metrics"`
+			Configurations []struct {
+				Nodes []struct {
+					CPEMatch []struct {
+						Vulnerable bool   `json:"vulnerable"`
+						Criteria   string `json:"criteria"`
+					} `json:"cpeMatch"`
+				} `json:"nodes"`
+			} `json:"configurations"`
+		} `json:"cve"`
+	} `json:"vulnerabilities"`
+}
+
+func newNVDClient(u, key string) *nvdClient {
+	return &nvdClient{url: u, key: key, c: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// cpeProduct converts a CPE 2.3 string to "vendor product"
+func cpeProduct(cpe string) string {
+	parts := strings.Split(cpe, ":")
+	if len(parts) < 5 {
+		return cpe
+	}
+	return strings.Replace(parts[3]+" "+parts[4], "_", " ", -1)
+}
+
+// CVE details for the given ID. If the CVE is not known, NotFound is set on the reply.
+func (n *nvdClient) CVE(id string) (*domain.CVEReply, error) {
+	req, err := http.NewRequest("GET", n.url+"?cveId="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if n.key != "" {
+		req.Header.Set("apiKey", n.key)
+	}
+	resp, err := n.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &domain.CVEReply{Details: id}
+	if resp.StatusCode == http.StatusNotFound {
+		res.NotFound = true
+		return res, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from NVD - %s", resp.Status)
+	}
+	var data nvdResponse
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if len(data.Vulnerabilities) == 0 {
+		res.NotFound = true
+		return res, nil
+	}
+	cve := data.Vulnerabilities[0].CVE
+	res.Published = cve.Published
+	for _, d := range cve.Descriptions {
+		if d.Lang == "en" {
+			res.Summary = d.Value
+			break
+		}
+	}
+	// Prefer the newest CVSS version available
+	for _, metrics := range [][]nvdCVSS{cve.Metrics.V31, cve.Metrics.V30, cve.Metrics.V2} {
+		if len(metrics) > 0 {
+			res.Score, res.Vector = metrics[0].CVSSData.BaseScore, metrics[0].CVSSData.VectorString
+			res.Severity = metrics[0].CVSSData.BaseSeverity
+			if res.Severity == "" {
+				res.Severity = metrics[0].BaseSeverity
+			}
+			break
+		}
+	}
+	for _, c := range cve.Configurations {
+		for _, node := range c.Nodes {
+			for _, match := range node.CPEMatch {
+				if !match.Vulnerable {
+					continue
+				}
+				if product := cpeProduct(match.Criteria); !util.In(res.Products, product) {
+					res.Products = append(res.Products, product)
+				}
+			}
+		}
+	}
+	return res, nil
+}
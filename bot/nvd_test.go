@@ -0,0 +1,40 @@
+package bot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNVDClient_CVE(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("cveId") != "CVE-2021-44228" {
+			fmt.Fprint(w, `{"vulnerabilities":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"vulnerabilities":[{"cve":{"id":"CVE-2021-44228","published":"2021-12-10T10:15:09.143",
+"descriptions":[{"lang":"es","value":"nope"},{"lang":"en","value":"Apache Log4j2 JNDI features"}],
+"metrics":{"cvssMetricV31":[{"cvssData":{"baseScore":10.0,"baseSeverity":"CRITICAL","vectorString":"CVSS:3.1/AV:N"}}],
+"cvssMetricV2":[{"cvssData":{"baseScore":9.3},"baseSeverity":"HIGH"}]},
+"configurations":[{"nodes":[{"cpeMatch":[{"vulnerable":true,"criteria":"cpe:2.3:a:apache:log4j:*:*:*:*:*:*:*:*"},
+{"vulnerable":true,"criteria":"cpe:2.3:a:apache:log4j:2.0:beta9:*:*:*:*:*:*"},
+{"vulnerable":false,"criteria":"cpe:2.3:o:linux:linux_kernel:-:*:*:*:*:*:*:*"}]}]}]}}]}`)
+	}))
+	defer ts.Close()
+	n := newNVDClient(ts.URL, "")
+	res, err := n.CVE("CVE-2021-44228")
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if res.Score != 10 || res.Severity != "CRITICAL" || res.Summary != "Apache Log4j2 JNDI features" {
+		t.Errorf("unexpected CVE details %+v", res)
+	}
+	if len(res.Products) != 1 || res.Products[0] != "apache log4j" {
+		t.Errorf("unexpected products %v", res.Products)
+	}
+	res, err = n.CVE("CVE-1999-0001")
+	if err != nil || !res.NotFound {
+		t.Errorf("expected not found but got %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,230 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// otxURL is the AlienVault OTX API. Replaced by the tests.
+var otxURL = "https://otx.alienvault.com"
+
+const (
+	// otxMaxPulses caps the pulses we page through for the names and tags, popular indicators are in thousands
+	otxMaxPulses = 200
+	// otxPageSize is the number of pulses we ask for in a page
+	otxPageSize = 50
+	// otxTopPulses and otxTopTags are how many we show in the reply
+	otxTopPulses = 3
+	otxTopTags   = 5
+)
+
+// errOTXKey is returned if OTX does not accept the key
+var errOTXKey = errors.New("OTX did not accept the key")
+
+// otxScanner checks IPs, domains, URLs and hashes with AlienVault OTX using the key of the team. Pulses are what the
+// community shared about an indicator and include benign ones, so a result is weak unless OTX whitelisted it.
+type otxScanner struct {
+	url string
+	key string
+	c   *http.Client
+}
+
+// newOTXScanner skips the source for teams without a key
+func newOTXScanner(creds domain.Credentials) (Scanner, error) {
+	if creds.Key == "" {
+		return nil, nil
+	}
+	return &otxScanner{url: otxURL, key: creds.Key, c: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (o *otxScanner) Name() string {
+	return domain.SourceOTX
+}
+
+func (o *otxScanner) Supports(indicatorType int) bool {
+	switch indicatorType {
+	case domain.ReplyTypeHash, domain.ReplyTypeURL, domain.ReplyTypeIP, domain.ReplyTypeDomain:
+		return true
+	}
+	return false
+}
+
+// breakerKey is per key so a team with a bad key does not stop the checks of the others
+func (o *otxScanner) breakerKey() string {
+	return domain.SourceOTX + ":" + o.key
+}
+
+// otxSection is the indicator type in the API and the indicator pages
+func otxSection(indicator scanIndicator) string {
+	switch indicator.Type {
+	case domain.ReplyTypeHash:
+		return "file"
+	case domain.ReplyTypeURL:
+		return "url"
+	case domain.ReplyTypeDomain:
+		return "domain"
+	}
+	if strings.Contains(indicator.Value, ":") {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// otxPulse is a report shared on OTX
+type otxPulse struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Tags            []string `json:"tags"`
+	SubscriberCount int      `json:"subscriber_count"`
+}
+
+// otxGeneral is the general section of an indicator
+type otxGeneral struct {
+	PulseInfo struct {
+		Count  int        `json:"count"`
+		Pulses []otxPulse `json:"pulses"`
+	} `json:"pulse_info"`
+	// Validation lists why OTX whitelists the indicator, e.g. a top Alexa domain
+	Validation []struct {
+		Source  string `json:"source"`
+		Message string `json:"message"`
+	} `json:"validation"`
+}
+
+// otxPulsePage is a page of the pulses of an indicator
+type otxPulsePage struct {
+	Count   int        `json:"count"`
+	Next    string     `json:"next"`
+	Results []otxPulse `json:"results"`
+}
+
+// get decodes the answer of the path, false if OTX does not know the indicator
+func (o *otxScanner) get(ctx context.Context, path string, out interface{}) (bool, error) {
+	req, err := http.NewRequest("GET", o.url+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-OTX-API-KEY", o.key)
+	req.Header.Set("Accept", "application/json")
+	resp, err := o.c.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	// OTX answers invalid indicators with bad request
+	case http.StatusNotFound, http.StatusBadRequest:
+		return false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, errOTXKey
+	default:
+		return false, fmt.Errorf("OTX returned %s", resp.Status)
+	}
+	return true, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// pulses pages through the pulses of the indicator up to otxMaxPulses
+func (o *otxScanner) pulses(ctx context.Context, section, value string) ([]otxPulse, error) {
+	var pulses []otxPulse
+	for page := 1; len(pulses) < otxMaxPulses; page++ {
+		var p otxPulsePage
+		path := fmt.Sprintf("/api/v1/indicators/%s/%s/pulses?limit=%d&page=%d", section, url.PathEscape(value), otxPageSize, page)
+		ok, err := o.get(ctx, path, &p)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		pulses = append(pulses, p.Results...)
+		if p.Next == "" || len(p.Results) == 0 {
+			break
+		}
+	}
+	if len(pulses) > otxMaxPulses {
+		pulses = pulses[:otxMaxPulses]
+	}
+	return pulses, nil
+}
+
+// otxTop are the names of the pulses with the most subscribers and the most common tags
+func otxTop(pulses []otxPulse) ([]string, []string) {
+	sorted := append([]otxPulse{}, pulses...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].SubscriberCount > sorted[j].SubscriberCount })
+	var names []string
+	for i := 0; i < len(sorted) && len(names) < otxTopPulses; i++ {
+		if sorted[i].Name != "" {
+			names = append(names, sorted[i].Name)
+		}
+	}
+	counts := make(map[string]int)
+	var tags []string
+	for _, p := range pulses {
+		for _, t := range p.Tags {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == "" {
+				continue
+			}
+			if counts[t] == 0 {
+				tags = append(tags, t)
+			}
+			counts[t]++
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return counts[tags[i]] > counts[tags[j]] })
+	if len(tags) > otxTopTags {
+		tags = tags[:otxTopTags]
+	}
+	return names, tags
+}
+
+func (o *otxScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res := domain.SourceResult{Result: domain.ResultUnknown, NotFound: true}
+	section := otxSection(indicator)
+	var general otxGeneral
+	ok, err := o.get(ctx, fmt.Sprintf("/api/v1/indicators/%s/%s/general", section, url.PathEscape(indicator.Value)), &general)
+	if !ok || err != nil {
+		return res, err
+	}
+	count := general.PulseInfo.Count
+	link := fmt.Sprintf("https://otx.alienvault.com/indicator/%s/%s", strings.ToLower(section), url.PathEscape(indicator.Value))
+	if len(general.Validation) > 0 {
+		res.NotFound, res.Result, res.Link = false, domain.ResultClean, link
+		res.Score = fmt.Sprintf("Whitelisted, %d pulses", count)
+		res.Detail = "Whitelisted: " + general.Validation[0].Message
+		return res, nil
+	}
+	if count == 0 {
+		return res, nil
+	}
+	pulses := general.PulseInfo.Pulses
+	if count > len(pulses) && len(pulses) < otxMaxPulses {
+		if pulses, err = o.pulses(ctx, section, indicator.Value); err != nil {
+			return res, err
+		}
+	}
+	names, tags := otxTop(pulses)
+	res.NotFound, res.Result, res.Weak, res.Value = false, domain.ResultDirty, true, float64(count)
+	res.Score, res.Link = strconv.Itoa(count)+" pulses", link
+	lines := []string{fmt.Sprintf("Pulses: %d", count)}
+	if len(names) > 0 {
+		lines = append(lines, "Top Pulses: "+strings.Join(names, "; "))
+	}
+	if len(tags) > 0 {
+		lines = append(lines, "Tags: "+strings.Join(tags, ", "))
+	}
+	res.Detail = strings.Join(lines, "\n")
+	return res, nil
+}
@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestOTXScan(t *testing.T) {
+	pages := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-OTX-API-KEY") != "test-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/indicators/IPv4/1.2.3.4/general":
+			w.Write([]byte(`{"pulse_info":{"count":300,"pulses":[{"name":"first","tags":["mirai"]}]}}`))
+		case "/api/v1/indicators/IPv4/1.2.3.4/pulses":
+			pages++
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			var results []string
+			for i := 0; i < otxPageSize; i++ {
+				results = append(results, fmt.Sprintf(`{"name":"pulse %d-%d","tags":["Mirai","botnet"],"subscriber_count":%d}`, page, i, page*100+i))
+			}
+			w.Write([]byte(`{"count":300,"next":"more","results":[` + strings.Join(results, ",") + `]}`))
+		case "/api/v1/indicators/domain/google.com/general":
+			w.Write([]byte(`{"pulse_info":{"count":40},"validation":[{"source":"alexa","message":"Alexa rank: #1"}]}`))
+		case "/api/v1/indicators/file/44d88612fea8a8f36de82e1278abb02f/general":
+			w.Write([]byte(`{"pulse_info":{"count":0,"pulses":[]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	o := &otxScanner{url: srv.URL, key: "test-key", c: http.DefaultClient}
+	res, err := o.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "1.2.3.4"})
+	if err != nil || res.NotFound || res.Result != domain.ResultDirty || !res.Weak || res.Score != "300 pulses" ||
+		res.Link != "https://otx.alienvault.com/indicator/ipv4/1.2.3.4" {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	if pages != otxMaxPulses/otxPageSize {
+		t.Errorf("expected to stop paging at %d pulses but got %d pages", otxMaxPulses, pages)
+	}
+	if !strings.Contains(res.Detail, "Top Pulses: pulse 4-49; pulse 4-48; pulse 4-47") || !strings.Contains(res.Detail, "Tags: mirai, botnet") {
+		t.Errorf("unexpected detail %s", res.Detail)
+	}
+	res, err = o.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeDomain, Value: "google.com"})
+	if err != nil || res.Result != domain.ResultClean || res.Weak || !strings.Contains(res.Detail, "Alexa") {
+		t.Errorf("expected a whitelisted domain to be clean but got %+v - %v", res, err)
+	}
+	for _, indicator := range []scanIndicator{{Type: domain.ReplyTypeHash, Value: "44d88612fea8a8f36de82e1278abb02f"},
+		{Type: domain.ReplyTypeURL, Value: "http://example.com/x"}} {
+		res, err = o.Scan(context.Background(), indicator)
+		if err != nil || !res.NotFound || res.Result != domain.ResultUnknown {
+			t.Errorf("expected no data for %s but got %+v - %v", indicator.Value, res, err)
+		}
+	}
+	o.key = "bad-key"
+	if _, err = o.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "1.2.3.4"}); err != errOTXKey {
+		t.Errorf("expected the key error but got %v", err)
+	}
+}
+
+func TestNewOTXScanner(t *testing.T) {
+	if s, err := newOTXScanner(domain.Credentials{}); s != nil || err != nil {
+		t.Errorf("expected no scanner without a key but got %v - %v", s, err)
+	}
+	s, err := newOTXScanner(domain.Credentials{Key: "team-key"})
+	if err != nil || !s.Supports(domain.ReplyTypeHash) || s.Supports(domain.ReplyTypeEmail) || scanBreaker(s) != "otx:team-key" {
+		t.Errorf("unexpected scanner %v - %v", s, err)
+	}
+}
@@ -0,0 +1,258 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	stackerr "github.com/go-errors/errors"
+)
+
+var pendingScansTotal = metrics.NewCounter("alfred_pending_scans_total",
+	"Lookups that waited for the rate limit of the key of their source by the source and the outcome", "source", "outcome")
+
+// defaultPendingWait is how long the pending lookups of a reply wait for their turn if it is not configured
+const defaultPendingWait = 15 * time.Minute
+
+// keySchedule spaces the lookups of each key of a source. A lookup takes the next free slot of its key and moves it
+// on by the interval of the key so the lookups go in the order they asked for their turn.
+type keySchedule struct {
+	mu   sync.Mutex
+	next map[string]time.Time // The next free slot of each key
+}
+
+func newKeySchedule() *keySchedule {
+	return &keySchedule{next: make(map[string]time.Time)}
+}
+
+// reserve takes the next slot of the key unless it is after latest, and returns when the slot is
+func (s *keySchedule) reserve(key string, interval time.Duration, now, latest time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot := s.next[key]
+	if slot.Before(now) {
+		slot = now
+	}
+	if slot.After(latest) {
+		return slot, false
+	}
+	s.next[key] = slot.Add(interval)
+	return slot, true
+}
+
+// backoff stops the lookups of the key until the time, the source said the key is over its quota
+func (s *keySchedule) backoff(key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until.After(s.next[key]) {
+		s.next[key] = until
+	}
+}
+
+// wait for the turn of a lookup with the key, false if it does not come before the context is done
+func (s *keySchedule) wait(ctx context.Context, key string, interval time.Duration) bool {
+	now := time.Now()
+	latest, ok := ctx.Deadline()
+	if !ok {
+		latest = now.Add(defaultPendingWait)
+	}
+	slot, ok := s.reserve(key, interval, now, latest)
+	if !ok {
+		return false
+	}
+	if d := slot.Sub(now); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// queuedScanner is a scanner with a rate limit per key. It returns a pending result for an indicator with Queue set
+// if it is not its turn and the worker looks it up after it replied.
+type queuedScanner interface {
+	Scanner
+	// wait for the turn of a pending lookup, false if it does not come before the context is done
+	wait(ctx context.Context) bool
+}
+
+// pendingScan is a result the worker still has to look up
+type pendingScan struct {
+	indicatorType int
+	value         string
+	res           *domain.SourceResult
+	score         func() // Sets the verdict of the indicator again once the result is in
+}
+
+// pendingScans are the pending results of the reply
+func pendingScans(scoring *domain.ScoringProfile, reply *domain.WorkReply) []pendingScan {
+	var res []pendingScan
+	add := func(indicatorType int, value string, sources []domain.SourceResult, score func()) {
+		for i := range sources {
+			if sources[i].Pending {
+				res = append(res, pendingScan{indicatorType: indicatorType, value: value, res: &sources[i], score: score})
+			}
+		}
+	}
+	for i := range reply.URLs {
+		u := &reply.URLs[i]
+		add(domain.ReplyTypeURL, u.Details, u.Sources, func() { scoreURL(scoring, u) })
+	}
+	for i := range reply.IPs {
+		ip := &reply.IPs[i]
+		add(domain.ReplyTypeIP, ip.Details, ip.Sources, func() { scoreIP(scoring, ip) })
+	}
+	for i := range reply.Hashes {
+		h := &reply.Hashes[i]
+		add(domain.ReplyTypeHash, h.Details, h.Sources, func() { scoreHash(scoring, h) })
+	}
+	for i := range reply.Domains {
+		d := &reply.Domains[i]
+		add(domain.ReplyTypeDomain, d.Details, d.Sources, func() { scoreDomain(scoring, d) })
+	}
+	for i := range reply.Emails {
+		e := &reply.Emails[i]
+		add(domain.ReplyTypeEmail, e.Details, e.Sources, func() { scoreEmail(scoring, e) })
+	}
+	return res
+}
+
+// pendingWait is how long the pending lookups of a reply wait for their turn
+func pendingWait() time.Duration {
+	if conf.Options.VTRate.MaxWait > 0 {
+		return time.Duration(conf.Options.VTRate.MaxWait) * time.Second
+	}
+	return defaultPendingWait
+}
+
+// finishPending looks up the pending results of the reply one after the other and sends the reply again after each,
+// the last time without pending results
+func (w *Worker) finishPending(request *domain.WorkRequest, reply *domain.WorkReply, pending []pendingScan) {
+	defer func() {
+		if err := recover(); err != nil {
+			logrus.Error(err)
+			logrus.Error(stackerr.Wrap(err, 2).ErrorStack())
+		}
+	}()
+	set := w.scanSet(request)
+	ctx, cancel := context.WithTimeout(context.Background(), pendingWait())
+	defer cancel()
+	for _, p := range pending {
+		*p.res = lookupPending(ctx, set, request, p)
+		p.score()
+		reply.Pending--
+		if err := w.q.PushWorkReply(request.ReplyQueue, reply); err != nil {
+			logrus.WithError(err).Warnf("Unable to push the update of the reply to message %s", request.MessageID)
+		}
+	}
+}
+
+// lookupPending waits for the turn of the pending result and looks it up, again if the source still says the key is
+// over its quota
+func lookupPending(ctx context.Context, set []Scanner, request *domain.WorkRequest, p pendingScan) domain.SourceResult {
+	name := p.res.Source
+	var q queuedScanner
+	for _, s := range set {
+		if s.Name() == name {
+			q, _ = s.(queuedScanner)
+		}
+	}
+	failed := domain.SourceResult{Source: name, Result: domain.ResultUnknown}
+	if q == nil {
+		failed.Error = fmt.Sprintf("%s is no longer available for the team", scannerTitle(name))
+		return failed
+	}
+	indicator := newScanIndicator(request, p.indicatorType, p.value)
+	indicator.Queue, indicator.Scheduled = false, true
+	for {
+		if !q.wait(ctx) {
+			pendingScansTotal.Inc(name, "expired")
+			failed.Error = fmt.Sprintf("The rate limit of the %s key did not leave room for this lookup in %v", scannerTitle(name), pendingWait())
+			return failed
+		}
+		if res := scanCached(q, indicator); !res.Pending {
+			pendingScansTotal.Inc(name, "done")
+			return res
+		}
+	}
+}
+
+// postedReply is the message of a reply with pending results, the ts is empty if we did not post it
+type postedReply struct {
+	channel string
+	ts      string
+	seen    time.Time // The last reply of the message
+}
+
+// pendingTTL is how long we keep the message of a reply the worker did not finish, longer than the worker waits
+const pendingTTL = time.Hour
+
+// pendingReplies are the messages of the replies with pending results so their updates edit the message
+type pendingReplies struct {
+	mu      sync.Mutex
+	replies map[string]*postedReply
+}
+
+// pendingKey is the key of the replies of a message
+func pendingKey(data *domain.Context, reply *domain.WorkReply) string {
+	return fmt.Sprintf("%s/%s/%s/%v", data.Team, data.Channel, reply.MessageID, data.Rescan)
+}
+
+// track returns the message of the earlier replies of the key and if there were any. The last reply forgets it.
+func (p *pendingReplies) track(key string, last bool, now time.Time) (*postedReply, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.replies == nil {
+		p.replies = make(map[string]*postedReply)
+	}
+	for k, r := range p.replies {
+		if now.Sub(r.seen) > pendingTTL {
+			delete(p.replies, k)
+		}
+	}
+	r, ok := p.replies[key]
+	if last {
+		delete(p.replies, key)
+		return r, ok
+	}
+	if !ok {
+		r = &postedReply{}
+		p.replies[key] = r
+	}
+	r.seen = now
+	return r, ok
+}
+
+// posted sets the message we posted for the replies
+func (p *pendingReplies) posted(r *postedReply, channel, ts string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r.channel, r.ts = channel, ts
+}
+
+// message returns the channel and ts of the message we posted, empty if we did not
+func (p *pendingReplies) message(r *postedReply) (string, string) {
+	if r == nil {
+		return "", ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return r.channel, r.ts
+}
+
+// update edits the message we posted for the earlier replies of the message
+func (b *Bot) update(message map[string]interface{}, channel, ts string, data *domain.Context, sub *subscription) error {
+	noteRescan(message, data)
+	message["channel"], message["ts"], message["as_user"] = channel, ts, true
+	_, err := sub.s.UpdateMessage(message)
+	return err
+}
@@ -0,0 +1,123 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+func TestKeySchedule(t *testing.T) {
+	s := newKeySchedule()
+	now := time.Now()
+	if slot, ok := s.reserve("k", time.Minute, now, now); !ok || !slot.Equal(now) {
+		t.Fatalf("expected the first lookup to go now but got %v", slot)
+	}
+	if _, ok := s.reserve("k", time.Minute, now, now); ok {
+		t.Error("expected the second lookup not to go now")
+	}
+	if slot, ok := s.reserve("k", time.Minute, now, now.Add(time.Hour)); !ok || !slot.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the second lookup to be spaced by the interval but got %v", slot)
+	}
+	if _, ok := s.reserve("other", time.Minute, now, now); !ok {
+		t.Error("expected the keys to have their own slots")
+	}
+	s.backoff("other", now.Add(time.Hour))
+	if slot, ok := s.reserve("other", time.Minute, now, now.Add(2*time.Hour)); !ok || !slot.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the lookup to wait for the backoff but got %v", slot)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if s.wait(ctx, "k", time.Minute) {
+		t.Error("expected no turn before the deadline")
+	}
+}
+
+// queuedFake lets the first lookups through and makes the rest pending until they are scheduled
+type queuedFake struct {
+	mu      sync.Mutex
+	allowed int
+	waits   int
+}
+
+func (q *queuedFake) Name() string                    { return domain.SourceVT }
+func (q *queuedFake) Supports(indicatorType int) bool { return indicatorType == domain.ReplyTypeHash }
+func (q *queuedFake) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if indicator.Queue {
+		if q.allowed == 0 {
+			return domain.SourceResult{Result: domain.ResultUnknown, Pending: true}, nil
+		}
+		q.allowed--
+	}
+	return domain.SourceResult{Result: domain.ResultDirty, Score: "5 / 70"}, nil
+}
+func (q *queuedFake) wait(ctx context.Context) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waits++
+	return true
+}
+
+func TestFinishPending(t *testing.T) {
+	q := testQueue()
+	fake := &queuedFake{allowed: 1}
+	w := &Worker{q: q, scanners: map[string]Scanner{domain.SourceVT: fake}}
+	request := &domain.WorkRequest{Type: "message", ReplyQueue: util.Hostname, Context: &domain.Context{Team: "T1"}, Hashes: []domain.Hash{
+		{Value: "44d88612fea8a8f36de82e1278abb02f", Type: domain.HashMD5},
+		{Value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Type: domain.HashSHA256},
+		{Value: "d41d8cd98f00b204e9800998ecf8427e", Type: domain.HashMD5},
+	}}
+	reply := &domain.WorkReply{Context: request.Context}
+	w.handleMessage(request, reply)
+	pending := pendingScans(&request.Scoring, reply)
+	if len(pending) != 2 || reply.Results() != 3 {
+		t.Fatalf("expected 2 of 3 results pending but got %d of %d", len(pending), reply.Results())
+	}
+	if reply.Hashes[1].Result != domain.ResultUnknown || reply.Hashes[1].Sources[0].Score != "" {
+		t.Errorf("expected the pending hash to be unknown but got %+v", reply.Hashes[1])
+	}
+	reply.Pending = len(pending)
+	w.finishPending(request, reply, pending)
+	if replies := pushedReplies(q); len(replies) != 2 || replies[0].Pending != 1 || replies[1].Pending != 0 {
+		t.Errorf("expected the reply to be sent after every lookup but got %+v", replies)
+	}
+	if fake.waits != 2 {
+		t.Errorf("expected the pending lookups to wait for their turn but got %d waits", fake.waits)
+	}
+	for _, h := range reply.Hashes {
+		if h.Result != domain.ResultDirty || h.Sources[0].Pending {
+			t.Errorf("expected the pending lookups to update the verdicts but got %+v", h)
+		}
+	}
+}
+
+func TestPendingReplies(t *testing.T) {
+	var p pendingReplies
+	now := time.Now()
+	r, seen := p.track("m", false, now)
+	if seen || r == nil {
+		t.Fatal("expected the first reply of the message to be new")
+	}
+	p.posted(r, "C1", "1.2")
+	again, seen := p.track("m", false, now)
+	if channel, ts := p.message(again); !seen || channel != "C1" || ts != "1.2" {
+		t.Errorf("expected the update to edit the posted message but got %s %s", channel, ts)
+	}
+	last, seen := p.track("m", true, now)
+	if _, ts := p.message(last); !seen || ts != "1.2" {
+		t.Error("expected the last reply to edit the posted message")
+	}
+	if _, seen = p.track("m", true, now); seen {
+		t.Error("expected the last reply to forget the message")
+	}
+	// Replies the worker never finished are forgotten
+	p.track("old", false, now)
+	if _, seen = p.track("old", false, now.Add(2*pendingTTL)); seen {
+		t.Error("expected the stale message to be forgotten")
+	}
+}
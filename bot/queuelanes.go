@@ -0,0 +1,30 @@
+package bot
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/metrics"
+)
+
+var (
+	queueDepthGauge = metrics.NewGauge("alfred_queue_depth",
+		"Messages waiting in the queue by the lane", "lane")
+	queueInFlightGauge = metrics.NewGauge("alfred_queue_in_flight",
+		"Work popped from the queue and not acknowledged yet by the lane", "lane")
+	queueOldestGauge = metrics.NewGauge("alfred_queue_oldest_seconds",
+		"Age of the oldest message waiting in the queue by the lane, 0 if the backend cannot tell", "lane")
+)
+
+// collectQueueLanes sets the gauges of the queue. Every host collects them since only the database backend sees the
+// lanes of all the hosts.
+func (b *Bot) collectQueueLanes() {
+	lanes, err := b.q.Lanes()
+	if err != nil {
+		logrus.WithError(err).Warn("Unable to load the depth of the queue")
+		return
+	}
+	for _, lane := range lanes {
+		queueDepthGauge.Set(float64(lane.Depth), lane.Lane)
+		queueInFlightGauge.Set(float64(lane.InFlight), lane.Lane)
+		queueOldestGauge.Set(float64(lane.Oldest), lane.Lane)
+	}
+}
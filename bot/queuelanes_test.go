@@ -0,0 +1,21 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/queue"
+)
+
+func TestCollectQueueLanes(t *testing.T) {
+	q := testQueue()
+	defer q.Close()
+	b := queueBot(q)
+	for _, id := range []string{"1.1", "1.2"} {
+		q.PushWork(&domain.WorkRequest{MessageID: id, Context: &domain.Context{Team: "T1"}})
+	}
+	b.collectQueueLanes()
+	if queueDepthGauge.Value(queue.LaneWork) != 2 || queueInFlightGauge.Value(queue.LaneWork) != 0 || queueDepthGauge.Value(queue.LaneReply) != 0 {
+		t.Errorf("unexpected gauges %v and %v", queueDepthGauge.Value(queue.LaneWork), queueInFlightGauge.Value(queue.LaneWork))
+	}
+}
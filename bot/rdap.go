@@ -0,0 +1,500 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// rdapBootstrapTTL is how long we use the IANA registry before we load it again
+	rdapBootstrapTTL = 24 * time.Hour
+	// whoisMaxSize bounds the answer of a WHOIS server
+	whoisMaxSize = 1 << 20
+)
+
+// errRDAPNotFound is returned for domains and IPs the registry does not know
+var errRDAPNotFound = errors.New("not found in the registry")
+
+// rdapBootstrapFile is a file of the IANA registry, each service is its TLDs or networks and their servers
+type rdapBootstrapFile struct {
+	Services [][][]string `json:"services"`
+}
+
+// rdapNetwork is a network of the IANA registry with its servers
+type rdapNetwork struct {
+	net     *net.IPNet
+	servers []string
+}
+
+// rdapBootstrap finds the RDAP server of a domain or an IP with the IANA registry as RFC 9224 describes
+type rdapBootstrap struct {
+	mu       sync.Mutex
+	loaded   time.Time
+	tlds     map[string][]string // Servers by TLD, some entries have more than one label
+	networks []rdapNetwork
+	c        *http.Client
+}
+
+// rdapServers is shared by the scanners since the registry is the same for everyone
+var rdapServers = &rdapBootstrap{c: &http.Client{Timeout: 30 * time.Second}}
+
+// load the registry files if they are older than rdapBootstrapTTL. A failed load keeps the registry we have.
+func (b *rdapBootstrap) load(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.loaded) < rdapBootstrapTTL {
+		return nil
+	}
+	tlds := make(map[string][]string)
+	var networks []rdapNetwork
+	for _, file := range []string{"dns.json", "ipv4.json", "ipv6.json"} {
+		var f rdapBootstrapFile
+		if err := b.get(ctx, file, &f); err != nil {
+			if b.loaded.IsZero() {
+				return err
+			}
+			return nil
+		}
+		for _, service := range f.Services {
+			if len(service) != 2 {
+				continue
+			}
+			for _, entry := range service[0] {
+				if file == "dns.json" {
+					tlds[strings.ToLower(entry)] = service[1]
+				} else if _, n, err := net.ParseCIDR(entry); err == nil {
+					networks = append(networks, rdapNetwork{net: n, servers: service[1]})
+				}
+			}
+		}
+	}
+	b.tlds, b.networks, b.loaded = tlds, networks, time.Now()
+	return nil
+}
+
+// get decodes the registry file
+func (b *rdapBootstrap) get(ctx context.Context, file string, out interface{}) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(conf.Options.RDAP.Bootstrap, "/")+"/"+file, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the RDAP registry returned %s for %s", resp.Status, file)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// rdapServer picks the HTTPS server if there is one
+func rdapServer(servers []string) string {
+	for _, s := range servers {
+		if strings.HasPrefix(s, "https://") {
+			return s
+		}
+	}
+	if len(servers) > 0 {
+		return servers[0]
+	}
+	return ""
+}
+
+// domainServer is the RDAP server of the longest entry of the registry the domain is under, empty if its TLD has no
+// RDAP server
+func (b *rdapBootstrap) domainServer(ctx context.Context, name string) (string, error) {
+	if err := b.load(ctx); err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i := range labels {
+		if servers, ok := b.tlds[strings.Join(labels[i:], ".")]; ok {
+			return rdapServer(servers), nil
+		}
+	}
+	return "", nil
+}
+
+// ipServer is the RDAP server of the most specific network of the registry the IP is in
+func (b *rdapBootstrap) ipServer(ctx context.Context, ip net.IP) (string, error) {
+	if err := b.load(ctx); err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	best, bestSize := "", -1
+	for _, n := range b.networks {
+		if size, _ := n.net.Mask.Size(); n.net.Contains(ip) && size > bestSize {
+			best, bestSize = rdapServer(n.servers), size
+		}
+	}
+	return best, nil
+}
+
+// rdapEntity is a contact of a domain or a network, e.g. the registrar
+type rdapEntity struct {
+	Roles      []string      `json:"roles"`
+	VCardArray []interface{} `json:"vcardArray"`
+	Entities   []rdapEntity  `json:"entities"`
+}
+
+// name is the formatted name of the vCard of the entity
+func (e *rdapEntity) name() string {
+	if len(e.VCardArray) < 2 {
+		return ""
+	}
+	props, _ := e.VCardArray[1].([]interface{})
+	for _, p := range props {
+		prop, _ := p.([]interface{})
+		if len(prop) >= 4 && prop[0] == "fn" {
+			name, _ := prop[3].(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// rdapObject is the domain or IP network answer of an RDAP server
+type rdapObject struct {
+	Name         string `json:"name"`
+	Handle       string `json:"handle"`
+	Country      string `json:"country"`
+	StartAddress string `json:"startAddress"`
+	EndAddress   string `json:"endAddress"`
+	Events       []struct {
+		Action string `json:"eventAction"`
+		Date   string `json:"eventDate"`
+	} `json:"events"`
+	Entities    []rdapEntity `json:"entities"`
+	Nameservers []struct {
+		LDHName string `json:"ldhName"`
+	} `json:"nameservers"`
+	// ARIN adds the ASNs that originate the network
+	OriginAutnums []int `json:"arin_originas0_originautnums"`
+}
+
+// entity is the name of the first entity with the role, looking into the entities of the entities too
+func (o *rdapObject) entity(role string) string {
+	var find func(entities []rdapEntity) string
+	find = func(entities []rdapEntity) string {
+		for i := range entities {
+			for _, r := range entities[i].Roles {
+				if r == role {
+					if name := entities[i].name(); name != "" {
+						return name
+					}
+				}
+			}
+			if name := find(entities[i].Entities); name != "" {
+				return name
+			}
+		}
+		return ""
+	}
+	return find(o.Entities)
+}
+
+// registered is when the domain was registered, zero if the server does not say
+func (o *rdapObject) registered() time.Time {
+	for _, e := range o.Events {
+		if e.Action == "registration" {
+			if t, err := time.Parse(time.RFC3339, e.Date); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// registration is what we show about the registration of a domain
+type registration struct {
+	created     time.Time
+	registrar   string
+	nameServers []string
+}
+
+// rdapScanner looks up the registration of domains and the networks of IPs with RDAP, and with WHOIS for the TLDs
+// without RDAP. The results are facts about the indicator and never change the verdict.
+type rdapScanner struct {
+	c *http.Client
+}
+
+// newRDAPScanner ignores the credentials, the registries need no key
+func newRDAPScanner(creds domain.Credentials) (Scanner, error) {
+	return &rdapScanner{c: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (r *rdapScanner) Name() string {
+	return domain.SourceRDAP
+}
+
+func (r *rdapScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeDomain || indicatorType == domain.ReplyTypeIP
+}
+
+// cacheTTL keeps the registrations longer than the other results since they rarely change
+func (r *rdapScanner) cacheTTL() time.Duration {
+	return time.Duration(conf.Options.RDAP.CacheHours) * time.Hour
+}
+
+// get decodes the answer of the RDAP server
+func (r *rdapScanner) get(ctx context.Context, u string, out interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := r.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotFound:
+		return errRDAPNotFound
+	}
+	return fmt.Errorf("RDAP server returned %s", resp.Status)
+}
+
+// rdapURL is the query of the object on the server
+func rdapURL(server, kind, value string) string {
+	return strings.TrimSuffix(server, "/") + "/" + kind + "/" + url.PathEscape(value)
+}
+
+func (r *rdapScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res := domain.SourceResult{Result: domain.ResultUnknown, NotFound: true, Info: true}
+	if indicator.Type == domain.ReplyTypeIP {
+		return r.scanIP(ctx, indicator.Value, res)
+	}
+	// The registries only know the registered domain and not the hosts under it
+	name := strings.ToLower(strings.TrimSuffix(indicator.Value, "."))
+	if registered, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		name = registered
+	}
+	reg, err := r.domain(ctx, name)
+	if err == errRDAPNotFound || err == nil && reg.created.IsZero() && reg.registrar == "" {
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	res.NotFound, res.Registered = false, reg.created
+	res.Link = "https://lookup.icann.org/en/lookup?name=" + url.QueryEscape(name)
+	var lines, score []string
+	if !reg.created.IsZero() {
+		score = append(score, "registered "+reg.created.Format("2006-01-02"))
+		lines = append(lines, "Created: "+reg.created.Format("2006-01-02"))
+	}
+	if reg.registrar != "" {
+		score = append(score, "by "+reg.registrar)
+		lines = append(lines, "Registrar: "+reg.registrar)
+	}
+	if len(reg.nameServers) > 0 {
+		lines = append(lines, "Name Servers: "+strings.Join(reg.nameServers, ", "))
+	}
+	res.Score, res.Detail = strings.Join(score, " "), strings.Join(lines, "\n")
+	return res, nil
+}
+
+// domain looks up the registration with the RDAP server of the TLD or with WHOIS if it has none
+func (r *rdapScanner) domain(ctx context.Context, name string) (*registration, error) {
+	server, err := rdapServers.domainServer(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if server == "" {
+		return whoisDomain(ctx, name)
+	}
+	var o rdapObject
+	if err = r.get(ctx, rdapURL(server, "domain", name), &o); err != nil {
+		return nil, err
+	}
+	reg := &registration{created: o.registered(), registrar: o.entity("registrar")}
+	for _, ns := range o.Nameservers {
+		reg.nameServers = append(reg.nameServers, strings.ToLower(ns.LDHName))
+	}
+	return reg, nil
+}
+
+// scanIP looks up the network of the IP and who it belongs to
+func (r *rdapScanner) scanIP(ctx context.Context, ip string, res domain.SourceResult) (domain.SourceResult, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return res, nil
+	}
+	server, err := rdapServers.ipServer(ctx, parsed)
+	if err != nil || server == "" {
+		return res, err
+	}
+	var o rdapObject
+	if err = r.get(ctx, rdapURL(server, "ip", ip), &o); err != nil {
+		if err == errRDAPNotFound {
+			return res, nil
+		}
+		return res, err
+	}
+	res.NotFound = false
+	org := o.entity("registrant")
+	if org == "" {
+		org = o.Name
+	}
+	var asns []string
+	for _, asn := range o.OriginAutnums {
+		asns = append(asns, fmt.Sprintf("AS%d", asn))
+	}
+	res.Score = org
+	if len(asns) > 0 {
+		res.Score += " (" + strings.Join(asns, ", ") + ")"
+	}
+	lines := []string{fmt.Sprintf("Network: %s (%s - %s)", o.Name, o.StartAddress, o.EndAddress)}
+	if org != o.Name {
+		lines = append(lines, "Organization: "+org)
+	}
+	if len(asns) > 0 {
+		lines = append(lines, "ASN: "+strings.Join(asns, ", "))
+	}
+	if o.Country != "" {
+		lines = append(lines, "Country: "+o.Country)
+	}
+	res.Detail = strings.Join(lines, "\n")
+	return res, nil
+}
+
+// whoisServers are the WHOIS servers of the TLDs IANA referred us to, empty for TLDs without one
+var whoisServers = struct {
+	sync.Mutex
+	tlds map[string]string
+}{tlds: make(map[string]string)}
+
+// whoisQuery sends the query to the WHOIS server and returns its answer
+func whoisQuery(ctx context.Context, server, query string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "43")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write([]byte(query + "\r\n")); err != nil {
+		return "", err
+	}
+	answer, err := io.ReadAll(io.LimitReader(conn, whoisMaxSize))
+	return string(answer), err
+}
+
+// whoisServer of the TLD, IANA refers us to it once
+func whoisServer(ctx context.Context, tld string) (string, error) {
+	whoisServers.Lock()
+	server, ok := whoisServers.tlds[tld]
+	whoisServers.Unlock()
+	if ok {
+		return server, nil
+	}
+	answer, err := whoisQuery(ctx, conf.Options.RDAP.WHOIS, tld)
+	if err != nil {
+		return "", err
+	}
+	for _, field := range whoisFields(answer) {
+		if field[0] == "whois" || field[0] == "refer" {
+			server = field[1]
+			break
+		}
+	}
+	whoisServers.Lock()
+	whoisServers.tlds[tld] = server
+	whoisServers.Unlock()
+	return server, nil
+}
+
+// whoisFields are the key and value of the lines of the answer, the keys in lower case
+func whoisFields(answer string) [][2]string {
+	var fields [][2]string
+	scanner := bufio.NewScanner(strings.NewReader(answer))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.Index(line, ":")
+		if i <= 0 || strings.HasPrefix(line, "%") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if value := strings.TrimSpace(line[i+1:]); value != "" {
+			fields = append(fields, [2]string{strings.ToLower(strings.TrimSpace(line[:i])), value})
+		}
+	}
+	return fields
+}
+
+// whoisDateLayouts are the formats of the creation dates of the WHOIS servers we know
+var whoisDateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05Z", "2006-01-02 15:04:05", "2006-01-02", "02-Jan-2006",
+	"2006.01.02", "02.01.2006", "2006/01/02"}
+
+// whoisDate parses the creation date, some servers add the time zone or the time after a space
+func whoisDate(value string) (time.Time, bool) {
+	for _, v := range []string{value, strings.Fields(value)[0]} {
+		for _, layout := range whoisDateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// whoisDomain looks up the registration of the domain with the WHOIS server of its TLD
+func whoisDomain(ctx context.Context, name string) (*registration, error) {
+	tld := name[strings.LastIndex(name, ".")+1:]
+	server, err := whoisServer(ctx, strings.ToLower(tld))
+	if err != nil || server == "" {
+		return &registration{}, err
+	}
+	answer, err := whoisQuery(ctx, server, name)
+	if err != nil {
+		return nil, err
+	}
+	return parseWHOIS(answer), nil
+}
+
+// parseWHOIS finds the registration in the answer of a WHOIS server, the fields differ between the servers
+func parseWHOIS(answer string) *registration {
+	reg := &registration{}
+	for _, field := range whoisFields(answer) {
+		switch field[0] {
+		case "creation date", "created", "created on", "registered", "registered on", "registration date",
+			"registration time", "domain registration date":
+			if t, ok := whoisDate(field[1]); ok && reg.created.IsZero() {
+				reg.created = t
+			}
+		case "registrar", "registrar name", "sponsoring registrar":
+			if reg.registrar == "" {
+				reg.registrar = field[1]
+			}
+		case "name server", "nserver", "nameserver", "name servers":
+			reg.nameServers = append(reg.nameServers, strings.ToLower(strings.Fields(field[1])[0]))
+		}
+	}
+	return reg
+}
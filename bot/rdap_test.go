@@ -0,0 +1,194 @@
+package bot
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// rdapTestServer serves the IANA registry and the RDAP answers by path, the registry points to the server itself
+func rdapTestServer(t *testing.T, responses map[string]string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dns.json":
+			w.Write([]byte(`{"services":[[["com","co.uk"],["` + srv.URL + `/rdap/"]]]}`))
+			return
+		case "/ipv4.json":
+			w.Write([]byte(`{"services":[[["8.0.0.0/8"],["` + srv.URL + `/wrong/"]],[["8.8.0.0/16"],["` + srv.URL + `/rdap/"]]]}`))
+			return
+		case "/ipv6.json":
+			w.Write([]byte(`{"services":[]}`))
+			return
+		}
+		if accept := r.Header.Get("Accept"); accept != "application/rdap+json" {
+			t.Errorf("unexpected accept %s", accept)
+		}
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	return srv
+}
+
+// whoisTestServer answers the WHOIS queries with the canned answers by the query
+func whoisTestServer(t *testing.T, answers map[string]string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			query, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte(answers[strings.TrimSpace(query)]))
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// useRDAP points the scanner to the test servers until the returned function restores the defaults
+func useRDAP(bootstrap, whois string) func() {
+	saved, savedServers := conf.Options.RDAP, rdapServers
+	conf.Options.RDAP.Bootstrap, conf.Options.RDAP.WHOIS = bootstrap, whois
+	rdapServers = &rdapBootstrap{c: http.DefaultClient}
+	whoisServers.Lock()
+	whoisServers.tlds = make(map[string]string)
+	whoisServers.Unlock()
+	return func() { conf.Options.RDAP, rdapServers = saved, savedServers }
+}
+
+func TestRDAPDomain(t *testing.T) {
+	srv := rdapTestServer(t, map[string]string{
+		"/rdap/domain/evil.com": `{"ldhName":"EVIL.COM","events":[{"eventAction":"expiration","eventDate":"2021-01-02T00:00:00Z"},
+{"eventAction":"registration","eventDate":"2020-01-02T10:00:00Z"}],
+"entities":[{"roles":["registrar"],"vcardArray":["vcard",[["version",{},"text","4.0"],["fn",{},"text","Bad Registrar Inc"]]]}],
+"nameservers":[{"ldhName":"NS1.EVIL.COM"},{"ldhName":"ns2.evil.com"}]}`,
+	})
+	defer srv.Close()
+	defer useRDAP(srv.URL, "")()
+	r := &rdapScanner{c: http.DefaultClient}
+	res, err := r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeDomain, Value: "evil.com"})
+	if err != nil || res.NotFound || !res.Info || res.Result != domain.ResultUnknown || res.Score != "registered 2020-01-02 by Bad Registrar Inc" ||
+		!res.Registered.Equal(time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)) || res.Link != "https://lookup.icann.org/en/lookup?name=evil.com" {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	for _, expected := range []string{"Created: 2020-01-02", "Registrar: Bad Registrar Inc", "Name Servers: ns1.evil.com, ns2.evil.com"} {
+		if !strings.Contains(res.Detail, expected) {
+			t.Errorf("expected %q in the detail but got %s", expected, res.Detail)
+		}
+	}
+	// A host is looked up by its registered domain
+	res, err = r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeDomain, Value: "login.Mail.evil.com"})
+	if err != nil || res.NotFound || res.Score != "registered 2020-01-02 by Bad Registrar Inc" || res.Link != "https://lookup.icann.org/en/lookup?name=evil.com" {
+		t.Errorf("expected the registration of evil.com for the host but got %+v - %v", res, err)
+	}
+	// The registry does not know the domain
+	res, err = r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeDomain, Value: "missing.com"})
+	if err != nil || !res.NotFound || !res.Info {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+}
+
+func TestRDAPIP(t *testing.T) {
+	srv := rdapTestServer(t, map[string]string{
+		"/rdap/ip/8.8.8.8": `{"name":"LVLT-GOGL-8-8-8","startAddress":"8.8.8.0","endAddress":"8.8.8.255","country":"US",
+"arin_originas0_originautnums":[15169],
+"entities":[{"roles":["registrant"],"vcardArray":["vcard",[["fn",{},"text","Google LLC"]]]}]}`,
+	})
+	defer srv.Close()
+	defer useRDAP(srv.URL, "")()
+	r := &rdapScanner{c: http.DefaultClient}
+	// The most specific network of the registry has the right server
+	res, err := r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "8.8.8.8"})
+	if err != nil || res.NotFound || !res.Info || res.Score != "Google LLC (AS15169)" || !res.Registered.IsZero() {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	for _, expected := range []string{"Network: LVLT-GOGL-8-8-8 (8.8.8.0 - 8.8.8.255)", "ASN: AS15169", "Country: US"} {
+		if !strings.Contains(res.Detail, expected) {
+			t.Errorf("expected %q in the detail but got %s", expected, res.Detail)
+		}
+	}
+	// No server for the network
+	res, err = r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeIP, Value: "1.1.1.1"})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+}
+
+func TestRDAPWHOIS(t *testing.T) {
+	srv := rdapTestServer(t, nil)
+	defer srv.Close()
+	tld := whoisTestServer(t, map[string]string{
+		"evil.io": "Domain Name: EVIL.IO\nRegistrar: Whois Registrar\nCreation Date: 2020-03-04T05:06:07Z\n" +
+			"Name Server: NS1.EVIL.IO\nName Server: ns2.evil.io\n",
+	})
+	defer tld.Close()
+	iana := whoisTestServer(t, map[string]string{"io": "% IANA WHOIS server\ndomain: IO\nwhois: " + tld.Addr().String() + "\n"})
+	defer iana.Close()
+	defer useRDAP(srv.URL, iana.Addr().String())()
+	r := &rdapScanner{c: http.DefaultClient}
+	// .io is not in the registry so we ask IANA for its WHOIS server
+	res, err := r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeDomain, Value: "evil.io"})
+	if err != nil || res.NotFound || res.Score != "registered 2020-03-04 by Whois Registrar" ||
+		!strings.Contains(res.Detail, "Name Servers: ns1.evil.io, ns2.evil.io") {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	// A TLD without a WHOIS server has no data
+	res, err = r.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeDomain, Value: "evil.zz"})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+}
+
+func TestParseWHOIS(t *testing.T) {
+	tests := []struct {
+		answer    string
+		created   string
+		registrar string
+	}{
+		{"created: 2019-05-06 10:00:00\nregistrar: X", "2019-05-06", "X"},
+		{"Registered on: 07-Jun-2018\nSponsoring Registrar: Y", "2018-06-07", "Y"},
+		{"% comment: 2000-01-01\nRegistration Time: 2017.08.09 10:00:00 (UTC+8)", "2017-08-09", ""},
+		{"Creation Date: not a date", "0001-01-01", ""},
+	}
+	for _, test := range tests {
+		reg := parseWHOIS(test.answer)
+		if created := reg.created.Format("2006-01-02"); created != test.created || reg.registrar != test.registrar {
+			t.Errorf("expected %s by %q for %q but got %s by %q", test.created, test.registrar, test.answer, created, reg.registrar)
+		}
+	}
+}
+
+func TestRegisteredNote(t *testing.T) {
+	saved := conf.Options.RDAP
+	defer func() { conf.Options.RDAP = saved }()
+	conf.Options.RDAP.YoungDays = 30
+	now := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	young := []domain.SourceResult{{Source: domain.SourceRDAP, Info: true, Registered: now.Add(-5 * 24 * time.Hour)}}
+	if note := registeredNote(defaultLocale, young, now); !strings.Contains(note, "registered 5 days ago") {
+		t.Errorf("unexpected note %q", note)
+	}
+	old := []domain.SourceResult{{Source: domain.SourceRDAP, Info: true, Registered: now.Add(-40 * 24 * time.Hour)}}
+	if note := registeredNote(defaultLocale, old, now); note != "" {
+		t.Errorf("expected no note for an old domain but got %q", note)
+	}
+	if note := registeredNote(defaultLocale, []domain.SourceResult{{Source: domain.SourceRDAP}}, now); note != "" {
+		t.Errorf("expected no note without a registration but got %q", note)
+	}
+}
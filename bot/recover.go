@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/util"
+	stackerr "github.com/go-errors/errors"
+)
+
+// recoverEvent is deferred by the event and reply handlers so a broken payload is logged and skipped instead of
+// killing the worker that handles it
+func (b *Bot) recoverEvent(what string, payload interface{}) {
+	if err := recover(); err != nil {
+		count := atomic.AddInt64(&b.panics, 1)
+		logrus.WithField(what, redactTokens(payload)).Errorf("Recovered from panic #%d handling %s - %v\n%s",
+			count, what, err, stackerr.Wrap(err, 2).ErrorStack())
+	}
+}
+
+// redactedValue replaces the tokens in the payloads we log
+const redactedValue = "[redacted]"
+
+// redactTokens returns the payload as JSON without the values of fields that look like tokens
+func redactTokens(payload interface{}) string {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	var v interface{}
+	if err = json.Unmarshal(raw, &v); err != nil {
+		return ""
+	}
+	return util.ToJSONStringNoIndent(redactValue(v))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if strings.Contains(strings.ToLower(k), "token") {
+				t[k] = redactedValue
+			} else {
+				t[k] = redactValue(val)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactValue(t[i])
+		}
+	}
+	return v
+}
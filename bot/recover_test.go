@@ -0,0 +1,70 @@
+package bot
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/slack"
+)
+
+// captureLog returns the log written while running f
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(out)
+	f()
+	return buf.String()
+}
+
+func TestHandleMessageBrokenEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		event slack.Response
+	}{
+		{"nil", nil},
+		{"missing event", slack.Response{"team_id": "T1", "token": "secret"}},
+		{"non string text", slack.Response{"team_id": "T1", "event": map[string]interface{}{"type": "message", "channel": "C1", "user": "U1", "text": 42}}},
+		{"non map event", slack.Response{"team_id": "T1", "event": []interface{}{"message"}}},
+	}
+	for _, test := range tests {
+		b := queueBot(testQueue())
+		b.handleMessage(test.event)
+		if atomic.LoadInt64(&b.panics) != 0 {
+			t.Errorf("%s: unexpected panic", test.name)
+		}
+	}
+}
+
+func TestHandleMessageRecovers(t *testing.T) {
+	b := queueBot(testQueue())
+	// The test team has no Slack client so answering the help command panics
+	msg := event(t, `{"type":"message","channel":"D1","user":"U1","text":"help"}`)
+	msg["token"] = "secret"
+	logged := captureLog(func() { b.handleMessage(msg) })
+	if atomic.LoadInt64(&b.panics) != 1 {
+		t.Fatalf("expected the panic to be recovered and counted, got %d", b.panics)
+	}
+	if !strings.Contains(logged, "Recovered from panic #1 handling event") || strings.Contains(logged, "secret") {
+		t.Errorf("unexpected log %s", logged)
+	}
+}
+
+func TestHandleReplyRecovers(t *testing.T) {
+	b := queueBot(testQueue())
+	b.handleReply(nil)
+	if atomic.LoadInt64(&b.panics) != 1 {
+		t.Errorf("expected the nil reply to be recovered, got %d", b.panics)
+	}
+}
+
+func TestRedactTokens(t *testing.T) {
+	res := redactTokens(slack.Response{"token": "a", "event": map[string]interface{}{"bot_token": "b", "text": "c",
+		"items": []interface{}{map[string]interface{}{"access_token": "d"}}}})
+	if strings.Contains(res, `"a"`) || strings.Contains(res, `"b"`) || strings.Contains(res, `"d"`) || !strings.Contains(res, `"c"`) {
+		t.Errorf("tokens were not redacted - %s", res)
+	}
+}
@@ -0,0 +1,91 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/util"
+)
+
+var (
+	replyQueuesRemovedTotal = metrics.NewCounter("alfred_reply_queues_removed_total",
+		"Reply queues of the bot hosts that stopped their heartbeat")
+	repliesReroutedTotal = metrics.NewCounter("alfred_replies_rerouted_total",
+		"Replies pending in a removed reply queue that were passed to a live bot")
+)
+
+// botStore has the heartbeats of the bot hosts, the repo in production
+type botStore interface {
+	BotHeartbeat() error
+	Bots(timeout time.Duration) ([]*domain.BotHeartbeat, error)
+	DeleteBot(bot string) error
+}
+
+// heartbeat keeps the bot host alive. Once it works again after failing the other bots might have taken the host for
+// gone and removed its reply queue, so the queue is created again.
+func (b *Bot) heartbeat(store botStore) {
+	if err := store.BotHeartbeat(); err != nil {
+		logrus.Errorf("Unable to update heartbeat - %v\n", err)
+		b.lapsed = true
+		return
+	}
+	if !b.lapsed {
+		return
+	}
+	if err := b.q.RestoreReplyQueue(); err != nil {
+		logrus.WithError(err).Warn("Unable to restore the reply queue of the host")
+		return
+	}
+	b.lapsed = false
+}
+
+// orphanTimeout of the bot hosts from conf.Options.Queue.OrphanTimeout
+func orphanTimeout() time.Duration {
+	if conf.Options.Queue.OrphanTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(conf.Options.Queue.OrphanTimeout) * time.Second
+}
+
+// cleanReplyQueues removes the reply queues of the bot hosts that stopped their heartbeat. A redeployed instance comes
+// back with a new hostname so nobody would read them again. The replies only need their context to be posted, so
+// unless conf.Options.Queue.RerouteReplies is off the pending ones are passed to the live bots.
+func (b *Bot) cleanReplyQueues(store botStore) {
+	bots, err := store.Bots(orphanTimeout())
+	if err != nil {
+		logrus.WithError(err).Warn("Unable to load the heartbeats of the bots")
+		return
+	}
+	var live, gone []string
+	for _, bot := range bots {
+		switch {
+		case !bot.Stale:
+			live = append(live, bot.Bot)
+		case bot.Bot != util.Hostname:
+			gone = append(gone, bot.Bot)
+		}
+	}
+	if len(live) == 0 {
+		live = []string{util.Hostname}
+	}
+	for i, bot := range gone {
+		reroute := ""
+		if conf.Options.Queue.RerouteReplies {
+			reroute = live[i%len(live)]
+		}
+		moved, err := b.q.RemoveReplyQueue(bot, reroute)
+		if err != nil {
+			logrus.WithError(err).Warnf("Unable to remove the reply queue of bot %s", bot)
+			continue
+		}
+		if err = store.DeleteBot(bot); err != nil {
+			logrus.WithError(err).Warnf("Unable to delete the heartbeat of bot %s", bot)
+		}
+		replyQueuesRemovedTotal.Inc()
+		repliesReroutedTotal.Add(float64(moved))
+		logrus.Infof("Removed the reply queue of bot %s that stopped its heartbeat, %d replies were passed to %s", bot, moved, reroute)
+	}
+}
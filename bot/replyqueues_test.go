@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/queue"
+	"github.com/demisto/alfred/util"
+)
+
+// fakeBotStore has the heartbeats of the bots
+type fakeBotStore struct {
+	bots     []*domain.BotHeartbeat
+	deleted  []string
+	failBeat bool
+}
+
+func (s *fakeBotStore) BotHeartbeat() error {
+	if s.failBeat {
+		return errors.New("database unavailable")
+	}
+	return nil
+}
+
+func (s *fakeBotStore) Bots(timeout time.Duration) ([]*domain.BotHeartbeat, error) {
+	return s.bots, nil
+}
+
+func (s *fakeBotStore) DeleteBot(bot string) error {
+	s.deleted = append(s.deleted, bot)
+	return nil
+}
+
+// hostQueues keeps the replies of the other hosts until their queues are removed
+type hostQueues struct {
+	queue.Queue
+	pending  map[string][]*domain.WorkReply
+	fail     bool
+	restored int
+}
+
+func (q *hostQueues) RestoreReplyQueue() error {
+	if q.fail {
+		return errors.New("queue unavailable")
+	}
+	q.restored++
+	return nil
+}
+
+func (q *hostQueues) PushWorkReply(replyQueue string, reply *domain.WorkReply) error {
+	if replyQueue == util.Hostname {
+		return q.Queue.PushWorkReply(replyQueue, reply)
+	}
+	q.pending[replyQueue] = append(q.pending[replyQueue], reply)
+	return nil
+}
+
+func (q *hostQueues) RemoveReplyQueue(replyQueue, reroute string) (int, error) {
+	if q.fail {
+		return 0, errors.New("queue unavailable")
+	}
+	pending := q.pending[replyQueue]
+	delete(q.pending, replyQueue)
+	if reroute == "" {
+		return 0, nil
+	}
+	for _, reply := range pending {
+		if err := q.PushWorkReply(reroute, reply); err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+func TestCleanReplyQueues(t *testing.T) {
+	saved := conf.Options.Queue
+	defer func() { conf.Options.Queue = saved }()
+	conf.Options.Queue.RerouteReplies = true
+	q := &hostQueues{Queue: testQueue(), pending: make(map[string][]*domain.WorkReply)}
+	b := queueBot(q)
+	// The old instance was replaced before the worker replied to it
+	q.PushWorkReply("bot-old", &domain.WorkReply{MessageID: "1.1", Context: &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}})
+	store := &fakeBotStore{bots: []*domain.BotHeartbeat{{Bot: "bot-old", Stale: true}, {Bot: util.Hostname}}}
+	q.fail = true
+	b.cleanReplyQueues(store)
+	if len(store.deleted) != 0 || len(q.pending["bot-old"]) != 1 {
+		t.Fatalf("expected the bot to be kept until its queue is removed but got %v", store.deleted)
+	}
+	q.fail = false
+	b.cleanReplyQueues(store)
+	if len(store.deleted) != 1 || store.deleted[0] != "bot-old" || len(q.pending) != 0 {
+		t.Fatalf("expected the queue of the old bot to be removed but got %v", store.deleted)
+	}
+	if replies := pushedReplies(q); len(replies) != 1 || replies[0].MessageID != "1.1" {
+		t.Errorf("expected the pending reply to be rerouted to us but got %+v", replies)
+	}
+	// Without rerouting the replies are dropped with the queue
+	conf.Options.Queue.RerouteReplies = false
+	q.PushWorkReply("bot-other", &domain.WorkReply{MessageID: "1.2", Context: &domain.Context{Team: "T1"}})
+	store.bots = []*domain.BotHeartbeat{{Bot: "bot-other", Stale: true}, {Bot: util.Hostname, Stale: true}}
+	b.cleanReplyQueues(store)
+	if len(store.deleted) != 2 || store.deleted[1] != "bot-other" || len(pushedReplies(q)) != 0 {
+		t.Errorf("expected the queue to be removed without rerouting but got %v", store.deleted)
+	}
+}
+
+func TestHeartbeatRestoresReplyQueue(t *testing.T) {
+	q := &hostQueues{Queue: testQueue(), pending: make(map[string][]*domain.WorkReply)}
+	b := queueBot(q)
+	store := &fakeBotStore{}
+	b.heartbeat(store)
+	if q.restored != 0 {
+		t.Fatalf("expected the queue to be left alone while the heartbeat works but got %d restores", q.restored)
+	}
+	// The heartbeat lapsed long enough for another bot to remove the queue of the host
+	store.failBeat = true
+	b.heartbeat(store)
+	b.heartbeat(store)
+	store.failBeat, q.fail = false, true
+	b.heartbeat(store)
+	if q.restored != 0 {
+		t.Fatalf("expected the restore to fail but got %d restores", q.restored)
+	}
+	q.fail = false
+	b.heartbeat(store)
+	b.heartbeat(store)
+	if q.restored != 1 {
+		t.Errorf("expected the queue to be restored once the heartbeat is back but got %d restores", q.restored)
+	}
+}
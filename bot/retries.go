@@ -0,0 +1,169 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	stackerr "github.com/go-errors/errors"
+)
+
+var workFailuresTotal = metrics.NewCounter("alfred_work_failures_total",
+	"Work requests the workers failed on by what happened to them", "outcome")
+
+var workExpiredTotal = metrics.NewCounter("alfred_work_expired_total",
+	"Work requests the workers dropped because they waited in the queue past their TTL")
+
+// retryUnit is the unit of the backoff configuration. Replaced by the tests.
+var retryUnit = time.Second
+
+// deadLetterStore keeps the requests the workers gave up on
+type deadLetterStore interface {
+	AddDeadLetter(d *domain.DeadLetter) error
+}
+
+// work on the request and push the reply. A panic of the handlers and the failure to push the reply are returned so
+// the request is retried.
+func (w *Worker) work(msg *domain.WorkRequest) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+			logrus.Errorf("Recovered from panic handling work request %s - %v\n%s", msg.MessageID, r, stackerr.Wrap(r, 2).ErrorStack())
+		}
+	}()
+	if err := msg.Unbatch(); err != nil {
+		return err
+	}
+	reply := &domain.WorkReply{Context: msg.Context, MessageID: msg.MessageID, Original: msg.Original, Quote: msg.Quote,
+		Skipped: msg.Skipped, Truncated: msg.Truncated}
+	switch msg.Type {
+	case "message":
+		w.handleMessage(msg, reply)
+	case "file":
+		w.handleFile(msg, reply)
+	}
+	pending := pendingScans(&msg.Scoring, reply)
+	reply.Pending = len(pending)
+	if err := w.q.PushWorkReply(msg.ReplyQueue, reply); err != nil {
+		return fmt.Errorf("unable to push the reply - %v", err)
+	}
+	if len(pending) > 0 {
+		go w.finishPending(msg, reply, pending)
+	}
+	return nil
+}
+
+// ack the work request so the queue does not return it to the workers
+func (w *Worker) ack(msg *domain.WorkRequest) {
+	if err := w.q.Ack(msg); err != nil {
+		logrus.WithError(err).Warnf("Unable to acknowledge work request %s, it might be handled again", msg.MessageID)
+	}
+}
+
+// nack returns the work request to the queue as it was popped, the workers get it again after the delay
+func (w *Worker) nack(msg *domain.WorkRequest, delay time.Duration) {
+	if err := w.q.Nack(msg, delay); err != nil {
+		logrus.WithError(err).Warnf("Unable to return work request %s to the queue, it is returned when its reservation expires", msg.MessageID)
+	}
+}
+
+// retryDelay before the request is handled again, doubled with each attempt. It stays under the visibility timeout of
+// the queue so a retry does not wait longer than the request of a crashed worker.
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(conf.Options.Retries.Backoff) * retryUnit
+	max := time.Duration(conf.Options.Retries.MaxBackoff) * retryUnit
+	if visibility := time.Duration(conf.Options.Queue.VisibilityTimeout) * time.Second; visibility > 0 && max >= visibility {
+		max = visibility - time.Second
+	}
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// failed returns the request to the queue to be retried after the backoff. After conf.Options.Retries.MaxAttempts it
+// is dead lettered and the bot tells the user the analysis failed. The queue counts the attempts so the request
+// carries them to the next worker.
+func (w *Worker) failed(msg *domain.WorkRequest, failure error) {
+	msg.Attempts++
+	if msg.Attempts < conf.Options.Retries.MaxAttempts {
+		workFailuresTotal.Inc("retried")
+		delay := retryDelay(msg.Attempts)
+		logrus.WithError(failure).Warnf("Work request %s failed %d times - retrying in %v", msg.MessageID, msg.Attempts, delay)
+		w.nack(msg, delay)
+		return
+	}
+	workFailuresTotal.Inc("dead_lettered")
+	logrus.WithError(failure).Errorf("Work request %s failed %d times - dead lettering it", msg.MessageID, msg.Attempts)
+	w.deadLetter(msg, failure, &domain.WorkReply{Context: msg.Context, MessageID: msg.MessageID, Failed: true})
+}
+
+// crashed dead letters the request the workers popped conf.Options.Retries.MaxAttempts times without finishing it,
+// they stopped while handling it
+func (w *Worker) crashed(msg *domain.WorkRequest) {
+	workFailuresTotal.Inc("dead_lettered")
+	logrus.Errorf("Work request %s was popped %d times without finishing - dead lettering it", msg.MessageID, msg.Attempts)
+	w.deadLetter(msg, errors.New("the workers stopped while handling it"),
+		&domain.WorkReply{Context: msg.Context, MessageID: msg.MessageID, Failed: true})
+}
+
+// expired dead letters the request that waited in the queue past its TTL instead of checking indicators nobody is
+// waiting for anymore. The bot counts it in the team statistics.
+func (w *Worker) expired(msg *domain.WorkRequest, now time.Time) {
+	workExpiredTotal.Inc()
+	waited := now.Sub(msg.Enqueued).Round(time.Second)
+	logrus.Warnf("Work request %s waited %v in the queue - dropping it", msg.MessageID, waited)
+	w.deadLetter(msg, fmt.Errorf("expired after %v in the queue", waited),
+		&domain.WorkReply{Context: msg.Context, MessageID: msg.MessageID, Expired: true})
+}
+
+// deadLetter stores the request and pushes the reply telling the bot we gave up on it. If it cannot be stored the
+// request is returned to the queue after the backoff, the queue moves it to its dead lane once that happened too often.
+func (w *Worker) deadLetter(msg *domain.WorkRequest, failure error, reply *domain.WorkReply) {
+	if w.dead != nil {
+		d, err := domain.NewDeadLetter(msg, failure)
+		if err == nil {
+			err = w.dead.AddDeadLetter(d)
+		}
+		if err != nil {
+			logrus.WithError(err).Errorf("Unable to store the dead letter of work request %s", msg.MessageID)
+			w.nack(msg, retryDelay(msg.Attempts))
+			return
+		}
+	}
+	if err := w.q.PushWorkReply(msg.ReplyQueue, reply); err != nil {
+		logrus.WithError(err).Warnf("Unable to push the failure of work request %s", msg.MessageID)
+	}
+	w.ack(msg)
+}
+
+// handleFailedReply tells the user we could not analyze the message, in the thread of the message
+func (b *Bot) handleFailedReply(reply *domain.WorkReply, data *domain.Context) {
+	sub := b.relevantTeam(data.Team)
+	if sub == nil {
+		var err error
+		if sub, err = b.loadSubscription(data.Team); err != nil {
+			replyLog(reply, data).WithError(err).Warn("Team not found in subscriptions")
+			return
+		}
+	}
+	if data.Channel == "" || sub.configuration.IsMuted(data.Channel) {
+		return
+	}
+	message := map[string]interface{}{"channel": data.Channel, "as_user": true, "text": sub.msg("analysis_failed", nil)}
+	thread := data.ThreadTS
+	if thread == "" {
+		thread = data.TS
+	}
+	inThread(message, thread)
+	if _, err := sub.s.PostMessage(message); err != nil {
+		replyLog(reply, data).WithError(err).Warn("Unable to post the failure to Slack")
+	}
+}
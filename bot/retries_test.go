@@ -0,0 +1,200 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/queue"
+	"github.com/demisto/alfred/util"
+)
+
+// deadLetters records the dead letters instead of storing them
+type deadLetters struct {
+	letters []*domain.DeadLetter
+}
+
+func (d *deadLetters) AddDeadLetter(letter *domain.DeadLetter) error {
+	d.letters = append(d.letters, letter)
+	return nil
+}
+
+// delayingQueue records the delays of the returned requests and returns them at once
+type delayingQueue struct {
+	queue.Queue
+	delays []time.Duration
+}
+
+func (q *delayingQueue) Nack(work *domain.WorkRequest, delay time.Duration) error {
+	q.delays = append(q.delays, delay)
+	return q.Queue.Nack(work, 0)
+}
+
+func TestRetryDelay(t *testing.T) {
+	saved := conf.Options.Retries
+	defer func() { conf.Options.Retries = saved }()
+	conf.Options.Retries.Backoff, conf.Options.Retries.MaxBackoff = 30, 100
+	for attempts, expected := range map[int]time.Duration{1: 30 * time.Second, 2: 60 * time.Second, 3: 100 * time.Second, 10: 100 * time.Second} {
+		if delay := retryDelay(attempts); delay != expected {
+			t.Errorf("expected %v after %d attempts but got %v", expected, attempts, delay)
+		}
+	}
+	// The retry does not wait longer than the request of a crashed worker
+	savedQueue := conf.Options.Queue
+	defer func() { conf.Options.Queue = savedQueue }()
+	conf.Options.Queue.VisibilityTimeout = 60
+	if delay := retryDelay(10); delay != 59*time.Second {
+		t.Errorf("expected the delay under the visibility timeout but got %v", delay)
+	}
+}
+
+func TestWorkFailures(t *testing.T) {
+	saved, security, unit := conf.Options.Retries, conf.Options.Security, retryUnit
+	defer func() { conf.Options.Retries, conf.Options.Security, retryUnit = saved, security, unit }()
+	conf.Options.Security.DBKey = "0123456789abcdef0123456789abcdef"
+	conf.Options.Retries.MaxAttempts, conf.Options.Retries.Backoff, conf.Options.Retries.MaxBackoff = 2, 1, 1
+	retryUnit = time.Millisecond
+	q, dead := &delayingQueue{Queue: testQueue()}, &deadLetters{}
+	// Without an NVD client the lookup of the CVE panics
+	w := &Worker{q: q, dead: dead}
+	q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "1.1", CVEs: []string{"CVE-2021-44228"}, ReplyQueue: util.Hostname,
+		Context: &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}})
+	msg := pushedWork(q)[0]
+	err := w.work(msg)
+	if err == nil {
+		t.Fatal("expected the panic to be returned")
+	}
+	w.failed(msg, err)
+	if len(q.delays) != 1 || q.delays[0] != time.Millisecond {
+		t.Errorf("expected the request to be returned for the backoff but got %v", q.delays)
+	}
+	// The queue counts the attempts
+	retried := pushedWork(q)
+	if len(retried) != 1 || retried[0].Attempts != 1 || len(dead.letters) != 0 {
+		t.Fatalf("expected the request to be retried but got %+v", retried)
+	}
+	if err = q.Ack(msg); err != queue.ErrNotReserved {
+		t.Errorf("expected the request to be returned once retried but got %v", err)
+	}
+	if err = w.work(retried[0]); err == nil {
+		t.Fatal("expected the retry to fail as well")
+	}
+	w.failed(retried[0], err)
+	if len(dead.letters) != 1 || dead.letters[0].Team != "T1" || dead.letters[0].Attempts != 2 || dead.letters[0].Error == "" {
+		t.Fatalf("expected the request to be dead lettered but got %+v", dead.letters)
+	}
+	replies := pushedReplies(q)
+	if len(replies) != 1 || !replies[0].Failed || replies[0].MessageID != "1.1" {
+		t.Errorf("expected the bot to be told about the failure but got %+v", replies)
+	}
+	if work := pushedWork(q); len(work) != 0 {
+		t.Errorf("expected no more retries but got %+v", work)
+	}
+	if err = q.Ack(retried[0]); err != queue.ErrNotReserved {
+		t.Errorf("expected the request to be acknowledged once dead lettered but got %v", err)
+	}
+}
+
+func TestWorkCrashed(t *testing.T) {
+	saved, security := conf.Options.Retries, conf.Options.Security
+	defer func() { conf.Options.Retries, conf.Options.Security = saved, security }()
+	conf.Options.Security.DBKey = "0123456789abcdef0123456789abcdef"
+	conf.Options.Retries.MaxAttempts = 2
+	q, dead := testQueue(), &deadLetters{}
+	w := &Worker{q: q, dead: dead, c: make(chan *domain.WorkRequest, 1)}
+	q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "1.1", IPs: []string{"8.8.8.8"}, ReplyQueue: util.Hostname,
+		Context: &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}})
+	// The workers stopped twice while handling the request
+	for i := 0; i < 2; i++ {
+		if err := q.Nack(pushedWork(q)[0], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := pushedWork(q)[0]
+	w.c <- msg
+	close(w.c)
+	w.handle()
+	if len(dead.letters) != 1 || dead.letters[0].Attempts != 2 || !strings.Contains(dead.letters[0].Error, "stopped") {
+		t.Fatalf("expected the request to be dead lettered but got %+v", dead.letters)
+	}
+	if replies := pushedReplies(q); len(replies) != 1 || !replies[0].Failed || len(replies[0].IPs) != 0 {
+		t.Errorf("expected the bot to be told about the failure but got %+v", replies)
+	}
+	if err := q.Ack(msg); err != queue.ErrNotReserved {
+		t.Errorf("expected the request to be acknowledged once dead lettered but got %v", err)
+	}
+}
+
+func TestWorkExpired(t *testing.T) {
+	security := conf.Options.Security
+	defer func() { conf.Options.Security = security }()
+	conf.Options.Security.DBKey = "0123456789abcdef0123456789abcdef"
+	q, dead := testQueue(), &deadLetters{}
+	w := &Worker{q: q, dead: dead}
+	q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "1.1", IPs: []string{"8.8.8.8"}, ReplyQueue: util.Hostname,
+		Context: &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}, Enqueued: time.Now().Add(-time.Hour), TTL: 600})
+	msg := pushedWork(q)[0]
+	if !msg.Expired(time.Now()) {
+		t.Fatal("expected the request to be expired")
+	}
+	w.expired(msg, time.Now())
+	if len(dead.letters) != 1 || dead.letters[0].Team != "T1" || !strings.HasPrefix(dead.letters[0].Error, "expired after 1h") {
+		t.Fatalf("expected the request to be dead lettered but got %+v", dead.letters)
+	}
+	replies := pushedReplies(q)
+	if len(replies) != 1 || !replies[0].Expired || replies[0].Failed || len(replies[0].IPs) != 0 {
+		t.Fatalf("expected the bot to be told about the expiry but got %+v", replies)
+	}
+	if err := q.Ack(msg); err != queue.ErrNotReserved {
+		t.Errorf("expected the request to be acknowledged once dead lettered but got %v", err)
+	}
+	b := queueBot(q)
+	b.handleReply(replies[0])
+	if stats := b.stats["T1"]; stats == nil || stats.Expired != 1 || stats.Messages != 0 {
+		t.Errorf("expected the expired request to be counted but got %+v", stats)
+	}
+}
+
+func TestWorkBatched(t *testing.T) {
+	q := testQueue()
+	b := queueBot(q)
+	fake := &fakeScanner{name: domain.SourceVT, types: []int{domain.ReplyTypeURL, domain.ReplyTypeHash}, res: domain.SourceResult{Result: domain.ResultDirty}}
+	w := &Worker{q: q, scanners: map[string]Scanner{domain.SourceVT: fake}}
+	indicators := func(r *domain.WorkRequest) *domain.WorkRequest {
+		r.URLs = []string{"https://evil.com/a", "https://evil.com/b"}
+		r.Hashes = []domain.Hash{{Value: "44d88612fea8a8f36de82e1278abb02f", Type: domain.HashMD5}}
+		return r
+	}
+	ctx := &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}
+	if err := b.pushWork("T1", b.relevantTeam("T1"), indicators(&domain.WorkRequest{Type: "message", MessageID: "1.1", ReplyQueue: util.Hostname, Context: ctx})); err != nil {
+		t.Fatal(err)
+	}
+	// The workers of the previous version push the indicators in the slices of each type
+	q.PushWork(indicators(&domain.WorkRequest{Type: "message", MessageID: "1.2", ReplyQueue: util.Hostname, Context: ctx}))
+	for _, id := range []string{"1.1", "1.2"} {
+		msg, err := q.PopWork(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The batched request keeps the slices for the workers from before the batching
+		if batched := id == "1.1"; batched != (msg.Version == domain.WorkRequestVersion && len(msg.Indicators) == 3 && len(msg.URLs) == 2) {
+			t.Errorf("%s: unexpected request shape %+v", id, msg)
+		}
+		if err = w.work(msg); err != nil {
+			t.Fatal(err)
+		}
+		replies := pushedReplies(q)
+		if len(replies) != 1 || len(replies[0].URLs) != 2 || len(replies[0].Hashes) != 1 || replies[0].URLs[1].Details != "https://evil.com/b" ||
+			replies[0].Type != domain.ReplyTypeURL|domain.ReplyTypeHash {
+			t.Fatalf("%s: expected a single reply with all the results but got %+v", id, replies)
+		}
+		for _, u := range replies[0].URLs {
+			if u.Result != domain.ResultDirty {
+				t.Errorf("%s: expected the URL to be checked but got %+v", id, u)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+const (
+	// safeBrowsingMaxEntries is the number of URLs the API takes in one call
+	safeBrowsingMaxEntries = 500
+	// safeBrowsingCacheSize is the number of URLs we remember, the expired ones are dropped when it is full
+	safeBrowsingCacheSize = 10000
+)
+
+// safeBrowsingThreatTypes are the lists we check the URLs against
+var safeBrowsingThreatTypes = []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"}
+
+// safeBrowsingCached is what we know about a URL until it expires
+type safeBrowsingCached struct {
+	res     domain.SourceResult
+	expires time.Time
+}
+
+// safeBrowsingScanner checks URLs with Google Safe Browsing with our key. It only lists unsafe URLs so a match convicts
+// the URL and anything else is no data. As the API asks, we do not check a URL again for the cache duration it gave.
+type safeBrowsingScanner struct {
+	url           string
+	key           string
+	negativeCache time.Duration
+	c             *http.Client
+	mu            sync.Mutex
+	cache         map[string]safeBrowsingCached
+}
+
+// newSafeBrowsingScanner ignores the credentials, the API is free so all the teams use our key. Without it the source
+// is skipped.
+func newSafeBrowsingScanner(creds domain.Credentials) (Scanner, error) {
+	if conf.Options.SafeBrowsing.Key == "" {
+		return nil, nil
+	}
+	return &safeBrowsingScanner{url: conf.Options.SafeBrowsing.URL, key: conf.Options.SafeBrowsing.Key,
+		negativeCache: time.Duration(conf.Options.SafeBrowsing.NegativeCache) * time.Second,
+		c:             &http.Client{Timeout: 30 * time.Second}, cache: make(map[string]safeBrowsingCached)}, nil
+}
+
+func (s *safeBrowsingScanner) Name() string {
+	return domain.SourceSafeBrowsing
+}
+
+func (s *safeBrowsingScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeURL
+}
+
+// safeBrowsingEntry is a URL of the request and the matches
+type safeBrowsingEntry struct {
+	URL string `json:"url"`
+}
+
+// safeBrowsingRequest is the body of threatMatches:find
+type safeBrowsingRequest struct {
+	Client struct {
+		ClientID      string `json:"clientId"`
+		ClientVersion string `json:"clientVersion"`
+	} `json:"client"`
+	ThreatInfo struct {
+		ThreatTypes      []string            `json:"threatTypes"`
+		PlatformTypes    []string            `json:"platformTypes"`
+		ThreatEntryTypes []string            `json:"threatEntryTypes"`
+		ThreatEntries    []safeBrowsingEntry `json:"threatEntries"`
+	} `json:"threatInfo"`
+}
+
+// safeBrowsingMatch is a list the URL is on
+type safeBrowsingMatch struct {
+	ThreatType    string            `json:"threatType"`
+	PlatformType  string            `json:"platformType"`
+	Threat        safeBrowsingEntry `json:"threat"`
+	CacheDuration string            `json:"cacheDuration"`
+}
+
+// find returns the matches of the URLs, there are none for safe URLs
+func (s *safeBrowsingScanner) find(ctx context.Context, urls []string) ([]safeBrowsingMatch, error) {
+	var req safeBrowsingRequest
+	req.Client.ClientID, req.Client.ClientVersion = "alfred", "1.0"
+	req.ThreatInfo.ThreatTypes = safeBrowsingThreatTypes
+	req.ThreatInfo.PlatformTypes = []string{"ANY_PLATFORM"}
+	req.ThreatInfo.ThreatEntryTypes = []string{"URL"}
+	for _, u := range urls {
+		req.ThreatInfo.ThreatEntries = append(req.ThreatInfo.ThreatEntries, safeBrowsingEntry{URL: u})
+	}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", s.url+"?key="+url.QueryEscape(s.key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := s.c.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Google Safe Browsing returned %s", resp.Status)
+	}
+	var res struct {
+		Matches []safeBrowsingMatch `json:"matches"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Matches, nil
+}
+
+// safeBrowsingResult is the result of the URL from its matches
+func safeBrowsingResult(u string, matches []safeBrowsingMatch) domain.SourceResult {
+	if len(matches) == 0 {
+		return domain.SourceResult{Result: domain.ResultUnknown, NotFound: true}
+	}
+	threats, platforms := make(map[string]bool), make(map[string]bool)
+	for _, m := range matches {
+		threats[m.ThreatType], platforms[m.PlatformType] = true, true
+	}
+	keys := func(m map[string]bool) []string {
+		var res []string
+		for k := range m {
+			res = append(res, k)
+		}
+		sort.Strings(res)
+		return res
+	}
+	threatTypes := strings.Join(keys(threats), ", ")
+	return domain.SourceResult{Result: domain.ResultDirty, Score: threatTypes,
+		Link:   "https://transparencyreport.google.com/safe-browsing/search?url=" + url.QueryEscape(u),
+		Detail: fmt.Sprintf("Threat Types: %s\nPlatforms: %s", threatTypes, strings.Join(keys(platforms), ", "))}
+}
+
+// safeBrowsingCacheDuration is the shortest cache duration of the matches, e.g. "300s"
+func safeBrowsingCacheDuration(matches []safeBrowsingMatch) time.Duration {
+	var d time.Duration
+	for _, m := range matches {
+		if md, err := time.ParseDuration(m.CacheDuration); err == nil && (d == 0 || md < d) {
+			d = md
+		}
+	}
+	return d
+}
+
+// cached returns the result of the URL if it did not expire
+func (s *safeBrowsingScanner) cached(u string, now time.Time) (domain.SourceResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cache[u]
+	if !ok || !now.Before(c.expires) {
+		return domain.SourceResult{}, false
+	}
+	return c.res, true
+}
+
+// remember the result of the URL for the duration
+func (s *safeBrowsingScanner) remember(u string, res domain.SourceResult, d time.Duration, now time.Time) {
+	if d <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cache) >= safeBrowsingCacheSize {
+		for k, c := range s.cache {
+			if !now.Before(c.expires) {
+				delete(s.cache, k)
+			}
+		}
+		if len(s.cache) >= safeBrowsingCacheSize {
+			s.cache = make(map[string]safeBrowsingCached)
+		}
+	}
+	s.cache[u] = safeBrowsingCached{res: res, expires: now.Add(d)}
+}
+
+func (s *safeBrowsingScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res, err := s.ScanBatch(ctx, []scanIndicator{indicator})
+	if err != nil {
+		return domain.SourceResult{Result: domain.ResultUnknown}, err
+	}
+	return res[0], nil
+}
+
+// ScanBatch checks the URLs we do not have in the cache in as few calls as the API allows
+func (s *safeBrowsingScanner) ScanBatch(ctx context.Context, indicators []scanIndicator) ([]domain.SourceResult, error) {
+	now := time.Now()
+	results := make([]domain.SourceResult, len(indicators))
+	var missing []string
+	seen := make(map[string]bool)
+	for i, indicator := range indicators {
+		if res, ok := s.cached(indicator.Value, now); ok {
+			results[i] = res
+		} else if !seen[indicator.Value] {
+			seen[indicator.Value] = true
+			missing = append(missing, indicator.Value)
+		}
+	}
+	checked := make(map[string]domain.SourceResult)
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > safeBrowsingMaxEntries {
+			n = safeBrowsingMaxEntries
+		}
+		matches, err := s.find(ctx, missing[:n])
+		if err != nil {
+			return nil, err
+		}
+		byURL := make(map[string][]safeBrowsingMatch)
+		for _, m := range matches {
+			byURL[m.Threat.URL] = append(byURL[m.Threat.URL], m)
+		}
+		for _, u := range missing[:n] {
+			res, d := safeBrowsingResult(u, byURL[u]), s.negativeCache
+			if len(byURL[u]) > 0 {
+				d = safeBrowsingCacheDuration(byURL[u])
+			}
+			checked[u] = res
+			s.remember(u, res, d, now)
+		}
+		missing = missing[n:]
+	}
+	for i, indicator := range indicators {
+		if res, ok := checked[indicator.Value]; ok {
+			results[i] = res
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestSafeBrowsingScanBatch(t *testing.T) {
+	var calls, entries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Query().Get("key") != "test-key" {
+			t.Errorf("unexpected key %s", r.URL.Query().Get("key"))
+		}
+		var req safeBrowsingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		entries += len(req.ThreatInfo.ThreatEntries)
+		for _, e := range req.ThreatInfo.ThreatEntries {
+			if e.URL == "http://evil.com/login" {
+				w.Write([]byte(`{"matches":[{"threatType":"SOCIAL_ENGINEERING","platformType":"ANY_PLATFORM","threat":{"url":"http://evil.com/login"},"cacheDuration":"300s"},
+{"threatType":"MALWARE","platformType":"WINDOWS","threat":{"url":"http://evil.com/login"},"cacheDuration":"60s"}]}`))
+				return
+			}
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	s := &safeBrowsingScanner{url: srv.URL, key: "test-key", negativeCache: time.Minute, c: http.DefaultClient,
+		cache: make(map[string]safeBrowsingCached)}
+	indicators := []scanIndicator{{Type: domain.ReplyTypeURL, Value: "http://example.com"},
+		{Type: domain.ReplyTypeURL, Value: "http://evil.com/login"}, {Type: domain.ReplyTypeURL, Value: "http://example.com"}}
+	res, err := s.ScanBatch(context.Background(), indicators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 || entries != 2 {
+		t.Errorf("expected one call with the distinct URLs but got %d calls with %d URLs", calls, entries)
+	}
+	if !res[0].NotFound || res[0].Result != domain.ResultUnknown || !res[2].NotFound {
+		t.Errorf("URLs without matches should be no data but got %+v", res)
+	}
+	if res[1].Result != domain.ResultDirty || res[1].Score != "MALWARE, SOCIAL_ENGINEERING" ||
+		!strings.Contains(res[1].Detail, "Platforms: ANY_PLATFORM, WINDOWS") {
+		t.Errorf("unexpected match %+v", res[1])
+	}
+	// A match convicts the URL even if other sources think it is clean
+	if new(domain.ScoringProfile).Verdict([]domain.SourceResult{{Result: domain.ResultClean}, res[1]}, domain.ResultClean) != domain.ResultDirty {
+		t.Error("expected a match to convict the URL")
+	}
+	// Both are cached so there is no new call
+	if _, err = s.ScanBatch(context.Background(), indicators[:2]); err != nil || calls != 1 {
+		t.Errorf("expected the cached results but got %d calls - %v", calls, err)
+	}
+	if c := s.cache["http://evil.com/login"]; c.expires.Sub(time.Now()) > time.Minute {
+		t.Errorf("expected the shortest cache duration of the matches but got %v", c.expires)
+	}
+	// The cache expired
+	s.cache["http://example.com"] = safeBrowsingCached{expires: time.Now().Add(-time.Second)}
+	if _, err = s.Scan(context.Background(), indicators[0]); err != nil || calls != 2 {
+		t.Errorf("expected a new call after the cache expired but got %d calls - %v", calls, err)
+	}
+}
+
+// batchFakeScanner counts the batches it checked
+type batchFakeScanner struct {
+	fakeScanner
+	batches int
+}
+
+func (b *batchFakeScanner) ScanBatch(ctx context.Context, indicators []scanIndicator) ([]domain.SourceResult, error) {
+	b.batches++
+	res := make([]domain.SourceResult, len(indicators))
+	for i := range indicators {
+		res[i] = domain.SourceResult{Result: domain.ResultDirty, Score: indicators[i].Value}
+	}
+	return res, nil
+}
+
+func TestScanAll(t *testing.T) {
+	batch := &batchFakeScanner{fakeScanner: fakeScanner{name: "batch", types: []int{domain.ReplyTypeURL}}}
+	set := []Scanner{
+		&fakeScanner{name: "a", types: []int{domain.ReplyTypeURL}, res: domain.SourceResult{Result: domain.ResultClean}},
+		batch,
+		&fakeScanner{name: "b", types: []int{domain.ReplyTypeHash}},
+		&fakeScanner{name: "c", types: []int{domain.ReplyTypeURL}, res: domain.SourceResult{Result: domain.ResultClean}},
+	}
+	indicators := []scanIndicator{{Type: domain.ReplyTypeURL, Value: "http://a.com"}, {Type: domain.ReplyTypeURL, Value: "http://b.com"}}
+	results := scanAll(set, domain.ReplyTypeURL, indicators)
+	if batch.batches != 1 {
+		t.Errorf("expected one batch but got %d", batch.batches)
+	}
+	for i, res := range results {
+		if len(res) != 3 || res[0].Source != "a" || res[1].Source != "batch" || res[2].Source != "c" {
+			t.Fatalf("expected the results in the order of the scanners but got %+v", res)
+		}
+		if res[1].Score != indicators[i].Value {
+			t.Errorf("expected the batch result of %s but got %+v", indicators[i].Value, res[1])
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/util"
+	stackerr "github.com/go-errors/errors"
+)
+
+var sandboxTotal = metrics.NewCounter("alfred_sandbox_analyses_total",
+	"Files run in the team sandboxes by the outcome", "outcome")
+
+const (
+	// maxSandboxReport bounds the report we read, behavioral reports of busy samples are large
+	maxSandboxReport = 64 * 1024 * 1024
+	// maxSandboxSignatures we keep in the reply
+	maxSandboxSignatures = 10
+)
+
+// sandboxPollUnit is the unit of the poll interval, seconds. Replaced by the tests.
+var sandboxPollUnit = time.Second
+
+// sandboxClient talks to the REST API of Cuckoo and of CAPE which kept it
+type sandboxClient struct {
+	url      string
+	key      string
+	client   *http.Client
+	attempts int           // How many times we ask for the status of the task
+	interval time.Duration // Between the attempts
+}
+
+func newSandboxClient(s *domain.Sandbox) *sandboxClient {
+	return &sandboxClient{
+		url:      strings.TrimRight(s.URL, "/"),
+		key:      s.Key,
+		client:   util.PublicClient(time.Duration(conf.Options.Sandbox.Timeout) * time.Second),
+		attempts: conf.Options.Sandbox.PollAttempts,
+		interval: time.Duration(conf.Options.Sandbox.PollInterval) * sandboxPollUnit,
+	}
+}
+
+// do the request and decode the JSON answer into v
+func (c *sandboxClient) do(req *http.Request, v interface{}) error {
+	if c.key != "" {
+		req.Header.Set("Authorization", "Bearer "+c.key)
+	}
+	resp, err := util.DoPublic(c.client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the sandbox answered %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxSandboxReport)).Decode(v)
+}
+
+// submit the file and return the ID of its task
+func (c *sandboxClient) submit(name string, data []byte) (int, error) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return 0, err
+	}
+	part.Write(data)
+	mw.Close()
+	req, err := http.NewRequest("POST", c.url+"/tasks/create/file", body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var res struct {
+		TaskID int `json:"task_id"`
+		// CAPE answers with the tasks of the file
+		Data struct {
+			TaskIDs []int `json:"task_ids"`
+		} `json:"data"`
+	}
+	if err = c.do(req, &res); err != nil {
+		return 0, err
+	}
+	if res.TaskID == 0 && len(res.Data.TaskIDs) > 0 {
+		res.TaskID = res.Data.TaskIDs[0]
+	}
+	if res.TaskID == 0 {
+		return 0, errors.New("the sandbox did not create a task")
+	}
+	return res.TaskID, nil
+}
+
+// status of the task, reported when the report is ready
+func (c *sandboxClient) status(task int) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/tasks/view/%d", c.url, task), nil)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Task struct {
+			Status string `json:"status"`
+		} `json:"task"`
+	}
+	err = c.do(req, &res)
+	return res.Task.Status, err
+}
+
+// sandboxReport is the part of the report we use
+type sandboxReport struct {
+	Info struct {
+		Score float64 `json:"score"`
+	} `json:"info"`
+	// Malscore is the score of CAPE
+	Malscore   *float64 `json:"malscore"`
+	Signatures []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Severity    int    `json:"severity"`
+	} `json:"signatures"`
+}
+
+// report of the task as the verdict with the score and the most severe signatures
+func (c *sandboxClient) report(task int) (domain.SandboxReply, error) {
+	res := domain.SandboxReply{Task: task, Result: domain.ResultUnknown}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/tasks/report/%d", c.url, task), nil)
+	if err != nil {
+		return res, err
+	}
+	var report sandboxReport
+	if err = c.do(req, &report); err != nil {
+		return res, err
+	}
+	res.Score = report.Info.Score
+	if report.Malscore != nil {
+		res.Score = *report.Malscore
+	}
+	res.Result = sandboxVerdict(res.Score)
+	sort.SliceStable(report.Signatures, func(i, j int) bool { return report.Signatures[i].Severity > report.Signatures[j].Severity })
+	for _, s := range report.Signatures {
+		if len(res.Signatures) >= maxSandboxSignatures {
+			break
+		}
+		if s.Description == "" {
+			s.Description = s.Name
+		}
+		res.Signatures = append(res.Signatures, s.Description)
+	}
+	return res, nil
+}
+
+// sandboxVerdict is the verdict of the score of the sandbox
+func sandboxVerdict(score float64) int {
+	switch {
+	case score >= conf.Options.Sandbox.MaliciousScore:
+		return domain.ResultDirty
+	case score >= conf.Options.Sandbox.SuspiciousScore:
+		return domain.ResultSuspicious
+	}
+	return domain.ResultClean
+}
+
+// sandboxStopped is the error of the analyses the worker stopped waiting for
+const sandboxStopped = "the worker stopped"
+
+// analyze submits the file and polls for its report a bounded number of times, until the context is done
+func (c *sandboxClient) analyze(ctx context.Context, name string, data []byte) domain.SandboxReply {
+	task, err := c.submit(name, data)
+	if err != nil {
+		return domain.SandboxReply{Result: domain.ResultUnknown, Error: "unable to submit the file - " + err.Error()}
+	}
+	for attempt := 0; attempt < c.attempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return domain.SandboxReply{Task: task, Result: domain.ResultUnknown, Error: sandboxStopped}
+		case <-time.After(c.interval):
+		}
+		status, err := c.status(task)
+		if err != nil {
+			// The sandbox is busy, the next attempt might get through
+			logrus.WithError(err).Debugf("Unable to get the status of sandbox task %d", task)
+			continue
+		}
+		switch {
+		case status == "reported":
+			res, err := c.report(task)
+			if err != nil {
+				res.Error = "unable to get the report - " + err.Error()
+			}
+			return res
+		case strings.HasPrefix(status, "failed"):
+			return domain.SandboxReply{Task: task, Result: domain.ResultUnknown, Error: "the analysis " + strings.Replace(status, "_", " ", -1)}
+		}
+	}
+	return domain.SandboxReply{Task: task, Result: domain.ResultUnknown,
+		Error: fmt.Sprintf("the analysis did not finish after %d checks", c.attempts)}
+}
+
+// sandboxStore keeps the runs of the files in the sandboxes so the workers do not submit the same file twice
+type sandboxStore interface {
+	StartSandboxRun(key string, until time.Time) (*domain.SandboxRun, error)
+	FinishSandboxRun(key string, reply *domain.SandboxReply, until time.Time) error
+}
+
+// sandboxRunKey is the key of the runs of the file in the sandbox
+func sandboxRunKey(sandboxURL, hash string) string {
+	sum := sha256.Sum256([]byte(sandboxURL + "/" + hash))
+	return hex.EncodeToString(sum[:])
+}
+
+// sandboxRunTimeout is how long a run is held for the worker running it, after it another worker takes the file over
+func sandboxRunTimeout() time.Duration {
+	s := conf.Options.Sandbox
+	return time.Duration(s.PollAttempts*s.PollInterval)*sandboxPollUnit + time.Duration(s.PollAttempts+3*s.Timeout)*time.Second
+}
+
+// runSandbox runs the analysis unless a worker is running the file or ran it in the last CoalesceMinutes, then it
+// waits for that verdict. Failed analyses are not kept so the next share of the file tries again.
+func (w *Worker) runSandbox(key string, analyze func() domain.SandboxReply) domain.SandboxReply {
+	if w.runs == nil {
+		return analyze()
+	}
+	for {
+		run, err := w.runs.StartSandboxRun(key, time.Now().Add(sandboxRunTimeout()))
+		if err != nil {
+			logrus.WithError(err).Warn("Unable to check the runs of the sandbox, running the file")
+			return analyze()
+		}
+		if run == nil {
+			break
+		}
+		if run.Reply != nil {
+			res := *run.Reply
+			res.Coalesced = true
+			return res
+		}
+		// Another worker is running the file
+		select {
+		case <-w.ctx.Done():
+			return domain.SandboxReply{Result: domain.ResultUnknown, Error: sandboxStopped}
+		case <-time.After(time.Duration(conf.Options.Sandbox.PollInterval) * sandboxPollUnit):
+		}
+	}
+	res := analyze()
+	var keep *domain.SandboxReply
+	if res.Error == "" {
+		keep = &res
+	}
+	if err := w.runs.FinishSandboxRun(key, keep, time.Now().Add(time.Duration(conf.Options.Sandbox.CoalesceMinutes)*time.Minute)); err != nil {
+		logrus.WithError(err).Warn("Unable to store the verdict of the sandbox")
+	}
+	return res
+}
+
+// startSandbox runs the sandbox request once one of the Concurrency slots of the worker is free. It returns false if
+// the worker stopped first.
+func (w *Worker) startSandbox(request *domain.WorkRequest) bool {
+	select {
+	case w.sandboxSlots <- struct{}{}:
+	case <-w.ctx.Done():
+		return false
+	}
+	w.sandboxes.Add(1)
+	go func() {
+		defer w.sandboxes.Done()
+		defer func() { <-w.sandboxSlots }()
+		w.handleSandbox(request)
+	}()
+	return true
+}
+
+// queueSandbox pushes the file to run in the sandbox of the team, the reply to the file does not wait for it
+func (w *Worker) queueSandbox(request *domain.WorkRequest, md5 string) bool {
+	file := request.File
+	file.Hash = md5
+	work := &domain.WorkRequest{Type: "sandbox", MessageID: request.MessageID, File: file, ReplyQueue: request.ReplyQueue,
+		Context: request.Context, Sandbox: request.Sandbox}
+	if err := w.q.PushWork(work); err != nil {
+		sandboxTotal.Inc("push_failed")
+		logrus.WithError(err).Warnf("Unable to push file %s to the sandbox queue", request.File.Name)
+		return false
+	}
+	return true
+}
+
+// handleSandbox runs the file in the sandbox of the team and replies with its behavioral verdict
+func (w *Worker) handleSandbox(request *domain.WorkRequest) {
+	defer func() {
+		if err := recover(); err != nil {
+			logrus.Error(err)
+			logrus.Error(stackerr.Wrap(err, 2).ErrorStack())
+		}
+	}()
+	if request.Sandbox == nil || request.File.Hash == "" {
+		logrus.Warnf("Got a sandbox request without a sandbox or a hash for message %s", request.MessageID)
+		return
+	}
+	res := w.runSandbox(sandboxRunKey(request.Sandbox.URL, request.File.Hash), func() domain.SandboxReply {
+		buf, tooLarge, err := downloadFile(request.File, maxFileSize())
+		if err != nil || tooLarge {
+			return domain.SandboxReply{Result: domain.ResultUnknown, Error: "unable to download the file"}
+		}
+		return newSandboxClient(request.Sandbox).analyze(w.ctx, request.File.Name, buf.Bytes())
+	})
+	if res.Error == sandboxStopped {
+		// Another worker runs the file from the start
+		sandboxTotal.Inc("stopped")
+		if err := w.q.PushWork(request); err != nil {
+			logrus.WithError(err).Warnf("Unable to push the sandbox request of message %s again", request.MessageID)
+		}
+		return
+	}
+	switch {
+	case res.Coalesced:
+		sandboxTotal.Inc("coalesced")
+	case res.Error != "":
+		sandboxTotal.Inc("failed")
+	default:
+		sandboxTotal.Inc(strings.ToLower(verdictNames[res.Result]))
+	}
+	reply := &domain.WorkReply{Context: request.Context, MessageID: request.MessageID, Sandbox: &res}
+	reply.File.Details = request.File
+	if err := w.q.PushWorkReply(request.ReplyQueue, reply); err != nil {
+		logrus.WithError(err).Warnf("Unable to push the sandbox verdict of message %s", request.MessageID)
+	}
+}
+
+// sandboxMessages are the messages of the verdicts of the sandbox
+var sandboxMessages = map[int]string{
+	domain.ResultDirty:      "sandbox_bad",
+	domain.ResultSuspicious: "sandbox_suspicious",
+	domain.ResultClean:      "sandbox_good",
+}
+
+// sandboxText is the follow up with the behavioral verdict of the file
+func sandboxText(sub *subscription, reply *domain.WorkReply) string {
+	res := reply.Sandbox
+	args := msgArgs{"Indicator": reply.File.Details.Name, "Score": fmt.Sprintf("%.1f", res.Score), "Error": res.Error}
+	id, ok := sandboxMessages[res.Result]
+	if res.Error != "" || !ok {
+		id = "sandbox_failed"
+	}
+	text := sub.msg(id, args)
+	if len(res.Signatures) > 0 {
+		text += "\n" + sub.msg("sandbox_signatures", msgArgs{"Signatures": strings.Join(res.Signatures, "; ")})
+	}
+	if res.Coalesced {
+		text += "\n" + sub.msg("sandbox_coalesced", nil)
+	}
+	return text
+}
+
+// handleSandboxReply posts the behavioral verdict of the file in the thread of the message it was shared in, with the
+// channel thresholds of the file replies
+func (b *Bot) handleSandboxReply(reply *domain.WorkReply, data *domain.Context) {
+	sub := b.relevantTeam(data.Team)
+	if sub == nil {
+		var err error
+		if sub, err = b.loadSubscription(data.Team); err != nil {
+			replyLog(reply, data).WithError(err).Warn("Team not found in subscriptions")
+			return
+		}
+	}
+	if sub.configuration.IsMuted(data.Channel) {
+		return
+	}
+	result := reply.Sandbox.Result
+	shouldPost := data.Mention || data.Rescan || result == domain.ResultDirty || result == domain.ResultSuspicious
+	if data.Channel != "" {
+		shouldPost = shouldPost || data.Channel[0] == 'D' || sub.configuration.IsVerbose(data.Channel)
+		switch sub.configuration.Threshold(data.Channel) {
+		case domain.ThresholdAll:
+			shouldPost = true
+		case domain.ThresholdSuspicious:
+			shouldPost = result != domain.ResultClean
+		case domain.ThresholdMalicious:
+			shouldPost = result == domain.ResultDirty
+		}
+	}
+	if !shouldPost {
+		return
+	}
+	message := map[string]interface{}{"channel": data.Channel, "as_user": true, "text": sandboxText(sub, reply)}
+	// The verdict comes minutes after the reply so it always goes to the thread
+	thread := data.ThreadTS
+	if thread == "" {
+		thread = data.TS
+	}
+	inThread(message, thread)
+	if _, err := sub.s.PostMessage(message); err != nil {
+		replyLog(reply, data).WithError(err).Warn("Unable to post the sandbox verdict to Slack")
+	}
+}
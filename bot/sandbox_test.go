@@ -0,0 +1,250 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/queue"
+	"github.com/demisto/alfred/repo/repotest"
+	"github.com/demisto/alfred/util"
+)
+
+// sandboxTestReport is a Cuckoo report of a malicious file
+const sandboxTestReport = `{"info": {"score": 8.4}, "signatures": [
+	{"name": "antivm", "description": "Checks for a virtual machine", "severity": 2},
+	{"name": "c2", "description": "Connects to a known C2 server", "severity": 3},
+	{"name": "packer", "severity": 1}]}`
+
+// sandboxTestServer serves the shared file and the Cuckoo API. The task runs for the number of status checks.
+func sandboxTestServer(t *testing.T, running int32, status string, submits *int32) *httptest.Server {
+	var checks int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			w.Write([]byte("MZ not really a program"))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer k3y" {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		switch r.URL.Path {
+		case "/api/tasks/create/file":
+			f, h, err := r.FormFile("file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content, _ := ioutil.ReadAll(f); h.Filename != "invoice.exe" || string(content) != "MZ not really a program" {
+				t.Errorf("unexpected file %s - %s", h.Filename, content)
+			}
+			atomic.AddInt32(submits, 1)
+			w.Write([]byte(`{"task_id": 7}`))
+		case "/api/tasks/view/7":
+			if atomic.AddInt32(&checks, 1) <= running {
+				w.Write([]byte(`{"task": {"id": 7, "status": "running"}}`))
+				return
+			}
+			fmt.Fprintf(w, `{"task": {"id": 7, "status": %q}}`, status)
+		case "/api/tasks/report/7":
+			w.Write([]byte(sandboxTestReport))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// useSandbox sets quick polls and a fresh coalescing window for the test, call the returned function to restore
+func useSandbox() func() {
+	saved, savedUnit := conf.Options.Sandbox, sandboxPollUnit
+	conf.Options.Sandbox.Timeout, conf.Options.Sandbox.PollAttempts, conf.Options.Sandbox.PollInterval = 5, 3, 1
+	conf.Options.Sandbox.CoalesceMinutes, conf.Options.Sandbox.Concurrency = 60, 2
+	conf.Options.Sandbox.MaliciousScore, conf.Options.Sandbox.SuspiciousScore = 7, 4
+	sandboxPollUnit = time.Millisecond
+	return func() {
+		conf.Options.Sandbox, sandboxPollUnit = saved, savedUnit
+	}
+}
+
+// sandboxWorker is a worker with the sandbox runs of the store, workers with the same store share the runs
+func sandboxWorker(q queue.Queue, runs sandboxStore) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Worker{q: q, runs: runs, ctx: ctx, cancel: cancel, sandboxSlots: make(chan struct{}, 1)}
+}
+
+func TestSandboxClient(t *testing.T) {
+	defer allowPrivateURLs()()
+	defer useSandbox()()
+	var submits int32
+	srv := sandboxTestServer(t, 2, "reported", &submits)
+	defer srv.Close()
+	c := newSandboxClient(&domain.Sandbox{URL: srv.URL + "/api/", Key: "k3y"})
+	res := c.analyze(context.Background(), "invoice.exe", []byte("MZ not really a program"))
+	expected := domain.SandboxReply{Result: domain.ResultDirty, Task: 7, Score: 8.4,
+		Signatures: []string{"Connects to a known C2 server", "Checks for a virtual machine", "packer"}}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %+v but got %+v", expected, res)
+	}
+	// The task is still running after all the checks
+	running := sandboxTestServer(t, 10, "reported", &submits)
+	defer running.Close()
+	res = newSandboxClient(&domain.Sandbox{URL: running.URL + "/api", Key: "k3y"}).analyze(context.Background(), "invoice.exe", []byte("MZ not really a program"))
+	if res.Result != domain.ResultUnknown || res.Task != 7 || res.Error != "the analysis did not finish after 3 checks" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	failed := sandboxTestServer(t, 0, "failed_analysis", &submits)
+	defer failed.Close()
+	res = newSandboxClient(&domain.Sandbox{URL: failed.URL + "/api", Key: "k3y"}).analyze(context.Background(), "invoice.exe", []byte("MZ not really a program"))
+	if res.Result != domain.ResultUnknown || res.Error != "the analysis failed analysis" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if submits != 3 {
+		t.Errorf("expected 3 submits but got %d", submits)
+	}
+}
+
+func TestSandboxVerdict(t *testing.T) {
+	defer useSandbox()()
+	for score, expected := range map[float64]int{0: domain.ResultClean, 3.9: domain.ResultClean, 4: domain.ResultSuspicious, 7.5: domain.ResultDirty} {
+		if res := sandboxVerdict(score); res != expected {
+			t.Errorf("score %v is %d, expected %d", score, res, expected)
+		}
+	}
+}
+
+func TestSandboxRunsCoalesce(t *testing.T) {
+	defer useSandbox()()
+	var calls int32
+	release := make(chan struct{})
+	analyze := func() domain.SandboxReply {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return domain.SandboxReply{Result: domain.ResultDirty, Task: 1}
+	}
+	// Two workers of the same store, like two processes of the same database
+	runs := repotest.New()
+	first, second := sandboxWorker(nil, runs), sandboxWorker(nil, runs)
+	results := make([]domain.SandboxReply, 3)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = first.runSandbox("abc", analyze)
+	}()
+	// Wait for the first to start before the same file is shared again
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1] = second.runSandbox("abc", analyze)
+	}()
+	close(release)
+	wg.Wait()
+	// Still within the window
+	results[2] = second.runSandbox("abc", analyze)
+	if calls != 1 || results[0].Coalesced || !results[1].Coalesced || !results[2].Coalesced || results[2].Task != 1 {
+		t.Errorf("expected a single analysis but got %d - %+v", calls, results)
+	}
+	// Failures are tried again
+	fail := func() domain.SandboxReply {
+		atomic.AddInt32(&calls, 1)
+		return domain.SandboxReply{Result: domain.ResultUnknown, Error: "down"}
+	}
+	first.runSandbox("def", fail)
+	if res := second.runSandbox("def", fail); res.Coalesced || calls != 3 {
+		t.Errorf("expected the failure to be tried again but got %d calls - %+v", calls, res)
+	}
+}
+
+func TestHandleSandbox(t *testing.T) {
+	defer allowPrivateURLs()()
+	defer useSandbox()()
+	var submits int32
+	srv := sandboxTestServer(t, 1, "reported", &submits)
+	defer srv.Close()
+	q := testQueue()
+	s := &fakeScanner{name: domain.SourceURLhaus, types: []int{domain.ReplyTypeHash}, res: domain.SourceResult{NotFound: true, Result: domain.ResultUnknown}}
+	w := sandboxWorker(q, repotest.New())
+	w.scanners = map[string]Scanner{domain.SourceURLhaus: s}
+	sandbox := &domain.Sandbox{URL: srv.URL + "/api", Key: "k3y", Enabled: true}
+	ctx := &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}
+	request := &domain.WorkRequest{Type: "file", MessageID: "1.1", ReplyQueue: util.Hostname, Context: ctx, Sandbox: sandbox,
+		File: domain.File{Name: "invoice.exe", FileType: "binary", Size: 23, URL: srv.URL + "/file"}}
+	reply := &domain.WorkReply{}
+	w.handleFile(request, reply)
+	work := pushedWork(q)
+	if !reply.File.Sandboxed || len(work) != 1 || work[0].Type != "sandbox" || work[0].File.Hash != reply.Hashes[0].Details ||
+		work[0].Sandbox == nil || work[0].Sandbox.URL != sandbox.URL {
+		t.Fatalf("expected the file to be queued for the sandbox but got %+v - %+v", reply.File, work)
+	}
+	if f := fileFinding(defaultLocale, reply, "https://example.com/details"); !strings.Contains(f.comment, "follows in the thread") {
+		t.Errorf("unexpected finding %+v", f)
+	}
+	// The sandbox replies on its own
+	w.handleSandbox(work[0])
+	w.handleSandbox(work[0])
+	replies := pushedReplies(q)
+	if len(replies) != 2 || replies[0].Sandbox == nil || replies[0].Sandbox.Result != domain.ResultDirty || replies[0].Context.(*domain.Context).TS != "1.1" ||
+		!replies[1].Sandbox.Coalesced || submits != 1 {
+		t.Fatalf("unexpected replies %+v with %d submits", replies, submits)
+	}
+	text := sandboxText(nil, replies[0])
+	if !strings.HasPrefix(text, "Warning: the sandbox saw File (invoice.exe) behave maliciously - it scored 8.4 / 10.") ||
+		!strings.Contains(text, "What it did: Connects to a known C2 server; ") {
+		t.Errorf("unexpected text %s", text)
+	}
+	// Known files and disabled sandboxes are not submitted
+	w.handleFile(&domain.WorkRequest{Type: "file", Context: ctx, Sandbox: &domain.Sandbox{URL: srv.URL}, File: request.File}, &domain.WorkReply{})
+	s.res = domain.SourceResult{Result: domain.ResultClean}
+	w.handleFile(request, &domain.WorkReply{})
+	if work = pushedWork(q); len(work) != 0 {
+		t.Errorf("expected nothing queued but got %+v", work)
+	}
+}
+
+func TestSandboxStop(t *testing.T) {
+	defer allowPrivateURLs()()
+	defer useSandbox()()
+	// The analysis would wait a long time for its verdict
+	conf.Options.Sandbox.PollInterval = 60000
+	var submits int32
+	srv := sandboxTestServer(t, 10, "reported", &submits)
+	defer srv.Close()
+	q := testQueue()
+	w := sandboxWorker(q, repotest.New())
+	request := &domain.WorkRequest{Type: "sandbox", MessageID: "1.1", ReplyQueue: util.Hostname, Context: &domain.Context{Team: "T1"},
+		Sandbox: &domain.Sandbox{URL: srv.URL + "/api", Key: "k3y"}, File: domain.File{Name: "invoice.exe", Hash: "abc", URL: srv.URL + "/file"}}
+	if !w.startSandbox(request) {
+		t.Fatal("expected the sandbox to start")
+	}
+	for atomic.LoadInt32(&submits) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Only Concurrency files run at the same time
+	started := make(chan bool)
+	go func() { started <- w.startSandbox(request) }()
+	select {
+	case <-started:
+		t.Fatal("expected the second file to wait for a slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	w.Stop()
+	if <-started {
+		t.Error("expected the waiting file not to start once the worker stopped")
+	}
+	// The running analysis is pushed again for another worker and its run is released
+	if work := pushedWork(q); len(work) != 1 || work[0].MessageID != "1.1" || len(pushedReplies(q)) != 0 {
+		t.Errorf("expected the request to be pushed again without a reply but got %+v", work)
+	}
+}
@@ -0,0 +1,233 @@
+package bot
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+)
+
+var scanCacheTotal = metrics.NewCounter("alfred_scan_cache_total",
+	"Results of the sources answered from the scan cache (hit) or looked up (miss) by the source", "source", "result")
+
+// scanCache keeps the results of the sources by source and indicator
+type scanCache interface {
+	// get returns the result of the key and when it was cached if it did not expire
+	get(key string) (domain.SourceResult, time.Time, bool)
+	set(key string, res domain.SourceResult, ttl time.Duration)
+}
+
+// scanResults is the cache in front of the scanners, nil when it is disabled. Replaced by the tests.
+var scanResults scanCache
+
+// newScanCache creates the cache of the configured backend
+func newScanCache() (scanCache, error) {
+	switch conf.Options.ScanCache.Backend {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryScanCache(conf.Options.ScanCache.Size), nil
+	}
+	return nil, fmt.Errorf("unknown scan cache backend %s - must be memory", conf.Options.ScanCache.Backend)
+}
+
+// scanCacheTTL is how long the results of the indicator type are kept, 0 if they are not cached
+func scanCacheTTL(indicatorType int) time.Duration {
+	var minutes int
+	switch indicatorType {
+	case domain.ReplyTypeHash:
+		minutes = conf.Options.ScanCache.Hash
+	case domain.ReplyTypeURL:
+		minutes = conf.Options.ScanCache.URL
+	case domain.ReplyTypeIP:
+		minutes = conf.Options.ScanCache.IP
+	case domain.ReplyTypeDomain:
+		minutes = conf.Options.ScanCache.Domain
+	case domain.ReplyTypeEmail:
+		minutes = conf.Options.ScanCache.Email
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// scanCacheKey is the key of the result of the scanner for the indicator. It has the credentials the source is checked
+// with, like the breaker, so a result looked up with the key of a team is not shown to the teams without it.
+func scanCacheKey(s Scanner, indicator scanIndicator) string {
+	sum := sha256.Sum256([]byte(scanBreaker(s)))
+	return fmt.Sprintf("%s:%x:%d:%s", s.Name(), sum[:8], indicator.Type, indicator.Value)
+}
+
+// memoryScanCache is a bounded LRU of the results in the worker
+type memoryScanCache struct {
+	mu      sync.Mutex // Guards the entries and order
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+}
+
+// cachedScan is a single entry of the memory cache
+type cachedScan struct {
+	key     string
+	res     domain.SourceResult
+	ts      time.Time
+	expires time.Time
+}
+
+func newMemoryScanCache(size int) *memoryScanCache {
+	return &memoryScanCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *memoryScanCache) get(key string) (domain.SourceResult, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return domain.SourceResult{}, time.Time{}, false
+	}
+	entry := e.Value.(*cachedScan)
+	if !time.Now().Before(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return domain.SourceResult{}, time.Time{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.res, entry.ts, true
+}
+
+func (c *memoryScanCache) set(key string, res domain.SourceResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		entry := e.Value.(*cachedScan)
+		entry.res, entry.ts, entry.expires = res, now, now.Add(ttl)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedScan{key: key, res: res, ts: now, expires: now.Add(ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedScan).key)
+	}
+}
+
+// scanFlight is a scan in progress, the scans of the same key wait for its result
+type scanFlight struct {
+	done chan struct{}
+	res  domain.SourceResult
+}
+
+// scanFlights are the scans in progress by key
+var scanFlights = struct {
+	sync.Mutex
+	keys map[string]*scanFlight
+}{keys: make(map[string]*scanFlight)}
+
+// scanOnce runs the scan of the key unless one is already in progress and returns its result, so a burst of the same
+// indicator is one call to the source
+func scanOnce(key string, run func() domain.SourceResult) domain.SourceResult {
+	scanFlights.Lock()
+	if f, ok := scanFlights.keys[key]; ok {
+		scanFlights.Unlock()
+		<-f.done
+		return f.res
+	}
+	f := &scanFlight{done: make(chan struct{})}
+	scanFlights.keys[key] = f
+	scanFlights.Unlock()
+	defer func() {
+		scanFlights.Lock()
+		delete(scanFlights.keys, key)
+		scanFlights.Unlock()
+		close(f.done)
+	}()
+	f.res = run()
+	return f.res
+}
+
+// cacheTTLScanner is a scanner whose results are kept for their own time instead of the time of the indicator type
+type cacheTTLScanner interface {
+	cacheTTL() time.Duration
+}
+
+// scanCached answers from the cache if it has a result of the source for the indicator and checks it with the
+// scanner otherwise. Failed and pending scans are not cached and the ones the source does not know only for
+// NotFound minutes, since a new sample or URL is often known a few minutes later.
+func scanCached(s Scanner, indicator scanIndicator) domain.SourceResult {
+	cache, ttl := scanResults, scanCacheTTL(indicator.Type)
+	if t, ok := s.(cacheTTLScanner); ok && ttl > 0 {
+		ttl = t.cacheTTL()
+	}
+	if cache == nil || ttl <= 0 {
+		return scanOne(s, indicator)
+	}
+	key := scanCacheKey(s, indicator)
+	// The details page shows what only the online scans add and rescan asks for new results
+	if !indicator.Online && !indicator.Fresh {
+		if res, ts, ok := cache.get(key); ok {
+			scansTotal.Inc(s.Name(), "cached")
+			scanCacheTotal.Inc(s.Name(), "hit")
+			res.Cached = ts
+			return res
+		}
+	}
+	scanCacheTotal.Inc(s.Name(), "miss")
+	return scanOnce(fmt.Sprintf("%s:%v", key, indicator.Online), func() domain.SourceResult {
+		res := scanOne(s, indicator)
+		if res.Error != "" || res.Pending {
+			return res
+		}
+		if notFound := time.Duration(conf.Options.ScanCache.NotFound) * time.Minute; res.NotFound && notFound < ttl {
+			if notFound <= 0 {
+				return res
+			}
+			ttl = notFound
+		}
+		cache.set(key, res, ttl)
+		return res
+	})
+}
+
+// sha512Key is the cache key of the MD5 of the file with the SHA-512
+func sha512Key(sha512 string) string {
+	return "sha512:" + sha512
+}
+
+// rememberSHA512 keeps the MD5 of a file we downloaded by its SHA-512 for as long as the results of the hashes, so a
+// SHA-512 pasted later can be looked up by the MD5 the sources index. It needs the scan cache.
+func rememberSHA512(sha512, md5 string) {
+	if ttl := scanCacheTTL(domain.ReplyTypeHash); scanResults != nil && ttl > 0 {
+		scanResults.set(sha512Key(sha512), domain.SourceResult{Detail: md5}, ttl)
+	}
+}
+
+// resolveSHA512 returns the MD5 of the file with the SHA-512, empty if we did not download it
+func resolveSHA512(sha512 string) string {
+	if scanResults == nil {
+		return ""
+	}
+	res, _, ok := scanResults.get(sha512Key(sha512))
+	if !ok {
+		return ""
+	}
+	return res.Detail
+}
+
+// cachedAgo is how long ago the result was cached in the reply, e.g. 2h ago
+func cachedAgo(ts, now time.Time) string {
+	d := now.Sub(ts)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
@@ -0,0 +1,168 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// countingScanner counts its scans and holds them until release is closed
+type countingScanner struct {
+	calls    int32
+	release  chan struct{}
+	err      error
+	notFound bool
+	teamKey  string
+}
+
+func (s *countingScanner) Name() string                    { return "counting" }
+func (s *countingScanner) Supports(indicatorType int) bool { return true }
+func (s *countingScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	return domain.SourceResult{Result: domain.ResultClean, Score: "clean", NotFound: s.notFound}, s.err
+}
+func (s *countingScanner) breakerKey() string { return teamBreakerKey("counting", s.teamKey) }
+
+// withScanCache caches the results in memory for the test, call the returned function to restore the cache
+func withScanCache() func() {
+	saved, savedConf := scanResults, conf.Options.ScanCache
+	scanResults = newMemoryScanCache(10)
+	conf.Options.ScanCache.Hash, conf.Options.ScanCache.URL = 60, 60
+	return func() { scanResults, conf.Options.ScanCache = saved, savedConf }
+}
+
+func TestMemoryScanCache(t *testing.T) {
+	c := newMemoryScanCache(2)
+	c.set("a", domain.SourceResult{Score: "a"}, time.Hour)
+	c.set("b", domain.SourceResult{Score: "b"}, time.Hour)
+	// a is now the most recent so b goes when c comes
+	if res, _, ok := c.get("a"); !ok || res.Score != "a" {
+		t.Errorf("expected a but got %+v", res)
+	}
+	c.set("c", domain.SourceResult{Score: "c"}, time.Hour)
+	if _, _, ok := c.get("b"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	c.set("d", domain.SourceResult{Score: "d"}, -time.Second)
+	if _, _, ok := c.get("d"); ok {
+		t.Error("expected the expired entry to be missing")
+	}
+}
+
+func TestScanCached(t *testing.T) {
+	defer withScanCache()()
+	s := &countingScanner{}
+	indicator := scanIndicator{Type: domain.ReplyTypeHash, Value: "44d88612fea8a8f36de82e1278abb02f"}
+	if res := scanCached(s, indicator); !res.Cached.IsZero() {
+		t.Errorf("expected the first scan to go to the source but got %+v", res)
+	}
+	hits := scanCacheTotal.Value("counting", "hit")
+	res := scanCached(s, indicator)
+	if s.calls != 1 || res.Cached.IsZero() || res.Score != "clean" {
+		t.Errorf("expected a cached result but got %+v after %d calls", res, s.calls)
+	}
+	if scanCacheTotal.Value("counting", "hit") != hits+1 {
+		t.Error("expected the hit to be counted")
+	}
+	// Rescan and the details page go to the source
+	fresh := indicator
+	fresh.Fresh = true
+	if res = scanCached(s, fresh); s.calls != 2 || !res.Cached.IsZero() {
+		t.Errorf("expected rescan to bypass the cache but got %+v after %d calls", res, s.calls)
+	}
+	// Failures are not cached
+	failing := &countingScanner{err: errors.New("down")}
+	indicator.Value = "275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f"
+	scanCached(failing, indicator)
+	scanCached(failing, indicator)
+	if failing.calls != 2 {
+		t.Errorf("expected the failed scan not to be cached but got %d calls", failing.calls)
+	}
+}
+
+func TestScanCachedNotFound(t *testing.T) {
+	defer withScanCache()()
+	indicator := scanIndicator{Type: domain.ReplyTypeHash, Value: "44d88612fea8a8f36de82e1278abb02f"}
+	conf.Options.ScanCache.NotFound = 0
+	s := &countingScanner{notFound: true}
+	scanCached(s, indicator)
+	scanCached(s, indicator)
+	if s.calls != 2 {
+		t.Errorf("expected an unknown indicator not to be cached without NotFound but got %d calls", s.calls)
+	}
+	conf.Options.ScanCache.NotFound = 5
+	scanCached(s, indicator)
+	if res := scanCached(s, indicator); s.calls != 3 || res.Cached.IsZero() {
+		t.Errorf("expected an unknown indicator to be cached for NotFound minutes but got %+v after %d calls", res, s.calls)
+	}
+	if res, _, _ := scanResults.(*memoryScanCache).get(scanCacheKey(s, indicator)); !res.NotFound {
+		t.Errorf("expected the not found result in the cache but got %+v", res)
+	}
+	if e := scanResults.(*memoryScanCache).entries[scanCacheKey(s, indicator)].Value.(*cachedScan); time.Until(e.expires) > 5*time.Minute {
+		t.Errorf("expected the not found result to expire in 5 minutes but it expires at %v", e.expires)
+	}
+}
+
+func TestScanCachedPerKey(t *testing.T) {
+	defer withScanCache()()
+	indicator := scanIndicator{Type: domain.ReplyTypeHash, Value: "44d88612fea8a8f36de82e1278abb02f"}
+	ours, mine, theirs := &countingScanner{}, &countingScanner{teamKey: "mine"}, &countingScanner{teamKey: "theirs"}
+	for _, s := range []*countingScanner{ours, mine, theirs} {
+		scanCached(s, indicator)
+	}
+	if ours.calls != 1 || mine.calls != 1 || theirs.calls != 1 {
+		t.Errorf("expected each key to look the indicator up - %d, %d, %d", ours.calls, mine.calls, theirs.calls)
+	}
+	if res := scanCached(&countingScanner{teamKey: "mine"}, indicator); res.Cached.IsZero() {
+		t.Errorf("expected the result of the same key to be cached but got %+v", res)
+	}
+}
+
+func TestScanCachedSingleflight(t *testing.T) {
+	defer withScanCache()()
+	s := &countingScanner{release: make(chan struct{})}
+	indicator := scanIndicator{Type: domain.ReplyTypeURL, Value: "http://example.com/burst", Fresh: true}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := scanCached(s, indicator); res.Score != "clean" {
+				t.Errorf("unexpected result %+v", res)
+			}
+		}()
+	}
+	// Let the burst join the scan in progress
+	for atomic.LoadInt32(&s.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(s.release)
+	wg.Wait()
+	if s.calls != 1 {
+		t.Errorf("expected a single scan for the burst but got %d", s.calls)
+	}
+}
+
+func TestCachedAgo(t *testing.T) {
+	now := time.Now()
+	for d, expected := range map[time.Duration]string{
+		10 * time.Second: "just now",
+		5 * time.Minute:  "5m ago",
+		2 * time.Hour:    "2h ago",
+		72 * time.Hour:   "3d ago",
+	} {
+		if ago := cachedAgo(now.Add(-d), now); ago != expected {
+			t.Errorf("expected %s for %v but got %s", expected, d, ago)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/util"
+)
+
+// scanTimeout bounds the scan of an indicator with a source so a slow one does not hold the reply. Configured by
+// NewWorker and replaced by the tests.
+var scanTimeout = 30 * time.Second
+
+var scansTotal = metrics.NewCounter("alfred_source_scans_total",
+	"Indicators checked with the reputation sources by the source and the result", "source", "result")
+
+// Scanner checks the reputation of indicators with one source, e.g. VirusTotal
+type Scanner interface {
+	// Name is the source of the results, one of the domain sources
+	Name() string
+	// Supports checks if the source knows indicators of the type, one of the domain reply types
+	Supports(indicatorType int) bool
+	// Scan returns what the source says about the indicator. Indicators the source does not know are a result with
+	// NotFound and not an error.
+	Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error)
+}
+
+// scanIndicator is an indicator of a work request
+type scanIndicator struct {
+	Type   int // One of the domain reply types
+	Value  string
+	Online bool // The request comes from the details page so the sources add what only it shows
+	Fresh  bool // The user asked to rescan so the results are not taken from the scan cache
+	// Queue if the reply is sent again as pending results come in, so the sources with rate limits return a pending
+	// result instead of waiting for their turn
+	Queue bool
+	// Scheduled if the lookup already waited for its turn with the rate limit of the source
+	Scheduled bool
+}
+
+// newScanIndicator is the indicator of the request. Only the messages the bot gets the replies of are queued, the
+// details page and the files get a single reply.
+func newScanIndicator(request *domain.WorkRequest, indicatorType int, value string) scanIndicator {
+	indicator := scanIndicator{Type: indicatorType, Value: value, Online: request.Online,
+		Queue: request.Type == "message" && request.ReplyQueue != "" && !request.Online}
+	if ctx, err := domain.GetContext(request.Context); err == nil {
+		indicator.Fresh = ctx.Rescan
+	}
+	return indicator
+}
+
+// scannerFactory creates a scanner with the credentials of a team, the zero credentials for ours
+type scannerFactory func(creds domain.Credentials) (Scanner, error)
+
+// registeredScanner is a source the worker can check the indicators with
+type registeredScanner struct {
+	name    string
+	title   string // Shown in the replies
+	factory scannerFactory
+}
+
+// scanners are the registered sources in the order we show them
+var scanners []registeredScanner
+
+// registerScanner adds a source, the factory is called once for our credentials and for every request with credentials
+// of a team. Factories return a nil scanner to skip the source, e.g. when it needs a key we do not have.
+func registerScanner(name, title string, factory scannerFactory) {
+	scanners = append(scanners, registeredScanner{name: name, title: title, factory: factory})
+}
+
+func init() {
+	registerScanner(domain.SourceCy, "Cylance Infinity", newCyScanner)
+	registerScanner(domain.SourceXFE, "IBM X-Force Exchange", newXFEScanner)
+	registerScanner(domain.SourceVT, "VirusTotal", newVTScanner)
+	registerScanner(domain.SourceURLhaus, "URLhaus", newURLhausScanner)
+	registerScanner(domain.SourceAbuseIPDB, "AbuseIPDB", newAbuseIPDBScanner)
+	registerScanner(domain.SourceSafeBrowsing, "Google Safe Browsing", newSafeBrowsingScanner)
+	registerScanner(domain.SourceOTX, "AlienVault OTX", newOTXScanner)
+	registerScanner(domain.SourceHIBP, "Have I Been Pwned", newHIBPScanner)
+	registerScanner(domain.SourceRDAP, "Registration (RDAP)", newRDAPScanner)
+	registerScanner(domain.SourceTLS, "TLS certificate", newCertScanner)
+}
+
+// scannerTitle is the name of the source in the replies
+func scannerTitle(name string) string {
+	for _, s := range scanners {
+		if s.name == name {
+			return s.title
+		}
+	}
+	return name
+}
+
+// defaultScanners creates the scanners of all the sources with our credentials
+func defaultScanners() (map[string]Scanner, error) {
+	res := make(map[string]Scanner)
+	for _, s := range scanners {
+		scanner, err := s.factory(domain.Credentials{})
+		if err != nil {
+			return nil, err
+		}
+		res[s.name] = scanner
+	}
+	return res, nil
+}
+
+// scanSet is the scanners of the sources the team did not disable, with the team credentials where it has them
+func (w *Worker) scanSet(request *domain.WorkRequest) []Scanner {
+	var set []Scanner
+	for _, s := range scanners {
+		if util.In(request.DisabledSources, s.name) {
+			continue
+		}
+		scanner := w.scanners[s.name]
+		if creds, ok := request.Credentials[s.name]; ok {
+			own, err := s.factory(creds)
+			if err != nil {
+				logrus.WithError(err).Infof("Unable to use the team credentials for %s", s.title)
+			} else {
+				scanner = own
+			}
+		}
+		if scanner != nil {
+			set = append(set, scanner)
+		}
+	}
+	return set
+}
+
+var (
+	sourceBreakersGauge = metrics.NewGauge("alfred_source_breakers",
+		"Circuit breakers of the reputation sources that are not closed by the source and the state", "source", "state")
+	sourceBreakerTransitions = metrics.NewCounter("alfred_source_breaker_transitions_total",
+		"Changes of the state of the circuit breakers of the reputation sources by the source and the new state", "source", "state")
+)
+
+// breakerStore keeps the breakers that tripped so the bots can tell the users why a source is missing
+type breakerStore interface {
+	SetSourceBreaker(b *domain.SourceBreaker) error
+	DeleteSourceBreaker(breaker string) error
+}
+
+// sourceBreaker counts the failures of a source in a row
+type sourceBreaker struct {
+	source    string
+	failures  int
+	err       string    // The last failure
+	openUntil time.Time // Set once the breaker trips
+	probing   bool      // A probe is checking if the source is back, the other scans wait for it
+}
+
+// state of the breaker at the time
+func (br *sourceBreaker) state(now time.Time) string {
+	switch {
+	case br.openUntil.IsZero():
+		return breakerClosed
+	case br.probing || !now.Before(br.openUntil):
+		return domain.BreakerHalfOpen
+	}
+	return domain.BreakerOpen
+}
+
+// breakerClosed is the state of a breaker that lets all the scans through
+const breakerClosed = "closed"
+
+// sourceBreakers skip the sources that keep failing. After the cooldown a single scan probes the source, it closes
+// the breaker if it works and opens it for another cooldown if it does not.
+type sourceBreakers struct {
+	mu       sync.Mutex
+	breakers map[string]*sourceBreaker
+	failures int           // Failures in a row that open a breaker
+	cooldown time.Duration // How long a breaker stays open
+	store    breakerStore  // Nil if the breakers are not shared with the bots
+}
+
+// scanBreakers are shared by all the teams since a source that is down is down for everyone. Configured by NewWorker.
+var scanBreakers = &sourceBreakers{breakers: make(map[string]*sourceBreaker), failures: 5, cooldown: 5 * time.Minute}
+
+// configureSources sets the timeout of the scans and the breakers of the sources from the options. The tripped
+// breakers are stored for the bots if there is a store.
+func configureSources(store breakerStore) {
+	if conf.Options.Sources.Timeout > 0 {
+		scanTimeout = time.Duration(conf.Options.Sources.Timeout) * time.Second
+	}
+	scanBreakers.mu.Lock()
+	defer scanBreakers.mu.Unlock()
+	if conf.Options.Sources.BreakerFailures > 0 {
+		scanBreakers.failures = conf.Options.Sources.BreakerFailures
+	}
+	if conf.Options.Sources.BreakerCooldown > 0 {
+		scanBreakers.cooldown = time.Duration(conf.Options.Sources.BreakerCooldown) * time.Second
+	}
+	scanBreakers.store = store
+}
+
+// allow checks the breaker of the source is closed or lets the probe through once its cooldown passed
+func (s *sourceBreakers) allow(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	br := s.breakers[key]
+	if br == nil || br.openUntil.IsZero() {
+		return true
+	}
+	if br.probing || now.Before(br.openUntil) {
+		return false
+	}
+	br.probing = true
+	s.transition(br, domain.BreakerHalfOpen, now)
+	return true
+}
+
+// done records the result of a scan, too many failures in a row or a failed probe open the breaker
+func (s *sourceBreakers) done(key, source string, err error, now time.Time) {
+	s.mu.Lock()
+	br := s.breakers[key]
+	if err == nil {
+		delete(s.breakers, key)
+		tripped := br != nil && !br.openUntil.IsZero()
+		if tripped {
+			s.transition(br, breakerClosed, now)
+		}
+		s.mu.Unlock()
+		if tripped && s.store != nil {
+			if err := s.store.DeleteSourceBreaker(domain.BreakerName(breakerSource(key))); err != nil {
+				logrus.WithError(err).Warnf("Unable to delete the breaker of %s", source)
+			}
+		}
+		return
+	}
+	if br == nil {
+		br = &sourceBreaker{source: source}
+		s.breakers[key] = br
+	}
+	br.failures++
+	br.err = err.Error()
+	opened := br.probing || br.openUntil.IsZero() && br.failures >= s.failures
+	if opened {
+		br.probing, br.openUntil = false, now.Add(s.cooldown)
+		s.transition(br, domain.BreakerOpen, now)
+	}
+	stored := domain.SourceBreaker{Breaker: domain.BreakerName(breakerSource(key)), Source: source, State: domain.BreakerOpen,
+		Failures: br.failures, Error: br.err, OpenUntil: br.openUntil}
+	s.mu.Unlock()
+	if opened {
+		logrus.WithError(err).Warnf("%s failed %d times in a row, not checking with it until %v", scannerTitle(source), stored.Failures, stored.OpenUntil)
+		if s.store != nil {
+			if err := s.store.SetSourceBreaker(&stored); err != nil {
+				logrus.WithError(err).Warnf("Unable to store the breaker of %s", source)
+			}
+		}
+	}
+}
+
+// transition counts the change of the state of the breaker and updates the gauges, the caller holds the lock
+func (s *sourceBreakers) transition(br *sourceBreaker, state string, now time.Time) {
+	sourceBreakerTransitions.Inc(br.source, state)
+	counts := map[string]float64{domain.BreakerOpen: 0, domain.BreakerHalfOpen: 0}
+	for _, other := range s.breakers {
+		if other.source == br.source {
+			if st := other.state(now); st != breakerClosed {
+				counts[st]++
+			}
+		}
+	}
+	for st, count := range counts {
+		sourceBreakersGauge.Set(count, br.source, st)
+	}
+}
+
+// breakerSource splits the key of the breaker into the source and the key of the team, if any
+func breakerSource(key string) (source, teamKey string) {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+// keyedScanner is a scanner with the keys of the teams, a key that fails only opens the breaker of that key
+type keyedScanner interface {
+	breakerKey() string
+}
+
+// teamBreakerKey is the breaker of the team key of the source, the breaker of the source itself if we use our key
+func teamBreakerKey(source, teamKey string) string {
+	if teamKey == "" {
+		return source
+	}
+	return source + ":" + teamKey
+}
+
+// scanBreaker is the breaker of the scanner, by default the breaker of its source
+func scanBreaker(s Scanner) string {
+	if k, ok := s.(keyedScanner); ok {
+		return k.breakerKey()
+	}
+	return s.Name()
+}
+
+// batchScanner is a scanner that checks all the indicators of a request in one call to its source
+type batchScanner interface {
+	Scanner
+	// ScanBatch returns the results in the order of the indicators, which are all of types the source supports
+	ScanBatch(ctx context.Context, indicators []scanIndicator) ([]domain.SourceResult, error)
+}
+
+// scanned is what a scanner returned
+type scanned struct {
+	res []domain.SourceResult
+	err error
+}
+
+// scanGuarded runs the scan of count indicators with the scanner within scanTimeout unless its source keeps failing
+func scanGuarded(s Scanner, count int, run func(ctx context.Context) ([]domain.SourceResult, error)) []domain.SourceResult {
+	name, key := s.Name(), scanBreaker(s)
+	results := make([]domain.SourceResult, count)
+	if !scanBreakers.allow(key, time.Now()) {
+		for i := range results {
+			scansTotal.Inc(name, "skipped")
+			results[i] = domain.SourceResult{Source: name, Result: domain.ResultUnknown, Unavailable: true,
+				Error: fmt.Sprintf("%s keeps failing, we will try it again in a few minutes", scannerTitle(name))}
+		}
+		return results
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+	// The channel is buffered so a scanner that ignores the context does not leak when we stop waiting for it
+	done := make(chan scanned, 1)
+	go func() {
+		res, err := run(ctx)
+		done <- scanned{res: res, err: err}
+	}()
+	var r scanned
+	select {
+	case r = <-done:
+		if r.err == nil && len(r.res) != count {
+			r.err = fmt.Errorf("%s returned %d results for %d indicators", scannerTitle(name), len(r.res), count)
+		}
+	case <-ctx.Done():
+		r.err = fmt.Errorf("%s did not answer in %v", scannerTitle(name), scanTimeout)
+	}
+	scanBreakers.done(key, name, r.err, time.Now())
+	for i := range results {
+		if i < len(r.res) {
+			results[i] = r.res[i]
+		}
+		results[i].Source = name
+		switch {
+		case r.err != nil:
+			results[i].Error, results[i].Result = r.err.Error(), domain.ResultUnknown
+			scansTotal.Inc(name, "failed")
+		case results[i].Pending:
+			scansTotal.Inc(name, "pending")
+		case results[i].NotFound:
+			scansTotal.Inc(name, "not_found")
+		default:
+			scansTotal.Inc(name, "found")
+		}
+	}
+	return results
+}
+
+// scanOne checks the indicator with the scanner
+func scanOne(s Scanner, indicator scanIndicator) domain.SourceResult {
+	return scanGuarded(s, 1, func(ctx context.Context) ([]domain.SourceResult, error) {
+		res, err := s.Scan(ctx, indicator)
+		return []domain.SourceResult{res}, err
+	})[0]
+}
+
+// scan checks the indicator with the scanners that support its type in parallel, through the scan cache. The results
+// are in the order of the scanners and a failed scan is a result with the error.
+func scan(set []Scanner, indicator scanIndicator) []domain.SourceResult {
+	var supported []Scanner
+	for _, s := range set {
+		if s.Supports(indicator.Type) {
+			supported = append(supported, s)
+		}
+	}
+	results := make([]domain.SourceResult, len(supported))
+	var wg sync.WaitGroup
+	for i := range supported {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = scanCached(supported[i], indicator)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// scanAll checks indicators of the same type like scan, one after the other. Batch scanners check all of them in one
+// call while the others scan the indicators.
+func scanAll(set []Scanner, indicatorType int, indicators []scanIndicator) [][]domain.SourceResult {
+	var single []Scanner
+	batched := make(map[Scanner][]domain.SourceResult)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, s := range set {
+		b, ok := s.(batchScanner)
+		if !ok || len(indicators) == 0 || !s.Supports(indicatorType) {
+			single = append(single, s)
+			continue
+		}
+		wg.Add(1)
+		go func(b batchScanner) {
+			defer wg.Done()
+			res := scanGuarded(b, len(indicators), func(ctx context.Context) ([]domain.SourceResult, error) {
+				return b.ScanBatch(ctx, indicators)
+			})
+			mu.Lock()
+			batched[b] = res
+			mu.Unlock()
+		}(b)
+	}
+	scannedSingle := make([][]domain.SourceResult, len(indicators))
+	for i, indicator := range indicators {
+		scannedSingle[i] = scan(single, indicator)
+	}
+	wg.Wait()
+	// Back in the order of the scanners
+	results := make([][]domain.SourceResult, len(indicators))
+	for i := range indicators {
+		next := 0
+		for _, s := range set {
+			if !s.Supports(indicatorType) {
+				continue
+			}
+			if res, ok := batched[s]; ok {
+				results[i] = append(results[i], res[i])
+			} else {
+				results[i] = append(results[i], scannedSingle[i][next])
+				next++
+			}
+		}
+	}
+	return results
+}
+
+// found checks if the source knows the indicator
+func found(r *domain.SourceResult) bool {
+	return !r.NotFound && r.Error == "" && !r.Pending
+}
+
+// sourceScore is the score of the source if it knows the indicator
+func sourceScore(results []domain.SourceResult, source string) string {
+	for i := range results {
+		if results[i].Source == source && found(&results[i]) {
+			return results[i].Score
+		}
+	}
+	return ""
+}
+
+// sourceScores are the scores of the sources that know the indicator keyed by source
+func sourceScores(results []domain.SourceResult) map[string]string {
+	scores := make(map[string]string)
+	for i := range results {
+		if found(&results[i]) {
+			scores[results[i].Source] = results[i].Score
+		}
+	}
+	return scores
+}
+
+// sourceErrors are the errors of the sources that failed, joined
+func sourceErrors(results []domain.SourceResult) string {
+	var errs []string
+	for i := range results {
+		if results[i].Error != "" {
+			errs = append(errs, results[i].Source+": "+results[i].Error)
+		}
+	}
+	return strings.Join(errs, "; ")
+}
@@ -0,0 +1,215 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// fakeScanner returns the same result for the indicator types it supports
+type fakeScanner struct {
+	name  string
+	types []int
+	res   domain.SourceResult
+	err   error
+}
+
+func (f *fakeScanner) Name() string {
+	return f.name
+}
+
+func (f *fakeScanner) Supports(indicatorType int) bool {
+	for _, t := range f.types {
+		if t == indicatorType {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	return f.res, f.err
+}
+
+func TestScan(t *testing.T) {
+	set := []Scanner{
+		&fakeScanner{name: "a", types: []int{domain.ReplyTypeURL}, res: domain.SourceResult{Result: domain.ResultClean, Score: "1"}},
+		&fakeScanner{name: "b", types: []int{domain.ReplyTypeHash}, res: domain.SourceResult{Result: domain.ResultDirty}},
+		&fakeScanner{name: "c", types: []int{domain.ReplyTypeURL}, res: domain.SourceResult{Result: domain.ResultDirty}, err: errors.New("down")},
+	}
+	results := scan(set, scanIndicator{Type: domain.ReplyTypeURL, Value: "http://example.com"})
+	if len(results) != 2 || results[0].Source != "a" || results[1].Source != "c" {
+		t.Fatalf("expected the results of the scanners supporting URLs in order but got %+v", results)
+	}
+	if results[1].Error != "down" || results[1].Result != domain.ResultUnknown {
+		t.Errorf("a failed scan should be unknown with the error but got %+v", results[1])
+	}
+	if errs := sourceErrors(results); errs != "c: down" {
+		t.Errorf("unexpected errors %s", errs)
+	}
+	if score := sourceScore(results, "a"); score != "1" {
+		t.Errorf("unexpected score %s", score)
+	}
+}
+
+func TestScanSet(t *testing.T) {
+	w := &Worker{scanners: map[string]Scanner{
+		domain.SourceCy:  &cyScanner{},
+		domain.SourceXFE: &xfeScanner{},
+		domain.SourceVT:  &vtScanner{key: "ours"},
+	}}
+	set := w.scanSet(&domain.WorkRequest{DisabledSources: []string{domain.SourceXFE},
+		Credentials: map[string]domain.Credentials{domain.SourceVT: {Key: "theirs"}}})
+	if len(set) != 2 || set[0].Name() != domain.SourceCy || set[1].Name() != domain.SourceVT {
+		t.Fatalf("expected Cylance and VirusTotal but got %+v", set)
+	}
+	if key := set[1].(*vtScanner).key; key != "theirs" {
+		t.Errorf("expected the team key but got %s", key)
+	}
+	if set := w.scanSet(&domain.WorkRequest{}); len(set) != 3 || set[2].(*vtScanner).key != "ours" {
+		t.Errorf("expected all the sources with our key but got %+v", set)
+	}
+}
+
+func TestAddSources(t *testing.T) {
+	f := newFinding("URL", "http[://]evil[.]com", domain.ResultDirty, "", "")
+	f.addSources([]domain.SourceResult{
+		{Source: domain.SourceXFE, Result: domain.ResultDirty, Value: 8, Score: "8", Link: "https://exchange.xforce.ibmcloud.com"},
+		{Source: domain.SourceVT, Result: domain.ResultUnknown, Error: "rate limited"},
+		{Source: domain.SourceCy, NotFound: true},
+	})
+	if len(f.sources) != 1 || f.sources[0].name != "IBM X-Force Exchange" || f.sources[0].score != "8" {
+		t.Errorf("expected only the source that knows the indicator but got %+v", f.sources)
+	}
+	if f.xfe != 8 || f.vt != 0 {
+		t.Errorf("unexpected severity scores %v and %d", f.xfe, f.vt)
+	}
+	if scores := strings.Join(f.scores(), ","); !strings.Contains(scores, "IBM X-Force Exchange") {
+		t.Errorf("unexpected scores %s", scores)
+	}
+}
+
+// slowScanner answers when the context is done
+type slowScanner struct {
+	fakeScanner
+}
+
+func (s *slowScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	<-ctx.Done()
+	return s.res, nil
+}
+
+func TestScanTimeoutAndBreaker(t *testing.T) {
+	defer func(timeout time.Duration) { scanTimeout = timeout }(scanTimeout)
+	scanTimeout = time.Millisecond
+	defer func(b *sourceBreakers) { scanBreakers = b }(scanBreakers)
+	scanBreakers = newTestBreakers(nil)
+	slow := &slowScanner{fakeScanner{name: "slow", types: []int{domain.ReplyTypeURL}, res: domain.SourceResult{Result: domain.ResultDirty}}}
+	indicator := scanIndicator{Type: domain.ReplyTypeURL, Value: "http://example.com"}
+	for i := 0; i < scanBreakers.failures; i++ {
+		res := scan([]Scanner{slow}, indicator)
+		if !strings.Contains(res[0].Error, "did not answer") || res[0].Result != domain.ResultUnknown {
+			t.Fatalf("expected a timeout but got %+v", res[0])
+		}
+	}
+	res := scan([]Scanner{slow}, indicator)
+	if !strings.Contains(res[0].Error, "keeps failing") || !res[0].Unavailable {
+		t.Errorf("expected the source to be skipped after %d failures but got %+v", scanBreakers.failures, res[0])
+	}
+	if !scanBreakers.allow("slow", time.Now().Add(scanBreakers.cooldown)) {
+		t.Error("the source should be tried again after the cooldown")
+	}
+}
+
+// fakeBreakerStore keeps the stored breakers in memory
+type fakeBreakerStore struct {
+	breakers map[string]domain.SourceBreaker
+}
+
+func (f *fakeBreakerStore) SetSourceBreaker(b *domain.SourceBreaker) error {
+	f.breakers[b.Breaker] = *b
+	return nil
+}
+
+func (f *fakeBreakerStore) DeleteSourceBreaker(breaker string) error {
+	delete(f.breakers, breaker)
+	return nil
+}
+
+// newTestBreakers open after 2 failures for a minute
+func newTestBreakers(store breakerStore) *sourceBreakers {
+	return &sourceBreakers{breakers: make(map[string]*sourceBreaker), failures: 2, cooldown: time.Minute, store: store}
+}
+
+func TestSourceBreakers(t *testing.T) {
+	store := &fakeBreakerStore{breakers: make(map[string]domain.SourceBreaker)}
+	s := newTestBreakers(store)
+	now, down := time.Now(), errors.New("down")
+	opened := sourceBreakerTransitions.Value("test", domain.BreakerOpen)
+	s.done("test", "test", down, now)
+	if !s.allow("test", now) || len(store.breakers) != 0 {
+		t.Fatal("a single failure should not open the breaker")
+	}
+	s.done("test", "test", down, now)
+	if s.allow("test", now) || store.breakers["test"].State != domain.BreakerOpen || store.breakers["test"].Error != "down" {
+		t.Fatalf("expected the breaker to be open and stored but got %+v", store.breakers)
+	}
+	if sourceBreakerTransitions.Value("test", domain.BreakerOpen) != opened+1 || sourceBreakersGauge.Value("test", domain.BreakerOpen) != 1 {
+		t.Error("expected the breaker to be counted as open")
+	}
+	// After the cooldown a single probe goes through
+	later := now.Add(time.Minute)
+	if !s.allow("test", later) || s.allow("test", later) {
+		t.Fatal("expected a single probe after the cooldown")
+	}
+	if sourceBreakersGauge.Value("test", domain.BreakerHalfOpen) != 1 {
+		t.Error("expected the breaker to be counted as half-open")
+	}
+	// A failed probe opens the breaker for another cooldown
+	s.done("test", "test", down, later)
+	if s.allow("test", later.Add(time.Second)) || !s.allow("test", later.Add(time.Minute)) {
+		t.Fatal("expected the failed probe to open the breaker again")
+	}
+	// A probe that works closes it
+	s.done("test", "test", nil, later.Add(time.Minute))
+	if !s.allow("test", later.Add(time.Minute)) || len(store.breakers) != 0 || sourceBreakersGauge.Value("test", domain.BreakerOpen) != 0 {
+		t.Errorf("expected the breaker to be closed and deleted but got %+v", store.breakers)
+	}
+	// The keys of the teams never leave the worker
+	s.done("otx:secret", "otx", down, now)
+	s.done("otx:secret", "otx", down, now)
+	for name := range store.breakers {
+		if strings.Contains(name, "secret") || name != domain.BreakerName("otx", "secret") {
+			t.Errorf("unexpected breaker %s", name)
+		}
+	}
+}
+
+func TestTeamKeyBreakers(t *testing.T) {
+	tests := []struct {
+		factory  func(domain.Credentials) (Scanner, error)
+		creds    domain.Credentials
+		expected string
+	}{
+		{newVTScanner, domain.Credentials{}, "vt"},
+		{newVTScanner, domain.Credentials{Key: "team-key"}, "vt:team-key"},
+		{newXFEScanner, domain.Credentials{}, "xfe"},
+		{newXFEScanner, domain.Credentials{Key: "team-key"}, "xfe"},
+		{newXFEScanner, domain.Credentials{Key: "team-key", Password: "team-pass"}, "xfe:team-key"},
+		{newCyScanner, domain.Credentials{}, "cy"},
+		{newCyScanner, domain.Credentials{Key: "team-key"}, "cy:team-key"},
+	}
+	for _, test := range tests {
+		s, err := test.factory(test.creds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanBreaker(s) != test.expected {
+			t.Errorf("%s with %+v expected the breaker %s but got %s", s.Name(), test.creds, test.expected, scanBreaker(s))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// maxSightings is the number of previous sightings we list for an indicator
+const maxSightings = 10
+
+// NormalizeIndicator returns the form of the indicator we keep in the scan history and look it up with.
+// Defanged and refanged forms, Slack links and the case of hashes, domains and URL hosts all resolve to the same value.
+func NormalizeIndicator(value string) string {
+	value = strings.TrimSpace(value)
+	value, _ = refang(value)
+	value = strings.TrimPrefix(strings.TrimSpace(entityReplacer.Replace(unwrapLink(value))), "mailto:")
+	lvalue := strings.ToLower(value)
+	if strings.HasPrefix(lvalue, "http://") || strings.HasPrefix(lvalue, "https://") {
+		return canonicalURL(value)
+	}
+	// Bitcoin addresses are case sensitive, everything else we detect is not
+	if btcReg.FindString(value) == value {
+		return value
+	}
+	return lvalue
+}
+
+// canonicalURL lowercases the scheme and host and drops what does not change the resource - default ports,
+// the fragment and an empty path
+func canonicalURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(raw)
+	}
+	u.Scheme, u.Host, u.Fragment = strings.ToLower(u.Scheme), strings.ToLower(u.Host), ""
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) || (u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	if u.Path == "/" {
+		u.Path = ""
+	}
+	return u.String()
+}
+
+// formatSightings lists the latest sightings of an indicator out of the total we have, newest first
+func formatSightings(indicator string, sightings []domain.ScanRecord, total int) string {
+	if len(sightings) == 0 {
+		return fmt.Sprintf("I have not seen %s before.", indicator)
+	}
+	lines := []string{fmt.Sprintf("I saw %s %d times, the latest first:", indicator, total)}
+	for _, s := range sightings {
+		line := fmt.Sprintf("• %s", s.Created.UTC().Format("Jan 2 2006 15:04"))
+		if s.Channel != "" {
+			line += fmt.Sprintf(" in <#%s>", s.Channel)
+		}
+		line += " - " + verdictNames[s.Verdict]
+		if s.Permalink != "" {
+			line += fmt.Sprintf(" - <%s|message>", s.Permalink)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// handleSeen tells the user when and where we saw the indicator before
+func (b *Bot) handleSeen(team, text, channel, thread string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	inThread(postMessage, thread)
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		postMessage["text"] = "I could not understand your command. Seen command is:\nseen indicator - to see where and when I saw a hash, URL, domain, IP or email before"
+	} else if sightings, total, err := b.r.Sightings(sub.team.ID, NormalizeIndicator(fields[1]), maxSightings); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Unable to load sightings")
+		postMessage["text"] = "Error loading the history of the indicator - no worries, we are handling it"
+	} else {
+		postMessage["text"] = formatSightings(fields[1], sightings, total)
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting seen message to Slack")
+	}
+}
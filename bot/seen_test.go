@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo/repotest"
+)
+
+func TestNormalizeIndicator(t *testing.T) {
+	tests := []struct {
+		value, expected string
+	}{
+		{"44D88612FEA8A8F36DE82E1278ABB02F", "44d88612fea8a8f36de82e1278abb02f"},
+		{"hxxp://Evil[.]com/Login", "http://evil.com/Login"},
+		{"<http://evil.com/Login>", "http://evil.com/Login"},
+		{"HTTP://EVIL.COM:80/Login#top", "http://evil.com/Login"},
+		{"https://evil.com:443/", "https://evil.com"},
+		{"http://evil.com/?a=1&amp;b=2", "http://evil.com?a=1&b=2"},
+		{"Evil[.]com", "evil.com"},
+		{"<http://evil.com|evil.com>", "evil.com"},
+		{"8.8.8[.]8", "8.8.8.8"},
+		{"<mailto:Bad@Evil.com|Bad@Evil.com>", "bad@evil.com"},
+		{"1BoatSLRHtKNngkdXEeobR76b53LETtpyT", "1BoatSLRHtKNngkdXEeobR76b53LETtpyT"},
+	}
+	for _, test := range tests {
+		if got := NormalizeIndicator(test.value); got != test.expected {
+			t.Errorf("NormalizeIndicator(%q) = %q, expected %q", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestFormatSightings(t *testing.T) {
+	if text := formatSightings("evil.com", nil, 0); text != "I have not seen evil.com before." {
+		t.Errorf("Unexpected text for an unknown indicator - %s", text)
+	}
+	sightings := []domain.ScanRecord{
+		{Channel: "C1", Verdict: domain.ResultDirty, Permalink: "https://team.slack.com/archives/C1/p1", Created: time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)},
+		{Verdict: domain.ResultClean, Created: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	text := formatSightings("evil.com", sightings, 12)
+	lines := strings.Split(text, "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "12 times") {
+		t.Fatalf("Expected the total and a line per sighting but got %s", text)
+	}
+	if !strings.Contains(lines[1], "Jan 2 2020 03:04") || !strings.Contains(lines[1], "<#C1>") ||
+		!strings.Contains(lines[1], verdictNames[domain.ResultDirty]) || !strings.Contains(lines[1], "<https://team.slack.com/archives/C1/p1|message>") {
+		t.Errorf("Unexpected sighting line - %s", lines[1])
+	}
+	if strings.Contains(lines[2], "<#") || strings.Contains(lines[2], "|message>") {
+		t.Errorf("Expected no channel or link for a sighting without them - %s", lines[2])
+	}
+}
+
+func TestSeenForAdmins(t *testing.T) {
+	s, done := newFakeSlack("U2")
+	defer done()
+	r := repotest.New().
+		SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Status: domain.UserStatusActive, BotUserID: "UBOT", BotToken: "xoxb-1", ConfigAdmins: []string{"U1"}},
+			&domain.User{ID: "u1", ExternalID: "U1"}, &domain.User{ID: "u2", ExternalID: "U2"})
+	r.MarkWelcomed("1", "U1")
+	r.MarkWelcomed("1", "U2")
+	r.StoreScans([]domain.ScanRecord{{Team: "1", Channel: "G1", Indicator: "8.8.8.8", Normalized: "8.8.8.8", Created: time.Now()}})
+	b := repoBot(r)
+	// The sightings cover private channels so even the users allowed to configure do not see them
+	b.handleMessage(event(t, `{"type":"message","channel":"D1","user":"U1","text":"seen 8.8.8.8","ts":"1.1"}`))
+	b.handleMessage(event(t, `{"type":"message","channel":"D2","user":"U2","text":"seen 8.8.8.8","ts":"1.2"}`))
+	if len(s.posted) != 2 {
+		t.Fatalf("expected two replies but got %q", s.posted)
+	}
+	if !strings.HasPrefix(s.posted[0], "Sorry, only workspace admins") {
+		t.Errorf("expected the config admin to be refused - %s", s.posted[0])
+	}
+	if !strings.Contains(s.posted[1], "<#G1>") {
+		t.Errorf("expected the sightings for the workspace admin - %s", s.posted[1])
+	}
+}
@@ -1,37 +1,32 @@
 package bot
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
-	"sort"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
 	"github.com/demisto/alfred/slack"
 	"github.com/demisto/alfred/util"
 	"github.com/slavikm/govt"
 )
 
-const (
-	fileCommentGood    = "File (%s) is clean. Click %s for more details."
-	fileCommentBig     = "File (%s) is too large to scan. Click %s for more details."
-	fileCommentBad     = "Warning: File (%s) is malicious. Click %s for more details."
-	fileCommentWarning = "Unable to find details regarding this file (%s). Click %s for more details."
-	urlCommentGood     = "URL (%s) is clean: %s."
-	urlCommentBad      = "Warning: URL (%s) is malicious: %s."
-	urlCommentWarning  = "Unable to find details regarding this URL (%s): %s."
-	ipCommentGood      = "IP (%s) is clean: %s."
-	ipCommentBad       = "Warning: IP (%s) is malicious: %s."
-	ipCommentWarning   = "Unable to find details regarding this IP (%s): %s."
-	ipCommentPrivate   = "IP (%s) is a private (internal) IP so we cannot provide reputation information: %s."
-	hashCommentGood    = "Hash (%s) is clean: %s."
-	hashCommentBad     = "Warning: hash (%s) is malicious: %s."
-	hashCommentWarning = "Unable to find details regarding this hash (%s): %s."
-	mainMessage        = "Security check by DBot - Demisto Bot. Click <%s|here> for configuration and details."
-)
+// verdictEmoji is the reaction we add to the original message for each verdict
+var verdictEmoji = map[int]string{
+	domain.ResultClean:      "large_green_circle",
+	domain.ResultUnknown:    "large_yellow_circle",
+	domain.ResultSuspicious: "large_orange_circle",
+	domain.ResultDirty:      "red_circle",
+}
 
 func joinMap(m map[string]bool) string {
 	res := ""
@@ -68,112 +63,47 @@ func joinMapFloat32(m map[string]float32) string {
 	return res
 }
 
-func mainMessageFormatted() string {
-	return fmt.Sprintf(mainMessage, conf.Options.ExternalAddress)
-}
-
-func (b *Bot) handleFileReply(reply *domain.WorkReply, data *domain.Context, sub *subscription, verbose bool) {
-	// First, make sure it is a valid reply and if not, do nothing
-	if len(reply.Hashes) != 1 {
-		logrus.Warnf("Weird, invalid reply with no MD5 part - %+v", reply)
+func (b *Bot) handleFileReply(reply *domain.WorkReply, data *domain.Context, sub *subscription, verbose bool, incident <-chan string) {
+	// First, make sure it is a valid reply and if not, do nothing. Files we did not download only have a hash if the
+	// event had one.
+	skipped := reply.File.FileTooLarge || reply.File.Excluded
+	if len(reply.Hashes) != 1 && !(skipped && len(reply.Hashes) == 0) {
+		replyLog(reply, data).Warn("Weird, invalid reply with no MD5 part")
+		if debugEnabled() {
+			logrus.Debugf("Invalid file reply - %s", util.ToJSONString(reply))
+		}
 		return
 	}
-	link := fmt.Sprintf("%s/details?f=%s&t=%s", conf.Options.ExternalAddress, reply.File.Details.ID, sub.team.ID)
-	color := "warning"
-	comment := fileCommentWarning
-	shouldPost := false
-	if reply.File.FileTooLarge {
-		comment = fileCommentBig
-		shouldPost = true
-	} else if reply.File.Result == domain.ResultDirty {
-		color = "danger"
-		comment = fileCommentBad
-	} else if reply.File.Result == domain.ResultClean {
-		// At least one of reputation services found this to be known good
-		// Keep the default
-		color = "good"
-		comment = fileCommentGood
-	}
-	fileMessage := fmt.Sprintf(comment, reply.File.Details.Name, fmt.Sprintf("<%s&text=%s|Details>", link, url.QueryEscape(reply.Hashes[0].Details)))
-	attachments := []map[string]interface{}{{"fallback": fileMessage, "text": fileMessage, "color": color}}
+	link := fileLink(reply, sub.team.ID)
+	shouldPost := reply.File.FileTooLarge
+	f := fileFinding(sub.team.Locale, reply, link)
 	postMessage := map[string]interface{}{"channel": data.Channel}
 	if data.Channel != "" {
-		if reply.Hashes[0].Cy.Error == "" && reply.Hashes[0].Cy.Result.StatusCode == 1 {
-			cyColor := "good"
-			if reply.Hashes[0].Cy.Result.GeneralScore < cyScoreToConvict {
-				cyColor = "danger"
-			}
-			attachments = append(attachments, map[string]interface{}{
-				"fallback":   fmt.Sprintf("Score: %v, Classifiers: %v", reply.Hashes[0].Cy.Result.GeneralScore, reply.Hashes[0].Cy.Result.Classifiers),
-				"color":      cyColor,
-				"title":      "Cylance Infinity",
-				"title_link": "https://www.cylance.com",
-				"fields": []map[string]interface{}{
-					{"title": "Score", "value": fmt.Sprintf("%v", reply.Hashes[0].Cy.Result.GeneralScore), "short": true},
-					{"title": "Classifiers", "value": joinMapFloat32(reply.Hashes[0].Cy.Result.Classifiers), "short": true},
-				},
-			})
-		}
-		if !reply.Hashes[0].XFE.NotFound && reply.Hashes[0].XFE.Error == "" {
-			xfeColor := "good"
-			if len(reply.Hashes[0].XFE.Malware.Family) > 0 || len(reply.Hashes[0].XFE.Malware.Origins.External.Family) > 0 {
-				xfeColor = "danger"
-			}
-			attachments = append(attachments, map[string]interface{}{
-				"fallback":   fmt.Sprintf("Mime Type: %s, Family: %s", reply.Hashes[0].XFE.Malware.MimeType, strings.Join(reply.Hashes[0].XFE.Malware.Family, ",")),
-				"color":      xfeColor,
-				"title":      "IBM X-Force Exchange",
-				"title_link": fmt.Sprintf("https://exchange.xforce.ibmcloud.com/malware/%s", reply.Hashes[0].Details),
-				"fields": []map[string]interface{}{
-					{"title": "Family", "value": strings.Join(reply.Hashes[0].XFE.Malware.Family, ","), "short": true},
-					{"title": "MIME Type", "value": reply.Hashes[0].XFE.Malware.MimeType, "short": true},
-					{"title": "Created", "value": reply.Hashes[0].XFE.Malware.Created.String(), "short": true},
-				},
-			})
-		}
-		if reply.Hashes[0].VT.FileReport.ResponseCode == 1 {
-			vtColor := "good"
-			if reply.Hashes[0].VT.FileReport.Positives >= numOfPositivesToConvictForFiles {
-				vtColor = "danger"
-			}
-			attachments = append(attachments, map[string]interface{}{
-				"fallback":   fmt.Sprintf("Scan Date: %s, Positives: %v, Total: %v", reply.Hashes[0].VT.FileReport.ScanDate, reply.Hashes[0].VT.FileReport.Positives, reply.Hashes[0].VT.FileReport.Total),
-				"color":      vtColor,
-				"title":      "VirusTotal",
-				"title_link": reply.Hashes[0].VT.FileReport.Permalink,
-				"fields": []map[string]interface{}{
-					{"title": "Scan Date", "value": reply.Hashes[0].VT.FileReport.ScanDate, "short": true},
-					{"title": "Positives", "value": fmt.Sprintf("%v", reply.Hashes[0].VT.FileReport.Positives), "short": true},
-					{"title": "Total", "value": fmt.Sprintf("%v", reply.Hashes[0].VT.FileReport.Total), "short": true},
-				},
-			})
-		}
-		if reply.File.Virus != "" {
-			attachments = append(attachments, map[string]interface{}{
-				"fallback":    fmt.Sprintf("Virus name: %s", reply.File.Virus),
-				"text":        fmt.Sprintf("Virus name: %s", reply.File.Virus),
-				"color":       "danger",
-				"author_name": "ClamAV",
-				"title":       "ClamAV",
-			})
-		}
-		if verbose {
-			shouldPost = true
-		} else if reply.File.Result == domain.ResultDirty {
+		// The channel threshold overrides the verbose setting
+		switch sub.configuration.Threshold(data.Channel) {
+		case domain.ThresholdAll:
 			shouldPost = true
+		case domain.ThresholdSuspicious:
+			shouldPost = shouldPost || reply.File.Result != domain.ResultClean
+		case domain.ThresholdMalicious:
+			shouldPost = reply.File.Result == domain.ResultDirty
+		default:
+			shouldPost = shouldPost || verbose || reply.File.Result == domain.ResultDirty || reply.File.Encrypted
 		}
 	}
 	if shouldPost {
-		postMessage["attachments"] = attachments
-		err := b.post(postMessage, reply, data, sub)
-		if err != nil {
-			logrus.Errorf("Unable to send message to Slack - %v\n", err)
+		findings := []finding{f}
+		blocks := b.oversized(replyBlocks(sub.team.Locale, findings, "", nil, verbose, link), findings, "", nil, link, data, sub)
+		setReply(postMessage, b.compactDetails(blocks, reply, sub, verbose), findings, sub.configuration)
+		if _, err := b.post(postMessage, reply, data, sub); err != nil {
+			replyLog(reply, data).WithError(err).Error("Unable to send message to Slack")
 			return
 		}
+		b.noteIncident(incident, reply, data, sub)
 	}
 }
 
-func (b *Bot) handleReplyStats(reply *domain.WorkReply, sub *subscription) {
+func (b *Bot) handleReplyStats(reply *domain.WorkReply, data *domain.Context, sub *subscription) {
 	b.smu.Lock()
 	defer b.smu.Unlock()
 	stats, ok := b.stats[sub.team.ExternalID]
@@ -181,7 +111,8 @@ func (b *Bot) handleReplyStats(reply *domain.WorkReply, sub *subscription) {
 		stats = &domain.Statistics{Team: sub.team.ID}
 		b.stats[sub.team.ExternalID] = stats
 	}
-	stats.Messages++
+	stats.CountMessage(data.Channel)
+	// Suspicious indicators were not convicted so they are counted with the unknown ones
 	if reply.Type&domain.ReplyTypeFile > 0 {
 		if reply.File.Result == domain.ResultClean {
 			stats.FilesClean++
@@ -201,7 +132,10 @@ func (b *Bot) handleReplyStats(reply *domain.WorkReply, sub *subscription) {
 			}
 		}
 		for i := range reply.URLs {
-			if reply.URLs[i].Result == domain.ResultClean {
+			// Internal ones were not checked so they are not clean
+			if reply.URLs[i].Internal {
+				stats.URLsUnknown++
+			} else if reply.URLs[i].Result == domain.ResultClean {
 				stats.URLsClean++
 			} else if reply.URLs[i].Result == domain.ResultDirty {
 				stats.URLsDirty++
@@ -218,6 +152,69 @@ func (b *Bot) handleReplyStats(reply *domain.WorkReply, sub *subscription) {
 				stats.IPsUnknown++
 			}
 		}
+		// Domains are counted as URLs since they use the same reputation services
+		for i := range reply.Domains {
+			// Internal ones were not checked so they are not clean
+			if reply.Domains[i].Internal {
+				stats.URLsUnknown++
+			} else if reply.Domains[i].Result == domain.ResultClean {
+				stats.URLsClean++
+			} else if reply.Domains[i].Result == domain.ResultDirty {
+				stats.URLsDirty++
+			} else {
+				stats.URLsUnknown++
+			}
+		}
+		for i := range reply.Emails {
+			// Internal ones were not checked so they are not clean
+			if reply.Emails[i].Internal {
+				stats.URLsUnknown++
+			} else if reply.Emails[i].Result == domain.ResultClean {
+				stats.URLsClean++
+			} else if reply.Emails[i].Result == domain.ResultDirty {
+				stats.URLsDirty++
+			} else {
+				stats.URLsUnknown++
+			}
+		}
+	}
+	if c := stats.Channel(data.Channel); c != nil {
+		countChannelReply(c, reply)
+	}
+}
+
+// countChannelReply adds the indicators of the reply to the counters of its channel
+func countChannelReply(c *domain.ChannelStatistics, reply *domain.WorkReply) {
+	if reply.Type&domain.ReplyTypeFile > 0 {
+		c.Files++
+		if reply.File.Result == domain.ResultDirty {
+			c.Malicious++
+		}
+		return
+	}
+	c.URLs += int64(len(reply.URLs) + len(reply.Domains) + len(reply.Emails))
+	c.IPs += int64(len(reply.IPs))
+	c.Hashes += int64(len(reply.Hashes))
+	var results []int
+	for i := range reply.URLs {
+		results = append(results, reply.URLs[i].Result)
+	}
+	for i := range reply.Domains {
+		results = append(results, reply.Domains[i].Result)
+	}
+	for i := range reply.Emails {
+		results = append(results, reply.Emails[i].Result)
+	}
+	for i := range reply.IPs {
+		results = append(results, reply.IPs[i].Result)
+	}
+	for i := range reply.Hashes {
+		results = append(results, reply.Hashes[i].Result)
+	}
+	for _, result := range results {
+		if result == domain.ResultDirty {
+			c.Malicious++
+		}
 	}
 }
 
@@ -225,12 +222,10 @@ func (b *Bot) handleConvicted(reply *domain.WorkReply, ctx *domain.Context, sub
 	if reply.Type&domain.ReplyTypeFile > 0 && reply.File.Result == domain.ResultDirty {
 		// First, make sure it is a valid reply and if not, do nothing
 		if len(reply.Hashes) != 1 {
-			logrus.Warnf("Weird, invalid reply with no MD5 part - %+v", reply)
+			replyLog(reply, ctx).Warn("Weird, invalid reply with no MD5 part")
 			return
 		}
-		vtScore := fmt.Sprintf("%v / %v", reply.Hashes[0].VT.FileReport.Positives, reply.Hashes[0].VT.FileReport.Total)
-		xfeScore := strings.Join(reply.Hashes[0].XFE.Malware.Family, ",")
-		cyScore := fmt.Sprintf("%v - %v", reply.Hashes[0].Cy.Result.GeneralScore, reply.Hashes[0].Cy.Result.Classifiers)
+		sources := reply.Hashes[0].Sources
 		if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
 			Team:        sub.team.ID,
 			Channel:     ctx.Channel,
@@ -238,60 +233,92 @@ func (b *Bot) handleConvicted(reply *domain.WorkReply, ctx *domain.Context, sub
 			ContentType: domain.ReplyTypeFile,
 			Content:     reply.Hashes[0].Details,
 			FileName:    reply.File.Details.Name,
-			VT:          vtScore,
-			XFE:         xfeScore,
-			Cy:          cyScore,
+			VT:          sourceScore(sources, domain.SourceVT),
+			XFE:         sourceScore(sources, domain.SourceXFE),
+			Cy:          sourceScore(sources, domain.SourceCy),
 			ClamAV:      reply.File.Virus}); err != nil {
-			logrus.WithError(err).Warnf("Unable to store convicted for team [%s]", sub.team.ID)
+			replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
 		}
 	} else {
 		for i := range reply.Hashes {
 			if reply.Hashes[i].Result == domain.ResultDirty {
-				vtScore := fmt.Sprintf("%v / %v", reply.Hashes[i].VT.FileReport.Positives, reply.Hashes[i].VT.FileReport.Total)
-				xfeScore := strings.Join(reply.Hashes[i].XFE.Malware.Family, ",")
-				cyScore := fmt.Sprintf("%v - %v", reply.Hashes[i].Cy.Result.GeneralScore, reply.Hashes[i].Cy.Result.Classifiers)
 				if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
 					Team:        sub.team.ID,
 					Channel:     ctx.Channel,
 					MessageID:   reply.MessageID,
 					ContentType: domain.ReplyTypeHash,
 					Content:     reply.Hashes[i].Details,
-					VT:          vtScore,
-					XFE:         xfeScore,
-					Cy:          cyScore}); err != nil {
-					logrus.WithError(err).Warnf("Unable to store convicted for team [%s]", sub.team.ID)
+					VT:          sourceScore(reply.Hashes[i].Sources, domain.SourceVT),
+					XFE:         sourceScore(reply.Hashes[i].Sources, domain.SourceXFE),
+					Cy:          sourceScore(reply.Hashes[i].Sources, domain.SourceCy)}); err != nil {
+					replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
 				}
 			}
 		}
 		for i := range reply.URLs {
 			if reply.URLs[i].Result == domain.ResultDirty {
-				vtScore := fmt.Sprintf("%v / %v", reply.URLs[i].VT.URLReport.Positives, reply.URLs[i].VT.URLReport.Total)
-				xfeScore := fmt.Sprintf("%v", reply.URLs[i].XFE.URLDetails.Score)
 				if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
 					Team:        sub.team.ID,
 					Channel:     ctx.Channel,
 					MessageID:   reply.MessageID,
 					ContentType: domain.ReplyTypeURL,
 					Content:     reply.URLs[i].Details,
-					VT:          vtScore,
-					XFE:         xfeScore}); err != nil {
-					logrus.WithError(err).Warnf("Unable to store convicted for team [%s]", sub.team.ID)
+					VT:          sourceScore(reply.URLs[i].Sources, domain.SourceVT),
+					XFE:         sourceScore(reply.URLs[i].Sources, domain.SourceXFE)}); err != nil {
+					replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
 				}
 			}
 		}
 		for i := range reply.IPs {
 			if reply.IPs[i].Result == domain.ResultDirty {
-				vtScore := fmt.Sprintf("%v", len(reply.IPs[i].VT.IPReport.DetectedUrls))
-				xfeScore := fmt.Sprintf("%v", reply.IPs[i].XFE.IPReputation.Score)
 				if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
 					Team:        sub.team.ID,
 					Channel:     ctx.Channel,
 					MessageID:   reply.MessageID,
 					ContentType: domain.ReplyTypeIP,
 					Content:     reply.IPs[i].Details,
-					VT:          vtScore,
-					XFE:         xfeScore}); err != nil {
-					logrus.WithError(err).Warnf("Unable to store convicted for team [%s]", sub.team.ID)
+					VT:          sourceScore(reply.IPs[i].Sources, domain.SourceVT),
+					XFE:         sourceScore(reply.IPs[i].Sources, domain.SourceXFE)}); err != nil {
+					replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
+				}
+			}
+		}
+		for i := range reply.Domains {
+			if reply.Domains[i].Result == domain.ResultDirty {
+				if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
+					Team:        sub.team.ID,
+					Channel:     ctx.Channel,
+					MessageID:   reply.MessageID,
+					ContentType: domain.ReplyTypeDomain,
+					Content:     reply.Domains[i].Details,
+					VT:          sourceScore(reply.Domains[i].Sources, domain.SourceVT),
+					XFE:         sourceScore(reply.Domains[i].Sources, domain.SourceXFE)}); err != nil {
+					replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
+				}
+			}
+		}
+		for i := range reply.Wallets {
+			if reply.Wallets[i].Result == domain.ResultDirty {
+				if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
+					Team:        sub.team.ID,
+					Channel:     ctx.Channel,
+					MessageID:   reply.MessageID,
+					ContentType: domain.ReplyTypeWallet,
+					Content:     reply.Wallets[i].Details}); err != nil {
+					replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
+				}
+			}
+		}
+		for i := range reply.Emails {
+			if reply.Emails[i].Result == domain.ResultDirty {
+				if err := b.r.StoreMaliciousContent(&domain.MaliciousContent{
+					Team:        sub.team.ID,
+					Channel:     ctx.Channel,
+					MessageID:   reply.MessageID,
+					ContentType: domain.ReplyTypeEmail,
+					Content:     reply.Emails[i].Details,
+					XFE:         sourceScore(reply.Emails[i].Sources, domain.SourceXFE)}); err != nil {
+					replyLog(reply, ctx).WithError(err).Warn("Unable to store convicted")
 				}
 			}
 		}
@@ -307,8 +334,12 @@ func (a IPByDate) Less(i, j int) bool { return a[i].ScanDate < a[j].ScanDate }
 
 func (b *Bot) relevantTeam(team string) *subscription {
 	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return b.subscriptions[team]
+	sub := b.subscriptions[team]
+	b.mu.RUnlock()
+	if sub != nil {
+		sub.touch()
+	}
+	return sub
 }
 
 func nilOrUnknown(v interface{}) string {
@@ -322,260 +353,181 @@ func defangURL(u string) string {
 	return strings.Replace(strings.Replace(strings.Replace(u, "https://", "https[://]", 1), "http://", "http[://]", 1), ".", "[.]", -1)
 }
 
+// displayIndicator returns the indicator the way the user typed it if we had to refang it
+func displayIndicator(reply *domain.WorkReply, indicator string) string {
+	if original, ok := reply.Original[indicator]; ok {
+		return original
+	}
+	return indicator
+}
+
 func (b *Bot) handleReply(reply *domain.WorkReply) {
+	defer b.recoverEvent("reply", reply)
 	logrus.Debugf("Handling reply - %s", reply.MessageID)
+	outcome, team := "posted", ""
+	defer func() { repliesTotal.Inc(outcome, metrics.Team(team)) }()
 	data, err := domain.GetContext(reply.Context)
 	if err != nil {
-		logrus.Warnf("Error getting context from reply - %+v\n", reply)
+		outcome = "bad_context"
+		logrus.WithError(err).Warnf("Error getting context from reply %s", reply.MessageID)
+		if debugEnabled() {
+			logrus.Debugf("Reply without context - %s", util.ToJSONString(reply))
+		}
+		return
+	}
+	team = data.Team
+	// The verdict of the sandbox follows the reply to the file, the file was already counted
+	if reply.Sandbox != nil {
+		outcome = "sandbox"
+		b.handleSandboxReply(reply, data)
+		return
+	}
+	if reply.Failed {
+		outcome = "failed"
+		b.handleFailedReply(reply, data)
+		return
+	}
+	// Nobody is waiting for the verdicts of an expired request anymore so we only count it
+	if reply.Expired {
+		outcome = "expired"
+		b.countExpired(data.Team)
 		return
 	}
+	// Replies with pending results come again as the results come in, only the last one is counted and stored
+	posted, updating := b.pending.track(pendingKey(data, reply), reply.Pending == 0, time.Now())
+	if !updating && !data.Cached {
+		b.observeLatency(data)
+	}
+	if reply.Pending > 0 {
+		outcome = "pending"
+	}
 	sub := b.relevantTeam(data.Team)
 	if sub == nil {
 		if sub, err = b.loadSubscription(data.Team); err != nil {
-			logrus.WithError(err).Warnf("Team not found in subscriptions for message %s", reply.MessageID)
+			outcome = "unknown_team"
+			replyLog(reply, data).WithError(err).Warn("Team not found in subscriptions")
+			return
+		}
+	}
+	var incident <-chan string
+	// Cached verdicts were counted, stored and forwarded with the reply they came from so we only post them
+	if reply.Pending == 0 && !data.Cached {
+		b.handleReplyStats(reply, data, sub)
+		b.handleConvicted(reply, data, sub)
+		b.storeScans(reply, data, sub)
+		b.queueVerdicts(reply, data, sub)
+		b.queueEmail(reply, data, sub)
+		b.queueSyslog(reply, data, sub)
+		incident = b.openIncident(reply, data, sub)
+		b.cache.add(data.Team, reply)
+	}
+	// Muted channels are still scanned and counted, we just keep quiet
+	if sub.configuration.IsMuted(data.Channel) {
+		outcome = "muted"
+		if reply.Pending > 0 {
 			return
 		}
+		replyLog(reply, data).Debug("Channel is muted, ignoring reply")
+		b.smu.Lock()
+		if stats, ok := b.stats[sub.team.ExternalID]; ok {
+			stats.Muted++
+		} else {
+			b.stats[sub.team.ExternalID] = &domain.Statistics{Team: sub.team.ID, Muted: 1}
+		}
+		b.smu.Unlock()
+		return
+	}
+	mode := sub.configuration.Mode(data.Channel)
+	if mode != domain.ModeMessage && data.TS != "" && reply.Pending == 0 {
+		if err = sub.s.ReactionsAdd(data.Channel, data.TS, verdictEmoji[reply.Verdict()]); err != nil {
+			replyLog(reply, data).WithError(err).Warn("Unable to add reaction to message")
+		}
+	}
+	// A re-scan was asked for explicitly so it always gets a message
+	if mode == domain.ModeReaction && !data.Rescan && !data.Mention {
+		outcome = "reaction"
+		return
 	}
-	b.handleReplyStats(reply, sub)
-	b.handleConvicted(reply, data, sub)
 	verbose := false
 	if data.Channel != "" {
 		if data.Channel[0] == 'D' {
 			// Since it's a direct message to me, I need to reply verbose
 			verbose = true
 		} else {
-			verbose = sub.configuration.IsVerbose(data.Channel)
+			// So is a scan we were asked for by mentioning us
+			verbose = data.Mention || sub.configuration.IsVerbose(data.Channel)
 		}
 	}
 	if reply.Type&domain.ReplyTypeFile > 0 {
-		b.handleFileReply(reply, data, sub, verbose)
+		outcome = "file"
+		b.handleFileReply(reply, data, sub, verbose, incident)
+		// Indicators inside a shared text file get their own reply
+		if reply.Snippet != nil {
+			snippet := *reply.Snippet
+			// The latency was already counted with the file itself
+			snippetCtx := *data
+			snippetCtx.Pushed, snippetCtx.Enqueued, snippetCtx.Replied = time.Time{}, time.Time{}, time.Time{}
+			snippet.Context, snippet.MessageID = &snippetCtx, reply.MessageID
+			b.handleReply(&snippet)
+		}
 	} else {
-		link := fmt.Sprintf("%s/details?c=%s&m=%s&t=%s", conf.Options.ExternalAddress, data.Channel, reply.MessageID, sub.team.ID)
+		link := messageLink(data.Channel, reply.MessageID, sub.team.ID)
 		postMessage := slack.Response{"channel": data.Channel}
-		attachments := make([]map[string]interface{}, 0)
-		for i := range reply.URLs {
-			color := "warning"
-			comment := urlCommentWarning
-			if reply.URLs[i].Result == domain.ResultDirty {
-				color = "danger"
-				comment = urlCommentBad
-			} else if reply.URLs[i].Result == domain.ResultClean {
-				color = "good"
-				comment = urlCommentGood
-			}
-			urlMessage := fmt.Sprintf(comment, defangURL(reply.URLs[i].Details), fmt.Sprintf("<%s&text=%s|Details>", link, url.QueryEscape("<"+reply.URLs[i].Details+">")))
-			if verbose || color != "good" {
-				attachments = append(attachments, map[string]interface{}{
-					"fallback": urlMessage,
-					"text":     urlMessage,
-					"color":    color,
-				})
-			}
-			if verbose {
-				if !reply.URLs[i].XFE.NotFound && reply.URLs[i].XFE.Error == "" {
-					xfeColor := "good"
-					if reply.URLs[i].XFE.URLDetails.Score >= xfeScoreToConvict {
-						xfeColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback": fmt.Sprintf("Score: %v, A Records: %s, Categories: %s",
-							reply.URLs[i].XFE.URLDetails.Score,
-							strings.Join(reply.URLs[i].XFE.Resolve.A, ","),
-							joinMap(reply.URLs[i].XFE.URLDetails.Cats)),
-						"color":      xfeColor,
-						"title":      "IBM X-Force Exchange",
-						"title_link": fmt.Sprintf("https://exchange.xforce.ibmcloud.com/url/%s", reply.URLs[i].Details),
-						"fields": []map[string]interface{}{
-							{"title": "Score", "value": fmt.Sprintf("%v", reply.URLs[i].XFE.URLDetails.Score), "short": true},
-							{"title": "A Records", "value": strings.Join(reply.URLs[i].XFE.Resolve.A, ","), "short": true},
-							{"title": "Categories", "value": joinMap(reply.URLs[i].XFE.URLDetails.Cats), "short": true},
-						},
-					})
-					if len(reply.URLs[i].XFE.Resolve.AAAA) > 0 {
-						attachments[len(attachments)-1]["fields"] = append(attachments[len(attachments)-1]["fields"].([]map[string]interface{}),
-							map[string]interface{}{"title": "A Records", "value": strings.Join(reply.URLs[i].XFE.Resolve.AAAA, ","), "short": true})
-					}
-				}
-				if reply.URLs[i].VT.URLReport.ResponseCode == 1 {
-					vtColor := "good"
-					if reply.URLs[i].VT.URLReport.Positives >= numOfPositivesToConvict {
-						vtColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback":   fmt.Sprintf("Scan Date: %s, Positives: %v, Total: %v", reply.URLs[i].VT.URLReport.ScanDate, reply.URLs[i].VT.URLReport.Positives, reply.URLs[i].VT.URLReport.Total),
-						"color":      vtColor,
-						"title":      "VirusTotal",
-						"title_link": reply.URLs[i].VT.URLReport.Permalink,
-						"fields": []map[string]interface{}{
-							{"title": "Scan Date", "value": reply.URLs[i].VT.URLReport.ScanDate, "short": true},
-							{"title": "Positives", "value": fmt.Sprintf("%v", reply.URLs[i].VT.URLReport.Positives), "short": true},
-							{"title": "Total", "value": fmt.Sprintf("%v", reply.URLs[i].VT.URLReport.Total), "short": true},
-						},
-					})
-				}
-			}
+		findings := replyFindings(sub.team.Locale, reply, link, verbose)
+		// Let the user know we did not check everything even if what we checked is clean
+		shouldPost := verbose || !clean(findings) || reply.Skipped > 0 || reply.Truncated
+		// The channel threshold overrides the verbose setting
+		switch sub.configuration.Threshold(data.Channel) {
+		case domain.ThresholdAll:
+			shouldPost = true
+		case domain.ThresholdSuspicious:
+			shouldPost = !clean(findings) || reply.Skipped > 0 || reply.Truncated
+		case domain.ThresholdMalicious:
+			shouldPost = reply.Verdict() == domain.ResultDirty
 		}
-		for i := range reply.IPs {
-			color := "warning"
-			comment := ipCommentWarning
-			if reply.IPs[i].Private {
-				color = "good"
-				comment = ipCommentPrivate
-			} else if reply.IPs[i].Result == domain.ResultDirty {
-				color = "danger"
-				comment = ipCommentBad
-			} else if reply.IPs[i].Result == domain.ResultClean {
-				color = "good"
-				comment = ipCommentGood
-			}
-			ipMessage := fmt.Sprintf(comment, reply.IPs[i].Details, fmt.Sprintf("<%s&text=%s|Details>", link, url.QueryEscape(reply.IPs[i].Details)))
-			if verbose || color != "good" {
-				attachments = append(attachments, map[string]interface{}{
-					"fallback": ipMessage,
-					"text":     ipMessage,
-					"color":    color,
-				})
-			}
-			if verbose {
-				if !reply.IPs[i].XFE.NotFound && reply.IPs[i].XFE.Error == "" {
-					xfeColor := "good"
-					if reply.IPs[i].XFE.IPReputation.Score >= xfeScoreToConvict {
-						xfeColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback": fmt.Sprintf("Score: %v, Categories: %s, Geo: %v",
-							reply.IPs[i].XFE.IPReputation.Score, joinMapInt(reply.IPs[i].XFE.IPReputation.Cats), nilOrUnknown(reply.IPs[i].XFE.IPReputation.Geo["country"])),
-						"color":      xfeColor,
-						"title":      "IBM X-Force Exchange",
-						"title_link": fmt.Sprintf("https://exchange.xforce.ibmcloud.com/ip/%s", reply.IPs[i].Details),
-						"fields": []map[string]interface{}{
-							{"title": "Score", "value": fmt.Sprintf("%v", reply.IPs[i].XFE.IPReputation.Score), "short": true},
-							{"title": "Categories", "value": joinMapInt(reply.IPs[i].XFE.IPReputation.Cats), "short": true},
-							{"title": "Geo", "value": nilOrUnknown(reply.IPs[i].XFE.IPReputation.Geo["country"]), "short": true},
-						},
-					})
-				}
-				if reply.IPs[i].VT.IPReport.ResponseCode == 1 {
-					var vtPositives uint16
-					listOfURLs := ""
-					now := time.Now()
-					detectedURLs := reply.IPs[i].VT.IPReport.DetectedUrls
-					sort.Sort(sort.Reverse(IPByDate(detectedURLs)))
-					for j := range detectedURLs {
-						t, err := time.Parse("2006-01-02 15:04:05", detectedURLs[j].ScanDate)
-						if err != nil {
-							logrus.Debugf("Error parsing scan date - %v", err)
-							continue
-						}
-						if detectedURLs[j].Positives > vtPositives && t.Add(365*24*time.Hour).After(now) {
-							vtPositives = detectedURLs[j].Positives
-						}
-						if j < 20 {
-							listOfURLs += fmt.Sprintf("URL: %s, Positives: %v, Total: %v, Date: %s", defangURL(detectedURLs[j].Url), detectedURLs[j].Positives, detectedURLs[j].Total, detectedURLs[j].ScanDate) + "\n"
-						}
-					}
-					vtColor := "good"
-					if vtPositives >= numOfPositivesToConvict {
-						vtColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback":   listOfURLs,
-						"text":       listOfURLs,
-						"color":      vtColor,
-						"title":      "VirusTotal",
-						"title_link": "https://www.virustotal.com/en/search?query=" + reply.IPs[i].Details,
-					})
-				}
+		// The message we posted for the earlier replies gets the rest of the results whatever they are
+		channel, ts := b.pending.message(posted)
+		shouldPost = shouldPost || data.Rescan || data.Mention || ts != ""
+		if shouldPost {
+			var notes []string
+			if reply.Pending > 0 {
+				notes = append(notes, sub.msg("pending", msgArgs{"Pending": reply.Pending, "Total": reply.Results()}))
 			}
-		}
-		// We will handle hashes only for verbose channels
-		if verbose {
-			for i := range reply.Hashes {
-				color := "warning"
-				comment := hashCommentWarning
-				if reply.Hashes[i].Result == domain.ResultDirty {
-					color = "danger"
-					comment = hashCommentBad
-				} else if reply.Hashes[i].Result == domain.ResultClean {
-					color = "good"
-					comment = hashCommentGood
-				}
-				hashMessage := fmt.Sprintf(comment, reply.Hashes[i].Details, fmt.Sprintf("<%s&text=%s|Details>", link, url.QueryEscape(reply.Hashes[i].Details)))
-				attachments = append(attachments, map[string]interface{}{
-					"fallback": hashMessage,
-					"text":     hashMessage,
-					"color":    color,
-				})
-				if reply.Hashes[i].Cy.Error == "" && reply.Hashes[0].Cy.Result.StatusCode == 1 {
-					cyColor := "good"
-					if reply.Hashes[0].Cy.Result.GeneralScore < cyScoreToConvict {
-						cyColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback":   fmt.Sprintf("Score: %v, Classifiers: %v", reply.Hashes[0].Cy.Result.GeneralScore, reply.Hashes[0].Cy.Result.Classifiers),
-						"color":      cyColor,
-						"title":      "Cylance Infinity",
-						"title_link": "https://www.cylance.com",
-						"fields": []map[string]interface{}{
-							{"title": "Score", "value": fmt.Sprintf("%v", reply.Hashes[0].Cy.Result.GeneralScore), "short": true},
-							{"title": "Classifiers", "value": joinMapFloat32(reply.Hashes[0].Cy.Result.Classifiers), "short": true},
-						},
-					})
-				}
-				if !reply.Hashes[i].XFE.NotFound && reply.Hashes[i].XFE.Error == "" {
-					xfeColor := "good"
-					if len(reply.Hashes[i].XFE.Malware.Family) > 0 || len(reply.Hashes[i].XFE.Malware.Origins.External.Family) > 0 {
-						xfeColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback":   fmt.Sprintf("Mime Type: %s, Family: %s", reply.Hashes[i].XFE.Malware.MimeType, strings.Join(reply.Hashes[i].XFE.Malware.Family, ",")),
-						"color":      xfeColor,
-						"title":      "IBM X-Force Exchange",
-						"title_link": fmt.Sprintf("https://exchange.xforce.ibmcloud.com/malware/%s", reply.Hashes[i].Details),
-						"fields": []map[string]interface{}{
-							{"title": "Family", "value": strings.Join(reply.Hashes[i].XFE.Malware.Family, ","), "short": true},
-							{"title": "MIME Type", "value": reply.Hashes[i].XFE.Malware.MimeType, "short": true},
-							{"title": "Created", "value": reply.Hashes[i].XFE.Malware.Created.String(), "short": true},
-						},
-					})
-				}
-				if reply.Hashes[i].VT.FileReport.ResponseCode == 1 {
-					vtColor := "good"
-					if reply.Hashes[i].VT.FileReport.Positives >= numOfPositivesToConvictForFiles {
-						vtColor = "danger"
-					}
-					attachments = append(attachments, map[string]interface{}{
-						"fallback":   fmt.Sprintf("Scan Date: %s, Positives: %v, Total: %v", reply.Hashes[i].VT.FileReport.ScanDate, reply.Hashes[i].VT.FileReport.Positives, reply.Hashes[i].VT.FileReport.Total),
-						"color":      vtColor,
-						"title":      "VirusTotal",
-						"title_link": reply.Hashes[i].VT.FileReport.Permalink,
-						"fields": []map[string]interface{}{
-							{"title": "Scan Date", "value": reply.Hashes[i].VT.FileReport.ScanDate, "short": true},
-							{"title": "Positives", "value": fmt.Sprintf("%v", reply.Hashes[i].VT.FileReport.Positives), "short": true},
-							{"title": "Total", "value": fmt.Sprintf("%v", reply.Hashes[i].VT.FileReport.Total), "short": true},
-						},
-					})
-				}
+			if reply.Truncated {
+				notes = append(notes, sub.msg("truncated", nil))
 			}
-		}
-		clean := true
-		if !verbose {
-			for i := range attachments {
-				if attachments[i]["color"] != "good" {
-					clean = false
-					break
+			if reply.Skipped > 0 {
+				notes = append(notes, sub.msg("skipped", msgArgs{"Count": reply.Skipped}))
+			}
+			quote := ""
+			if data.Attachment > 0 && reply.Quote != "" {
+				quote = fmt.Sprintf("From attachment #%d:\n>%s", data.Attachment, strings.Replace(reply.Quote, "\n", "\n>", -1))
+			}
+			blocks := replyBlocks(sub.team.Locale, findings, quote, notes, verbose, link)
+			// The full report is uploaded once, with the last reply
+			if reply.Pending == 0 {
+				blocks = b.oversized(blocks, findings, quote, notes, link, data, sub)
+			}
+			setReply(postMessage, b.compactDetails(blocks, reply, sub, verbose), findings, sub.configuration)
+			if ts != "" {
+				outcome = "updated"
+				err = b.update(postMessage, channel, ts, data, sub)
+			} else {
+				var res slack.Response
+				res, err = b.post(postMessage, reply, data, sub)
+				if err == nil && posted != nil && reply.Pending > 0 {
+					b.pending.posted(posted, res.S("channel"), res.S("ts"))
 				}
 			}
-		}
-		if verbose || !clean {
-			postMessage["attachments"] = attachments
-			err = b.post(postMessage, reply, data, sub)
 			if err != nil {
-				logrus.Errorf("Unable to send message to Slack - %v\n", err)
+				outcome = "post_failed"
+				replyLog(reply, data).WithError(err).Error("Unable to send message to Slack")
 				return
 			}
+			b.noteIncident(incident, reply, data, sub)
 		} else {
-			logrus.Debugf("Reply %s clean, ignoring", reply.MessageID)
+			outcome = "below_threshold"
+			replyLog(reply, data).Debug("Reply is below the reply threshold, ignoring")
 		}
 	}
 }
@@ -583,12 +535,23 @@ func (b *Bot) handleReply(reply *domain.WorkReply) {
 // post uses the correct client to post to the channel
 // See if the original message poster is subscribed and if so use him.
 // If not, use the first user we have that is subscribed to the channel.
-func (b *Bot) post(message map[string]interface{}, reply *domain.WorkReply, data *domain.Context, sub *subscription) error {
-	message["text"] = mainMessageFormatted()
+func (b *Bot) post(message map[string]interface{}, reply *domain.WorkReply, data *domain.Context, sub *subscription) (slack.Response, error) {
+	noteRescan(message, data)
 	message["as_user"] = true
-	var err error
-	_, err = sub.s.Do("POST", "chat.postMessage", message)
-	return err
+	if data.ThreadTS != "" {
+		message["thread_ts"] = data.ThreadTS
+	} else if data.TS != "" && (data.Rescan || sub.configuration.IsThreaded(data.Channel)) {
+		message["thread_ts"] = data.TS
+	}
+	return sub.s.PostMessage(message)
+}
+
+// noteRescan says who asked for the re-scan in the text of the message
+func noteRescan(message map[string]interface{}, data *domain.Context) {
+	if data.Rescan {
+		note := fmt.Sprintf("Re-scan requested by <@%s>.", data.User)
+		message["text"] = fmt.Sprintf("%s %v", note, message["text"])
+	}
 }
 
 func parseChannels(sub *subscription, text string, pos int) ([]string, []string, error) {
@@ -633,6 +596,75 @@ func parseChannels(sub *subscription, text string, pos int) ([]string, []string,
 	return parts, channels, nil
 }
 
+// resolveChannels resolves the channel arguments of join, leave and verbose against the conversations.
+// Besides #channel mentions and names, arguments can be comma separated lists, all or glob patterns on the channel
+// name (eng-*). All and patterns select only the conversations accepted by the filter. It returns the IDs in the order
+// they were given and the arguments that did not match any channel.
+func resolveChannels(args []string, conversations []slack.Response, filter func(c slack.Response) bool) ([]string, []string) {
+	var ids, unmatched []string
+	add := func(id string) {
+		if !util.In(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	for _, arg := range args {
+		for _, part := range strings.Split(arg, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if strings.HasPrefix(part, "<#") && strings.HasSuffix(part, ">") {
+				add(strings.Split(part[2:len(part)-1], "|")[0])
+				continue
+			}
+			name := strings.ToLower(strings.TrimPrefix(part, "#"))
+			isPattern := name == "all" || strings.ContainsAny(name, "*?[")
+			found := false
+			for _, c := range conversations {
+				var match bool
+				switch {
+				case name == "all":
+					match = filter(c)
+				case isPattern:
+					ok, err := path.Match(name, strings.ToLower(c.S("name")))
+					match = err == nil && ok && filter(c)
+				default:
+					match = strings.EqualFold(c.S("name"), name)
+				}
+				if match {
+					add(c.S("id"))
+					found = true
+				}
+			}
+			if !found {
+				unmatched = append(unmatched, part)
+			}
+		}
+	}
+	return ids, unmatched
+}
+
+// isMember selects the conversations we are in - the ones we monitor
+func isMember(c slack.Response) bool {
+	return c.B("is_member")
+}
+
+// channelNames returns #name for each of the channel IDs
+func channelNames(ids []string, conversations []slack.Response) []string {
+	var names []string
+	for _, id := range ids {
+		name := "<#" + id + ">"
+		for _, c := range conversations {
+			if c.S("id") == id {
+				name = "#" + c.S("name")
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
 func (b *Bot) joinChannels(team, text, channel string, sub *subscription) {
 	postMessage := map[string]interface{}{
 		"channel": channel,
@@ -640,256 +672,1327 @@ func (b *Bot) joinChannels(team, text, channel string, sub *subscription) {
 	}
 	users, err := b.r.TeamMembers(sub.team.ID)
 	if err != nil {
-		logrus.Warnf("Unable to retrieve team members - %v", err)
+		teamLog(team, channel).WithError(err).Warn("Unable to retrieve team members")
 		return
 	}
-	parts, incomingChannels, err := parseChannels(sub, text, 1)
 	ch, err := sub.s.Conversations("")
 	if err != nil {
-		logrus.WithError(err).Warn("Error retrieving my channels")
-		postMessage["text"] = "Error retrieving current configuration. Rest assured we are looking into the issue."
+		teamLog(team, channel).WithError(err).Warn("Error retrieving my channels")
+		postMessage["text"] = sub.msg("config_error", nil)
 	} else {
-		var channels []string
-		var channelFound bool
+		ids, unmatched := resolveChannels(strings.Fields(text)[1:], ch, func(c slack.Response) bool { return !c.B("is_member") })
+		var channels, already []string
+		var channelFound, included bool
+		// The messages are dispatched with the configuration while we change it so we change a copy and swap it in
+		configuration := sub.configuration.Clone()
 	usersLoop:
 		for i := range users {
 			if users[i].Status == domain.UserStatusActive {
 				s := &slack.Client{Token: users[i].Token}
-				if err != nil {
-					logrus.Infof("Error creating Slack client for user %s (%s) - %v\n", users[i].ID, users[i].Name, err)
-					continue
-				}
 				for _, c := range ch {
-					if !c.B("is_member") && !util.In(channels, c.S("name")) &&
-						(strings.ToLower(parts[1]) == "all" || util.In(incomingChannels, c.S("id"))) {
-						channelFound = true
-						_, err = s.Do("POST", "conversations.invite", map[string]interface{}{
-							"channel": c.S("id"),
-							"users":   sub.team.BotUserID,
-						})
-						if err != nil {
-							logrus.Infof("Error inviting us - %v\n", err)
-							continue usersLoop
-						}
-						channels = append(channels, c.S("name"))
+					if !util.In(ids, c.S("id")) || util.In(channels, c.S("name")) || util.In(already, c.S("name")) {
+						continue
+					}
+					if c.B("is_member") {
+						already = append(already, c.S("name"))
+						included = configuration.AddChannel(c.S("id")) || included
+						continue
+					}
+					channelFound = true
+					_, err = s.Do("POST", "conversations.invite", map[string]interface{}{
+						"channel": c.S("id"),
+						"users":   sub.team.BotUserID,
+					})
+					if err != nil {
+						teamLog(team, channel).WithError(err).Info("Error inviting us")
+						continue usersLoop
+					}
+					channels = append(channels, c.S("name"))
+					included = configuration.AddChannel(c.S("id")) || included
+					// Joining an excluded channel explicitly lets us join it on our own again
+					if index := util.Index(configuration.ExcludedChannels, c.S("id")); index >= 0 {
+						configuration.ExcludedChannels = append(configuration.ExcludedChannels[:index], configuration.ExcludedChannels[index+1:]...)
+						included = true
 					}
 				}
 				break
 			}
 		}
-		if len(channels) > 0 {
-			text := fmt.Sprintf("I've started monitoring the following channels: %s", strings.Join(channels, ", "))
-			postMessage["text"] = text
-		} else {
-			if channelFound {
-				postMessage["text"] = "I could not invite myself to the public channels, rest assured we are looking into the issue."
-			} else {
-				postMessage["text"] = "I was already monitoring all public channels but thanks for thinking of me."
+		var lines []string
+		if included {
+			if err = b.setConfiguration(sub, configuration); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error storing configuration")
+				lines = append(lines, sub.msg("config_save_error", nil))
+			} else if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
 			}
 		}
+		if len(channels) > 0 {
+			lines = append(lines, sub.msg("join_started", msgArgs{"Channels": strings.Join(channels, ", ")}))
+		} else if channelFound {
+			lines = append(lines, sub.msg("join_invite_failed", nil))
+		}
+		if len(already) > 0 {
+			lines = append(lines, sub.msg("join_already", msgArgs{"Channels": strings.Join(already, ", ")}))
+		}
+		if len(unmatched) > 0 {
+			lines = append(lines, sub.msg("channels_unmatched", msgArgs{"Channels": strings.Join(unmatched, ", ")}))
+		}
+		if len(lines) == 0 {
+			lines = append(lines, sub.msg("join_nothing", nil))
+		}
+		postMessage["text"] = strings.Join(lines, "\n")
 	}
 	_, err = sub.s.Do("POST", "chat.postMessage", postMessage)
 	if err != nil {
-		logrus.Warnf("Error posting config message - %v", err)
+		teamLog(team, channel).WithError(err).Warn("Error posting config message")
 	}
 }
 
-func (b *Bot) handleVerbose(team, text, channel string, sub *subscription) {
+// leaveChannels stops monitoring the given channels - we remove them from the configuration and leave them
+func (b *Bot) leaveChannels(team, text, channel string, sub *subscription) {
 	postMessage := map[string]interface{}{
 		"channel": channel,
 		"as_user": true,
 	}
-	changed := false
-	parts, channels, err := parseChannels(sub, text, 2)
+	ch, err := sub.s.Conversations("public_channel,private_channel")
 	if err != nil {
-		postMessage["text"] = "I could not understand your command. Verbose command is:\nverbose on #channel1,#channel2 - to turn on verbose mode on for a list of channels.\nverbose off #channel1,#channel2 - to turn off verbose mode on for a list of channels."
-	} else {
-		for _, ch := range channels {
-			if ch == "" {
-				continue
+		teamLog(team, channel).WithError(err).Warn("Error retrieving my channels")
+	}
+	incomingChannels, unmatched := resolveChannels(strings.Fields(text)[1:], ch, isMember)
+	if len(incomingChannels) == 0 && len(unmatched) == 0 {
+		postMessage["text"] = sub.msg("leave_usage", nil)
+		if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting config message")
+		}
+		return
+	}
+	conversations := make(map[string]slack.Response)
+	for _, c := range ch {
+		conversations[c.S("id")] = c
+	}
+	var removed, notMonitored, failed []string
+	changed := false
+	// The messages are dispatched with the configuration while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	for _, id := range incomingChannels {
+		name, member := id, false
+		if conversation, ok := conversations[id]; ok {
+			name, member = "#"+conversation.S("name"), conversation.B("is_member")
+		}
+		configured := false
+		for _, list := range []*[]string{&c.Channels, &c.Groups, &c.VerboseChannels, &c.VerboseGroups} {
+			if index := util.Index(*list, id); index >= 0 {
+				*list = append((*list)[:index], (*list)[index+1:]...)
+				configured = true
 			}
-			if strings.ToLower(parts[1]) == "on" {
-				if ch[0] == 'C' {
-					if !util.In(sub.configuration.VerboseChannels, ch) {
-						sub.configuration.VerboseChannels = append(sub.configuration.VerboseChannels, ch)
-						changed = true
-					}
-				} else if ch[0] == 'G' {
-					if !util.In(sub.configuration.VerboseGroups, ch) {
-						sub.configuration.VerboseGroups = append(sub.configuration.VerboseGroups, ch)
-						changed = true
-					}
-				}
-			} else if strings.ToLower(parts[1]) == "off" {
-				if ch[0] == 'C' {
-					if util.In(sub.configuration.VerboseChannels, ch) {
-						index := util.Index(sub.configuration.VerboseChannels, ch)
-						if index >= 0 {
-							sub.configuration.VerboseChannels = sub.configuration.VerboseChannels[:index+copy(sub.configuration.VerboseChannels[index:], sub.configuration.VerboseChannels[index+1:])]
-						}
-						changed = true
-					}
-				} else if ch[0] == 'G' {
-					if util.In(sub.configuration.VerboseGroups, ch) {
-						index := util.Index(sub.configuration.VerboseGroups, ch)
-						if index >= 0 {
-							sub.configuration.VerboseGroups = sub.configuration.VerboseGroups[:index+copy(sub.configuration.VerboseGroups[index:], sub.configuration.VerboseGroups[index+1:])]
-						}
-						changed = true
-					}
-				}
+		}
+		// Otherwise the all public channels mode or the channel patterns join it again
+		if (c.AllPublicChannels || c.MatchesChannelPattern(name)) && id[0] == 'C' && !c.IsExcluded(id) {
+			c.ExcludedChannels = append(c.ExcludedChannels, id)
+			configured = true
+		}
+		changed = changed || configured
+		if member {
+			if _, err = sub.s.Do("POST", "conversations.leave", map[string]interface{}{"channel": id}); err != nil {
+				teamLog(team, id).WithError(err).Info("Error leaving channel")
+				failed = append(failed, name)
+				continue
 			}
 		}
+		if configured || member {
+			removed = append(removed, name)
+		} else {
+			notMonitored = append(notMonitored, name)
+		}
 	}
+	var lines []string
 	if changed {
-		err := b.r.SetChannelsAndGroups(sub.configuration)
-		if err != nil {
-			logrus.WithError(err).Warnf("error storing verbose configuration for team %s", team)
-			postMessage["text"] = "I had an issue saving the verbose state."
-		} else {
-			postMessage["text"] = "Verbose state was changed."
-			if err = b.q.PushConf(team); err != nil {
-				logrus.WithError(err).Warnf("error pushing configuration message for %s", team)
-				postMessage["text"] = "I had an issue saving the verbose state."
-			}
+		if err = b.setConfiguration(sub, c); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing configuration")
+			lines = append(lines, sub.msg("config_save_error", nil))
+		} else if err = b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+			lines = append(lines, sub.msg("config_save_error", nil))
 		}
-	} else {
-		postMessage["text"] = "Verbose state did not change - could not find anything new to change"
 	}
+	if len(removed) > 0 {
+		lines = append(lines, sub.msg("leave_stopped", msgArgs{"Channels": strings.Join(removed, ", ")}))
+	}
+	if len(failed) > 0 {
+		lines = append(lines, sub.msg("leave_failed", msgArgs{"Channels": strings.Join(failed, ", ")}))
+	}
+	if len(notMonitored) > 0 {
+		lines = append(lines, sub.msg("leave_unmonitored", msgArgs{"Channels": strings.Join(notMonitored, ", ")}))
+	}
+	if len(unmatched) > 0 {
+		lines = append(lines, sub.msg("channels_unmatched", msgArgs{"Channels": strings.Join(unmatched, ", ")}))
+	}
+	postMessage["text"] = strings.Join(lines, "\n")
 	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
-		logrus.WithError(err).Warnf("error posting config message to Slack for team [%s] on channel [%s]", team, channel)
+		teamLog(team, channel).WithError(err).Warn("Error posting config message")
 	}
 }
 
-func (b *Bot) handleConfig(team string, msg slack.Response, sub *subscription) {
+func (b *Bot) handleVerbose(team, text, channel string, sub *subscription) {
+	fields := strings.Fields(text)
+	if len(fields) > 1 && strings.ToLower(fields[1]) == "thread" {
+		b.handleThread(team, strings.Join(fields, " "), channel, sub)
+		return
+	}
+	// An optional threshold after the channels sets when we reply on them
+	threshold := ""
+	if len(fields) > 3 {
+		if last := strings.ToLower(fields[len(fields)-1]); domain.ValidThreshold(last) || last == "default" {
+			threshold, fields = last, fields[:len(fields)-1]
+		}
+	}
 	postMessage := map[string]interface{}{
-		"channel": msg.S("channel"),
+		"channel": channel,
 		"as_user": true,
 	}
-	ch, err := sub.s.Conversations("public_channel,private_channel")
+	// The state can come before or after the channels - verbose on #a,#b or verbose eng-* on
+	var state string
+	var args []string
+	switch {
+	case len(fields) < 3:
+	case strings.EqualFold(fields[1], "on") || strings.EqualFold(fields[1], "off"):
+		state, args = strings.ToLower(fields[1]), fields[2:]
+	case strings.EqualFold(fields[len(fields)-1], "on") || strings.EqualFold(fields[len(fields)-1], "off"):
+		state, args = strings.ToLower(fields[len(fields)-1]), fields[1:len(fields)-1]
+	}
+	if state == "" {
+		postMessage["text"] = sub.msg("verbose_usage", nil)
+		if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+		}
+		return
+	}
+	conversations, err := sub.s.Conversations("public_channel,private_channel")
 	if err != nil {
-		logrus.Warnf("Error retrieving my channels - %v", err)
-		postMessage["text"] = "Error retrieving configuration. Rest assured we are looking into the issue."
-	} else {
-		var channels []string
-		var verboseChannels []string
-		var groups []string
-		var verboseGroups []string
-		for _, c := range ch {
-			if c.B("is_member") {
-				if sub.configuration.IsVerbose(c.S("id")) {
-					if c.B("is_channel") {
-						verboseChannels = append(verboseChannels, c.S("name"))
-					} else {
-						verboseGroups = append(verboseGroups, c.S("name"))
-					}
-				} else {
-					if c.B("is_channel") {
-						channels = append(channels, c.S("name"))
-					} else {
-						groups = append(groups, c.S("name"))
-					}
-				}
-			}
+		teamLog(team, channel).WithError(err).Warn("Error retrieving my channels")
+		postMessage["text"] = sub.msg("config_error", nil)
+		if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
 		}
-		text := fmt.Sprintf("Channels I'm monitoring: %s", strings.Join(channels, ", "))
-		if len(verboseChannels) > 0 {
-			text = text + fmt.Sprintf("\nChannels I'm monitoring and providing extra info: %s", strings.Join(verboseChannels, ", "))
+		return
+	}
+	channels, unmatched := resolveChannels(args, conversations, isMember)
+	// The replies read the configuration while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	var changed, unchanged []string
+	for _, ch := range channels {
+		if ch == "" || ch[0] != 'C' && ch[0] != 'G' {
+			continue
 		}
-		if len(groups) > 0 {
-			text = text + fmt.Sprintf("\nPrivate channels I'm monitoring: %s", strings.Join(groups, ", "))
+		chChanged := false
+		switch {
+		case threshold == "default" && c.Threshold(ch) != "":
+			delete(c.ReplyThreshold, ch)
+			chChanged = true
+		case domain.ValidThreshold(threshold) && c.Threshold(ch) != threshold:
+			if c.ReplyThreshold == nil {
+				c.ReplyThreshold = make(map[string]string)
+			}
+			c.ReplyThreshold[ch] = threshold
+			chChanged = true
 		}
-		if len(verboseGroups) > 0 {
-			text = text + fmt.Sprintf("\nPrivate channels I'm monitoring and providing extra info: %s", strings.Join(verboseGroups, ", "))
+		list := &c.VerboseChannels
+		if ch[0] == 'G' {
+			list = &c.VerboseGroups
 		}
-		if sub.team.VTKey != "" {
-			l := len(sub.team.VTKey)
-			text = text + "\nUsing your own VirusTotal key ending with " + sub.team.VTKey[l-4:]
+		index := util.Index(*list, ch)
+		if state == "on" && index < 0 {
+			*list = append(*list, ch)
+			chChanged = true
+		} else if state == "off" && index >= 0 {
+			*list = (*list)[:index+copy((*list)[index:], (*list)[index+1:])]
+			chChanged = true
 		}
-		if sub.team.XFEKey != "" {
-			l := len(sub.team.XFEKey)
-			text = text + "\nUsing your own IBM X-Force Exchange key ending with " + sub.team.XFEKey[l-4:]
+		if chChanged {
+			changed = append(changed, ch)
+		} else {
+			unchanged = append(unchanged, ch)
 		}
-		postMessage["text"] = text
 	}
-	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
-		logrus.Warnf("Error posting config message - %v", err)
+	var lines []string
+	if len(changed) > 0 {
+		if err = b.setConfiguration(sub, c); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing verbose configuration")
+			lines = append(lines, sub.msg("verbose_save_error", nil))
+		} else if err = b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+			lines = append(lines, sub.msg("verbose_save_error", nil))
+		} else {
+			lines = append(lines, sub.msg("verbose_changed", msgArgs{"State": state, "Channels": strings.Join(channelNames(changed, conversations), ", "), "Threshold": threshold}))
+		}
+	}
+	if len(unchanged) > 0 {
+		lines = append(lines, sub.msg("verbose_unchanged", msgArgs{"Channels": strings.Join(channelNames(unchanged, conversations), ", ")}))
+	}
+	if len(unmatched) > 0 {
+		lines = append(lines, sub.msg("channels_unmatched", msgArgs{"Channels": strings.Join(unmatched, ", ")}))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, sub.msg("verbose_nothing", nil))
+	}
+	postMessage["text"] = strings.Join(lines, "\n")
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
 	}
 }
 
-func (b *Bot) handleVT(team, text, channel string, sub *subscription) {
+// handleThread turns replying in a thread on or off for the given channels
+func (b *Bot) handleThread(team, text, channel string, sub *subscription) {
 	postMessage := map[string]interface{}{
 		"channel": channel,
 		"as_user": true,
 	}
-	parts := strings.Split(text, " ")
-	if len(parts) == 2 {
-		if parts[1] == "-" {
-			sub.team.VTKey = ""
-			err := b.r.SetTeam(sub.team)
-			if err == nil {
-				postMessage["text"] = "Cleared VT key - using default"
+	changed := false
+	// The replies read the configuration while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	parts, channels, err := parseChannels(sub, text, 3)
+	if err != nil || strings.ToLower(parts[2]) != "on" && strings.ToLower(parts[2]) != "off" {
+		postMessage["text"] = sub.msg("thread_usage", nil)
+	} else {
+		on := strings.ToLower(parts[2]) == "on"
+		for _, ch := range channels {
+			if ch == "" || ch[0] != 'C' && ch[0] != 'G' || c.IsThreaded(ch) == on {
+				continue
+			}
+			if on {
+				c.ReplyInThread = append(c.ReplyInThread, ch)
 			} else {
-				postMessage["text"] = "Error clearing VT key - no worries, we are handling it"
-				logrus.WithError(err).Warnf("Unable to clear VT key for team %s", team)
+				index := util.Index(c.ReplyInThread, ch)
+				c.ReplyInThread = append(c.ReplyInThread[:index], c.ReplyInThread[index+1:]...)
 			}
+			changed = true
+		}
+	}
+	if changed {
+		err := b.setConfiguration(sub, c)
+		if err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing thread configuration")
+			postMessage["text"] = sub.msg("thread_save_error", nil)
 		} else {
-			sub.team.VTKey = parts[1]
-			err := b.r.SetTeam(sub.team)
-			if err == nil {
-				postMessage["text"] = "VT key set."
+			postMessage["text"] = sub.msg("thread_changed", nil)
+			if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+				postMessage["text"] = sub.msg("thread_save_error", nil)
+			}
+		}
+	} else if _, ok := postMessage["text"]; !ok {
+		postMessage["text"] = sub.msg("thread_nothing", nil)
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+	}
+}
+
+// handleMode sets the way we reply on the given channels
+func (b *Bot) handleMode(team, text, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	changed := false
+	// The replies read the configuration while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	parts, channels, err := parseChannels(sub, text, 3)
+	if err != nil || !domain.ValidMode(strings.ToLower(parts[2])) {
+		postMessage["text"] = "I could not understand your command. Config mode command is:\nconfig mode message/reaction/both #channel1,#channel2 - to reply with a message, a reaction on the original message or both."
+	} else {
+		mode := strings.ToLower(parts[2])
+		for _, ch := range channels {
+			if ch == "" || ch[0] != 'C' && ch[0] != 'G' || c.Mode(ch) == mode {
+				continue
+			}
+			if mode == domain.ModeMessage {
+				delete(c.ReplyMode, ch)
 			} else {
-				postMessage["text"] = "Error setting VT key - no worries, we are handling it"
-				logrus.WithError(err).Warnf("Unable to set VT key for team %s", team)
+				if c.ReplyMode == nil {
+					c.ReplyMode = make(map[string]string)
+				}
+				c.ReplyMode[ch] = mode
+			}
+			changed = true
+		}
+	}
+	if changed {
+		err := b.setConfiguration(sub, c)
+		if err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing reply mode")
+			postMessage["text"] = "I had an issue saving the reply mode."
+		} else {
+			postMessage["text"] = "Reply mode was changed."
+			if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+				postMessage["text"] = "I had an issue saving the reply mode."
+			}
+		}
+	} else if _, ok := postMessage["text"]; !ok {
+		postMessage["text"] = "Reply mode did not change - could not find anything new to change"
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+	}
+}
+
+func (b *Bot) handleConfig(team string, msg slack.Response, sub *subscription) {
+	channel := msg.S("channel")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	ch, err := sub.s.Conversations("public_channel,private_channel")
+	if err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error retrieving my channels")
+		postMessage["text"] = "Error retrieving configuration. Rest assured we are looking into the issue."
+	} else {
+		var channels []string
+		var verboseChannels []string
+		var groups []string
+		var verboseGroups []string
+		var threaded []string
+		var botScanned []string
+		var thresholds []string
+		var modes []string
+		var muted []string
+		for _, c := range ch {
+			if c.B("is_member") && sub.configuration.IsMuted(c.S("id")) {
+				muted = append(muted, fmt.Sprintf("%s (until %s UTC)", c.S("name"), sub.configuration.Muted[c.S("id")].UTC().Format("Jan 2 15:04")))
+			}
+			if c.B("is_member") && sub.configuration.Mode(c.S("id")) != domain.ModeMessage {
+				modes = append(modes, c.S("name")+" ("+sub.configuration.Mode(c.S("id"))+")")
+			}
+			if c.B("is_member") && sub.configuration.Threshold(c.S("id")) != "" {
+				thresholds = append(thresholds, c.S("name")+" ("+sub.configuration.Threshold(c.S("id"))+")")
+			}
+			if c.B("is_member") && sub.configuration.IsThreaded(c.S("id")) {
+				threaded = append(threaded, c.S("name"))
+			}
+			if c.B("is_member") && sub.configuration.ScansBotMessages(c.S("id")) {
+				botScanned = append(botScanned, c.S("name"))
+			}
+			if c.B("is_member") {
+				if sub.configuration.IsVerbose(c.S("id")) {
+					if c.B("is_channel") {
+						verboseChannels = append(verboseChannels, c.S("name"))
+					} else {
+						verboseGroups = append(verboseGroups, c.S("name"))
+					}
+				} else {
+					if c.B("is_channel") {
+						channels = append(channels, c.S("name"))
+					} else {
+						groups = append(groups, c.S("name"))
+					}
+				}
+			}
+		}
+		text := fmt.Sprintf("Channels I'm monitoring: %s", strings.Join(channels, ", "))
+		if sub.configuration.AllPublicChannels {
+			text = text + "\nI join all public channels, including new ones"
+			if excluded := channelNames(sub.configuration.ExcludedChannels, ch); len(excluded) > 0 {
+				text = text + fmt.Sprintf(" except: %s", strings.Join(excluded, ", "))
+			}
+		}
+		if len(sub.configuration.ChannelPatterns) > 0 {
+			text = text + fmt.Sprintf("\nI monitor channels matching: %s", strings.Join(sub.configuration.ChannelPatterns, ", "))
+		}
+		if sub.configuration.AutoMonitorOnInvite {
+			text = text + "\nChannels I'm invited to are added to the configuration"
+		}
+		if len(verboseChannels) > 0 {
+			text = text + fmt.Sprintf("\nChannels I'm monitoring and providing extra info: %s", strings.Join(verboseChannels, ", "))
+		}
+		if len(groups) > 0 {
+			text = text + fmt.Sprintf("\nPrivate channels I'm monitoring: %s", strings.Join(groups, ", "))
+		}
+		if len(verboseGroups) > 0 {
+			text = text + fmt.Sprintf("\nPrivate channels I'm monitoring and providing extra info: %s", strings.Join(verboseGroups, ", "))
+		}
+		if len(threaded) > 0 {
+			text = text + fmt.Sprintf("\nChannels where I reply in a thread: %s", strings.Join(threaded, ", "))
+		}
+		if len(botScanned) > 0 {
+			text = text + fmt.Sprintf("\nChannels where I check messages posted by other bots: %s", strings.Join(botScanned, ", "))
+		}
+		if len(thresholds) > 0 {
+			text = text + fmt.Sprintf("\nChannels where I reply only above a threshold: %s", strings.Join(thresholds, ", "))
+		}
+		if len(modes) > 0 {
+			text = text + fmt.Sprintf("\nChannels where I react on the original message: %s", strings.Join(modes, ", "))
+		}
+		if len(muted) > 0 {
+			text = text + fmt.Sprintf("\nMuted channels: %s", strings.Join(muted, ", "))
+		}
+		if sub.configuration.DigestChannel != "" {
+			text = text + fmt.Sprintf("\nDaily digest: <#%s> at %d:00 %s", sub.configuration.DigestChannel, sub.configuration.DigestHour, sub.configuration.DigestTimezone)
+		}
+		if sub.configuration.DisableWeeklyReport {
+			text = text + "\nWeekly report to the configuration admins is off"
+		}
+		creds := sub.team.Credentials()
+		for _, source := range domain.Sources {
+			if key := creds[source].Key; len(key) >= 4 {
+				text = text + fmt.Sprintf("\nUsing your own %s key ending with %s", scannerTitle(source), key[len(key)-4:])
 			}
 		}
+		postMessage["text"] = text
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message")
+	}
+}
+
+// handleStatus shows what we monitor for the team and how many messages we handled since the last statistics flush
+func (b *Bot) handleStatus(team, channel, thread string, sub *subscription) {
+	// Gather everything under the read lock and post after releasing it
+	b.mu.RLock()
+	c := sub.configuration
+	var monitored []string
+	if c.All {
+		monitored = append(monitored, "All channels")
+	}
+	if c.AllPublicChannels {
+		monitored = append(monitored, "All public channels")
+	}
+	for _, ch := range append(append(append(append([]string{}, c.Channels...), c.Groups...), c.VerboseChannels...), c.VerboseGroups...) {
+		monitored = append(monitored, "<#"+ch+">")
+	}
+	if c.IM || c.VerboseIM {
+		monitored = append(monitored, "Direct messages")
+	}
+	if c.Regexp != "" {
+		monitored = append(monitored, "Channels matching "+c.Regexp)
+	}
+	for _, p := range c.ChannelPatterns {
+		monitored = append(monitored, "Channels matching "+p)
+	}
+	loaded, hasVT, hasXFE, t := sub.ts, sub.team.VTKey != "", sub.team.XFEKey != "", sub.team
+	b.mu.RUnlock()
+	sources := "Unknown"
+	if breakers, err := b.SourceBreakers(t); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Unable to load the breakers of the sources")
 	} else {
-		postMessage["text"] = "Sorry, I could not understand you."
+		sources = breakersText(breakers, time.Now())
+	}
+	var messages int64
+	b.smu.Lock()
+	if stats, ok := b.stats[team]; ok {
+		messages = stats.Messages
+	}
+	b.smu.Unlock()
+	latency := "No replies in the last hour"
+	if p50, p95, count := b.ReplyLatency(team); count > 0 {
+		latency = fmt.Sprintf("p50 %v, p95 %v (%d replies)", p50.Round(100*time.Millisecond), p95.Round(100*time.Millisecond), count)
+	}
+	if len(monitored) == 0 {
+		monitored = append(monitored, "Nothing - invite me to a channel or use the join command")
+	}
+	keyState := func(own bool) string {
+		if own {
+			return "Your own key"
+		}
+		return "Default (rate limited)"
 	}
+	fields := []map[string]interface{}{
+		{"title": "Monitoring", "value": strings.Join(monitored, ", "), "short": false},
+		{"title": "Configuration loaded", "value": loaded.UTC().Format(time.RFC1123), "short": true},
+		{"title": "Messages since last flush", "value": fmt.Sprintf("%d", messages), "short": true},
+		{"title": "Reply time in the last hour", "value": latency, "short": true},
+		{"title": "VirusTotal", "value": keyState(hasVT), "short": true},
+		{"title": "IBM X-Force Exchange", "value": keyState(hasXFE), "short": true},
+		{"title": "Sources", "value": sources, "short": false},
+	}
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+		"text":    "I'm connected and monitoring your team.",
+		"attachments": []map[string]interface{}{{
+			"fallback": fmt.Sprintf("Monitoring: %s. Messages since last flush: %d", strings.Join(monitored, ", "), messages),
+			"color":    "good",
+			"title":    "DBot status",
+			"fields":   fields,
+		}},
+	}
+	inThread(postMessage, thread)
 	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
-		logrus.Warnf("Error posting config message - %v", err)
+		teamLog(team, channel).WithError(err).Warn("Error posting status message to Slack")
 	}
 }
 
-func (b *Bot) handleXFE(team, text, channel string, sub *subscription) {
+// handleStats shows the statistics of the team or of a single channel for today and the last week
+func (b *Bot) handleStats(team, channel, text string, sub *subscription) {
 	postMessage := map[string]interface{}{
 		"channel": channel,
 		"as_user": true,
 	}
-	parts := strings.Split(text, " ")
-	if len(parts) == 2 && parts[1] == "-" || len(parts) == 3 && parts[1] == "-" {
-		sub.team.XFEKey, sub.team.XFEPass = "", ""
-		err := b.r.SetTeam(sub.team)
+	var target string
+	var err error
+	if len(strings.Fields(text)) > 1 {
+		var channels []string
+		_, channels, err = parseChannels(sub, strings.TrimSpace(text), 1)
+		if err == nil && len(channels) != 1 {
+			err = fmt.Errorf("expected a single channel in '%s'", text)
+		}
+		if err != nil {
+			teamLog(team, channel).WithError(err).Debug("Unable to parse stats channel")
+			postMessage["text"] = "I could not understand your command. Stats command is:\nstats [#channel] - to see what I checked for the whole team or a single channel"
+			if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error posting stats message to Slack")
+			}
+			return
+		}
+		target = channels[0]
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	day, err := b.r.TotalsSince(sub.team.ID, target, today)
+	var week *domain.ChannelStatistics
+	if err == nil {
+		week, err = b.r.TotalsSince(sub.team.ID, target, today.AddDate(0, 0, -6))
+	}
+	checked := "Here is what I checked for you"
+	if target != "" {
+		checked = "Here is what I checked in <#" + target + ">"
+	}
+	switch {
+	case err != nil:
+		teamLog(team, channel).WithError(err).Warn("Unable to load statistics")
+		postMessage["text"] = "Error loading your statistics - no worries, we are handling it"
+	case !week.HasSomething():
+		postMessage["text"] = "I did not see any messages in the last week yet. Statistics are updated every minute."
+	default:
+		postMessage["text"] = checked + " (UTC days, updated every minute):\n" + formatStats(day, week)
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting stats message to Slack")
+	}
+}
+
+// formatStats lays out the statistics of the day and week side by side in a code block
+func formatStats(day, week *domain.ChannelStatistics) string {
+	rows := []struct {
+		title     string
+		day, week int64
+	}{
+		{"Messages", day.Messages, week.Messages},
+		{"URLs", day.URLs, week.URLs},
+		{"IPs", day.IPs, week.IPs},
+		{"Hashes", day.Hashes, week.Hashes},
+		{"Files", day.Files, week.Files},
+		{"Malicious", day.Malicious, week.Malicious},
+	}
+	res := fmt.Sprintf("```\n%-10s %10s %12s\n", "", "Today", "Last 7 days")
+	for _, row := range rows {
+		res += fmt.Sprintf("%-10s %10d %12d\n", row.title, row.day, row.week)
+	}
+	return res + "```"
+}
+
+// maxMute is the longest we allow a channel to be muted, it should not be forgotten forever
+const maxMute = 7 * 24 * time.Hour
+
+// handleMute stops replying on the given channels for the given duration (e.g. mute #channel 2h)
+func (b *Bot) handleMute(team, text, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	fields := strings.Fields(text)
+	var duration time.Duration
+	var err error
+	var channels []string
+	if len(fields) > 2 {
+		duration, err = time.ParseDuration(strings.ToLower(fields[len(fields)-1]))
 		if err == nil {
-			postMessage["text"] = "Cleared XFE key - using default"
+			_, channels, err = parseChannels(sub, strings.Join(fields[:len(fields)-1], " "), 1)
+		}
+	}
+	if len(fields) <= 2 || err != nil || duration <= 0 || duration > maxMute || len(channels) == 0 {
+		postMessage["text"] = "I could not understand your command. Mute command is:\nmute #channel1,#channel2 2h - to stop replying on the channels for a while (e.g. 30m or 2h, up to a week). I will still check the messages."
+	} else {
+		until := time.Now().Add(duration)
+		// The replies read the configuration while we change it so we change a copy and swap it in
+		c := sub.configuration.Clone()
+		if c.Muted == nil {
+			c.Muted = make(map[string]time.Time)
+		}
+		for _, ch := range channels {
+			c.Muted[ch] = until
+		}
+		if err = b.setConfiguration(sub, c); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing mute")
+			postMessage["text"] = "I had an issue saving the mute."
+		} else if err = b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+			postMessage["text"] = "I had an issue saving the mute."
 		} else {
-			postMessage["text"] = "Error clearing XFE key - no worries, we are handling it"
-			logrus.WithError(err).Warnf("Unable to clear XFE key for team %s", team)
+			postMessage["text"] = fmt.Sprintf("Muted until %s UTC. Use unmute to reply again sooner.", until.UTC().Format("Jan 2 15:04"))
 		}
-	} else if len(parts) == 3 {
-		sub.team.XFEKey, sub.team.XFEPass = parts[1], parts[2]
-		err := b.r.SetTeam(sub.team)
-		if err == nil {
-			postMessage["text"] = "XFE key set."
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+	}
+}
+
+// handleUnmute clears the mute of the given channels
+func (b *Bot) handleUnmute(team, text, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	changed := false
+	// The replies read the configuration while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	_, channels, err := parseChannels(sub, text, 1)
+	if err != nil {
+		postMessage["text"] = "I could not understand your command. Unmute command is:\nunmute #channel1,#channel2 - to reply on the channels again."
+	} else {
+		for _, ch := range channels {
+			if c.IsMuted(ch) {
+				delete(c.Muted, ch)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err = b.setConfiguration(sub, c); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing mute")
+			postMessage["text"] = "I had an issue saving the mute."
+		} else if err = b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+			postMessage["text"] = "I had an issue saving the mute."
+		} else {
+			postMessage["text"] = "Unmuted, I will reply on these channels again."
+		}
+	} else if _, ok := postMessage["text"]; !ok {
+		postMessage["text"] = "These channels were not muted."
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+	}
+}
+
+// refuseConfiguration lets the user know only admins can change the configuration
+func (b *Bot) refuseConfiguration(team, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+		"text": "Sorry, only workspace admins and owners (or users they allowed on the configuration page) can change my configuration. " +
+			"You can still use config, status, stats, scan, vt, xfe and help.",
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+	}
+}
+
+// refuseAdminCommand tells the user that only the workspace admins can run the command
+func (b *Bot) refuseAdminCommand(team, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+		"text":    "Sorry, only workspace admins and owners can see where I saw a value since it covers every channel, including private ones.",
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting refusal message to Slack")
+	}
+}
+
+const (
+	vtUsage  = "I could not understand you. Send *vt* with hashes, URLs, domains or IPs to look them up on VirusTotal, e.g. vt 8.8.8.8 example.com\nTo set your own key use *setkey vt your-key* and *vt -* to return to the default key."
+	xfeUsage = "I could not understand you. Send *xfe* with hashes, URLs, domains or IPs to look them up on IBM X-Force Exchange, e.g. xfe 8.8.8.8 example.com\nTo set your own credentials use *setkey xfe your-key your-password* and *xfe -* to return to the default ones."
+)
+
+// handleVT clears the team key with "vt -"
+func (b *Bot) handleVT(team, text, channel, thread string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	inThread(postMessage, thread)
+	sub.team.VTKey = ""
+	if err := b.r.SetTeam(sub.team); err == nil {
+		postMessage["text"] = "Cleared VT key - using default"
+	} else {
+		postMessage["text"] = "Error clearing VT key - no worries, we are handling it"
+		teamLog(team, channel).WithError(err).Warn("Unable to clear VT key")
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message")
+	}
+}
+
+// handleXFE clears the team credentials with "xfe -"
+func (b *Bot) handleXFE(team, text, channel, thread string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	inThread(postMessage, thread)
+	sub.team.XFEKey, sub.team.XFEPass = "", ""
+	if err := b.r.SetTeam(sub.team); err == nil {
+		postMessage["text"] = "Cleared XFE key - using default"
+	} else {
+		postMessage["text"] = "Error clearing XFE key - no worries, we are handling it"
+		teamLog(team, channel).WithError(err).Warn("Unable to clear XFE key")
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message")
+	}
+}
+
+// keyCheckIP is a well known IP we look up to make sure the reputation services accept a key
+const keyCheckIP = "8.8.8.8"
+
+// keyValidators make a lightweight call to the sources the teams can set their own keys for
+var keyValidators = map[string]func(creds domain.Credentials) error{
+	domain.SourceVT:        validateVTKey,
+	domain.SourceXFE:       validateXFEKey,
+	domain.SourceAbuseIPDB: validateAbuseIPDBKey,
+	domain.SourceOTX:       validateOTXKey,
+	domain.SourceHIBP:      validateHIBPKey,
+}
+
+// ValidateKey checks the source accepts the credentials of a team
+func ValidateKey(source string, creds domain.Credentials) error {
+	validate, ok := keyValidators[source]
+	if !ok {
+		return fmt.Errorf("teams cannot set a key for %s", source)
+	}
+	return validate(creds)
+}
+
+// validateVTKey makes a lightweight call to VirusTotal with the key
+func validateVTKey(creds domain.Credentials) error {
+	vt, err := newVTClient(creds.Key)
+	if err != nil {
+		return err
+	}
+	_, err = vt.GetIpReport(keyCheckIP)
+	return err
+}
+
+// validateXFEKey makes a lightweight call to IBM X-Force Exchange with the credentials
+func validateXFEKey(creds domain.Credentials) error {
+	if creds.Key == "" || creds.Password == "" {
+		return errors.New("IBM X-Force Exchange needs both a key and a password")
+	}
+	xfe, err := newXFEClient(creds.Key, creds.Password)
+	if err != nil {
+		return err
+	}
+	_, err = xfe.IPR(keyCheckIP)
+	return err
+}
+
+// validateAbuseIPDBKey makes a lightweight call to AbuseIPDB with the key. A key out of checks for the day is valid.
+func validateAbuseIPDBKey(creds domain.Credentials) error {
+	s, err := newAbuseIPDBScanner(creds)
+	if err != nil {
+		return err
+	}
+	_, err = s.(*abuseIPDBScanner).check(context.Background(), keyCheckIP)
+	return err
+}
+
+// validateOTXKey makes a lightweight call to OTX with the key
+func validateOTXKey(creds domain.Credentials) error {
+	s, err := newOTXScanner(creds)
+	if err != nil {
+		return err
+	}
+	var general otxGeneral
+	_, err = s.(*otxScanner).get(context.Background(), "/api/v1/indicators/IPv4/"+keyCheckIP+"/general", &general)
+	return err
+}
+
+// keyCheckEmail is the test account of HIBP, it is in breaches on every key
+const keyCheckEmail = "account-exists@hibp-integration-tests.com"
+
+// validateHIBPKey makes a lightweight call to HIBP with the key
+func validateHIBPKey(creds domain.Credentials) error {
+	s, err := newHIBPScanner(creds)
+	if err != nil {
+		return err
+	}
+	_, err = s.(*hibpScanner).breaches(context.Background(), keyCheckEmail)
+	return err
+}
+
+// handleSetKey validates and stores the team's own reputation service keys (setkey vt key / setkey xfe key password /
+// setkey abuseipdb key / setkey otx key / setkey hibp key).
+// The key is never echoed back and we try to delete the message containing it.
+func (b *Bot) handleSetKey(team string, msg slack.Response, sub *subscription) {
+	channel := msg.S("channel")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	fields := strings.Fields(msg.S("text"))
+	source := ""
+	var creds domain.Credentials
+	if len(fields) > 1 {
+		source = strings.ToLower(fields[1])
+	}
+	switch {
+	case len(fields) == 4 && source == domain.SourceXFE:
+		creds = domain.Credentials{Key: fields[2], Password: fields[3]}
+	case len(fields) == 3 && source != domain.SourceXFE && keyValidators[source] != nil:
+		creds = domain.Credentials{Key: fields[2]}
+	default:
+		source = ""
+		postMessage["text"] = "I could not understand your command. Setkey command is:\nsetkey vt your-virustotal-key\nsetkey xfe your-xfe-key your-xfe-password\nsetkey abuseipdb your-abuseipdb-key\nsetkey otx your-otx-key\nsetkey hibp your-hibp-key"
+	}
+	var err error
+	if source != "" {
+		service := scannerTitle(source)
+		if err = ValidateKey(source, creds); err != nil {
+			teamLog(team, channel).WithError(err).Infof("Invalid %s key", service)
+			postMessage["text"] = fmt.Sprintf("%s did not accept the key - please check it and try again. Your current key was not changed.", service)
+		} else if err = b.r.SetTeamCredentials(sub.team.ID, source, creds); err != nil {
+			teamLog(team, channel).WithError(err).Warnf("Unable to set %s key", service)
+			postMessage["text"] = fmt.Sprintf("Error setting the %s key - no worries, we are handling it", service)
 		} else {
-			postMessage["text"] = "Error setting XFE key - no worries, we are handling it"
-			logrus.WithError(err).Warnf("Unable to set XFE key for team %s", team)
+			// New work requests should carry the new key so reload the team here and on the other bots
+			b.subscriptionChanged(team)
+			if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+			}
+			postMessage["text"] = fmt.Sprintf("%s key set.", service)
+		}
+	}
+	// Do not leave the secret in the conversation
+	if len(fields) > 2 {
+		if _, err = sub.s.Do("POST", "chat.delete", map[string]interface{}{"channel": channel, "ts": msg.S("ts")}); err != nil {
+			teamLog(team, channel).WithError(err).Debug("Unable to delete the key message")
+			postMessage["text"] = postMessage["text"].(string) + "\nI could not delete your message - please delete it yourself since it contains the key."
+		}
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message to Slack")
+	}
+}
+
+// handleFP records a verdict the user reported as wrong (fp indicator comment) and whitelists it if asked with --whitelist
+func (b *Bot) handleFP(team string, msg slack.Response, sub *subscription) {
+	channel, user := msg.S("channel"), msg.S("user")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	fields := strings.Fields(msg.S("text"))
+	// Some clients turn -- into a dash
+	whitelist := len(fields) > 2 && (strings.ToLower(fields[len(fields)-1]) == "--whitelist" || strings.ToLower(fields[len(fields)-1]) == "—whitelist")
+	if whitelist {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) < 2 {
+		postMessage["text"] = "I could not understand your command. False positive command is:\nfp indicator optional comment - to let us know we got it wrong.\nfp indicator optional comment --whitelist - to also stop checking it."
+		if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting fp message to Slack")
+		}
+		return
+	}
+	fp := &domain.FalsePositive{Team: sub.team.ID, User: user, Indicator: strings.ToLower(unwrapLink(fields[1])), Comment: strings.Join(fields[2:], " ")}
+	var notes []string
+	switch {
+	case !whitelist:
+	case !b.canConfigure(team, sub, user):
+		notes = append(notes, "Only workspace admins and the users they allow can change the whitelist so I did not whitelist it.")
+	case len(fp.Indicator) > 200:
+		notes = append(notes, "This indicator is too long to whitelist.")
+	case util.In(sub.configuration.Whitelist, fp.Indicator):
+		fp.Whitelisted = true
+		notes = append(notes, fmt.Sprintf("%s is already whitelisted.", fp.Indicator))
+	default:
+		// The indicator extraction reads the whitelist while we change it so we change a copy and swap it in
+		c := sub.configuration.Clone()
+		c.Whitelist = append(c.Whitelist, fp.Indicator)
+		if err := b.setConfiguration(sub, c); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing whitelist")
+			notes = append(notes, "I had an issue saving the whitelist.")
+			break
+		}
+		if err := b.q.PushConf(team); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
 		}
+		fp.Whitelisted = true
+		notes = append(notes, fmt.Sprintf("%s was added to the whitelist.", fp.Indicator))
+	}
+	if err := b.r.StoreFalsePositive(fp); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error storing false positive")
+		notes = append([]string{"I had an issue recording the false positive - no worries, we are handling it."}, notes...)
 	} else {
-		postMessage["text"] = "Sorry, I could not understand you."
+		notes = append([]string{fmt.Sprintf("Thanks, I recorded %s as a false positive so we can review it.", fp.Indicator)}, notes...)
+	}
+	postMessage["text"] = strings.Join(notes, "\n")
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting fp message to Slack")
+	}
+}
+
+func (b *Bot) handleWhitelist(team, text, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	parts := strings.Fields(text)
+	changed := false
+	// The indicator extraction reads the whitelist while we change it so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	switch {
+	case len(parts) == 2 && strings.ToLower(parts[1]) == "list":
+		if len(sub.configuration.Whitelist) == 0 {
+			postMessage["text"] = sub.msg("whitelist_empty", nil)
+		} else {
+			postMessage["text"] = sub.msg("whitelist_list", msgArgs{"Indicators": strings.Join(sub.configuration.Whitelist, ", ")})
+		}
+	case len(parts) == 3 && strings.ToLower(parts[1]) == "add":
+		entry := strings.ToLower(unwrapLink(parts[2]))
+		if strings.Contains(entry, "/") && !strings.Contains(entry, "://") {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				postMessage["text"] = sub.msg("whitelist_bad_cidr", msgArgs{"Indicator": entry})
+				break
+			}
+		}
+		if len(entry) > 200 {
+			postMessage["text"] = sub.msg("whitelist_too_long", nil)
+		} else if util.In(c.Whitelist, entry) {
+			postMessage["text"] = sub.msg("whitelist_already", msgArgs{"Indicator": entry})
+		} else {
+			c.Whitelist = append(c.Whitelist, entry)
+			changed = true
+		}
+	case len(parts) == 3 && strings.ToLower(parts[1]) == "remove":
+		entry := strings.ToLower(unwrapLink(parts[2]))
+		index := util.Index(c.Whitelist, entry)
+		if index < 0 {
+			postMessage["text"] = sub.msg("whitelist_missing", msgArgs{"Indicator": entry})
+		} else {
+			c.Whitelist = append(c.Whitelist[:index], c.Whitelist[index+1:]...)
+			changed = true
+		}
+	default:
+		postMessage["text"] = sub.msg("whitelist_usage", nil)
+	}
+	if changed {
+		err := b.setConfiguration(sub, c)
+		if err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing whitelist")
+			postMessage["text"] = sub.msg("whitelist_save_error", nil)
+		} else {
+			postMessage["text"] = sub.msg("whitelist_changed", nil)
+			if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+				postMessage["text"] = sub.msg("whitelist_save_error", nil)
+			}
+		}
 	}
 	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
-		logrus.Warnf("Error posting config message - %v", err)
+		teamLog(team, channel).WithError(err).Warn("Error posting whitelist message to Slack")
 	}
 }
 
-func (b *Bot) showHelp(team, channel string) {
+// resolveUser returns the ID of a user given as a mention (<@U123>) or by name
+func resolveUser(sub *subscription, user string) (string, error) {
+	if strings.HasPrefix(user, "<@") && strings.HasSuffix(user, ">") {
+		return strings.Split(user[2:len(user)-1], "|")[0], nil
+	}
+	user = strings.TrimPrefix(user, "@")
+	users, err := sub.s.Users()
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve the list of users - %v", err)
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.S("name"), user) || strings.EqualFold(u.S("profile.display_name"), user) || u.S("id") == user {
+			return u.S("id"), nil
+		}
+	}
+	return "", fmt.Errorf("could not find user %s", user)
+}
+
+func (b *Bot) handleIgnore(team, text, channel string, sub *subscription) {
 	postMessage := map[string]interface{}{
 		"channel": channel,
 		"as_user": true,
-		"text":    conf.DefaultHelpMessage}
+	}
+	parts := strings.Fields(text)
+	changed := false
+	// The messages are checked against the ignored users while we change them so we change a copy and swap it in
+	c := sub.configuration.Clone()
+	switch {
+	case len(parts) == 2 && strings.ToLower(parts[1]) == "list":
+		if len(sub.configuration.IgnoredUsers) == 0 {
+			postMessage["text"] = sub.msg("ignore_empty", nil)
+		} else {
+			var users []string
+			for _, u := range sub.configuration.IgnoredUsers {
+				users = append(users, "<@"+u+">")
+			}
+			postMessage["text"] = sub.msg("ignore_list", msgArgs{"Users": strings.Join(users, ", ")})
+		}
+	case len(parts) == 3 && (strings.ToLower(parts[1]) == "add" || strings.ToLower(parts[1]) == "remove"):
+		user, err := resolveUser(sub, parts[2])
+		if err != nil {
+			teamLog(team, channel).WithError(err).Debug("Unable to resolve user")
+			postMessage["text"] = sub.msg("ignore_no_user", msgArgs{"User": parts[2]})
+			break
+		}
+		index := util.Index(c.IgnoredUsers, user)
+		if strings.ToLower(parts[1]) == "add" {
+			if user == sub.team.BotUserID {
+				postMessage["text"] = sub.msg("ignore_self", nil)
+			} else if index >= 0 {
+				postMessage["text"] = sub.msg("ignore_already", msgArgs{"User": user})
+			} else {
+				c.IgnoredUsers = append(c.IgnoredUsers, user)
+				changed = true
+			}
+		} else if index < 0 {
+			postMessage["text"] = sub.msg("ignore_missing", msgArgs{"User": user})
+		} else {
+			c.IgnoredUsers = append(c.IgnoredUsers[:index], c.IgnoredUsers[index+1:]...)
+			changed = true
+		}
+	default:
+		postMessage["text"] = sub.msg("ignore_usage", nil)
+	}
+	if changed {
+		err := b.setConfiguration(sub, c)
+		if err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing ignored users")
+			postMessage["text"] = sub.msg("ignore_save_error", nil)
+		} else {
+			postMessage["text"] = sub.msg("ignore_changed", nil)
+			if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+				postMessage["text"] = sub.msg("ignore_save_error", nil)
+			}
+		}
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting ignore message to Slack")
+	}
+}
+
+// showHelp lists the commands or shows the detailed usage of the command in the topic
+func (b *Bot) showHelp(team, channel, thread, topic string) {
 	sub := b.subscriptions[team]
+	text := helpMessage(sub.team.Locale)
+	if topic != "" {
+		if text = commandHelp(topic); text == "" {
+			text = sub.msg("help_unknown", msgArgs{"Topic": topic})
+			if suggestion := suggestCommand(topic); suggestion != "" {
+				text += sub.msg("help_suggestion", msgArgs{"Suggestion": suggestion})
+			} else {
+				text += sub.msg("help_all", nil)
+			}
+		}
+	}
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+		"text":    text}
+	inThread(postMessage, thread)
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting config message")
+	}
+}
+
+// welcomeUser introduces us on the first DM of the user, once even across restarts and bot instances
+func (b *Bot) welcomeUser(team, user, channel string, sub *subscription) {
+	key := welcomedKey(sub.team.ID, user)
+	if b.welcomed.has(key) {
+		return
+	}
+	first, err := b.r.MarkWelcomed(sub.team.ID, user)
+	if err != nil {
+		// Better to skip the welcome than to repeat it, we will try again on the next DM
+		contextLog(&domain.Context{Team: team, Channel: channel, User: user}).WithError(err).Warn("Unable to mark user as welcomed")
+		return
+	}
+	b.welcomed.add(key)
+	if !first {
+		return
+	}
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+		"text":    "Hi, I am dbot. I check the URLs, IPs, hashes and files shared in the channels I monitor and you can send me indicators here to check them privately. Type *help* to see what else I can do.",
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting welcome message to Slack")
+	}
+}
+
+// inThread makes the message a reply in the thread if there is one
+func inThread(postMessage map[string]interface{}, thread string) {
+	if thread != "" {
+		postMessage["thread_ts"] = thread
+	}
+}
+
+// handleMention runs the command after a mention of us in a channel and replies in the thread of the message.
+// Only the safe commands run here, the rest (and everything that changes the configuration) stay in the DM.
+// It returns false if the text is not a command so the message is handled like any other.
+func (b *Bot) handleMention(team, text string, content slack.Response, channel string, sub *subscription) bool {
+	thread := content.S("thread_ts")
+	if thread == "" {
+		thread = content.S("ts")
+	}
+	postMessage := map[string]interface{}{
+		"channel":   channel,
+		"as_user":   true,
+		"thread_ts": thread,
+	}
+	handled := true
+	c := findCommand(strings.ToLower(text))
+	switch {
+	case c != nil && c.mention:
+		commandsTotal.Inc(c.name, "mention")
+		c.run(b, team, slack.Response{"type": "message", "channel": channel, "user": content.S("user"), "text": text, "ts": content.S("ts"), "thread_ts": thread}, sub)
+		return true
+	case c != nil:
+		postMessage["text"] = fmt.Sprintf("Please send me *%s* in a direct message. In channels I only answer %s.", c.name, strings.Join(mentionCommands(), ", "))
+	default:
+		postMessage["text"] = fmt.Sprintf("Send me *help* in a direct message to see what I can do, or mention me here with %s.", strings.Join(mentionCommands(), ", "))
+		handled = false
+	}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting mention message to Slack")
+	}
+	return handled
+}
+
+// handleUnknown replies to a DM that is neither a command nor has anything to check
+func (b *Bot) handleUnknown(team, text, channel string, sub *subscription) {
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+		"text":    unknownCommandReply(text)}
+	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting unknown command message to Slack")
+	}
+}
+
+// permalinkReg matches Slack message permalinks - the ts is the digits after p with the dot removed
+var permalinkReg = regexp.MustCompile(`^https://[^/]+\.slack\.com/archives/([A-Z0-9]+)/p(\d{10})(\d{6})(?:\?(.*))?$`)
+
+// parsePermalink returns the channel, ts and thread ts of the message the permalink points to
+func parsePermalink(link string) (string, string, string, bool) {
+	m := permalinkReg.FindStringSubmatch(entityReplacer.Replace(unwrapLink(link)))
+	if m == nil {
+		return "", "", "", false
+	}
+	threadTS := ""
+	if query, err := url.ParseQuery(m[4]); err == nil {
+		threadTS = query.Get("thread_ts")
+	}
+	return m[1], m[2] + "." + m[3], threadTS, true
+}
+
+// handleRescan checks the message in the permalink again and replies on it, e.g. when a fresh sample was not found the first time
+func (b *Bot) handleRescan(team string, msg slack.Response, sub *subscription) {
+	channel, user := msg.S("channel"), msg.S("user")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	fields := strings.Fields(msg.S("text"))
+	target, ts, threadTS, ok := "", "", "", len(fields) == 2
+	if ok {
+		target, ts, threadTS, ok = parsePermalink(fields[1])
+	}
+	var original slack.Response
+	switch {
+	case !ok:
+		postMessage["text"] = "I could not understand your command. Rescan command is:\nrescan message-link - use Copy link on the message to get it."
+	default:
+		members, err := sub.s.ConversationMembers(target)
+		switch {
+		case err != nil:
+			teamLog(team, target).WithError(err).Info("Unable to get the members of the channel")
+			postMessage["text"] = fmt.Sprintf("I cannot access <#%s> - please invite me to the channel first.", target)
+		case !util.In(members, user):
+			postMessage["text"] = "You can only re-scan messages in channels you are a member of."
+		default:
+			if original, err = sub.s.ConversationMessage(target, ts, threadTS); err != nil || original == nil {
+				contextLog(&domain.Context{Team: team, Channel: target, TS: ts}).WithError(err).Info("Unable to get message")
+				postMessage["text"] = "I could not find that message."
+			}
+		}
+	}
+	if original != nil {
+		var attachments []string
+		if !sub.configuration.DisableAttachments {
+			attachments = attachmentTexts(original)
+		}
+		prepare := stripCode
+		if sub.configuration.ScansCode(target) {
+			prepare = func(s string) string { return s }
+		}
+		text, truncated := truncateText(strings.Join(append([]string{original.S("text")}, attachments...), "\n"), conf.Options.Limits.MessageSize)
+		found := findIndicators(sub, prepare(text))
+		if !found.found() {
+			postMessage["text"] = "I did not find anything to check in that message."
+		} else {
+			skipped := found.limit(conf.Options.Limits.Indicators)
+			workReq := domain.WorkRequestFromMessage(slack.Response{"type": "message", "ts": ts, "text": original.S("text")},
+				sub.team.BotToken, sub.team.Credentials(), sub.configuration.SkippedSources(), sub.configuration.Scoring)
+			found.apply(workReq, sub.configuration)
+			workReq.Skipped, workReq.Truncated = skipped, truncated
+			workReq.ReplyQueue, workReq.TTL = util.Hostname, commandTTL()
+			workReq.Context = &domain.Context{Team: team, User: user, Type: "message", Channel: target, OriginalUser: original.S("user"),
+				TS: ts, ThreadTS: threadTS, Rescan: true}
+			if err := b.pushWork(team, sub, workReq); err == errRateLimited {
+				postMessage["text"] = "Your team sent too many requests in the last minute - please try the re-scan again soon."
+			} else if err != nil {
+				contextLog(workReq.Context.(*domain.Context)).WithError(err).Warn("Unable to push rescan request")
+				if debugEnabled() {
+					logrus.Debugf("Rescan request - %s", util.ToJSONStringNoIndent(workReq))
+				}
+				postMessage["text"] = "Error requesting the re-scan - no worries, we are handling it"
+			} else {
+				postMessage["text"] = fmt.Sprintf("Re-scan requested - I will reply on the message in <#%s>.", target)
+			}
+		}
+	}
 	if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
-		logrus.Warnf("Error posting config message - %v", err)
+		teamLog(team, channel).WithError(err).Warn("Error posting rescan message to Slack")
+	}
+}
+
+// handleScan checks every indicator in the text after the command and replies in the DM or in the thread we were mentioned in
+func (b *Bot) handleScan(team string, msg slack.Response, sub *subscription) {
+	channel := msg.S("channel")
+	text, truncated := truncateText(strings.TrimSpace(msg.S("text")[len("scan "):]), conf.Options.Limits.MessageSize)
+	// Pasted blobs are usually in code blocks so we do not strip them
+	found := findIndicators(sub, linkify(text))
+	if !found.found() {
+		postMessage := map[string]interface{}{
+			"channel": channel,
+			"as_user": true,
+			"text":    "I could not find anything to check. I look for URLs, domains, IPs, hashes, CVEs, crypto wallets and email addresses (if enabled) - whitelisted and private ones are skipped.",
+		}
+		inThread(postMessage, msg.S("thread_ts"))
+		if _, err := sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error posting scan message to Slack")
+		}
+		return
+	}
+	skipped := found.limit(conf.Options.Limits.Indicators)
+	workReq := domain.WorkRequestFromMessage(msg, sub.team.BotToken, sub.team.Credentials(), sub.configuration.SkippedSources(), sub.configuration.Scoring)
+	found.apply(workReq, sub.configuration)
+	workReq.Skipped, workReq.Truncated = skipped, truncated
+	workReq.ReplyQueue, workReq.TTL = util.Hostname, commandTTL()
+	workReq.Context = &domain.Context{Team: team, User: msg.S("user"), Type: "message", Channel: channel, OriginalUser: msg.S("user"), TS: msg.S("ts"),
+		ThreadTS: msg.S("thread_ts"), Mention: channel != "" && channel[0] != 'D'}
+	if err := b.pushWork(team, sub, workReq); err != nil && err != errRateLimited {
+		contextLog(workReq.Context.(*domain.Context)).WithError(err).Warn("Unable to push scan request")
+		if debugEnabled() {
+			logrus.Debugf("Scan request - %s", util.ToJSONStringNoIndent(workReq))
+		}
 	}
 }
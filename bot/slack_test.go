@@ -0,0 +1,125 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+func TestFormatStats(t *testing.T) {
+	day := &domain.Statistics{Messages: 5, URLsClean: 2, URLsDirty: 1}
+	week := &domain.Statistics{Messages: 120, URLsClean: 20, URLsDirty: 3, FilesDirty: 1}
+	res := formatStats(day.Totals(), week.Totals())
+	if !strings.HasPrefix(res, "```") || !strings.HasSuffix(res, "```") {
+		t.Errorf("expected a code block but got %s", res)
+	}
+	for _, line := range []string{"Messages            5          120", "URLs                3           23", "Malicious           1            4"} {
+		if !strings.Contains(res, line) {
+			t.Errorf("expected %q in %s", line, res)
+		}
+	}
+}
+
+func TestParsePermalink(t *testing.T) {
+	tests := []struct {
+		link, channel, ts, thread string
+		ok                        bool
+	}{
+		{"<https://example.slack.com/archives/C0123ABC/p1514764800000100>", "C0123ABC", "1514764800.000100", "", true},
+		{"https://example.slack.com/archives/C0123ABC/p1514764900000200?thread_ts=1514764800.000100&amp;cid=C0123ABC", "C0123ABC", "1514764900.000200", "1514764800.000100", true},
+		{"https://example.com/archives/C0123ABC/p1514764800000100", "", "", "", false},
+		{"https://example.slack.com/archives/C0123ABC", "", "", "", false},
+	}
+	for _, test := range tests {
+		channel, ts, thread, ok := parsePermalink(test.link)
+		if channel != test.channel || ts != test.ts || thread != test.thread || ok != test.ok {
+			t.Errorf("parsePermalink(%s) = %s, %s, %s, %v", test.link, channel, ts, thread, ok)
+		}
+	}
+}
+
+func TestFormatDigest(t *testing.T) {
+	d := &domain.Digest{
+		Stats: &domain.Statistics{Messages: 10, URLsClean: 3, URLsDirty: 2},
+		Malicious: []domain.DigestFinding{
+			{ContentType: domain.ReplyTypeURL, Content: "http://evil.com/x", Channel: "C1", MessageID: "1.2", Count: 2},
+			{ContentType: domain.ReplyTypeHash, Content: "44d88612fea8a8f36de82e1278abb02f", Channel: "C2", MessageID: "3.4", Count: 1},
+		},
+	}
+	res := formatDigest(d, func(channel, ts string) string {
+		if channel == "C1" {
+			return "https://example.slack.com/archives/C1/p12"
+		}
+		return ""
+	})
+	for _, line := range []string{"Messages checked: 10", "URLs: 5 (2 malicious)", "• URL http[://]evil[.]com/x seen 2 time(s) - <https://example.slack.com/archives/C1/p12|last message>",
+		"• Hash 44d88612fea8a8f36de82e1278abb02f seen 1 time(s)\n"} {
+		if !strings.Contains(res+"\n", line) {
+			t.Errorf("expected %q in %s", line, res)
+		}
+	}
+	if res = formatDigest(&domain.Digest{Stats: &domain.Statistics{Messages: 1}}, nil); !strings.Contains(res, "Nothing malicious") {
+		t.Errorf("expected nothing malicious in %s", res)
+	}
+}
+
+func TestResolveChannels(t *testing.T) {
+	conversations := []slack.Response{
+		{"id": "C1", "name": "eng-backend", "is_member": true},
+		{"id": "C2", "name": "eng-frontend", "is_member": true},
+		{"id": "C3", "name": "eng-random", "is_member": false},
+		{"id": "G1", "name": "soc", "is_member": true},
+	}
+	tests := []struct {
+		args           []string
+		ids, unmatched []string
+	}{
+		{[]string{"all"}, []string{"C1", "C2", "G1"}, nil},
+		{[]string{"eng-*"}, []string{"C1", "C2"}, nil},
+		{[]string{"#soc,<#C3|eng-random>", "eng-backend"}, []string{"G1", "C3", "C1"}, nil},
+		{[]string{"eng-backend,eng-*"}, []string{"C1", "C2"}, nil},
+		{[]string{"ops-*", "nope"}, nil, []string{"ops-*", "nope"}},
+	}
+	for _, test := range tests {
+		ids, unmatched := resolveChannels(test.args, conversations, isMember)
+		if strings.Join(ids, ",") != strings.Join(test.ids, ",") || strings.Join(unmatched, ",") != strings.Join(test.unmatched, ",") {
+			t.Errorf("resolveChannels(%v) = %v, %v, expected %v, %v", test.args, ids, unmatched, test.ids, test.unmatched)
+		}
+	}
+}
+
+func TestHandleReplyStatsChannels(t *testing.T) {
+	b := queueBot(testQueue())
+	sub := b.subscriptions["T1"]
+	reply := &domain.WorkReply{Type: domain.ReplyTypeURL | domain.ReplyTypeIP,
+		URLs: []domain.URLReply{{Result: domain.ResultDirty}, {Result: domain.ResultClean}},
+		IPs:  []domain.IPReply{{Result: domain.ResultUnknown}}}
+	b.handleReplyStats(reply, &domain.Context{Team: "T1", Channel: "C1"}, sub)
+	b.handleReplyStats(reply, &domain.Context{Team: "T1", Channel: "D1"}, sub)
+	stats := b.stats["T1"]
+	if stats.Messages != 2 || stats.URLsDirty != 2 || len(stats.Channels) != 1 {
+		t.Fatalf("unexpected team statistics %+v", stats)
+	}
+	c := stats.Channels["C1"]
+	if c.Messages != 1 || c.URLs != 2 || c.IPs != 1 || c.Malicious != 1 {
+		t.Errorf("unexpected channel statistics %+v", c)
+	}
+}
+
+func TestHandleReplyStatsSHA512(t *testing.T) {
+	b := queueBot(testQueue())
+	sub := b.subscriptions["T1"]
+	sha512 := "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e"
+	found := findIndicators(sub, "check "+sha512)
+	workReq := &domain.WorkRequest{Type: "message"}
+	found.apply(workReq, sub.configuration)
+	reply := &domain.WorkReply{}
+	(&Worker{}).handleHashes(workReq, reply)
+	b.handleReplyStats(reply, &domain.Context{Team: "T1", Channel: "C1"}, sub)
+	// A SHA-512 is a single hash and not two SHA-256 halves
+	if stats := b.stats["T1"]; stats.HashesUnknown != 1 || stats.HashesClean != 0 || stats.HashesDirty != 0 || stats.Channels["C1"].Hashes != 1 {
+		t.Errorf("expected the SHA-512 to be counted once %+v", stats)
+	}
+}
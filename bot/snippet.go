@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+const (
+	// snippetThreshold is the size of the reply blocks (as JSON) from which we upload the full report as a snippet.
+	// Slack truncates bigger messages and files with dozens of detections lose the interesting part.
+	snippetThreshold = 12000
+	// snippetFiletype is the format of the full report
+	snippetFiletype = slack.SnippetMarkdown
+)
+
+// needsSnippet checks if the blocks are too large to post as they are
+func needsSnippet(blocks []slack.Block) bool {
+	b, err := json.Marshal(blocks)
+	return err == nil && len(b) > snippetThreshold
+}
+
+// reportSnippet is the full report of the findings in the given format
+func reportSnippet(findings []finding, filetype string) string {
+	bold, bullet := func(s string) string { return s }, "  "
+	if filetype == slack.SnippetMarkdown {
+		bold, bullet = func(s string) string { return "**" + s + "**" }, "- "
+	}
+	var lines []string
+	for i := range findings {
+		f := &findings[i]
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, bold(fmt.Sprintf("%s %s: %s", f.verdict, f.kind, f.value)), f.comment)
+		for _, s := range f.sources {
+			lines = append(lines, bullet+fmt.Sprintf("%s: %s", s.name, s.score))
+			if s.link != "" {
+				lines = append(lines, bullet+"  "+s.link)
+			}
+			for _, d := range strings.Split(s.detail, "\n") {
+				if d != "" {
+					lines = append(lines, bullet+"  "+d)
+				}
+			}
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// oversized uploads the full report as a snippet in the thread of the original message if the blocks are too large
+// and returns the compact layout with a link to it instead.
+// If the upload fails we post the blocks as they are and let Slack truncate them.
+func (b *Bot) oversized(blocks []slack.Block, findings []finding, quote string, notes []string, link string, data *domain.Context, sub *subscription) []slack.Block {
+	if !needsSnippet(blocks) {
+		return blocks
+	}
+	thread := data.ThreadTS
+	if thread == "" {
+		thread = data.TS
+	}
+	filename := "dbot-report.txt"
+	if snippetFiletype == slack.SnippetMarkdown {
+		filename = "dbot-report.md"
+	}
+	res, err := sub.s.UploadFile(&slack.Upload{
+		Channel:  data.Channel,
+		ThreadTS: thread,
+		Filename: filename,
+		Filetype: snippetFiletype,
+		Title:    "dbot full report",
+		Content:  []byte(reportSnippet(findings, snippetFiletype)),
+	})
+	if err != nil {
+		contextLog(data).WithError(err).Warn("Unable to upload the full report")
+		return blocks
+	}
+	note := fmt.Sprintf("The reply is too long for a message, the full report is in <%s|this snippet>.", res.S("file.permalink"))
+	return replyBlocks(sub.team.Locale, findings, quote, append(notes[:len(notes):len(notes)], note), false, link)
+}
@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+func TestNeedsSnippet(t *testing.T) {
+	// Pad the last block so the blocks are exactly at the threshold
+	blocks := []slack.Block{{"type": "section", "text": ""}}
+	b, _ := json.Marshal(blocks)
+	blocks[0]["text"] = strings.Repeat("a", snippetThreshold-len(b))
+	if needsSnippet(blocks) {
+		t.Error("blocks at the threshold should be posted as they are")
+	}
+	blocks[0]["text"] = strings.Repeat("a", snippetThreshold-len(b)+1)
+	if !needsSnippet(blocks) {
+		t.Error("blocks above the threshold should be uploaded as a snippet")
+	}
+}
+
+func TestReportSnippet(t *testing.T) {
+	f := newFinding("File", "evil.exe", domain.ResultDirty, "File evil.exe is malicious.", "")
+	f.add("VirusTotal", "40 / 70", "https://www.virustotal.com", "Scan Date: 2020-01-01\nDetections:\nAvast: Trojan")
+	markdown := reportSnippet([]finding{f, f}, slack.SnippetMarkdown)
+	if !strings.HasPrefix(markdown, "**Malicious File: evil.exe**\n") || !strings.Contains(markdown, "\n-   Avast: Trojan\n") {
+		t.Errorf("unexpected markdown report %q", markdown)
+	}
+	if strings.Count(markdown, "**Malicious File") != 2 {
+		t.Errorf("expected both findings in the report %q", markdown)
+	}
+	if text := reportSnippet([]finding{f}, slack.SnippetText); strings.Contains(text, "**") || !strings.Contains(text, "VirusTotal: 40 / 70") {
+		t.Errorf("unexpected plain text report %q", text)
+	}
+}
@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/demisto/alfred/metrics"
+)
+
+var staleTotal = metrics.NewCounter("alfred_stale_subscriptions_total",
+	"Subscriptions that stopped getting events by the result of reloading them", "result")
+
+// verifyToken checks the bot token of the subscription is still good, replaced by the tests
+var verifyToken = func(sub *subscription) error {
+	_, err := sub.s.Do("POST", "auth.test", nil)
+	return err
+}
+
+// checkStaleSubscriptions looks for teams with monitored channels that did not send us any event for the period
+// and verifies and reloads them in the background. The network calls are made without holding the lock.
+func (b *Bot) checkStaleSubscriptions(period time.Duration) {
+	if period <= 0 || !atomic.CompareAndSwapInt32(&b.checkingStale, 0, 1) {
+		return
+	}
+	stale := make(map[string]*subscription)
+	b.mu.RLock()
+	for team, sub := range b.subscriptions {
+		if sub.configuration.IsActive() && sub.quietFor() >= period {
+			stale[team] = sub
+		}
+	}
+	b.mu.RUnlock()
+	if len(stale) == 0 {
+		atomic.StoreInt32(&b.checkingStale, 0)
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer atomic.StoreInt32(&b.checkingStale, 0)
+		for team, sub := range stale {
+			if b.ctx.Err() != nil {
+				return
+			}
+			b.recoverStale(team, sub)
+		}
+	}()
+}
+
+// recoverStale reloads the subscription of the quiet team with a fresh client. It is recovered only if the token we
+// reloaded passes auth.test.
+func (b *Bot) recoverStale(team string, sub *subscription) {
+	log := teamLog(team, "").WithField("quiet", sub.quietFor().Round(time.Minute).String())
+	log.Info("Stale subscription, reloading it")
+	reloaded, err := b.fetchSubscription(team)
+	if err == nil {
+		err = verifyToken(reloaded)
+		if err != nil {
+			staleTotal.Inc("unauthorized")
+			log.WithError(err).Warn("Reloaded stale subscription failed auth.test")
+			return
+		}
+	}
+	switch err {
+	case nil:
+		staleTotal.Inc("recovered")
+		log.Info("Stale subscription recovered")
+	case errUninstalled:
+		staleTotal.Inc("uninstalled")
+		log.Info("Team uninstalled us, dropping the stale subscription")
+		b.dropSubscription(team)
+	default:
+		staleTotal.Inc("failed")
+		log.WithError(err).Warn("Unable to reload stale subscription, keeping the current one")
+		// Check it again only after another period
+		sub.eventSeen()
+	}
+}
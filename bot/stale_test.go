@@ -0,0 +1,70 @@
+package bot
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestCheckStaleSubscriptions(t *testing.T) {
+	defer func(v func(*subscription) error) { verifyToken = v }(verifyToken)
+	var verified int32
+	verifyToken = func(sub *subscription) error {
+		atomic.AddInt32(&verified, 1)
+		return nil
+	}
+	b := queueBot(testQueue())
+	store := &countingStore{}
+	b.store = store
+	quiet := &subscription{team: &domain.Team{ID: "9", ExternalID: "T9"}, configuration: &domain.Configuration{Channels: []string{"C9"}}}
+	atomic.StoreInt64(&quiet.lastEvent, time.Now().Add(-2*time.Hour).UnixNano())
+	// Nothing monitored so no events are expected
+	idle := &subscription{team: &domain.Team{ID: "8", ExternalID: "T8"}, configuration: &domain.Configuration{}}
+	b.subscriptions["T9"], b.subscriptions["T8"] = quiet, idle
+	b.subscriptions["T1"].eventSeen()
+	recovered := staleTotal.Value("recovered")
+	b.checkStaleSubscriptions(time.Hour)
+	b.wg.Wait()
+	if verified != 1 || store.loads != 1 {
+		t.Errorf("expected only the quiet team to be verified and reloaded, verified %d loaded %d", verified, store.loads)
+	}
+	if sub := b.relevantTeam("T9"); sub == quiet || sub.quietFor() > time.Minute {
+		t.Error("expected a fresh subscription for the quiet team")
+	}
+	if staleTotal.Value("recovered") != recovered+1 {
+		t.Error("expected the recovery to be counted")
+	}
+	if atomic.LoadInt32(&b.checkingStale) != 0 {
+		t.Error("expected the check to be done")
+	}
+}
+
+func TestRecoverStaleUnauthorized(t *testing.T) {
+	defer func(v func(*subscription) error) { verifyToken = v }(verifyToken)
+	verifyToken = func(sub *subscription) error { return errors.New("invalid_auth") }
+	b := queueBot(testQueue())
+	b.store = &countingStore{}
+	recovered, unauthorized := staleTotal.Value("recovered"), staleTotal.Value("unauthorized")
+	b.recoverStale("T1", b.subscriptions["T1"])
+	if staleTotal.Value("recovered") != recovered || staleTotal.Value("unauthorized") != unauthorized+1 {
+		t.Error("expected a token that fails auth.test not to be counted as recovered")
+	}
+}
+
+func TestRecoverStaleFailure(t *testing.T) {
+	defer func(v func(*subscription) error) { verifyToken = v }(verifyToken)
+	verifyToken = func(sub *subscription) error { return nil }
+	b := queueBot(testQueue())
+	b.store = &countingStore{fail: map[string]bool{"T1": true}}
+	sub := b.subscriptions["T1"]
+	b.recoverStale("T1", sub)
+	if b.relevantTeam("T1") != sub {
+		t.Error("expected the current subscription to be kept")
+	}
+	if sub.quietFor() > time.Minute {
+		t.Error("expected the team to be checked again only after another period")
+	}
+}
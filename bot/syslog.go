@@ -0,0 +1,223 @@
+package bot
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+)
+
+const (
+	// syslogQueueSize bounds the events waiting for the syslog server, more are dropped
+	syslogQueueSize = 1000
+	// syslogTimeout bounds connecting and writing so a stuck server does not hold the events forever
+	syslogTimeout = 5 * time.Second
+)
+
+// syslogRetry is how long we drop the events after we failed to connect before trying again. Replaced by the tests.
+var syslogRetry = 10 * time.Second
+
+// errSyslogDown is returned while we wait to connect again
+var errSyslogDown = errors.New("syslog server is down")
+
+var syslogTotal = metrics.NewCounter("alfred_syslog_events_total", "CEF events forwarded to syslog by the result", "result")
+
+// syslogFacilities are the facility codes of RFC 5424
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9,
+	"authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21,
+	"local6": 22, "local7": 23,
+}
+
+// verdictSeverity is the CEF severity (0-10) and the syslog severity of each result
+var verdictSeverity = map[int]struct{ cef, syslog int }{
+	domain.ResultClean:      {1, 6},  // Informational
+	domain.ResultUnknown:    {5, 5},  // Notice
+	domain.ResultSuspicious: {7, 4},  // Warning
+	domain.ResultDirty:      {10, 4}, // Warning
+}
+
+var (
+	// cefHeader escapes the header fields, they cannot span lines
+	cefHeader = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r\n", " ", "\n", " ", "\r", " ")
+	// cefValue escapes the extension values
+	cefValue = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r\n", `\n`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefExtension is a key and value of the CEF extension
+type cefExtension struct {
+	key, value string
+}
+
+// cefEvent formats the verdict as a CEF event
+func cefEvent(rec *domain.ScanRecord, sub *subscription, now time.Time) string {
+	kind, verdict := indicatorTypeNames[rec.IndicatorType], verdictNames[rec.Verdict]
+	var sources []string
+	for name, score := range rec.Scores {
+		sources = append(sources, name+": "+score)
+	}
+	sort.Strings(sources)
+	ext := []cefExtension{
+		{"rt", strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)},
+		{"cat", kind},
+		{"act", strings.ToLower(verdict)},
+		{"suser", rec.User},
+		{"cs1Label", "Team"}, {"cs1", sub.team.Name},
+		{"cs2Label", "Channel"}, {"cs2", rec.Channel},
+		{"cs3Label", "Indicator"}, {"cs3", rec.Indicator},
+		{"cs4Label", "Sources"}, {"cs4", strings.Join(sources, "; ")},
+		{"cs5Label", "Permalink"}, {"cs5", rec.Permalink},
+		{"cs6Label", "Team ID"}, {"cs6", sub.team.ExternalID},
+	}
+	var pairs []string
+	for _, e := range ext {
+		if e.value != "" {
+			pairs = append(pairs, e.key+"="+cefValue.Replace(e.value))
+		}
+	}
+	header := []string{"CEF:0", "Demisto", "Alfred", "1.0", kind + "-" + strings.ToLower(verdict), verdict + " " + kind,
+		strconv.Itoa(verdictSeverity[rec.Verdict].cef)}
+	for i := 1; i < len(header); i++ {
+		header[i] = cefHeader.Replace(header[i])
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(pairs, " ")
+}
+
+// syslogForwarder writes the CEF events to the syslog server from a single worker
+type syslogForwarder struct {
+	protocol string
+	address  string
+	facility int
+	hostname string
+	queue    chan []byte
+	conn     net.Conn  // Only used by the worker
+	retry    time.Time // When we can try to connect again after a failure, only used by the worker
+}
+
+// newSyslogForwarder returns nil if there is no syslog server
+func newSyslogForwarder(protocol, address, facility string) (*syslogForwarder, error) {
+	if address == "" {
+		return nil, nil
+	}
+	switch protocol {
+	case "":
+		protocol = "udp"
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("syslog protocol must be tcp, udp or tls and not %s", protocol)
+	}
+	if facility == "" {
+		facility = "local0"
+	}
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %s", facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "alfred"
+	}
+	return &syslogForwarder{protocol: protocol, address: address, facility: code, hostname: hostname,
+		queue: make(chan []byte, syslogQueueSize)}, nil
+}
+
+// message is the syslog line with the event, stream connections need the trailing newline to separate them
+func (s *syslogForwarder) message(event string, result int, now time.Time) []byte {
+	msg := fmt.Sprintf("<%d>%s %s alfred: %s", s.facility*8+verdictSeverity[result].syslog, now.Format(time.Stamp), s.hostname, event)
+	if s.protocol != "udp" {
+		msg += "\n"
+	}
+	return []byte(msg)
+}
+
+func (s *syslogForwarder) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: syslogTimeout}
+	if s.protocol == "tls" {
+		host, _, _ := net.SplitHostPort(s.address)
+		return tls.DialWithDialer(d, "tcp", s.address, &tls.Config{ServerName: host})
+	}
+	return d.Dial(s.protocol, s.address)
+}
+
+// send writes the message, connecting again once if the connection broke. After we fail to connect the messages are
+// dropped for a while instead of dialing for every one of them.
+func (s *syslogForwarder) send(msg []byte, now time.Time) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if now.Before(s.retry) {
+				return errSyslogDown
+			}
+			if s.conn, err = s.dial(); err != nil {
+				s.conn, s.retry = nil, now.Add(syslogRetry)
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.close()
+	}
+	return err
+}
+
+func (s *syslogForwarder) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// queueSyslog queues a CEF event for every verdict of the reply. It never blocks, the events are dropped if the
+// syslog server cannot keep up.
+func (b *Bot) queueSyslog(reply *domain.WorkReply, ctx *domain.Context, sub *subscription) {
+	if b.syslog == nil {
+		return
+	}
+	now := time.Now()
+	records := scanRecords(reply, ctx, sub)
+	for i := range records {
+		select {
+		case b.syslog.queue <- b.syslog.message(cefEvent(&records[i], sub, now), records[i].Verdict, now):
+		default:
+			syslogTotal.Inc("dropped")
+		}
+	}
+}
+
+// startSyslog starts the worker forwarding the events. It returns when the bot is stopped.
+func (b *Bot) startSyslog() {
+	if b.syslog == nil {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer b.syslog.close()
+		for {
+			select {
+			case msg := <-b.syslog.queue:
+				if err := b.syslog.send(msg, time.Now()); err != nil {
+					syslogTotal.Inc("failed")
+					if err != errSyslogDown {
+						logrus.WithError(err).Warnf("Unable to forward events to syslog at %s", b.syslog.address)
+					}
+					continue
+				}
+				syslogTotal.Inc("sent")
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+}
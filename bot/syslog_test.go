@@ -0,0 +1,146 @@
+package bot
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestCEFEvent(t *testing.T) {
+	sub := &subscription{team: &domain.Team{ExternalID: "T1", Name: `a|b\c`}}
+	rec := &domain.ScanRecord{Channel: "C1", User: "U1", Indicator: "http://evil.com/?a=1\nb", IndicatorType: domain.ReplyTypeURL,
+		Verdict: domain.ResultDirty, Scores: map[string]string{"xfe": "10", "vt": "3 / 70"}}
+	event := cefEvent(rec, sub, time.Unix(1514764800, 0))
+	expected := `CEF:0|Demisto|Alfred|1.0|url-malicious|Malicious url|10|rt=1514764800000 cat=url act=malicious suser=U1 ` +
+		`cs1Label=Team cs1=a|b\\c cs2Label=Channel cs2=C1 cs3Label=Indicator cs3=http://evil.com/?a\=1\nb ` +
+		`cs4Label=Sources cs4=vt: 3 / 70; xfe: 10 cs5Label=Permalink cs6Label=Team ID cs6=T1`
+	if event != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, event)
+	}
+	if escaped := cefHeader.Replace(`a|b\c`); escaped != `a\|b\\c` {
+		t.Errorf("bad header escaping %s", escaped)
+	}
+}
+
+func TestNewSyslogForwarder(t *testing.T) {
+	if s, err := newSyslogForwarder("tcp", "", "local0"); s != nil || err != nil {
+		t.Error("no address should disable the forwarder")
+	}
+	if _, err := newSyslogForwarder("http", "localhost:514", ""); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+	if _, err := newSyslogForwarder("udp", "localhost:514", "local9"); err == nil {
+		t.Error("expected an error for an unknown facility")
+	}
+	s, err := newSyslogForwarder("", "localhost:514", "")
+	if err != nil || s.protocol != "udp" || s.facility != 16 {
+		t.Errorf("unexpected defaults %+v - %v", s, err)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s, _ := newSyslogForwarder("udp", pc.LocalAddr().String(), "local0")
+	defer s.close()
+	if err = s.send(s.message("CEF:0|test", domain.ResultDirty, time.Now()), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<132>") || !strings.HasSuffix(msg, " alfred: CEF:0|test") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestSyslogTCPReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	s, _ := newSyslogForwarder("tcp", ln.Addr().String(), "daemon")
+	defer s.close()
+	now := time.Now()
+	if err = s.send(s.message("first", domain.ResultClean, now), now); err != nil {
+		t.Fatal(err)
+	}
+	// A broken connection is replaced for the next event
+	s.conn.Close()
+	if err = s.send(s.message("second", domain.ResultClean, now), now); err != nil {
+		t.Fatal(err)
+	}
+	// The connections are read concurrently so the order is not kept
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, "<30>") {
+				t.Errorf("unexpected line %q", line)
+			}
+			received[line[strings.LastIndex(line, " ")+1:]] = true
+		case <-time.After(time.Second):
+			t.Fatalf("got only %v", received)
+		}
+	}
+	if !received["first"] || !received["second"] {
+		t.Errorf("unexpected events %v", received)
+	}
+	// While the server is down we do not dial for every event
+	ln.Close()
+	s.close()
+	if err = s.send([]byte("third\n"), now); err == nil || err == errSyslogDown {
+		t.Errorf("expected a connection error but got %v", err)
+	}
+	if err = s.send([]byte("fourth\n"), now.Add(time.Second)); err != errSyslogDown {
+		t.Errorf("expected to wait before connecting again but got %v", err)
+	}
+	if err = s.send([]byte("fifth\n"), now.Add(syslogRetry)); err == errSyslogDown {
+		t.Error("expected to connect again after the retry interval")
+	}
+}
+
+func TestQueueSyslog(t *testing.T) {
+	b := queueBot(testQueue())
+	reply := &domain.WorkReply{Type: domain.ReplyTypeURL | domain.ReplyTypeIP,
+		URLs: []domain.URLReply{{Details: "http://evil.com", Result: domain.ResultDirty}},
+		IPs:  []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}}
+	ctx := &domain.Context{Team: "T1", Channel: "C1", OriginalUser: "U1"}
+	// Not configured
+	b.queueSyslog(reply, ctx, b.subscriptions["T1"])
+	b.syslog, _ = newSyslogForwarder("tcp", "127.0.0.1:514", "local0")
+	b.queueSyslog(reply, ctx, b.subscriptions["T1"])
+	if len(b.syslog.queue) != 2 {
+		t.Fatalf("expected an event per indicator but got %d", len(b.syslog.queue))
+	}
+	if msg := string(<-b.syslog.queue); !strings.HasPrefix(msg, "<132>") || !strings.Contains(msg, "|url-malicious|") ||
+		!strings.HasSuffix(msg, "\n") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
@@ -0,0 +1,178 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+// certMaxNames bounds the names of the certificate we show
+const certMaxNames = 10
+
+// certScanner inspects the certificate of https URLs. It only does the TLS handshake with the host, it never sends a
+// request so there are no redirects to follow and no body to download. A certificate issued less than
+// Certificates.YoungDays ago is a weak conviction, anything else we find is information.
+type certScanner struct {
+	resolver *net.Resolver
+	routable func(ip string) bool // Replaced by the tests, which connect to local servers
+	now      func() time.Time
+}
+
+// newCertScanner ignores the credentials, it only connects to the host
+func newCertScanner(creds domain.Credentials) (Scanner, error) {
+	return &certScanner{resolver: net.DefaultResolver, routable: util.IsRoutableIP, now: time.Now}, nil
+}
+
+func (c *certScanner) Name() string {
+	return domain.SourceTLS
+}
+
+func (c *certScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeURL
+}
+
+// timeout of the connection and the handshake
+func (c *certScanner) timeout() time.Duration {
+	if conf.Options.Certificates.Timeout > 0 {
+		return time.Duration(conf.Options.Certificates.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// address is the IP we connect to, empty if the host or any of its IPs is private so we never connect to the
+// internal network. We connect to the IP we checked so the host cannot resolve to another one in between.
+func (c *certScanner) address(ctx context.Context, host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !c.routable(host) {
+			return "", nil
+		}
+		return host, nil
+	}
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if !c.routable(addr.IP.String()) {
+			return "", nil
+		}
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// certificates does the handshake with the host and returns the certificates it sent, the leaf first
+func (c *certScanner) certificates(ctx context.Context, ip, port, host string) ([]*x509.Certificate, error) {
+	d := &net.Dialer{Timeout: c.timeout()}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout()))
+	// We check the certificate ourselves so a bad one is a finding and not a failed handshake
+	client := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err = client.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := client.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s sent no certificate", host)
+	}
+	return certs, nil
+}
+
+// certProblems are what is wrong with the certificate of the host
+func certProblems(certs []*x509.Certificate, host string, now time.Time) []string {
+	leaf := certs[0]
+	var problems []string
+	if now.After(leaf.NotAfter) {
+		problems = append(problems, "expired")
+	} else if now.Before(leaf.NotBefore) {
+		problems = append(problems, "not yet valid")
+	}
+	// CheckSignatureFrom would need the certificate to be a CA
+	if bytes.Equal(leaf.RawIssuer, leaf.RawSubject) && leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature) == nil {
+		problems = append(problems, "self-signed")
+	}
+	if leaf.VerifyHostname(host) != nil {
+		problems = append(problems, "name mismatch")
+	}
+	return problems
+}
+
+// certIssuer is the organization of the issuer, its common name if it has none
+func certIssuer(cert *x509.Certificate) string {
+	if len(cert.Issuer.Organization) > 0 {
+		return cert.Issuer.Organization[0]
+	}
+	return cert.Issuer.CommonName
+}
+
+func (c *certScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res := domain.SourceResult{Result: domain.ResultUnknown, NotFound: true}
+	u, err := url.Parse(indicator.Value)
+	if err != nil || !strings.EqualFold(u.Scheme, "https") || u.Hostname() == "" {
+		return res, nil
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	// Failing to connect says nothing about the URL so it is information and not an error of the source
+	res.NotFound, res.Info = false, true
+	ip, err := c.address(ctx, host)
+	if err == nil && ip == "" {
+		res.NotFound = true
+		return res, nil
+	}
+	var certs []*x509.Certificate
+	if err == nil {
+		certs, err = c.certificates(ctx, ip, port, host)
+	}
+	if err != nil {
+		res.Score, res.Detail = "unreachable", "Unable to connect: "+err.Error()
+		return res, nil
+	}
+	leaf, now := certs[0], c.now()
+	age := int(now.Sub(leaf.NotBefore).Hours() / 24)
+	problems := certProblems(certs, host, now)
+	res.Score = fmt.Sprintf("issued %dd ago by %s", age, certIssuer(leaf))
+	if len(problems) > 0 {
+		res.Score += " (" + strings.Join(problems, ", ") + ")"
+	}
+	if age < conf.Options.Certificates.YoungDays && !now.Before(leaf.NotBefore) {
+		res.Info, res.Result, res.Weak, res.Value = false, domain.ResultDirty, true, float64(age)
+	}
+	names := leaf.DNSNames
+	if len(names) > certMaxNames {
+		names = append(names[:certMaxNames:certMaxNames], fmt.Sprintf("and %d more", len(leaf.DNSNames)-certMaxNames))
+	}
+	lines := []string{
+		"Issuer: " + leaf.Issuer.String(),
+		"Subject: " + leaf.Subject.String(),
+		fmt.Sprintf("Valid: %s to %s", leaf.NotBefore.UTC().Format("2006-01-02"), leaf.NotAfter.UTC().Format("2006-01-02")),
+	}
+	if len(names) > 0 {
+		lines = append(lines, "Names: "+strings.Join(names, ", "))
+	}
+	if len(problems) > 0 {
+		lines = append(lines, "Problems: "+strings.Join(problems, ", "))
+	}
+	res.Detail = strings.Join(lines, "\n")
+	return res, nil
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// certTestServer does the handshake with a self-signed certificate for the names, valid from notBefore for a year
+func certTestServer(t *testing.T, notBefore time.Time, names ...string) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0], Organization: []string{"Test Issuer"}},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(365 * 24 * time.Hour),
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// testCertScanner connects to the local servers
+func testCertScanner(now time.Time) *certScanner {
+	return &certScanner{resolver: net.DefaultResolver, routable: func(string) bool { return true }, now: func() time.Time { return now }}
+}
+
+func TestCertScanner(t *testing.T) {
+	saved := conf.Options.Certificates
+	defer func() { conf.Options.Certificates = saved }()
+	conf.Options.Certificates.Timeout, conf.Options.Certificates.YoungDays = 2, 3
+	now := time.Now()
+	young := certTestServer(t, now.Add(-24*time.Hour), "127.0.0.1", "evil.com")
+	defer young.Close()
+	c := testCertScanner(now)
+	res, err := c.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "https://" + young.Addr().String() + "/login"})
+	if err != nil || res.NotFound || res.Info || !res.Weak || res.Result != domain.ResultDirty ||
+		res.Score != "issued 1d ago by Test Issuer (self-signed, name mismatch)" {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	for _, expected := range []string{"Subject: CN=127.0.0.1,O=Test Issuer", "Names: 127.0.0.1, evil.com", "Problems: self-signed, name mismatch"} {
+		if !strings.Contains(res.Detail, expected) {
+			t.Errorf("expected %q in the detail but got %s", expected, res.Detail)
+		}
+	}
+	// A young certificate alone makes the URL suspicious
+	res.Source = domain.SourceTLS
+	if verdict := new(domain.ScoringProfile).Verdict([]domain.SourceResult{res}, domain.ResultUnknown); verdict != domain.ResultSuspicious {
+		t.Errorf("expected a suspicious verdict but got %d", verdict)
+	}
+	// An old certificate is information, this one expired
+	old := certTestServer(t, now.Add(-400*24*time.Hour), "127.0.0.1")
+	defer old.Close()
+	res, err = c.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "https://" + old.Addr().String()})
+	if err != nil || res.NotFound || !res.Info || res.Weak || !strings.HasPrefix(res.Score, "issued 400d ago by Test Issuer (expired, self-signed") {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+}
+
+func TestCertScannerSkips(t *testing.T) {
+	saved := conf.Options.Certificates
+	defer func() { conf.Options.Certificates = saved }()
+	conf.Options.Certificates.Timeout = 2
+	c := testCertScanner(time.Now())
+	// Nothing listens on the port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	res, err := c.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "https://" + addr})
+	if err != nil || res.NotFound || !res.Info || res.Score != "unreachable" || res.Error != "" {
+		t.Errorf("expected unreachable but got %+v - %v", res, err)
+	}
+	// Only https URLs have certificates
+	res, err = c.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "http://example.com"})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+	// We never connect to private hosts
+	c.routable = func(ip string) bool { return ip != "10.0.0.1" }
+	res, err = c.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "https://10.0.0.1/admin"})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+	c = &certScanner{resolver: net.DefaultResolver, routable: func(string) bool { return false }, now: time.Now}
+	res, err = c.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "https://localhost:" + strings.Split(addr, ":")[1]})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no data for localhost but got %+v - %v", res, err)
+	}
+}
@@ -0,0 +1,150 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// urlhausURL is the public API of abuse.ch URLhaus. Replaced by the tests.
+var urlhausURL = "https://urlhaus-api.abuse.ch/v1"
+
+// urlhausScanner checks URLs and the MD5 and SHA-256 of files with URLhaus. It only knows malicious ones so a hit
+// convicts the indicator and anything else is no data and never clean.
+type urlhausScanner struct {
+	url string
+	c   *http.Client
+}
+
+// newURLhausScanner ignores the credentials, the API needs no key
+func newURLhausScanner(creds domain.Credentials) (Scanner, error) {
+	return &urlhausScanner{url: urlhausURL, c: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (u *urlhausScanner) Name() string {
+	return domain.SourceURLhaus
+}
+
+func (u *urlhausScanner) Supports(indicatorType int) bool {
+	return indicatorType == domain.ReplyTypeURL || indicatorType == domain.ReplyTypeHash
+}
+
+// urlhausURLReply is the answer of the url endpoint
+type urlhausURLReply struct {
+	QueryStatus string   `json:"query_status"`
+	URLStatus   string   `json:"url_status"`
+	Threat      string   `json:"threat"`
+	Tags        []string `json:"tags"`
+	DateAdded   string   `json:"date_added"`
+	Reference   string   `json:"urlhaus_reference"`
+}
+
+// urlhausPayloadReply is the answer of the payload endpoint
+type urlhausPayloadReply struct {
+	QueryStatus string `json:"query_status"`
+	SHA256      string `json:"sha256_hash"`
+	FileType    string `json:"file_type"`
+	Signature   string `json:"signature"`
+	FirstSeen   string `json:"firstseen"`
+}
+
+// post the form to the endpoint and decode the answer
+func (u *urlhausScanner) post(ctx context.Context, endpoint string, form url.Values, out interface{}) error {
+	req, err := http.NewRequest("POST", u.url+endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := u.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("URLhaus returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// urlhausStatus checks the query status. No results and indicators URLhaus cannot look up (e.g. invalid_url) are no
+// data, other statuses are errors.
+func urlhausStatus(status string) (bool, error) {
+	switch {
+	case status == "ok":
+		return true, nil
+	case status == "no_results" || strings.HasPrefix(status, "invalid_"):
+		return false, nil
+	}
+	return false, fmt.Errorf("URLhaus returned %s", status)
+}
+
+// urlhausDetail lists the threat, the tags and when URLhaus first saw the indicator
+func urlhausDetail(threat string, tags []string, firstSeen string) string {
+	lines := []string{"Threat: " + threat}
+	if len(tags) > 0 {
+		lines = append(lines, "Tags: "+strings.Join(tags, ", "))
+	}
+	return strings.Join(append(lines, "First Seen: "+firstSeen), "\n")
+}
+
+func (u *urlhausScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	res := domain.SourceResult{Result: domain.ResultUnknown, NotFound: true}
+	if indicator.Type == domain.ReplyTypeURL {
+		var r urlhausURLReply
+		if err := u.post(ctx, "/url/", url.Values{"url": {indicator.Value}}, &r); err != nil {
+			return res, err
+		}
+		hit, err := urlhausStatus(r.QueryStatus)
+		if !hit {
+			return res, err
+		}
+		res.NotFound, res.Result, res.Link = false, domain.ResultDirty, r.Reference
+		res.Score = r.Threat
+		if r.URLStatus != "" {
+			res.Score += " (" + r.URLStatus + ")"
+		}
+		res.Detail = urlhausDetail(r.Threat, r.Tags, r.DateAdded)
+		return res, nil
+	}
+	// The payloads are only indexed by MD5 and SHA-256
+	var field string
+	switch len(indicator.Value) {
+	case 32:
+		field = "md5_hash"
+	case 64:
+		field = "sha256_hash"
+	default:
+		return res, nil
+	}
+	var r urlhausPayloadReply
+	if err := u.post(ctx, "/payload/", url.Values{field: {indicator.Value}}, &r); err != nil {
+		return res, err
+	}
+	hit, err := urlhausStatus(r.QueryStatus)
+	if !hit {
+		return res, err
+	}
+	// Every payload on URLhaus was downloaded from a malware site
+	res.NotFound, res.Result = false, domain.ResultDirty
+	res.Score = r.Signature
+	if res.Score == "" {
+		res.Score = "Malware download"
+	}
+	res.Link = "https://urlhaus.abuse.ch/browse.php?search=" + r.SHA256
+	var tags []string
+	for _, t := range []string{r.FileType, r.Signature} {
+		if t != "" {
+			tags = append(tags, t)
+		}
+	}
+	res.Detail = urlhausDetail("malware_download", tags, r.FirstSeen)
+	return res, nil
+}
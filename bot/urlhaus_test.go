@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// urlhausServer answers the queries with the canned responses by the queried value
+func urlhausServer(t *testing.T, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		r.ParseForm()
+		for _, field := range []string{"url", "md5_hash", "sha256_hash"} {
+			if body, ok := responses[r.URL.Path+" "+r.PostForm.Get(field)]; ok {
+				w.Write([]byte(body))
+				return
+			}
+		}
+		w.Write([]byte(`{"query_status":"no_results"}`))
+	}))
+}
+
+func TestURLhausScan(t *testing.T) {
+	srv := urlhausServer(t, map[string]string{
+		"/url/ http://evil.com/x.exe": `{"query_status":"ok","url_status":"online","threat":"malware_download",
+"tags":["elf","mozi"],"date_added":"2020-01-01 10:00:00 UTC","urlhaus_reference":"https://urlhaus.abuse.ch/url/1/"}`,
+		"/payload/ 44d88612fea8a8f36de82e1278abb02f": `{"query_status":"ok","sha256_hash":"275a021b","file_type":"exe",
+"signature":"Emotet","firstseen":"2020-02-01 10:00:00"}`,
+	})
+	defer srv.Close()
+	u := &urlhausScanner{url: srv.URL, c: http.DefaultClient}
+	res, err := u.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "http://evil.com/x.exe"})
+	if err != nil || res.NotFound || res.Result != domain.ResultDirty || res.Score != "malware_download (online)" ||
+		res.Link != "https://urlhaus.abuse.ch/url/1/" {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	for _, expected := range []string{"Threat: malware_download", "Tags: elf, mozi", "First Seen: 2020-01-01 10:00:00 UTC"} {
+		if !strings.Contains(res.Detail, expected) {
+			t.Errorf("expected %q in the detail but got %s", expected, res.Detail)
+		}
+	}
+	res, err = u.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeHash, Value: "44d88612fea8a8f36de82e1278abb02f"})
+	if err != nil || res.Result != domain.ResultDirty || res.Score != "Emotet" || !strings.Contains(res.Detail, "First Seen: 2020-02-01") {
+		t.Errorf("unexpected result %+v - %v", res, err)
+	}
+	// No results is no data and not clean
+	res, err = u.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeURL, Value: "http://example.com"})
+	if err != nil || !res.NotFound || res.Result != domain.ResultUnknown {
+		t.Errorf("expected no data but got %+v - %v", res, err)
+	}
+	if new(domain.ScoringProfile).Verdict([]domain.SourceResult{res}, domain.ResultUnknown) != domain.ResultUnknown {
+		t.Error("no results must not make the indicator clean")
+	}
+	// URLhaus does not index SHA-1
+	res, err = u.Scan(context.Background(), scanIndicator{Type: domain.ReplyTypeHash, Value: "3395856ce81f2b7382dee72602f798b642f14140"})
+	if err != nil || !res.NotFound {
+		t.Errorf("expected no data for a SHA-1 but got %+v - %v", res, err)
+	}
+}
@@ -0,0 +1,524 @@
+package bot
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/slavikm/govt"
+)
+
+// The VirusTotal API versions
+const (
+	vtAuto = 0 // Use v3 if the key works with it
+	vtV2   = 2
+	vtV3   = 3
+)
+
+const (
+	// vtAttempts is how many times we send a request that was rate limited
+	vtAttempts = 3
+	// vtMaxRetryAfter is the longest Retry-After we wait for, we give up if VirusTotal asks for more
+	vtMaxRetryAfter = time.Minute
+	// vtProbeRetry is how long we use v2 for a key we could not probe before we try again
+	vtProbeRetry = 10 * time.Minute
+	// vtRelatedURLs is how many of the URLs of an IP or a domain we check for detections
+	vtRelatedURLs = 40
+)
+
+var (
+	// vt3URL is the v3 API. Replaced by the tests.
+	vt3URL = "https://www.virustotal.com/api/v3"
+	// vtSleep waits for the rate limit. Replaced by the tests.
+	vtSleep = time.Sleep
+	// vtHTTPClient is shared by the v3 clients of all the keys
+	vtHTTPClient = &http.Client{Timeout: 30 * time.Second}
+	// vtSchedule spaces the lookups of each key to its rate limit
+	vtSchedule = newKeySchedule()
+)
+
+// vtInterval between the lookups of the key, 0 if it is not limited
+func vtInterval(key string) time.Duration {
+	perMinute := conf.Options.VTRate.TeamRequestsPerMinute
+	if key == conf.Options.VT {
+		perMinute = conf.Options.VTRate.RequestsPerMinute
+	}
+	if perMinute <= 0 {
+		return 0
+	}
+	return time.Minute / time.Duration(perMinute)
+}
+
+// vtRateLimited checks if VirusTotal refused the lookup because the key is over its quota - v2 answers 204 without a
+// body and v3 answers 429
+func vtRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range []string{"status code: 204", "204 No Content", "429 Too Many Requests", "QuotaExceededError", "VirusTotal rate limit"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// vtClient looks up VirusTotal reports. The v3 client returns the objects in the shape of the v2 reports so the
+// verdicts, the replies and the vt command work the same with both versions.
+type vtClient interface {
+	GetFileReport(hash string) (*govt.FileReport, error)
+	GetUrlReport(url string) (*govt.UrlReport, error)
+	GetIpReport(ip string) (*govt.IpReport, error)
+	GetDomainReport(domain string) (*govt.DomainReport, error)
+}
+
+// vtProbe is the API version that works with a key
+type vtProbe struct {
+	version int
+	ts      time.Time
+	final   bool // The probe got an answer, otherwise we try again after vtProbeRetry
+}
+
+var (
+	vtProbesMu sync.Mutex
+	vtProbes   = make(map[string]vtProbe)
+)
+
+// newVTClient returns a VirusTotal client with the given key for the configured API version, by default v3 if the
+// key works with it
+func newVTClient(key string) (vtClient, error) {
+	if vtKeyVersion(key) == vtV3 {
+		return newVT3Client(vt3URL, key), nil
+	}
+	return govt.New(govt.SetApikey(key), govt.SetErrorLog(log.New(conf.LogWriter, "VT:", log.Lshortfile)))
+}
+
+// vtKeyVersion returns the API version we use for the key, probing v3 once per key if it is not configured
+func vtKeyVersion(key string) int {
+	if conf.Options.VTVersion != vtAuto {
+		return conf.Options.VTVersion
+	}
+	vtProbesMu.Lock()
+	p, ok := vtProbes[key]
+	vtProbesMu.Unlock()
+	if ok && (p.final || time.Since(p.ts) < vtProbeRetry) {
+		return p.version
+	}
+	p = vtProbe{version: vtV2, ts: time.Now()}
+	switch err := newVT3Client(vt3URL, key).probe(); {
+	case err == nil:
+		p.version, p.final = vtV3, true
+	case err == errVTForbidden:
+		p.final = true
+	}
+	vtProbesMu.Lock()
+	vtProbes[key] = p
+	vtProbesMu.Unlock()
+	return p.version
+}
+
+var (
+	// errVTNotFound is returned for objects VirusTotal does not know, the reports have response code 0 like in v2
+	errVTNotFound = errors.New("not found in VirusTotal")
+	// errVTForbidden is returned if the key does not work with v3
+	errVTForbidden = errors.New("the key is not allowed to use the VirusTotal v3 API")
+)
+
+// vt3Client talks to the v3 API
+type vt3Client struct {
+	url string
+	key string
+	c   *http.Client
+}
+
+// vt3Stats is the last_analysis_stats of an object
+type vt3Stats struct {
+	Harmless   uint16 `json:"harmless"`
+	Malicious  uint16 `json:"malicious"`
+	Suspicious uint16 `json:"suspicious"`
+	Undetected uint16 `json:"undetected"`
+	Timeout    uint16 `json:"timeout"`
+}
+
+// total is the number of engines that gave a verdict, like the total of v2
+func (s *vt3Stats) total() uint16 {
+	return s.Harmless + s.Malicious + s.Suspicious + s.Undetected + s.Timeout
+}
+
+// vt3Analysis is the result of an engine in last_analysis_results
+type vt3Analysis struct {
+	Category      string `json:"category"`
+	Result        string `json:"result"`
+	EngineVersion string `json:"engine_version"`
+	EngineUpdate  string `json:"engine_update"`
+}
+
+// vt3Attributes are the attributes of the file, URL, IP and domain objects we use
+type vt3Attributes struct {
+	MD5                 string                 `json:"md5"`
+	SHA1                string                 `json:"sha1"`
+	SHA256              string                 `json:"sha256"`
+	URL                 string                 `json:"url"`
+	LastAnalysisDate    int64                  `json:"last_analysis_date"`
+	LastAnalysisStats   vt3Stats               `json:"last_analysis_stats"`
+	LastAnalysisResults map[string]vt3Analysis `json:"last_analysis_results"`
+}
+
+type vt3Object struct {
+	ID         string        `json:"id"`
+	Type       string        `json:"type"`
+	Attributes vt3Attributes `json:"attributes"`
+}
+
+type vt3Error struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newVT3Client(u, key string) *vt3Client {
+	return &vt3Client{url: u, key: key, c: vtHTTPClient}
+}
+
+// get decodes the data of the path into out, waiting for the rate limit as VirusTotal asks
+func (v *vt3Client) get(path string, out interface{}) error {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("GET", v.url+path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-apikey", v.key)
+		req.Header.Set("Accept", "application/json")
+		resp, err := v.c.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < vtAttempts {
+			wait, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			if err != nil || wait < 0 {
+				wait = 1
+			}
+			if time.Duration(wait)*time.Second > vtMaxRetryAfter {
+				return fmt.Errorf("VirusTotal rate limit, retry after %d seconds", wait)
+			}
+			vtSleep(time.Duration(wait) * time.Second)
+			continue
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return json.NewDecoder(resp.Body).Decode(&struct {
+				Data interface{} `json:"data"`
+			}{out})
+		case http.StatusNotFound:
+			return errVTNotFound
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return errVTForbidden
+		}
+		var e vt3Error
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Code != "" {
+			return fmt.Errorf("VirusTotal returned %s - %s", e.Error.Code, e.Error.Message)
+		}
+		return fmt.Errorf("VirusTotal returned %s", resp.Status)
+	}
+}
+
+// probe checks the key works with v3
+func (v *vt3Client) probe() error {
+	var ip vt3Object
+	return v.get("/ip_addresses/"+keyCheckIP, &ip)
+}
+
+// vtScanDate formats the analysis date like the v2 scan_date
+func vtScanDate(date int64) string {
+	if date == 0 {
+		return ""
+	}
+	return time.Unix(date, 0).UTC().Format("2006-01-02 15:04:05")
+}
+
+// GetFileReport of the MD5, SHA-1 or SHA-256
+func (v *vt3Client) GetFileReport(hash string) (*govt.FileReport, error) {
+	r := &govt.FileReport{Resource: hash}
+	var file vt3Object
+	if err := v.get("/files/"+url.PathEscape(hash), &file); err != nil {
+		if err == errVTNotFound {
+			return r, nil
+		}
+		return nil, err
+	}
+	a := &file.Attributes
+	r.ResponseCode, r.ScanId, r.Md5, r.Sha1, r.Sha256 = 1, file.ID, a.MD5, a.SHA1, a.SHA256
+	r.ScanDate, r.Positives, r.Total = vtScanDate(a.LastAnalysisDate), a.LastAnalysisStats.Malicious, a.LastAnalysisStats.total()
+	r.Permalink = "https://www.virustotal.com/gui/file/" + a.SHA256
+	r.Scans = make(map[string]govt.FileScan)
+	for engine, res := range a.LastAnalysisResults {
+		r.Scans[engine] = govt.FileScan{Detected: res.Category == "malicious", Version: res.EngineVersion, Result: res.Result,
+			Update: res.EngineUpdate}
+	}
+	return r, nil
+}
+
+// vtURLID is the identifier of the URL object
+func vtURLID(u string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(u))
+}
+
+// GetUrlReport of the URL
+func (v *vt3Client) GetUrlReport(u string) (*govt.UrlReport, error) {
+	r := &govt.UrlReport{Url: u, Resource: u}
+	var obj vt3Object
+	if err := v.get("/urls/"+vtURLID(u), &obj); err != nil {
+		if err == errVTNotFound {
+			return r, nil
+		}
+		return nil, err
+	}
+	a := &obj.Attributes
+	r.ResponseCode, r.ScanId, r.ScanDate = 1, obj.ID, vtScanDate(a.LastAnalysisDate)
+	r.Positives, r.Total = a.LastAnalysisStats.Malicious, a.LastAnalysisStats.total()
+	r.Permalink = "https://www.virustotal.com/gui/url/" + obj.ID
+	r.Scans = make(map[string]govt.UrlScan)
+	for engine, res := range a.LastAnalysisResults {
+		r.Scans[engine] = govt.UrlScan{Detected: res.Category == "malicious", Result: res.Result}
+	}
+	return r, nil
+}
+
+// detectedURLs returns the related URLs of the object with detections like the v2 detected_urls. The relationship
+// is not available to every key so we only return the error if the object itself is unknown.
+func (v *vt3Client) detectedURLs(collection, id string) (int, []govt.DetectedUrl, error) {
+	var obj vt3Object
+	if err := v.get("/"+collection+"/"+url.PathEscape(id), &obj); err != nil {
+		if err == errVTNotFound {
+			return 0, nil, nil
+		}
+		return 0, nil, err
+	}
+	var related []vt3Object
+	if err := v.get(fmt.Sprintf("/%s/%s/urls?limit=%d", collection, url.PathEscape(id), vtRelatedURLs), &related); err != nil {
+		return 1, nil, nil
+	}
+	var detected []govt.DetectedUrl
+	for i := range related {
+		a := &related[i].Attributes
+		if a.LastAnalysisStats.Malicious > 0 {
+			detected = append(detected, govt.DetectedUrl{Url: a.URL, Positives: a.LastAnalysisStats.Malicious,
+				Total: a.LastAnalysisStats.total(), ScanDate: vtScanDate(a.LastAnalysisDate)})
+		}
+	}
+	return 1, detected, nil
+}
+
+// GetIpReport of the IP with the detected URLs on it
+func (v *vt3Client) GetIpReport(ip string) (*govt.IpReport, error) {
+	code, detected, err := v.detectedURLs("ip_addresses", ip)
+	if err != nil {
+		return nil, err
+	}
+	r := &govt.IpReport{DetectedUrls: detected}
+	r.ResponseCode = code
+	return r, nil
+}
+
+// GetDomainReport of the domain with the detected URLs on it
+func (v *vt3Client) GetDomainReport(d string) (*govt.DomainReport, error) {
+	code, detected, err := v.detectedURLs("domains", d)
+	if err != nil {
+		return nil, err
+	}
+	r := &govt.DomainReport{DetectedUrls: detected}
+	r.ResponseCode = code
+	return r, nil
+}
+
+// vtScanner checks hashes, URLs, IPs and domains with VirusTotal
+type vtScanner struct {
+	key     string
+	teamKey string // Set if the key is the one of the team
+}
+
+// newVTScanner uses the team key if it has one, ours otherwise
+func newVTScanner(creds domain.Credentials) (Scanner, error) {
+	key := creds.Key
+	if key == "" {
+		key = conf.Options.VT
+	}
+	return &vtScanner{key: key, teamKey: creds.Key}, nil
+}
+
+func (v *vtScanner) Name() string {
+	return domain.SourceVT
+}
+
+// breakerKey is per team key so a team with a bad or throttled key does not stop the checks of the others
+func (v *vtScanner) breakerKey() string {
+	return teamBreakerKey(domain.SourceVT, v.teamKey)
+}
+
+func (v *vtScanner) Supports(indicatorType int) bool {
+	switch indicatorType {
+	case domain.ReplyTypeHash, domain.ReplyTypeURL, domain.ReplyTypeIP, domain.ReplyTypeDomain:
+		return true
+	}
+	return false
+}
+
+// vtResult is the result with the positives, dirty from the number of positives to convict
+func vtResult(positives uint16, convict int) int {
+	if int(positives) >= convict {
+		return domain.ResultDirty
+	}
+	return domain.ResultClean
+}
+
+// turn waits for the turn of the lookup with the rate limit of the key. Lookups that can be queued only go if it is
+// their turn now and the others wait for it within the timeout of the scan.
+func (v *vtScanner) turn(ctx context.Context, indicator scanIndicator) bool {
+	switch {
+	case indicator.Scheduled:
+		return true
+	case indicator.Queue:
+		now := time.Now()
+		_, ok := vtSchedule.reserve(v.key, vtInterval(v.key), now, now)
+		return ok
+	}
+	return vtSchedule.wait(ctx, v.key, vtInterval(v.key))
+}
+
+// wait for the turn of a pending lookup
+func (v *vtScanner) wait(ctx context.Context) bool {
+	return vtSchedule.wait(ctx, v.key, vtInterval(v.key))
+}
+
+// Scan creates the client for every indicator so a key we could not probe is probed again. Lookups that do not get
+// their turn with the rate limit of the key and the ones VirusTotal refuses for the quota of the key are pending.
+func (v *vtScanner) Scan(ctx context.Context, indicator scanIndicator) (res domain.SourceResult, err error) {
+	res = domain.SourceResult{Result: domain.ResultUnknown}
+	if !v.turn(ctx, indicator) {
+		pendingScansTotal.Inc(domain.SourceVT, "queued")
+		res.Pending = true
+		return res, nil
+	}
+	defer func() {
+		if vtRateLimited(err) {
+			vtSchedule.backoff(v.key, time.Now().Add(time.Duration(conf.Options.VTRate.Backoff)*time.Second))
+			pendingScansTotal.Inc(domain.SourceVT, "throttled")
+			res.Pending, err = true, nil
+		}
+	}()
+	vt, err := newVTClient(v.key)
+	if err != nil {
+		return res, err
+	}
+	switch indicator.Type {
+	case domain.ReplyTypeHash:
+		rep := &domain.VtHashReply{}
+		res.Report = rep
+		r, err := vt.GetFileReport(indicator.Value)
+		if err != nil {
+			rep.Error = err.Error()
+			return res, err
+		}
+		rep.FileReport = *r
+		if res.NotFound = r.ResponseCode != 1; !res.NotFound {
+			res.Result, res.Value = vtResult(r.Positives, numOfPositivesToConvictForFiles), float64(r.Positives)
+			res.Score, res.Link = fmt.Sprintf("%v / %v", r.Positives, r.Total), r.Permalink
+			res.Detail = "Scan Date: " + r.ScanDate
+			if detections := vtDetections(r); len(detections) > 0 {
+				res.Detail += "\nDetections:\n" + strings.Join(detections, "\n")
+			}
+		}
+	case domain.ReplyTypeURL:
+		rep := &domain.VtURLReply{}
+		res.Report = rep
+		r, err := vt.GetUrlReport(indicator.Value)
+		if err != nil {
+			rep.Error = err.Error()
+			return res, err
+		}
+		rep.URLReport = *r
+		if res.NotFound = r.ResponseCode != 1; !res.NotFound {
+			res.Result, res.Value = vtResult(r.Positives, numOfPositivesToConvict), float64(r.Positives)
+			res.Score, res.Link = fmt.Sprintf("%v / %v", r.Positives, r.Total), r.Permalink
+			res.Detail = "Scan Date: " + r.ScanDate
+		}
+	case domain.ReplyTypeIP:
+		rep := &domain.VtIPReply{}
+		res.Report = rep
+		r, err := vt.GetIpReport(indicator.Value)
+		if err != nil {
+			rep.Error = err.Error()
+			return res, err
+		}
+		rep.IPReport = *r
+		// The detected URLs might be unrelated sites sharing the IP so they only count if no other source knows it
+		res.Weak = true
+		if res.NotFound = r.ResponseCode != 1; !res.NotFound {
+			positives := recentPositives(r.DetectedUrls)
+			res.Result, res.Value = vtResult(positives, numOfPositivesToConvict), float64(positives)
+			res.Score = fmt.Sprintf("%d detected URLs, max %v positives", len(r.DetectedUrls), positives)
+			res.Link = "https://www.virustotal.com/en/search?query=" + indicator.Value
+			res.Detail = vtDetectedURLs(r.DetectedUrls)
+		}
+	case domain.ReplyTypeDomain:
+		rep := &domain.VtDomainReply{}
+		res.Report = rep
+		r, err := vt.GetDomainReport(indicator.Value)
+		if err != nil {
+			rep.Error = err.Error()
+			return res, err
+		}
+		rep.DomainReport = *r
+		if res.NotFound = r.ResponseCode != 1; !res.NotFound {
+			positives := recentPositives(r.DetectedUrls)
+			res.Result, res.Value = vtResult(positives, numOfPositivesToConvict), float64(positives)
+			res.Score = fmt.Sprintf("%d detected URLs, max %v positives", len(r.DetectedUrls), positives)
+			res.Link = "https://www.virustotal.com/en/domain/" + indicator.Value + "/information/"
+		}
+	default:
+		res.NotFound = true
+	}
+	return res, nil
+}
+
+// vtDetections are the engines that detected the file on VirusTotal with what they called it, sorted by engine
+func vtDetections(r *govt.FileReport) []string {
+	var detections []string
+	for engine, scan := range r.Scans {
+		if scan.Detected {
+			detections = append(detections, engine+": "+scan.Result)
+		}
+	}
+	sort.Strings(detections)
+	return detections
+}
+
+// vtDetectedURLs lists the latest 20 detected URLs
+func vtDetectedURLs(detected []govt.DetectedUrl) string {
+	urls := append([]govt.DetectedUrl{}, detected...)
+	sort.Sort(sort.Reverse(IPByDate(urls)))
+	var list string
+	for i := range urls {
+		if i == 20 {
+			break
+		}
+		list += fmt.Sprintf("URL: %s, Positives: %v, Total: %v, Date: %s", defangURL(urls[i].Url), urls[i].Positives, urls[i].Total, urls[i].ScanDate) + "\n"
+	}
+	return list
+}
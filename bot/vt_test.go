@@ -0,0 +1,219 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+)
+
+// vt3Server answers the v3 API requests with the canned responses by path
+func vt3Server(t *testing.T, responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-apikey") != "k3y" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"code":"WrongCredentialsError","message":"Wrong API key"}}`))
+			return
+		}
+		body, ok := responses[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"NotFoundError","message":"not found"}}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+const vt3File = `{"data":{"id":"275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f","type":"file","attributes":{
+"md5":"44d88612fea8a8f36de82e1278abb02f","sha256":"275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f",
+"last_analysis_date":1514764800,"last_analysis_stats":{"harmless":0,"malicious":60,"suspicious":2,"undetected":8,"timeout":0,"type-unsupported":5},
+"last_analysis_results":{"Engine":{"category":"malicious","result":"EICAR","engine_version":"1.0","engine_update":"20180101"}}}}}`
+
+func TestVT3FileReport(t *testing.T) {
+	srv := vt3Server(t, map[string]string{"/files/44d88612fea8a8f36de82e1278abb02f": vt3File})
+	defer srv.Close()
+	vt := newVT3Client(srv.URL, "k3y")
+	r, err := vt.GetFileReport("44d88612fea8a8f36de82e1278abb02f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ResponseCode != 1 || r.Positives != 60 || r.Total != 70 || r.ScanDate != "2018-01-01 00:00:00" ||
+		r.Permalink != "https://www.virustotal.com/gui/file/275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f" ||
+		!r.Scans["Engine"].Detected || r.Scans["Engine"].Result != "EICAR" {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if r, err = vt.GetFileReport("d41d8cd98f00b204e9800998ecf8427e"); err != nil || r.ResponseCode != 0 {
+		t.Errorf("expected an unknown file to be not found but got %+v - %v", r, err)
+	}
+	if _, err = newVT3Client(srv.URL, "bad").GetFileReport("44d88612fea8a8f36de82e1278abb02f"); err != errVTForbidden {
+		t.Errorf("expected a bad key to be forbidden but got %v", err)
+	}
+}
+
+func TestVT3IPReport(t *testing.T) {
+	srv := vt3Server(t, map[string]string{
+		"/ip_addresses/1.2.3.4": `{"data":{"id":"1.2.3.4","type":"ip_address","attributes":{"last_analysis_stats":{"malicious":3}}}}`,
+		"/ip_addresses/1.2.3.4/urls?limit=40": `{"data":[
+{"id":"a","type":"url","attributes":{"url":"http://1.2.3.4/evil","last_analysis_date":1514764800,"last_analysis_stats":{"malicious":9,"harmless":61}}},
+{"id":"b","type":"url","attributes":{"url":"http://1.2.3.4/","last_analysis_date":1514764800,"last_analysis_stats":{"harmless":70}}}]}`,
+		"/domains/evil.com": `{"data":{"id":"evil.com","type":"domain","attributes":{}}}`,
+	})
+	defer srv.Close()
+	vt := newVT3Client(srv.URL, "k3y")
+	r, err := vt.GetIpReport("1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ResponseCode != 1 || len(r.DetectedUrls) != 1 || r.DetectedUrls[0].Url != "http://1.2.3.4/evil" ||
+		r.DetectedUrls[0].Positives != 9 || r.DetectedUrls[0].Total != 70 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	// The relationship is not available to every key
+	d, err := vt.GetDomainReport("evil.com")
+	if err != nil || d.ResponseCode != 1 || len(d.DetectedUrls) != 0 {
+		t.Errorf("unexpected report %+v - %v", d, err)
+	}
+}
+
+func TestVT3URLReport(t *testing.T) {
+	id := vtURLID("http://evil.com/a?b=c")
+	if id != "aHR0cDovL2V2aWwuY29tL2E_Yj1j" {
+		t.Errorf("unexpected URL identifier %s", id)
+	}
+	srv := vt3Server(t, map[string]string{"/urls/" + id: `{"data":{"id":"` + id + `","type":"url","attributes":{
+"url":"http://evil.com/a?b=c","last_analysis_date":1514764800,"last_analysis_stats":{"malicious":7,"harmless":60,"undetected":3},
+"last_analysis_results":{"Engine":{"category":"malicious","result":"phishing"}}}}}`})
+	defer srv.Close()
+	r, err := newVT3Client(srv.URL, "k3y").GetUrlReport("http://evil.com/a?b=c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ResponseCode != 1 || r.Positives != 7 || r.Total != 70 || r.ScanDate != "2018-01-01 00:00:00" ||
+		r.Permalink != "https://www.virustotal.com/gui/url/"+id {
+		t.Errorf("unexpected report %+v", r)
+	}
+}
+
+func TestVT3RateLimit(t *testing.T) {
+	defer func(sleep func(time.Duration)) { vtSleep = sleep }(vtSleep)
+	var waited []time.Duration
+	vtSleep = func(d time.Duration) { waited = append(waited, d) }
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(vt3File))
+	}))
+	defer srv.Close()
+	r, err := newVT3Client(srv.URL, "k3y").GetFileReport("44d88612fea8a8f36de82e1278abb02f")
+	if err != nil || r.Positives != 60 {
+		t.Fatalf("unexpected report %+v - %v", r, err)
+	}
+	if len(waited) != 1 || waited[0] != 7*time.Second {
+		t.Errorf("expected to wait as asked but waited %v", waited)
+	}
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	if _, err = newVT3Client(limited.URL, "k3y").GetFileReport("44d88612fea8a8f36de82e1278abb02f"); err == nil ||
+		!strings.Contains(err.Error(), "rate limit") {
+		t.Errorf("expected to give up on a long wait but got %v", err)
+	}
+}
+
+func TestVTScannerRateLimit(t *testing.T) {
+	savedURL, savedVersion, savedSchedule, savedRate := vt3URL, conf.Options.VTVersion, vtSchedule, conf.Options.VTRate
+	defer func() {
+		vt3URL, conf.Options.VTVersion, vtSchedule, conf.Options.VTRate = savedURL, savedVersion, savedSchedule, savedRate
+	}()
+	srv := vt3Server(t, map[string]string{"/files/44d88612fea8a8f36de82e1278abb02f": vt3File})
+	defer srv.Close()
+	vt3URL, conf.Options.VTVersion, vtSchedule = srv.URL, vtV3, newKeySchedule()
+	conf.Options.VTRate.TeamRequestsPerMinute, conf.Options.VTRate.Backoff = 1, 60
+	s := &vtScanner{key: "k3y"}
+	indicator := scanIndicator{Type: domain.ReplyTypeHash, Value: "44d88612fea8a8f36de82e1278abb02f", Queue: true}
+	if res, err := s.Scan(context.Background(), indicator); err != nil || res.Pending || res.Value != 60 {
+		t.Fatalf("expected the first lookup to go but got %+v - %v", res, err)
+	}
+	if res, err := s.Scan(context.Background(), indicator); err != nil || !res.Pending {
+		t.Errorf("expected the second lookup to be pending but got %+v - %v", res, err)
+	}
+	indicator.Queue, indicator.Scheduled = false, true
+	if res, err := s.Scan(context.Background(), indicator); err != nil || res.Pending {
+		t.Errorf("expected the scheduled lookup to go but got %+v - %v", res, err)
+	}
+	// VirusTotal says the key is over its quota
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	vt3URL = limited.URL
+	if res, err := s.Scan(context.Background(), indicator); err != nil || !res.Pending {
+		t.Errorf("expected the refused lookup to be pending but got %+v - %v", res, err)
+	}
+	if _, ok := vtSchedule.reserve("k3y", 0, time.Now().Add(59*time.Second), time.Now().Add(59*time.Second)); ok {
+		t.Error("expected the key to back off")
+	}
+}
+
+func TestVTRateLimited(t *testing.T) {
+	for err, expected := range map[error]bool{
+		nil: false,
+		errors.New("Unexpected status code: 204"):                             true,
+		errors.New("VirusTotal returned QuotaExceededError - Quota exceeded"): true,
+		errors.New("VirusTotal returned 500 Internal Server Error"):           false,
+	} {
+		if vtRateLimited(err) != expected {
+			t.Errorf("expected %v for %v", expected, err)
+		}
+	}
+}
+
+func TestVTKeyVersion(t *testing.T) {
+	defer func(u string, version int) { vt3URL, conf.Options.VTVersion = u, version }(vt3URL, conf.Options.VTVersion)
+	srv := vt3Server(t, map[string]string{"/ip_addresses/" + keyCheckIP: `{"data":{"id":"8.8.8.8","type":"ip_address","attributes":{}}}`})
+	defer srv.Close()
+	vt3URL, conf.Options.VTVersion = srv.URL, vtAuto
+	if v := vtKeyVersion("k3y"); v != vtV3 {
+		t.Errorf("a key that works with v3 should use it but got v%d", v)
+	}
+	if v := vtKeyVersion("v2-only"); v != vtV2 {
+		t.Errorf("a key that v3 rejects should use v2 but got v%d", v)
+	}
+	if _, ok := vtProbes["v2-only"]; !ok || !vtProbes["v2-only"].final {
+		t.Error("the probe should be kept")
+	}
+	srv.Close()
+	if v := vtKeyVersion("unknown"); v != vtV2 || vtProbes["unknown"].final {
+		t.Errorf("an unanswered probe should fall back to v2 and be tried again but got v%d", v)
+	}
+	conf.Options.VTVersion = vtV2
+	if _, ok := mustVTClient(t, "k3y").(*vt3Client); ok {
+		t.Error("the configured version should be used")
+	}
+	conf.Options.VTVersion = vtV3
+	if _, ok := mustVTClient(t, "v2-only").(*vt3Client); !ok {
+		t.Error("the configured version should be used")
+	}
+}
+
+func mustVTClient(t *testing.T, key string) vtClient {
+	vt, err := newVTClient(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vt
+}
@@ -0,0 +1,63 @@
+package bot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+	"strings"
+
+	"github.com/demisto/alfred/domain"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58Decode decodes a base58 string keeping the leading zero bytes
+func base58Decode(s string) ([]byte, bool) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, false
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), true
+}
+
+// validBTCAddress checks the Base58Check encoding of legacy (P2PKH) and script (P2SH) addresses.
+// A random identifier that happens to use the base58 alphabet fails the checksum.
+func validBTCAddress(address string) bool {
+	decoded, ok := base58Decode(address)
+	if !ok || len(decoded) != 25 || decoded[0] != 0x00 && decoded[0] != 0x05 {
+		return false
+	}
+	first := sha256.Sum256(decoded[:21])
+	second := sha256.Sum256(first[:])
+	return bytes.Equal(second[:4], decoded[21:])
+}
+
+// extractWallets returns the unique BTC and ETH addresses in the text. ETH addresses are lower cased.
+func extractWallets(text string) []domain.Wallet {
+	var res []domain.Wallet
+	seen := make(map[string]bool)
+	for _, a := range btcReg.FindAllString(text, -1) {
+		if !seen[a] && validBTCAddress(a) {
+			seen[a] = true
+			res = append(res, domain.Wallet{Value: a, Type: domain.WalletBTC})
+		}
+	}
+	for _, a := range ethReg.FindAllString(text, -1) {
+		a = strings.ToLower(a)
+		if !seen[a] {
+			seen[a] = true
+			res = append(res, domain.Wallet{Value: a, Type: domain.WalletETH})
+		}
+	}
+	return res
+}
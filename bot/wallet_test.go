@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestExtractWallets(t *testing.T) {
+	text := "pay 1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa or 3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy, not 1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb " +
+		"or 1BoatSLRHtKNngkdXEeobR76b53LETtpyX (bad checksum), eth 0x52908400098527886E0F7030069857D2E4169EE7 and again 0x52908400098527886e0f7030069857d2e4169ee7"
+	wallets := extractWallets(text)
+	expected := []domain.Wallet{
+		{Value: "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", Type: domain.WalletBTC},
+		{Value: "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy", Type: domain.WalletBTC},
+		{Value: "0x52908400098527886e0f7030069857d2e4169ee7", Type: domain.WalletETH},
+	}
+	if len(wallets) != len(expected) {
+		t.Fatalf("extractWallets = %v, expected %v", wallets, expected)
+	}
+	for i := range wallets {
+		if wallets[i] != expected[i] {
+			t.Errorf("extractWallets = %v, expected %v", wallets, expected)
+			break
+		}
+	}
+}
+
+func TestAbuseClient_Wallet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _, ok := r.BasicAuth(); !ok || user != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("address") == "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa" && r.URL.Query().Get("chain") == "BTC" {
+			fmt.Fprint(w, `[{"scamCategory":"RANSOMWARE"},{"scamCategory":"RANSOMWARE"},{"scamCategory":"SEXTORTION"}]`)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer ts.Close()
+	a := newAbuseClient(ts.URL, "key")
+	res, err := a.Wallet(domain.Wallet{Value: "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", Type: domain.WalletBTC})
+	if err != nil {
+		t.Fatalf("unexpected error - %v", err)
+	}
+	if res.Reports != 3 || len(res.Categories) != 2 {
+		t.Errorf("unexpected wallet reply %+v", res)
+	}
+	res, err = a.Wallet(domain.Wallet{Value: "0x52908400098527886e0f7030069857d2e4169ee7", Type: domain.WalletETH})
+	if err != nil || res.Reports != 0 {
+		t.Errorf("expected no reports but got %+v, %v", res, err)
+	}
+	if _, err = newAbuseClient(ts.URL, "").Wallet(domain.Wallet{Value: "x", Type: domain.WalletBTC}); err == nil {
+		t.Error("expected an error without a key")
+	}
+}
@@ -0,0 +1,225 @@
+package bot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/util"
+)
+
+const (
+	// webhookQueueSize bounds the verdicts waiting for delivery, more are dropped so replies never wait for a receiver
+	webhookQueueSize = 1000
+	// webhookWorkers deliver the verdicts in parallel so a slow receiver does not hold back the other teams
+	webhookWorkers = 4
+	// webhookAttempts is how many times we try to deliver a verdict
+	webhookAttempts = 4
+	// breakerFailures is how many verdicts of a team we fail to deliver in a row before we stop trying
+	breakerFailures = 5
+	// breakerCooldown is how long we stop trying, after it a single verdict is tried again
+	breakerCooldown = 5 * time.Minute
+)
+
+const (
+	// WebhookSignatureHeader holds v1=<hex HMAC-SHA256 of "v1:<timestamp>:<body>"> keyed with the team secret
+	WebhookSignatureHeader = "X-Alfred-Signature"
+	// WebhookTimestampHeader holds the unix time we signed the payload at so receivers can reject replays
+	WebhookTimestampHeader = "X-Alfred-Timestamp"
+)
+
+// webhookBackoff is the wait before the first retry, it doubles with every retry. Replaced by the tests.
+var webhookBackoff = time.Second
+
+var webhooksTotal = metrics.NewCounter("alfred_webhook_deliveries_total",
+	"Verdicts pushed to the team webhooks by the result of the delivery", "result")
+
+// indicatorTypeNames are the types of the indicators in the webhook events
+var indicatorTypeNames = map[int]string{
+	domain.ReplyTypeHash:   "hash",
+	domain.ReplyTypeURL:    "url",
+	domain.ReplyTypeIP:     "ip",
+	domain.ReplyTypeFile:   "file",
+	domain.ReplyTypeDomain: "domain",
+	domain.ReplyTypeCVE:    "cve",
+	domain.ReplyTypeEmail:  "email",
+	domain.ReplyTypeWallet: "wallet",
+}
+
+// webhookDelivery is a verdict waiting to be pushed to the webhook of the team
+type webhookDelivery struct {
+	team string
+	hook *domain.Webhook
+	body []byte
+}
+
+// breaker stops the deliveries to the webhook of a team that keeps failing
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+// webhooks delivers the verdicts in the background
+type webhooks struct {
+	queue    chan *webhookDelivery
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newWebhooks() *webhooks {
+	return &webhooks{queue: make(chan *webhookDelivery, webhookQueueSize), breakers: make(map[string]*breaker)}
+}
+
+// allow checks the breaker of the team is closed or its cooldown passed
+func (w *webhooks) allow(team string, now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	br := w.breakers[team]
+	return br == nil || !now.Before(br.openUntil)
+}
+
+// done records the result of a delivery, too many failures in a row open the breaker
+func (w *webhooks) done(team string, err error, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil {
+		delete(w.breakers, team)
+		return
+	}
+	br := w.breakers[team]
+	if br == nil {
+		br = &breaker{}
+		w.breakers[team] = br
+	}
+	br.failures++
+	if br.failures >= breakerFailures {
+		br.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+// signWebhook returns the signature of the body at the timestamp
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v1:" + ts + ":"))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts the signed body once. Network errors, throttling and server errors are worth a retry.
+func postWebhook(hook *domain.Webhook, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, ts)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(hook.Secret, ts, body))
+	resp, err := util.DoPublic(webhookClient, req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
+
+// TestWebhook sends a test event to the webhook once so admins can verify their receiver
+func TestWebhook(hook *domain.Webhook, team *domain.Team) error {
+	body, err := json.Marshal(&domain.WebhookEvent{Event: domain.WebhookEventTest, Team: team.ExternalID, TeamName: team.Name,
+		Indicator: "44d88612fea8a8f36de82e1278abb02f", Type: indicatorTypeNames[domain.ReplyTypeHash],
+		Verdict: strings.ToLower(verdictNames[domain.ResultDirty]), Sources: map[string]string{"vt": "60 / 70"}, Timestamp: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = postWebhook(hook, body)
+	return err
+}
+
+// queueVerdicts queues the verdicts of the reply that cross the threshold of the team webhook
+func (b *Bot) queueVerdicts(reply *domain.WorkReply, ctx *domain.Context, sub *subscription) {
+	if sub.webhook == nil {
+		return
+	}
+	now := time.Now().UTC()
+	for _, rec := range scanRecords(reply, ctx, sub) {
+		if !sub.webhook.Pushes(rec.Verdict) {
+			continue
+		}
+		body, err := json.Marshal(&domain.WebhookEvent{Event: domain.WebhookEventVerdict, Team: sub.team.ExternalID,
+			TeamName: sub.team.Name, Channel: rec.Channel, User: rec.User, Indicator: rec.Indicator,
+			Type: indicatorTypeNames[rec.IndicatorType], Verdict: strings.ToLower(verdictNames[rec.Verdict]),
+			Sources: rec.Scores, Permalink: rec.Permalink, Timestamp: now})
+		if err != nil {
+			replyLog(reply, ctx).WithError(err).Warn("Unable to marshal webhook event")
+			continue
+		}
+		select {
+		case b.webhooks.queue <- &webhookDelivery{team: sub.team.ExternalID, hook: sub.webhook, body: body}:
+		default:
+			webhooksTotal.Inc("dropped")
+			replyLog(reply, ctx).Warn("Too many verdicts waiting for webhooks, dropping verdict")
+		}
+	}
+}
+
+// startWebhooks starts the delivery workers. They return when the bot is stopped.
+func (b *Bot) startWebhooks() {
+	b.wg.Add(webhookWorkers)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			defer b.wg.Done()
+			for {
+				select {
+				case d := <-b.webhooks.queue:
+					b.deliverWebhook(d)
+				case <-b.ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// deliverWebhook tries the delivery with exponential backoff unless the breaker of the team is open
+func (b *Bot) deliverWebhook(d *webhookDelivery) {
+	if !b.webhooks.allow(d.team, time.Now()) {
+		webhooksTotal.Inc("circuit_open")
+		return
+	}
+	wait := webhookBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = postWebhook(d.hook, d.body); err == nil || !retry || attempt == webhookAttempts {
+			break
+		}
+		select {
+		case <-time.After(wait):
+		case <-b.ctx.Done():
+			return
+		}
+		wait *= 2
+	}
+	b.webhooks.done(d.team, err, time.Now())
+	if err != nil {
+		webhooksTotal.Inc("failed")
+		teamLog(d.team, "").WithError(err).Warn("Unable to deliver verdict to the team webhook")
+		return
+	}
+	webhooksTotal.Inc("delivered")
+	logrus.Debugf("Delivered verdict to the webhook of team %s", d.team)
+}
@@ -0,0 +1,157 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+// allowPrivateURLs lets the clients of the team URLs reach the test servers until the returned func is called
+func allowPrivateURLs() func() {
+	conf.Options.Security.PrivateURLs = true
+	return func() { conf.Options.Security.PrivateURLs = false }
+}
+
+// webhookReceiver fails the given number of requests with the status and checks the signature of the rest
+func webhookReceiver(t *testing.T, failures int32, status int, events chan<- domain.WebhookEvent) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get(WebhookSignatureHeader); sig != signWebhook("s3cr3t", r.Header.Get(WebhookTimestampHeader), body) {
+			t.Errorf("bad signature %s", sig)
+		}
+		var event domain.WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("bad payload %s - %v", body, err)
+		}
+		events <- event
+	}))
+	return srv, &calls
+}
+
+func TestQueueVerdictsThreshold(t *testing.T) {
+	b := queueBot(testQueue())
+	sub := b.subscriptions["T1"]
+	sub.webhook = &domain.Webhook{URL: "http://localhost", Secret: "s3cr3t", Threshold: domain.ThresholdMalicious}
+	ctx := &domain.Context{Team: "T1", Channel: "C1", OriginalUser: "U1"}
+	reply := &domain.WorkReply{Type: domain.ReplyTypeURL | domain.ReplyTypeIP,
+		URLs: []domain.URLReply{{Details: "http://evil.com", Result: domain.ResultDirty,
+			Sources: []domain.SourceResult{{Source: domain.SourceVT, Result: domain.ResultDirty, Score: "9 / 70"}}}},
+		IPs: []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultUnknown}}}
+	b.queueVerdicts(reply, ctx, sub)
+	if len(b.webhooks.queue) != 1 {
+		t.Fatalf("expected only the malicious verdict but got %d", len(b.webhooks.queue))
+	}
+	var event domain.WebhookEvent
+	if err := json.Unmarshal((<-b.webhooks.queue).body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != domain.WebhookEventVerdict || event.Team != "T1" || event.Channel != "C1" || event.Indicator != "http://evil.com" ||
+		event.Type != "url" || event.Verdict != "malicious" || event.Sources["vt"] != "9 / 70" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	sub.webhook.Threshold = domain.ThresholdSuspicious
+	b.queueVerdicts(reply, ctx, sub)
+	if len(b.webhooks.queue) != 2 {
+		t.Errorf("expected the unknown verdict as well but got %d", len(b.webhooks.queue))
+	}
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	defer allowPrivateURLs()()
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	events := make(chan domain.WebhookEvent, 1)
+	srv, calls := webhookReceiver(t, 2, http.StatusServiceUnavailable, events)
+	defer srv.Close()
+	b := queueBot(testQueue())
+	hook := &domain.Webhook{URL: srv.URL, Secret: "s3cr3t"}
+	b.deliverWebhook(&webhookDelivery{team: "T1", hook: hook, body: []byte(`{"indicator":"evil.com"}`)})
+	if atomic.LoadInt32(calls) != 3 {
+		t.Errorf("expected two retries but got %d calls", atomic.LoadInt32(calls))
+	}
+	select {
+	case event := <-events:
+		if event.Indicator != "evil.com" {
+			t.Errorf("unexpected event %+v", event)
+		}
+	default:
+		t.Error("the event was not delivered")
+	}
+	if len(b.webhooks.breakers) != 0 {
+		t.Error("a delivery should close the breaker")
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	defer allowPrivateURLs()()
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+	srv, calls := webhookReceiver(t, 100, http.StatusBadRequest, nil)
+	defer srv.Close()
+	b := queueBot(testQueue())
+	b.deliverWebhook(&webhookDelivery{team: "T1", hook: &domain.Webhook{URL: srv.URL, Secret: "s3cr3t"}, body: []byte("{}")})
+	if atomic.LoadInt32(calls) != 1 {
+		t.Errorf("a client error should not be retried but got %d calls", atomic.LoadInt32(calls))
+	}
+	down, calls := webhookReceiver(t, 100, http.StatusInternalServerError, nil)
+	defer down.Close()
+	b.deliverWebhook(&webhookDelivery{team: "T1", hook: &domain.Webhook{URL: down.URL, Secret: "s3cr3t"}, body: []byte("{}")})
+	if atomic.LoadInt32(calls) != webhookAttempts {
+		t.Errorf("expected %d attempts but got %d", webhookAttempts, atomic.LoadInt32(calls))
+	}
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	srv, calls := webhookReceiver(t, 0, http.StatusOK, make(chan domain.WebhookEvent, 1))
+	defer srv.Close()
+	// The name of the test server resolves to a loopback address
+	hook := &domain.Webhook{URL: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), Secret: "s3cr3t"}
+	if err := TestWebhook(hook, &domain.Team{ExternalID: "T1"}); err != util.ErrUnreachable || atomic.LoadInt32(calls) != 0 {
+		t.Errorf("expected the loopback webhook to be refused with a generic error but got %v after %d calls", err, atomic.LoadInt32(calls))
+	}
+}
+
+func TestWebhookBreaker(t *testing.T) {
+	w := newWebhooks()
+	now := time.Now()
+	errBroken := errors.New("connection refused")
+	for i := 0; i < breakerFailures; i++ {
+		if !w.allow("T1", now) {
+			t.Fatalf("the breaker opened after %d failures", i)
+		}
+		w.done("T1", errBroken, now)
+	}
+	if w.allow("T1", now) {
+		t.Error("the breaker should be open")
+	}
+	if !w.allow("T2", now) {
+		t.Error("other teams should not be affected")
+	}
+	later := now.Add(breakerCooldown)
+	if !w.allow("T1", later) {
+		t.Error("the breaker should let a delivery through after the cooldown")
+	}
+	w.done("T1", errBroken, later)
+	if w.allow("T1", later) {
+		t.Error("a failure after the cooldown should open the breaker again")
+	}
+	w.done("T1", nil, later)
+	if !w.allow("T1", later) {
+		t.Error("a delivery should close the breaker")
+	}
+}
@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/slack"
+)
+
+// weeklyReportDue checks if we should send the weekly report - once every Monday (UTC) for the 7 days before it
+func weeklyReportDue(now, last time.Time) bool {
+	now = now.UTC()
+	return now.Weekday() == time.Monday && last.Before(now.Truncate(24*time.Hour))
+}
+
+// change describes the difference from the previous week
+func change(current, previous int64) string {
+	switch {
+	case current == previous:
+		return "no change"
+	case previous == 0:
+		return "new"
+	}
+	return fmt.Sprintf("%+.0f%%", float64(current-previous)*100/float64(previous))
+}
+
+// maliciousRate is the percentage of the checked indicators that were malicious
+func maliciousRate(s *domain.Statistics) float64 {
+	total := s.URLsClean + s.URLsDirty + s.URLsUnknown + s.IPsClean + s.IPsDirty + s.IPsUnknown +
+		s.HashesClean + s.HashesDirty + s.HashesUnknown + s.FilesClean + s.FilesDirty + s.FilesUnknown
+	if total == 0 {
+		return 0
+	}
+	return float64(s.URLsDirty+s.IPsDirty+s.HashesDirty+s.FilesDirty) * 100 / float64(total)
+}
+
+// formatWeeklyReport renders the trends of the week as an attachment colored by the severity of the week
+func formatWeeklyReport(r *domain.WeeklyReport, c *domain.Configuration) map[string]interface{} {
+	cur, prev := r.Current, r.Previous
+	counter := func(title string, current, previous int64) map[string]interface{} {
+		return map[string]interface{}{"title": title, "value": fmt.Sprintf("%d (%s)", current, change(current, previous)), "short": true}
+	}
+	rate, prevRate := maliciousRate(cur), maliciousRate(prev)
+	busiest := "No channel activity"
+	if len(r.Busiest) > 0 {
+		var lines []string
+		for _, ch := range r.Busiest {
+			lines = append(lines, fmt.Sprintf("<#%s> - %d messages", ch.Channel, ch.Messages))
+		}
+		busiest = strings.Join(lines, "\n")
+	}
+	return map[string]interface{}{
+		"fallback": fmt.Sprintf("Weekly dbot report: %d messages scanned (%s), malicious rate %.1f%%", cur.Messages, change(cur.Messages, prev.Messages), rate),
+		"color":    c.Severity(domain.Scores{Result: cur.Result()}),
+		"title":    "Weekly dbot report",
+		"fields": []map[string]interface{}{
+			counter("Messages scanned", cur.Messages, prev.Messages),
+			{"title": "Malicious rate", "value": fmt.Sprintf("%.1f%% (%+.1f points)", rate, rate-prevRate), "short": true},
+			counter("URLs", cur.URLsClean+cur.URLsDirty+cur.URLsUnknown, prev.URLsClean+prev.URLsDirty+prev.URLsUnknown),
+			counter("IPs", cur.IPsClean+cur.IPsDirty+cur.IPsUnknown, prev.IPsClean+prev.IPsDirty+prev.IPsUnknown),
+			counter("Hashes", cur.HashesClean+cur.HashesDirty+cur.HashesUnknown, prev.HashesClean+prev.HashesDirty+prev.HashesUnknown),
+			counter("Files", cur.FilesClean+cur.FilesDirty+cur.FilesUnknown, prev.FilesClean+prev.FilesDirty+prev.FilesUnknown),
+			{"title": "Busiest channels", "value": busiest, "short": false},
+		},
+	}
+}
+
+// sendWeeklyReports sends the weekly trends to the configuration admins of the teams that are due. It runs from the Start loop.
+func (b *Bot) sendWeeklyReports() {
+	now := time.Now()
+	type due struct {
+		sub    *subscription
+		admins []string
+	}
+	var teams []due
+	b.mu.RLock()
+	for _, sub := range b.subscriptions {
+		if sub.configuration.DisableWeeklyReport || len(sub.team.ConfigAdmins) == 0 || !weeklyReportDue(now, b.reported[sub.team.ID]) {
+			continue
+		}
+		teams = append(teams, due{sub: sub, admins: append([]string{}, sub.team.ConfigAdmins...)})
+	}
+	b.mu.RUnlock()
+	for _, t := range teams {
+		team := t.sub.team.ID
+		last, err := b.r.LastWeeklyReport(team)
+		if err != nil {
+			teamLog(team, "").WithError(err).Warn("Unable to load the last weekly report")
+			continue
+		}
+		b.reported[team] = last
+		if !weeklyReportDue(now, last) {
+			continue
+		}
+		// Record it before sending so a restart or a failure never sends the report twice
+		if err = b.r.SetLastWeeklyReport(team, now); err != nil {
+			teamLog(team, "").WithError(err).Warn("Unable to record the weekly report")
+			continue
+		}
+		b.reported[team] = now
+		report, err := b.r.WeeklyReportForTeam(team, now.UTC().Truncate(24*time.Hour))
+		if err != nil {
+			teamLog(team, "").WithError(err).Warn("Unable to load the weekly report")
+			continue
+		}
+		if !report.Current.HasSomething() {
+			continue
+		}
+		attachment := formatWeeklyReport(report, t.sub.configuration)
+		for _, admin := range t.admins {
+			im, err := t.sub.s.Do("POST", "im.open", map[string]interface{}{"user": admin})
+			if err != nil {
+				contextLog(&domain.Context{Team: team, User: admin}).WithError(err).Warn("Unable to open an IM for the weekly report")
+				continue
+			}
+			postMessage := map[string]interface{}{
+				"channel":     im.S("channel.id"),
+				"as_user":     true,
+				"text":        "Here are the trends of the last week compared with the week before (UTC days). Send me *weekly off* to stop these reports.",
+				"attachments": []map[string]interface{}{attachment},
+			}
+			if _, err = t.sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+				contextLog(&domain.Context{Team: team, User: admin}).WithError(err).Warn("Error posting weekly report to Slack")
+			}
+		}
+	}
+}
+
+// handleWeekly turns the weekly report on or off for the team
+func (b *Bot) handleWeekly(team string, msg slack.Response, sub *subscription) {
+	channel := msg.S("channel")
+	postMessage := map[string]interface{}{
+		"channel": channel,
+		"as_user": true,
+	}
+	fields := strings.Fields(strings.ToLower(msg.S("text")))
+	c := *sub.configuration
+	switch {
+	case len(fields) == 2 && fields[1] == "on":
+		c.DisableWeeklyReport = false
+	case len(fields) == 2 && fields[1] == "off":
+		c.DisableWeeklyReport = true
+	default:
+		postMessage["text"] = "I could not understand your command. Weekly command is:\nweekly on - to send the weekly trends to the configuration admins every Monday.\nweekly off - to stop the weekly trends."
+	}
+	var err error
+	if postMessage["text"] == nil {
+		*sub.configuration = c
+		if err = b.r.SetChannelsAndGroups(sub.configuration); err != nil {
+			teamLog(team, channel).WithError(err).Warn("Error storing weekly report")
+			postMessage["text"] = "I had an issue saving the weekly report setting."
+		} else {
+			if err = b.q.PushConf(team); err != nil {
+				teamLog(team, channel).WithError(err).Warn("Error pushing configuration message")
+			}
+			postMessage["text"] = "Weekly report is off."
+			if !c.DisableWeeklyReport {
+				postMessage["text"] = "I will send the weekly trends to the configuration admins every Monday."
+			}
+		}
+	}
+	if _, err = sub.s.Do("POST", "chat.postMessage", postMessage); err != nil {
+		teamLog(team, channel).WithError(err).Warn("Error posting weekly message to Slack")
+	}
+}
@@ -0,0 +1,66 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+func TestWeeklyReportDue(t *testing.T) {
+	monday := time.Date(2018, 1, 8, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now, last time.Time
+		due       bool
+	}{
+		{monday, time.Time{}, true},
+		{monday, monday.Add(-7 * 24 * time.Hour), true},
+		{monday, monday.Add(-time.Hour), false},
+		{monday.Add(24 * time.Hour), time.Time{}, false},
+	}
+	for _, test := range tests {
+		if due := weeklyReportDue(test.now, test.last); due != test.due {
+			t.Errorf("weeklyReportDue(%v, %v) = %v, expected %v", test.now, test.last, due, test.due)
+		}
+	}
+}
+
+func TestChange(t *testing.T) {
+	tests := []struct {
+		current, previous int64
+		change            string
+	}{
+		{5, 5, "no change"},
+		{3, 0, "new"},
+		{15, 10, "+50%"},
+		{5, 10, "-50%"},
+	}
+	for _, test := range tests {
+		if res := change(test.current, test.previous); res != test.change {
+			t.Errorf("change(%d, %d) = %s, expected %s", test.current, test.previous, res, test.change)
+		}
+	}
+}
+
+func TestFormatWeeklyReport(t *testing.T) {
+	r := &domain.WeeklyReport{
+		Current:  &domain.Statistics{Messages: 20, URLsClean: 3, URLsDirty: 1},
+		Previous: &domain.Statistics{Messages: 10, URLsClean: 4},
+		Busiest:  []domain.ChannelActivity{{Channel: "C1", Messages: 15}},
+	}
+	a := formatWeeklyReport(r, &domain.Configuration{})
+	if a["color"] != "danger" {
+		t.Errorf("expected danger color for malicious findings but got %v", a["color"])
+	}
+	expected := map[string]string{
+		"Messages scanned": "20 (+100%)",
+		"Malicious rate":   "25.0% (+25.0 points)",
+		"URLs":             "4 (no change)",
+		"Busiest channels": "<#C1> - 15 messages",
+	}
+	for _, f := range a["fields"].([]map[string]interface{}) {
+		if v, ok := expected[f["title"].(string)]; ok && f["value"] != v {
+			t.Errorf("expected %s for %s but got %v", v, f["title"], f["value"])
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/goxforce"
+)
+
+// xfeScanner checks hashes, URLs, IPs, domains and the domains of emails with IBM X-Force Exchange
+type xfeScanner struct {
+	c       *goxforce.Client
+	teamKey string // Set if the credentials are the ones of the team
+}
+
+// newXFEScanner uses the team key and password if it has both, ours otherwise
+func newXFEScanner(creds domain.Credentials) (Scanner, error) {
+	key, pass, teamKey := creds.Key, creds.Password, creds.Key
+	if key == "" || pass == "" {
+		key, pass, teamKey = conf.Options.XFE.Key, conf.Options.XFE.Password, ""
+	}
+	c, err := newXFEClient(key, pass)
+	if err != nil {
+		return nil, err
+	}
+	return &xfeScanner{c: c, teamKey: teamKey}, nil
+}
+
+func (x *xfeScanner) Name() string {
+	return domain.SourceXFE
+}
+
+// breakerKey is per team key so a team with bad credentials does not stop the checks of the others
+func (x *xfeScanner) breakerKey() string {
+	return teamBreakerKey(domain.SourceXFE, x.teamKey)
+}
+
+func (x *xfeScanner) Supports(indicatorType int) bool {
+	switch indicatorType {
+	case domain.ReplyTypeHash, domain.ReplyTypeURL, domain.ReplyTypeIP, domain.ReplyTypeDomain, domain.ReplyTypeEmail:
+		return true
+	}
+	return false
+}
+
+// xfeNotFound checks the error of the client for a 404 - it does not tell us otherwise
+func xfeNotFound(err error) bool {
+	return strings.Contains(err.Error(), "404")
+}
+
+// xfeResult is the result with the score, dirty from xfeScoreToConvict
+func xfeResult(score float32) int {
+	if score >= xfeScoreToConvict {
+		return domain.ResultDirty
+	}
+	return domain.ResultClean
+}
+
+func (x *xfeScanner) Scan(ctx context.Context, indicator scanIndicator) (domain.SourceResult, error) {
+	switch indicator.Type {
+	case domain.ReplyTypeHash:
+		return x.scanHash(indicator.Value)
+	case domain.ReplyTypeIP:
+		return x.scanIP(indicator.Value, indicator.Online)
+	}
+	return x.scanURL(indicator)
+}
+
+func (x *xfeScanner) scanHash(hash string) (domain.SourceResult, error) {
+	rep := &domain.XfeHashReply{}
+	res := domain.SourceResult{Result: domain.ResultUnknown, Report: rep}
+	resp, err := x.c.MalwareDetails(hash)
+	if err != nil {
+		if xfeNotFound(err) {
+			res.NotFound, rep.NotFound = true, true
+			return res, nil
+		}
+		rep.Error = err.Error()
+		return res, err
+	}
+	rep.Malware = resp.Malware
+	res.Result = domain.ResultClean
+	if len(rep.Malware.Family) > 0 || len(rep.Malware.Origins.External.Family) > 0 {
+		res.Result = domain.ResultDirty
+	}
+	res.Score = strings.Join(rep.Malware.Family, ",")
+	if res.Score == "" {
+		res.Score = "No malware family"
+	}
+	res.Link = "https://exchange.xforce.ibmcloud.com/malware/" + hash
+	res.Detail = fmt.Sprintf("MIME Type: %s\nCreated: %s", rep.Malware.MimeType, rep.Malware.Created.String())
+	return res, nil
+}
+
+func (x *xfeScanner) scanIP(ip string, online bool) (domain.SourceResult, error) {
+	rep := &domain.XfeIPReply{}
+	res := domain.SourceResult{Result: domain.ResultUnknown, Report: rep}
+	resp, err := x.c.IPR(ip)
+	if err != nil {
+		if xfeNotFound(err) {
+			res.NotFound, rep.NotFound = true, true
+			return res, nil
+		}
+		rep.Error = err.Error()
+		return res, err
+	}
+	rep.IPReputation = *resp
+	if online {
+		if hist, err := x.c.IPRHistory(ip); err == nil {
+			rep.IPHistory = *hist
+		}
+	}
+	res.Result, res.Value, res.Score = xfeResult(resp.Score), float64(resp.Score), fmt.Sprintf("%v", resp.Score)
+	res.Link = "https://exchange.xforce.ibmcloud.com/ip/" + ip
+	res.Detail = fmt.Sprintf("Categories: %s\nGeo: %s", joinMapInt(resp.Cats), nilOrUnknown(resp.Geo["country"]))
+	return res, nil
+}
+
+// scanURL checks URLs, domains and the domains of emails
+func (x *xfeScanner) scanURL(indicator scanIndicator) (domain.SourceResult, error) {
+	if indicator.Type == domain.ReplyTypeEmail {
+		indicator.Value = indicator.Value[strings.LastIndex(indicator.Value, "@")+1:]
+	}
+	rep := &domain.XfeURLReply{}
+	res := domain.SourceResult{Result: domain.ResultUnknown, Report: rep}
+	resp, err := x.c.URL(indicator.Value)
+	if err != nil {
+		if !xfeNotFound(err) {
+			rep.Error = err.Error()
+			return res, err
+		}
+		res.NotFound, rep.NotFound = true, true
+	} else {
+		rep.URLDetails = resp.Result
+	}
+	// The records are shown on the details page even if the URL itself is not known
+	if indicator.Type != domain.ReplyTypeEmail {
+		if resolve, err := x.c.Resolve(indicator.Value); err == nil {
+			rep.Resolve = *resolve
+		}
+	}
+	if indicator.Type == domain.ReplyTypeURL && indicator.Online {
+		if malware, err := x.c.URLMalware(indicator.Value); err == nil {
+			rep.URLMalware = *malware
+		}
+	}
+	if res.NotFound {
+		return res, nil
+	}
+	score := rep.URLDetails.Score
+	res.Result, res.Value, res.Score = xfeResult(score), float64(score), fmt.Sprintf("%v", score)
+	res.Link = "https://exchange.xforce.ibmcloud.com/url/" + indicator.Value
+	switch indicator.Type {
+	case domain.ReplyTypeEmail:
+		res.Detail = "Categories: " + joinMap(rep.URLDetails.Cats)
+	case domain.ReplyTypeURL:
+		records := append(append([]string{}, rep.Resolve.A...), rep.Resolve.AAAA...)
+		res.Detail = fmt.Sprintf("A Records: %s\nCategories: %s", strings.Join(records, ","), joinMap(rep.URLDetails.Cats))
+	default:
+		res.Detail = fmt.Sprintf("A Records: %s\nCategories: %s", strings.Join(rep.Resolve.A, ","), joinMap(rep.URLDetails.Cats))
+	}
+	return res, nil
+}
@@ -0,0 +1,212 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
+	"github.com/demisto/alfred/util"
+)
+
+// xsoarSeverityHigh is the severity of the incidents we open on the XSOAR scale of 0 (unknown) to 4 (critical)
+const xsoarSeverityHigh = 3
+
+var xsoarTotal = metrics.NewCounter("alfred_xsoar_incidents_total",
+	"Incidents opened in the XSOAR servers of the teams by the result", "result")
+
+// xsoarClient opens incidents in the XSOAR (formerly Demisto) server of a team
+type xsoarClient struct {
+	url string
+	key string
+	c   *http.Client
+}
+
+type xsoarLabel struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// xsoarIncident is the incident we open for the malicious findings of a message
+type xsoarIncident struct {
+	Name                string       `json:"name"`
+	Type                string       `json:"type,omitempty"`
+	Severity            int          `json:"severity"`
+	Details             string       `json:"details"`
+	Labels              []xsoarLabel `json:"labels"`
+	CreateInvestigation bool         `json:"createInvestigation"` // So we can attach the details
+}
+
+func newXSOARClient(u, key string) *xsoarClient {
+	return &xsoarClient{url: strings.TrimSuffix(u, "/"), key: key, c: util.PublicClient(30 * time.Second)}
+}
+
+// do posts the JSON to the path of the server and decodes the reply into out if given
+func (x *xsoarClient) do(path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", x.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", x.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := util.DoPublic(x.c, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("XSOAR returned %s", resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// CreateIncident returns the ID of the new incident
+func (x *xsoarClient) CreateIncident(incident *xsoarIncident) (string, error) {
+	var res struct {
+		ID string `json:"id"`
+	}
+	if err := x.do("/incident", incident, &res); err != nil {
+		return "", err
+	}
+	if res.ID == "" {
+		return "", errors.New("XSOAR did not return the incident ID")
+	}
+	return res.ID, nil
+}
+
+// AttachDetails adds a markdown note with the details to the investigation of the incident
+func (x *xsoarClient) AttachDetails(id, details string) error {
+	return x.do("/entry/note", map[string]interface{}{"investigationId": id, "data": details, "markdown": true}, nil)
+}
+
+// incidentLink is the incident page on the server
+func (x *xsoarClient) incidentLink(id string) string {
+	return x.url + "/#/Details/" + id
+}
+
+// newIncident describes the dangerous findings of the message
+func newIncident(dangerous []finding, data *domain.Context, sub *subscription) *xsoarIncident {
+	name := fmt.Sprintf("Alfred: malicious %s %s", dangerous[0].kind, dangerous[0].value)
+	if len(dangerous) > 1 {
+		name += fmt.Sprintf(" and %d more", len(dangerous)-1)
+	}
+	var lines []string
+	for i := range dangerous {
+		var scores []string
+		for _, s := range dangerous[i].sources {
+			scores = append(scores, s.name+": "+s.score)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s - %s (%s)", dangerous[i].kind, dangerous[i].value, dangerous[i].verdict, strings.Join(scores, ", ")))
+	}
+	labels := []xsoarLabel{{Type: "SlackTeam", Value: sub.team.Name}, {Type: "SlackChannel", Value: data.Channel},
+		{Type: "SlackUser", Value: data.OriginalUser}}
+	if permalink := slackPermalink(sub.team.Domain, data); permalink != "" {
+		labels = append(labels, xsoarLabel{Type: "SlackMessage", Value: permalink})
+	}
+	return &xsoarIncident{Name: name, Type: sub.team.XSOARIncidentType, Severity: xsoarSeverityHigh,
+		Details: strings.Join(lines, "\n"), Labels: labels, CreateInvestigation: true}
+}
+
+// incidentDetails is the note we attach with a line per source of every dangerous finding
+func incidentDetails(dangerous []finding) string {
+	var lines []string
+	for i := range dangerous {
+		f := &dangerous[i]
+		lines = append(lines, fmt.Sprintf("### %s %s: %s", f.verdict, f.kind, f.value))
+		if f.link != "" {
+			lines = append(lines, fmt.Sprintf("[Details](%s)", f.link))
+		}
+		lines = append(lines, "| Source | Score |", "| --- | --- |")
+		for _, s := range f.sources {
+			lines = append(lines, fmt.Sprintf("| %s | %s |", s.name, s.score))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// openIncident opens an incident in the XSOAR server of the team in the background if any of the findings of the reply
+// is dangerous with the team thresholds. The incident link is sent on the returned channel, which is closed without it
+// on failure and nil if there is no incident to open.
+func (b *Bot) openIncident(reply *domain.WorkReply, data *domain.Context, sub *subscription) <-chan string {
+	if !sub.team.XSOAREnabled() {
+		return nil
+	}
+	link := messageLink(data.Channel, reply.MessageID, sub.team.ID)
+	var findings, dangerous []finding
+	if reply.Type&domain.ReplyTypeFile > 0 {
+		findings = []finding{fileFinding(sub.team.Locale, reply, link)}
+	} else {
+		findings = replyFindings(sub.team.Locale, reply, link, false)
+	}
+	for i := range findings {
+		if findings[i].severity(sub.configuration) == domain.SeverityDanger {
+			dangerous = append(dangerous, findings[i])
+		}
+	}
+	if len(dangerous) == 0 {
+		return nil
+	}
+	x := newXSOARClient(sub.team.XSOARURL, sub.team.XSOARKey)
+	incident, details := newIncident(dangerous, data, sub), incidentDetails(dangerous)
+	res := make(chan string, 1)
+	go func() {
+		defer close(res)
+		id, err := x.CreateIncident(incident)
+		if err != nil {
+			xsoarTotal.Inc("failed")
+			replyLog(reply, data).WithError(err).Warn("Unable to open XSOAR incident")
+			return
+		}
+		xsoarTotal.Inc("opened")
+		replyLog(reply, data).Infof("Opened XSOAR incident %s", id)
+		res <- fmt.Sprintf("<%s|#%s>", x.incidentLink(id), id)
+		if err = x.AttachDetails(id, details); err != nil {
+			replyLog(reply, data).WithError(err).Warn("Unable to attach the details to the XSOAR incident")
+		}
+	}()
+	return res
+}
+
+// noteIncident posts the link to the incident in the thread of the message once XSOAR opened it.
+// The reply is posted first so a slow XSOAR server never holds it back.
+func (b *Bot) noteIncident(incident <-chan string, reply *domain.WorkReply, data *domain.Context, sub *subscription) {
+	if incident == nil {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		var link string
+		var ok bool
+		select {
+		case link, ok = <-incident:
+		case <-b.ctx.Done():
+			return
+		}
+		if !ok {
+			return
+		}
+		message := map[string]interface{}{"channel": data.Channel, "as_user": true, "text": sub.msg("xsoar_incident", msgArgs{"Incident": link})}
+		thread := data.ThreadTS
+		if thread == "" {
+			thread = data.TS
+		}
+		inThread(message, thread)
+		if _, err := sub.s.PostMessage(message); err != nil {
+			replyLog(reply, data).WithError(err).Warn("Unable to post the XSOAR incident to Slack")
+		}
+	}()
+}
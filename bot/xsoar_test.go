@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo/repotest"
+	"github.com/demisto/alfred/slack"
+)
+
+func xsoarSub(u string) *subscription {
+	return &subscription{team: &domain.Team{ID: "1", ExternalID: "T1", Name: "acme", XSOARURL: u, XSOARKey: "key", XSOARIncidentType: "Phishing"},
+		configuration: &domain.Configuration{}, s: &slack.Client{Token: "xoxb-1"}}
+}
+
+func TestOpenIncident(t *testing.T) {
+	defer allowPrivateURLs()()
+	s, done := newFakeSlack()
+	defer done()
+	notes := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "key" {
+			t.Errorf("missing API key")
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/incident":
+			if body["type"] != "Phishing" || !strings.Contains(body["name"].(string), "evil[.]com") || body["createInvestigation"] != true {
+				t.Errorf("unexpected incident %v", body)
+			}
+			w.Write([]byte(`{"id": "42"}`))
+		case "/entry/note":
+			notes <- body
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	b := queueBot(testQueue())
+	sub := xsoarSub(srv.URL + "/")
+	reply := &domain.WorkReply{Type: domain.ReplyTypeURL | domain.ReplyTypeIP,
+		URLs: []domain.URLReply{{Details: "http://evil.com", Result: domain.ResultDirty}},
+		IPs:  []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}}
+	// The indicators are defanged the same way as in the Slack reply
+	data := &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}
+	b.noteIncident(b.openIncident(reply, data, sub), reply, data, sub)
+	b.wg.Wait()
+	if len(s.posted) != 1 || !strings.Contains(s.posted[0], "<"+srv.URL+"/#/Details/42|#42>") {
+		t.Fatalf("expected a note with the incident link but got %q", s.posted)
+	}
+	select {
+	case note := <-notes:
+		if note["investigationId"] != "42" || !strings.Contains(note["data"].(string), "evil") {
+			t.Errorf("unexpected details %v", note)
+		}
+	case <-time.After(time.Second):
+		t.Error("the details were not attached")
+	}
+}
+
+func TestOpenIncidentSkipped(t *testing.T) {
+	b := queueBot(testQueue())
+	clean := &domain.WorkReply{Type: domain.ReplyTypeIP, IPs: []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}}
+	if incident := b.openIncident(clean, &domain.Context{Team: "T1"}, xsoarSub("http://localhost")); incident != nil {
+		t.Error("a clean reply should not open an incident")
+	}
+	dirty := &domain.WorkReply{Type: domain.ReplyTypeIP, IPs: []domain.IPReply{{Details: "1.2.3.4", Result: domain.ResultDirty}}}
+	if incident := b.openIncident(dirty, &domain.Context{Team: "T1"}, b.subscriptions["T1"]); incident != nil {
+		t.Error("a team without XSOAR should not open an incident")
+	}
+}
+
+func TestIncidentNotesDoNotBlock(t *testing.T) {
+	defer allowPrivateURLs()()
+	s, done := newFakeSlack()
+	defer done()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	b := repoBot(repotest.New())
+	b.subscriptions["T1"] = xsoarSub(srv.URL)
+	data := &domain.Context{Team: "T1", Channel: "D1", TS: "1.1"}
+	reply := &domain.WorkReply{MessageID: "m1", Type: domain.ReplyTypeIP, IPs: []domain.IPReply{{Details: "1.2.3.4", Result: domain.ResultDirty}},
+		Context: data}
+	start := time.Now()
+	b.handleReply(reply)
+	if time.Since(start) > time.Second || len(s.posted) != 1 {
+		t.Errorf("expected the reply to be posted without waiting for XSOAR but got %q", s.posted)
+	}
+	// XSOAR fails so there is no note
+	close(release)
+	b.wg.Wait()
+	if len(s.posted) != 1 {
+		t.Errorf("expected only the reply but got %q", s.posted)
+	}
+}
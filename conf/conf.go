@@ -10,16 +10,6 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
-var DefaultHelpMessage = `Here are the commands I understand when you send me a DIRECT MESSAGE here:
-*config*: list the current channels I'm listening on
-*join all/#channel1,#channel2...*: I will join all/specified public channels and start monitoring them.
-*verbose on/off #channel1,#channel2,private1...* - turn on verbose mode on the specified channels or private groups
-verbose mode is usually used by security professionals. When in verbose mode, dbot will display reputation details about any URL, IP or file including clean ones.
-
-*vt the-api-key-you-got-from-vt*: add your own VirusTotal key to use. Accepts "-" to return to default. You can get a key at https://www.virustotal.com/en/documentation/public-api/
-*xfe the-api-key-you-got-from-xfe the-password-you-got*: add your own IBM X-Force Exchange credentials to use. Accepts "-" to return to default. You can get credentials at https://exchange.xforce.ibmcloud.com/
-- It's important to specify your own keys to get reliable results as our public API keys are rate limited.`
-
 // Options anonymous struct holds the global configuration options for the server
 var Options struct {
 	// The type of environment - PROD/TEST/DEV
@@ -40,6 +30,9 @@ var Options struct {
 		Recaptcha string
 		// Database encryption key used to encrypt the tokens
 		DBKey string
+		// PrivateURLs lets the webhooks, XSOAR servers and sandboxes of the teams be on private addresses.
+		// Only for a deployment that serves a single organization - otherwise teams could reach inside our network.
+		PrivateURLs bool
 	}
 	// SSL configuration
 	SSL struct {
@@ -54,9 +47,24 @@ var Options struct {
 		ClientID string
 		// ClientSecret is used to verify Slack reply
 		ClientSecret string
+		// SigningSecret is used to verify the requests Slack sends to the interactions endpoint
+		SigningSecret string
 	}
 	// VT token
 	VT string
+	// VTVersion of the VirusTotal API, 2 or 3. The default 0 uses v3 for every key that works with it.
+	VTVersion int
+	// VTRate spaces the VirusTotal lookups of each key to what the key allows
+	VTRate struct {
+		// RequestsPerMinute of our key, 0 for no limit
+		RequestsPerMinute int
+		// TeamRequestsPerMinute of the keys of the teams, 4 on the public API
+		TeamRequestsPerMinute int
+		// Backoff is the number of seconds we stop using a key after VirusTotal said it is over its quota
+		Backoff int
+		// MaxWait is the number of seconds a queued lookup waits for its turn before we give up on it
+		MaxWait int
+	}
 	// XFE credentials
 	XFE struct {
 		// Key to access the service
@@ -66,6 +74,175 @@ var Options struct {
 	}
 	// Cy API key
 	Cy string
+	// NVD API for CVE lookups
+	NVD struct {
+		// URL of the CVE API
+		URL string
+		// Key is optional and raises the rate limit
+		Key string
+	}
+	// AbuseIPDB checks IPs with the keys of the teams, there is no default key
+	AbuseIPDB struct {
+		// URL of the check endpoint
+		URL string
+		// DailyLimit is the number of checks a key can do per day, 1000 on the free plan
+		DailyLimit int
+	}
+	// SafeBrowsing checks URLs with Google Safe Browsing for all the teams
+	SafeBrowsing struct {
+		// URL of the threatMatches:find endpoint
+		URL string
+		// Key of the API, URLs are not checked without it
+		Key string
+		// NegativeCache is how many seconds a URL without matches is not checked again
+		NegativeCache int
+	}
+	// HIBP checks the breaches of emails with the keys of the teams that enabled it
+	HIBP struct {
+		// URL of the breached account endpoint
+		URL string
+		// RequestsPerMinute is the rate limit of a key, 10 on the lowest plan
+		RequestsPerMinute int
+	}
+	// Chainabuse API for wallet address reports
+	ChainAbuse struct {
+		// URL of the reports API
+		URL string
+		// Key is required, wallets are not checked without it
+		Key string
+	}
+	// RDAP looks up the registration of domains and the networks of IPs
+	RDAP struct {
+		// Bootstrap is the IANA registry of the RDAP servers, with dns.json, ipv4.json and ipv6.json under it
+		Bootstrap string
+		// WHOIS is the server that refers us to the WHOIS server of the TLDs without RDAP
+		WHOIS string
+		// YoungDays is the age in days under which replies say when the domain was registered
+		YoungDays int
+		// CacheHours is how long the registrations are cached, they rarely change
+		CacheHours int
+	}
+	// Certificates of https URLs are inspected by connecting to the host
+	Certificates struct {
+		// Timeout in seconds of the connection and the handshake
+		Timeout int
+		// YoungDays is the age in days of a certificate under which it is a weak sign that the URL is malicious
+		YoungDays int
+	}
+	// Sources protect the workers from reputation sources that are slow or down
+	Sources struct {
+		// Timeout in seconds of a check with a source
+		Timeout int
+		// BreakerFailures is the number of failures in a row after which we stop checking with the source
+		BreakerFailures int
+		// BreakerCooldown is the number of seconds we stop for, after it a single check probes the source
+		BreakerCooldown int
+	}
+	// Cache of recent verdicts so repeated indicators are answered without new lookups
+	Cache struct {
+		// Size is the maximum number of verdicts kept, 0 disables the cache
+		Size int
+		// Window in minutes during which a verdict is reused
+		Window int
+	}
+	// ScanCache keeps the results of the sources so the same indicator is not looked up again, e.g. to save VT quota
+	ScanCache struct {
+		// Backend is memory for an LRU in each worker, empty disables it
+		Backend string
+		// Size is the number of results the memory backend keeps
+		Size int
+		// Minutes a result is kept by the indicator type, 0 does not cache the type
+		Hash   int
+		URL    int
+		IP     int
+		Domain int
+		Email  int
+		// NotFound is the minutes a result the source does not know is kept, if shorter than the time of the type
+		NotFound int
+	}
+	// Dispatch hands the Slack events to workers so one slow team does not stall the others
+	Dispatch struct {
+		// Workers handling the events, the events of a team always go to the same worker
+		Workers int
+		// Queue is the number of events waiting for each worker, more are dropped
+		Queue int
+	}
+	// Metrics for Prometheus
+	Metrics struct {
+		// Address of a dedicated internal listener for /metrics, loopback by default. Empty serves them on the public web server.
+		Address string
+		// PerTeam labels the metrics with the team, with many teams this creates a lot of series
+		PerTeam bool
+	}
+	// Limits protect the bot and the reputation quotas from huge messages
+	Limits struct {
+		// MessageSize is the number of bytes of a message we scan, 0 for no limit
+		MessageSize int
+		// Indicators is the maximum number of indicators we check per message, 0 for no limit
+		Indicators int
+		// SnippetSize is the maximum size in bytes of a shared text file we scan for indicators
+		SnippetSize int
+		// WorkPerMinute is the number of work requests a team can send per minute, 0 for no limit
+		WorkPerMinute int
+		// WorkTTL is the number of seconds a work request can wait in the queue before the workers drop it, 0 for no limit
+		WorkTTL int
+		// CommandTTL is the same for the scan and rescan commands the users asked for explicitly, 0 for no limit
+		CommandTTL int
+	}
+	// Files shared in the channels that we download and scan
+	Files struct {
+		// MaxSize in bytes of the files we download, larger files are only looked up by their hash if the event has one
+		MaxSize int
+		// AllowedTypes are the only Slack file types (zip) or mime types (application/*) we download if not empty
+		AllowedTypes []string
+		// DeniedTypes are never downloaded
+		DeniedTypes []string
+	}
+	// Sandbox runs the files no source knows in the sandbox of the team
+	Sandbox struct {
+		// Timeout in seconds of each call to the sandbox
+		Timeout int
+		// PollAttempts is how many times we ask for the report and PollInterval the seconds between them
+		PollAttempts int
+		PollInterval int
+		// CoalesceMinutes is how long a file submitted to a sandbox is not submitted again, the verdict is reused
+		CoalesceMinutes int
+		// Concurrency bounds the files each worker runs in the sandboxes at the same time
+		Concurrency int
+		// MaliciousScore and SuspiciousScore are the sandbox scores (0 - 10) of the verdicts
+		MaliciousScore  float64
+		SuspiciousScore float64
+	}
+	// Retries of the work requests a worker failed on
+	Retries struct {
+		// MaxAttempts is the number of times a request is handled before it is dead lettered
+		MaxAttempts int
+		// Backoff is the number of seconds before the first retry, it doubles with each retry up to MaxBackoff. The
+		// retries wait less than Queue.VisibilityTimeout whatever MaxBackoff is.
+		Backoff    int
+		MaxBackoff int
+	}
+	// SMTP server we send the email alerts through
+	SMTP struct {
+		// Host of the server, empty disables the email alerts
+		Host string
+		// Port of the server, STARTTLS is used if the server offers it
+		Port int
+		// Username and Password are optional
+		Username string
+		Password string
+		// From is the sender of the alerts
+		From string
+	}
+	// Syslog receives a CEF event for every indicator we check, e.g. for the SIEM of the security team
+	Syslog struct {
+		// Protocol is tcp, udp or tls
+		Protocol string
+		// Address of the syslog server as host:port, empty disables the events
+		Address string
+		// Facility of the events, e.g. local0
+		Facility string
+	}
 	// DB properties
 	DB struct {
 		// ConnectString how to connect to DB
@@ -98,6 +275,69 @@ var Options struct {
 	Worker    bool
 	ClamCtl   string
 	QueuePoll int
+	// Queue passes the work between the bot and the workers
+	Queue struct {
+		// Backend is db to share the queue between the hosts, nats or sqs to share it over NATS or AWS SQS, or memory
+		// for a single process with the web and the worker
+		Backend string
+		// Size is the number of messages of each kind the memory backend buffers
+		Size int
+		// VisibilityTimeout is the number of seconds a popped work request stays reserved for its worker before it is
+		// returned to the queue. The sqs backend has its own. The db backend reserves the rows, so stop the workers
+		// of the versions before the reservations before starting the new ones - they delete the rows they take.
+		VisibilityTimeout int
+		// CompressAbove is the size in bytes of the JSON of the work requests and replies above which they are gzipped on
+		// the queue, 0 to never compress. The versions before the compression cannot read them, so it stays 0 until
+		// every process is upgraded - 32768 then.
+		CompressAbove int
+		// OrphanTimeout is the number of seconds without a heartbeat after which the reply queue of a bot host is removed
+		OrphanTimeout int
+		// RerouteReplies passes the replies pending in a removed reply queue to a live bot instead of dropping them
+		RerouteReplies bool
+		// NATS servers of the nats backend. It is core NATS, not JetStream, so it is not crash-safe - the work a worker
+		// popped is reserved in its process only, and a worker that crashes loses it.
+		NATS struct {
+			// URL of the servers, comma separated for a cluster, tls:// to connect with TLS
+			URL string
+			// Prefix of the subjects so installations can share the servers
+			Prefix string
+			// Credentials is the path of a .creds file, otherwise Token or User and Password if the servers need them
+			Credentials string
+			Token       string
+			User        string
+			Password    string
+			// ServerCA for TLS
+			ServerCA string
+			// ClientCert and ClientKey if the servers verify the clients
+			ClientCert string
+			ClientKey  string
+			// ReconnectWait is the number of seconds between the reconnects, MaxReconnects -1 reconnects forever
+			ReconnectWait int
+			MaxReconnects int
+		}
+		// SQS queues of the sqs backend
+		SQS struct {
+			// Region, AccessKey and SecretKey of the account, the default AWS chain is used for what is empty
+			Region    string
+			AccessKey string
+			SecretKey string
+			// Endpoint replaces the SQS endpoint of the region, e.g. for a local emulator
+			Endpoint string
+			// Prefix of the names of the queues
+			Prefix string
+			// WaitSeconds is how long a receive waits for messages, up to 20
+			WaitSeconds int
+			// VisibilityTimeout is the number of seconds a received work request is hidden from the other workers
+			VisibilityTimeout int
+		}
+	}
+	// SubscriptionIdle is the number of minutes after which the bot forgets a team that did not need it, 0 keeps them.
+	// Forgotten teams do not get digests and weekly reports until they are active again.
+	SubscriptionIdle int
+	// StaleSubscription is the number of minutes without events after which we verify and reload a team that monitors channels, 0 disables it.
+	StaleSubscription int
+	// ScanHistory is the number of days we keep the history of the indicators we checked, 0 keeps it forever.
+	ScanHistory int
 }
 
 // The pipe writer to wrap around standard logger. It is configured in main.
@@ -125,11 +365,127 @@ func Load(filename string, useDefault bool) error {
 	"Worker": true,
 	"ClamCtl": "/var/run/clamav/clamd.ctl",
 	"QueuePoll": 10,
+	"Queue": {
+		"Backend": "db",
+		"Size": 1000,
+		"VisibilityTimeout": 300,
+		"CompressAbove": 0,
+		"OrphanTimeout": 300,
+		"RerouteReplies": true,
+		"NATS": {
+			"URL": "nats://127.0.0.1:4222",
+			"Prefix": "dbot",
+			"ReconnectWait": 2,
+			"MaxReconnects": -1
+		},
+		"SQS": {
+			"Prefix": "dbot",
+			"WaitSeconds": 20,
+			"VisibilityTimeout": 300
+		}
+	},
+	"SubscriptionIdle": 10080,
+	"StaleSubscription": 360,
+	"ScanHistory": 90,
+	"NVD": {
+		"URL": "https://services.nvd.nist.gov/rest/json/cves/2.0"
+	},
+	"VTRate": {
+		"TeamRequestsPerMinute": 4,
+		"Backoff": 60,
+		"MaxWait": 900
+	},
+	"AbuseIPDB": {
+		"URL": "https://api.abuseipdb.com/api/v2/check",
+		"DailyLimit": 1000
+	},
+	"SafeBrowsing": {
+		"URL": "https://safebrowsing.googleapis.com/v4/threatMatches:find",
+		"NegativeCache": 300
+	},
+	"HIBP": {
+		"URL": "https://haveibeenpwned.com/api/v3/breachedaccount/",
+		"RequestsPerMinute": 10
+	},
+	"ChainAbuse": {
+		"URL": "https://api.chainabuse.com/v0/reports"
+	},
+	"RDAP": {
+		"Bootstrap": "https://data.iana.org/rdap",
+		"WHOIS": "whois.iana.org:43",
+		"YoungDays": 30,
+		"CacheHours": 168
+	},
+	"Certificates": {
+		"Timeout": 5,
+		"YoungDays": 3
+	},
+	"Sources": {
+		"Timeout": 30,
+		"BreakerFailures": 5,
+		"BreakerCooldown": 300
+	},
+	"Cache": {
+		"Size": 10000,
+		"Window": 10
+	},
+	"ScanCache": {
+		"Backend": "memory",
+		"Size": 50000,
+		"Hash": 1440,
+		"URL": 60,
+		"IP": 30,
+		"Domain": 60,
+		"Email": 60,
+		"NotFound": 5
+	},
+	"Dispatch": {
+		"Workers": 8,
+		"Queue": 256
+	},
+	"Metrics": {
+		"Address": "127.0.0.1:9090"
+	},
+	"SMTP": {
+		"Port": 587,
+		"From": "Alfred <alfred@demisto.com>"
+	},
+	"Syslog": {
+		"Protocol": "udp",
+		"Facility": "local0"
+	},
+	"Limits": {
+		"MessageSize": 16384,
+		"Indicators": 25,
+		"SnippetSize": 1048576,
+		"WorkPerMinute": 60,
+		"WorkTTL": 600,
+		"CommandTTL": 3600
+	},
+	"Files": {
+		"MaxSize": 31457280,
+		"DeniedTypes": ["video/*", "audio/*"]
+	},
+	"Sandbox": {
+		"Timeout": 60,
+		"PollAttempts": 30,
+		"PollInterval": 20,
+		"CoalesceMinutes": 60,
+		"Concurrency": 4,
+		"MaliciousScore": 7,
+		"SuspiciousScore": 4
+	},
+	"Retries": {
+		"MaxAttempts": 3,
+		"Backoff": 30,
+		"MaxBackoff": 240
+	},
 	"Security": {
 		"SessionKey": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx",
 		"Timeout": 525600,
 		"Recaptcha": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx_xx_xxx",
-		"DBKey": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
+		"DBKey": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx",
+		"PrivateURLs": false
 	}
 }`)
 	// Start the options with the defaults and override with the file
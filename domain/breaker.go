@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// BreakerOpen skips the source until the breaker is retried
+	BreakerOpen = "open"
+	// BreakerHalfOpen lets a single probe check if the source is back
+	BreakerHalfOpen = "half-open"
+)
+
+// SourceBreaker is the circuit breaker of a reputation source that tripped on a worker - the source failed too many
+// times in a row so we stopped checking indicators with it for a while
+type SourceBreaker struct {
+	Worker string `json:"-" db:"worker"`
+	// Breaker is the source or, for the sources checked with the keys of the teams, the source and a hash of the key
+	Breaker   string    `json:"breaker" db:"breaker"`
+	Source    string    `json:"source" db:"source"`
+	State     string    `json:"state" db:"state"`
+	Failures  int       `json:"failures" db:"failures"`
+	Error     string    `json:"error" db:"error"`           // The last failure
+	OpenUntil time.Time `json:"open_until" db:"open_until"` // When a probe checks the source again
+}
+
+// BreakerName is the breaker of the source, with the key of the team if the source is checked with it. Keys are
+// hashed so they never show outside the worker.
+func BreakerName(source, key string) string {
+	if key == "" {
+		return source
+	}
+	sum := sha256.Sum256([]byte(key))
+	return source + ":" + hex.EncodeToString(sum[:])[:16]
+}
+
+// TeamBreakers are the breakers that affect the team - the ones of the sources and the ones of its own keys
+func TeamBreakers(breakers []SourceBreaker, team *Team) []SourceBreaker {
+	own := make(map[string]bool)
+	for source, creds := range team.Credentials() {
+		if creds.Key != "" {
+			own[BreakerName(source, creds.Key)] = true
+		}
+	}
+	var res []SourceBreaker
+	for _, b := range breakers {
+		if b.Breaker == b.Source || own[b.Breaker] {
+			res = append(res, b)
+		}
+	}
+	return res
+}
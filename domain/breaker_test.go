@@ -0,0 +1,28 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBreakerName(t *testing.T) {
+	if BreakerName(SourceVT, "") != SourceVT {
+		t.Error("expected the breaker of a source to be the source")
+	}
+	name := BreakerName(SourceOTX, "secret")
+	if !strings.HasPrefix(name, SourceOTX+":") || strings.Contains(name, "secret") || name == BreakerName(SourceOTX, "other") {
+		t.Errorf("unexpected breaker %s", name)
+	}
+}
+
+func TestTeamBreakers(t *testing.T) {
+	breakers := []SourceBreaker{
+		{Breaker: SourceVT, Source: SourceVT},
+		{Breaker: BreakerName(SourceHIBP, "mine"), Source: SourceHIBP},
+		{Breaker: BreakerName(SourceHIBP, "theirs"), Source: SourceHIBP},
+	}
+	res := TeamBreakers(breakers, &Team{SourceKeys: map[string]string{SourceHIBP: "mine"}})
+	if len(res) != 2 || res[0].Source != SourceVT || res[1].Breaker != BreakerName(SourceHIBP, "mine") {
+		t.Errorf("expected the breakers of the sources and of the team keys but got %+v", res)
+	}
+}
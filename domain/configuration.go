@@ -1,7 +1,15 @@
 package domain
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
 	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/demisto/alfred/util"
@@ -9,29 +17,326 @@ import (
 
 // Configuration holds the user configuration
 type Configuration struct {
-	Team            string   `json:"team"`
-	Channels        []string `json:"channels"`
-	Groups          []string `json:"groups"`
-	IM              bool     `json:"im"`
-	Regexp          string   `json:"regexp"`
-	All             bool     `json:"all"`
-	VerboseChannels []string `json:"verbose_channels"`
-	VerboseGroups   []string `json:"verbose_groups"`
-	VerboseIM       bool     `json:"verbose_im"`
+	Team                string               `json:"team"`
+	Channels            []string             `json:"channels"`
+	Groups              []string             `json:"groups"`
+	IM                  bool                 `json:"im"`
+	Regexp              string               `json:"regexp"`
+	All                 bool                 `json:"all"`
+	VerboseChannels     []string             `json:"verbose_channels"`
+	VerboseGroups       []string             `json:"verbose_groups"`
+	VerboseIM           bool                 `json:"verbose_im"`
+	DisableRefang       bool                 `json:"disable_refang"`         // Do not normalize defanged indicators (hxxp, [.]) before scanning
+	DisableDomains      bool                 `json:"disable_domains"`        // Do not look for bare domains (without http/https) in messages
+	InternalIPs         bool                 `json:"internal_ips"`           // Report private and reserved IPs instead of skipping them
+	CustomPatterns      []string             `json:"custom_patterns"`        // Team specific indicator formats (ticket IDs, malware families)
+	CustomWebhook       string               `json:"custom_webhook"`         // Where to forward custom pattern matches
+	Whitelist           []string             `json:"whitelist"`              // Indicators (or CIDRs) we should never check
+	InternalDomains     []string             `json:"internal_domains"`       // Domains (and their subdomains) whose URLs are never sent to the sources
+	DisableAttachments  bool                 `json:"disable_attachments"`    // Do not scan message attachments posted by integrations
+	ReplyInThread       []string             `json:"reply_in_thread"`        // Channels and groups where we reply in a thread on the original message
+	ScanBotMessages     []string             `json:"scan_bot_messages"`      // Channels and groups where messages posted by other bots are scanned as well
+	ScanEmails          bool                 `json:"scan_emails"`            // Check the domain reputation of email addresses
+	ScanCode            []string             `json:"scan_code"`              // Channels and groups where code blocks and quotes are scanned as well
+	IgnoredUsers        []string             `json:"ignored_users"`          // Users (usually automation) whose messages we never scan
+	ReplyThreshold      map[string]string    `json:"reply_threshold"`        // Per channel minimal verdict we reply on (all, suspicious or malicious)
+	ReplyMode           map[string]string    `json:"reply_mode"`             // Per channel way we reply (message, reaction or both)
+	Muted               map[string]time.Time `json:"muted"`                  // Channels where we do not reply until the given time
+	DigestChannel       string               `json:"digest_channel"`         // Where we post the daily summary, empty for no digest
+	DigestHour          int                  `json:"digest_hour"`            // Hour of the day we post the digest in the digest timezone
+	DigestTimezone      string               `json:"digest_timezone"`        // IANA timezone of the team, UTC if empty
+	DisableWeeklyReport bool                 `json:"disable_weekly_report"`  // Do not send the weekly trends to the configuration admins
+	AllPublicChannels   bool                 `json:"all_public_channels"`    // Join every public channel, including new ones, and monitor it
+	ExcludedChannels    []string             `json:"excluded_channels"`      // Public channels we never join on our own (all public channels or patterns)
+	ChannelPatterns     []string             `json:"channel_patterns"`       // Glob patterns on channel names (incident-*) we monitor even if not listed
+	AutoMonitorOnInvite bool                 `json:"auto_monitor_on_invite"` // Add channels we are invited to to the configuration
+	SeverityVTPositives int                  `json:"severity_vt_positives"`  // VirusTotal positives from which we show an indicator as dangerous, 0 for the default
+	SeverityXFEScore    float64              `json:"severity_xfe_score"`     // X-Force Exchange score from which we show an indicator as dangerous, 0 for the default
+	DisabledSources     []string             `json:"disabled_sources"`       // Reputation sources we do not check the indicators with
+	EnabledSources      []string             `json:"enabled_sources"`        // Opt-in reputation sources the team wants
+	Scoring             ScoringProfile       `json:"scoring"`                // How much the team trusts each source for the verdict
+}
+
+const (
+	// ThresholdAll replies on clean results as well
+	ThresholdAll = "all"
+	// ThresholdSuspicious replies on anything that is not known to be clean
+	ThresholdSuspicious = "suspicious"
+	// ThresholdMalicious replies only if something was convicted
+	ThresholdMalicious = "malicious"
+)
+
+// ValidThreshold checks that the reply threshold is one we know
+func ValidThreshold(threshold string) bool {
+	return threshold == ThresholdAll || threshold == ThresholdSuspicious || threshold == ThresholdMalicious
+}
+
+// CrossesThreshold checks if the result is at least the threshold, an unknown threshold means malicious only
+func CrossesThreshold(threshold string, result int) bool {
+	switch threshold {
+	case ThresholdAll:
+		return true
+	case ThresholdSuspicious:
+		return result != ResultClean
+	}
+	return result == ResultDirty
+}
+
+// ValidSources checks that the disabled sources are ones we know and the enabled ones are opt-in
+func (c *Configuration) ValidSources() error {
+	for _, s := range c.DisabledSources {
+		if !util.In(Sources, s) {
+			return fmt.Errorf("unknown source %s - must be one of %s", s, strings.Join(Sources, ", "))
+		}
+	}
+	for _, s := range c.EnabledSources {
+		if !util.In(OptInSources, s) {
+			return fmt.Errorf("source %s is always enabled - only %s can be enabled", s, strings.Join(OptInSources, ", "))
+		}
+	}
+	return nil
+}
+
+// SkippedSources are the sources we do not check the indicators of the team with - the disabled ones and the opt-in
+// ones it did not enable
+func (c *Configuration) SkippedSources() []string {
+	skipped := append([]string{}, c.DisabledSources...)
+	for _, s := range OptInSources {
+		if !util.In(c.EnabledSources, s) && !util.In(skipped, s) {
+			skipped = append(skipped, s)
+		}
+	}
+	return skipped
+}
+
+// Clone returns a deep copy of the configuration so it can be changed while others read the original
+func (c *Configuration) Clone() *Configuration {
+	clone := *c
+	for _, list := range []*[]string{&clone.Channels, &clone.Groups, &clone.VerboseChannels, &clone.VerboseGroups, &clone.CustomPatterns,
+		&clone.Whitelist, &clone.InternalDomains, &clone.ReplyInThread, &clone.ScanBotMessages, &clone.ScanCode, &clone.IgnoredUsers,
+		&clone.ExcludedChannels, &clone.ChannelPatterns, &clone.DisabledSources, &clone.EnabledSources} {
+		if *list != nil {
+			*list = append([]string{}, *list...)
+		}
+	}
+	if c.ReplyThreshold != nil {
+		clone.ReplyThreshold = make(map[string]string, len(c.ReplyThreshold))
+		for k, v := range c.ReplyThreshold {
+			clone.ReplyThreshold[k] = v
+		}
+	}
+	if c.ReplyMode != nil {
+		clone.ReplyMode = make(map[string]string, len(c.ReplyMode))
+		for k, v := range c.ReplyMode {
+			clone.ReplyMode[k] = v
+		}
+	}
+	if c.Muted != nil {
+		clone.Muted = make(map[string]time.Time, len(c.Muted))
+		for k, v := range c.Muted {
+			clone.Muted[k] = v
+		}
+	}
+	if c.Scoring.Weights != nil {
+		clone.Scoring.Weights = make(map[string]float64, len(c.Scoring.Weights))
+		for k, v := range c.Scoring.Weights {
+			clone.Scoring.Weights[k] = v
+		}
+	}
+	return &clone
+}
+
+// ScanSettings are the parts of the configuration that decide which indicators we find in a text, for the workers
+// that extract the indicators of shared text files
+func (c *Configuration) ScanSettings() *Configuration {
+	return &Configuration{Team: c.Team, DisableRefang: c.DisableRefang, DisableDomains: c.DisableDomains, InternalIPs: c.InternalIPs,
+		ScanEmails: c.ScanEmails, CustomPatterns: c.CustomPatterns, CustomWebhook: c.CustomWebhook, Whitelist: c.Whitelist,
+		InternalDomains: c.InternalDomains}
+}
+
+const (
+	// ModeMessage replies with a message - the default
+	ModeMessage = "message"
+	// ModeReaction reacts on the original message with the verdict
+	ModeReaction = "reaction"
+	// ModeBoth replies with a message and a reaction
+	ModeBoth = "both"
+)
+
+// ValidMode checks that the reply mode is one we know
+func ValidMode(mode string) bool {
+	return mode == ModeMessage || mode == ModeReaction || mode == ModeBoth
+}
+
+const (
+	// MaxChannelPatterns a team can define
+	MaxChannelPatterns = 20
+	// MaxCustomPatterns a team can define
+	MaxCustomPatterns = 20
+	// MaxInternalDomains a team can define
+	MaxInternalDomains = 50
+	// MaxCustomPatternLength in bytes so it fits the configuration storage
+	MaxCustomPatternLength = 200
+	// maxCustomPatternInstructions limits the size of the compiled pattern
+	maxCustomPatternInstructions = 2000
+)
+
+// CompileCustomPattern validates and compiles a custom pattern.
+// Patterns that are too long, too complex or match an empty string are rejected.
+func CompileCustomPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errors.New("pattern is empty")
+	}
+	if len(pattern) > MaxCustomPatternLength {
+		return nil, fmt.Errorf("pattern is longer than %d characters", MaxCustomPatternLength)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > maxCustomPatternInstructions {
+		return nil, errors.New("pattern is too complex")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if re.MatchString("") {
+		return nil, errors.New("pattern matches an empty string")
+	}
+	return re, nil
+}
+
+// ValidateCustomPatterns makes sure all custom patterns compile and that we are within limits
+func (c *Configuration) ValidateCustomPatterns() error {
+	if len(c.CustomPatterns) > MaxCustomPatterns {
+		return fmt.Errorf("too many custom patterns, maximum is %d", MaxCustomPatterns)
+	}
+	for i, p := range c.CustomPatterns {
+		if _, err := CompileCustomPattern(p); err != nil {
+			return fmt.Errorf("invalid pattern %s - %v", p, err)
+		}
+		if util.Index(c.CustomPatterns, p) != i {
+			return fmt.Errorf("duplicate pattern %s", p)
+		}
+	}
+	return nil
+}
+
+// ValidInternalDomains makes sure the internal domains are host names and that we are within limits
+func (c *Configuration) ValidInternalDomains() error {
+	if len(c.InternalDomains) > MaxInternalDomains {
+		return fmt.Errorf("too many internal domains, maximum is %d", MaxInternalDomains)
+	}
+	for i, d := range c.InternalDomains {
+		if !validHostname(d) || len(d) > MaxCustomPatternLength {
+			return fmt.Errorf("invalid internal domain %s", d)
+		}
+		if util.Index(c.InternalDomains, d) != i {
+			return fmt.Errorf("duplicate internal domain %s", d)
+		}
+	}
+	return nil
+}
+
+// validHostname checks for dot separated labels of letters, digits and hyphens
+func validHostname(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reservedInternalDomains never resolve on the internet so their hosts are always internal
+var reservedInternalDomains = []string{"localhost", "local", "internal", "home.arpa"}
+
+// IsInternalHost checks if the host is one of the internal domains, a subdomain of one or a name that only resolves
+// inside a network - a single label (intranet) or a reserved domain (localhost)
+func IsInternalHost(host string, internal []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) == nil && !strings.Contains(host, ".") {
+		return true
+	}
+	for _, lists := range [][]string{reservedInternalDomains, internal} {
+		for _, d := range lists {
+			d = strings.ToLower(d)
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateChannelPatterns makes sure all channel patterns are valid globs and that we are within limits
+func (c *Configuration) ValidateChannelPatterns() error {
+	if len(c.ChannelPatterns) > MaxChannelPatterns {
+		return fmt.Errorf("too many channel patterns, maximum is %d", MaxChannelPatterns)
+	}
+	for i, p := range c.ChannelPatterns {
+		if _, err := path.Match(p, ""); err != nil || p == "" || len(p) > MaxCustomPatternLength {
+			return fmt.Errorf("invalid channel pattern %s", p)
+		}
+		if util.Index(c.ChannelPatterns, p) != i {
+			return fmt.Errorf("duplicate channel pattern %s", p)
+		}
+	}
+	return nil
+}
+
+// MatchesChannelPattern checks if the channel name matches one of the channel patterns
+func (c *Configuration) MatchesChannelPattern(name string) bool {
+	if name == "" {
+		return false
+	}
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	for _, p := range c.ChannelPatterns {
+		if ok, err := path.Match(strings.ToLower(strings.TrimPrefix(p, "#")), name); err == nil && ok {
+			return true
+		}
+	}
+	return false
 }
 
 // IsActive returns true if there is at least one active part for the user
 func (c *Configuration) IsActive() bool {
-	return c.All || len(c.Channels) > 0 || len(c.Groups) > 0 || c.IM ||
+	return c.All || c.AllPublicChannels || len(c.ChannelPatterns) > 0 || len(c.Channels) > 0 || len(c.Groups) > 0 || c.IM ||
 		len(c.VerboseChannels) > 0 || len(c.VerboseGroups) > 0 || c.VerboseIM
 }
 
+// IsExcluded checks if the team asked us to stay out of the channel when we join channels on our own
+func (c *Configuration) IsExcluded(channel string) bool {
+	return util.In(c.ExcludedChannels, channel)
+}
+
+// ShouldJoin checks if we should join the public channel on our own - in all public channels mode or if the name matches a pattern
+func (c *Configuration) ShouldJoin(channel, name string) bool {
+	return channel != "" && channel[0] == 'C' && !c.IsExcluded(channel) && (c.AllPublicChannels || c.MatchesChannelPattern(name))
+}
+
 // IsInterestedIn the given channel
 func (c *Configuration) IsInterestedIn(channel, channelName string) bool {
-	if len(channel) == 0 {
+	if len(channel) == 0 || c.IsExcluded(channel) {
 		return false
 	}
-	if c.All {
+	if c.All || c.AllPublicChannels && channel[0] == 'C' {
 		return true
 	}
 	found := false
@@ -43,6 +348,9 @@ func (c *Configuration) IsInterestedIn(channel, channelName string) bool {
 	case 'D':
 		return c.IM || c.VerboseIM
 	}
+	if !found && c.MatchesChannelPattern(channelName) {
+		return true
+	}
 	if !found && c.Regexp != "" && channelName != "" {
 		re, err := regexp.Compile(c.Regexp)
 		if err != nil {
@@ -55,6 +363,145 @@ func (c *Configuration) IsInterestedIn(channel, channelName string) bool {
 	return found
 }
 
+// IsWhitelisted checks if the indicator matches one of the whitelist entries.
+// Domains match their subdomains as well, URLs are matched by host and IPs are matched against CIDR entries.
+func (c *Configuration) IsWhitelisted(indicator string) bool {
+	if len(c.Whitelist) == 0 {
+		return false
+	}
+	indicator = strings.ToLower(indicator)
+	host := indicator
+	if u, err := url.Parse(indicator); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		host = u.Hostname()
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range c.Whitelist {
+		entry = strings.ToLower(entry)
+		if entry == indicator || entry == host {
+			return true
+		}
+		if ip != nil {
+			if _, n, err := net.ParseCIDR(entry); err == nil && n.Contains(ip) {
+				return true
+			}
+		} else if strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsThreaded checks if we should reply in a thread on the channel
+func (c *Configuration) IsThreaded(channel string) bool {
+	return util.In(c.ReplyInThread, channel)
+}
+
+// ScansBotMessages checks if messages of other bots should be scanned on the channel
+func (c *Configuration) ScansBotMessages(channel string) bool {
+	return util.In(c.ScanBotMessages, channel)
+}
+
+// ScansCode checks if code blocks and quotes should be scanned on the channel
+func (c *Configuration) ScansCode(channel string) bool {
+	return util.In(c.ScanCode, channel)
+}
+
+// IsIgnored checks if the messages of the user should be ignored
+func (c *Configuration) IsIgnored(user string) bool {
+	return user != "" && util.In(c.IgnoredUsers, user)
+}
+
+// Threshold returns the reply threshold of the channel or an empty string if the channel uses the verbose setting
+func (c *Configuration) Threshold(channel string) string {
+	return c.ReplyThreshold[channel]
+}
+
+// Mode returns the reply mode of the channel
+func (c *Configuration) Mode(channel string) string {
+	if mode, ok := c.ReplyMode[channel]; ok {
+		return mode
+	}
+	return ModeMessage
+}
+
+// IsMuted checks if replies on the channel are muted right now
+func (c *Configuration) IsMuted(channel string) bool {
+	until, ok := c.Muted[channel]
+	return ok && time.Now().Before(until)
+}
+
+// AddChannel lists the channel or private group as monitored. It returns true if it was not listed before.
+func (c *Configuration) AddChannel(channel string) bool {
+	if channel == "" {
+		return false
+	}
+	switch channel[0] {
+	case 'C':
+		if !util.In(c.Channels, channel) && !util.In(c.VerboseChannels, channel) {
+			c.Channels = append(c.Channels, channel)
+			return true
+		}
+	case 'G':
+		if !util.In(c.Groups, channel) && !util.In(c.VerboseGroups, channel) {
+			c.Groups = append(c.Groups, channel)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveChannel drops every setting of a channel that was archived or deleted. It returns true if anything changed.
+func (c *Configuration) RemoveChannel(channel string) bool {
+	changed := false
+	for _, list := range []*[]string{&c.Channels, &c.Groups, &c.VerboseChannels, &c.VerboseGroups, &c.ReplyInThread, &c.ScanBotMessages, &c.ScanCode, &c.ExcludedChannels} {
+		if index := util.Index(*list, channel); index >= 0 {
+			*list = append((*list)[:index], (*list)[index+1:]...)
+			changed = true
+		}
+	}
+	for _, m := range []map[string]string{c.ReplyThreshold, c.ReplyMode} {
+		if _, ok := m[channel]; ok {
+			delete(m, channel)
+			changed = true
+		}
+	}
+	if _, ok := c.Muted[channel]; ok {
+		delete(c.Muted, channel)
+		changed = true
+	}
+	if c.DigestChannel == channel {
+		c.DigestChannel, c.DigestHour, c.DigestTimezone = "", 0, ""
+		changed = true
+	}
+	return changed
+}
+
+// ValidDigest checks the digest hour and timezone
+func (c *Configuration) ValidDigest() error {
+	if c.DigestHour < 0 || c.DigestHour > 23 {
+		return fmt.Errorf("invalid digest hour %d - must be between 0 and 23", c.DigestHour)
+	}
+	if _, err := time.LoadLocation(c.DigestTimezone); err != nil {
+		return fmt.Errorf("invalid digest timezone %s", c.DigestTimezone)
+	}
+	return nil
+}
+
+// DigestDue checks if the daily digest should be posted now given when we posted the last one.
+// A digest that was missed (e.g. the bot was down at the hour) is posted later on the same day.
+func (c *Configuration) DigestDue(now, last time.Time) bool {
+	if c.DigestChannel == "" {
+		return false
+	}
+	loc, err := time.LoadLocation(c.DigestTimezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	scheduled := time.Date(now.Year(), now.Month(), now.Day(), c.DigestHour, 0, 0, 0, loc)
+	return !now.Before(scheduled) && last.Before(scheduled)
+}
+
 // IsVerbose checks if the channel is verbose
 func (c *Configuration) IsVerbose(channel string) bool {
 	if len(channel) == 0 {
@@ -1,6 +1,10 @@
 package domain
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 // TestRandomEvents tests the generation of random events
 func TestIsActive(t *testing.T) {
@@ -40,4 +44,301 @@ func TestIsInterestedIn(t *testing.T) {
 	if !c.IsInterestedIn("Cx", "") || !c.IsInterestedIn("Gx", "") || !c.IsInterestedIn("Dx", "") {
 		t.Error("Configuration is not interested but it should")
 	}
+
+	c.AllPublicChannels, c.ExcludedChannels = true, []string{"Cz"}
+	if !c.IsInterestedIn("Cy", "") || c.IsInterestedIn("Cz", "") || c.IsInterestedIn("Gy", "") {
+		t.Error("All public channels mode should monitor public channels that are not excluded")
+	}
+	if !c.ShouldJoin("Cy", "") || c.ShouldJoin("Cz", "") || c.ShouldJoin("Gy", "") {
+		t.Error("All public channels mode should join public channels that are not excluded")
+	}
+
+	c = Configuration{ChannelPatterns: []string{"incident-*", "#SEC-*"}}
+	if !c.IsInterestedIn("Cy", "incident-42") || !c.IsInterestedIn("Gy", "sec-team") || c.IsInterestedIn("Cy", "general") {
+		t.Error("Channel patterns should monitor the matching channels")
+	}
+	if !c.ShouldJoin("Cy", "incident-42") || c.ShouldJoin("Gy", "sec-team") || c.ShouldJoin("Cy", "") {
+		t.Error("Channel patterns should join only matching public channels")
+	}
+}
+
+func TestCompileCustomPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{`\bTICKET-\d{4,8}\b`, true},
+		{`(?i)emotet|trickbot`, true},
+		{``, false},
+		{`(unclosed`, false},
+		{`a*`, false},
+		{`(a{1000}){1000}`, false},
+		{`((((a{100}){100}){100}){100})`, false},
+		{strings.Repeat("a", MaxCustomPatternLength+1), false},
+	}
+	for _, test := range tests {
+		_, err := CompileCustomPattern(test.pattern)
+		if (err == nil) != test.valid {
+			t.Errorf("CompileCustomPattern(%q) error = %v, expected valid %v", test.pattern, err, test.valid)
+		}
+	}
+}
+
+func TestIsWhitelisted(t *testing.T) {
+	c := &Configuration{Whitelist: []string{"52.0.0.0/8", "8.8.8.8", "example.com", "d41d8cd98f00b204e9800998ecf8427e", "http://cdn.net/file.js"}}
+	tests := []struct {
+		indicator   string
+		whitelisted bool
+	}{
+		{"52.1.2.3", true},
+		{"53.1.2.3", false},
+		{"8.8.8.8", true},
+		{"8.8.4.4", false},
+		{"example.com", true},
+		{"www.EXAMPLE.com", true},
+		{"badexample.com", false},
+		{"https://mail.example.com/login", true},
+		{"http://52.3.3.3/x", true},
+		{"http://cdn.net/file.js", true},
+		{"http://cdn.net/other.js", false},
+		{"D41D8CD98F00B204E9800998ECF8427E", true},
+		{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", false},
+	}
+	for _, test := range tests {
+		if res := c.IsWhitelisted(test.indicator); res != test.whitelisted {
+			t.Errorf("IsWhitelisted(%s) = %v, expected %v", test.indicator, res, test.whitelisted)
+		}
+	}
+}
+
+func TestIsThreaded(t *testing.T) {
+	c := &Configuration{ReplyInThread: []string{"C1", "G1"}}
+	if !c.IsThreaded("C1") || !c.IsThreaded("G1") || c.IsThreaded("C2") || c.IsThreaded("D1") {
+		t.Error("unexpected thread state")
+	}
+}
+
+func TestScansBotMessages(t *testing.T) {
+	c := &Configuration{ScanBotMessages: []string{"C1"}}
+	if !c.ScansBotMessages("C1") || c.ScansBotMessages("C2") {
+		t.Error("unexpected bot message scanning state")
+	}
+}
+
+func TestIsIgnored(t *testing.T) {
+	c := &Configuration{IgnoredUsers: []string{"U1"}}
+	if !c.IsIgnored("U1") || c.IsIgnored("U2") || c.IsIgnored("") {
+		t.Error("unexpected ignore state")
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	var c Configuration
+	if c.Threshold("C1") != "" {
+		t.Error("expected no threshold on an empty configuration")
+	}
+	c.ReplyThreshold = map[string]string{"C1": ThresholdMalicious}
+	if c.Threshold("C1") != ThresholdMalicious || c.Threshold("C2") != "" {
+		t.Error("unexpected threshold")
+	}
+	if !ValidThreshold("all") || !ValidThreshold("suspicious") || !ValidThreshold("malicious") || ValidThreshold("clean") {
+		t.Error("unexpected threshold validation")
+	}
+	// Suspicious verdicts reach the suspicious threshold but not the malicious one
+	if !CrossesThreshold(ThresholdSuspicious, ResultSuspicious) || CrossesThreshold(ThresholdMalicious, ResultSuspicious) {
+		t.Error("unexpected threshold of a suspicious verdict")
+	}
+}
+
+func TestValidSources(t *testing.T) {
+	c := Configuration{DisabledSources: []string{SourceVT, SourceCy}}
+	if err := c.ValidSources(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	c.DisabledSources = append(c.DisabledSources, "shodan")
+	if err := c.ValidSources(); err == nil || !strings.Contains(err.Error(), "shodan") {
+		t.Errorf("expected an error for the unknown source but got %v", err)
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	reply := &WorkReply{URLs: []URLReply{{Result: ResultClean}}}
+	if reply.Verdict() != ResultClean {
+		t.Error("expected a clean verdict")
+	}
+	reply.IPs = []IPReply{{Result: ResultUnknown}}
+	if reply.Verdict() != ResultUnknown {
+		t.Error("expected an unknown verdict")
+	}
+	reply.Domains = []DomainReply{{Result: ResultSuspicious}}
+	if reply.Verdict() != ResultSuspicious {
+		t.Error("expected a suspicious verdict")
+	}
+	reply.Hashes = []HashReply{{Result: ResultDirty}}
+	if reply.Verdict() != ResultDirty {
+		t.Error("expected a dirty verdict")
+	}
+	if (&WorkReply{CVEs: []CVEReply{{}}}).Verdict() != ResultUnknown {
+		t.Error("expected CVEs to be unknown")
+	}
+	if (&WorkReply{Type: ReplyTypeFile, File: FileReply{Result: ResultDirty}}).Verdict() != ResultDirty {
+		t.Error("expected a dirty file verdict")
+	}
+}
+
+func TestMode(t *testing.T) {
+	c := &Configuration{ReplyMode: map[string]string{"C1": ModeReaction}}
+	if c.Mode("C1") != ModeReaction || c.Mode("C2") != ModeMessage {
+		t.Error("unexpected reply mode")
+	}
+	if !ValidMode("message") || !ValidMode("reaction") || !ValidMode("both") || ValidMode("emoji") {
+		t.Error("unexpected mode validation")
+	}
+}
+
+func TestIsMuted(t *testing.T) {
+	c := &Configuration{Muted: map[string]time.Time{"C1": time.Now().Add(time.Hour), "C2": time.Now().Add(-time.Minute)}}
+	if !c.IsMuted("C1") || c.IsMuted("C2") || c.IsMuted("C3") {
+		t.Error("unexpected mute state")
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	c := &Configuration{DigestChannel: "C1", DigestHour: 9, DigestTimezone: "America/New_York"}
+	loc, _ := time.LoadLocation("America/New_York")
+	morning := time.Date(2018, 1, 2, 9, 30, 0, 0, loc)
+	tests := []struct {
+		now, last time.Time
+		due       bool
+	}{
+		{morning, time.Time{}, true},
+		{morning, morning.Add(-time.Minute), false},
+		{morning, morning.Add(-24 * time.Hour), true},
+		{morning.Add(-time.Hour), morning.Add(-25 * time.Hour), false},
+		{morning.Add(12 * time.Hour), morning.Add(-24 * time.Hour), true},
+	}
+	for i, test := range tests {
+		if due := c.DigestDue(test.now, test.last); due != test.due {
+			t.Errorf("test %d: expected due %v", i, test.due)
+		}
+	}
+	if (&Configuration{}).DigestDue(morning, time.Time{}) {
+		t.Error("digest without a channel should never be due")
+	}
+	if (&Configuration{DigestHour: 24}).ValidDigest() == nil || (&Configuration{DigestTimezone: "Nowhere/City"}).ValidDigest() == nil {
+		t.Error("expected invalid digest settings")
+	}
+}
+
+func TestValidateChannelPatterns(t *testing.T) {
+	c := Configuration{ChannelPatterns: []string{"incident-*", "sec-?"}}
+	if err := c.ValidateChannelPatterns(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, patterns := range [][]string{{"bad-["}, {""}, {"a-*", "a-*"}} {
+		c.ChannelPatterns = patterns
+		if err := c.ValidateChannelPatterns(); err == nil {
+			t.Errorf("expected an error for %v", patterns)
+		}
+	}
+}
+
+func TestValidInternalDomains(t *testing.T) {
+	c := Configuration{InternalDomains: []string{"corp.example.com", "intra-net.io"}}
+	if err := c.ValidInternalDomains(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, domains := range [][]string{{""}, {"a..b"}, {"-corp.com"}, {"corp.com/x"}, {"a.com", "a.com"}} {
+		c.InternalDomains = domains
+		if err := c.ValidInternalDomains(); err == nil {
+			t.Errorf("expected an error for %v", domains)
+		}
+	}
+}
+
+func TestIsInternalHost(t *testing.T) {
+	internal := []string{"corp.example.com"}
+	tests := []struct {
+		host     string
+		internal bool
+	}{
+		{"corp.example.com", true},
+		{"Wiki.Corp.Example.com.", true},
+		{"example.com", false},
+		{"badcorp.example.com", false},
+		{"localhost", true},
+		{"app.localhost", true},
+		{"printer.local", true},
+		{"intranet", true},
+		{"10.1.2.3", false}, // IPs are checked by their range
+		{"", false},
+	}
+	for _, test := range tests {
+		if res := IsInternalHost(test.host, internal); res != test.internal {
+			t.Errorf("IsInternalHost(%s) = %v, expected %v", test.host, res, test.internal)
+		}
+	}
+}
+
+func TestRemoveChannel(t *testing.T) {
+	c := Configuration{
+		Channels:        []string{"C1", "C2"},
+		VerboseChannels: []string{"C1"},
+		ReplyInThread:   []string{"C1"},
+		ReplyThreshold:  map[string]string{"C1": ThresholdMalicious},
+		Muted:           map[string]time.Time{"C1": time.Now().Add(time.Hour)},
+		DigestChannel:   "C1",
+		DigestHour:      9,
+	}
+	if !c.RemoveChannel("C1") {
+		t.Fatal("expected the configuration to change")
+	}
+	if len(c.Channels) != 1 || len(c.VerboseChannels) != 0 || c.IsThreaded("C1") || c.Threshold("C1") != "" || c.IsMuted("C1") || c.DigestChannel != "" {
+		t.Errorf("channel settings were not removed %+v", c)
+	}
+	if c.RemoveChannel("C1") {
+		t.Error("did not expect a change for a channel we do not know")
+	}
+}
+
+func TestAddChannel(t *testing.T) {
+	c := Configuration{VerboseChannels: []string{"C2"}}
+	if !c.AddChannel("C1") || !c.AddChannel("G1") || c.AddChannel("C1") || c.AddChannel("C2") || c.AddChannel("D1") {
+		t.Errorf("unexpected add results %+v", c)
+	}
+	if len(c.Channels) != 1 || len(c.Groups) != 1 {
+		t.Errorf("unexpected configuration %+v", c)
+	}
+}
+
+func TestSkippedSources(t *testing.T) {
+	c := Configuration{DisabledSources: []string{SourceVT}}
+	if skipped := c.SkippedSources(); len(skipped) != 2 || skipped[0] != SourceVT || skipped[1] != SourceHIBP {
+		t.Errorf("expected the disabled and the opt-in sources but got %v", skipped)
+	}
+	c.EnabledSources = []string{SourceHIBP}
+	if skipped := c.SkippedSources(); len(skipped) != 1 || skipped[0] != SourceVT {
+		t.Errorf("expected only the disabled sources but got %v", skipped)
+	}
+	if err := c.ValidSources(); err != nil {
+		t.Error(err)
+	}
+	c.EnabledSources = []string{SourceVT}
+	if err := c.ValidSources(); err == nil {
+		t.Error("expected an error for enabling a source that is not opt-in")
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := &Configuration{Channels: []string{"C1"}, VerboseChannels: []string{}, ReplyThreshold: map[string]string{"C1": ThresholdAll},
+		ReplyMode: map[string]string{"C1": ModeReaction}, Muted: map[string]time.Time{"C1": time.Now()}, Scoring: ScoringProfile{Weights: map[string]float64{"VT": 1}}}
+	clone := c.Clone()
+	clone.Channels[0], clone.ReplyThreshold["C2"], clone.ReplyMode["C2"], clone.Scoring.Weights["VT"] = "C2", ThresholdMalicious, ModeBoth, 2
+	delete(clone.Muted, "C1")
+	if c.Channels[0] != "C1" || len(c.ReplyThreshold) != 1 || len(c.ReplyMode) != 1 || len(c.Muted) != 1 || c.Scoring.Weights["VT"] != 1 {
+		t.Errorf("changing the clone changed the original - %+v", c)
+	}
+	if clone.VerboseChannels == nil || clone.Groups != nil {
+		t.Error("expected the clone to keep empty and missing lists as they are")
+	}
 }
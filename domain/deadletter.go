@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/util"
+)
+
+// DeadLetter is a work request the workers gave up on after failing it too many times. It is kept until an admin of
+// the team drives it again.
+type DeadLetter struct {
+	ID        int64     `json:"id" db:"id"`
+	Team      string    `json:"team" db:"team"` // The external ID of the team from the context of the request
+	MessageID string    `json:"message_id" db:"message_id"`
+	Type      string    `json:"type" db:"type"`
+	Request   string    `json:"-" db:"request"` // The encrypted JSON of the request, it has the credentials of the team
+	Error     string    `json:"error" db:"error"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	Failed    time.Time `json:"failed" db:"failed"`
+}
+
+// maxDeadLetterError is the size of the error column
+const maxDeadLetterError = 1024
+
+// NewDeadLetter of the request that failed with the error
+func NewDeadLetter(request *WorkRequest, failure error) (*DeadLetter, error) {
+	d := &DeadLetter{MessageID: request.MessageID, Type: request.Type, Error: util.Substr(failure.Error(), 0, maxDeadLetterError),
+		Attempts: request.Attempts, Failed: time.Now()}
+	if ctx, err := GetContext(request.Context); err == nil {
+		d.Team = ctx.Team
+	}
+	var err error
+	if d.Request, err = util.EncryptJSON(request, conf.Options.Security.DBKey); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WorkRequest is returned from the encrypted request to drive it again, the attempts and the TTL start over
+func (d *DeadLetter) WorkRequest() (*WorkRequest, error) {
+	request := &WorkRequest{}
+	if err := util.DecryptJSON(d.Request, conf.Options.Security.DBKey, request); err != nil {
+		return nil, err
+	}
+	request.Attempts, request.Enqueued = 0, time.Now()
+	return request, nil
+}
@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/conf"
+)
+
+func TestDeadLetter(t *testing.T) {
+	saved := conf.Options.Security
+	defer func() { conf.Options.Security = saved }()
+	conf.Options.Security.DBKey = "0123456789abcdef0123456789abcdef"
+	request := &WorkRequest{Type: "message", MessageID: "1.1", Text: "8.8.8.8", IPs: []string{"8.8.8.8"}, Attempts: 3,
+		Context: &Context{Team: "T1", Channel: "C1"}}
+	d, err := NewDeadLetter(request, errors.New(strings.Repeat("x", 2000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Team != "T1" || d.Attempts != 3 || len(d.Error) != maxDeadLetterError || strings.Contains(d.Request, "8.8.8.8") {
+		t.Errorf("unexpected dead letter %+v", d)
+	}
+	again, err := d.WorkRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.MessageID != "1.1" || again.Attempts != 0 || len(again.IPs) != 1 {
+		t.Errorf("expected the request to start over but got %+v", again)
+	}
+}
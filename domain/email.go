@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+const (
+	// MaxEmailRecipients is the number of addresses a team can send the alerts to
+	MaxEmailRecipients = 10
+	// maxEmailRecipientsSize is the size of the recipients column
+	maxEmailRecipientsSize = 1024
+)
+
+// EmailAlerts are the people that want an email when a verdict crosses the threshold, e.g. managers that are not on Slack
+type EmailAlerts struct {
+	Team       string   `json:"-"`
+	Recipients []string `json:"recipients"`
+	Threshold  string   `json:"threshold"` // Minimal verdict we email (all, suspicious or malicious)
+}
+
+// Validate the alerts, an empty threshold means malicious only
+func (a *EmailAlerts) Validate() error {
+	if len(a.Recipients) == 0 || len(a.Recipients) > MaxEmailRecipients {
+		return fmt.Errorf("email alerts need between 1 and %d recipients", MaxEmailRecipients)
+	}
+	for _, r := range a.Recipients {
+		addr, err := mail.ParseAddress(r)
+		if err != nil || addr.Address != r || strings.Contains(r, ",") {
+			return fmt.Errorf("invalid email address %s", r)
+		}
+	}
+	if len(strings.Join(a.Recipients, ",")) > maxEmailRecipientsSize {
+		return errors.New("the recipients are too long")
+	}
+	if a.Threshold == "" {
+		a.Threshold = ThresholdMalicious
+	}
+	if !ValidThreshold(a.Threshold) {
+		return errors.New("email threshold must be all, suspicious or malicious")
+	}
+	return nil
+}
+
+// Sends checks if the result crosses the threshold of the alerts
+func (a *EmailAlerts) Sends(result int) bool {
+	return CrossesThreshold(a.Threshold, result)
+}
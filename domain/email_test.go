@@ -0,0 +1,20 @@
+package domain
+
+import "testing"
+
+func TestEmailAlertsValidate(t *testing.T) {
+	alerts := &EmailAlerts{Recipients: []string{"ciso@example.com"}}
+	if err := alerts.Validate(); err != nil || alerts.Threshold != ThresholdMalicious {
+		t.Errorf("expected valid alerts with the default threshold but got %s - %v", alerts.Threshold, err)
+	}
+	for _, bad := range []*EmailAlerts{
+		{},
+		{Recipients: []string{"CISO <ciso@example.com>"}},
+		{Recipients: []string{"not an address"}},
+		{Recipients: []string{"ciso@example.com"}, Threshold: "dangerous"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"errors"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/util"
+)
+
+const (
+	// maxSandboxURL is the size of the url column
+	maxSandboxURL = 512
+	// maxSandboxKey leaves room for the encryption in the api_key column
+	maxSandboxKey = 256
+)
+
+// Sandbox is where the team runs the shared files no reputation source knows, a Cuckoo or CAPE compatible REST API
+type Sandbox struct {
+	Team    string `json:"-" db:"team"`
+	URL     string `json:"url" db:"url"`
+	Key     string `json:"key,omitempty" db:"api_key"` // Sent as a bearer token, never returned by the API
+	MaxSize int    `json:"max_size" db:"max_size"`     // Bytes of the largest file we submit, 0 for the download limit
+	Enabled bool   `json:"enabled" db:"enabled"`
+}
+
+// Validate the sandbox settings
+func (s *Sandbox) Validate() error {
+	if len(s.URL) > maxSandboxURL || !util.PublicURL(s.URL) {
+		return errors.New("sandbox must be a valid public http(s) URL of up to 512 characters")
+	}
+	if len(s.Key) > maxSandboxKey {
+		return errors.New("sandbox API key must be up to 256 characters")
+	}
+	if s.MaxSize < 0 {
+		return errors.New("sandbox max size must not be negative")
+	}
+	return nil
+}
+
+// Submits checks if the sandbox is enabled and takes a file of the size
+func (s *Sandbox) Submits(size int) bool {
+	return s != nil && s.Enabled && (s.MaxSize == 0 || size <= s.MaxSize)
+}
+
+// ClearKey is returned from the encrypted key
+func (s *Sandbox) ClearKey() (string, error) {
+	if s.Key != "" {
+		return util.Decrypt(s.Key, conf.Options.Security.DBKey)
+	}
+	return "", nil
+}
+
+// SecureKey is returned from the clear key
+func (s *Sandbox) SecureKey() (string, error) {
+	if s.Key != "" {
+		return util.Encrypt(s.Key, conf.Options.Security.DBKey)
+	}
+	return "", nil
+}
+
+// SandboxReply is the behavioral verdict of a file the sandbox ran, a follow up of the reply to the file
+type SandboxReply struct {
+	Result     int      `json:"result"`
+	Task       int      `json:"task"`       // The ID of the analysis in the sandbox
+	Score      float64  `json:"score"`      // 0 - 10
+	Signatures []string `json:"signatures"` // The behaviors the sandbox saw, the most severe first
+	Coalesced  bool     `json:"coalesced"`  // The file was submitted recently so this is the earlier analysis
+	Error      string   `json:"error"`
+}
+
+// SandboxRun is a file running in a sandbox, shared by the workers so the file shared again is not submitted again
+type SandboxRun struct {
+	Key     string        // The sandbox and the hash of the file
+	Worker  string        // Running the file
+	Expires time.Time     // The run is taken over after it if it is running, the verdict is dropped after it
+	Reply   *SandboxReply // The verdict, nil while the file is running
+}
@@ -0,0 +1,39 @@
+package domain
+
+import "testing"
+
+func TestSandboxValidate(t *testing.T) {
+	s := &Sandbox{URL: "https://cuckoo.example.com:8090", Key: "k3y", Enabled: true}
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected a valid sandbox but got %v", err)
+	}
+	for _, bad := range []*Sandbox{
+		{URL: "ftp://cuckoo.example.com"},
+		{URL: "http://localhost:8090"},
+		{URL: "cuckoo.example.com"},
+		{URL: "https://cuckoo.example.com", MaxSize: -1},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func TestSandboxSubmits(t *testing.T) {
+	tests := []struct {
+		sandbox  *Sandbox
+		size     int
+		expected bool
+	}{
+		{nil, 10, false},
+		{&Sandbox{MaxSize: 100}, 10, false},
+		{&Sandbox{Enabled: true}, 1 << 30, true},
+		{&Sandbox{Enabled: true, MaxSize: 100}, 100, true},
+		{&Sandbox{Enabled: true, MaxSize: 100}, 101, false},
+	}
+	for _, test := range tests {
+		if submits := test.sandbox.Submits(test.size); submits != test.expected {
+			t.Errorf("%+v submits %d bytes %v, expected %v", test.sandbox, test.size, submits, test.expected)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/demisto/alfred/util"
+)
+
+const (
+	// DefaultSourceWeight is the weight of the sources the profile does not list unless they have a default weight
+	DefaultSourceWeight = 1
+	// DefaultMaliciousScore is the score from which an indicator is malicious - a single source by default
+	DefaultMaliciousScore = 1
+	// maxSourceWeight bounds the weights so a typo does not make a source the only one that counts
+	maxSourceWeight = 10
+	// scoreEpsilon absorbs the rounding of summing fractional weights, e.g. 0.1 + 0.2 reaches a 0.3 threshold
+	scoreEpsilon = 1e-9
+)
+
+// defaultWeights are the weights of the sources that do not weigh DefaultSourceWeight unless the profile lists them.
+// A young certificate alone only makes a URL suspicious.
+var defaultWeights = map[string]float64{SourceTLS: 0.5}
+
+// ScoringProfile is how much a team trusts each source when we combine their results into the verdict.
+// Every source that convicted the indicator adds its weight to the score of the indicator. The zero profile is the
+// default one, where a single conviction is malicious.
+type ScoringProfile struct {
+	// Weights of the sources, the ones not listed weigh their default weight and a weight of 0 ignores the source
+	Weights map[string]float64 `json:"weights"`
+	// Malicious is the score from which the indicator is malicious, 0 for DefaultMaliciousScore
+	Malicious float64 `json:"malicious"`
+	// Suspicious is the score from which the indicator is suspicious, 0 for half the malicious threshold
+	Suspicious float64 `json:"suspicious"`
+}
+
+// weight of the source and if it counts at all
+func (p *ScoringProfile) weight(source string) (float64, bool) {
+	w, ok := p.Weights[source]
+	if !ok {
+		if w, ok = defaultWeights[source]; ok {
+			return w, true
+		}
+		return DefaultSourceWeight, true
+	}
+	return w, w > 0
+}
+
+// thresholds of the profile with the defaults for the ones not set
+func (p *ScoringProfile) thresholds() (malicious, suspicious float64) {
+	malicious, suspicious = p.Malicious, p.Suspicious
+	if malicious <= 0 {
+		malicious = DefaultMaliciousScore
+	}
+	if suspicious <= 0 {
+		suspicious = malicious / 2
+	}
+	return malicious, suspicious
+}
+
+// Effective is the profile with the defaults filled in - the weight of every source and both thresholds
+func (p *ScoringProfile) Effective() ScoringProfile {
+	res := ScoringProfile{Weights: make(map[string]float64, len(Sources))}
+	for _, s := range Sources {
+		res.Weights[s], _ = p.weight(s)
+	}
+	res.Malicious, res.Suspicious = p.thresholds()
+	return res
+}
+
+// known checks if the source has data on the indicator - it did not fail, did not say it does not know it and is not
+// still pending
+func known(r *SourceResult) bool {
+	return !r.NotFound && r.Error == "" && !r.Pending
+}
+
+// Verdict combines the results of the sources of an indicator:
+//   - Info results, sources that do not know the indicator, failed or are pending (no data) and sources of weight 0
+//     never count
+//   - Weak results only count if no other source knows the indicator
+//   - The convictions add up to the score, at the malicious threshold the indicator is malicious and at the
+//     suspicious threshold it is suspicious. Sources that found it clean do not outweigh the convictions.
+//   - Below the thresholds it is clean if any source knows it and the fallback otherwise
+//
+// The score does not depend on the order of the results so the same results always get the same verdict.
+func (p *ScoringProfile) Verdict(results []SourceResult, fallback int) int {
+	counts := func(r *SourceResult) bool {
+		_, ok := p.weight(r.Source)
+		return ok && !r.Info && known(r)
+	}
+	strong := false
+	for i := range results {
+		if counts(&results[i]) && !results[i].Weak {
+			strong = true
+		}
+	}
+	score, found := 0.0, false
+	for i := range results {
+		r := &results[i]
+		if !counts(r) || r.Weak && strong {
+			continue
+		}
+		found = true
+		if r.Result == ResultDirty {
+			w, _ := p.weight(r.Source)
+			score += w
+		}
+	}
+	malicious, suspicious := p.thresholds()
+	switch {
+	case score >= malicious-scoreEpsilon:
+		return ResultDirty
+	case score >= suspicious-scoreEpsilon:
+		return ResultSuspicious
+	case found:
+		return ResultClean
+	}
+	return fallback
+}
+
+// ValidScoring checks the scoring profile of the team, zero thresholds mean the defaults
+func (c *Configuration) ValidScoring() error {
+	p := &c.Scoring
+	var sources []string
+	for s := range p.Weights {
+		sources = append(sources, s)
+	}
+	// The first error is always about the same source
+	sort.Strings(sources)
+	for _, s := range sources {
+		if !util.In(Sources, s) {
+			return fmt.Errorf("unknown source %s - must be one of %s", s, strings.Join(Sources, ", "))
+		}
+		if w := p.Weights[s]; w < 0 || w > maxSourceWeight {
+			return fmt.Errorf("invalid weight %v for %s - must be between 0 and %d", w, s, maxSourceWeight)
+		}
+	}
+	if p.Malicious < 0 || p.Suspicious < 0 {
+		return fmt.Errorf("invalid scoring thresholds - must not be negative")
+	}
+	if malicious, suspicious := p.thresholds(); suspicious > malicious {
+		return fmt.Errorf("suspicious threshold %v must not be above the malicious threshold %v", suspicious, malicious)
+	}
+	return nil
+}
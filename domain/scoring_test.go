@@ -0,0 +1,102 @@
+package domain
+
+import "testing"
+
+func TestScoringVerdict(t *testing.T) {
+	result := func(source string, result int) SourceResult {
+		return SourceResult{Source: source, Result: result}
+	}
+	vtDirty, xfeDirty, otxDirty := result(SourceVT, ResultDirty), result(SourceXFE, ResultDirty), result(SourceOTX, ResultDirty)
+	vtClean, xfeClean := result(SourceVT, ResultClean), result(SourceXFE, ResultClean)
+	missing := SourceResult{Source: SourceCy, Result: ResultUnknown, NotFound: true}
+	failed := SourceResult{Source: SourceURLhaus, Result: ResultUnknown, Error: "timeout"}
+	weak := SourceResult{Source: SourceOTX, Result: ResultDirty, Weak: true}
+	info := SourceResult{Source: SourceHIBP, Result: ResultDirty, Info: true}
+	// The team trusts X-Force Exchange less and does not trust OTX at all
+	cautious := ScoringProfile{Weights: map[string]float64{SourceXFE: 0.5, SourceOTX: 0}}
+	fractions := ScoringProfile{Weights: map[string]float64{SourceVT: 0.1, SourceXFE: 0.2}, Malicious: 0.3}
+	tests := []struct {
+		name     string
+		profile  ScoringProfile
+		results  []SourceResult
+		fallback int
+		expected int
+	}{
+		{"conviction wins over clean", ScoringProfile{}, []SourceResult{vtClean, xfeDirty}, ResultUnknown, ResultDirty},
+		{"clean with no data", ScoringProfile{}, []SourceResult{vtClean, missing}, ResultUnknown, ResultClean},
+		{"no data is not clean", ScoringProfile{}, []SourceResult{missing, failed}, ResultUnknown, ResultUnknown},
+		{"no data falls back", ScoringProfile{}, []SourceResult{missing}, ResultClean, ResultClean},
+		{"no sources", ScoringProfile{}, nil, ResultUnknown, ResultUnknown},
+		{"info never counts", ScoringProfile{}, []SourceResult{info}, ResultUnknown, ResultUnknown},
+		{"pending is not clean", ScoringProfile{}, []SourceResult{{Source: SourceVT, Result: ResultUnknown, Pending: true}}, ResultUnknown, ResultUnknown},
+		{"failed conviction does not count", ScoringProfile{}, []SourceResult{{Source: SourceVT, Result: ResultDirty, Error: "quota"}}, ResultUnknown, ResultUnknown},
+		// Weak results only convict what the other sources do not know
+		{"weak with clean", ScoringProfile{}, []SourceResult{vtClean, weak}, ResultUnknown, ResultClean},
+		{"weak with no data", ScoringProfile{}, []SourceResult{missing, weak}, ResultUnknown, ResultDirty},
+		{"weak alone", ScoringProfile{}, []SourceResult{weak}, ResultUnknown, ResultDirty},
+		// Weights of the team
+		{"less trusted source is suspicious", cautious, []SourceResult{vtClean, xfeDirty}, ResultUnknown, ResultSuspicious},
+		{"less trusted sources add up", cautious, []SourceResult{xfeDirty, vtDirty}, ResultUnknown, ResultDirty},
+		{"ignored source does not convict", cautious, []SourceResult{otxDirty}, ResultUnknown, ResultUnknown},
+		{"ignored source against clean", cautious, []SourceResult{otxDirty, vtClean}, ResultUnknown, ResultClean},
+		{"ignored strong source does not hide weak ones", ScoringProfile{Weights: map[string]float64{SourceVT: 0}},
+			[]SourceResult{vtClean, weak}, ResultUnknown, ResultDirty},
+		{"fractions reach the threshold", fractions, []SourceResult{vtDirty, xfeDirty}, ResultUnknown, ResultDirty},
+		{"fractions below the threshold", fractions, []SourceResult{vtDirty, xfeClean}, ResultUnknown, ResultClean},
+		{"fractions above the default suspicious threshold", fractions, []SourceResult{xfeDirty}, ResultUnknown, ResultSuspicious},
+		{"explicit thresholds", ScoringProfile{Malicious: 3, Suspicious: 2}, []SourceResult{vtDirty, xfeDirty, otxDirty}, ResultUnknown, ResultDirty},
+		{"below explicit suspicious", ScoringProfile{Malicious: 3, Suspicious: 2}, []SourceResult{vtDirty, xfeClean}, ResultUnknown, ResultClean},
+	}
+	for _, test := range tests {
+		if res := test.profile.Verdict(test.results, test.fallback); res != test.expected {
+			t.Errorf("%s: expected %d but got %d", test.name, test.expected, res)
+		}
+		// The order of the sources never changes the verdict
+		reversed := make([]SourceResult, len(test.results))
+		for i := range test.results {
+			reversed[len(reversed)-1-i] = test.results[i]
+		}
+		if res := test.profile.Verdict(reversed, test.fallback); res != test.expected {
+			t.Errorf("%s reversed: expected %d but got %d", test.name, test.expected, res)
+		}
+	}
+}
+
+func TestEffectiveScoring(t *testing.T) {
+	p := ScoringProfile{Weights: map[string]float64{SourceXFE: 0.5}, Malicious: 2}
+	e := p.Effective()
+	if len(e.Weights) != len(Sources) || e.Weights[SourceXFE] != 0.5 || e.Weights[SourceVT] != DefaultSourceWeight ||
+		e.Weights[SourceTLS] != 0.5 {
+		t.Errorf("unexpected weights %v", e.Weights)
+	}
+	if e.Malicious != 2 || e.Suspicious != 1 {
+		t.Errorf("unexpected thresholds %v / %v", e.Malicious, e.Suspicious)
+	}
+	// The profile overrides the default weights
+	if e = (&ScoringProfile{Weights: map[string]float64{SourceTLS: 1}}).Effective(); e.Weights[SourceTLS] != 1 {
+		t.Errorf("unexpected weights %v", e.Weights)
+	}
+}
+
+func TestValidScoring(t *testing.T) {
+	tests := []struct {
+		profile ScoringProfile
+		valid   bool
+	}{
+		{ScoringProfile{}, true},
+		{ScoringProfile{Weights: map[string]float64{SourceVT: 2, SourceOTX: 0}, Malicious: 2, Suspicious: 1}, true},
+		{ScoringProfile{Weights: map[string]float64{"nope": 1}}, false},
+		{ScoringProfile{Weights: map[string]float64{SourceVT: -1}}, false},
+		{ScoringProfile{Weights: map[string]float64{SourceVT: maxSourceWeight + 1}}, false},
+		{ScoringProfile{Malicious: -1}, false},
+		{ScoringProfile{Malicious: 1, Suspicious: 2}, false},
+		// Suspicious only above the default malicious threshold
+		{ScoringProfile{Suspicious: 1.5}, false},
+	}
+	for i, test := range tests {
+		c := &Configuration{Scoring: test.profile}
+		if err := c.ValidScoring(); (err == nil) != test.valid {
+			t.Errorf("test %d: expected valid %v but got %v", i, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package domain
+
+import "fmt"
+
+const (
+	// SeverityGood is known to be clean
+	SeverityGood = "good"
+	// SeverityWarning is not convicted but worth a look - unknown or flagged by a few engines
+	SeverityWarning = "warning"
+	// SeverityDanger is convicted or above the team thresholds
+	SeverityDanger = "danger"
+)
+
+const (
+	// DefaultSeverityVTPositives is the VirusTotal positives from which an indicator is dangerous
+	DefaultSeverityVTPositives = 5
+	// DefaultSeverityXFEScore is the X-Force Exchange score from which an indicator is dangerous
+	DefaultSeverityXFEScore = 7
+	// maxXFEScore is the highest score X-Force Exchange gives
+	maxXFEScore = 10
+)
+
+// Scores are what the reputation services said about an indicator
+type Scores struct {
+	Result      int     // One of the results
+	VTPositives int     // Engines that flagged it on VirusTotal
+	XFEScore    float64 // Risk score on X-Force Exchange
+}
+
+// severities from the least to the most severe
+var severities = map[string]int{SeverityGood: 0, SeverityWarning: 1, SeverityDanger: 2}
+
+// Severity maps the scores to the color we show them with.
+// Convicted indicators and the ones above the team thresholds are dangerous, unknown and suspicious ones and the ones
+// that only some engines flagged are a warning and the rest are good.
+func (c *Configuration) Severity(s Scores) string {
+	vt, xfe := DefaultSeverityVTPositives, float64(DefaultSeverityXFEScore)
+	if c != nil && c.SeverityVTPositives > 0 {
+		vt = c.SeverityVTPositives
+	}
+	if c != nil && c.SeverityXFEScore > 0 {
+		xfe = c.SeverityXFEScore
+	}
+	switch {
+	case s.Result == ResultDirty || s.VTPositives >= vt || s.XFEScore >= xfe:
+		return SeverityDanger
+	case s.Result == ResultUnknown || s.Result == ResultSuspicious || s.VTPositives > 0:
+		return SeverityWarning
+	}
+	return SeverityGood
+}
+
+// WorstSeverity of the given ones, good if there are none
+func WorstSeverity(severity ...string) string {
+	worst := SeverityGood
+	for _, s := range severity {
+		if severities[s] > severities[worst] {
+			worst = s
+		}
+	}
+	return worst
+}
+
+// ValidSeverity checks the severity thresholds of the team, zero means the default
+func (c *Configuration) ValidSeverity() error {
+	if c.SeverityVTPositives < 0 {
+		return fmt.Errorf("invalid VirusTotal positives threshold %d - must not be negative", c.SeverityVTPositives)
+	}
+	if c.SeverityXFEScore < 0 || c.SeverityXFEScore > maxXFEScore {
+		return fmt.Errorf("invalid X-Force Exchange score threshold %v - must be between 0 and %d", c.SeverityXFEScore, maxXFEScore)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package domain
+
+import "testing"
+
+func TestSeverity(t *testing.T) {
+	var c *Configuration
+	tests := []struct {
+		scores   Scores
+		expected string
+	}{
+		{Scores{Result: ResultClean}, SeverityGood},
+		{Scores{Result: ResultUnknown}, SeverityWarning},
+		{Scores{Result: ResultSuspicious}, SeverityWarning},
+		{Scores{Result: ResultDirty}, SeverityDanger},
+		{Scores{Result: ResultClean, VTPositives: 1}, SeverityWarning},
+		{Scores{Result: ResultClean, VTPositives: DefaultSeverityVTPositives}, SeverityDanger},
+		{Scores{Result: ResultClean, XFEScore: 6.9}, SeverityGood},
+		{Scores{Result: ResultClean, XFEScore: DefaultSeverityXFEScore}, SeverityDanger},
+	}
+	for _, test := range tests {
+		if s := c.Severity(test.scores); s != test.expected {
+			t.Errorf("expected %s for %+v but got %s", test.expected, test.scores, s)
+		}
+	}
+	c = &Configuration{SeverityVTPositives: 10, SeverityXFEScore: 3}
+	if s := c.Severity(Scores{Result: ResultClean, VTPositives: 5}); s != SeverityWarning {
+		t.Errorf("expected warning below the team VT threshold but got %s", s)
+	}
+	if s := c.Severity(Scores{Result: ResultClean, XFEScore: 3}); s != SeverityDanger {
+		t.Errorf("expected danger at the team XFE threshold but got %s", s)
+	}
+	if s := c.Severity(Scores{Result: ResultDirty}); s != SeverityDanger {
+		t.Errorf("expected danger for a convicted indicator regardless of the thresholds but got %s", s)
+	}
+}
+
+func TestWorstSeverity(t *testing.T) {
+	if s := WorstSeverity(); s != SeverityGood {
+		t.Errorf("expected good without severities but got %s", s)
+	}
+	if s := WorstSeverity(SeverityGood, SeverityDanger, SeverityWarning); s != SeverityDanger {
+		t.Errorf("expected danger but got %s", s)
+	}
+	if s := WorstSeverity(SeverityWarning, SeverityGood); s != SeverityWarning {
+		t.Errorf("expected warning but got %s", s)
+	}
+}
+
+func TestValidSeverity(t *testing.T) {
+	c := &Configuration{}
+	if err := c.ValidSeverity(); err != nil {
+		t.Errorf("defaults should be valid - %v", err)
+	}
+	c.SeverityVTPositives = -1
+	if err := c.ValidSeverity(); err == nil {
+		t.Error("negative VT threshold should be invalid")
+	}
+	c.SeverityVTPositives, c.SeverityXFEScore = 5, 11
+	if err := c.ValidSeverity(); err == nil {
+		t.Error("XFE threshold above 10 should be invalid")
+	}
+}
@@ -19,6 +19,109 @@ type Statistics struct {
 	IPsClean      int64     `json:"ips_clean" db:"ips_clean"`
 	IPsDirty      int64     `json:"ips_dirty" db:"ips_dirty"`
 	IPsUnknown    int64     `json:"ips_unknown" db:"ips_unknown"`
+	IPsSkipped    int64     `json:"ips_skipped" db:"ips_skipped"`   // Private / reserved IPs we did not check
+	Whitelisted   int64     `json:"whitelisted" db:"whitelisted"`   // Indicators the team whitelisted
+	CacheHits     int64     `json:"cache_hits" db:"cache_hits"`     // Indicators answered from the verdict cache
+	Truncated     int64     `json:"truncated" db:"truncated"`       // Messages that were only partially checked because of the limits
+	Muted         int64     `json:"muted" db:"muted"`               // Replies we did not post because the channel was muted
+	Dropped       int64     `json:"dropped" db:"dropped"`           // Events we dropped because the bot was too busy to handle them
+	RateLimited   int64     `json:"rate_limited" db:"rate_limited"` // Work requests we dropped because the team sent too many
+	Expired       int64     `json:"expired" db:"expired"`           // Work requests the workers dropped because they waited too long in the queue
+	// Channels holds the counters per channel since the last flush, they are stored separately from the team counters
+	Channels map[string]*ChannelStatistics `json:"-" db:"-"`
+}
+
+// ChannelStatistics holds what we checked in a single channel. Domains and emails are counted as URLs like the team counters.
+type ChannelStatistics struct {
+	Messages  int64 `json:"messages" db:"messages"`
+	URLs      int64 `json:"urls" db:"urls"`
+	IPs       int64 `json:"ips" db:"ips"`
+	Hashes    int64 `json:"hashes" db:"hashes"`
+	Files     int64 `json:"files" db:"files"`
+	Malicious int64 `json:"malicious" db:"malicious"`
+	// Expired work requests are only counted for the whole team, they are not kept per channel
+	Expired int64 `json:"expired,omitempty" db:"-"`
+}
+
+// Channel returns the counters of the channel or nil for direct messages which are not channel activity
+func (s *Statistics) Channel(channel string) *ChannelStatistics {
+	if channel == "" || channel[0] == 'D' {
+		return nil
+	}
+	if s.Channels == nil {
+		s.Channels = make(map[string]*ChannelStatistics)
+	}
+	c, ok := s.Channels[channel]
+	if !ok {
+		c = &ChannelStatistics{}
+		s.Channels[channel] = c
+	}
+	return c
+}
+
+// CountMessage in the channel
+func (s *Statistics) CountMessage(channel string) {
+	s.Messages++
+	if c := s.Channel(channel); c != nil {
+		c.Messages++
+	}
+}
+
+// Totals sums the team counters the same way the channel counters are kept
+func (s *Statistics) Totals() *ChannelStatistics {
+	return &ChannelStatistics{
+		Messages:  s.Messages,
+		URLs:      s.URLsClean + s.URLsDirty + s.URLsUnknown,
+		IPs:       s.IPsClean + s.IPsDirty + s.IPsUnknown,
+		Hashes:    s.HashesClean + s.HashesDirty + s.HashesUnknown,
+		Files:     s.FilesClean + s.FilesDirty + s.FilesUnknown,
+		Malicious: s.URLsDirty + s.IPsDirty + s.HashesDirty + s.FilesDirty,
+		Expired:   s.Expired,
+	}
+}
+
+// HasSomething that is not 0 in the channel statistics
+func (c *ChannelStatistics) HasSomething() bool {
+	return c.Messages != 0 || c.URLs != 0 || c.IPs != 0 || c.Hashes != 0 || c.Files != 0 || c.Malicious != 0
+}
+
+// Result is dirty if anything we counted was convicted, unknown if anything was unknown and clean otherwise
+func (s *Statistics) Result() int {
+	switch {
+	case s.URLsDirty+s.IPsDirty+s.HashesDirty+s.FilesDirty > 0:
+		return ResultDirty
+	case s.URLsUnknown+s.IPsUnknown+s.HashesUnknown+s.FilesUnknown > 0:
+		return ResultUnknown
+	}
+	return ResultClean
+}
+
+// ChannelActivity is the number of messages we checked in a channel
+type ChannelActivity struct {
+	Channel  string `db:"channel"`
+	Messages int64  `db:"messages"`
+}
+
+// WeeklyReport compares the statistics of the last week with the week before
+type WeeklyReport struct {
+	Current  *Statistics
+	Previous *Statistics
+	Busiest  []ChannelActivity // The channels with the most messages in the last week first
+}
+
+// Digest summarizes what we checked for a team in a period
+type Digest struct {
+	Stats     *Statistics
+	Malicious []DigestFinding // The most seen malicious indicators first
+}
+
+// DigestFinding is a malicious indicator with the last message it was seen in
+type DigestFinding struct {
+	ContentType int    `db:"content_type"`
+	Content     string `db:"content"`
+	Channel     string `db:"channel"`
+	MessageID   string `db:"message_id"`
+	Count       int    `db:"-"`
 }
 
 // Reset all the counters
@@ -36,6 +139,15 @@ func (s *Statistics) Reset() {
 	s.IPsClean = 0
 	s.IPsDirty = 0
 	s.IPsUnknown = 0
+	s.IPsSkipped = 0
+	s.Whitelisted = 0
+	s.CacheHits = 0
+	s.Truncated = 0
+	s.Muted = 0
+	s.Dropped = 0
+	s.RateLimited = 0
+	s.Expired = 0
+	s.Channels = nil
 }
 
 // HasSomething that is not 0 in the statistics
@@ -52,5 +164,13 @@ func (s *Statistics) HasSomething() bool {
 		s.HashesUnknown != 0 ||
 		s.IPsClean != 0 ||
 		s.IPsDirty != 0 ||
-		s.IPsUnknown != 0
+		s.IPsUnknown != 0 ||
+		s.IPsSkipped != 0 ||
+		s.Whitelisted != 0 ||
+		s.CacheHits != 0 ||
+		s.Truncated != 0 ||
+		s.Muted != 0 ||
+		s.Dropped != 0 ||
+		s.RateLimited != 0 ||
+		s.Expired != 0
 }
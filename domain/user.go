@@ -37,6 +37,8 @@ const (
 	UserStatusActive = iota
 	// UserStatusDeleted is a deleted user
 	UserStatusDeleted
+	// UserStatusInactive is a team that uninstalled us or revoked our tokens, a re-install activates it again
+	UserStatusInactive
 )
 
 // Stringer implementation
@@ -46,6 +48,8 @@ func (s UserStatus) String() string {
 		return "Active"
 	case UserStatusDeleted:
 		return "Deleted"
+	case UserStatusInactive:
+		return "Inactive"
 	default:
 		return "Unknown"
 	}
@@ -67,6 +71,7 @@ type User struct {
 	IsRestricted      bool       `json:"is_restricted" db:"is_restricted"`
 	IsUltraRestricted bool       `json:"is_ultra_restricted" db:"is_ultra_restricted"`
 	ExternalID        string     `json:"external_id" db:"external_id"`
+	IsSystemAdmin     bool       `json:"is_system_admin" db:"is_system_admin"` // Operates the service, granted in the database only
 	Token             string     `json:"token"`
 	Created           time.Time  `json:"created"`
 }
@@ -89,19 +94,37 @@ func (u *User) SecureToken() (string, error) {
 
 // Team holds information about the team
 type Team struct {
-	ID          string     `json:"id"`
-	Name        string     `json:"name"`
-	Status      UserStatus `json:"status"`
-	EmailDomain string     `json:"email_domain" db:"email_domain"`
-	Domain      string     `json:"domain"`
-	Plan        string     `json:"plan"`
-	ExternalID  string     `json:"external_id" db:"external_id"`
-	Created     time.Time  `json:"created"`
-	BotUserID   string     `json:"bot_user_id" db:"bot_user_id"`
-	BotToken    string     `json:"bot_token" db:"bot_token"`
-	VTKey       string     `json:"vt_key" db:"vt_key"`
-	XFEKey      string     `json:"xfe_key" db:"xfe_key"`
-	XFEPass     string     `json:"xfe_pass" db:"xfe_pass"`
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Status       UserStatus `json:"status"`
+	EmailDomain  string     `json:"email_domain" db:"email_domain"`
+	Domain       string     `json:"domain"`
+	Plan         string     `json:"plan"`
+	ExternalID   string     `json:"external_id" db:"external_id"`
+	Created      time.Time  `json:"created"`
+	BotUserID    string     `json:"bot_user_id" db:"bot_user_id"`
+	BotToken     string     `json:"bot_token" db:"bot_token"`
+	VTKey        string     `json:"vt_key" db:"vt_key"`
+	XFEKey       string     `json:"xfe_key" db:"xfe_key"`
+	XFEPass      string     `json:"xfe_pass" db:"xfe_pass"`
+	ConfigAdmins []string   `json:"config_admins" db:"-"` // Users allowed to change the configuration in addition to the workspace admins
+	Locale       string     `json:"locale"`               // Language we reply in, English if empty
+	// XSOAR server we open incidents in for malicious verdicts, no incidents if empty
+	XSOARURL          string `json:"xsoar_url" db:"xsoar_url"`
+	XSOARKey          string `json:"xsoar_key" db:"xsoar_key"`
+	XSOARIncidentType string `json:"xsoar_incident_type" db:"xsoar_incident_type"` // The default type of the server if empty
+	// SourceKeys are the keys of the team for the KeyedSources by the source, the sources are skipped without them
+	SourceKeys map[string]string `json:"source_keys" db:"-"`
+}
+
+// Installed checks that the team did not uninstall us
+func (t *Team) Installed() bool {
+	return t.Status != UserStatusInactive
+}
+
+// IsConfigAdmin checks if the user was allowed to change the configuration
+func (t *Team) IsConfigAdmin(user string) bool {
+	return user != "" && util.In(t.ConfigAdmins, user)
 }
 
 // ClearToken is returned from the encrypted token
@@ -112,6 +135,28 @@ func (t *Team) ClearToken() (string, error) {
 	return "", nil
 }
 
+// Credentials are the team own keys of the reputation sources, the sources without them use ours
+func (t *Team) Credentials() map[string]Credentials {
+	creds := make(map[string]Credentials)
+	if t.VTKey != "" {
+		creds[SourceVT] = Credentials{Key: t.VTKey}
+	}
+	if t.XFEKey != "" && t.XFEPass != "" {
+		creds[SourceXFE] = Credentials{Key: t.XFEKey, Password: t.XFEPass}
+	}
+	for source, key := range t.SourceKeys {
+		if key != "" {
+			creds[source] = Credentials{Key: key}
+		}
+	}
+	return creds
+}
+
+// XSOAREnabled checks if the team wants incidents opened in its XSOAR server
+func (t *Team) XSOAREnabled() bool {
+	return t.XSOARURL != "" && t.XSOARKey != ""
+}
+
 // ClearVTKey is returned from the encrypted vt key
 func (t *Team) ClearVTKey() (string, error) {
 	if t.VTKey != "" {
@@ -168,6 +213,22 @@ func (t *Team) SecureXFEPass() (string, error) {
 	return "", nil
 }
 
+// ClearXSOARKey is returned from the encrypted XSOAR API key
+func (t *Team) ClearXSOARKey() (string, error) {
+	if t.XSOARKey != "" {
+		return util.Decrypt(t.XSOARKey, conf.Options.Security.DBKey)
+	}
+	return "", nil
+}
+
+// SecureXSOARKey is returned from the clear XSOAR API key
+func (t *Team) SecureXSOARKey() (string, error) {
+	if t.XSOARKey != "" {
+		return util.Encrypt(t.XSOARKey, conf.Options.Security.DBKey)
+	}
+	return "", nil
+}
+
 // OAuthState holds oauth validation state
 type OAuthState struct {
 	State     string    `json:"state"`
@@ -0,0 +1,84 @@
+package domain
+
+import (
+	"errors"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/util"
+)
+
+const (
+	// maxWebhookURL is the size of the url column
+	maxWebhookURL = 512
+	// maxWebhookSecret leaves room for the encryption in the secret column
+	maxWebhookSecret = 128
+)
+
+// Webhook is where the team wants the verdicts pushed to, e.g. their SIEM or ticketing system
+type Webhook struct {
+	Team      string `json:"-"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"` // Signs the payload with HMAC, never returned by the API
+	Threshold string `json:"threshold"`        // Minimal verdict we push (all, suspicious or malicious)
+}
+
+// Validate the webhook, an empty threshold means malicious only
+func (w *Webhook) Validate() error {
+	if len(w.URL) > maxWebhookURL || !util.PublicURL(w.URL) {
+		return errors.New("webhook must be a valid public http(s) URL of up to 512 characters")
+	}
+	if w.Secret == "" || len(w.Secret) > maxWebhookSecret {
+		return errors.New("webhook secret must be between 1 and 128 characters")
+	}
+	if w.Threshold == "" {
+		w.Threshold = ThresholdMalicious
+	}
+	if !ValidThreshold(w.Threshold) {
+		return errors.New("webhook threshold must be all, suspicious or malicious")
+	}
+	return nil
+}
+
+// Pushes checks if the result crosses the threshold of the webhook
+func (w *Webhook) Pushes(result int) bool {
+	return CrossesThreshold(w.Threshold, result)
+}
+
+// ClearSecret is returned from the encrypted secret
+func (w *Webhook) ClearSecret() (string, error) {
+	if w.Secret != "" {
+		return util.Decrypt(w.Secret, conf.Options.Security.DBKey)
+	}
+	return "", nil
+}
+
+// SecureSecret is returned from the clear secret
+func (w *Webhook) SecureSecret() (string, error) {
+	if w.Secret != "" {
+		return util.Encrypt(w.Secret, conf.Options.Security.DBKey)
+	}
+	return "", nil
+}
+
+const (
+	// WebhookEventVerdict is pushed for every indicator that crosses the threshold
+	WebhookEventVerdict = "verdict"
+	// WebhookEventTest is sent when an admin verifies the receiver
+	WebhookEventTest = "test"
+)
+
+// WebhookEvent is the JSON payload we post to the webhook of the team
+type WebhookEvent struct {
+	Event     string            `json:"event"`
+	Team      string            `json:"team"` // The Slack team ID
+	TeamName  string            `json:"team_name"`
+	Channel   string            `json:"channel,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Indicator string            `json:"indicator"`
+	Type      string            `json:"type"`    // e.g. url, hash or ip
+	Verdict   string            `json:"verdict"` // clean, unknown or malicious
+	Sources   map[string]string `json:"sources"` // What each source said, e.g. "vt": "3 / 70"
+	Permalink string            `json:"permalink,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
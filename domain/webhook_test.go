@@ -0,0 +1,39 @@
+package domain
+
+import "testing"
+
+func TestWebhookValidate(t *testing.T) {
+	hook := &Webhook{URL: "https://siem.example.com/alfred", Secret: "s3cr3t"}
+	if err := hook.Validate(); err != nil || hook.Threshold != ThresholdMalicious {
+		t.Errorf("expected a valid webhook with the default threshold but got %s - %v", hook.Threshold, err)
+	}
+	for _, bad := range []*Webhook{
+		{URL: "ftp://siem.example.com", Secret: "s3cr3t"},
+		{URL: "http://169.254.169.254/latest/meta-data", Secret: "s3cr3t"},
+		{URL: "https://siem.example.com"},
+		{URL: "https://siem.example.com", Secret: "s3cr3t", Threshold: "dangerous"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", bad)
+		}
+	}
+}
+
+func TestWebhookPushes(t *testing.T) {
+	tests := []struct {
+		threshold string
+		result    int
+		expected  bool
+	}{
+		{ThresholdMalicious, ResultDirty, true},
+		{ThresholdMalicious, ResultUnknown, false},
+		{ThresholdSuspicious, ResultUnknown, true},
+		{ThresholdSuspicious, ResultClean, false},
+		{ThresholdAll, ResultClean, true},
+	}
+	for _, test := range tests {
+		if pushes := (&Webhook{Threshold: test.threshold}).Pushes(test.result); pushes != test.expected {
+			t.Errorf("threshold %s and result %d pushes %v, expected %v", test.threshold, test.result, pushes, test.expected)
+		}
+	}
+}
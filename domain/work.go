@@ -2,6 +2,7 @@ package domain
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -19,17 +20,64 @@ type Context struct {
 	OriginalUser string `json:"original_user"`
 	Channel      string `json:"channel"`
 	Type         string `json:"type"`
+	Attachment   int    `json:"attachment"` // 1 based index of the message attachment the indicators came from, 0 for the message text
+	TS           string `json:"ts"`         // The ts of the message we are replying to
+	ThreadTS     string `json:"thread_ts"`  // The thread of a message that was also sent to the channel, we reply in the thread
+	Rescan       bool   `json:"rescan"`     // User asked us to check the message again with the rescan command
+	Mention      bool   `json:"mention"`    // User asked us to scan by mentioning us in a channel, we always reply in the thread
+	Cached       bool   `json:"cached"`     // The verdicts came from the cache of the bot, they were already counted and stored
+	// Pushed is when the bot pushed the work, on the clock of the bot that also gets the reply
+	Pushed time.Time `json:"pushed"`
+	// Enqueued and Replied are when the queue got the work and the reply, both on the clock of the queue
+	Enqueued time.Time `json:"enqueued"`
+	Replied  time.Time `json:"replied"`
+}
+
+// Latency is how long the work took from the push until the reply reached the bot. The queue times are used
+// when we have both since they come from the same clock, otherwise the push time of the bot itself.
+func (c *Context) Latency(now time.Time) (time.Duration, bool) {
+	if !c.Enqueued.IsZero() && !c.Replied.IsZero() && !c.Replied.Before(c.Enqueued) {
+		return c.Replied.Sub(c.Enqueued), true
+	}
+	if !c.Pushed.IsZero() && !now.Before(c.Pushed) {
+		return now.Sub(c.Pushed), true
+	}
+	return 0, false
 }
 
 // contextFromMap ...
 func contextFromMap(c map[string]interface{}) *Context {
-	return &Context{
+	ctx := &Context{
 		Team:         c["team"].(string),
 		User:         c["user"].(string),
 		OriginalUser: c["original_user"].(string),
 		Channel:      c["channel"].(string),
 		Type:         c["type"].(string),
 	}
+	// Numbers are decoded as float64 and might be missing in messages pushed by older versions
+	if attachment, ok := c["attachment"].(float64); ok {
+		ctx.Attachment = int(attachment)
+	}
+	if ts, ok := c["ts"].(string); ok {
+		ctx.TS = ts
+	}
+	if threadTS, ok := c["thread_ts"].(string); ok {
+		ctx.ThreadTS = threadTS
+	}
+	if mention, ok := c["mention"].(bool); ok {
+		ctx.Mention = mention
+	}
+	ctx.Pushed, ctx.Enqueued, ctx.Replied = mapTime(c, "pushed"), mapTime(c, "enqueued"), mapTime(c, "replied")
+	return ctx
+}
+
+// mapTime parses the time of the key, messages pushed by older versions do not have it
+func mapTime(c map[string]interface{}, key string) time.Time {
+	var t time.Time
+	if s, ok := c[key].(string); ok {
+		t, _ = time.Parse(time.RFC3339Nano, s)
+	}
+	return t
 }
 
 // GetContext from a message based on actual type
@@ -48,34 +96,197 @@ func GetContext(context interface{}) (*Context, error) {
 
 // File details for a request
 type File struct {
-	ID    string `json:"id"`
-	URL   string `json:"url"`
-	Name  string `json:"name"`
-	Size  int    `json:"size"`
-	Token string `json:"token"`
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	DownloadURL string `json:"download_url"`
+	Name        string `json:"name"`
+	FileType    string `json:"file_type"`
+	MimeType    string `json:"mime_type"`
+	Size        int    `json:"size"`
+	Token       string `json:"token"`
+	// Hash of the file if the event has one, we look it up for the files we do not download
+	Hash string `json:"hash"`
+	// Message the file was shared with, it might have the password of an archive
+	Message string `json:"message"`
+}
+
+// Hash types we recognize
+const (
+	HashMD5    = "md5"
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+)
+
+// Hash found in a message together with its type
+type Hash struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// Wallet types
+const (
+	WalletBTC = "btc"
+	WalletETH = "eth"
+)
+
+// Wallet is a crypto currency address found in a message
+type Wallet struct {
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// CustomMatch is a match of one of the team custom patterns
+type CustomMatch struct {
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+}
+
+// WorkRequestVersion is the version of the work requests the bot pushes. Version 2 batches the indicators of the
+// message in Indicators, the requests without a version have them in the slice of each type.
+const WorkRequestVersion = 2
+
+// Indicator types of the batched work requests
+const (
+	IndicatorURL    = "url"
+	IndicatorDomain = "domain"
+	IndicatorEmail  = "email"
+	IndicatorIP     = "ip"
+	IndicatorCVE    = "cve"
+	IndicatorHash   = "hash"
+	IndicatorWallet = "wallet"
+	IndicatorCustom = "custom"
+)
+
+// Indicator of a batched work request. Kind is the type of a hash or a wallet, or the pattern of a custom match.
+type Indicator struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	Kind  string `json:"kind,omitempty"`
 }
 
 // WorkRequest contains the relevant fields for a work request
 type WorkRequest struct {
-	MessageID  string      `json:"message_id"`
-	Type       string      `json:"type"`
-	Text       string      `json:"text"`
-	File       File        `json:"file"`
-	ReplyQueue string      `json:"reply_queue"`
-	Context    interface{} `json:"context"`
-	Online     bool        `json:"online"`   // Are we running this request from online details page
-	VTKey      string      `json:"vt_key"`   // This team has his own vt key
-	XFEKey     string      `json:"xfe_key"`  // This team has his own xfe key
-	XFEPass    string      `json:"xfe_pass"` // This team has his own xfe pass
-}
-
-// WorkRequestFromMessage converts a message to a work request
-func WorkRequestFromMessage(msg slack.Response, token, vtKey, xfeKey, xfePass string) *WorkRequest {
-	req := &WorkRequest{VTKey: vtKey, XFEKey: xfeKey, XFEPass: xfePass}
+	// Version of the request, 0 for the requests with the indicators in the slices of each type
+	Version       int               `json:"version,omitempty"`
+	Indicators    []Indicator       `json:"indicators,omitempty"` // The indicators of the message from version 2
+	MessageID     string            `json:"message_id"`
+	Type          string            `json:"type"`
+	Text          string            `json:"text"`
+	File          File              `json:"file"`
+	ReplyQueue    string            `json:"reply_queue"`
+	Context       interface{}       `json:"context"`
+	Online        bool              `json:"online"`   // Are we running this request from online details page
+	Original      map[string]string `json:"original"` // The defanged form of indicators we normalized, keyed by the normalized indicator
+	URLs          []string          `json:"urls"`     // URLs from the Slack formatted links in the text
+	Domains       []string          `json:"domains"`  // Bare domains (without a scheme) found in the text
+	Emails        []string          `json:"emails"`   // Email addresses whose domain we check
+	Wallets       []Wallet          `json:"wallets"`  // Crypto currency addresses
+	IPs           []string          `json:"ips"`      // IPs to check - private ones are already filtered unless the team asked for them
+	CVEs          []string          `json:"cves"`     // Vulnerability identifiers (CVE-YYYY-NNNN)
+	Hashes        []Hash            `json:"hashes"`
+	Custom        []CustomMatch     `json:"custom"`         // Matches of the team custom patterns
+	CustomWebhook string            `json:"custom_webhook"` // Where to forward the custom matches
+	Quote         string            `json:"quote"`          // The piece of the message the indicators came from if it is not the text
+	Skipped       int               `json:"skipped"`        // Indicators we did not push because of the per message limit
+	Truncated     bool              `json:"truncated"`      // Only the beginning of the message was scanned
+	// Credentials are the team own keys by source, the other sources use ours
+	Credentials map[string]Credentials `json:"credentials"`
+	// DisabledSources are the reputation sources the team does not want the indicators checked with
+	DisabledSources []string `json:"disabled_sources"`
+	// Scoring is how the team combines the results of the sources into the verdict
+	Scoring ScoringProfile `json:"scoring"`
+	// InternalDomains of the team, their URLs are never sent to the sources
+	InternalDomains []string `json:"internal_domains"`
+	// Sandbox of the team that runs the files no source knows, nil if it has none
+	Sandbox *Sandbox `json:"sandbox,omitempty"`
+	// ScanSettings of the team for the indicators inside shared text files, nil for the defaults
+	ScanSettings *Configuration `json:"scan_settings,omitempty"`
+	// Attempts is the number of times the workers failed on the request so far
+	Attempts int `json:"attempts"`
+	// Receipt of the reservation the queue made when the worker popped the request, to acknowledge it with
+	Receipt string `json:"-"`
+	// Enqueued is when the bot pushed the request
+	Enqueued time.Time `json:"enqueued"`
+	// TTL in seconds after which the workers drop the request instead of checking it, 0 or less never expires
+	TTL int `json:"ttl"`
+}
+
+// Batch copies the indicators from the slices of each type to Indicators and sets the version. The slices are kept for
+// a release so the workers from before the batching still check the request, drop them once no such worker is left.
+func (r *WorkRequest) Batch() {
+	var indicators []Indicator
+	add := func(indicatorType string, values []string) {
+		for _, v := range values {
+			indicators = append(indicators, Indicator{Type: indicatorType, Value: v})
+		}
+	}
+	add(IndicatorURL, r.URLs)
+	add(IndicatorDomain, r.Domains)
+	add(IndicatorEmail, r.Emails)
+	add(IndicatorIP, r.IPs)
+	add(IndicatorCVE, r.CVEs)
+	for _, h := range r.Hashes {
+		indicators = append(indicators, Indicator{Type: IndicatorHash, Value: h.Value, Kind: h.Type})
+	}
+	for _, w := range r.Wallets {
+		indicators = append(indicators, Indicator{Type: IndicatorWallet, Value: w.Value, Kind: w.Type})
+	}
+	for _, c := range r.Custom {
+		indicators = append(indicators, Indicator{Type: IndicatorCustom, Value: c.Value, Kind: c.Pattern})
+	}
+	r.Version, r.Indicators = WorkRequestVersion, append(r.Indicators, indicators...)
+}
+
+// Unbatch moves the indicators of a batched request back to the slices of each type the workers check them from, in
+// place of the copies the bot kept there. Requests without a version already have them there.
+func (r *WorkRequest) Unbatch() error {
+	if r.Version > WorkRequestVersion {
+		return fmt.Errorf("unsupported work request version %d", r.Version)
+	}
+	if len(r.Indicators) > 0 {
+		r.URLs, r.Domains, r.Emails, r.IPs, r.CVEs, r.Hashes, r.Wallets, r.Custom = nil, nil, nil, nil, nil, nil, nil, nil
+	}
+	for _, i := range r.Indicators {
+		switch i.Type {
+		case IndicatorURL:
+			r.URLs = append(r.URLs, i.Value)
+		case IndicatorDomain:
+			r.Domains = append(r.Domains, i.Value)
+		case IndicatorEmail:
+			r.Emails = append(r.Emails, i.Value)
+		case IndicatorIP:
+			r.IPs = append(r.IPs, i.Value)
+		case IndicatorCVE:
+			r.CVEs = append(r.CVEs, i.Value)
+		case IndicatorHash:
+			r.Hashes = append(r.Hashes, Hash{Value: i.Value, Type: i.Kind})
+		case IndicatorWallet:
+			r.Wallets = append(r.Wallets, Wallet{Value: i.Value, Type: i.Kind})
+		case IndicatorCustom:
+			r.Custom = append(r.Custom, CustomMatch{Pattern: i.Kind, Value: i.Value})
+		default:
+			// A newer bot with a type we do not check yet, the rest of the message is still checked
+			logrus.Warnf("Ignoring indicator of unknown type %s in work request %s", i.Type, r.MessageID)
+		}
+	}
+	r.Indicators = nil
+	return nil
+}
+
+// Expired returns true if the request waited in the queue longer than its TTL
+func (r *WorkRequest) Expired(now time.Time) bool {
+	return r.TTL > 0 && !r.Enqueued.IsZero() && now.Sub(r.Enqueued) > time.Duration(r.TTL)*time.Second
+}
+
+// WorkRequestFromMessage converts a message to a work request checked with the sources the team did not disable and
+// scored with the profile of the team
+func WorkRequestFromMessage(msg slack.Response, token string, credentials map[string]Credentials, disabled []string, scoring ScoringProfile) *WorkRequest {
+	req := &WorkRequest{Credentials: credentials, DisabledSources: disabled, Scoring: scoring}
 	switch msg.S("type") {
 	case "message":
 		switch msg.S("subtype") {
-		case "":
+		case "", "bot_message", "me_message", "thread_broadcast", "link_shared":
 			req.MessageID, req.Type, req.Text = msg.S("ts"), "message", msg.S("text")
 		case "message_changed":
 			req.MessageID, req.Type, req.Text = msg.S("message.ts"), "message", msg.S("message.text")
@@ -86,7 +297,14 @@ func WorkRequestFromMessage(msg slack.Response, token, vtKey, xfeKey, xfePass st
 						if file, ok := filesArr[0].(map[string]interface{}); ok {
 							fileResponse := slack.Response(file)
 							req.MessageID, req.Type, req.File = msg.S("ts"), "file", File{ID: fileResponse.S("id"),
-								URL: fileResponse.S("url_private"), Name: fileResponse.S("name"), Size: fileResponse.I("size"), Token: token}
+								URL: fileResponse.S("url_private"), DownloadURL: fileResponse.S("url_private_download"), Name: fileResponse.S("name"),
+								FileType: fileResponse.S("filetype"), MimeType: fileResponse.S("mimetype"), Size: fileResponse.I("size"), Token: token,
+								Message: msg.S("text")}
+							for _, h := range []string{HashSHA256, HashSHA1, HashMD5} {
+								if req.File.Hash = fileResponse.S(h); req.File.Hash != "" {
+									break
+								}
+							}
 						} else {
 							logrus.Warnf("file shared and files section does not contain file objects: %s", util.ToJSONString(msg))
 						}
@@ -118,8 +336,75 @@ const (
 	ReplyTypeIP
 	// ReplyTypeFile for File replies
 	ReplyTypeFile
+	// ReplyTypeDomain for bare domain replies
+	ReplyTypeDomain
+	// ReplyTypeCVE for vulnerability replies
+	ReplyTypeCVE
+	// ReplyTypeCustom for custom pattern replies
+	ReplyTypeCustom
+	// ReplyTypeEmail for email domain replies
+	ReplyTypeEmail
+	// ReplyTypeWallet for crypto currency address replies
+	ReplyTypeWallet
 )
 
+// The reputation sources we check the indicators with. They key the credentials of the teams and the sources the
+// teams disable.
+const (
+	SourceCy           = "cy"
+	SourceXFE          = "xfe"
+	SourceVT           = "vt"
+	SourceURLhaus      = "urlhaus"
+	SourceAbuseIPDB    = "abuseipdb"
+	SourceSafeBrowsing = "safebrowsing"
+	SourceOTX          = "otx"
+	SourceHIBP         = "hibp"
+	SourceRDAP         = "rdap"
+	SourceTLS          = "tls"
+)
+
+// Sources are all the reputation sources
+var Sources = []string{SourceCy, SourceXFE, SourceVT, SourceURLhaus, SourceAbuseIPDB, SourceSafeBrowsing, SourceOTX, SourceHIBP, SourceRDAP, SourceTLS}
+
+// OptInSources are only checked for the teams that enabled them, e.g. HIBP looks up personal data
+var OptInSources = []string{SourceHIBP}
+
+// KeyedSources are only checked with the keys of the teams since we have none of our own
+var KeyedSources = []string{SourceAbuseIPDB, SourceOTX, SourceHIBP}
+
+// Credentials of a team for a reputation source
+type Credentials struct {
+	Key      string `json:"key"`
+	Password string `json:"password,omitempty"`
+}
+
+// SourceResult is what one reputation source said about an indicator
+type SourceResult struct {
+	Source   string  `json:"source"` // One of the sources, e.g. vt
+	Result   int     `json:"result"` // The verdict of this source alone
+	NotFound bool    `json:"notFound"`
+	Error    string  `json:"error"`
+	Weak     bool    `json:"weak"`   // The verdict comes from related indicators so it only counts if no other source knows this one
+	Value    float64 `json:"value"`  // What the severity thresholds of the team compare, e.g. VirusTotal positives
+	Score    string  `json:"score"`  // Short enough for a single line, e.g. 5 / 70
+	Link     string  `json:"link"`   // The report on the site of the source
+	Detail   string  `json:"detail"` // Shown in the full reply
+	// Info results are facts about the indicator and not a verdict, e.g. the breaches of an email
+	Info bool `json:"info"`
+	// PrivateDetail is only shown to the user who asked for the details and never in the channel
+	PrivateDetail string `json:"privateDetail"`
+	// Unavailable if the breaker of the source is open so it was not checked
+	Unavailable bool `json:"unavailable"`
+	// Pending if the source did not check the indicator yet because the key is over its rate limit
+	Pending bool `json:"pending"`
+	// Registered is when the domain was registered if the source knows it
+	Registered time.Time `json:"registered"`
+	// Cached is when the result was cached if it came from the scan cache
+	Cached time.Time `json:"cached"`
+	// Report is the full report of the source, the worker keeps it in the fields of the source for the details page
+	Report interface{} `json:"-"`
+}
+
 const (
 	// ResultClean from the scan if it is not known bad and at least one service found it to be clean
 	ResultClean int = iota
@@ -127,8 +412,13 @@ const (
 	ResultDirty
 	// ResultUnknown if none of the services knowns about the request
 	ResultUnknown
+	// ResultSuspicious if the services that convicted it are not trusted enough by the team to call it malicious
+	ResultSuspicious
 )
 
+// resultRanks orders the results from the least to the most severe
+var resultRanks = map[int]int{ResultClean: 0, ResultUnknown: 1, ResultSuspicious: 2, ResultDirty: 3}
+
 // XfeHashReply ...
 type XfeHashReply struct {
 	NotFound bool             `json:"notFound"`
@@ -150,11 +440,14 @@ type CyHashReply struct {
 
 // HashReply holds the information about a hash
 type HashReply struct {
-	Details string       `json:"details"`
-	Result  int          `json:"result"`
-	XFE     XfeHashReply `json:"xfe"`
-	VT      VtHashReply  `json:"vt"`
-	Cy      CyHashReply  `json:"cy"`
+	Details     string         `json:"details"`
+	Type        string         `json:"type"`
+	Unsupported bool           `json:"unsupported"` // None of the services can look up this hash type
+	Result      int            `json:"result"`
+	XFE         XfeHashReply   `json:"xfe"`
+	VT          VtHashReply    `json:"vt"`
+	Cy          CyHashReply    `json:"cy"`
+	Sources     []SourceResult `json:"sources"` // What each source said, in the order we show them
 }
 
 type XfeURLReply struct {
@@ -172,10 +465,13 @@ type VtURLReply struct {
 
 // URLReply holds the information about a URL
 type URLReply struct {
-	Details string      `json:"details"`
-	Result  int         `json:"result"`
-	XFE     XfeURLReply `json:"xfe"`
-	VT      VtURLReply  `json:"vt"`
+	Details string         `json:"details"`
+	Result  int            `json:"result"`
+	XFE     XfeURLReply    `json:"xfe"`
+	VT      VtURLReply     `json:"vt"`
+	Sources []SourceResult `json:"sources"` // What each source said, in the order we show them
+	// Internal if the host is private or one of the internal domains of the team so we did not send it to the sources
+	Internal bool `json:"internal"`
 }
 
 // XfeIPReply ...
@@ -194,31 +490,182 @@ type VtIPReply struct {
 
 // IPReply holds the information about an IP
 type IPReply struct {
-	Details string     `json:"details"`
-	Result  int        `json:"result"`
-	Private bool       `json:"isPrivate"`
-	XFE     XfeIPReply `json:"xfe"`
-	VT      VtIPReply  `json:"vt"`
+	Details string         `json:"details"`
+	Result  int            `json:"result"`
+	Private bool           `json:"isPrivate"`
+	XFE     XfeIPReply     `json:"xfe"`
+	VT      VtIPReply      `json:"vt"`
+	Sources []SourceResult `json:"sources"` // What each source said, in the order we show them
+}
+
+// VtDomainReply ...
+type VtDomainReply struct {
+	Error        string            `json:"error"`
+	DomainReport govt.DomainReport `json:"domainReport"`
+}
+
+// DomainReply holds the information about a bare domain
+type DomainReply struct {
+	Details string         `json:"details"`
+	Result  int            `json:"result"`
+	XFE     XfeURLReply    `json:"xfe"`
+	VT      VtDomainReply  `json:"vt"`
+	Sources []SourceResult `json:"sources"` // What each source said, in the order we show them
+	// Internal if the domain is private or one of the internal domains of the team so we did not send it to the sources
+	Internal bool `json:"internal"`
+}
+
+// EmailReply holds the reputation of the domain of an email address
+type EmailReply struct {
+	Details   string         `json:"details"`
+	Domain    string         `json:"domain"`
+	Result    int            `json:"result"`
+	LookAlike string         `json:"lookAlike"` // The domain this one imitates if it looks spoofed
+	XFE       XfeURLReply    `json:"xfe"`
+	Sources   []SourceResult `json:"sources"` // What each source said, in the order we show them
+	// Internal if the domain of the address is internal so we did not send the address to the sources
+	Internal bool `json:"internal"`
+}
+
+// WalletReply holds the abuse reports of a crypto currency address
+type WalletReply struct {
+	Details    string   `json:"details"`
+	Type       string   `json:"type"`
+	Result     int      `json:"result"`
+	NotFound   bool     `json:"notFound"`
+	Error      string   `json:"error"`
+	Reports    int      `json:"reports"`    // Total number of abuse reports
+	Categories []string `json:"categories"` // The scam categories the address was reported for
+}
+
+// CVEReply holds the information about a vulnerability
+type CVEReply struct {
+	Details   string   `json:"details"`
+	NotFound  bool     `json:"notFound"`
+	Error     string   `json:"error"`
+	Score     float64  `json:"score"`
+	Severity  string   `json:"severity"`
+	Vector    string   `json:"vector"`
+	Summary   string   `json:"summary"`
+	Products  []string `json:"products"`
+	Published string   `json:"published"`
+}
+
+// CustomReply holds the result of forwarding a custom pattern match
+type CustomReply struct {
+	Details   string `json:"details"`
+	Pattern   string `json:"pattern"`
+	Forwarded bool   `json:"forwarded"`
+	Error     string `json:"error"`
 }
 
 // FileReply holds the information about a File
 type FileReply struct {
 	Result       int    `json:"result"`
 	FileTooLarge bool   `json:"file_too_large"`
+	Excluded     bool   `json:"excluded"` // The type of the file is not one we download
+	Archive      bool   `json:"archive"`  // Zip, rar and the like, their content is not scanned
 	Virus        string `json:"virus"`
 	Error        string `json:"error"`
 	Details      File   `json:"details"`
+	// Encrypted archives are suspicious since the scanners cannot look inside
+	Encrypted bool `json:"encrypted"`
+	// Members are the names of the files in the archive from its headers, MemberCount counts all of them
+	Members     []string `json:"members"`
+	MemberCount int      `json:"member_count"`
+	// Packed archives compress their headers so we do not know the files or if they are encrypted
+	Packed bool `json:"packed"`
+	// PasswordMatches if a password from the message opens the archive
+	PasswordMatches bool `json:"password_matches"`
+	// Sandboxed if the file was submitted to the sandbox of the team, the verdict follows in the thread
+	Sandboxed bool `json:"sandboxed"`
 }
 
 // WorkReply to a work request being done
 type WorkReply struct {
-	Type      int         `json:"type"`
-	MessageID string      `json:"message_id"`
-	Hashes    []HashReply `json:"hashes"`
-	URLs      []URLReply  `json:"urls"`
-	IPs       []IPReply   `json:"ips"`
-	File      FileReply   `json:"file"`
-	Context   interface{} `json:"context"`
+	Type      int               `json:"type"`
+	MessageID string            `json:"message_id"`
+	Hashes    []HashReply       `json:"hashes"`
+	URLs      []URLReply        `json:"urls"`
+	IPs       []IPReply         `json:"ips"`
+	Domains   []DomainReply     `json:"domains"`
+	Emails    []EmailReply      `json:"emails"`
+	Wallets   []WalletReply     `json:"wallets"`
+	Snippet   *WorkReply        `json:"snippet,omitempty"` // Verdicts of the indicators in a shared text file
+	CVEs      []CVEReply        `json:"cves"`
+	Custom    []CustomReply     `json:"custom"`
+	File      FileReply         `json:"file"`
+	Context   interface{}       `json:"context"`
+	Original  map[string]string `json:"original"`  // Copied from the request so we can echo defanged indicators back
+	Quote     string            `json:"quote"`     // Copied from the request
+	Skipped   int               `json:"skipped"`   // Copied from the request
+	Truncated bool              `json:"truncated"` // Copied from the request
+	// Pending results the worker is still looking up, it sends the reply again as each comes in and the last time
+	// without pending results
+	Pending int `json:"pending"`
+	// Sandbox is the follow up with the behavioral verdict of the file of the message, the rest of the reply is empty
+	Sandbox *SandboxReply `json:"sandbox,omitempty"`
+	// Failed is set if the workers gave up on the request and dead lettered it, the rest of the reply is empty
+	Failed bool `json:"failed,omitempty"`
+	// Expired is set if the request waited in the queue past its TTL and was dead lettered, the rest of the reply is empty
+	Expired bool `json:"expired,omitempty"`
+}
+
+// Results is the number of results of the sources in the reply
+func (r *WorkReply) Results() int {
+	count := 0
+	for i := range r.URLs {
+		count += len(r.URLs[i].Sources)
+	}
+	for i := range r.IPs {
+		count += len(r.IPs[i].Sources)
+	}
+	for i := range r.Hashes {
+		count += len(r.Hashes[i].Sources)
+	}
+	for i := range r.Domains {
+		count += len(r.Domains[i].Sources)
+	}
+	for i := range r.Emails {
+		count += len(r.Emails[i].Sources)
+	}
+	return count
+}
+
+// Verdict is the worst result in the reply. CVEs and custom matches are informational so they count as unknown.
+func (r *WorkReply) Verdict() int {
+	var results []int
+	if r.Type&ReplyTypeFile > 0 {
+		results = append(results, r.File.Result)
+	}
+	for i := range r.URLs {
+		results = append(results, r.URLs[i].Result)
+	}
+	for i := range r.Domains {
+		results = append(results, r.Domains[i].Result)
+	}
+	for i := range r.Emails {
+		results = append(results, r.Emails[i].Result)
+	}
+	for i := range r.IPs {
+		results = append(results, r.IPs[i].Result)
+	}
+	for i := range r.Wallets {
+		results = append(results, r.Wallets[i].Result)
+	}
+	for i := range r.Hashes {
+		results = append(results, r.Hashes[i].Result)
+	}
+	if len(r.CVEs) > 0 || len(r.Custom) > 0 {
+		results = append(results, ResultUnknown)
+	}
+	verdict := ResultClean
+	for _, result := range results {
+		if resultRanks[result] > resultRanks[verdict] {
+			verdict = result
+		}
+	}
+	return verdict
 }
 
 // MaliciousContent holds info about convicted content
@@ -235,6 +682,43 @@ type MaliciousContent struct {
 	ClamAV      string `json:"clamav"`
 }
 
+// FalsePositive is a verdict a user reported as wrong with the fp command
+type FalsePositive struct {
+	ID          int64     `json:"id"`
+	Team        string    `json:"team"`
+	User        string    `json:"user"`
+	Indicator   string    `json:"indicator"`
+	Comment     string    `json:"comment"`
+	Whitelisted bool      `json:"whitelisted"`
+	Created     time.Time `json:"created" db:"ts"`
+}
+
+// ScanRecord is a single indicator we checked, kept as the scan history of the team
+type ScanRecord struct {
+	ID            int64             `json:"id"`
+	Team          string            `json:"team"`
+	Channel       string            `json:"channel"`
+	User          string            `json:"user"`
+	Indicator     string            `json:"indicator"`
+	Normalized    string            `json:"-"`                                  // The indicator as we look it up, e.g. refanged and lower cased
+	IndicatorType int               `json:"indicator_type" db:"indicator_type"` // One of the ReplyType constants
+	Scores        map[string]string `json:"scores" db:"-"`                      // What each source said, e.g. "vt": "3 / 70"
+	Verdict       int               `json:"verdict"`
+	Permalink     string            `json:"permalink"` // The Slack message the indicator was in
+	Created       time.Time         `json:"created" db:"ts"`
+}
+
+// ScanFilter narrows down the scan history of a team, zero fields do not filter
+type ScanFilter struct {
+	From      time.Time
+	To        time.Time
+	Channel   string
+	Indicator string
+	// Normalized matches all the forms of the indicator, see bot.NormalizeIndicator
+	Normalized string
+	Malicious  bool // Only the indicators with a malicious verdict
+}
+
 // UniqueID of the message
 func (mc *MaliciousContent) UniqueID() string {
 	return mc.Team + "," + mc.Channel + "," + mc.MessageID
@@ -247,4 +731,20 @@ type DBQueueMessage struct {
 	MessageType string    `json:"message_type" db:"message_type"`
 	Message     string    `json:"message"`
 	Timestamp   time.Time `json:"ts" db:"ts"`
+	Attempts    int       `json:"attempts"`
+}
+
+// BotHeartbeat is the last keep-alive of a bot host, the replies of its work go to the reply queue of the same name
+type BotHeartbeat struct {
+	Bot       string    `json:"bot" db:"bot"`
+	Timestamp time.Time `json:"ts" db:"ts"`
+	Stale     bool      `json:"stale" db:"stale"` // No keep-alive within the timeout we asked about, the host is gone
+}
+
+// QueueLane is the depth of one lane of the queue - the work, the replies or the configuration changes
+type QueueLane struct {
+	Lane     string `json:"lane" db:"lane"`
+	Depth    int64  `json:"depth" db:"depth"`         // Messages waiting to be popped
+	InFlight int64  `json:"in_flight" db:"in_flight"` // Work popped and not acknowledged yet
+	Oldest   int64  `json:"oldest" db:"oldest"`       // Seconds the oldest waiting message waits, 0 if the backend cannot tell
 }
@@ -0,0 +1,120 @@
+package domain
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/slack"
+)
+
+func TestContextLatency(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		ctx     Context
+		latency time.Duration
+		ok      bool
+	}{
+		{"queue times", Context{Pushed: now.Add(-time.Minute), Enqueued: now.Add(-10 * time.Second), Replied: now.Add(-2 * time.Second)}, 8 * time.Second, true},
+		{"push time", Context{Pushed: now.Add(-5 * time.Second)}, 5 * time.Second, true},
+		{"skewed queue", Context{Pushed: now.Add(-5 * time.Second), Enqueued: now, Replied: now.Add(-time.Second)}, 5 * time.Second, true},
+		{"future push", Context{Pushed: now.Add(time.Second)}, 0, false},
+		{"nothing", Context{}, 0, false},
+	}
+	for _, test := range tests {
+		latency, ok := test.ctx.Latency(now)
+		if latency != test.latency || ok != test.ok {
+			t.Errorf("%s: expected %v %v but got %v %v", test.name, test.latency, test.ok, latency, ok)
+		}
+	}
+}
+
+func TestWorkRequestExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		req     WorkRequest
+		expired bool
+	}{
+		{"past the TTL", WorkRequest{Enqueued: now.Add(-11 * time.Minute), TTL: 600}, true},
+		{"within the TTL", WorkRequest{Enqueued: now.Add(-time.Minute), TTL: 600}, false},
+		{"no TTL", WorkRequest{Enqueued: now.Add(-time.Hour)}, false},
+		{"exempt", WorkRequest{Enqueued: now.Add(-time.Hour), TTL: -1}, false},
+		{"never enqueued", WorkRequest{TTL: 600}, false},
+	}
+	for _, test := range tests {
+		if expired := test.req.Expired(now); expired != test.expired {
+			t.Errorf("%s: expected %v but got %v", test.name, test.expired, expired)
+		}
+	}
+}
+
+func TestWorkRequestBatch(t *testing.T) {
+	r := &WorkRequest{MessageID: "1.1", URLs: []string{"https://evil.com"}, Domains: []string{"evil.com"}, Emails: []string{"a@evil.com"},
+		IPs: []string{"8.8.8.8"}, CVEs: []string{"CVE-2021-44228"}, Hashes: []Hash{{Value: "44d88612fea8a8f36de82e1278abb02f", Type: HashMD5}},
+		Wallets: []Wallet{{Value: "0x52908400098527886E0F7030069857D2E4169EE7", Type: WalletETH}}, Custom: []CustomMatch{{Pattern: "ticket", Value: "INC-1"}}}
+	r.Batch()
+	if r.Version != WorkRequestVersion || len(r.Indicators) != 8 {
+		t.Fatalf("expected the indicators to be batched but got %+v", r)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A worker from before the batching ignores the fields it does not know and checks the slices
+	var legacy struct {
+		URLs   []string      `json:"urls"`
+		IPs    []string      `json:"ips"`
+		Hashes []Hash        `json:"hashes"`
+		Custom []CustomMatch `json:"custom"`
+	}
+	if err = json.Unmarshal(b, &legacy); err != nil || len(legacy.URLs) != 1 || len(legacy.IPs) != 1 || len(legacy.Hashes) != 1 || len(legacy.Custom) != 1 {
+		t.Fatalf("expected the slices to be kept for the old workers but got %+v - %v", legacy, err)
+	}
+	got := &WorkRequest{}
+	if err = json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	got.Indicators = append(got.Indicators, Indicator{Type: "future", Value: "x"})
+	if err = got.Unbatch(); err != nil {
+		t.Fatal(err)
+	}
+	if got.Indicators != nil || len(got.URLs) != 1 || len(got.IPs) != 1 || len(got.Custom) != 1 || got.Domains[0] != "evil.com" || got.Emails[0] != "a@evil.com" || got.IPs[0] != "8.8.8.8" ||
+		got.CVEs[0] != "CVE-2021-44228" || got.Hashes[0].Type != HashMD5 || got.Wallets[0].Type != WalletETH || got.Custom[0].Pattern != "ticket" {
+		t.Errorf("expected the indicators back in their slices but got %+v", got)
+	}
+	// Requests without a version are left as they are
+	old := &WorkRequest{IPs: []string{"8.8.8.8"}}
+	if err = old.Unbatch(); err != nil || len(old.IPs) != 1 {
+		t.Errorf("expected the old request to be kept but got %+v - %v", old, err)
+	}
+	if err = (&WorkRequest{Version: WorkRequestVersion + 1}).Unbatch(); err == nil {
+		t.Error("expected a newer version to fail")
+	}
+}
+
+func TestContextFromMapTimes(t *testing.T) {
+	pushed := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+	b, _ := json.Marshal(&Context{Team: "T1", Pushed: pushed})
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := GetContext(m)
+	if err != nil || !ctx.Pushed.Equal(pushed) || !ctx.Enqueued.IsZero() {
+		t.Errorf("unexpected times %v %v - %v", ctx.Pushed, ctx.Enqueued, err)
+	}
+}
+
+func TestWorkRequestFromFileShare(t *testing.T) {
+	msg := slack.Response{"type": "message", "subtype": "file_share", "ts": "1.2", "files": []interface{}{
+		map[string]interface{}{"id": "F1", "name": "movie.mp4", "filetype": "mp4", "mimetype": "video/mp4", "size": float64(2 << 30),
+			"url_private": "https://files.slack.com/F1", "md5": "44d88612fea8a8f36de82e1278abb02f"},
+	}}
+	req := WorkRequestFromMessage(msg, "token", nil, nil, ScoringProfile{})
+	if req.Type != "file" || req.File.MimeType != "video/mp4" || req.File.FileType != "mp4" || req.File.Size != 2<<30 ||
+		req.File.Hash != "44d88612fea8a8f36de82e1278abb02f" {
+		t.Errorf("unexpected request %+v", req.File)
+	}
+}
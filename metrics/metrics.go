@@ -0,0 +1,350 @@
+// Package metrics keeps the operational counters, gauges and histograms of alfred and serves them in the Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PerTeam adds the actual team to the team label. With thousands of teams it multiplies the series so it is off by default.
+var PerTeam bool
+
+// allTeams is the team label when PerTeam is off
+const allTeams = "all"
+
+// Team returns the value of the team label for the team
+func Team(team string) string {
+	if PerTeam && team != "" {
+		return team
+	}
+	return allTeams
+}
+
+// DefaultBuckets in seconds for latency histograms
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is what the registry knows how to write
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metrics by name. The package functions use the default registry, the tests use their own.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// defaultRegistry has the metrics of alfred that Handler serves
+var defaultRegistry = NewRegistry()
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic("metric " + m.name() + " is already registered")
+	}
+	r.metrics[m.name()] = m
+}
+
+// labelSet joins the label values into the key of a series
+func labelSet(labels, values []string) string {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("expected %d label values but got %d", len(labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels returns the labels of the series in the text format, extra is added as is, e.g. the le of buckets
+func formatLabels(labels []string, key, extra string) string {
+	var pairs []string
+	if len(labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, labels[i]+"=\""+escape(v)+"\"")
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escape(v string) string {
+	return escaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys of the series so the output is stable
+func sortedKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Counter only goes up, per combination of label values
+type Counter struct {
+	n, help string
+	labels  []string
+	mu      sync.Mutex
+	values  map[string]float64
+}
+
+// NewCounter registers a counter with the given labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	return defaultRegistry.NewCounter(name, help, labels...)
+}
+
+// NewCounter registers a counter with the given labels in the registry
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{n: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add v to the series of the label values
+func (c *Counter) Add(v float64, values ...string) {
+	key := labelSet(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+// Value of the series of the label values
+func (c *Counter) Value(values ...string) float64 {
+	key := labelSet(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) name() string {
+	return c.n
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.n, c.help, c.n)
+	keys := make(map[string]bool, len(c.values))
+	for k := range c.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.n, formatLabels(c.labels, k, ""), formatFloat(c.values[k]))
+	}
+}
+
+// Gauge goes up and down, per combination of label values
+type Gauge struct {
+	n, help string
+	labels  []string
+	mu      sync.Mutex
+	values  map[string]float64
+}
+
+// NewGauge registers a gauge with the given labels
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return defaultRegistry.NewGauge(name, help, labels...)
+}
+
+// NewGauge registers a gauge with the given labels in the registry
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{n: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(g)
+	return g
+}
+
+// Set the series of the label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	key := labelSet(g.labels, values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[key] = v
+}
+
+// Value of the series of the label values
+func (g *Gauge) Value(values ...string) float64 {
+	key := labelSet(g.labels, values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) name() string {
+	return g.n
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.n, g.help, g.n)
+	keys := make(map[string]bool, len(g.values))
+	for k := range g.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", g.n, formatLabels(g.labels, k, ""), formatFloat(g.values[k]))
+	}
+}
+
+// histogramSeries holds the observations of one combination of label values
+type histogramSeries struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations in buckets, per combination of label values
+type Histogram struct {
+	n, help string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// NewHistogram registers a histogram with the given upper bounds of the buckets and labels
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return defaultRegistry.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram registers a histogram with the given upper bounds of the buckets and labels in the registry
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	h := &Histogram{n: name, help: help, labels: labels, buckets: b, series: make(map[string]*histogramSeries)}
+	r.register(h)
+	return h
+}
+
+// Observe v in the series of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := labelSet(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Since observes the seconds that passed since start
+func (h *Histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Count of the observations of the label values
+func (h *Histogram) Count(values ...string) uint64 {
+	key := labelSet(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) name() string {
+	return h.n
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.n, h.help, h.n)
+	keys := make(map[string]bool, len(h.series))
+	for k := range h.series {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		s := h.series[k]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, formatLabels(h.labels, k, "le=\""+formatFloat(upper)+"\""), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, formatLabels(h.labels, k, "le=\"+Inf\""), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.n, formatLabels(h.labels, k, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.n, formatLabels(h.labels, k, ""), s.count)
+	}
+}
+
+// Write all the registered metrics in the Prometheus text format
+func Write(w io.Writer) error {
+	return defaultRegistry.Write(w)
+}
+
+// Write all the metrics of the registry in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make(map[string]bool, len(r.metrics))
+	for k := range r.metrics {
+		names[k] = true
+	}
+	r.mu.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, name := range sortedKeys(names) {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler serves the metrics for Prometheus to scrape
+func Handler() http.Handler {
+	return defaultRegistry.Handler()
+}
+
+// Handler serves the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// Serve the metrics on /metrics of a dedicated internal address
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_counter_total", "A test counter", "outcome")
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Add(3, "failed")
+	if c.Value("ok") != 2 || c.Value("failed") != 3 || c.Value("other") != 0 {
+		t.Errorf("unexpected values %v", c.values)
+	}
+	var buf bytes.Buffer
+	c.write(&buf)
+	expected := "# HELP test_counter_total A test counter\n# TYPE test_counter_total counter\n" +
+		"test_counter_total{outcome=\"failed\"} 3\ntest_counter_total{outcome=\"ok\"} 2\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output\n%s", buf.String())
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("test_gauge", "A test gauge", "source")
+	g.Set(2, "vt")
+	g.Set(0, "vt")
+	g.Set(1, "xfe")
+	if g.Value("vt") != 0 || g.Value("xfe") != 1 {
+		t.Errorf("unexpected values %v", g.values)
+	}
+	var buf bytes.Buffer
+	g.write(&buf)
+	expected := "# HELP test_gauge A test gauge\n# TYPE test_gauge gauge\n" +
+		"test_gauge{source=\"vt\"} 0\ntest_gauge{source=\"xfe\"} 1\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output\n%s", buf.String())
+	}
+}
+
+func TestCounterEscapesLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_escape_total", "Escaping", "team")
+	c.Inc("a\"b\\c\n")
+	var buf bytes.Buffer
+	c.write(&buf)
+	if !strings.Contains(buf.String(), `test_escape_total{team="a\"b\\c\n"} 1`) {
+		t.Errorf("label not escaped\n%s", buf.String())
+	}
+}
+
+func TestCounterWrongLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_wrong_total", "Wrong labels", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic on missing label values")
+		}
+	}()
+	c.Inc("a")
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_seconds", "A test histogram", []float64{1, 0.1}, "result")
+	h.Observe(0.05, "ok")
+	h.Observe(0.5, "ok")
+	h.Observe(5, "ok")
+	if h.Count("ok") != 3 || h.Count("failed") != 0 {
+		t.Errorf("unexpected counts")
+	}
+	var buf bytes.Buffer
+	h.write(&buf)
+	expected := "# HELP test_seconds A test histogram\n# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{result=\"ok\",le=\"0.1\"} 1\n" +
+		"test_seconds_bucket{result=\"ok\",le=\"1\"} 2\n" +
+		"test_seconds_bucket{result=\"ok\",le=\"+Inf\"} 3\n" +
+		"test_seconds_sum{result=\"ok\"} 5.55\n" +
+		"test_seconds_count{result=\"ok\"} 3\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output\n%s", buf.String())
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_twice_total", "Twice")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic on duplicate registration")
+		}
+	}()
+	r.NewCounter("test_twice_total", "Twice")
+}
+
+func TestTeam(t *testing.T) {
+	defer func() { PerTeam = false }()
+	if Team("T1") != allTeams {
+		t.Errorf("expected the team to be hidden by default")
+	}
+	PerTeam = true
+	if Team("T1") != "T1" || Team("") != allTeams {
+		t.Errorf("expected the team when per team is on")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_handler_total", "Handler")
+	c.Inc()
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "test_handler_total 1\n") {
+		t.Errorf("metric missing from\n%s", w.Body.String())
+	}
+}
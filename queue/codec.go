@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/demisto/alfred/conf"
+)
+
+// compressedPrefix marks the compressed payloads of the backends that keep text. JSON never starts with it.
+const compressedPrefix = "gz:"
+
+// gzipMagic starts every gzip stream, JSON never does so the payloads need no other header
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzipBytes compresses b
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode v as JSON, gzipped if it is larger than conf.Options.Queue.CompressAbove bytes
+func encode(v interface{}) ([]byte, bool, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, false, err
+	}
+	if above := conf.Options.Queue.CompressAbove; above <= 0 || len(b) <= above {
+		return b, false, nil
+	}
+	if b, err = gzipBytes(b); err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// decode the payload of encode into v. The plain JSON of the processes that do not compress is decoded as is.
+func decode(b []byte, v interface{}) error {
+	if bytes.HasPrefix(b, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		if b, err = ioutil.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(b, v)
+}
+
+// encodeText is encode for the backends that keep text, the compressed payloads are base64 after compressedPrefix
+func encodeText(v interface{}) (string, error) {
+	b, compressed, err := encode(v)
+	if err != nil {
+		return "", err
+	}
+	if !compressed {
+		return string(b), nil
+	}
+	return compressedPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decodeText the payload of encodeText into v
+func decodeText(s string, v interface{}) error {
+	if !strings.HasPrefix(s, compressedPrefix) {
+		return json.Unmarshal([]byte(s), v)
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len(compressedPrefix):])
+	if err != nil {
+		return err
+	}
+	return decode(b, v)
+}
@@ -0,0 +1,157 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/slavikm/govt"
+)
+
+// vtEngines are the engines of a VirusTotal file report
+var vtEngines = []string{"Bkav", "Lionic", "Elastic", "MicroWorld-eScan", "FireEye", "CAT-QuickHeal", "McAfee", "Cylance", "Zillya",
+	"Sangfor", "K7AntiVirus", "Alibaba", "K7GW", "Cybereason", "Baidu", "VirIT", "Cyren", "SymantecMobileInsight", "Symantec",
+	"ESET-NOD32", "APEX", "TrendMicro-HouseCall", "Avast", "ClamAV", "Kaspersky", "BitDefender", "NANO-Antivirus", "SUPERAntiSpyware",
+	"Tencent", "Ad-Aware", "Emsisoft", "Comodo", "F-Secure", "DrWeb", "VIPRE", "TrendMicro", "McAfee-GW-Edition", "Trapmine",
+	"CMC", "Sophos", "Ikarus", "Jiangmin", "Webroot", "Avira", "Antiy-AVL", "Kingsoft", "Gridinsoft", "Arcabit", "ViRobot",
+	"ZoneAlarm", "GData", "Cynet", "BitDefenderFalx", "AhnLab-V3", "Acronis", "BitDefenderTheta", "ALYac", "MAX", "VBA32",
+	"Malwarebytes", "Panda", "Zoner", "Rising", "Yandex", "TACHYON", "MaxSecure", "Fortinet", "AVG", "SentinelOne", "Paloalto"}
+
+// fileReportReply is the reply to a message with a few files VirusTotal knows
+func fileReportReply() *domain.WorkReply {
+	reply := &domain.WorkReply{MessageID: "1.1", Type: domain.ReplyTypeHash, Context: &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}}
+	for i := 0; i < 8; i++ {
+		md5 := fmt.Sprintf("%032x", i+1)
+		report := govt.FileReport{Resource: md5, ScanId: strings.Repeat("e", 64) + "-1612345678", Md5: md5, Sha1: fmt.Sprintf("%040x", i+1),
+			Sha256: fmt.Sprintf("%064x", i+1), ScanDate: "2021-02-03 09:41:18", Total: uint16(len(vtEngines)),
+			Permalink: "https://www.virustotal.com/gui/file/" + fmt.Sprintf("%064x", i+1) + "/detection/f-1612345678",
+			Scans:     make(map[string]govt.FileScan)}
+		for j, engine := range vtEngines {
+			scan := govt.FileScan{Version: fmt.Sprintf("%d.%d.%d.%d", 1+j%9, j%21, 100+j, 5000+j*7), Update: "20210203"}
+			if j%3 != 0 {
+				scan.Detected, scan.Result = true, fmt.Sprintf("Trojan.GenericKD.%d", 34000000+i*1000+j)
+				report.Positives++
+			}
+			report.Scans[engine] = scan
+		}
+		hash := domain.HashReply{Details: md5, Type: domain.HashMD5, Result: domain.ResultDirty}
+		hash.VT.FileReport = report
+		hash.Sources = []domain.SourceResult{{Source: domain.SourceVT, Result: domain.ResultDirty, Score: fmt.Sprintf("%d / %d", report.Positives, report.Total),
+			Link: report.Permalink}}
+		reply.Hashes = append(reply.Hashes, hash)
+	}
+	return reply
+}
+
+func TestCodec(t *testing.T) {
+	saved := conf.Options.Queue
+	defer func() { conf.Options.Queue = saved }()
+	conf.Options.Queue.CompressAbove = 1024
+	reply := fileReportReply()
+	plain, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, compressed, err := encode(reply)
+	if err != nil || !compressed || !bytes.HasPrefix(b, gzipMagic) || len(b)*5 > len(plain) {
+		t.Fatalf("expected the report to be compressed to a fifth at most but got %d of %d bytes - %v", len(b), len(plain), err)
+	}
+	text, err := encodeText(reply)
+	if err != nil || !strings.HasPrefix(text, compressedPrefix) {
+		t.Fatalf("expected the text to be marked compressed - %v", err)
+	}
+	// The payloads of the processes that do not compress are plain JSON
+	for name, decoded := range map[string]func(v interface{}) error{
+		"compressed":       func(v interface{}) error { return decode(b, v) },
+		"compressed text":  func(v interface{}) error { return decodeText(text, v) },
+		"old process":      func(v interface{}) error { return decode(plain, v) },
+		"old process text": func(v interface{}) error { return decodeText(string(plain), v) },
+	} {
+		got := &domain.WorkReply{}
+		if err = decoded(got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got.Hashes) != 8 || got.Hashes[7].VT.FileReport.Scans["Kaspersky"].Result != reply.Hashes[7].VT.FileReport.Scans["Kaspersky"].Result {
+			t.Errorf("%s: unexpected reply %+v", name, got.Hashes)
+		}
+	}
+	// Small messages and disabled compression stay plain so the older processes read them
+	small := &domain.WorkRequest{MessageID: "1.2", IPs: []string{"8.8.8.8"}}
+	if b, compressed, err = encode(small); err != nil || compressed || b[0] != '{' {
+		t.Errorf("expected the small request to stay plain - %v", err)
+	}
+	// An old process decodes the JSON itself, it cannot read the compressed form a new one writes
+	old := func(payload []byte) error {
+		got := &domain.WorkReply{}
+		if err := json.Unmarshal(payload, got); err != nil {
+			return err
+		}
+		if len(got.Hashes) != 8 {
+			return fmt.Errorf("unexpected reply %+v", got.Hashes)
+		}
+		return nil
+	}
+	if err = old(b); err == nil {
+		t.Error("expected the old process to fail on the compressed reply")
+	}
+	// With compression disabled, the default until every process is upgraded, it reads what the new ones write
+	conf.Options.Queue.CompressAbove = 0
+	if text, err = encodeText(reply); err != nil || !strings.HasPrefix(text, "{") {
+		t.Errorf("expected no compression when disabled - %v", err)
+	}
+	if b, compressed, err = encode(reply); err != nil || compressed {
+		t.Fatalf("expected no compression when disabled - %v", err)
+	}
+	for name, payload := range map[string][]byte{"bytes": b, "text": []byte(text)} {
+		if err = old(payload); err != nil {
+			t.Errorf("%s: expected the old process to read the new one - %v", name, err)
+		}
+	}
+}
+
+func BenchmarkEncodeFileReport(b *testing.B) {
+	saved := conf.Options.Queue
+	defer func() { conf.Options.Queue = saved }()
+	reply := fileReportReply()
+	for _, above := range []int{0, 32768} {
+		b.Run(fmt.Sprintf("above=%d", above), func(b *testing.B) {
+			conf.Options.Queue.CompressAbove = above
+			var size int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				payload, _, err := encode(reply)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(payload)
+			}
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkDecodeFileReport(b *testing.B) {
+	saved := conf.Options.Queue
+	defer func() { conf.Options.Queue = saved }()
+	reply := fileReportReply()
+	for _, above := range []int{0, 32768} {
+		b.Run(fmt.Sprintf("above=%d", above), func(b *testing.B) {
+			conf.Options.Queue.CompressAbove = above
+			payload, _, err := encode(reply)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = decode(payload, &domain.WorkReply{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,8 +1,8 @@
 package queue
 
 import (
-	"encoding/json"
-	"sync"
+	"context"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -12,28 +12,30 @@ import (
 	"github.com/demisto/alfred/util"
 )
 
-// dbQueue implements the queue functionality using a database backend
+// dbQueue implements the queue functionality using a database backend. The work requests are reserved for the host
+// in the database and deleted once the worker acknowledges them.
 type dbQueue struct {
-	d            *repo.MySQL
-	done         chan bool
-	conf         chan string
-	work         chan *domain.WorkRequest
-	workReply    chan *domain.WorkReply
-	webWorkReply map[string]chan *domain.WorkReply
-	mux          sync.Mutex
-	closed       bool
+	d         *repo.MySQL
+	done      chan bool
+	stopped   chan struct{} // Closed with the queue so the web waiters give up
+	conf      chan string
+	work      chan *domain.WorkRequest
+	workReply chan *domain.WorkReply
+	web       *webWaiters
+	closed    bool
 }
 
 func NewDBQueue(r *repo.MySQL) *dbQueue {
 	q := &dbQueue{
-		d:            r,
-		conf:         make(chan string, 1000),
-		work:         make(chan *domain.WorkRequest, 1000),
-		workReply:    make(chan *domain.WorkReply, 1000),
-		webWorkReply: make(map[string]chan *domain.WorkReply),
-		done:         make(chan bool),
-	}
-	go q.getMessages()
+		d:         r,
+		conf:      make(chan string, 1000),
+		work:      make(chan *domain.WorkRequest, 1000),
+		workReply: make(chan *domain.WorkReply, 1000),
+		web:       newWebWaiters(),
+		done:      make(chan bool),
+		stopped:   make(chan struct{}),
+	}
+	go q.getMessages(reapInterval)
 	return q
 }
 
@@ -44,8 +46,13 @@ func (dq *dbQueue) PushConf(team string) error {
 }
 
 // PopConf ...
-func (dq *dbQueue) PopConf(timeout time.Duration) (string, error) {
-	team := <-dq.conf
+func (dq *dbQueue) PopConf(ctx context.Context) (string, error) {
+	var team string
+	select {
+	case team = <-dq.conf:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 	// If someone closed the channel
 	if team == "" {
 		return "", ErrClosed
@@ -59,17 +66,69 @@ func (dq *dbQueue) PushWork(work *domain.WorkRequest) error {
 	if err != nil {
 		return err
 	}
-	m := domain.DBQueueMessage{MessageType: "work", Message: util.ToJSONStringNoIndent(work), Name: work.ReplyQueue}
+	message, err := encodeText(work)
+	if err != nil {
+		return err
+	}
+	m := domain.DBQueueMessage{MessageType: "work", Message: message, Name: work.ReplyQueue}
 	return dq.d.PostMessage(&m)
 }
 
-// PopWork ...
-func (dq *dbQueue) PopWork(timeout time.Duration) (*domain.WorkRequest, error) {
-	work := <-dq.work
-	if work == nil {
-		return nil, ErrClosed
+// PopWork renews the reservation from now, the request might have waited in the buffer
+func (dq *dbQueue) PopWork(ctx context.Context) (*domain.WorkRequest, error) {
+	for {
+		var work *domain.WorkRequest
+		select {
+		case work = <-dq.work:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if work == nil {
+			return nil, ErrClosed
+		}
+		id, _ := receipt(work)
+		ok, err := dq.d.RenewQueueMessage(id, util.Hostname, visibility())
+		if err != nil {
+			logrus.WithError(err).Warnf("Unable to renew the reservation of work request %s", work.MessageID)
+		} else if !ok {
+			// The reservation expired so another worker might have it already
+			continue
+		}
+		return work, nil
 	}
-	return work, nil
+}
+
+// receipt is the ID of the message of the work
+func receipt(work *domain.WorkRequest) (int64, error) {
+	id, err := strconv.ParseInt(work.Receipt, 10, 64)
+	if err != nil {
+		return 0, ErrNotReserved
+	}
+	return id, nil
+}
+
+// Ack ...
+func (dq *dbQueue) Ack(work *domain.WorkRequest) error {
+	id, err := receipt(work)
+	if err != nil {
+		return err
+	}
+	if err = dq.d.AckQueueMessage(id, util.Hostname); err == repo.ErrNotFound {
+		return ErrNotReserved
+	}
+	return err
+}
+
+// Nack ...
+func (dq *dbQueue) Nack(work *domain.WorkRequest, delay time.Duration) error {
+	id, err := receipt(work)
+	if err != nil {
+		return err
+	}
+	if err = dq.d.NackQueueMessage(id, util.Hostname, delay); err == repo.ErrNotFound {
+		return ErrNotReserved
+	}
+	return err
 }
 
 // PushWorkReply ...
@@ -78,28 +137,31 @@ func (dq *dbQueue) PushWorkReply(replyQueue string, reply *domain.WorkReply) err
 	if err != nil {
 		return err
 	}
-	m := domain.DBQueueMessage{MessageType: "workr", Message: util.ToJSONStringNoIndent(reply), Name: replyQueue}
+	message, err := encodeText(reply)
+	if err != nil {
+		return err
+	}
+	m := domain.DBQueueMessage{MessageType: "workr", Message: message, Name: replyQueue}
 	return dq.d.PostMessage(&m)
 }
 
 // PopWorkReply ...
-func (dq *dbQueue) PopWorkReply(replyQueue string, timeout time.Duration) (work *domain.WorkReply, err error) {
+func (dq *dbQueue) PopWorkReply(ctx context.Context, replyQueue string) (work *domain.WorkReply, err error) {
 	if replyQueue == util.Hostname {
-		work = <-dq.workReply
+		select {
+		case work = <-dq.workReply:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	} else {
-		var ch chan *domain.WorkReply
-		var ok bool
-		dq.mux.Lock()
-		if ch, ok = dq.webWorkReply[replyQueue]; !ok {
-			ch = make(chan *domain.WorkReply, 1)
-			dq.webWorkReply[replyQueue] = ch
+		ch := dq.web.channel(replyQueue, true)
+		defer dq.web.leave(replyQueue)
+		select {
+		case work = <-ch:
+		case <-dq.stopped:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		dq.mux.Unlock()
-		work = <-ch
-		close(ch)
-		dq.mux.Lock()
-		delete(dq.webWorkReply, replyQueue)
-		dq.mux.Unlock()
 	}
 	if work == nil {
 		return nil, ErrClosed
@@ -107,76 +169,149 @@ func (dq *dbQueue) PopWorkReply(replyQueue string, timeout time.Duration) (work
 	return work, nil
 }
 
+// RemoveReplyQueue moves the pending replies of the host to reroute if given and deletes the rest of its messages
+func (dq *dbQueue) RemoveReplyQueue(replyQueue, reroute string) (int, error) {
+	var moved int64
+	if reroute != "" {
+		var err error
+		if moved, err = dq.d.MoveQueueMessages(replyQueue, reroute, "workr"); err != nil {
+			return 0, err
+		}
+	}
+	_, err := dq.d.DeleteQueueMessages(replyQueue)
+	return int(moved), err
+}
+
+// RestoreReplyQueue has nothing to do, the replies posted to the host after its messages were deleted are still read
+func (dq *dbQueue) RestoreReplyQueue() error {
+	return nil
+}
+
+// Lanes of all the hosts from the queue table, the reservations of the workers are in flight
+func (dq *dbQueue) Lanes() ([]*domain.QueueLane, error) {
+	counted, err := dq.d.QueueLanes()
+	if err != nil {
+		return nil, err
+	}
+	lanes := []*domain.QueueLane{{Lane: LaneWork}, {Lane: LaneReply}, {Lane: LaneConf}, {Lane: LaneDead}}
+	for _, c := range counted {
+		switch c.Lane {
+		case "work":
+			c.Lane, lanes[0] = LaneWork, c
+		case "workr":
+			c.Lane, lanes[1] = LaneReply, c
+		case "conf":
+			c.Lane, lanes[2] = LaneConf, c
+		case "dead":
+			c.Lane, lanes[3] = LaneDead, c
+		}
+	}
+	return lanes, nil
+}
+
+// Close returns the work reserved for the buffer to the queue
 func (dq *dbQueue) Close() error {
 	dq.done <- true
 	if !dq.closed {
 		dq.closed = true
+	drain:
+		for {
+			select {
+			case work := <-dq.work:
+				dq.Nack(work, 0)
+			default:
+				break drain
+			}
+		}
 		close(dq.conf)
 		close(dq.work)
 		close(dq.workReply)
-		dq.mux.Lock()
-		for _, ch := range dq.webWorkReply {
-			close(ch)
-		}
-		dq.mux.Unlock()
+		close(dq.stopped)
 	}
 	return nil
 }
 
-func (dq *dbQueue) getMessages() {
+// reply passes the reply message to the bot of the host or to its web waiter, a waiter that gave up does not block
+func (dq *dbQueue) reply(m *domain.DBQueueMessage) {
+	wr := &domain.WorkReply{}
+	if err := decodeText(m.Message, wr); err != nil {
+		logrus.WithError(err).Errorf("Unable to parse work reply message. got message - %s", m.Message)
+		return
+	}
+	// If this is a reply to Slack just push it to generic queue
+	if m.Name == util.Hostname {
+		if ctx, err := domain.GetContext(wr.Context); err == nil {
+			ctx.Replied = m.Timestamp
+			wr.Context = ctx
+		}
+		dq.workReply <- wr
+		return
+	}
+	select {
+	case dq.web.channel(m.Name, false) <- wr:
+	default:
+		logrus.Warnf("Dropping reply to %s, nobody is waiting for it", m.Name)
+	}
+}
+
+// getMessages polls the database for the messages of the host and returns the expired work reservations every
+// reapEvery
+func (dq *dbQueue) getMessages(reapEvery time.Duration) {
 	t := time.NewTicker(time.Duration(conf.Options.QueuePoll) * time.Second)
 	defer t.Stop()
+	reap := time.NewTicker(reapEvery)
+	defer reap.Stop()
 	for {
 		select {
 		case <-dq.done:
 			return
-		case <-t.C:
+		case <-reap.C:
 			if conf.Options.Worker {
-				messages, err := dq.d.QueueMessages(nil, "work")
+				released, err := dq.d.ReleaseExpiredQueueMessages()
+				if err != nil {
+					logrus.WithError(err).Warn("Unable to release the expired work reservations")
+				} else if released > 0 {
+					logrus.Warnf("Returned %d work requests that were not acknowledged in time to the queue", released)
+				}
+			}
+		case <-t.C:
+			// Only reserve what the buffer has room for
+			if free := cap(dq.work) - len(dq.work); conf.Options.Worker && free > 0 {
+				messages, err := dq.d.ReserveQueueMessages("work", util.Hostname, free, visibility())
 				if err != nil {
 					logrus.WithError(err).Error("Unable to load worker messages - going to retry")
 				}
 				for _, m := range messages {
+					if m.Attempts >= maxDeliveries() {
+						logrus.Errorf("Work request message %d was reserved %d times - moving it to the dead lane", m.ID, m.Attempts)
+						if err := dq.d.BuryQueueMessage(m.ID, util.Hostname); err != nil {
+							logrus.WithError(err).Error("Unable to move the work request message to the dead lane")
+						}
+						continue
+					}
 					wr := &domain.WorkRequest{}
-					if err := json.Unmarshal([]byte(m.Message), wr); err != nil {
+					if err := decodeText(m.Message, wr); err != nil {
 						logrus.WithError(err).Error("Unable to parse work request message")
+						dq.d.AckQueueMessage(m.ID, util.Hostname)
 						continue
 					}
+					wr.Receipt, wr.Attempts = strconv.FormatInt(m.ID, 10), m.Attempts
+					// The times of the queue are what the bot measures the latency with, the hosts might not agree on the time
+					if ctx, err := domain.GetContext(wr.Context); err == nil {
+						ctx.Enqueued = m.Timestamp
+						wr.Context = ctx
+					}
 					dq.work <- wr
 				}
 			}
 			if conf.Options.Web {
-				names := []string{util.Hostname}
-				dq.mux.Lock()
-				for k := range dq.webWorkReply {
-					names = append(names, k)
-				}
-				dq.mux.Unlock()
-				messages, err := dq.d.QueueMessages(names, "workr")
+				// Only the waiters still waiting are read, the replies to the ones that gave up are cleaned with the old messages
+				messages, err := dq.d.QueueMessages(append([]string{util.Hostname}, dq.web.names()...), "workr")
 				if err != nil {
 					logrus.WithError(err).Error("Unable to load web workr messages - going to retry")
 				}
 				for _, m := range messages {
-					wr := &domain.WorkReply{}
-					if err := json.Unmarshal([]byte(m.Message), wr); err != nil {
-						logrus.WithError(err).Errorf("Unable to parse work reply message. got message - %s", m.Message)
-						continue
-					}
-					// If this is a reply to Slack just push it to generic queue
-					if m.Name == util.Hostname {
-						dq.workReply <- wr
-					} else {
-						// Otherwise, make sure to push to the specific web waiter
-						var ch chan *domain.WorkReply
-						var ok bool
-						dq.mux.Lock()
-						if ch, ok = dq.webWorkReply[m.Name]; !ok {
-							ch = make(chan *domain.WorkReply, 1)
-							dq.webWorkReply[m.Name] = ch
-						}
-						dq.mux.Unlock()
-						ch <- wr
-					}
+					dq.reply(m)
 				}
 			}
 			if conf.Options.Web {
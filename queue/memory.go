@@ -0,0 +1,292 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+// ErrFull is returned if a push finds the buffer of the memory queue full
+var ErrFull = errors.New("queue is full")
+
+// defaultMemorySize is the number of messages of each kind the memory queue buffers if it is not configured
+const defaultMemorySize = 1000
+
+// memoryQueue passes the messages over channels for a bot and a worker in the same process. The messages go through
+// JSON like they do through the database so neither side sees the changes of the other.
+type memoryQueue struct {
+	conf       chan string
+	work       chan *domain.WorkRequest
+	workReply  chan *domain.WorkReply
+	web        *webWaiters
+	reserved   *reservations
+	visibility time.Duration
+	mux        sync.Mutex
+	enqueued   []time.Time // When the bot pushed the work in the channel, in the order of the channel
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewMemoryQueue buffers size messages of each kind, 0 for the default
+func NewMemoryQueue(size int) *memoryQueue {
+	if size <= 0 {
+		size = defaultMemorySize
+	}
+	mq := &memoryQueue{
+		conf:       make(chan string, size),
+		work:       make(chan *domain.WorkRequest, size),
+		workReply:  make(chan *domain.WorkReply, size),
+		web:        newWebWaiters(),
+		reserved:   newReservations(),
+		visibility: visibility(),
+		done:       make(chan struct{}),
+	}
+	go mq.reserved.reap(reapInterval, mq.done, mq.requeue)
+	return mq
+}
+
+// closed checks if the queue is closed
+func (mq *memoryQueue) closed() bool {
+	select {
+	case <-mq.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// copyJSON copies from into to the way the database queue does
+func copyJSON(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+// PushConf ...
+func (mq *memoryQueue) PushConf(team string) error {
+	if mq.closed() {
+		return ErrClosed
+	}
+	select {
+	case mq.conf <- team:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// PopConf ...
+func (mq *memoryQueue) PopConf(ctx context.Context) (string, error) {
+	select {
+	case team := <-mq.conf:
+		return team, nil
+	case <-mq.done:
+		return "", ErrClosed
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// PushWork ...
+func (mq *memoryQueue) PushWork(work *domain.WorkRequest) error {
+	if _, err := domain.GetContext(work.Context); err != nil {
+		return err
+	}
+	if mq.closed() {
+		return ErrClosed
+	}
+	wr := &domain.WorkRequest{}
+	if err := copyJSON(work, wr); err != nil {
+		return err
+	}
+	if ctx, err := domain.GetContext(wr.Context); err == nil {
+		ctx.Enqueued = time.Now()
+		wr.Context = ctx
+	}
+	wr.Attempts = 0
+	return mq.send(wr)
+}
+
+// send puts the work in the channel and keeps its enqueue time in the same order under the lock
+func (mq *memoryQueue) send(work *domain.WorkRequest) error {
+	mq.mux.Lock()
+	defer mq.mux.Unlock()
+	select {
+	case mq.work <- work:
+		mq.enqueued = append(mq.enqueued, work.Enqueued)
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+// received forgets the enqueue time of the work PopWork took from the channel
+func (mq *memoryQueue) received() {
+	mq.mux.Lock()
+	defer mq.mux.Unlock()
+	if len(mq.enqueued) > 0 {
+		mq.enqueued = mq.enqueued[1:]
+	}
+}
+
+// oldest is the seconds the oldest work in the channel waits since the bot pushed it, retries keep their time
+func (mq *memoryQueue) oldest(now time.Time) int64 {
+	mq.mux.Lock()
+	defer mq.mux.Unlock()
+	var first time.Time
+	for _, enqueued := range mq.enqueued {
+		if !enqueued.IsZero() && (first.IsZero() || enqueued.Before(first)) {
+			first = enqueued
+		}
+	}
+	if first.IsZero() || now.Before(first) {
+		return 0
+	}
+	return int64(now.Sub(first) / time.Second)
+}
+
+// PopWork ...
+func (mq *memoryQueue) PopWork(ctx context.Context) (*domain.WorkRequest, error) {
+	for {
+		select {
+		case work := <-mq.work:
+			mq.received()
+			if work.Attempts >= maxDeliveries() {
+				mq.reserved.bury(work)
+				continue
+			}
+			if err := mq.reserved.reserve(work, time.Now().Add(mq.visibility)); err != nil {
+				return nil, err
+			}
+			return work, nil
+		case <-mq.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// requeue the work as it was pushed
+func (mq *memoryQueue) requeue(work *domain.WorkRequest) error {
+	if mq.closed() {
+		return ErrClosed
+	}
+	return mq.send(work)
+}
+
+// Ack ...
+func (mq *memoryQueue) Ack(work *domain.WorkRequest) error {
+	_, err := mq.reserved.release(work)
+	return err
+}
+
+// Nack returns the work to the queue after the delay, if the queue is full the reaper tries again
+func (mq *memoryQueue) Nack(work *domain.WorkRequest, delay time.Duration) error {
+	saved, err := mq.reserved.release(work)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		mq.reserved.delay(saved, time.Now().Add(delay))
+		return nil
+	}
+	if err = mq.requeue(saved); err != nil {
+		mq.reserved.delay(saved, time.Now())
+	}
+	return err
+}
+
+// PushWorkReply ...
+func (mq *memoryQueue) PushWorkReply(replyQueue string, reply *domain.WorkReply) error {
+	if _, err := domain.GetContext(reply.Context); err != nil {
+		return err
+	}
+	if mq.closed() {
+		return ErrClosed
+	}
+	wr := &domain.WorkReply{}
+	if err := copyJSON(reply, wr); err != nil {
+		return err
+	}
+	ch := mq.workReply
+	if replyQueue == util.Hostname {
+		if ctx, err := domain.GetContext(wr.Context); err == nil {
+			ctx.Replied = time.Now()
+			wr.Context = ctx
+		}
+	} else {
+		ch = mq.web.channel(replyQueue, false)
+	}
+	select {
+	case ch <- wr:
+		return nil
+	default:
+		// A web waiter gets a single reply, the one that gave up already left it in the channel
+		if replyQueue != util.Hostname {
+			logrus.Warnf("Dropping reply to %s, nobody is waiting for it", replyQueue)
+		}
+		return ErrFull
+	}
+}
+
+// PopWorkReply ...
+func (mq *memoryQueue) PopWorkReply(ctx context.Context, replyQueue string) (*domain.WorkReply, error) {
+	if replyQueue == util.Hostname {
+		select {
+		case reply := <-mq.workReply:
+			return reply, nil
+		case <-mq.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	ch := mq.web.channel(replyQueue, true)
+	defer mq.web.leave(replyQueue)
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-mq.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RemoveReplyQueue has nothing to do, the replies never leave the process
+func (mq *memoryQueue) RemoveReplyQueue(replyQueue, reroute string) (int, error) {
+	return 0, nil
+}
+
+// RestoreReplyQueue has nothing to do, nothing removes the channels
+func (mq *memoryQueue) RestoreReplyQueue() error {
+	return nil
+}
+
+// Lanes counts what waits in the channels, the replies of the web waiters and the work delayed for its retry included.
+// The oldest work is the one the bot pushed first of those in the channel.
+func (mq *memoryQueue) Lanes() ([]*domain.QueueLane, error) {
+	replies := len(mq.workReply) + mq.web.replies()
+	reserved, delayed, dead := mq.reserved.count()
+	return []*domain.QueueLane{
+		{Lane: LaneWork, Depth: int64(len(mq.work) + delayed), InFlight: int64(reserved), Oldest: mq.oldest(time.Now())},
+		{Lane: LaneReply, Depth: int64(replies)},
+		{Lane: LaneConf, Depth: int64(len(mq.conf))},
+		{Lane: LaneDead, Depth: int64(dead)},
+	}, nil
+}
+
+// Close wakes up all the pops with ErrClosed, the messages still in the queue or reserved are lost
+func (mq *memoryQueue) Close() error {
+	mq.closeOnce.Do(func() { close(mq.done) })
+	return nil
+}
@@ -0,0 +1,283 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+func TestMemoryQueueWork(t *testing.T) {
+	q := NewMemoryQueue(2)
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1", Channel: "C1"}
+	work := &domain.WorkRequest{Type: "message", Text: "8.8.8.8", ReplyQueue: util.Hostname, Context: ctx}
+	if err := q.PushWork(work); err != nil {
+		t.Fatal(err)
+	}
+	// The worker gets a copy
+	work.Text = "changed"
+	got, err := q.PopWork(context.Background())
+	if err != nil || got.Text != "8.8.8.8" || got == work {
+		t.Fatalf("unexpected work %+v - %v", got, err)
+	}
+	if c, ok := got.Context.(*domain.Context); !ok || c.Team != "T1" || c.Enqueued.IsZero() || !ctx.Enqueued.IsZero() {
+		t.Errorf("unexpected context %+v", got.Context)
+	}
+	// Work without a context is refused like the database queue does
+	if err = q.PushWork(&domain.WorkRequest{Type: "message"}); err == nil {
+		t.Error("expected an error for work without a context")
+	}
+	// The pops block until the timeout
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = q.PopWork(timeout); err != context.DeadlineExceeded {
+		t.Errorf("expected a timeout but got %v", err)
+	}
+	// The buffer is bounded
+	q.PushWork(work)
+	q.PushWork(work)
+	if err = q.PushWork(work); err != ErrFull {
+		t.Errorf("expected a full queue but got %v", err)
+	}
+}
+
+func TestMemoryQueueReplies(t *testing.T) {
+	q := NewMemoryQueue(0)
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1"}
+	// The bot gets the replies of the host
+	if err := q.PushWorkReply(util.Hostname, &domain.WorkReply{MessageID: "1.1", Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	// The reply of a web waiter might come before it waits
+	if err := q.PushWorkReply("web-1", &domain.WorkReply{MessageID: "web", Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := q.PopWorkReply(context.Background(), util.Hostname)
+	if err != nil || reply.MessageID != "1.1" || reply.Context.(*domain.Context).Replied.IsZero() {
+		t.Fatalf("unexpected reply %+v - %v", reply, err)
+	}
+	if reply, err = q.PopWorkReply(context.Background(), "web-1"); err != nil || reply.MessageID != "web" {
+		t.Fatalf("unexpected web reply %+v - %v", reply, err)
+	}
+	// Each waiter only gets its own replies
+	done := make(chan *domain.WorkReply)
+	go func() {
+		reply, _ := q.PopWorkReply(context.Background(), "web-2")
+		done <- reply
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.PushWorkReply("web-3", &domain.WorkReply{MessageID: "other", Context: ctx})
+	q.PushWorkReply("web-2", &domain.WorkReply{MessageID: "mine", Context: ctx})
+	if reply = <-done; reply == nil || reply.MessageID != "mine" {
+		t.Errorf("unexpected web reply %+v", reply)
+	}
+}
+
+func TestMemoryQueueLateReply(t *testing.T) {
+	defer func(ttl time.Duration) { webReplyTTL = ttl }(webReplyTTL)
+	webReplyTTL = 10 * time.Millisecond
+	q := NewMemoryQueue(0)
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1"}
+	// The waiter gave up before the reply came so nobody takes it
+	timeout, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := q.PopWorkReply(timeout, "web-1"); err != context.DeadlineExceeded {
+		t.Fatalf("expected a timeout but got %v", err)
+	}
+	q.PushWorkReply("web-1", &domain.WorkReply{MessageID: "late", Context: ctx})
+	if n := q.web.count(); n != 1 {
+		t.Fatalf("expected the late reply to wait but got %d channels", n)
+	}
+	// Its channel is dropped once it waited too long while a waiter keeps its own
+	time.Sleep(20 * time.Millisecond)
+	waiting, stop := context.WithCancel(context.Background())
+	defer stop()
+	go q.PopWorkReply(waiting, "web-2")
+	time.Sleep(20 * time.Millisecond)
+	q.PushWorkReply("web-3", &domain.WorkReply{MessageID: "early", Context: ctx})
+	if n, replies := q.web.count(), q.web.replies(); n != 2 || replies != 1 {
+		t.Errorf("expected the late reply to be dropped but got %d channels with %d replies", n, replies)
+	}
+}
+
+func TestMemoryQueueAck(t *testing.T) {
+	saved, retries := reapInterval, conf.Options.Retries
+	defer func() { reapInterval, conf.Options.Retries = saved, retries }()
+	reapInterval, conf.Options.Retries.MaxAttempts = 5*time.Millisecond, 3
+	q := NewMemoryQueue(0)
+	defer q.Close()
+	q.visibility = 20 * time.Millisecond
+	ctx := &domain.Context{Team: "T1"}
+	for _, id := range []string{"1.1", "1.2", "1.3"} {
+		q.PushWork(&domain.WorkRequest{Type: "message", MessageID: id, ReplyQueue: util.Hostname, Context: ctx})
+	}
+	pop := func() *domain.WorkRequest {
+		timeout, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		work, err := q.PopWork(timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return work
+	}
+	acked := pop()
+	if err := q.Ack(acked); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(acked); err != ErrNotReserved {
+		t.Errorf("expected the second ack to fail but got %v", err)
+	}
+	// The returned request is as it was pushed, whatever the worker did to it, and counts the pop
+	returned := pop()
+	returned.Attempts = 5
+	if err := q.Nack(returned, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The worker crashes before it acknowledges the requests so they come back after the visibility timeout
+	crashed := []*domain.WorkRequest{pop(), pop()}
+	if crashed[0].MessageID != "1.3" || crashed[0].Attempts != 0 || crashed[1].MessageID != "1.2" || crashed[1].Attempts != 1 {
+		t.Fatalf("unexpected requests %+v", crashed)
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		work := pop()
+		got[work.MessageID] = true
+		q.Ack(work)
+	}
+	if !got["1.2"] || !got["1.3"] {
+		t.Errorf("expected the requests of the crashed worker again but got %v", got)
+	}
+	if err := q.Ack(crashed[0]); err != ErrNotReserved {
+		t.Errorf("expected the expired reservation to be gone but got %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if work, err := q.PopWork(timeout); err != context.DeadlineExceeded {
+		t.Errorf("expected nothing left but got %+v - %v", work, err)
+	}
+}
+
+func TestMemoryQueueRetries(t *testing.T) {
+	saved, retries := reapInterval, conf.Options.Retries
+	defer func() { reapInterval, conf.Options.Retries = saved, retries }()
+	reapInterval, conf.Options.Retries.MaxAttempts = 5*time.Millisecond, 1
+	q := NewMemoryQueue(0)
+	defer q.Close()
+	q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "1.1", ReplyQueue: util.Hostname, Context: &domain.Context{Team: "T1"}})
+	pop := func(wait time.Duration) (*domain.WorkRequest, error) {
+		timeout, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+		return q.PopWork(timeout)
+	}
+	work, err := pop(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The worker returns it for the backoff of its retry
+	if err = q.Nack(work, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if work, err = pop(10 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to wait for its retry but got %+v - %v", work, err)
+	}
+	if lanes, _ := q.Lanes(); lanes[0].Depth != 1 || lanes[0].InFlight != 0 {
+		t.Errorf("expected the delayed request to wait but got %+v", lanes[0])
+	}
+	if work, err = pop(time.Second); err != nil || work.Attempts != 1 {
+		t.Fatalf("expected the retry but got %+v - %v", work, err)
+	}
+	// The queue gives up on it once it was popped more than the retries allow
+	if err = q.Nack(work, 0); err != nil {
+		t.Fatal(err)
+	}
+	if work, err = pop(20 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to be dead but got %+v - %v", work, err)
+	}
+	if lanes, _ := q.Lanes(); lanes[0].Depth != 0 || lanes[3].Lane != LaneDead || lanes[3].Depth != 1 {
+		t.Errorf("expected the request in the dead lane but got %+v", lanes)
+	}
+}
+
+func TestMemoryQueueLanes(t *testing.T) {
+	q := NewMemoryQueue(0)
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1"}
+	// The popped request is older but only the one left in the channel waits
+	now := time.Now()
+	for i, enqueued := range []time.Time{now.Add(-time.Hour), now.Add(-2 * time.Minute)} {
+		if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: fmt.Sprintf("1.%d", i+1), ReplyQueue: util.Hostname, Context: ctx, Enqueued: enqueued}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.PopWork(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	q.PushWorkReply(util.Hostname, &domain.WorkReply{MessageID: "1.1", Context: ctx})
+	q.PushWorkReply("web-1", &domain.WorkReply{MessageID: "web", Context: ctx})
+	q.PushConf("T1")
+	lanes, err := q.Lanes()
+	if err != nil || len(lanes) != 4 {
+		t.Fatalf("unexpected lanes %+v - %v", lanes, err)
+	}
+	expected := []domain.QueueLane{{Lane: LaneWork, Depth: 1, InFlight: 1, Oldest: 120}, {Lane: LaneReply, Depth: 2}, {Lane: LaneConf, Depth: 1},
+		{Lane: LaneDead}}
+	for i := range expected {
+		if *lanes[i] != expected[i] {
+			t.Errorf("expected %+v but got %+v", expected[i], lanes[i])
+		}
+	}
+}
+
+func TestMemoryQueueClose(t *testing.T) {
+	q := NewMemoryQueue(0)
+	errs := make(chan error, 3)
+	go func() {
+		_, err := q.PopWork(context.Background())
+		errs <- err
+	}()
+	go func() {
+		_, err := q.PopWorkReply(context.Background(), util.Hostname)
+		errs <- err
+	}()
+	go func() {
+		_, err := q.PopConf(context.Background())
+		errs <- err
+	}()
+	q.Close()
+	q.Close()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != ErrClosed {
+			t.Errorf("expected the pop to see the queue closed but got %v", err)
+		}
+	}
+	if err := q.PushConf("T1"); err != ErrClosed {
+		t.Errorf("expected a closed queue but got %v", err)
+	}
+}
+
+func TestNewQueue(t *testing.T) {
+	saved, web, worker := conf.Options.Queue, conf.Options.Web, conf.Options.Worker
+	defer func() { conf.Options.Queue, conf.Options.Web, conf.Options.Worker = saved, web, worker }()
+	conf.Options.Queue.Backend, conf.Options.Web, conf.Options.Worker = "memory", true, true
+	if q, err := New(nil); err != nil {
+		t.Errorf("expected a memory queue but got %v", err)
+	} else if _, ok := q.(*memoryQueue); !ok {
+		t.Errorf("expected a memory queue but got %T", q)
+	}
+	// The bot and the worker must share the process
+	conf.Options.Worker = false
+	if _, err := New(nil); err == nil {
+		t.Error("expected an error for a memory queue without the worker")
+	}
+	conf.Options.Queue.Backend = "carrier-pigeon"
+	if _, err := New(nil); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
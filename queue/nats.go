@@ -0,0 +1,416 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+	"github.com/nats-io/nats.go"
+)
+
+// natsWorkers is the queue group of the workers, each work message goes to one of them
+const natsWorkers = "workers"
+
+// natsQueue passes the messages over core NATS subjects under the prefix - the work to the queue group of the workers,
+// the replies to a subject of each host or web waiter and the configuration changes to every bot. Core NATS does not
+// keep the messages so whatever is published while nobody subscribes is lost. There is no clock of the queue either,
+// so the bot measures the latency from its own push. The reservations of the popped work are kept by the worker that
+// popped it, they survive a stuck worker but not a crashed process.
+type natsQueue struct {
+	nc           *nats.Conn
+	prefix       string
+	conf         *nats.Subscription
+	work         *nats.Subscription
+	workReply    *nats.Subscription
+	webWorkReply map[string]*nats.Subscription
+	reserved     *reservations
+	visibility   time.Duration
+	mux          sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// natsTLS is the TLS configuration of the connection if we have the CA of the servers
+func natsTLS() (*tls.Config, error) {
+	o := conf.Options.Queue.NATS
+	if o.ServerCA == "" {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM([]byte(o.ServerCA)); !ok {
+		return nil, errors.New("unable to add the NATS ServerCA PEM")
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if o.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(o.ClientCert), []byte(o.ClientKey))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// natsOptions of the connection from the configuration
+func natsOptions() ([]nats.Option, error) {
+	o := conf.Options.Queue.NATS
+	opts := []nats.Option{
+		nats.Name("dbot " + util.Hostname),
+		nats.MaxReconnects(o.MaxReconnects),
+		nats.ReconnectWait(time.Duration(o.ReconnectWait) * time.Second),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			logrus.WithError(err).Warn("Disconnected from NATS - reconnecting")
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logrus.Infof("Reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+	}
+	switch {
+	case o.Credentials != "":
+		opts = append(opts, nats.UserCredentials(o.Credentials))
+	case o.Token != "":
+		opts = append(opts, nats.Token(o.Token))
+	case o.User != "":
+		opts = append(opts, nats.UserInfo(o.User, o.Password))
+	}
+	config, err := natsTLS()
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		opts = append(opts, nats.Secure(config))
+	}
+	return opts, nil
+}
+
+// subjectToken replaces what NATS does not allow in a token of a subject, host names have dots
+func subjectToken(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// NewNATSQueue connects to the servers of conf.Options.Queue.NATS. The worker joins the queue group of the work and
+// the web subscribes to the replies of the host and to the configuration changes.
+func NewNATSQueue() (*natsQueue, error) {
+	opts, err := natsOptions()
+	if err != nil {
+		return nil, err
+	}
+	nc, err := nats.Connect(conf.Options.Queue.NATS.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Using NATS at %s", nc.ConnectedUrl())
+	nq := &natsQueue{
+		nc:           nc,
+		prefix:       conf.Options.Queue.NATS.Prefix,
+		webWorkReply: make(map[string]*nats.Subscription),
+		reserved:     newReservations(),
+		visibility:   visibility(),
+		done:         make(chan struct{}),
+	}
+	if conf.Options.Worker {
+		if nq.work, err = nc.QueueSubscribeSync(nq.subject("work"), natsWorkers); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		go nq.reserved.reap(reapInterval, nq.done, nq.requeue)
+	}
+	if conf.Options.Web {
+		if nq.workReply, err = nc.SubscribeSync(nq.replySubject(util.Hostname)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if nq.conf, err = nc.SubscribeSync(nq.subject("conf")); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return nq, nil
+}
+
+func (nq *natsQueue) subject(name string) string {
+	return nq.prefix + "." + name
+}
+
+func (nq *natsQueue) replySubject(replyQueue string) string {
+	return nq.subject("reply." + subjectToken(replyQueue))
+}
+
+// closed checks if the queue is closed
+func (nq *natsQueue) closed() bool {
+	select {
+	case <-nq.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish the message as JSON, compressed if it is large
+func (nq *natsQueue) publish(subject string, v interface{}) error {
+	if nq.closed() {
+		return ErrClosed
+	}
+	b, _, err := encode(v)
+	if err != nil {
+		return err
+	}
+	return nq.nc.Publish(subject, b)
+}
+
+// next message of the subscription, it blocks until there is one, the queue is closed or the context is done. The
+// process does not subscribe to what it does not do so the pops of those just wait.
+func (nq *natsQueue) next(ctx context.Context, sub *nats.Subscription) (*nats.Msg, error) {
+	if sub == nil {
+		select {
+		case <-nq.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	for {
+		m, err := sub.NextMsgWithContext(ctx)
+		switch {
+		case err == nil:
+			return m, nil
+		case nq.closed():
+			return nil, ErrClosed
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err == nats.ErrSlowConsumer:
+			// The client dropped messages we did not pop fast enough, the next ones are still good
+			logrus.WithError(err).Warnf("Messages of %s were dropped", sub.Subject)
+		default:
+			return nil, err
+		}
+	}
+}
+
+// PushConf ...
+func (nq *natsQueue) PushConf(team string) error {
+	if nq.closed() {
+		return ErrClosed
+	}
+	return nq.nc.Publish(nq.subject("conf"), []byte(team))
+}
+
+// PopConf ...
+func (nq *natsQueue) PopConf(ctx context.Context) (string, error) {
+	m, err := nq.next(ctx, nq.conf)
+	if err != nil {
+		return "", err
+	}
+	return string(m.Data), nil
+}
+
+// PushWork subscribes to the reply of a web waiter before the work goes out, core NATS would lose a quick reply
+func (nq *natsQueue) PushWork(work *domain.WorkRequest) error {
+	if _, err := domain.GetContext(work.Context); err != nil {
+		return err
+	}
+	if nq.closed() {
+		return ErrClosed
+	}
+	if work.ReplyQueue != "" && work.ReplyQueue != util.Hostname {
+		if _, err := nq.webSubscription(work.ReplyQueue); err != nil {
+			return err
+		}
+	}
+	if work.Attempts != 0 {
+		w := *work
+		w.Attempts = 0
+		work = &w
+	}
+	err := nq.publish(nq.subject("work"), work)
+	if err != nil && work.ReplyQueue != util.Hostname {
+		nq.unsubscribeWeb(work.ReplyQueue)
+	}
+	return err
+}
+
+// PopWork ...
+func (nq *natsQueue) PopWork(ctx context.Context) (*domain.WorkRequest, error) {
+	for {
+		m, err := nq.next(ctx, nq.work)
+		if err != nil {
+			return nil, err
+		}
+		wr := &domain.WorkRequest{}
+		if err := decode(m.Data, wr); err != nil {
+			logrus.WithError(err).Error("Unable to parse work request message")
+			continue
+		}
+		if wr.Attempts >= maxDeliveries() {
+			nq.reserved.bury(wr)
+			continue
+		}
+		if err = nq.reserved.reserve(wr, time.Now().Add(nq.visibility)); err != nil {
+			return nil, err
+		}
+		return wr, nil
+	}
+}
+
+// requeue publishes the work as it was popped for the queue group
+func (nq *natsQueue) requeue(work *domain.WorkRequest) error {
+	return nq.publish(nq.subject("work"), work)
+}
+
+// Ack ...
+func (nq *natsQueue) Ack(work *domain.WorkRequest) error {
+	_, err := nq.reserved.release(work)
+	return err
+}
+
+// Nack publishes the work again for another worker after the delay
+func (nq *natsQueue) Nack(work *domain.WorkRequest, delay time.Duration) error {
+	saved, err := nq.reserved.release(work)
+	if err != nil {
+		return err
+	}
+	if delay > 0 {
+		nq.reserved.delay(saved, time.Now().Add(delay))
+		return nil
+	}
+	if err = nq.requeue(saved); err != nil {
+		nq.reserved.delay(saved, time.Now())
+	}
+	return err
+}
+
+// webSubscription returns the subscription to the replies of a web waiter
+func (nq *natsQueue) webSubscription(replyQueue string) (*nats.Subscription, error) {
+	nq.mux.Lock()
+	defer nq.mux.Unlock()
+	if sub, ok := nq.webWorkReply[replyQueue]; ok {
+		return sub, nil
+	}
+	sub, err := nq.nc.SubscribeSync(nq.replySubject(replyQueue))
+	if err != nil {
+		return nil, err
+	}
+	nq.webWorkReply[replyQueue] = sub
+	return sub, nil
+}
+
+func (nq *natsQueue) unsubscribeWeb(replyQueue string) {
+	nq.mux.Lock()
+	defer nq.mux.Unlock()
+	if sub, ok := nq.webWorkReply[replyQueue]; ok {
+		sub.Unsubscribe()
+		delete(nq.webWorkReply, replyQueue)
+	}
+}
+
+// PushWorkReply ...
+func (nq *natsQueue) PushWorkReply(replyQueue string, reply *domain.WorkReply) error {
+	if _, err := domain.GetContext(reply.Context); err != nil {
+		return err
+	}
+	return nq.publish(nq.replySubject(replyQueue), reply)
+}
+
+// PopWorkReply ...
+func (nq *natsQueue) PopWorkReply(ctx context.Context, replyQueue string) (*domain.WorkReply, error) {
+	sub := nq.workReply
+	if replyQueue != util.Hostname {
+		var err error
+		if sub, err = nq.webSubscription(replyQueue); err != nil {
+			return nil, err
+		}
+		// A web waiter gets a single reply
+		defer nq.unsubscribeWeb(replyQueue)
+	}
+	for {
+		m, err := nq.next(ctx, sub)
+		if err != nil {
+			return nil, err
+		}
+		wr := &domain.WorkReply{}
+		if err := decode(m.Data, wr); err != nil {
+			logrus.WithError(err).Errorf("Unable to parse work reply message. got message - %s", m.Data)
+			continue
+		}
+		return wr, nil
+	}
+}
+
+// RemoveReplyQueue has nothing to do, the servers drop the replies to a subject nobody subscribes to
+func (nq *natsQueue) RemoveReplyQueue(replyQueue, reroute string) (int, error) {
+	return 0, nil
+}
+
+// RestoreReplyQueue has nothing to do, the subscription of the host stays
+func (nq *natsQueue) RestoreReplyQueue() error {
+	return nil
+}
+
+// pending messages of the subscription the process did not pop yet, 0 if it does not subscribe
+func pending(sub *nats.Subscription) (int64, error) {
+	if sub == nil {
+		return 0, nil
+	}
+	msgs, _, err := sub.Pending()
+	return int64(msgs), err
+}
+
+// Lanes counts the messages the client holds for the subscriptions of the process. The servers do not keep messages
+// so there is nothing else waiting.
+func (nq *natsQueue) Lanes() ([]*domain.QueueLane, error) {
+	work, err := pending(nq.work)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := pending(nq.workReply)
+	if err != nil {
+		return nil, err
+	}
+	nq.mux.Lock()
+	for _, sub := range nq.webWorkReply {
+		web, err := pending(sub)
+		if err != nil {
+			nq.mux.Unlock()
+			return nil, err
+		}
+		replies += web
+	}
+	nq.mux.Unlock()
+	confs, err := pending(nq.conf)
+	if err != nil {
+		return nil, err
+	}
+	reserved, delayed, dead := nq.reserved.count()
+	return []*domain.QueueLane{
+		{Lane: LaneWork, Depth: work + int64(delayed), InFlight: int64(reserved)},
+		{Lane: LaneReply, Depth: replies},
+		{Lane: LaneConf, Depth: confs},
+		{Lane: LaneDead, Depth: int64(dead)},
+	}, nil
+}
+
+// Close wakes up all the pops with ErrClosed after the published messages are flushed to the servers
+func (nq *natsQueue) Close() error {
+	nq.closeOnce.Do(func() {
+		close(nq.done)
+		if err := nq.nc.FlushTimeout(time.Second); err != nil {
+			logrus.WithError(err).Warn("Unable to flush the messages to NATS")
+		}
+		nq.nc.Close()
+	})
+	return nil
+}
@@ -0,0 +1,246 @@
+// +build integration
+
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// useNATS runs an embedded server that needs a token and points the configuration at it, call the returned function
+// to stop it
+func useNATS() func() {
+	opts := natsserver.DefaultTestOptions
+	opts.Port, opts.Authorization = -1, "s3cret"
+	s := natsserver.RunServer(&opts)
+	saved, web, worker := conf.Options.Queue, conf.Options.Web, conf.Options.Worker
+	conf.Options.Queue.Backend, conf.Options.Web, conf.Options.Worker = "nats", true, true
+	conf.Options.Queue.NATS.URL, conf.Options.Queue.NATS.Prefix, conf.Options.Queue.NATS.Token = s.ClientURL(), "test", "s3cret"
+	conf.Options.Queue.NATS.ReconnectWait, conf.Options.Queue.NATS.MaxReconnects = 1, -1
+	return func() {
+		conf.Options.Queue, conf.Options.Web, conf.Options.Worker = saved, web, worker
+		s.Shutdown()
+	}
+}
+
+func newTestNATS(t *testing.T) *natsQueue {
+	q, err := NewNATSQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestNATSQueue_Work(t *testing.T) {
+	defer useNATS()()
+	q, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}
+	work := &domain.WorkRequest{Type: "message", MessageID: "1.1", Text: "8.8.8.8", IPs: []string{"8.8.8.8"}, ReplyQueue: util.Hostname, Context: ctx}
+	if err = q.PushWork(work); err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.PopWork(context.Background())
+	if err != nil || got.MessageID != "1.1" || len(got.IPs) != 1 || got.ReplyQueue != util.Hostname {
+		t.Fatalf("unexpected work %+v - %v", got, err)
+	}
+	if c, err := domain.GetContext(got.Context); err != nil || c.Team != "T1" || c.TS != "1.1" {
+		t.Errorf("unexpected context %+v - %v", got.Context, err)
+	}
+	// The reply goes back to the bot of the host
+	if err = q.PushWorkReply(got.ReplyQueue, &domain.WorkReply{Type: domain.ReplyTypeIP, MessageID: got.MessageID, Context: got.Context}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := q.PopWorkReply(context.Background(), util.Hostname)
+	if err != nil || reply.MessageID != "1.1" || reply.Type != domain.ReplyTypeIP {
+		t.Fatalf("unexpected reply %+v - %v", reply, err)
+	}
+	// The pops block until the timeout
+	timeout, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = q.PopWork(timeout); err != context.DeadlineExceeded {
+		t.Errorf("expected a timeout but got %v", err)
+	}
+	if _, err = q.PopWorkReply(timeout, util.Hostname); err != context.DeadlineExceeded {
+		t.Errorf("expected a timeout but got %v", err)
+	}
+	if err = q.PushWork(&domain.WorkRequest{Type: "message"}); err == nil {
+		t.Error("expected an error for work without a context")
+	}
+}
+
+func TestNATSQueue_WebReply(t *testing.T) {
+	defer useNATS()()
+	q := newTestNATS(t)
+	defer q.Close()
+	// The worker might reply before the web waits for it
+	work := &domain.WorkRequest{Type: "message", MessageID: "file-message", ReplyQueue: "web-1", Context: &domain.Context{}, Online: true}
+	if err := q.PushWork(work); err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.PopWork(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.PushWorkReply("web-2", &domain.WorkReply{MessageID: "other", Context: got.Context})
+	if err = q.PushWorkReply(got.ReplyQueue, &domain.WorkReply{MessageID: got.MessageID, Context: got.Context}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := q.PopWorkReply(timeout, "web-1")
+	if err != nil || reply.MessageID != "file-message" {
+		t.Fatalf("unexpected web reply %+v - %v", reply, err)
+	}
+	if len(q.webWorkReply) != 0 {
+		t.Errorf("expected the web waiter to unsubscribe but got %v", q.webWorkReply)
+	}
+}
+
+func TestNATSQueue_Hosts(t *testing.T) {
+	defer useNATS()()
+	first, second := newTestNATS(t), newTestNATS(t)
+	defer first.Close()
+	defer second.Close()
+	// Every bot gets the configuration changes
+	if err := first.PushConf("T1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*natsQueue{first, second} {
+		timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+		team, err := q.PopConf(timeout)
+		cancel()
+		if err != nil || team != "T1" {
+			t.Errorf("expected the configuration change but got %s - %v", team, err)
+		}
+	}
+	// A single worker gets the work
+	for i := 0; i < 10; i++ {
+		first.PushWork(&domain.WorkRequest{Type: "message", ReplyQueue: util.Hostname, Context: &domain.Context{Team: "T1"}})
+	}
+	popped := 0
+	for _, q := range []*natsQueue{first, second} {
+		for {
+			timeout, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			_, err := q.PopWork(timeout)
+			cancel()
+			if err != nil {
+				break
+			}
+			popped++
+		}
+	}
+	if popped != 10 {
+		t.Errorf("expected each work request to be popped once but got %d", popped)
+	}
+}
+
+func TestNATSQueue_Ack(t *testing.T) {
+	defer useNATS()()
+	saved, retries := reapInterval, conf.Options.Retries
+	defer func() { reapInterval, conf.Options.Retries = saved, retries }()
+	reapInterval, conf.Options.Retries.MaxAttempts = 5*time.Millisecond, 3
+	q := newTestNATS(t)
+	defer q.Close()
+	q.visibility = 20 * time.Millisecond
+	pop := func() *domain.WorkRequest {
+		timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		work, err := q.PopWork(timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return work
+	}
+	if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "1.1", ReplyQueue: util.Hostname, Context: &domain.Context{}}); err != nil {
+		t.Fatal(err)
+	}
+	work := pop()
+	if err := q.Nack(work, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The worker does not acknowledge the returned request so it is published again after the visibility timeout
+	if work = pop(); work.MessageID != "1.1" {
+		t.Fatalf("expected the returned request but got %+v", work)
+	}
+	if work = pop(); work.MessageID != "1.1" || work.Attempts != 2 {
+		t.Fatalf("expected the request that was not acknowledged but got %+v", work)
+	}
+	if err := q.Ack(work); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if got, err := q.PopWork(timeout); err != context.DeadlineExceeded {
+		t.Errorf("expected the acknowledged request to be gone but got %+v - %v", got, err)
+	}
+}
+
+func TestNATSQueue_Lanes(t *testing.T) {
+	defer useNATS()()
+	q := newTestNATS(t)
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1"}
+	for _, id := range []string{"1.1", "1.2"} {
+		if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: id, ReplyQueue: util.Hostname, Context: ctx}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.PopWork(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The second request reaches the client of the process
+	for i := 0; i < 100; i++ {
+		if msgs, _, _ := q.work.Pending(); msgs > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lanes, err := q.Lanes()
+	if err != nil || len(lanes) != 4 {
+		t.Fatalf("unexpected lanes %+v - %v", lanes, err)
+	}
+	if work := lanes[0]; work.Lane != LaneWork || work.Depth != 1 || work.InFlight != 1 {
+		t.Errorf("unexpected work lane %+v", work)
+	}
+}
+
+func TestNATSQueue_Close(t *testing.T) {
+	defer useNATS()()
+	q := newTestNATS(t)
+	errs := make(chan error, 2)
+	go func() {
+		_, err := q.PopWork(context.Background())
+		errs <- err
+	}()
+	go func() {
+		_, err := q.PopConf(context.Background())
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	q.Close()
+	q.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrClosed {
+			t.Errorf("expected the pop to see the queue closed but got %v", err)
+		}
+	}
+	if err := q.PushConf("T1"); err != ErrClosed {
+		t.Errorf("expected a closed queue but got %v", err)
+	}
+	// Without the token the servers refuse us
+	conf.Options.Queue.NATS.Token = ""
+	if _, err := NewNATSQueue(); err == nil {
+		t.Error("expected the connection to be refused")
+	}
+}
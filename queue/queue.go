@@ -2,9 +2,12 @@
 package queue
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
 	"github.com/demisto/alfred/repo"
 )
@@ -14,20 +17,88 @@ var (
 	ErrTimeout = errors.New("timeout occurred")
 	// ErrClosed is returned if you try to access a closed queue
 	ErrClosed = errors.New("queue is already closed")
+	// ErrNotReserved is returned if the work request was not popped or its reservation expired
+	ErrNotReserved = errors.New("work request is not reserved")
 )
 
-// Queue abstracts the external / internal queues
+// The lanes of the queue Lanes reports
+const (
+	LaneWork  = "work"
+	LaneReply = "reply"
+	LaneConf  = "conf"
+	LaneDead  = "dead"
+)
+
+// reapInterval is how often the expired reservations are returned to the queue. Replaced by the tests.
+var reapInterval = 10 * time.Second
+
+// Queue abstracts the external / internal queues.
+// The Pop calls block until there is a message, the queue is closed or the context is done. PopWork reserves the
+// request for the visibility timeout - the worker acknowledges it once done with Ack or returns it with Nack, and a
+// request that is neither (the worker crashed) goes back to the queue when the reservation expires. Nack hides the
+// request from the workers for the delay, 0 to return it at once. PopWork sets Attempts to the number of times the
+// request was popped before, and the request popped more than maxDeliveries times is moved to the dead lane instead.
+// RemoveReplyQueue deletes the reply queue of a bot host that is gone. If reroute is given the replies still pending
+// in it are pushed to that reply queue first, and the number of rerouted replies is returned. RestoreReplyQueue creates
+// the reply queue of the host again in case another bot took the host for gone while it was alive and removed it.
+// Lanes reports the depth of the work, the replies and the configuration changes as far as the backend can see them -
+// the database sees all the hosts, the others only what waits for the process. The dead lane counts the requests the
+// queue gave up on.
 type Queue interface {
 	PushConf(team string) error
-	PopConf(timeout time.Duration) (string, error)
+	PopConf(ctx context.Context) (string, error)
 	PushWork(work *domain.WorkRequest) error
-	PopWork(timeout time.Duration) (*domain.WorkRequest, error)
+	PopWork(ctx context.Context) (*domain.WorkRequest, error)
+	Ack(work *domain.WorkRequest) error
+	Nack(work *domain.WorkRequest, delay time.Duration) error
 	PushWorkReply(replyQueue string, reply *domain.WorkReply) error
-	PopWorkReply(replyQueue string, timeout time.Duration) (*domain.WorkReply, error)
+	PopWorkReply(ctx context.Context, replyQueue string) (*domain.WorkReply, error)
+	RemoveReplyQueue(replyQueue, reroute string) (int, error)
+	RestoreReplyQueue() error
+	Lanes() ([]*domain.QueueLane, error)
 	Close() error
 }
 
-// New queue is returned depending on environment
+// maxDeliveries of a work request before the queue gives up on it. The workers dead letter the request after
+// conf.Options.Retries.MaxAttempts failures themselves, the queue catches the ones they crashed on or could not store.
+func maxDeliveries() int {
+	if conf.Options.Retries.MaxAttempts <= 0 {
+		return 2
+	}
+	return conf.Options.Retries.MaxAttempts + 1
+}
+
+// visibility of the popped work requests from conf.Options.Queue.VisibilityTimeout
+func visibility() time.Duration {
+	if conf.Options.Queue.VisibilityTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(conf.Options.Queue.VisibilityTimeout) * time.Second
+}
+
+// New queue is returned depending on environment. The memory queue only works with the bot and the worker in the
+// same process.
 func New(r *repo.MySQL) (Queue, error) {
-	return NewDBQueue(r), nil
+	switch conf.Options.Queue.Backend {
+	case "", "db":
+		return NewDBQueue(r), nil
+	case "memory":
+		if !conf.Options.Web || !conf.Options.Worker {
+			return nil, errors.New("the memory queue needs the web and the worker in the same process")
+		}
+		return NewMemoryQueue(conf.Options.Queue.Size), nil
+	case "nats":
+		q, err := NewNATSQueue()
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	case "sqs":
+		q, err := NewSQSQueue()
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	return nil, fmt.Errorf("unknown queue backend %s", conf.Options.Queue.Backend)
 }
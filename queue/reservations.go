@@ -0,0 +1,135 @@
+package queue
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/domain"
+)
+
+// deadLimit is how many dead work requests the backends that keep them in the process remember
+const deadLimit = 1000
+
+// reservation is a copy of the popped work request, the worker changes its own as it goes
+type reservation struct {
+	work     *domain.WorkRequest
+	deadline time.Time
+	delayed  bool // The worker returned it to be retried at the deadline
+}
+
+// reservations are the work requests popped from the backends that keep them in the process until they are
+// acknowledged, and the ones they gave up on
+type reservations struct {
+	mux     sync.Mutex
+	last    int64
+	pending map[string]*reservation
+	dead    []*domain.WorkRequest
+}
+
+func newReservations() *reservations {
+	return &reservations{pending: make(map[string]*reservation)}
+}
+
+// reserve a copy of the work until the deadline and set the receipt of the work. The copy counts the pop so the work
+// returned to the queue carries the number of times it was popped.
+func (r *reservations) reserve(work *domain.WorkRequest, deadline time.Time) error {
+	saved := &domain.WorkRequest{}
+	if err := copyJSON(work, saved); err != nil {
+		return err
+	}
+	saved.Attempts++
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	work.Receipt = r.add(&reservation{work: saved, deadline: deadline})
+	return nil
+}
+
+// delay the released work until the deadline, the reaper returns it to the queue then
+func (r *reservations) delay(work *domain.WorkRequest, deadline time.Time) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.add(&reservation{work: work, deadline: deadline, delayed: true})
+}
+
+func (r *reservations) add(res *reservation) string {
+	r.last++
+	receipt := strconv.FormatInt(r.last, 10)
+	r.pending[receipt] = res
+	return receipt
+}
+
+// bury the work the queue gave up on, only the last deadLimit are kept
+func (r *reservations) bury(work *domain.WorkRequest) {
+	logrus.Errorf("Work request %s was popped %d times - moving it to the dead lane", work.MessageID, work.Attempts)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.dead = append(r.dead, work)
+	if len(r.dead) > deadLimit {
+		r.dead = r.dead[len(r.dead)-deadLimit:]
+	}
+}
+
+// release the reservation of the work and return the copy taken when it was popped
+func (r *reservations) release(work *domain.WorkRequest) (*domain.WorkRequest, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	res, ok := r.pending[work.Receipt]
+	if !ok {
+		return nil, ErrNotReserved
+	}
+	delete(r.pending, work.Receipt)
+	return res.work, nil
+}
+
+// count the work reserved for the workers, the work delayed for its retry and the dead work
+func (r *reservations) count() (reserved, delayed, dead int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, res := range r.pending {
+		if res.delayed {
+			delayed++
+		} else {
+			reserved++
+		}
+	}
+	return reserved, delayed, len(r.dead)
+}
+
+// expired releases the reservations past their deadline
+func (r *reservations) expired(now time.Time) []*reservation {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var expired []*reservation
+	for receipt, res := range r.pending {
+		if now.After(res.deadline) {
+			expired = append(expired, res)
+			delete(r.pending, receipt)
+		}
+	}
+	return expired
+}
+
+// reap returns the expired and the delayed work with requeue every interval until done. Work that cannot be returned
+// yet stays delayed for the next round.
+func (r *reservations) reap(interval time.Duration, done <-chan struct{}, requeue func(work *domain.WorkRequest) error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-t.C:
+			for _, res := range r.expired(now) {
+				if !res.delayed {
+					logrus.Warnf("Work request %s was not acknowledged in time - returning it to the queue", res.work.MessageID)
+				}
+				if err := requeue(res.work); err != nil {
+					logrus.WithError(err).Warnf("Unable to return work request %s to the queue", res.work.MessageID)
+					r.delay(res.work, now)
+				}
+			}
+		}
+	}
+}
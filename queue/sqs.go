@@ -0,0 +1,656 @@
+package queue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+// ErrTooLarge is returned if a message does not fit in SQS even compressed
+var ErrTooLarge = errors.New("message is too large for the queue")
+
+const (
+	// sqsMaxBody leaves room for the attributes under the 256KB limit of a message
+	sqsMaxBody = 250 * 1024
+	// sqsMaxName is the length limit of a queue name
+	sqsMaxName = 80
+	// sqsTimeout of the calls that do not wait for messages
+	sqsTimeout = 30 * time.Second
+)
+
+var (
+	// sqsRetry is how long we wait after SQS failed before polling again. Replaced by the tests.
+	sqsRetry = 5 * time.Second
+	// sqsRecreateWait is how long we wait to create a queue SQS deleted in the last minute. Replaced by the tests.
+	sqsRecreateWait = 10 * time.Second
+)
+
+// sqsClient is the part of the SQS API we use. Replaced by the tests.
+type sqsClient interface {
+	CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error)
+	GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error)
+	ListQueues(ctx context.Context, params *sqs.ListQueuesInput, optFns ...func(*sqs.Options)) (*sqs.ListQueuesOutput, error)
+	DeleteQueue(ctx context.Context, params *sqs.DeleteQueueInput, optFns ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error)
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+	GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+	SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error)
+}
+
+// sqsQueue passes the work over an SQS queue the workers share. Each bot host has a queue of its own, created on start
+// and deleted on close, for its replies, the replies of its web waiters and the configuration changes. PushConf sends
+// the change to the queue of every host since they all must see it. The popped work stays hidden in the work queue for
+// the visibility timeout until it is acknowledged, SQS returns it to the other workers after that. SQS moves the work
+// received more than maxDeliveries times to the dead queue by the redrive policy of the work queue.
+type sqsQueue struct {
+	client    sqsClient
+	prefix    string
+	workURL   string
+	deadURL   string
+	hostURL   string
+	hosts     map[string]string // The URLs of the queues of the hosts we replied to
+	conf      chan string
+	workReply chan *domain.WorkReply
+	web       *webWaiters
+	mux       sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	receiving sync.WaitGroup
+}
+
+// newSQSClient with the region and the keys of conf.Options.Queue.SQS, the default AWS chain for what is missing
+func newSQSClient() (sqsClient, error) {
+	o := conf.Options.Queue.SQS
+	var opts []func(*config.LoadOptions) error
+	if o.Region != "" {
+		opts = append(opts, config.WithRegion(o.Region))
+	}
+	if o.AccessKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(o.AccessKey, o.SecretKey, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sqs.NewFromConfig(cfg, func(so *sqs.Options) {
+		if o.Endpoint != "" {
+			so.BaseEndpoint = aws.String(o.Endpoint)
+		}
+	}), nil
+}
+
+// NewSQSQueue creates the work queue if needed and, for the web, the queue of the host
+func NewSQSQueue() (*sqsQueue, error) {
+	client, err := newSQSClient()
+	if err != nil {
+		return nil, err
+	}
+	return newSQSQueue(client)
+}
+
+func newSQSQueue(client sqsClient) (*sqsQueue, error) {
+	sq := &sqsQueue{
+		client:    client,
+		prefix:    conf.Options.Queue.SQS.Prefix,
+		hosts:     make(map[string]string),
+		conf:      make(chan string, 1000),
+		workReply: make(chan *domain.WorkReply, 1000),
+		web:       newWebWaiters(),
+		done:      make(chan struct{}),
+	}
+	var err error
+	if sq.workURL, err = sq.createQueue(sqsName(sq.prefix + "-work")); err != nil {
+		return nil, err
+	}
+	if sq.deadURL, err = sq.createQueue(sqsName(sq.prefix + "-dead")); err != nil {
+		return nil, err
+	}
+	if err = sq.redrive(); err != nil {
+		return nil, err
+	}
+	if conf.Options.Web {
+		if sq.hostURL, err = sq.createQueue(sq.hostQueue(util.Hostname)); err != nil {
+			return nil, err
+		}
+		logrus.Infof("Using SQS queue %s for the replies of the host", sq.hostURL)
+		sq.receiving.Add(1)
+		go sq.receive()
+	}
+	return sq, nil
+}
+
+// sqsName replaces what SQS does not allow in the name of a queue and keeps it to the length limit
+func sqsName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, name)
+	if len(name) > sqsMaxName {
+		// Long hosts that share the start of the name must not share the queue so the tail is replaced by its hash
+		sum := sha256.Sum256([]byte(name))
+		tail := hex.EncodeToString(sum[:8])
+		name = name[:sqsMaxName-len(tail)-1] + "-" + tail
+	}
+	return name
+}
+
+func (sq *sqsQueue) hostQueue(host string) string {
+	return sqsName(sq.prefix + "-host-" + host)
+}
+
+// createQueue returns the URL of the queue, SQS does not create a queue again for a minute after it was deleted
+func (sq *sqsQueue) createQueue(name string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+		out, err := sq.client.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: aws.String(name)})
+		cancel()
+		if err == nil {
+			return aws.ToString(out.QueueUrl), nil
+		}
+		var recently *types.QueueDeletedRecently
+		if !errors.As(err, &recently) || attempt >= 7 {
+			return "", err
+		}
+		logrus.Infof("Queue %s was deleted recently - waiting to create it again", name)
+		time.Sleep(sqsRecreateWait)
+	}
+}
+
+// redrive the work received more than maxDeliveries times to the dead queue. The policy is set on the existing work
+// queue as well, CreateQueue refuses different attributes for a queue that exists.
+func (sq *sqsQueue) redrive() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	out, err := sq.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: aws.String(sq.deadURL),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn}})
+	if err != nil {
+		return err
+	}
+	policy, err := json.Marshal(map[string]string{"deadLetterTargetArn": out.Attributes[string(types.QueueAttributeNameQueueArn)],
+		"maxReceiveCount": strconv.Itoa(maxDeliveries())})
+	if err != nil {
+		return err
+	}
+	_, err = sq.client.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{QueueUrl: aws.String(sq.workURL),
+		Attributes: map[string]string{string(types.QueueAttributeNameRedrivePolicy): string(policy)}})
+	return err
+}
+
+// closed checks if the queue is closed
+func (sq *sqsQueue) closed() bool {
+	select {
+	case <-sq.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// popContext is done with the context or when the queue is closed
+func (sq *sqsQueue) popContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-sq.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// sqsBody is the JSON of the message, compressed if it is large or does not fit
+func sqsBody(v interface{}) (string, bool, error) {
+	b, compressed, err := encode(v)
+	if err != nil {
+		return "", false, err
+	}
+	if !compressed && len(b) <= sqsMaxBody {
+		return string(b), false, nil
+	}
+	if !compressed {
+		if b, err = gzipBytes(b); err != nil {
+			return "", false, err
+		}
+	}
+	body := base64.StdEncoding.EncodeToString(b)
+	if len(body) > sqsMaxBody {
+		return "", false, ErrTooLarge
+	}
+	return body, true, nil
+}
+
+// sqsAttribute returns the string attribute of the message
+func sqsAttribute(m types.Message, name string) string {
+	return aws.ToString(m.MessageAttributes[name].StringValue)
+}
+
+// sqsDecode the JSON of the message into v
+func sqsDecode(m types.Message, v interface{}) error {
+	b := []byte(aws.ToString(m.Body))
+	if sqsAttribute(m, "encoding") == "gzip" {
+		var err error
+		if b, err = base64.StdEncoding.DecodeString(string(b)); err != nil {
+			return err
+		}
+	}
+	return decode(b, v)
+}
+
+// send the message to the queue with the string attributes
+func (sq *sqsQueue) send(url string, v interface{}, attributes map[string]string) error {
+	if sq.closed() {
+		return ErrClosed
+	}
+	body, compressed, err := sqsBody(v)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]types.MessageAttributeValue, len(attributes)+1)
+	for k, v := range attributes {
+		values[k] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+	}
+	if compressed {
+		values["encoding"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String("gzip")}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	_, err = sq.client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(url), MessageBody: aws.String(body), MessageAttributes: values})
+	return err
+}
+
+// next message of the queue, hidden from the other receives for the visibility timeout. The long polls go on until
+// there is a message, the queue is closed or the context is done, and the failures of SQS are retried.
+func (sq *sqsQueue) next(ctx context.Context, url string, visibility int32) (types.Message, error) {
+	ctx, cancel := sq.popContext(ctx)
+	defer cancel()
+	for {
+		out, err := sq.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(url),
+			MaxNumberOfMessages:   1,
+			WaitTimeSeconds:       int32(conf.Options.Queue.SQS.WaitSeconds),
+			VisibilityTimeout:     visibility,
+			MessageAttributeNames: []string{"All"},
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+				types.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		switch {
+		case sq.closed():
+			return types.Message{}, ErrClosed
+		case ctx.Err() != nil:
+			return types.Message{}, ctx.Err()
+		case err != nil:
+			var missing *types.QueueDoesNotExist
+			if errors.As(err, &missing) && url == sq.hostURL {
+				logrus.Warn("The queue of the host was removed while it was alive - creating it again")
+				if err = sq.RestoreReplyQueue(); err == nil {
+					continue
+				}
+			}
+			logrus.WithError(err).Warnf("Unable to receive messages of %s - going to retry", url)
+			select {
+			case <-time.After(sqsRetry):
+			case <-ctx.Done():
+			}
+			continue
+		case len(out.Messages) == 0:
+			continue
+		}
+		return out.Messages[0], nil
+	}
+}
+
+// remove the received message from the queue
+func (sq *sqsQueue) remove(url, receipt string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	_, err := sq.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(url), ReceiptHandle: aws.String(receipt)})
+	return err
+}
+
+// receive the messages of the queue of the host until it is closed
+func (sq *sqsQueue) receive() {
+	defer sq.receiving.Done()
+	for {
+		m, err := sq.next(context.Background(), sq.hostURL, 0)
+		if err != nil {
+			return
+		}
+		// The replies and the configuration changes are not reserved, a crashed bot loses its queue anyway
+		if err = sq.remove(sq.hostURL, aws.ToString(m.ReceiptHandle)); err != nil {
+			logrus.WithError(err).Warnf("Unable to delete message %s, it might be received again", aws.ToString(m.MessageId))
+		}
+		switch sqsAttribute(m, "type") {
+		case "conf":
+			var team string
+			if err := sqsDecode(m, &team); err != nil {
+				logrus.WithError(err).Error("Unable to parse conf message")
+				continue
+			}
+			select {
+			case sq.conf <- team:
+			case <-sq.done:
+				return
+			}
+		case "workr":
+			wr := &domain.WorkReply{}
+			if err := sqsDecode(m, wr); err != nil {
+				logrus.WithError(err).Errorf("Unable to parse work reply message. got message - %s", aws.ToString(m.Body))
+				continue
+			}
+			if waiter := sqsAttribute(m, "waiter"); waiter != "" {
+				select {
+				case sq.web.channel(waiter, false) <- wr:
+				default:
+					logrus.Warnf("Dropping reply to %s, nobody is waiting for it", waiter)
+				}
+				continue
+			}
+			select {
+			case sq.workReply <- wr:
+			case <-sq.done:
+				return
+			}
+		default:
+			logrus.Warnf("Ignoring message %s of unknown type", aws.ToString(m.MessageId))
+		}
+	}
+}
+
+// hostQueueURL returns the URL of the queue of the host
+func (sq *sqsQueue) hostQueueURL(host string) (string, error) {
+	sq.mux.Lock()
+	url, ok := sq.hosts[host]
+	sq.mux.Unlock()
+	if ok {
+		return url, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	out, err := sq.client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String(sq.hostQueue(host))})
+	if err != nil {
+		return "", err
+	}
+	sq.mux.Lock()
+	sq.hosts[host] = aws.ToString(out.QueueUrl)
+	sq.mux.Unlock()
+	return aws.ToString(out.QueueUrl), nil
+}
+
+// PushConf to the queues of all the hosts
+func (sq *sqsQueue) PushConf(team string) error {
+	if sq.closed() {
+		return ErrClosed
+	}
+	var urls []string
+	input := &sqs.ListQueuesInput{QueueNamePrefix: aws.String(sq.hostQueue(""))}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+		out, err := sq.client.ListQueues(ctx, input)
+		cancel()
+		if err != nil {
+			return err
+		}
+		urls = append(urls, out.QueueUrls...)
+		if out.NextToken == nil {
+			break
+		}
+		input.NextToken = out.NextToken
+	}
+	var err error
+	for _, url := range urls {
+		if sendErr := sq.send(url, team, map[string]string{"type": "conf"}); sendErr != nil {
+			logrus.WithError(sendErr).Warnf("Unable to push the configuration change of %s to %s", team, url)
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// PopConf ...
+func (sq *sqsQueue) PopConf(ctx context.Context) (string, error) {
+	select {
+	case team := <-sq.conf:
+		return team, nil
+	case <-sq.done:
+		return "", ErrClosed
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// PushWork of a web waiter names the host too, the worker replies to the queue of the host that waits
+func (sq *sqsQueue) PushWork(work *domain.WorkRequest) error {
+	if _, err := domain.GetContext(work.Context); err != nil {
+		return err
+	}
+	if work.ReplyQueue != "" && work.ReplyQueue != util.Hostname {
+		w := *work
+		w.ReplyQueue = util.Hostname + "/" + work.ReplyQueue
+		work = &w
+	}
+	return sq.send(sq.workURL, work, nil)
+}
+
+// PopWork ...
+func (sq *sqsQueue) PopWork(ctx context.Context) (*domain.WorkRequest, error) {
+	for {
+		m, err := sq.next(ctx, sq.workURL, int32(conf.Options.Queue.SQS.VisibilityTimeout))
+		if err != nil {
+			return nil, err
+		}
+		wr := &domain.WorkRequest{}
+		if err := sqsDecode(m, wr); err != nil {
+			logrus.WithError(err).Error("Unable to parse work request message")
+			sq.remove(sq.workURL, aws.ToString(m.ReceiptHandle))
+			continue
+		}
+		wr.Receipt = aws.ToString(m.ReceiptHandle)
+		// SQS counts the receives, this one included
+		if received, err := strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)]); err == nil && received > 0 {
+			wr.Attempts = received - 1
+		}
+		return wr, nil
+	}
+}
+
+// Ack deletes the work from the queue
+func (sq *sqsQueue) Ack(work *domain.WorkRequest) error {
+	if work.Receipt == "" {
+		return ErrNotReserved
+	}
+	return sq.remove(sq.workURL, work.Receipt)
+}
+
+// Nack makes the work visible to the workers again after the delay
+func (sq *sqsQueue) Nack(work *domain.WorkRequest, delay time.Duration) error {
+	if work.Receipt == "" {
+		return ErrNotReserved
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	_, err := sq.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{QueueUrl: aws.String(sq.workURL),
+		ReceiptHandle: aws.String(work.Receipt), VisibilityTimeout: int32(delay / time.Second)})
+	return err
+}
+
+// PushWorkReply to the queue of the host, the reply queue is host/waiter for the web waiters
+func (sq *sqsQueue) PushWorkReply(replyQueue string, reply *domain.WorkReply) error {
+	if _, err := domain.GetContext(reply.Context); err != nil {
+		return err
+	}
+	attributes := map[string]string{"type": "workr"}
+	host := replyQueue
+	if i := strings.Index(replyQueue, "/"); i >= 0 {
+		host, attributes["waiter"] = replyQueue[:i], replyQueue[i+1:]
+	}
+	url, err := sq.hostQueueURL(host)
+	if err != nil {
+		return err
+	}
+	if err = sq.send(url, reply, attributes); err != nil {
+		// The host might be gone, look it up again the next time
+		sq.mux.Lock()
+		delete(sq.hosts, host)
+		sq.mux.Unlock()
+	}
+	return err
+}
+
+// PopWorkReply ...
+func (sq *sqsQueue) PopWorkReply(ctx context.Context, replyQueue string) (*domain.WorkReply, error) {
+	ch := sq.workReply
+	if replyQueue != util.Hostname {
+		ch = sq.web.channel(replyQueue, true)
+		defer sq.web.leave(replyQueue)
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-sq.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RemoveReplyQueue deletes the queue of a host that is gone. The replies still in it are sent as they are to the queue
+// of reroute if given, its configuration changes and the replies of its web waiters are dropped.
+func (sq *sqsQueue) RemoveReplyQueue(replyQueue, reroute string) (int, error) {
+	url, err := sq.hostQueueURL(replyQueue)
+	if err != nil {
+		var missing *types.QueueDoesNotExist
+		if errors.As(err, &missing) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	moved := 0
+	if reroute != "" {
+		to, err := sq.hostQueueURL(reroute)
+		if err != nil {
+			return 0, err
+		}
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+			out, err := sq.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{QueueUrl: aws.String(url), MaxNumberOfMessages: 10,
+				VisibilityTimeout: int32(sqsTimeout / time.Second), MessageAttributeNames: []string{"All"}})
+			cancel()
+			if err != nil {
+				return moved, err
+			}
+			if len(out.Messages) == 0 {
+				break
+			}
+			for _, m := range out.Messages {
+				if sqsAttribute(m, "type") == "workr" && sqsAttribute(m, "waiter") == "" {
+					ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+					_, err = sq.client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(to), MessageBody: m.Body,
+						MessageAttributes: m.MessageAttributes})
+					cancel()
+					if err != nil {
+						return moved, err
+					}
+					moved++
+				}
+				if err = sq.remove(url, aws.ToString(m.ReceiptHandle)); err != nil {
+					return moved, err
+				}
+			}
+		}
+	}
+	sq.mux.Lock()
+	delete(sq.hosts, replyQueue)
+	sq.mux.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	_, err = sq.client.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(url)})
+	return moved, err
+}
+
+// RestoreReplyQueue creates the queue of the host again, SQS gives the queue of the same name the same URL
+func (sq *sqsQueue) RestoreReplyQueue() error {
+	if sq.hostURL == "" {
+		return nil
+	}
+	_, err := sq.createQueue(sq.hostQueue(util.Hostname))
+	return err
+}
+
+// depth of the queue of the URL - the messages waiting and the ones received and not deleted yet. SQS only
+// approximates them.
+func (sq *sqsQueue) depth(url string) (*domain.QueueLane, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+	defer cancel()
+	out, err := sq.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{QueueUrl: aws.String(url),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible}})
+	if err != nil {
+		return nil, err
+	}
+	lane := &domain.QueueLane{}
+	lane.Depth, _ = strconv.ParseInt(out.Attributes[string(types.QueueAttributeNameApproximateNumberOfMessages)], 10, 64)
+	lane.InFlight, _ = strconv.ParseInt(out.Attributes[string(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible)], 10, 64)
+	return lane, nil
+}
+
+// Lanes of the shared work and dead queues and the queue of the host. The configuration changes share the queue of the host with
+// the replies so only the ones received and not popped yet are counted apart.
+func (sq *sqsQueue) Lanes() ([]*domain.QueueLane, error) {
+	work, err := sq.depth(sq.workURL)
+	if err != nil {
+		return nil, err
+	}
+	work.Lane = LaneWork
+	dead, err := sq.depth(sq.deadURL)
+	if err != nil {
+		return nil, err
+	}
+	dead.Lane = LaneDead
+	reply := &domain.QueueLane{Lane: LaneReply}
+	if sq.hostURL != "" {
+		if reply, err = sq.depth(sq.hostURL); err != nil {
+			return nil, err
+		}
+		reply.Lane = LaneReply
+	}
+	reply.Depth += int64(len(sq.workReply) + sq.web.replies())
+	return []*domain.QueueLane{work, reply, {Lane: LaneConf, Depth: int64(len(sq.conf))}, dead}, nil
+}
+
+// Close stops receiving and deletes the queue of the host, the replies still in it are lost
+func (sq *sqsQueue) Close() error {
+	var err error
+	sq.closeOnce.Do(func() {
+		close(sq.done)
+		sq.receiving.Wait()
+		if sq.hostURL == "" {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sqsTimeout)
+		defer cancel()
+		_, err = sq.client.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: aws.String(sq.hostURL)})
+	})
+	return err
+}
@@ -0,0 +1,639 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+const (
+	fakeSQSURL = "https://sqs.test/"
+	fakeSQSARN = "arn:aws:sqs:test:"
+)
+
+// fakeReceived is a received message hidden until the visibility timeout
+type fakeReceived struct {
+	url     string
+	message types.Message
+	until   time.Time
+}
+
+// fakeRedrive is the redrive policy of a queue
+type fakeRedrive struct {
+	target string
+	max    int
+}
+
+// fakeSQS keeps the queues in memory. The receives wait for a message until the wait time or the context is done.
+type fakeSQS struct {
+	mux           sync.Mutex
+	queues        map[string][]types.Message
+	received      map[string]*fakeReceived // The messages not deleted yet by their receipt handles
+	recently      map[string]bool          // Queues deleted that cannot be created again yet
+	receives      map[string]int           // The receives of the messages by their IDs
+	redrive       map[string]fakeRedrive
+	failReceives  int
+	lastReceive   *sqs.ReceiveMessageInput
+	id            int
+	deletedQueues []string
+}
+
+func newFakeSQS() *fakeSQS {
+	return &fakeSQS{queues: make(map[string][]types.Message), received: make(map[string]*fakeReceived), recently: make(map[string]bool),
+		receives: make(map[string]int), redrive: make(map[string]fakeRedrive)}
+}
+
+func (f *fakeSQS) CreateQueue(ctx context.Context, params *sqs.CreateQueueInput, optFns ...func(*sqs.Options)) (*sqs.CreateQueueOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	name := aws.ToString(params.QueueName)
+	if f.recently[name] {
+		delete(f.recently, name)
+		return nil, &types.QueueDeletedRecently{Message: aws.String("wait a minute")}
+	}
+	if _, ok := f.queues[fakeSQSURL+name]; !ok {
+		f.queues[fakeSQSURL+name] = nil
+	}
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String(fakeSQSURL + name)}, nil
+}
+
+func (f *fakeSQS) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	url := fakeSQSURL + aws.ToString(params.QueueName)
+	if _, ok := f.queues[url]; !ok {
+		return nil, &types.QueueDoesNotExist{}
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(url)}, nil
+}
+
+func (f *fakeSQS) ListQueues(ctx context.Context, params *sqs.ListQueuesInput, optFns ...func(*sqs.Options)) (*sqs.ListQueuesOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	out := &sqs.ListQueuesOutput{}
+	for url := range f.queues {
+		if strings.HasPrefix(url, fakeSQSURL+aws.ToString(params.QueueNamePrefix)) {
+			out.QueueUrls = append(out.QueueUrls, url)
+		}
+	}
+	sort.Strings(out.QueueUrls)
+	return out, nil
+}
+
+func (f *fakeSQS) DeleteQueue(ctx context.Context, params *sqs.DeleteQueueInput, optFns ...func(*sqs.Options)) (*sqs.DeleteQueueOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	url := aws.ToString(params.QueueUrl)
+	delete(f.queues, url)
+	f.recently[strings.TrimPrefix(url, fakeSQSURL)] = true
+	f.deletedQueues = append(f.deletedQueues, url)
+	return &sqs.DeleteQueueOutput{}, nil
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	url := aws.ToString(params.QueueUrl)
+	if _, ok := f.queues[url]; !ok {
+		return nil, &types.QueueDoesNotExist{}
+	}
+	if len(aws.ToString(params.MessageBody)) > 256*1024 {
+		return nil, errors.New("message too long")
+	}
+	f.id++
+	id := strconv.Itoa(f.id)
+	f.queues[url] = append(f.queues[url], types.Message{MessageId: aws.String(id), ReceiptHandle: aws.String("r" + id),
+		Body: params.MessageBody, MessageAttributes: params.MessageAttributes})
+	return &sqs.SendMessageOutput{MessageId: aws.String(id)}, nil
+}
+
+func (f *fakeSQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	deadline := time.Now().Add(time.Duration(params.WaitTimeSeconds) * time.Second)
+	for {
+		f.mux.Lock()
+		f.lastReceive = params
+		if f.failReceives > 0 {
+			f.failReceives--
+			f.mux.Unlock()
+			return nil, errors.New("service unavailable")
+		}
+		url := aws.ToString(params.QueueUrl)
+		if _, ok := f.queues[url]; !ok {
+			f.mux.Unlock()
+			return nil, &types.QueueDoesNotExist{}
+		}
+		// The messages not deleted in time are received again
+		for receipt, r := range f.received {
+			if r.url == url && time.Now().After(r.until) {
+				f.queues[url] = append([]types.Message{r.message}, f.queues[url]...)
+				delete(f.received, receipt)
+			}
+		}
+		for len(f.queues[url]) > 0 {
+			m := f.queues[url][0]
+			f.queues[url] = f.queues[url][1:]
+			id := aws.ToString(m.MessageId)
+			// The message received too many times goes to the dead queue of the redrive policy
+			if r, ok := f.redrive[url]; ok && f.receives[id] >= r.max {
+				f.queues[r.target] = append(f.queues[r.target], m)
+				continue
+			}
+			f.receives[id]++
+			m.Attributes = map[string]string{"ApproximateReceiveCount": strconv.Itoa(f.receives[id])}
+			visibility := params.VisibilityTimeout
+			if visibility == 0 {
+				visibility = 30
+			}
+			f.received[aws.ToString(m.ReceiptHandle)] = &fakeReceived{url: url, message: m,
+				until: time.Now().Add(time.Duration(visibility) * time.Second)}
+			f.mux.Unlock()
+			return &sqs.ReceiveMessageOutput{Messages: []types.Message{m}}, nil
+		}
+		f.mux.Unlock()
+		if time.Now().After(deadline) {
+			return &sqs.ReceiveMessageOutput{}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (f *fakeSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.received, aws.ToString(params.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	r, ok := f.received[aws.ToString(params.ReceiptHandle)]
+	if !ok {
+		return nil, &types.ReceiptHandleIsInvalid{}
+	}
+	r.until = time.Now().Add(time.Duration(params.VisibilityTimeout) * time.Second)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (f *fakeSQS) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	url := aws.ToString(params.QueueUrl)
+	if _, ok := f.queues[url]; !ok {
+		return nil, &types.QueueDoesNotExist{}
+	}
+	hidden := 0
+	for _, r := range f.received {
+		if r.url == url {
+			hidden++
+		}
+	}
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]string{"ApproximateNumberOfMessages": strconv.Itoa(len(f.queues[url])),
+		"ApproximateNumberOfMessagesNotVisible": strconv.Itoa(hidden), "QueueArn": fakeSQSARN + strings.TrimPrefix(url, fakeSQSURL)}}, nil
+}
+
+func (f *fakeSQS) SetQueueAttributes(ctx context.Context, params *sqs.SetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.SetQueueAttributesOutput, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	url := aws.ToString(params.QueueUrl)
+	if _, ok := f.queues[url]; !ok {
+		return nil, &types.QueueDoesNotExist{}
+	}
+	var policy struct {
+		DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+		MaxReceiveCount     string `json:"maxReceiveCount"`
+	}
+	if err := json.Unmarshal([]byte(params.Attributes["RedrivePolicy"]), &policy); err != nil {
+		return nil, err
+	}
+	max, err := strconv.Atoi(policy.MaxReceiveCount)
+	if err != nil {
+		return nil, err
+	}
+	f.redrive[url] = fakeRedrive{target: fakeSQSURL + strings.TrimPrefix(policy.DeadLetterTargetArn, fakeSQSARN), max: max}
+	return &sqs.SetQueueAttributesOutput{}, nil
+}
+
+// useSQS configures a bot and a worker with quick retries, call the returned function to restore
+func useSQS() func() {
+	saved, web, worker, host, retries := conf.Options.Queue, conf.Options.Web, conf.Options.Worker, util.Hostname, conf.Options.Retries
+	savedRetry, savedWait := sqsRetry, sqsRecreateWait
+	conf.Options.Web, conf.Options.Worker, util.Hostname, conf.Options.Retries.MaxAttempts = true, true, "bot-1.example.com", 3
+	conf.Options.Queue.SQS.Prefix, conf.Options.Queue.SQS.WaitSeconds, conf.Options.Queue.SQS.VisibilityTimeout = "test", 1, 300
+	sqsRetry, sqsRecreateWait = time.Millisecond, time.Millisecond
+	return func() {
+		conf.Options.Queue, conf.Options.Web, conf.Options.Worker, util.Hostname, conf.Options.Retries = saved, web, worker, host, retries
+		sqsRetry, sqsRecreateWait = savedRetry, savedWait
+	}
+}
+
+func newTestSQS(t *testing.T, client sqsClient) *sqsQueue {
+	q, err := newSQSQueue(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestSQSQueue_Work(t *testing.T) {
+	defer useSQS()()
+	f := newFakeSQS()
+	q := newTestSQS(t, f)
+	defer q.Close()
+	if q.workURL != fakeSQSURL+"test-work" || q.hostURL != fakeSQSURL+"test-host-bot-1-example-com" {
+		t.Fatalf("unexpected queues %s and %s", q.workURL, q.hostURL)
+	}
+	ctx := &domain.Context{Team: "T1", Channel: "C1", TS: "1.1"}
+	work := &domain.WorkRequest{Type: "message", MessageID: "1.1", IPs: []string{"8.8.8.8"}, ReplyQueue: util.Hostname, Context: ctx}
+	if err := q.PushWork(work); err != nil {
+		t.Fatal(err)
+	}
+	// A failing SQS is polled again
+	f.failReceives = 2
+	got, err := q.PopWork(context.Background())
+	if err != nil || got.MessageID != "1.1" || got.ReplyQueue != util.Hostname || len(f.received) != 1 {
+		t.Fatalf("unexpected work %+v - %v", got, err)
+	}
+	// The work is deleted once it is acknowledged
+	if err = q.Ack(got); err != nil || len(f.received) != 0 {
+		t.Fatalf("expected the work to be deleted but got %v", err)
+	}
+	if f.lastReceive.VisibilityTimeout != 300 || f.lastReceive.WaitTimeSeconds != 1 {
+		t.Errorf("unexpected receive %+v", f.lastReceive)
+	}
+	if err = q.PushWorkReply(got.ReplyQueue, &domain.WorkReply{MessageID: got.MessageID, Context: got.Context}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := q.PopWorkReply(context.Background(), util.Hostname)
+	if err != nil || reply.MessageID != "1.1" {
+		t.Fatalf("unexpected reply %+v - %v", reply, err)
+	}
+	if c, err := domain.GetContext(reply.Context); err != nil || c.TS != "1.1" {
+		t.Errorf("unexpected context %+v - %v", reply.Context, err)
+	}
+	// The pops block until the timeout
+	timeout, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = q.PopWork(timeout); err != context.DeadlineExceeded {
+		t.Errorf("expected a timeout but got %v", err)
+	}
+	if err = q.PushWork(&domain.WorkRequest{Type: "message"}); err == nil {
+		t.Error("expected an error for work without a context")
+	}
+	if err = q.PushWorkReply("gone.example.com", &domain.WorkReply{Context: ctx}); err == nil {
+		t.Error("expected an error for a host without a queue")
+	}
+}
+
+func TestSQSQueue_WebReply(t *testing.T) {
+	defer useSQS()()
+	q := newTestSQS(t, newFakeSQS())
+	defer q.Close()
+	if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "file-message", ReplyQueue: "web-1", Context: &domain.Context{}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.PopWork(context.Background())
+	if err != nil || got.ReplyQueue != "bot-1.example.com/web-1" {
+		t.Fatalf("expected the reply queue to name the host but got %+v - %v", got, err)
+	}
+	// The worker might reply before the web waits for it
+	if err = q.PushWorkReply(got.ReplyQueue, &domain.WorkReply{MessageID: got.MessageID, Context: got.Context}); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := q.PopWorkReply(timeout, "web-1")
+	if err != nil || reply.MessageID != "file-message" {
+		t.Fatalf("unexpected web reply %+v - %v", reply, err)
+	}
+	if n := q.web.count(); n != 0 {
+		t.Errorf("expected the web waiter to be forgotten but got %d", n)
+	}
+}
+
+func TestSQSName(t *testing.T) {
+	long := strings.Repeat("bot", 30)
+	first, second := sqsName("alfred-host-"+long+".a.example.com"), sqsName("alfred-host-"+long+".b.example.com")
+	if first == second {
+		t.Errorf("expected long hosts to get their own queues but both got %s", first)
+	}
+	for _, name := range []string{first, second} {
+		if len(name) != sqsMaxName || !strings.HasPrefix(name, "alfred-host-bot") {
+			t.Errorf("unexpected name %s", name)
+		}
+	}
+	if name := sqsName("alfred-host-bot-1.example.com"); name != "alfred-host-bot-1-example-com" {
+		t.Errorf("unexpected name %s", name)
+	}
+}
+
+func TestSQSQueue_Hosts(t *testing.T) {
+	defer useSQS()()
+	f := newFakeSQS()
+	first := newTestSQS(t, f)
+	util.Hostname = "bot-2"
+	second := newTestSQS(t, f)
+	// Worker only hosts do not get a queue
+	conf.Options.Web = false
+	worker := newTestSQS(t, f)
+	if worker.hostURL != "" {
+		t.Errorf("expected no queue for the worker but got %s", worker.hostURL)
+	}
+	// Every bot gets the configuration changes
+	if err := worker.PushConf("T1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*sqsQueue{first, second} {
+		timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+		team, err := q.PopConf(timeout)
+		cancel()
+		if err != nil || team != "T1" {
+			t.Errorf("expected the configuration change but got %s - %v", team, err)
+		}
+	}
+	// The reply goes to the host that pushed the work
+	if err := worker.PushWorkReply("bot-1.example.com", &domain.WorkReply{MessageID: "1.1", Context: &domain.Context{}}); err != nil {
+		t.Fatal(err)
+	}
+	util.Hostname = "bot-1.example.com"
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if reply, err := first.PopWorkReply(timeout, util.Hostname); err != nil || reply.MessageID != "1.1" {
+		t.Errorf("unexpected reply %+v - %v", reply, err)
+	}
+	// The queues of the hosts are deleted on close and can be created again
+	first.Close()
+	second.Close()
+	worker.Close()
+	if len(f.deletedQueues) != 2 {
+		t.Errorf("expected the queues of the hosts to be deleted but got %v", f.deletedQueues)
+	}
+	conf.Options.Web = true
+	newTestSQS(t, f).Close()
+}
+
+func TestSQSQueue_HostComesBack(t *testing.T) {
+	defer useSQS()()
+	f := newFakeSQS()
+	q := newTestSQS(t, f)
+	defer q.Close()
+	conf.Options.Web = false
+	worker := newTestSQS(t, f)
+	defer worker.Close()
+	// The heartbeat of the host lapsed so the worker took it for gone
+	if _, err := worker.RemoveReplyQueue(util.Hostname, ""); err != nil {
+		t.Fatal(err)
+	}
+	// The host receives from its queue again and finds it gone
+	reply := &domain.WorkReply{MessageID: "1.1", Context: &domain.Context{}}
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = worker.PushWorkReply(util.Hostname, reply); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the queue of the host to be created again but got %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if got, err := q.PopWorkReply(timeout, util.Hostname); err != nil || got.MessageID != "1.1" {
+		t.Fatalf("expected the reply in the restored queue but got %+v - %v", got, err)
+	}
+	// Restoring a queue that is there changes nothing
+	if err = q.RestoreReplyQueue(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQSQueue_Ack(t *testing.T) {
+	defer useSQS()()
+	conf.Options.Queue.SQS.VisibilityTimeout = 1
+	f := newFakeSQS()
+	q := newTestSQS(t, f)
+	for _, id := range []string{"1.1", "1.2"} {
+		if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: id, ReplyQueue: util.Hostname, Context: &domain.Context{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A returned request goes to the next worker right away
+	first, err := q.PopWork(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Nack(first, 0); err != nil {
+		t.Fatal(err)
+	}
+	again, err := q.PopWork(context.Background())
+	if err != nil || again.MessageID != first.MessageID || again.Attempts != 1 {
+		t.Fatalf("expected the returned request again but got %+v - %v", again, err)
+	}
+	second, err := q.PopWork(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Ack(second)
+	// The worker crashes before it acknowledges the request so another worker gets it
+	q.Close()
+	worker := newTestSQS(t, f)
+	defer worker.Close()
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	got, err := worker.PopWork(timeout)
+	if err != nil || got.MessageID != first.MessageID {
+		t.Fatalf("expected the request of the crashed worker but got %+v - %v", got, err)
+	}
+	if err = worker.Ack(got); err != nil {
+		t.Fatal(err)
+	}
+	timeout, cancel = context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if got, err = worker.PopWork(timeout); err != context.DeadlineExceeded {
+		t.Errorf("expected the acknowledged requests to be gone but got %+v - %v", got, err)
+	}
+	if err = worker.Ack(&domain.WorkRequest{}); err != ErrNotReserved {
+		t.Errorf("expected a request that was not popped to fail but got %v", err)
+	}
+}
+
+func TestSQSQueue_Retries(t *testing.T) {
+	defer useSQS()()
+	conf.Options.Retries.MaxAttempts = 1
+	q := newTestSQS(t, newFakeSQS())
+	defer q.Close()
+	if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: "1.1", ReplyQueue: util.Hostname, Context: &domain.Context{}}); err != nil {
+		t.Fatal(err)
+	}
+	pop := func(wait time.Duration) (*domain.WorkRequest, error) {
+		timeout, cancel := context.WithTimeout(context.Background(), wait)
+		defer cancel()
+		return q.PopWork(timeout)
+	}
+	work, err := pop(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The worker returns it for the backoff of its retry
+	if err = q.Nack(work, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if work, err = pop(200 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to wait for its retry but got %+v - %v", work, err)
+	}
+	if work, err = pop(3 * time.Second); err != nil || work.Attempts != 1 {
+		t.Fatalf("expected the retry but got %+v - %v", work, err)
+	}
+	// SQS moves it to the dead queue once it was received more than the retries allow
+	if err = q.Nack(work, 0); err != nil {
+		t.Fatal(err)
+	}
+	if work, err = pop(200 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("expected the request to be dead but got %+v - %v", work, err)
+	}
+	if lanes, err := q.Lanes(); err != nil || lanes[0].Depth != 0 || lanes[3].Lane != LaneDead || lanes[3].Depth != 1 {
+		t.Errorf("expected the request in the dead queue but got %+v - %v", lanes, err)
+	}
+}
+
+func TestSQSQueue_RemoveReplyQueue(t *testing.T) {
+	defer useSQS()()
+	f := newFakeSQS()
+	q := newTestSQS(t, f)
+	defer q.Close()
+	// The old instance of the bot was replaced with replies and a configuration change still in its queue
+	if _, err := f.CreateQueue(context.Background(), &sqs.CreateQueueInput{QueueName: aws.String(q.hostQueue("bot-old"))}); err != nil {
+		t.Fatal(err)
+	}
+	for _, replyQueue := range []string{"bot-old", "bot-old/waiter"} {
+		if err := q.PushWorkReply(replyQueue, &domain.WorkReply{MessageID: "1.1", Context: &domain.Context{Team: "T1"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.PushConf("T1"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := q.RemoveReplyQueue("bot-old", util.Hostname)
+	if err != nil || moved != 1 {
+		t.Fatalf("expected a single reply to be rerouted but got %d - %v", moved, err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if reply, err := q.PopWorkReply(timeout, util.Hostname); err != nil || reply.MessageID != "1.1" {
+		t.Errorf("expected the rerouted reply but got %+v - %v", reply, err)
+	}
+	if _, ok := f.queues[fakeSQSURL+q.hostQueue("bot-old")]; ok {
+		t.Error("expected the queue of the old bot to be deleted")
+	}
+	// A host without a queue has nothing to remove
+	if moved, err = q.RemoveReplyQueue("bot-never", util.Hostname); err != nil || moved != 0 {
+		t.Errorf("expected nothing to remove but got %d - %v", moved, err)
+	}
+}
+
+func TestSQSQueue_Lanes(t *testing.T) {
+	defer useSQS()()
+	f := newFakeSQS()
+	q := newTestSQS(t, f)
+	defer q.Close()
+	ctx := &domain.Context{Team: "T1"}
+	for _, id := range []string{"1.1", "1.2", "1.3"} {
+		if err := q.PushWork(&domain.WorkRequest{Type: "message", MessageID: id, ReplyQueue: util.Hostname, Context: ctx}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.PopWork(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	q.PushWorkReply(util.Hostname, &domain.WorkReply{MessageID: "1.1", Context: ctx})
+	// The reply is received into the buffer of the host
+	for i := 0; i < 100 && len(q.workReply) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lanes, err := q.Lanes()
+	if err != nil || len(lanes) != 4 {
+		t.Fatalf("unexpected lanes %+v - %v", lanes, err)
+	}
+	if work := lanes[0]; work.Lane != LaneWork || work.Depth != 2 || work.InFlight != 1 {
+		t.Errorf("unexpected work lane %+v", work)
+	}
+	if reply := lanes[1]; reply.Lane != LaneReply || reply.Depth != 1 {
+		t.Errorf("unexpected reply lane %+v", reply)
+	}
+	if conf := lanes[2]; conf.Lane != LaneConf || conf.Depth != 0 {
+		t.Errorf("unexpected conf lane %+v", conf)
+	}
+	if dead := lanes[3]; dead.Lane != LaneDead || dead.Depth != 0 {
+		t.Errorf("unexpected dead lane %+v", dead)
+	}
+}
+
+func TestSQSQueue_Large(t *testing.T) {
+	defer useSQS()()
+	q := newTestSQS(t, newFakeSQS())
+	defer q.Close()
+	// A report that compresses well fits
+	details := strings.Repeat(`{"scan": "clean", "engine": "av"}, `, 20000)
+	reply := &domain.WorkReply{MessageID: "1.1", Context: &domain.Context{}, Hashes: []domain.HashReply{{Details: details}}}
+	if err := q.PushWorkReply(util.Hostname, reply); err != nil {
+		t.Fatal(err)
+	}
+	got, err := q.PopWorkReply(context.Background(), util.Hostname)
+	if err != nil || len(got.Hashes) != 1 || got.Hashes[0].Details != details {
+		t.Fatalf("expected the reply to be compressed and back but got %v", err)
+	}
+	random := make([]byte, 300*1024)
+	rand.Read(random)
+	reply.Hashes[0].Details = base64.StdEncoding.EncodeToString(random)
+	if err = q.PushWorkReply(util.Hostname, reply); err != ErrTooLarge {
+		t.Errorf("expected the reply to be too large but got %v", err)
+	}
+}
+
+func TestSQSQueue_Close(t *testing.T) {
+	defer useSQS()()
+	q := newTestSQS(t, newFakeSQS())
+	errs := make(chan error, 3)
+	go func() {
+		_, err := q.PopWork(context.Background())
+		errs <- err
+	}()
+	go func() {
+		_, err := q.PopConf(context.Background())
+		errs <- err
+	}()
+	go func() {
+		_, err := q.PopWorkReply(context.Background(), util.Hostname)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	q.Close()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != ErrClosed {
+			t.Errorf("expected the pop to see the queue closed but got %v", err)
+		}
+	}
+	if err := q.PushConf("T1"); err != ErrClosed {
+		t.Errorf("expected a closed queue but got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// webReplyTTL is how long a reply waits for its web waiter, the waiters give up well before. Replaced by the tests.
+var webReplyTTL = 5 * time.Minute
+
+// webWaiter is the channel of the reply of a web waiter
+type webWaiter struct {
+	ch      chan *domain.WorkReply
+	waiting bool      // The waiter is waiting on the channel, it forgets it once it got the reply or gave up
+	created time.Time // Channels nobody waits on are dropped webReplyTTL after it
+}
+
+// webWaiters are the channels of the web waiters of the backends that pass the replies in the process. A reply might
+// come before its waiter so it waits in the channel, and one that comes after its waiter gave up is dropped with its
+// channel after webReplyTTL. The backends send to the channels without blocking, each waiter gets a single reply.
+type webWaiters struct {
+	mux     sync.Mutex
+	waiters map[string]*webWaiter
+}
+
+func newWebWaiters() *webWaiters {
+	return &webWaiters{waiters: make(map[string]*webWaiter)}
+}
+
+// channel returns the channel of the waiter, waiting is true for the waiter itself and false for its reply
+func (w *webWaiters) channel(name string, waiting bool) chan *domain.WorkReply {
+	now := time.Now()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for n, waiter := range w.waiters {
+		if !waiter.waiting && now.Sub(waiter.created) > webReplyTTL {
+			delete(w.waiters, n)
+		}
+	}
+	waiter, ok := w.waiters[name]
+	if !ok {
+		waiter = &webWaiter{ch: make(chan *domain.WorkReply, 1), created: now}
+		w.waiters[name] = waiter
+	}
+	waiter.waiting = waiter.waiting || waiting
+	return waiter.ch
+}
+
+// leave forgets the channel of the waiter once it got its reply or gave up
+func (w *webWaiters) leave(name string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	delete(w.waiters, name)
+}
+
+// names of the waiters waiting for their reply, the backends that read the replies by name only look for these
+func (w *webWaiters) names() []string {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	var names []string
+	for name, waiter := range w.waiters {
+		if waiter.waiting {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// replies counts the replies in the channels
+func (w *webWaiters) replies() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	replies := 0
+	for _, waiter := range w.waiters {
+		replies += len(waiter.ch)
+	}
+	return replies
+}
+
+// count is the number of channels
+func (w *webWaiters) count() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return len(w.waiters)
+}
@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/util"
+)
+
+func TestWebWaiters(t *testing.T) {
+	saved := webReplyTTL
+	defer func() { webReplyTTL = saved }()
+	webReplyTTL = time.Hour
+	w := newWebWaiters()
+	// The reply came first, its waiter finds it
+	w.channel("web-1", false) <- &domain.WorkReply{MessageID: "1"}
+	w.channel("web-2", true)
+	if names := w.names(); len(names) != 1 || names[0] != "web-2" {
+		t.Errorf("expected only the waiter that waits to be named but got %v", names)
+	}
+	if reply := <-w.channel("web-1", true); reply.MessageID != "1" || w.replies() != 0 {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	w.leave("web-1")
+	w.leave("web-2")
+	// A reply to a waiter that left stays until the TTL and is dropped with its channel by the next waiter
+	w.channel("web-2", false) <- &domain.WorkReply{MessageID: "2"}
+	if w.count() != 1 || w.replies() != 1 || len(w.names()) != 0 {
+		t.Errorf("expected the late reply to wait - %d channels, %d replies, %v", w.count(), w.replies(), w.names())
+	}
+	webReplyTTL = 0
+	time.Sleep(time.Millisecond)
+	w.channel("web-3", true)
+	if w.count() != 1 || w.replies() != 0 {
+		t.Errorf("expected the late reply to be dropped - %d channels, %d replies", w.count(), w.replies())
+	}
+}
+
+func TestDBQueueLateReply(t *testing.T) {
+	dq := &dbQueue{workReply: make(chan *domain.WorkReply, 1), web: newWebWaiters(), stopped: make(chan struct{})}
+	message := func(name, id string) *domain.DBQueueMessage {
+		text, err := encodeText(&domain.WorkReply{MessageID: id, Context: &domain.Context{Team: "T1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &domain.DBQueueMessage{MessageType: "workr", Message: text, Name: name, Timestamp: time.Now()}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := dq.PopWorkReply(ctx, "web-1"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the waiter to give up but got %v", err)
+	}
+	if names := dq.web.names(); len(names) != 0 {
+		t.Errorf("expected the waiter that gave up not to be polled but got %v", names)
+	}
+	// The replies after the deadline neither block the poll nor make the name polled again
+	done := make(chan struct{})
+	go func() {
+		dq.reply(message("web-1", "1"))
+		dq.reply(message("web-1", "2"))
+		dq.reply(message(util.Hostname, "3"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the late replies blocked the poll")
+	}
+	if names := dq.web.names(); len(names) != 0 || dq.web.replies() != 1 {
+		t.Errorf("expected a single late reply waiting for the TTL - %v, %d", names, dq.web.replies())
+	}
+	if reply := <-dq.workReply; reply.MessageID != "3" {
+		t.Errorf("expected the reply of the bot but got %+v", reply)
+	}
+	close(dq.stopped)
+	if _, err := dq.PopWorkReply(context.Background(), "web-2"); err != ErrClosed {
+		t.Errorf("expected the closed queue to wake the waiter but got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"time"
+
+	"github.com/demisto/alfred/domain"
+)
+
+// Repo is the storage of the bot, the web and the workers - MySQL in production and the fake of repotest in the
+// tests. The queue table is not part of it, only the db queue uses it and it needs MySQL anyway.
+type Repo interface {
+	// Users and teams, the secrets of the teams in the clear
+	User(id string) (*domain.User, error)
+	UserByExternalID(id string) (*domain.User, error)
+	TeamMembers(team string) ([]domain.User, error)
+	SetTeamAndUser(team *domain.Team, user *domain.User) error
+	Team(id string) (*domain.Team, error)
+	TeamByExternalID(id string) (*domain.Team, error)
+	Teams() ([]domain.Team, error)
+	SetTeam(team *domain.Team) error
+	SetTeamStatus(team string, status domain.UserStatus) error
+	SetTeamLocale(team, locale string) error
+	SetTeamXSOAR(team *domain.Team) error
+	SetTeamCredentials(team, source string, creds domain.Credentials) error
+	SetConfigAdmins(team string, admins []string) error
+	OAuthState(id string) (*domain.OAuthState, error)
+	SetOAuthState(state *domain.OAuthState) error
+	JoinSlackChannel(email string) error
+
+	// The configuration of the teams and the settings of their integrations, nil if the team has none
+	ChannelsAndGroups(team string) (*domain.Configuration, error)
+	SetChannelsAndGroups(configuration *domain.Configuration) error
+	Webhook(team string) (*domain.Webhook, error)
+	SetWebhook(hook *domain.Webhook) error
+	DeleteWebhook(team string) error
+	Sandbox(team string) (*domain.Sandbox, error)
+	SetSandbox(s *domain.Sandbox) error
+	DeleteSandbox(team string) error
+	StartSandboxRun(key string, until time.Time) (*domain.SandboxRun, error)
+	FinishSandboxRun(key string, reply *domain.SandboxReply, until time.Time) error
+	EmailAlerts(team string) (*domain.EmailAlerts, error)
+	SetEmailAlerts(alerts *domain.EmailAlerts) error
+	DeleteEmailAlerts(team string) error
+
+	// The bot hosts and the jobs only one of them runs
+	BotHeartbeat() error
+	Bots(timeout time.Duration) ([]*domain.BotHeartbeat, error)
+	DeleteBot(bot string) error
+	AcquireLease(job, owner string, ttl time.Duration) (bool, error)
+	RenewLease(job, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(job, owner string) error
+	MarkGreeted(team, channel string) (bool, error)
+	MarkWelcomed(team, user string) (bool, error)
+
+	// Statistics and the reports made of them
+	UpdateStatistics(stats *domain.Statistics) error
+	TotalsSince(team, channel string, since time.Time) (*domain.ChannelStatistics, error)
+	TotalMessages() (int, error)
+	StoreMaliciousContent(convicted *domain.MaliciousContent) error
+	DigestForTeamSince(team string, since time.Time) (*domain.Digest, error)
+	LastDigest(team string) (time.Time, error)
+	SetLastDigest(team string, ts time.Time) error
+	WeeklyReportForTeam(team string, end time.Time) (*domain.WeeklyReport, error)
+	LastWeeklyReport(team string) (time.Time, error)
+	SetLastWeeklyReport(team string, ts time.Time) error
+
+	// The replies and the scans we keep, ErrNotFound for what expired
+	StoreReply(team string, reply *domain.WorkReply) (string, error)
+	StoredReply(team, id string) (*domain.WorkReply, error)
+	DeleteStoredReplies(before time.Time) error
+	StoreFalsePositive(fp *domain.FalsePositive) error
+	FalsePositives(team string, offset, limit int) ([]domain.FalsePositive, int, error)
+	StoreScans(records []domain.ScanRecord) error
+	ScanHistory(team string, filter domain.ScanFilter, offset, limit int) ([]domain.ScanRecord, int, error)
+	Sightings(team, normalized string, limit int) ([]domain.ScanRecord, int, error)
+	DeleteScansBefore(before time.Time) error
+
+	// The state the workers share
+	SetSourceBreaker(b *domain.SourceBreaker) error
+	DeleteSourceBreaker(breaker string) error
+	SourceBreakers(since time.Time) ([]domain.SourceBreaker, error)
+	AddDeadLetter(d *domain.DeadLetter) error
+	DeadLetters(team string, limit int) ([]domain.DeadLetter, error)
+	DeadLetter(team string, id int64) (*domain.DeadLetter, error)
+	DeleteDeadLetter(team string, id int64) error
+}
+
+var _ Repo = (*MySQL)(nil)
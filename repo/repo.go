@@ -4,8 +4,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,6 +35,10 @@ CREATE TABLE IF NOT EXISTS teams (
 	vt_key VARCHAR(512),
 	xfe_key VARCHAR(512),
 	xfe_pass VARCHAR(512),
+	locale VARCHAR(16) NOT NULL DEFAULT '',
+	xsoar_url VARCHAR(512) NOT NULL DEFAULT '',
+	xsoar_key VARCHAR(512) NOT NULL DEFAULT '',
+	xsoar_incident_type VARCHAR(128) NOT NULL DEFAULT '',
 	CONSTRAINT teams_pk PRIMARY KEY (id),
 	CONSTRAINT teams_external_id_uk UNIQUE (external_id)
 );
@@ -52,6 +59,7 @@ CREATE TABLE IF NOT EXISTS users (
 	external_id VARCHAR(64) NOT NULL,
 	token VARCHAR(512) NOT NULL,
 	created timestamp NOT NULL,
+	is_system_admin int(1) NOT NULL DEFAULT 0,
 	CONSTRAINT users_pk PRIMARY KEY (id),
 	CONSTRAINT users_team_fk FOREIGN KEY (team) REFERENCES teams (id),
 	CONSTRAINT users_external_id_uk UNIQUE (external_id)
@@ -63,7 +71,7 @@ CREATE TABLE IF NOT EXISTS oauth_state (
 );
 CREATE TABLE IF NOT EXISTS configurations (
 	team VARCHAR(64) NOT NULL,
-	channel VARCHAR(64) NOT NULL,
+	channel VARCHAR(255) NOT NULL,
 	CONSTRAINT configurations_pk PRIMARY KEY (team, channel),
 	CONSTRAINT configurations_team_fk FOREIGN KEY (team) REFERENCES teams (id)
 );
@@ -97,9 +105,70 @@ CREATE TABLE IF NOT EXISTS team_statistics (
 	ips_clean BIGINT NOT NULL,
 	ips_dirty BIGINT NOT NULL,
 	ips_unknown BIGINT NOT NULL,
+	ips_skipped BIGINT NOT NULL DEFAULT 0,
+	whitelisted BIGINT NOT NULL DEFAULT 0,
+	cache_hits BIGINT NOT NULL DEFAULT 0,
+	truncated BIGINT NOT NULL DEFAULT 0,
+	muted BIGINT NOT NULL DEFAULT 0,
+	dropped BIGINT NOT NULL DEFAULT 0,
+	rate_limited BIGINT NOT NULL DEFAULT 0,
+	expired BIGINT NOT NULL DEFAULT 0,
 	CONSTRAINT team_statistics_pk PRIMARY KEY (team),
 	CONSTRAINT team_statistics_team_fk FOREIGN KEY (team) REFERENCES teams (id)
 );
+CREATE TABLE IF NOT EXISTS team_statistics_daily (
+	team VARCHAR(64) NOT NULL,
+	day DATE NOT NULL,
+	messages BIGINT NOT NULL DEFAULT 0,
+	files_clean BIGINT NOT NULL DEFAULT 0,
+	files_dirty BIGINT NOT NULL DEFAULT 0,
+	files_unknown BIGINT NOT NULL DEFAULT 0,
+	urls_clean BIGINT NOT NULL DEFAULT 0,
+	urls_dirty BIGINT NOT NULL DEFAULT 0,
+	urls_unknown BIGINT NOT NULL DEFAULT 0,
+	hashes_clean BIGINT NOT NULL DEFAULT 0,
+	hashes_dirty BIGINT NOT NULL DEFAULT 0,
+	hashes_unknown BIGINT NOT NULL DEFAULT 0,
+	ips_clean BIGINT NOT NULL DEFAULT 0,
+	ips_dirty BIGINT NOT NULL DEFAULT 0,
+	ips_unknown BIGINT NOT NULL DEFAULT 0,
+	ips_skipped BIGINT NOT NULL DEFAULT 0,
+	whitelisted BIGINT NOT NULL DEFAULT 0,
+	cache_hits BIGINT NOT NULL DEFAULT 0,
+	truncated BIGINT NOT NULL DEFAULT 0,
+	muted BIGINT NOT NULL DEFAULT 0,
+	dropped BIGINT NOT NULL DEFAULT 0,
+	rate_limited BIGINT NOT NULL DEFAULT 0,
+	expired BIGINT NOT NULL DEFAULT 0,
+	CONSTRAINT team_statistics_daily_pk PRIMARY KEY (team, day),
+	CONSTRAINT team_statistics_daily_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS channel_statistics_daily (
+	team VARCHAR(64) NOT NULL,
+	channel VARCHAR(64) NOT NULL,
+	day DATE NOT NULL,
+	messages BIGINT NOT NULL DEFAULT 0,
+	urls BIGINT NOT NULL DEFAULT 0,
+	ips BIGINT NOT NULL DEFAULT 0,
+	hashes BIGINT NOT NULL DEFAULT 0,
+	files BIGINT NOT NULL DEFAULT 0,
+	malicious BIGINT NOT NULL DEFAULT 0,
+	CONSTRAINT channel_statistics_daily_pk PRIMARY KEY (team, day, channel),
+	CONSTRAINT channel_statistics_daily_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS config_admins (
+	team VARCHAR(64) NOT NULL,
+	user VARCHAR(64) NOT NULL,
+	CONSTRAINT config_admins_pk PRIMARY KEY (team, user),
+	CONSTRAINT config_admins_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS team_keys (
+	team VARCHAR(64) NOT NULL,
+	source VARCHAR(32) NOT NULL,
+	api_key VARCHAR(512) NOT NULL,
+	CONSTRAINT team_keys_pk PRIMARY KEY (team, source),
+	CONSTRAINT team_keys_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
 CREATE TABLE IF NOT EXISTS slack_invites (
 	email VARCHAR(128) NOT NULL,
 	ts TIMESTAMP NOT NULL,
@@ -121,16 +190,191 @@ CREATE TABLE IF NOT EXISTS convicted (
 	CONSTRAINT convicted_pk PRIMARY KEY (team, channel, message_id),
 	CONSTRAINT convicted_team_fk FOREIGN KEY (team) REFERENCES teams (id)
 );
+CREATE TABLE IF NOT EXISTS false_positives (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	team VARCHAR(64) NOT NULL,
+	user VARCHAR(64) NOT NULL,
+	indicator VARCHAR(255) NOT NULL,
+	comment VARCHAR(512) NOT NULL,
+	whitelisted INT(1) NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT false_positives_pk PRIMARY KEY (id),
+	CONSTRAINT false_positives_team_fk FOREIGN KEY (team) REFERENCES teams (id),
+	INDEX false_positives_team_ts (team, ts)
+);
+CREATE TABLE IF NOT EXISTS scan_history (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	team VARCHAR(64) NOT NULL,
+	channel VARCHAR(64) NOT NULL,
+	user VARCHAR(64) NOT NULL,
+	indicator VARCHAR(255) NOT NULL,
+	normalized VARCHAR(255) NOT NULL DEFAULT '',
+	indicator_type INT NOT NULL,
+	scores VARCHAR(1024) NOT NULL,
+	verdict INT NOT NULL,
+	permalink VARCHAR(512) NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT scan_history_pk PRIMARY KEY (id),
+	CONSTRAINT scan_history_team_fk FOREIGN KEY (team) REFERENCES teams (id),
+	INDEX scan_history_team_ts (team, ts),
+	INDEX scan_history_indicator (indicator),
+	INDEX scan_history_normalized (team, normalized)
+);
+CREATE TABLE IF NOT EXISTS digests (
+	team VARCHAR(64) NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT digests_pk PRIMARY KEY (team),
+	CONSTRAINT digests_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS weekly_reports (
+	team VARCHAR(64) NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT weekly_reports_pk PRIMARY KEY (team),
+	CONSTRAINT weekly_reports_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS greeted_channels (
+	team VARCHAR(64) NOT NULL,
+	channel VARCHAR(64) NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT greeted_channels_pk PRIMARY KEY (team, channel),
+	CONSTRAINT greeted_channels_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS welcomed_users (
+	team VARCHAR(64) NOT NULL,
+	user VARCHAR(64) NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT welcomed_users_pk PRIMARY KEY (team, user),
+	CONSTRAINT welcomed_users_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS stored_replies (
+	id VARCHAR(16) NOT NULL,
+	team VARCHAR(64) NOT NULL,
+	reply LONGTEXT NOT NULL,
+	ts TIMESTAMP NOT NULL,
+	CONSTRAINT stored_replies_pk PRIMARY KEY (id),
+	CONSTRAINT stored_replies_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
 CREATE TABLE IF NOT EXISTS queue (
 	id BIGINT NOT NULL AUTO_INCREMENT,
 	name VARCHAR(64) NOT NULL,
 	message_type VARCHAR(10) NOT NULL,
 	message LONGTEXT NOT NULL,
 	ts TIMESTAMP NOT NULL,
+	reserved_by VARCHAR(255) NOT NULL DEFAULT '',
+	reserved_until TIMESTAMP(6) NULL,
+	attempts INT NOT NULL DEFAULT 0,
 	CONSTRAINT queue_pk PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS leases (
+	job VARCHAR(64) NOT NULL,
+	owner VARCHAR(255) NOT NULL,
+	expires TIMESTAMP(6) NOT NULL,
+	CONSTRAINT leases_pk PRIMARY KEY (job)
+);
+CREATE TABLE IF NOT EXISTS webhooks (
+	team VARCHAR(64) NOT NULL,
+	url VARCHAR(512) NOT NULL,
+	secret VARCHAR(512) NOT NULL,
+	threshold VARCHAR(16) NOT NULL,
+	CONSTRAINT webhooks_pk PRIMARY KEY (team),
+	CONSTRAINT webhooks_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS sandboxes (
+	team VARCHAR(64) NOT NULL,
+	url VARCHAR(512) NOT NULL,
+	api_key VARCHAR(512) NOT NULL,
+	max_size INT NOT NULL,
+	enabled BOOLEAN NOT NULL,
+	CONSTRAINT sandboxes_pk PRIMARY KEY (team),
+	CONSTRAINT sandboxes_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS sandbox_runs (
+	run_key CHAR(64) NOT NULL,
+	worker VARCHAR(255) NOT NULL,
+	expires TIMESTAMP NOT NULL,
+	reply TEXT NOT NULL,
+	CONSTRAINT sandbox_runs_pk PRIMARY KEY (run_key),
+	INDEX sandbox_runs_expires (expires)
+);
+CREATE TABLE IF NOT EXISTS email_alerts (
+	team VARCHAR(64) NOT NULL,
+	recipients VARCHAR(1024) NOT NULL,
+	threshold VARCHAR(16) NOT NULL,
+	CONSTRAINT email_alerts_pk PRIMARY KEY (team),
+	CONSTRAINT email_alerts_team_fk FOREIGN KEY (team) REFERENCES teams (id)
+);
+CREATE TABLE IF NOT EXISTS source_breakers (
+	worker VARCHAR(255) NOT NULL,
+	breaker VARCHAR(64) NOT NULL,
+	source VARCHAR(32) NOT NULL,
+	state VARCHAR(16) NOT NULL,
+	failures INT NOT NULL,
+	error VARCHAR(512) NOT NULL,
+	open_until TIMESTAMP NOT NULL,
+	CONSTRAINT source_breakers_pk PRIMARY KEY (worker, breaker)
+);
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id BIGINT NOT NULL AUTO_INCREMENT,
+	team VARCHAR(64) NOT NULL,
+	message_id VARCHAR(64) NOT NULL,
+	type VARCHAR(32) NOT NULL,
+	request LONGTEXT NOT NULL,
+	error VARCHAR(1024) NOT NULL,
+	attempts INT NOT NULL,
+	failed TIMESTAMP NOT NULL,
+	CONSTRAINT dead_letters_pk PRIMARY KEY (id),
+	INDEX dead_letters_team_failed (team, failed)
 )
 `
 
+// migrations alter tables that were created by an older version of the schema.
+// Columns and indexes that already exist are skipped.
+var migrations = []string{
+	"ALTER TABLE team_statistics ADD COLUMN ips_skipped BIGINT NOT NULL DEFAULT 0",
+	// Custom patterns and webhooks are stored in the configuration and need more room than channel IDs
+	"ALTER TABLE configurations MODIFY channel VARCHAR(255) NOT NULL",
+	"ALTER TABLE team_statistics ADD COLUMN whitelisted BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics ADD COLUMN cache_hits BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics ADD COLUMN truncated BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics ADD COLUMN muted BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics_daily ADD COLUMN muted BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE teams ADD COLUMN locale VARCHAR(16) NOT NULL DEFAULT ''",
+	"ALTER TABLE team_statistics ADD COLUMN dropped BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics_daily ADD COLUMN dropped BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics ADD COLUMN rate_limited BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics_daily ADD COLUMN rate_limited BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics ADD COLUMN expired BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE team_statistics_daily ADD COLUMN expired BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE channel_statistics_daily ADD COLUMN urls BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE channel_statistics_daily ADD COLUMN ips BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE channel_statistics_daily ADD COLUMN hashes BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE channel_statistics_daily ADD COLUMN files BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE channel_statistics_daily ADD COLUMN malicious BIGINT NOT NULL DEFAULT 0",
+	"ALTER TABLE scan_history ADD COLUMN normalized VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE scan_history ADD INDEX scan_history_normalized (team, normalized)",
+	"ALTER TABLE teams ADD COLUMN xsoar_url VARCHAR(512) NOT NULL DEFAULT ''",
+	"ALTER TABLE teams ADD COLUMN xsoar_key VARCHAR(512) NOT NULL DEFAULT ''",
+	"ALTER TABLE teams ADD COLUMN xsoar_incident_type VARCHAR(128) NOT NULL DEFAULT ''",
+	"ALTER TABLE queue ADD COLUMN reserved_by VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE queue ADD COLUMN reserved_until TIMESTAMP(6) NULL",
+	"ALTER TABLE queue ADD COLUMN attempts INT NOT NULL DEFAULT 0",
+	"ALTER TABLE users ADD COLUMN is_system_admin int(1) NOT NULL DEFAULT 0",
+}
+
+// seedWelcomed marks the users we already know as welcomed while nobody is, so the upgrade that added the table does
+// not introduce us again to everyone who installed us or whose messages we scanned
+func seedWelcomed(db *sqlx.DB) error {
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM welcomed_users"); err != nil || count > 0 {
+		return err
+	}
+	if _, err := db.Exec("INSERT IGNORE INTO welcomed_users (team, user, ts) SELECT team, external_id, now() FROM users"); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT IGNORE INTO welcomed_users (team, user, ts) SELECT DISTINCT team, user, now() FROM scan_history WHERE user <> ''")
+	return err
+}
+
 var (
 	// ErrNotFound is a not found error if Get does not retrieve a value
 	ErrNotFound = errors.New("not_found")
@@ -195,6 +439,17 @@ func NewMySQL() (*MySQL, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, migration := range migrations {
+		if _, err = db.Exec(migration); err != nil {
+			// Duplicate column or index means the migration was already applied
+			if mysqlErr, ok := err.(*mysql.MySQLError); !ok || (mysqlErr.Number != 1060 && mysqlErr.Number != 1061) {
+				return nil, err
+			}
+		}
+	}
+	if err = seedWelcomed(db); err != nil {
+		return nil, err
+	}
 	r := &MySQL{
 		db:   db,
 		stop: make(chan bool, 1),
@@ -253,7 +508,11 @@ func clearTeamFields(t *domain.Team) error {
 	if err != nil {
 		return err
 	}
-	t.BotToken, t.VTKey, t.XFEKey, t.XFEPass = clearToken, clearVTKey, clearXFEKey, clearXFEPass
+	clearXSOARKey, err := t.ClearXSOARKey()
+	if err != nil {
+		return err
+	}
+	t.BotToken, t.VTKey, t.XFEKey, t.XFEPass, t.XSOARKey = clearToken, clearVTKey, clearXFEKey, clearXFEPass, clearXSOARKey
 	return nil
 }
 
@@ -301,6 +560,12 @@ func (r *MySQL) Team(id string) (*domain.Team, error) {
 	if err = clearTeamFields(team); err != nil {
 		return nil, err
 	}
+	if team.ConfigAdmins, err = r.ConfigAdmins(team.ID); err != nil {
+		return nil, err
+	}
+	if team.SourceKeys, err = r.sourceKeys(team.ID); err != nil {
+		return nil, err
+	}
 	return team, nil
 }
 
@@ -313,9 +578,108 @@ func (r *MySQL) TeamByExternalID(id string) (*domain.Team, error) {
 	if err = clearTeamFields(team); err != nil {
 		return nil, err
 	}
+	if team.ConfigAdmins, err = r.ConfigAdmins(team.ID); err != nil {
+		return nil, err
+	}
+	if team.SourceKeys, err = r.sourceKeys(team.ID); err != nil {
+		return nil, err
+	}
 	return team, nil
 }
 
+// SetTeamStatus changes only the status of the team, e.g. when it uninstalls us. The configuration is kept for a re-install.
+func (r *MySQL) SetTeamStatus(team string, status domain.UserStatus) error {
+	_, err := r.db.Exec("UPDATE teams SET status = ? WHERE id = ?", status, team)
+	return err
+}
+
+// SetTeamLocale changes only the language of the team so installs and token updates keep it
+func (r *MySQL) SetTeamLocale(team, locale string) error {
+	_, err := r.db.Exec("UPDATE teams SET locale = ? WHERE id = ?", locale, team)
+	return err
+}
+
+// SetTeamXSOAR changes only the XSOAR server of the team encrypting the API key, empty values stop the incidents
+func (r *MySQL) SetTeamXSOAR(team *domain.Team) error {
+	secureKey, err := team.SecureXSOARKey()
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("UPDATE teams SET xsoar_url = ?, xsoar_key = ?, xsoar_incident_type = ? WHERE id = ?",
+		team.XSOARURL, secureKey, team.XSOARIncidentType, team.ID)
+	return err
+}
+
+// SetTeamCredentials changes only the credentials of the team for the source encrypting them. Empty credentials
+// return VirusTotal and IBM X-Force Exchange to our keys and skip the KeyedSources.
+func (r *MySQL) SetTeamCredentials(team, source string, creds domain.Credentials) error {
+	key, err := secureValue(creds.Key)
+	if err != nil {
+		return err
+	}
+	switch {
+	case source == domain.SourceVT:
+		_, err = r.db.Exec("UPDATE teams SET vt_key = ? WHERE id = ?", key, team)
+	case source == domain.SourceXFE:
+		var pass string
+		if pass, err = secureValue(creds.Password); err != nil {
+			return err
+		}
+		_, err = r.db.Exec("UPDATE teams SET xfe_key = ?, xfe_pass = ? WHERE id = ?", key, pass, team)
+	case !util.In(domain.KeyedSources, source):
+		return fmt.Errorf("teams cannot set a key for %s", source)
+	case key == "":
+		_, err = r.db.Exec("DELETE FROM team_keys WHERE team = ? AND source = ?", team, source)
+	default:
+		_, err = r.db.Exec("INSERT INTO team_keys (team, source, api_key) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE api_key = VALUES(api_key)",
+			team, source, key)
+	}
+	return err
+}
+
+// secureValue is the encrypted value, empty if there is none
+func secureValue(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	return util.Encrypt(v, conf.Options.Security.DBKey)
+}
+
+// sourceKey is an encrypted key of a team for one of the KeyedSources
+type sourceKey struct {
+	Team   string
+	Source string
+	Key    string `db:"api_key"`
+}
+
+// sourceKeys returns the clear keys of the team by the source
+func (r *MySQL) sourceKeys(team string) (map[string]string, error) {
+	var keys []sourceKey
+	if err := r.db.Select(&keys, "SELECT team, source, api_key FROM team_keys WHERE team = ?", team); err != nil {
+		return nil, err
+	}
+	return clearSourceKeys(keys, team)
+}
+
+// clearSourceKeys decrypts the keys of the team, nil if it has none
+func clearSourceKeys(keys []sourceKey, team string) (map[string]string, error) {
+	var res map[string]string
+	for _, k := range keys {
+		if k.Team != team {
+			continue
+		}
+		clear, err := util.Decrypt(k.Key, conf.Options.Security.DBKey)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = make(map[string]string)
+		}
+		res[k.Source] = clear
+	}
+	return res, nil
+}
+
 func (r *MySQL) SetTeam(team *domain.Team) error {
 	return r.SetTeamAndUser(team, nil)
 }
@@ -326,15 +690,59 @@ func (r *MySQL) Teams() ([]domain.Team, error) {
 	if err != nil {
 		return teams, err
 	}
+	var admins []struct {
+		Team string
+		User string
+	}
+	if err = r.db.Select(&admins, "SELECT team, user FROM config_admins"); err != nil {
+		return teams, err
+	}
+	var keys []sourceKey
+	if err = r.db.Select(&keys, "SELECT team, source, api_key FROM team_keys"); err != nil {
+		return teams, err
+	}
 	for i := range teams {
 		err = clearTeamFields(&teams[i])
 		if err != nil {
 			logrus.Warnf("Unencrypted token found in DB - %v", err)
 		}
+		if teams[i].SourceKeys, err = clearSourceKeys(keys, teams[i].ID); err != nil {
+			logrus.Warnf("Unencrypted key found in DB - %v", err)
+		}
+		for _, admin := range admins {
+			if admin.Team == teams[i].ID {
+				teams[i].ConfigAdmins = append(teams[i].ConfigAdmins, admin.User)
+			}
+		}
 	}
 	return teams, err
 }
 
+// ConfigAdmins of the team - users allowed to change the configuration in addition to the workspace admins
+func (r *MySQL) ConfigAdmins(team string) ([]string, error) {
+	var admins []string
+	err := r.db.Select(&admins, "SELECT user FROM config_admins WHERE team = ?", team)
+	return admins, err
+}
+
+// SetConfigAdmins replaces the config admins of the team
+func (r *MySQL) SetConfigAdmins(team string, admins []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM config_admins WHERE team = ?", team); err != nil {
+		return err
+	}
+	for _, admin := range admins {
+		if _, err = tx.Exec("INSERT INTO config_admins (team, user) VALUES (?, ?)", team, admin); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (r *MySQL) TeamMembers(team string) ([]domain.User, error) {
 	var users []domain.User
 	err := r.db.Select(&users, "SELECT * FROM users WHERE team = ?", team)
@@ -505,6 +913,103 @@ func (r *MySQL) ChannelsAndGroups(team string) (*domain.Configuration, error) {
 			res.VerboseGroups = append(res.VerboseGroups, s[1:])
 		case 'Z':
 			res.VerboseIM = true
+		case 'F':
+			res.DisableRefang = true
+		case 'N':
+			res.DisableDomains = true
+		case 'I':
+			res.InternalIPs = true
+		case 'P':
+			res.CustomPatterns = append(res.CustomPatterns, s[1:])
+		case 'W':
+			res.CustomWebhook = s[1:]
+		case 'L':
+			res.Whitelist = append(res.Whitelist, s[1:])
+		case '.':
+			res.InternalDomains = append(res.InternalDomains, s[1:])
+		case 'T':
+			res.DisableAttachments = true
+		case 'H':
+			res.ReplyInThread = append(res.ReplyInThread, s[1:])
+		case 'B':
+			res.ScanBotMessages = append(res.ScanBotMessages, s[1:])
+		case 'E':
+			res.ScanEmails = true
+		case 'K':
+			res.ScanCode = append(res.ScanCode, s[1:])
+		case 'U':
+			res.IgnoredUsers = append(res.IgnoredUsers, s[1:])
+		case 'M':
+			if i := strings.LastIndex(s, ":"); i > 1 && domain.ValidMode(s[i+1:]) {
+				if res.ReplyMode == nil {
+					res.ReplyMode = make(map[string]string)
+				}
+				res.ReplyMode[s[1:i]] = s[i+1:]
+			}
+		case 'S':
+			if i := strings.LastIndex(s, ":"); i > 1 {
+				if until, err := strconv.ParseInt(s[i+1:], 10, 64); err == nil && time.Now().Before(time.Unix(until, 0)) {
+					if res.Muted == nil {
+						res.Muted = make(map[string]time.Time)
+					}
+					res.Muted[s[1:i]] = time.Unix(until, 0)
+				}
+			}
+		case 'O':
+			res.DisableWeeklyReport = true
+		case '+':
+			res.AutoMonitorOnInvite = true
+		case '#':
+			res.ChannelPatterns = append(res.ChannelPatterns, s[1:])
+		case 'Q':
+			// Q alone is the all public channels mode, with a channel it is a channel excluded from the mode
+			if len(s) == 1 {
+				res.AllPublicChannels = true
+			} else {
+				res.ExcludedChannels = append(res.ExcludedChannels, s[1:])
+			}
+		case '!':
+			if parts := strings.Split(s[1:], ":"); len(parts) == 2 {
+				vt, vtErr := strconv.Atoi(parts[0])
+				xfe, xfeErr := strconv.ParseFloat(parts[1], 64)
+				if vtErr == nil && xfeErr == nil {
+					res.SeverityVTPositives, res.SeverityXFEScore = vt, xfe
+				}
+			}
+		case 'V':
+			if parts := strings.Split(s[1:], ":"); len(parts) == 3 {
+				if hour, err := strconv.Atoi(parts[1]); err == nil {
+					res.DigestChannel, res.DigestHour, res.DigestTimezone = parts[0], hour, parts[2]
+				}
+			}
+		case '-':
+			res.DisabledSources = append(res.DisabledSources, s[1:])
+		case '~':
+			res.EnabledSources = append(res.EnabledSources, s[1:])
+		case '%':
+			if i := strings.LastIndex(s, ":"); i > 1 {
+				if weight, err := strconv.ParseFloat(s[i+1:], 64); err == nil {
+					if res.Scoring.Weights == nil {
+						res.Scoring.Weights = make(map[string]float64)
+					}
+					res.Scoring.Weights[s[1:i]] = weight
+				}
+			}
+		case '=':
+			if parts := strings.Split(s[1:], ":"); len(parts) == 2 {
+				malicious, maliciousErr := strconv.ParseFloat(parts[0], 64)
+				suspicious, suspiciousErr := strconv.ParseFloat(parts[1], 64)
+				if maliciousErr == nil && suspiciousErr == nil {
+					res.Scoring.Malicious, res.Scoring.Suspicious = malicious, suspicious
+				}
+			}
+		case 'J':
+			if i := strings.LastIndex(s, ":"); i > 1 && domain.ValidThreshold(s[i+1:]) {
+				if res.ReplyThreshold == nil {
+					res.ReplyThreshold = make(map[string]string)
+				}
+				res.ReplyThreshold[s[1:i]] = s[i+1:]
+			}
 		}
 	}
 	return res, err
@@ -572,155 +1077,902 @@ func (r *MySQL) SetChannelsAndGroups(configuration *domain.Configuration) error
 			return err
 		}
 	}
-	return tx.Commit()
-}
-
-func (r *MySQL) IsVerboseChannel(team, channel string) (bool, error) {
-	var count int
-	if team == "" || channel == "" {
-		return false, nil
+	if configuration.DisableRefang {
+		_, err = stmt.Exec(configuration.Team, "F")
+		if err != nil {
+			return err
+		}
 	}
-	switch channel[0] {
-	case 'C':
-		channel = "X" + channel
-	case 'G':
-		channel = "Y" + channel
+	if configuration.DisableDomains {
+		_, err = stmt.Exec(configuration.Team, "N")
+		if err != nil {
+			return err
+		}
 	}
-	err := r.db.Get(&count, "SELECT count(*) FROM configurations WHERE team = ? AND channel = ?", team, channel)
-	if err != nil {
-		return false, err
+	if configuration.InternalIPs {
+		_, err = stmt.Exec(configuration.Team, "I")
+		if err != nil {
+			return err
+		}
 	}
-	return count > 0, nil
-}
-
-// BotHeartbeat updates the bot keep-alive timestamp
-func (r *MySQL) BotHeartbeat() error {
-	_, err := r.db.Exec("INSERT INTO bots (bot, ts) VALUES (?, now()) ON DUPLICATE KEY UPDATE ts = now()", util.Hostname)
-	return err
-}
-
-func (r *MySQL) updateStats(stats *domain.Statistics, oldTimestamp time.Time) error {
-	var rows int64
-	for count := 5; rows == 0 && count > 0; count-- {
-		res, err := r.db.Exec(`UPDATE team_statistics SET
-ts = now(),
-messages = messages + ?,
-files_clean = files_clean + ?,
-files_dirty = files_dirty + ?,
-files_unknown = files_unknown + ?,
-urls_clean = urls_clean + ?,
-urls_dirty = urls_dirty + ?,
-urls_unknown = urls_unknown + ?,
-hashes_clean = hashes_clean + ?,
-hashes_dirty = hashes_dirty + ?,
-hashes_unknown = hashes_unknown + ?,
-ips_clean = ips_clean + ?,
-ips_dirty = ips_dirty + ?,
-ips_unknown = ips_unknown + ?
-WHERE team = ? AND ts = ?`,
-			stats.Messages, stats.FilesClean, stats.FilesDirty, stats.FilesUnknown, stats.URLsClean, stats.URLsDirty, stats.URLsUnknown,
-			stats.HashesClean, stats.HashesDirty, stats.HashesUnknown, stats.IPsClean, stats.IPsDirty, stats.IPsUnknown, stats.Team, oldTimestamp)
+	for _, p := range configuration.CustomPatterns {
+		_, err = stmt.Exec(configuration.Team, "P"+p)
 		if err != nil {
 			return err
 		}
-		rows, err = res.RowsAffected()
+	}
+	if configuration.CustomWebhook != "" {
+		_, err = stmt.Exec(configuration.Team, "W"+configuration.CustomWebhook)
 		if err != nil {
 			return err
 		}
-		if rows == 0 {
-			err = r.db.Get(&oldTimestamp, "SELECT ts FROM team_statistics WHERE team = ?", stats.Team)
-			if err != nil {
-				return err
-			}
+	}
+	for _, entry := range configuration.Whitelist {
+		_, err = stmt.Exec(configuration.Team, "L"+entry)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
-}
-
-func (r *MySQL) UpdateStatistics(stats *domain.Statistics) error {
-	if stats == nil || !stats.HasSomething() {
-		return nil
+	// Stored with a leading dot like a suffix, .corp.example.com
+	for _, d := range configuration.InternalDomains {
+		_, err = stmt.Exec(configuration.Team, "."+d)
+		if err != nil {
+			return err
+		}
 	}
-	// Can be probably done via UPSERT
-	// The code selects current timestamp. If there is no row for the team, we try to insert. If insert fails (because someone already inserted this team) then move to updates.
-	// The updates try to update the row while making sure that the timestamp is the same as we selected. If someone changed data, we will need to re-select timestmap to prevent lost updates.
-	var oldTimestamp time.Time
-	err := r.db.Get(&oldTimestamp, "SELECT ts FROM team_statistics WHERE team = ?", stats.Team)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return err
-		}
-		_, err := r.db.Exec(`INSERT INTO team_statistics
-(team, ts, messages, files_clean, files_dirty, files_unknown, urls_clean, urls_dirty, urls_unknown, hashes_clean, hashes_dirty, hashes_unknown, ips_clean, ips_dirty, ips_unknown)
-VALUES (?, now(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			stats.Team, stats.Messages, stats.FilesClean, stats.FilesDirty, stats.FilesUnknown, stats.URLsClean, stats.URLsDirty, stats.URLsUnknown,
-			stats.HashesClean, stats.HashesDirty, stats.HashesUnknown, stats.IPsClean, stats.IPsDirty, stats.IPsUnknown)
-		if err != nil {
-			switch mysqlErr := err.(type) {
-			case *mysql.MySQLError:
-				// Duplicate key because someone already inserted stats for team
-				if mysqlErr.Number == 1062 {
-					// Do select again and then update
-					err = r.db.Get(&oldTimestamp, "SELECT ts FROM team_statistics WHERE team = ?", stats.Team)
-					if err != nil {
-						return err
-					}
-					return r.updateStats(stats, oldTimestamp)
-				}
-			}
+	if configuration.DisableAttachments {
+		_, err = stmt.Exec(configuration.Team, "T")
+		if err != nil {
 			return err
 		}
-		return nil
 	}
-	return r.updateStats(stats, oldTimestamp)
-}
-
-func (r *MySQL) Statistics(team string) (*domain.Statistics, error) {
-	stats := &domain.Statistics{}
-	err := r.db.Get(stats, "SELECT * FROM team_statistics WHERE team = ?", team)
-	return stats, err
-}
-
-func (r *MySQL) GlobalStatistics() (*domain.Statistics, error) {
-	// Notice - this will not work if there are no statistics at all in the DB
-	stats := &domain.Statistics{}
-	err := r.db.Get(stats, `SELECT 'Global' as team, sum(messages) as messages,
-sum(files_clean) as clean_files, sum(files_dirty) as files_dirty, sum(files_unknown) as files_unknown,
-sum(urls_clean) as urls_clean, sum(urls_dirty) as urls_dirty, sum(urls_unknown) as urls_unknown,
-sum(hashes_clean) as hashes_clean, sum(hashes_dirty) as hashes_dirty, sum(hashes_unknown) as hashes_unknown,
-sum(ips_clean) as ips_clean, sum(ips_dirty) as ips_dirty, sum(ips_unknown) as ips_unknown FROM team_statistics`)
-	return stats, err
-}
-
-func (r *MySQL) TotalMessages() (int, error) {
-	var sum int
-	err := r.db.Get(&sum, `SELECT sum(messages) FROM team_statistics`)
-	return sum, err
-}
-
-func (r *MySQL) StoreMaliciousContent(convicted *domain.MaliciousContent) error {
-	_, err := r.db.Exec("INSERT INTO convicted (team, channel, message_id, ts, content_type, content, file_name, vt, xfe, clamav, cy) VALUES (?, ?, ?, now(), ?, ?, ?, ?, ?, ?, ?)",
-		convicted.Team, convicted.Channel, convicted.MessageID, convicted.ContentType, util.Substr(convicted.Content, 0, 128), util.Substr(convicted.FileName, 0, 128),
-		util.Substr(convicted.VT, 0, 128), util.Substr(convicted.XFE, 0, 128), util.Substr(convicted.ClamAV, 0, 128), util.Substr(convicted.Cy, 0, 128))
-	return err
-}
-
-func (r *MySQL) JoinSlackChannel(email string) error {
-	_, err := r.db.Exec("INSERT INTO slack_invites (email, ts, invited) VALUES (?, now(), 0)", email)
-	if err != nil {
-		switch err := err.(type) {
-		case *mysql.MySQLError:
-			// Duplicate key might happen but it's fine
-			if err.Number == 1062 {
-				return nil
-			}
+	for _, ch := range configuration.ReplyInThread {
+		_, err = stmt.Exec(configuration.Team, "H"+ch)
+		if err != nil {
+			return err
 		}
 	}
-	return err
-}
-
-func (r *MySQL) QueueMessages(names []string, messageType string) (messages []*domain.DBQueueMessage, err error) {
-	query := "SELECT id, name, message_type, message, ts FROM queue WHERE message_type = ?"
+	for _, ch := range configuration.ScanBotMessages {
+		_, err = stmt.Exec(configuration.Team, "B"+ch)
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.ScanEmails {
+		_, err = stmt.Exec(configuration.Team, "E")
+		if err != nil {
+			return err
+		}
+	}
+	for _, ch := range configuration.ScanCode {
+		_, err = stmt.Exec(configuration.Team, "K"+ch)
+		if err != nil {
+			return err
+		}
+	}
+	for _, user := range configuration.IgnoredUsers {
+		_, err = stmt.Exec(configuration.Team, "U"+user)
+		if err != nil {
+			return err
+		}
+	}
+	for ch, threshold := range configuration.ReplyThreshold {
+		_, err = stmt.Exec(configuration.Team, "J"+ch+":"+threshold)
+		if err != nil {
+			return err
+		}
+	}
+	for ch := range configuration.Muted {
+		// Expired mutes are dropped on the next save
+		if !configuration.IsMuted(ch) {
+			continue
+		}
+		_, err = stmt.Exec(configuration.Team, "S"+ch+":"+strconv.FormatInt(configuration.Muted[ch].Unix(), 10))
+		if err != nil {
+			return err
+		}
+	}
+	for ch, mode := range configuration.ReplyMode {
+		_, err = stmt.Exec(configuration.Team, "M"+ch+":"+mode)
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.DisableWeeklyReport {
+		_, err = stmt.Exec(configuration.Team, "O")
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.AllPublicChannels {
+		_, err = stmt.Exec(configuration.Team, "Q")
+		if err != nil {
+			return err
+		}
+	}
+	for _, ch := range configuration.ExcludedChannels {
+		_, err = stmt.Exec(configuration.Team, "Q"+ch)
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.AutoMonitorOnInvite {
+		_, err = stmt.Exec(configuration.Team, "+")
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range configuration.ChannelPatterns {
+		_, err = stmt.Exec(configuration.Team, "#"+p)
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.SeverityVTPositives > 0 || configuration.SeverityXFEScore > 0 {
+		_, err = stmt.Exec(configuration.Team, "!"+strconv.Itoa(configuration.SeverityVTPositives)+":"+strconv.FormatFloat(configuration.SeverityXFEScore, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	for _, source := range configuration.DisabledSources {
+		_, err = stmt.Exec(configuration.Team, "-"+source)
+		if err != nil {
+			return err
+		}
+	}
+	for _, source := range configuration.EnabledSources {
+		_, err = stmt.Exec(configuration.Team, "~"+source)
+		if err != nil {
+			return err
+		}
+	}
+	for source, weight := range configuration.Scoring.Weights {
+		_, err = stmt.Exec(configuration.Team, "%"+source+":"+strconv.FormatFloat(weight, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.Scoring.Malicious > 0 || configuration.Scoring.Suspicious > 0 {
+		_, err = stmt.Exec(configuration.Team, "="+strconv.FormatFloat(configuration.Scoring.Malicious, 'f', -1, 64)+":"+
+			strconv.FormatFloat(configuration.Scoring.Suspicious, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	if configuration.DigestChannel != "" {
+		_, err = stmt.Exec(configuration.Team, "V"+configuration.DigestChannel+":"+strconv.Itoa(configuration.DigestHour)+":"+configuration.DigestTimezone)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *MySQL) IsVerboseChannel(team, channel string) (bool, error) {
+	var count int
+	if team == "" || channel == "" {
+		return false, nil
+	}
+	switch channel[0] {
+	case 'C':
+		channel = "X" + channel
+	case 'G':
+		channel = "Y" + channel
+	}
+	err := r.db.Get(&count, "SELECT count(*) FROM configurations WHERE team = ? AND channel = ?", team, channel)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// BotHeartbeat updates the bot keep-alive timestamp
+func (r *MySQL) BotHeartbeat() error {
+	_, err := r.db.Exec("INSERT INTO bots (bot, ts) VALUES (?, now()) ON DUPLICATE KEY UPDATE ts = now()", util.Hostname)
+	return err
+}
+
+// Bots returns the keep-alives of the bot hosts, stale if older than timeout by the clock of the database
+func (r *MySQL) Bots(timeout time.Duration) ([]*domain.BotHeartbeat, error) {
+	var bots []*domain.BotHeartbeat
+	err := r.db.Select(&bots, "SELECT bot, ts, ts < DATE_SUB(now(), INTERVAL ? SECOND) AS stale FROM bots ORDER BY bot",
+		int64(timeout/time.Second))
+	return bots, err
+}
+
+// DeleteBot forgets the bot host so the configuration changes are no longer posted to it
+func (r *MySQL) DeleteBot(bot string) error {
+	_, err := r.db.Exec("DELETE FROM bots WHERE bot = ?", bot)
+	return err
+}
+
+// UpdateStatistics adds the statistics to the totals, the daily counters and the channel counters of the team in one
+// transaction, so a failed update can be retried without counting anything twice
+func (r *MySQL) UpdateStatistics(stats *domain.Statistics) error {
+	if stats == nil || !stats.HasSomething() {
+		return nil
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = updateTotalStats(tx, stats); err != nil {
+		return err
+	}
+	if err = updateDailyStats(tx, stats); err != nil {
+		return err
+	}
+	if err = updateChannelStats(tx, stats); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateTotalStats adds the statistics to the counters of the team since we were installed
+func updateTotalStats(tx *sql.Tx, stats *domain.Statistics) error {
+	_, err := tx.Exec(`INSERT INTO team_statistics
+(team, ts, messages, files_clean, files_dirty, files_unknown, urls_clean, urls_dirty, urls_unknown, hashes_clean, hashes_dirty, hashes_unknown, ips_clean, ips_dirty, ips_unknown, ips_skipped, whitelisted, cache_hits, truncated, muted, dropped, rate_limited, expired)
+VALUES (?, now(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE
+ts = now(),
+messages = messages + VALUES(messages),
+files_clean = files_clean + VALUES(files_clean),
+files_dirty = files_dirty + VALUES(files_dirty),
+files_unknown = files_unknown + VALUES(files_unknown),
+urls_clean = urls_clean + VALUES(urls_clean),
+urls_dirty = urls_dirty + VALUES(urls_dirty),
+urls_unknown = urls_unknown + VALUES(urls_unknown),
+hashes_clean = hashes_clean + VALUES(hashes_clean),
+hashes_dirty = hashes_dirty + VALUES(hashes_dirty),
+hashes_unknown = hashes_unknown + VALUES(hashes_unknown),
+ips_clean = ips_clean + VALUES(ips_clean),
+ips_dirty = ips_dirty + VALUES(ips_dirty),
+ips_unknown = ips_unknown + VALUES(ips_unknown),
+ips_skipped = ips_skipped + VALUES(ips_skipped),
+whitelisted = whitelisted + VALUES(whitelisted),
+cache_hits = cache_hits + VALUES(cache_hits),
+truncated = truncated + VALUES(truncated),
+muted = muted + VALUES(muted),
+dropped = dropped + VALUES(dropped),
+rate_limited = rate_limited + VALUES(rate_limited),
+expired = expired + VALUES(expired)`,
+		stats.Team, stats.Messages, stats.FilesClean, stats.FilesDirty, stats.FilesUnknown, stats.URLsClean, stats.URLsDirty, stats.URLsUnknown,
+		stats.HashesClean, stats.HashesDirty, stats.HashesUnknown, stats.IPsClean, stats.IPsDirty, stats.IPsUnknown, stats.IPsSkipped, stats.Whitelisted, stats.CacheHits, stats.Truncated, stats.Muted, stats.Dropped, stats.RateLimited, stats.Expired)
+	return err
+}
+
+// updateDailyStats adds the statistics to the counters of the team for today
+func updateDailyStats(tx *sql.Tx, stats *domain.Statistics) error {
+	_, err := tx.Exec(`INSERT INTO team_statistics_daily
+(team, day, messages, files_clean, files_dirty, files_unknown, urls_clean, urls_dirty, urls_unknown, hashes_clean, hashes_dirty, hashes_unknown, ips_clean, ips_dirty, ips_unknown, ips_skipped, whitelisted, cache_hits, truncated, muted, dropped, rate_limited, expired)
+VALUES (?, utc_date(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE
+messages = messages + VALUES(messages),
+files_clean = files_clean + VALUES(files_clean),
+files_dirty = files_dirty + VALUES(files_dirty),
+files_unknown = files_unknown + VALUES(files_unknown),
+urls_clean = urls_clean + VALUES(urls_clean),
+urls_dirty = urls_dirty + VALUES(urls_dirty),
+urls_unknown = urls_unknown + VALUES(urls_unknown),
+hashes_clean = hashes_clean + VALUES(hashes_clean),
+hashes_dirty = hashes_dirty + VALUES(hashes_dirty),
+hashes_unknown = hashes_unknown + VALUES(hashes_unknown),
+ips_clean = ips_clean + VALUES(ips_clean),
+ips_dirty = ips_dirty + VALUES(ips_dirty),
+ips_unknown = ips_unknown + VALUES(ips_unknown),
+ips_skipped = ips_skipped + VALUES(ips_skipped),
+whitelisted = whitelisted + VALUES(whitelisted),
+cache_hits = cache_hits + VALUES(cache_hits),
+truncated = truncated + VALUES(truncated),
+muted = muted + VALUES(muted),
+dropped = dropped + VALUES(dropped),
+rate_limited = rate_limited + VALUES(rate_limited),
+expired = expired + VALUES(expired)`,
+		stats.Team, stats.Messages, stats.FilesClean, stats.FilesDirty, stats.FilesUnknown, stats.URLsClean, stats.URLsDirty, stats.URLsUnknown,
+		stats.HashesClean, stats.HashesDirty, stats.HashesUnknown, stats.IPsClean, stats.IPsDirty, stats.IPsUnknown, stats.IPsSkipped, stats.Whitelisted, stats.CacheHits, stats.Truncated, stats.Muted, stats.Dropped, stats.RateLimited, stats.Expired)
+	return err
+}
+
+// updateChannelStats adds the messages per channel to the counters of the day
+func updateChannelStats(tx *sql.Tx, stats *domain.Statistics) error {
+	for channel, c := range stats.Channels {
+		_, err := tx.Exec(`INSERT INTO channel_statistics_daily (team, channel, day, messages, urls, ips, hashes, files, malicious)
+VALUES (?, ?, utc_date(), ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE messages = messages + VALUES(messages), urls = urls + VALUES(urls), ips = ips + VALUES(ips),
+hashes = hashes + VALUES(hashes), files = files + VALUES(files), malicious = malicious + VALUES(malicious)`,
+			stats.Team, channel, c.Messages, c.URLs, c.IPs, c.Hashes, c.Files, c.Malicious)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StatisticsForTeamSince sums the daily statistics of the team from the (UTC) day of since.
+// Teams without any statistics get zero counters.
+func (r *MySQL) StatisticsForTeamSince(team string, since time.Time) (*domain.Statistics, error) {
+	return r.StatisticsForTeamBetween(team, since, time.Now().AddDate(0, 0, 1))
+}
+
+// StatisticsForTeamBetween sums the daily statistics of the team from the (UTC) day of from until the day of to, excluding it
+func (r *MySQL) StatisticsForTeamBetween(team string, from, to time.Time) (*domain.Statistics, error) {
+	stats := &domain.Statistics{}
+	err := r.db.Get(stats, `SELECT ? as team, coalesce(sum(messages), 0) as messages,
+coalesce(sum(files_clean), 0) as files_clean, coalesce(sum(files_dirty), 0) as files_dirty, coalesce(sum(files_unknown), 0) as files_unknown,
+coalesce(sum(urls_clean), 0) as urls_clean, coalesce(sum(urls_dirty), 0) as urls_dirty, coalesce(sum(urls_unknown), 0) as urls_unknown,
+coalesce(sum(hashes_clean), 0) as hashes_clean, coalesce(sum(hashes_dirty), 0) as hashes_dirty, coalesce(sum(hashes_unknown), 0) as hashes_unknown,
+coalesce(sum(ips_clean), 0) as ips_clean, coalesce(sum(ips_dirty), 0) as ips_dirty, coalesce(sum(ips_unknown), 0) as ips_unknown,
+coalesce(sum(ips_skipped), 0) as ips_skipped, coalesce(sum(whitelisted), 0) as whitelisted, coalesce(sum(cache_hits), 0) as cache_hits,
+coalesce(sum(truncated), 0) as truncated, coalesce(sum(muted), 0) as muted, coalesce(sum(dropped), 0) as dropped, coalesce(sum(rate_limited), 0) as rate_limited,
+coalesce(sum(expired), 0) as expired FROM team_statistics_daily WHERE team = ? AND day >= ? AND day < ?`,
+		team, team, from.UTC().Format("2006-01-02"), to.UTC().Format("2006-01-02"))
+	return stats, err
+}
+
+// StatisticsForChannelBetween sums the daily statistics of the channel of the team from the (UTC) day of from
+// until the day of to, excluding it. The team counters are kept on their own so they do not need the channels.
+func (r *MySQL) StatisticsForChannelBetween(team, channel string, from, to time.Time) (*domain.ChannelStatistics, error) {
+	stats := &domain.ChannelStatistics{}
+	err := r.db.Get(stats, `SELECT coalesce(sum(messages), 0) as messages, coalesce(sum(urls), 0) as urls, coalesce(sum(ips), 0) as ips,
+coalesce(sum(hashes), 0) as hashes, coalesce(sum(files), 0) as files, coalesce(sum(malicious), 0) as malicious
+FROM channel_statistics_daily WHERE team = ? AND channel = ? AND day >= ? AND day < ?`,
+		team, channel, from.UTC().Format("2006-01-02"), to.UTC().Format("2006-01-02"))
+	return stats, err
+}
+
+// StatisticsForChannelSince sums the daily statistics of the channel of the team from the (UTC) day of since
+func (r *MySQL) StatisticsForChannelSince(team, channel string, since time.Time) (*domain.ChannelStatistics, error) {
+	return r.StatisticsForChannelBetween(team, channel, since, time.Now().AddDate(0, 0, 1))
+}
+
+// TotalsSince sums what we checked for the team, or only in the channel if given, from the (UTC) day of since
+func (r *MySQL) TotalsSince(team, channel string, since time.Time) (*domain.ChannelStatistics, error) {
+	if channel != "" {
+		return r.StatisticsForChannelSince(team, channel, since)
+	}
+	stats, err := r.StatisticsForTeamSince(team, since)
+	if err != nil {
+		return nil, err
+	}
+	return stats.Totals(), nil
+}
+
+func (r *MySQL) Statistics(team string) (*domain.Statistics, error) {
+	stats := &domain.Statistics{}
+	err := r.db.Get(stats, "SELECT * FROM team_statistics WHERE team = ?", team)
+	return stats, err
+}
+
+func (r *MySQL) GlobalStatistics() (*domain.Statistics, error) {
+	// Notice - this will not work if there are no statistics at all in the DB
+	stats := &domain.Statistics{}
+	err := r.db.Get(stats, `SELECT 'Global' as team, sum(messages) as messages,
+sum(files_clean) as clean_files, sum(files_dirty) as files_dirty, sum(files_unknown) as files_unknown,
+sum(urls_clean) as urls_clean, sum(urls_dirty) as urls_dirty, sum(urls_unknown) as urls_unknown,
+sum(hashes_clean) as hashes_clean, sum(hashes_dirty) as hashes_dirty, sum(hashes_unknown) as hashes_unknown,
+sum(ips_clean) as ips_clean, sum(ips_dirty) as ips_dirty, sum(ips_unknown) as ips_unknown FROM team_statistics`)
+	return stats, err
+}
+
+func (r *MySQL) TotalMessages() (int, error) {
+	var sum int
+	err := r.db.Get(&sum, `SELECT sum(messages) FROM team_statistics`)
+	return sum, err
+}
+
+func (r *MySQL) StoreMaliciousContent(convicted *domain.MaliciousContent) error {
+	_, err := r.db.Exec("INSERT INTO convicted (team, channel, message_id, ts, content_type, content, file_name, vt, xfe, clamav, cy) VALUES (?, ?, ?, now(), ?, ?, ?, ?, ?, ?, ?)",
+		convicted.Team, convicted.Channel, convicted.MessageID, convicted.ContentType, util.Substr(convicted.Content, 0, 128), util.Substr(convicted.FileName, 0, 128),
+		util.Substr(convicted.VT, 0, 128), util.Substr(convicted.XFE, 0, 128), util.Substr(convicted.ClamAV, 0, 128), util.Substr(convicted.Cy, 0, 128))
+	return err
+}
+
+// maxDigestFindings is the number of malicious indicators we list in the digest
+const maxDigestFindings = 10
+
+// DigestForTeamSince aggregates the statistics and the most seen malicious indicators of the team
+func (r *MySQL) DigestForTeamSince(team string, since time.Time) (*domain.Digest, error) {
+	stats, err := r.StatisticsForTeamSince(team, since)
+	if err != nil {
+		return nil, err
+	}
+	var convicted []domain.DigestFinding
+	if err = r.db.Select(&convicted, "SELECT content_type, content, channel, message_id FROM convicted WHERE team = ? AND ts >= ? ORDER BY ts DESC",
+		team, since.UTC()); err != nil {
+		return nil, err
+	}
+	digest := &domain.Digest{Stats: stats}
+	seen := make(map[string]int)
+	for _, c := range convicted {
+		// Keep the newest message for each indicator
+		key := strconv.Itoa(c.ContentType) + ":" + c.Content
+		if i, ok := seen[key]; ok {
+			digest.Malicious[i].Count++
+			continue
+		}
+		c.Count = 1
+		seen[key] = len(digest.Malicious)
+		digest.Malicious = append(digest.Malicious, c)
+	}
+	sort.SliceStable(digest.Malicious, func(i, j int) bool { return digest.Malicious[i].Count > digest.Malicious[j].Count })
+	if len(digest.Malicious) > maxDigestFindings {
+		digest.Malicious = digest.Malicious[:maxDigestFindings]
+	}
+	return digest, nil
+}
+
+// LastDigest returns when we posted the last digest for the team, zero time if never
+func (r *MySQL) LastDigest(team string) (time.Time, error) {
+	var ts time.Time
+	err := r.db.Get(&ts, "SELECT ts FROM digests WHERE team = ?", team)
+	if err == sql.ErrNoRows {
+		return ts, nil
+	}
+	return ts, err
+}
+
+// SetLastDigest records when we posted the digest for the team so restarts do not post it again
+func (r *MySQL) SetLastDigest(team string, ts time.Time) error {
+	_, err := r.db.Exec("INSERT INTO digests (team, ts) VALUES (?, ?) ON DUPLICATE KEY UPDATE ts = ?", team, ts.UTC(), ts.UTC())
+	return err
+}
+
+// maxBusiestChannels is the number of channels we list in the weekly report
+const maxBusiestChannels = 5
+
+// WeeklyReportForTeam compares the week (7 UTC days) before the day of end with the week before it
+func (r *MySQL) WeeklyReportForTeam(team string, end time.Time) (*domain.WeeklyReport, error) {
+	start := end.AddDate(0, 0, -7)
+	current, err := r.StatisticsForTeamBetween(team, start, end)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := r.StatisticsForTeamBetween(team, start.AddDate(0, 0, -7), start)
+	if err != nil {
+		return nil, err
+	}
+	report := &domain.WeeklyReport{Current: current, Previous: previous}
+	err = r.db.Select(&report.Busiest, `SELECT channel, sum(messages) as messages FROM channel_statistics_daily
+WHERE team = ? AND day >= ? AND day < ? GROUP BY channel ORDER BY messages DESC LIMIT ?`,
+		team, start.UTC().Format("2006-01-02"), end.UTC().Format("2006-01-02"), maxBusiestChannels)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// LastWeeklyReport returns when we sent the last weekly report for the team, zero time if never
+func (r *MySQL) LastWeeklyReport(team string) (time.Time, error) {
+	var ts time.Time
+	err := r.db.Get(&ts, "SELECT ts FROM weekly_reports WHERE team = ?", team)
+	if err == sql.ErrNoRows {
+		return ts, nil
+	}
+	return ts, err
+}
+
+// SetLastWeeklyReport records when we sent the weekly report for the team so restarts do not send it again
+func (r *MySQL) SetLastWeeklyReport(team string, ts time.Time) error {
+	_, err := r.db.Exec("INSERT INTO weekly_reports (team, ts) VALUES (?, ?) ON DUPLICATE KEY UPDATE ts = ?", team, ts.UTC(), ts.UTC())
+	return err
+}
+
+// MarkGreeted records that we greeted the channel. It returns false if we (or another instance) already did.
+func (r *MySQL) MarkGreeted(team, channel string) (bool, error) {
+	res, err := r.db.Exec("INSERT IGNORE INTO greeted_channels (team, channel, ts) VALUES (?, ?, now())", team, channel)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// MarkWelcomed records that we welcomed the user. It returns false if we (or another instance) already did.
+func (r *MySQL) MarkWelcomed(team, user string) (bool, error) {
+	res, err := r.db.Exec("INSERT IGNORE INTO welcomed_users (team, user, ts) VALUES (?, ?, now())", team, user)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// AcquireLease takes the lease of the job for the owner until ttl from now. It succeeds if the owner already holds
+// the lease or if the lease expired. The expiry uses the clock of the DB so the instances do not need to agree on the time.
+func (r *MySQL) AcquireLease(job, owner string, ttl time.Duration) (bool, error) {
+	// Make sure there is a row to update, an expired one so whoever gets to the update first takes it
+	if _, err := r.db.Exec("INSERT IGNORE INTO leases (job, owner, expires) VALUES (?, '', '1970-01-01 00:00:01')", job); err != nil {
+		return false, err
+	}
+	res, err := r.db.Exec("UPDATE leases SET owner = ?, expires = DATE_ADD(now(6), INTERVAL ? MICROSECOND) WHERE job = ? AND (owner = ? OR expires < now(6))",
+		owner, ttl.Nanoseconds()/1000, job, owner)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// RenewLease extends the lease of the job until ttl from now. It returns false if the owner lost the lease.
+func (r *MySQL) RenewLease(job, owner string, ttl time.Duration) (bool, error) {
+	res, err := r.db.Exec("UPDATE leases SET expires = DATE_ADD(now(6), INTERVAL ? MICROSECOND) WHERE job = ? AND owner = ?",
+		ttl.Nanoseconds()/1000, job, owner)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// ReleaseLease gives up the lease of the job so another instance can take it without waiting for the expiry
+func (r *MySQL) ReleaseLease(job, owner string) error {
+	_, err := r.db.Exec("UPDATE leases SET expires = '1970-01-01 00:00:01' WHERE job = ? AND owner = ?", job, owner)
+	return err
+}
+
+// storedReplyIDSize is the length of the IDs of the stored replies, short enough for a button value
+const storedReplyIDSize = 12
+
+// StoreReply keeps the full reply so its details can be shown after the fact and returns its ID
+func (r *MySQL) StoreReply(team string, reply *domain.WorkReply) (string, error) {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return "", err
+	}
+	id := util.SecureRandomString(storedReplyIDSize, false)
+	_, err = r.db.Exec("INSERT INTO stored_replies (id, team, reply, ts) VALUES (?, ?, ?, now())", id, team, string(b))
+	return id, err
+}
+
+// StoredReply returns the reply stored for the team with the ID or ErrNotFound if it expired
+func (r *MySQL) StoredReply(team, id string) (*domain.WorkReply, error) {
+	var reply string
+	err := r.db.Get(&reply, "SELECT reply FROM stored_replies WHERE id = ? AND team = ?", id, team)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &domain.WorkReply{}
+	return res, json.Unmarshal([]byte(reply), res)
+}
+
+// DeleteStoredReplies removes the replies stored before the given time
+func (r *MySQL) DeleteStoredReplies(before time.Time) error {
+	_, err := r.db.Exec("DELETE FROM stored_replies WHERE ts < ?", before.UTC())
+	return err
+}
+
+// StoreFalsePositive records a verdict the user reported as wrong
+func (r *MySQL) StoreFalsePositive(fp *domain.FalsePositive) error {
+	res, err := r.db.Exec("INSERT INTO false_positives (team, user, indicator, comment, whitelisted, ts) VALUES (?, ?, ?, ?, ?, now())",
+		fp.Team, fp.User, util.Substr(fp.Indicator, 0, 255), util.Substr(fp.Comment, 0, 512), fp.Whitelisted)
+	if err != nil {
+		return err
+	}
+	fp.ID, err = res.LastInsertId()
+	return err
+}
+
+// FalsePositives of the team, newest first, with the total count for paging
+func (r *MySQL) FalsePositives(team string, offset, limit int) ([]domain.FalsePositive, int, error) {
+	var total int
+	if err := r.db.Get(&total, "SELECT count(*) FROM false_positives WHERE team = ?", team); err != nil {
+		return nil, 0, err
+	}
+	fps := make([]domain.FalsePositive, 0)
+	err := r.db.Select(&fps, "SELECT * FROM false_positives WHERE team = ? ORDER BY ts DESC, id DESC LIMIT ? OFFSET ?", team, limit, offset)
+	return fps, total, err
+}
+
+// StoreScans adds the indicators of a reply to the scan history of the team
+func (r *MySQL) StoreScans(records []domain.ScanRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var args []interface{}
+	for _, rec := range records {
+		scores, err := json.Marshal(rec.Scores)
+		if err != nil {
+			return err
+		}
+		args = append(args, rec.Team, rec.Channel, rec.User, util.Substr(rec.Indicator, 0, 255), util.Substr(rec.Normalized, 0, 255),
+			rec.IndicatorType, util.Substr(string(scores), 0, 1024), rec.Verdict, util.Substr(rec.Permalink, 0, 512))
+	}
+	_, err := r.db.Exec("INSERT INTO scan_history (team, channel, user, indicator, normalized, indicator_type, scores, verdict, permalink, ts) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, now())"+
+		strings.Repeat(", (?, ?, ?, ?, ?, ?, ?, ?, ?, now())", len(records)-1), args...)
+	return err
+}
+
+// scanRow is a scan history row with the scores as they are stored
+type scanRow struct {
+	domain.ScanRecord
+	Scores string `db:"scores"`
+}
+
+// ScanHistory returns a page of the scan history of the team matching the filter, newest first, and the total that matches
+func (r *MySQL) ScanHistory(team string, filter domain.ScanFilter, offset, limit int) ([]domain.ScanRecord, int, error) {
+	where := " FROM scan_history WHERE team = ?"
+	args := []interface{}{team}
+	if !filter.From.IsZero() {
+		where += " AND ts >= ?"
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		where += " AND ts < ?"
+		args = append(args, filter.To.UTC())
+	}
+	if filter.Channel != "" {
+		where += " AND channel = ?"
+		args = append(args, filter.Channel)
+	}
+	if filter.Indicator != "" {
+		where += " AND indicator = ?"
+		args = append(args, filter.Indicator)
+	}
+	if filter.Normalized != "" {
+		where += " AND normalized = ?"
+		args = append(args, filter.Normalized)
+	}
+	if filter.Malicious {
+		where += " AND verdict = ?"
+		args = append(args, domain.ResultDirty)
+	}
+	var total int
+	if err := r.db.Get(&total, "SELECT count(*)"+where, args...); err != nil {
+		return nil, 0, err
+	}
+	var rows []scanRow
+	if err := r.db.Select(&rows, "SELECT *"+where+" ORDER BY ts DESC, id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...); err != nil {
+		return nil, 0, err
+	}
+	records := make([]domain.ScanRecord, 0, len(rows))
+	for _, row := range rows {
+		rec := row.ScanRecord
+		if err := json.Unmarshal([]byte(row.Scores), &rec.Scores); err != nil {
+			// Scores that were cut to fit the column are still worth the rest of the record
+			rec.Scores = nil
+		}
+		records = append(records, rec)
+	}
+	return records, total, nil
+}
+
+// Sightings returns the latest scans of the normalized indicator in the team, newest first, and how many there are
+func (r *MySQL) Sightings(team, normalized string, limit int) ([]domain.ScanRecord, int, error) {
+	return r.ScanHistory(team, domain.ScanFilter{Normalized: normalized}, 0, limit)
+}
+
+// DeleteScansBefore prunes the scan history that is past the retention
+func (r *MySQL) DeleteScansBefore(before time.Time) error {
+	_, err := r.db.Exec("DELETE FROM scan_history WHERE ts < ?", before.UTC())
+	return err
+}
+
+// SetSourceBreaker stores the breaker of a source that tripped on this worker
+func (r *MySQL) SetSourceBreaker(b *domain.SourceBreaker) error {
+	_, err := r.db.Exec("REPLACE INTO source_breakers (worker, breaker, source, state, failures, error, open_until) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		util.Hostname, b.Breaker, b.Source, b.State, b.Failures, util.Substr(b.Error, 0, 512), b.OpenUntil.UTC())
+	return err
+}
+
+// DeleteSourceBreaker forgets the breaker of this worker once its source is back
+func (r *MySQL) DeleteSourceBreaker(breaker string) error {
+	_, err := r.db.Exec("DELETE FROM source_breakers WHERE worker = ? AND breaker = ?", util.Hostname, breaker)
+	return err
+}
+
+// SourceBreakers returns the breakers of all the workers that were open since the given time. Older ones belong to
+// workers that went away while their breaker was open.
+func (r *MySQL) SourceBreakers(since time.Time) ([]domain.SourceBreaker, error) {
+	var breakers []domain.SourceBreaker
+	err := r.db.Select(&breakers, "SELECT worker, breaker, source, state, failures, error, open_until FROM source_breakers WHERE open_until > ? ORDER BY breaker, worker", since.UTC())
+	return breakers, err
+}
+
+// Webhook returns the verdict webhook of the team with the secret in the clear, nil if the team has none
+func (r *MySQL) Webhook(team string) (*domain.Webhook, error) {
+	hook := &domain.Webhook{}
+	err := r.db.Get(hook, "SELECT * FROM webhooks WHERE team = ?", team)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hook.Secret, err = hook.ClearSecret(); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// SetWebhook stores the verdict webhook of the team encrypting the secret
+func (r *MySQL) SetWebhook(hook *domain.Webhook) error {
+	secret, err := hook.SecureSecret()
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("INSERT INTO webhooks (team, url, secret, threshold) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE url = ?, secret = ?, threshold = ?",
+		hook.Team, hook.URL, secret, hook.Threshold, hook.URL, secret, hook.Threshold)
+	return err
+}
+
+// DeleteWebhook stops pushing the verdicts of the team
+func (r *MySQL) DeleteWebhook(team string) error {
+	_, err := r.db.Exec("DELETE FROM webhooks WHERE team = ?", team)
+	return err
+}
+
+// Sandbox returns the sandbox of the team with the key in the clear, nil if the team has none
+func (r *MySQL) Sandbox(team string) (*domain.Sandbox, error) {
+	s := &domain.Sandbox{}
+	err := r.db.Get(s, "SELECT team, url, api_key, max_size, enabled FROM sandboxes WHERE team = ?", team)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Key, err = s.ClearKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetSandbox stores the sandbox of the team encrypting the key
+func (r *MySQL) SetSandbox(s *domain.Sandbox) error {
+	key, err := s.SecureKey()
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("INSERT INTO sandboxes (team, url, api_key, max_size, enabled) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE url = ?, api_key = ?, max_size = ?, enabled = ?",
+		s.Team, s.URL, key, s.MaxSize, s.Enabled, s.URL, key, s.MaxSize, s.Enabled)
+	return err
+}
+
+// DeleteSandbox stops running the files of the team in its sandbox
+func (r *MySQL) DeleteSandbox(team string) error {
+	_, err := r.db.Exec("DELETE FROM sandboxes WHERE team = ?", team)
+	return err
+}
+
+// StartSandboxRun claims the run of the key for this worker until the given time and returns nil, or returns the run
+// of another worker if it is running or finished in time. Expired runs are deleted so a worker that went away does
+// not hold the file.
+func (r *MySQL) StartSandboxRun(key string, until time.Time) (*domain.SandboxRun, error) {
+	if _, err := r.db.Exec("DELETE FROM sandbox_runs WHERE expires < ?", time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	res, err := r.db.Exec("INSERT IGNORE INTO sandbox_runs (run_key, worker, expires, reply) VALUES (?, ?, ?, '')", key, util.Hostname, until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+	var row struct {
+		Worker  string    `db:"worker"`
+		Expires time.Time `db:"expires"`
+		Reply   string    `db:"reply"`
+	}
+	err = r.db.Get(&row, "SELECT worker, expires, reply FROM sandbox_runs WHERE run_key = ?", key)
+	if err == sql.ErrNoRows {
+		// It failed in between, the caller asks again
+		return &domain.SandboxRun{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	run := &domain.SandboxRun{Key: key, Worker: row.Worker, Expires: row.Expires}
+	if row.Reply != "" {
+		run.Reply = &domain.SandboxReply{}
+		if err = json.Unmarshal([]byte(row.Reply), run.Reply); err != nil {
+			return nil, err
+		}
+	}
+	return run, nil
+}
+
+// FinishSandboxRun keeps the verdict of the run of this worker until the given time, a nil reply deletes the run so
+// the next share of the file tries again
+func (r *MySQL) FinishSandboxRun(key string, reply *domain.SandboxReply, until time.Time) error {
+	if reply == nil {
+		_, err := r.db.Exec("DELETE FROM sandbox_runs WHERE run_key = ? AND worker = ?", key, util.Hostname)
+		return err
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec("UPDATE sandbox_runs SET reply = ?, expires = ? WHERE run_key = ? AND worker = ?", string(b), until.UTC(), key, util.Hostname)
+	return err
+}
+
+// AddDeadLetter stores the request the workers gave up on
+func (r *MySQL) AddDeadLetter(d *domain.DeadLetter) error {
+	res, err := r.db.Exec("INSERT INTO dead_letters (team, message_id, type, request, error, attempts, failed) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		d.Team, util.Substr(d.MessageID, 0, 64), d.Type, d.Request, d.Error, d.Attempts, d.Failed.UTC())
+	if err != nil {
+		return err
+	}
+	d.ID, err = res.LastInsertId()
+	return err
+}
+
+// DeadLetters of the team by its external ID, the latest first
+func (r *MySQL) DeadLetters(team string, limit int) ([]domain.DeadLetter, error) {
+	letters := make([]domain.DeadLetter, 0)
+	err := r.db.Select(&letters, "SELECT id, team, message_id, type, request, error, attempts, failed FROM dead_letters WHERE team = ? ORDER BY failed DESC, id DESC LIMIT ?", team, limit)
+	return letters, err
+}
+
+// DeadLetter of the team by its ID, nil if the team has no such letter
+func (r *MySQL) DeadLetter(team string, id int64) (*domain.DeadLetter, error) {
+	d := &domain.DeadLetter{}
+	err := r.db.Get(d, "SELECT id, team, message_id, type, request, error, attempts, failed FROM dead_letters WHERE team = ? AND id = ?", team, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DeleteDeadLetter after it was driven again
+func (r *MySQL) DeleteDeadLetter(team string, id int64) error {
+	_, err := r.db.Exec("DELETE FROM dead_letters WHERE team = ? AND id = ?", team, id)
+	return err
+}
+
+// EmailAlerts returns who gets an email about the verdicts of the team, nil if nobody
+func (r *MySQL) EmailAlerts(team string) (*domain.EmailAlerts, error) {
+	var row struct {
+		Recipients string
+		Threshold  string
+	}
+	err := r.db.Get(&row, "SELECT recipients, threshold FROM email_alerts WHERE team = ?", team)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &domain.EmailAlerts{Team: team, Recipients: strings.Split(row.Recipients, ","), Threshold: row.Threshold}, nil
+}
+
+// SetEmailAlerts stores who gets an email about the verdicts of the team
+func (r *MySQL) SetEmailAlerts(alerts *domain.EmailAlerts) error {
+	recipients := strings.Join(alerts.Recipients, ",")
+	_, err := r.db.Exec("INSERT INTO email_alerts (team, recipients, threshold) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE recipients = ?, threshold = ?",
+		alerts.Team, recipients, alerts.Threshold, recipients, alerts.Threshold)
+	return err
+}
+
+// DeleteEmailAlerts stops the emails about the verdicts of the team
+func (r *MySQL) DeleteEmailAlerts(team string) error {
+	_, err := r.db.Exec("DELETE FROM email_alerts WHERE team = ?", team)
+	return err
+}
+
+func (r *MySQL) JoinSlackChannel(email string) error {
+	_, err := r.db.Exec("INSERT INTO slack_invites (email, ts, invited) VALUES (?, now(), 0)", email)
+	if err != nil {
+		switch err := err.(type) {
+		case *mysql.MySQLError:
+			// Duplicate key might happen but it's fine
+			if err.Number == 1062 {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+func (r *MySQL) QueueMessages(names []string, messageType string) (messages []*domain.DBQueueMessage, err error) {
+	query := "SELECT id, name, message_type, message, ts FROM queue WHERE message_type = ?"
 	args := []interface{}{messageType}
 	if len(names) > 0 {
 		query = "SELECT id, name, message_type, message, ts FROM queue WHERE message_type = ? AND name IN (?" + strings.Repeat(",?", len(names)-1) + ")"
@@ -769,3 +2021,120 @@ func (r *MySQL) PostMessageToAll(message *domain.DBQueueMessage) error {
 		message.MessageType, message.Message)
 	return err
 }
+
+// MoveQueueMessages passes the messages of the type from one name to another and returns how many were moved
+func (r *MySQL) MoveQueueMessages(from, to, messageType string) (int64, error) {
+	res, err := r.db.Exec("UPDATE queue SET name = ? WHERE name = ? AND message_type = ?", to, from, messageType)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteQueueMessages deletes all the messages of the name
+func (r *MySQL) DeleteQueueMessages(name string) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM queue WHERE name = ?", name)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ReserveQueueMessages reserves up to limit messages of the type for the owner until visibility from now. Unlike
+// QueueMessages the messages stay in the queue until the owner acknowledges them. The attempts of the messages are the
+// number of times they were reserved before.
+func (r *MySQL) ReserveQueueMessages(messageType, owner string, limit int, visibility time.Duration) ([]*domain.DBQueueMessage, error) {
+	var candidates []*domain.DBQueueMessage
+	err := r.db.Select(&candidates, "SELECT id, name, message_type, message, ts, attempts FROM queue WHERE message_type = ? AND reserved_by = '' ORDER BY id LIMIT ?",
+		messageType, limit)
+	if err != nil {
+		return nil, err
+	}
+	var messages []*domain.DBQueueMessage
+	for _, m := range candidates {
+		// Another owner might reserve it first
+		res, err := r.db.Exec("UPDATE queue SET reserved_by = ?, reserved_until = DATE_ADD(now(6), INTERVAL ? MICROSECOND), attempts = attempts + 1 WHERE id = ? AND reserved_by = ''",
+			owner, visibility.Nanoseconds()/1000, m.ID)
+		if err != nil {
+			return messages, err
+		}
+		if rows, err := res.RowsAffected(); err == nil && rows == 1 {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+// RenewQueueMessage extends the reservation of the message until visibility from now. It returns false if the owner
+// lost the reservation.
+func (r *MySQL) RenewQueueMessage(id int64, owner string, visibility time.Duration) (bool, error) {
+	res, err := r.db.Exec("UPDATE queue SET reserved_until = DATE_ADD(now(6), INTERVAL ? MICROSECOND) WHERE id = ? AND reserved_by = ?",
+		visibility.Nanoseconds()/1000, id, owner)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows == 1, err
+}
+
+// AckQueueMessage deletes the message the owner reserved, ErrNotFound if the reservation is gone
+func (r *MySQL) AckQueueMessage(id int64, owner string) error {
+	res, err := r.db.Exec("DELETE FROM queue WHERE id = ? AND reserved_by = ?", id, owner)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// NackQueueMessage returns the message the owner reserved to the queue after the delay, ErrNotFound if the reservation
+// is gone. A delayed message stays reserved until ReleaseExpiredQueueMessages returns it.
+func (r *MySQL) NackQueueMessage(id int64, owner string, delay time.Duration) error {
+	query, args := "UPDATE queue SET reserved_by = '', reserved_until = NULL WHERE id = ? AND reserved_by = ?", []interface{}{id, owner}
+	if delay > 0 {
+		query = "UPDATE queue SET reserved_until = DATE_ADD(now(6), INTERVAL ? MICROSECOND) WHERE id = ? AND reserved_by = ?"
+		args = append([]interface{}{delay.Nanoseconds() / 1000}, args...)
+	}
+	res, err := r.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// BuryQueueMessage moves the message the owner reserved to the dead messages nobody reserves, ErrNotFound if the
+// reservation is gone
+func (r *MySQL) BuryQueueMessage(id int64, owner string) error {
+	res, err := r.db.Exec("UPDATE queue SET message_type = 'dead', reserved_by = '', reserved_until = NULL WHERE id = ? AND reserved_by = ?", id, owner)
+	if err != nil {
+		return err
+	}
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// QueueLanes counts the messages of each type waiting and reserved in the queue, the age of the oldest waiting one
+// by the clock of the database
+func (r *MySQL) QueueLanes() ([]*domain.QueueLane, error) {
+	var lanes []*domain.QueueLane
+	err := r.db.Select(&lanes, `SELECT message_type AS lane, SUM(reserved_by = '') AS depth, SUM(reserved_by <> '') AS in_flight,
+COALESCE(TIMESTAMPDIFF(SECOND, MIN(CASE WHEN reserved_by = '' THEN ts END), now()), 0) AS oldest
+FROM queue GROUP BY message_type ORDER BY message_type`)
+	return lanes, err
+}
+
+// ReleaseExpiredQueueMessages returns the messages whose reservation expired to the queue
+func (r *MySQL) ReleaseExpiredQueueMessages() (int64, error) {
+	res, err := r.db.Exec("UPDATE queue SET reserved_by = '', reserved_until = NULL WHERE reserved_by <> '' AND reserved_until < now(6)")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -3,6 +3,9 @@
 package repo
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,13 +22,29 @@ func getTestDB(t *testing.T) *MySQL {
 		t.Fatalf("%v", err)
 	}
 	db.db.Exec("DELETE FROM queue")
+	db.db.Exec("DELETE FROM leases")
+	db.db.Exec("DELETE FROM webhooks")
+	db.db.Exec("DELETE FROM sandboxes")
+	db.db.Exec("DELETE FROM sandbox_runs")
+	db.db.Exec("DELETE FROM dead_letters")
+	db.db.Exec("DELETE FROM email_alerts")
 	db.db.Exec("DELETE FROM convicted")
+	db.db.Exec("DELETE FROM false_positives")
+	db.db.Exec("DELETE FROM scan_history")
+	db.db.Exec("DELETE FROM digests")
+	db.db.Exec("DELETE FROM weekly_reports")
+	db.db.Exec("DELETE FROM greeted_channels")
+	db.db.Exec("DELETE FROM welcomed_users")
+	db.db.Exec("DELETE FROM stored_replies")
 	db.db.Exec("DELETE FROM slack_invites")
 	db.db.Exec("DELETE FROM team_statistics")
+	db.db.Exec("DELETE FROM team_statistics_daily")
+	db.db.Exec("DELETE FROM channel_statistics_daily")
 	db.db.Exec("DELETE FROM bot_for_team")
 	db.db.Exec("DELETE FROM bots")
 	db.db.Exec("DELETE FROM configuration")
 	db.db.Exec("DELETE FROM oauth_state")
+	db.db.Exec("DELETE FROM team_keys")
 	db.db.Exec("DELETE FROM users")
 	db.db.Exec("DELETE FROM teams")
 	return db
@@ -165,3 +184,781 @@ func TestQueueMessages(t *testing.T) {
 		t.Errorf("Got messages but expecting none after delete")
 	}
 }
+
+func TestStatisticsForTeamSince(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	stats, err := r.StatisticsForTeamSince("xxx", time.Now())
+	if err != nil {
+		t.Fatalf("Unable to load empty statistics - %v", err)
+	}
+	if stats.HasSomething() {
+		t.Errorf("Expected no statistics but got %+v", stats)
+	}
+	for i := 0; i < 2; i++ {
+		if err = r.UpdateStatistics(&domain.Statistics{Team: "xxx", Messages: 3, URLsDirty: 1}); err != nil {
+			t.Fatalf("Unable to update statistics - %v", err)
+		}
+	}
+	stats, err = r.StatisticsForTeamSince("xxx", time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatalf("Unable to load statistics - %v", err)
+	}
+	if stats.Messages != 6 || stats.URLsDirty != 2 {
+		t.Errorf("Unexpected statistics %+v", stats)
+	}
+}
+
+func TestFalsePositives(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	for _, indicator := range []string{"a.com", "b.com", "c.com"} {
+		fp := &domain.FalsePositive{Team: "xxx", User: "U1", Indicator: indicator, Comment: "internal"}
+		if err := r.StoreFalsePositive(fp); err != nil || fp.ID == 0 {
+			t.Fatalf("Unable to store false positive - %v", err)
+		}
+	}
+	fps, total, err := r.FalsePositives("xxx", 2, 2)
+	if err != nil {
+		t.Fatalf("Unable to load false positives - %v", err)
+	}
+	if total != 3 || len(fps) != 1 || fps[0].Indicator != "a.com" {
+		t.Errorf("Unexpected false positives %d %+v", total, fps)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	last, err := r.LastDigest("xxx")
+	if err != nil || !last.IsZero() {
+		t.Fatalf("Expected no digest but got %v - %v", last, err)
+	}
+	now := time.Now().Truncate(time.Second)
+	if err = r.SetLastDigest("xxx", now); err != nil {
+		t.Fatalf("Unable to set last digest - %v", err)
+	}
+	if last, err = r.LastDigest("xxx"); err != nil || !last.Equal(now) {
+		t.Errorf("Expected last digest %v but got %v - %v", now, last, err)
+	}
+	for i, content := range []string{"http://a.com", "http://b.com", "http://b.com"} {
+		if err = r.StoreMaliciousContent(&domain.MaliciousContent{Team: "xxx", Channel: "C1", MessageID: strconv.Itoa(i), ContentType: domain.ReplyTypeURL, Content: content}); err != nil {
+			t.Fatalf("Unable to store convicted - %v", err)
+		}
+	}
+	digest, err := r.DigestForTeamSince("xxx", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to load digest - %v", err)
+	}
+	if len(digest.Malicious) != 2 || digest.Malicious[0].Content != "http://b.com" || digest.Malicious[0].Count != 2 {
+		t.Errorf("Unexpected digest findings %+v", digest.Malicious)
+	}
+}
+
+func TestWeeklyReport(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	stats := &domain.Statistics{Team: "xxx", URLsDirty: 1}
+	for _, ch := range []string{"C1", "C2", "C2", "D1"} {
+		stats.CountMessage(ch)
+	}
+	if err := r.UpdateStatistics(stats); err != nil {
+		t.Fatalf("Unable to update statistics - %v", err)
+	}
+	report, err := r.WeeklyReportForTeam("xxx", time.Now().AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Unable to load weekly report - %v", err)
+	}
+	if report.Current.Messages != 4 || report.Previous.HasSomething() {
+		t.Errorf("Unexpected statistics %+v %+v", report.Current, report.Previous)
+	}
+	if len(report.Busiest) != 2 || report.Busiest[0].Channel != "C2" || report.Busiest[0].Messages != 2 {
+		t.Errorf("Unexpected busiest channels %+v", report.Busiest)
+	}
+	now := time.Now().Truncate(time.Second)
+	if err = r.SetLastWeeklyReport("xxx", now); err != nil {
+		t.Fatalf("Unable to set last weekly report - %v", err)
+	}
+	if last, err := r.LastWeeklyReport("xxx"); err != nil || !last.Equal(now) {
+		t.Errorf("Expected last weekly report %v but got %v - %v", now, last, err)
+	}
+}
+
+func TestStatisticsForChannel(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	stats := &domain.Statistics{Team: "xxx", URLsDirty: 1, IPsClean: 2}
+	stats.CountMessage("C1")
+	stats.CountMessage("C2")
+	c := stats.Channel("C1")
+	c.URLs, c.IPs, c.Malicious = 1, 2, 1
+	for i := 0; i < 2; i++ {
+		if err := r.UpdateStatistics(stats); err != nil {
+			t.Fatalf("Unable to update statistics - %v", err)
+		}
+	}
+	channel, err := r.StatisticsForChannelSince("xxx", "C1", time.Now())
+	if err != nil {
+		t.Fatalf("Unable to load channel statistics - %v", err)
+	}
+	if channel.Messages != 2 || channel.URLs != 2 || channel.IPs != 4 || channel.Malicious != 2 {
+		t.Errorf("Unexpected channel statistics %+v", channel)
+	}
+	team, err := r.StatisticsForTeamSince("xxx", time.Now())
+	if err != nil || team.Messages != 4 || team.URLsDirty != 2 {
+		t.Errorf("Unexpected team statistics %+v - %v", team, err)
+	}
+}
+
+func TestSetTeamStatus(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if err := r.SetTeamStatus("xxx", domain.UserStatusInactive); err != nil {
+		t.Fatalf("Unable to set team status - %v", err)
+	}
+	team, err := r.Team("xxx")
+	if err != nil || team.Installed() {
+		t.Errorf("Expected an inactive team but got %+v - %v", team, err)
+	}
+}
+
+func TestSetTeamLocale(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if err := r.SetTeamLocale("xxx", "es"); err != nil {
+		t.Fatalf("Unable to set team locale - %v", err)
+	}
+	// Saving the team again, e.g. on a re-install, keeps the locale
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to update team - %v", err)
+	}
+	team, err := r.Team("xxx")
+	if err != nil || team.Locale != "es" {
+		t.Errorf("Expected locale es but got %+v - %v", team, err)
+	}
+}
+
+func TestSetTeamXSOAR(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if err := r.SetTeamXSOAR(&domain.Team{ID: "xxx", XSOARURL: "https://xsoar.example.com", XSOARKey: "key", XSOARIncidentType: "Phishing"}); err != nil {
+		t.Fatalf("Unable to set XSOAR - %v", err)
+	}
+	var stored string
+	if err := r.db.Get(&stored, "SELECT xsoar_key FROM teams WHERE id = ?", "xxx"); err != nil || stored == "key" {
+		t.Errorf("Expected the key to be encrypted but got %s - %v", stored, err)
+	}
+	// Saving the team again, e.g. on a re-install, keeps the server
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to update team - %v", err)
+	}
+	team, err := r.Team("xxx")
+	if err != nil || team.XSOARURL != "https://xsoar.example.com" || team.XSOARKey != "key" || team.XSOARIncidentType != "Phishing" {
+		t.Errorf("Expected the XSOAR server but got %+v - %v", team, err)
+	}
+}
+
+func TestSetTeamCredentials(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	tests := []struct {
+		source string
+		creds  domain.Credentials
+	}{
+		{domain.SourceVT, domain.Credentials{Key: "vt-key"}},
+		{domain.SourceXFE, domain.Credentials{Key: "xfe-key", Password: "xfe-pass"}},
+		{domain.SourceAbuseIPDB, domain.Credentials{Key: "abuseipdb-key"}},
+		{domain.SourceOTX, domain.Credentials{Key: "otx-key"}},
+		{domain.SourceHIBP, domain.Credentials{Key: "hibp-key"}},
+	}
+	for _, test := range tests {
+		if err := r.SetTeamCredentials("xxx", test.source, test.creds); err != nil {
+			t.Fatalf("Unable to set the %s key - %v", test.source, err)
+		}
+	}
+	var stored []string
+	if err := r.db.Select(&stored, "SELECT api_key FROM team_keys WHERE team = ?", "xxx"); err != nil || len(stored) != 3 || util.In(stored, "otx-key") {
+		t.Errorf("Expected the keys to be encrypted but got %v - %v", stored, err)
+	}
+	// Saving the team again, e.g. on a re-install, keeps the keys
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to update team - %v", err)
+	}
+	team, err := r.Team("xxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	teams, err := r.Teams()
+	if err != nil || len(teams) != 1 {
+		t.Fatalf("Expected the team but got %v - %v", teams, err)
+	}
+	for _, test := range tests {
+		if creds := team.Credentials()[test.source]; creds != test.creds {
+			t.Errorf("Expected the %s credentials but got %+v", test.source, creds)
+		}
+		if creds := teams[0].Credentials()[test.source]; creds != test.creds {
+			t.Errorf("Expected the %s credentials of all the teams but got %+v", test.source, creds)
+		}
+		if err = r.SetTeamCredentials("xxx", test.source, domain.Credentials{}); err != nil {
+			t.Fatalf("Unable to clear the %s key - %v", test.source, err)
+		}
+	}
+	if team, err = r.Team("xxx"); err != nil || len(team.Credentials()) != 0 {
+		t.Errorf("Expected the keys to be cleared but got %+v - %v", team, err)
+	}
+	if err = r.SetTeamCredentials("xxx", domain.SourceURLhaus, domain.Credentials{Key: "key"}); err == nil {
+		t.Error("Expected an error for a source without keys")
+	}
+}
+
+func TestScoringProfile(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	scoring := domain.ScoringProfile{Weights: map[string]float64{domain.SourceXFE: 0.5, domain.SourceOTX: 0}, Malicious: 1.5}
+	if err := r.SetChannelsAndGroups(&domain.Configuration{Team: "xxx", Scoring: scoring}); err != nil {
+		t.Fatalf("Unable to save the configuration - %v", err)
+	}
+	c, err := r.ChannelsAndGroups("xxx")
+	if err != nil || c.Scoring.Weights[domain.SourceXFE] != 0.5 || len(c.Scoring.Weights) != 2 ||
+		c.Scoring.Malicious != 1.5 || c.Scoring.Suspicious != 0 {
+		t.Errorf("Expected the scoring profile but got %+v - %v", c.Scoring, err)
+	}
+	// Ignored sources are kept with their weight of 0
+	if w, ok := c.Scoring.Weights[domain.SourceOTX]; !ok || w != 0 {
+		t.Errorf("Expected OTX to be ignored but got %v", c.Scoring.Weights)
+	}
+}
+
+func TestInternalDomains(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	internal := []string{"corp.example.com", "intra.example.net"}
+	if err := r.SetChannelsAndGroups(&domain.Configuration{Team: "xxx", InternalDomains: internal, Whitelist: []string{"example.org"}}); err != nil {
+		t.Fatalf("Unable to save the configuration - %v", err)
+	}
+	c, err := r.ChannelsAndGroups("xxx")
+	if err != nil || len(c.InternalDomains) != 2 || !util.In(c.InternalDomains, internal[0]) || !util.In(c.InternalDomains, internal[1]) ||
+		len(c.Whitelist) != 1 {
+		t.Errorf("Expected the internal domains but got %+v - %v", c, err)
+	}
+}
+
+func TestSourceBreakers(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	until := time.Now().Add(time.Minute).Truncate(time.Second)
+	if err := r.SetSourceBreaker(&domain.SourceBreaker{Breaker: "vt", Source: "vt", State: domain.BreakerOpen, Failures: 5, Error: "down", OpenUntil: until}); err != nil {
+		t.Fatalf("Unable to store the breaker - %v", err)
+	}
+	breakers, err := r.SourceBreakers(time.Now())
+	if err != nil || len(breakers) != 1 || breakers[0].Failures != 5 || !breakers[0].OpenUntil.Equal(until) {
+		t.Errorf("Expected the breaker but got %+v - %v", breakers, err)
+	}
+	if breakers, err = r.SourceBreakers(until); err != nil || len(breakers) != 0 {
+		t.Errorf("Expected no breakers open after %v but got %+v - %v", until, breakers, err)
+	}
+	if err = r.DeleteSourceBreaker("vt"); err != nil {
+		t.Fatal(err)
+	}
+	if breakers, err = r.SourceBreakers(time.Now()); err != nil || len(breakers) != 0 {
+		t.Errorf("Expected the breaker to be deleted but got %+v - %v", breakers, err)
+	}
+}
+
+func TestMarkGreeted(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	for i, expected := range []bool{true, false} {
+		first, err := r.MarkGreeted("xxx", "C1")
+		if err != nil || first != expected {
+			t.Errorf("Attempt %d - expected %v but got %v - %v", i, expected, first, err)
+		}
+	}
+}
+
+func TestStoredReplies(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	id, err := r.StoreReply("xxx", &domain.WorkReply{MessageID: "1.1", IPs: []domain.IPReply{{Details: "8.8.8.8", Result: domain.ResultClean}}})
+	if err != nil {
+		t.Fatalf("Unable to store reply - %v", err)
+	}
+	reply, err := r.StoredReply("xxx", id)
+	if err != nil || reply.MessageID != "1.1" || len(reply.IPs) != 1 || reply.IPs[0].Details != "8.8.8.8" {
+		t.Errorf("Expected the stored reply but got %+v - %v", reply, err)
+	}
+	if _, err = r.StoredReply("other", id); err != ErrNotFound {
+		t.Errorf("Expected other teams not to see the reply but got %v", err)
+	}
+	if err = r.DeleteStoredReplies(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Unable to delete stored replies - %v", err)
+	}
+	if _, err = r.StoredReply("xxx", id); err != ErrNotFound {
+		t.Errorf("Expected the reply to be deleted but got %v", err)
+	}
+}
+
+func TestMarkWelcomed(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	for i, expected := range []bool{true, false} {
+		first, err := r.MarkWelcomed("xxx", "U1")
+		if err != nil || first != expected {
+			t.Errorf("Attempt %d - expected %v but got %v - %v", i, expected, first, err)
+		}
+	}
+}
+
+func TestSeedWelcomed(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if err := r.StoreScans([]domain.ScanRecord{{Team: "xxx", Channel: "C1", User: "U1", Indicator: "8.8.8.8"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedWelcomed(r.db); err != nil {
+		t.Fatal(err)
+	}
+	if first, err := r.MarkWelcomed("xxx", "U1"); err != nil || first {
+		t.Errorf("Expected the user we scanned to be welcomed - %v", err)
+	}
+	// Once anyone is welcomed the seed does not run again
+	r.db.Exec("DELETE FROM scan_history")
+	r.StoreScans([]domain.ScanRecord{{Team: "xxx", Channel: "C1", User: "U2", Indicator: "8.8.8.8"}})
+	if err := seedWelcomed(r.db); err != nil {
+		t.Fatal(err)
+	}
+	if first, err := r.MarkWelcomed("xxx", "U2"); err != nil || !first {
+		t.Errorf("Expected a new user to be welcomed once - %v", err)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	ok, err := r.AcquireLease("job", "host1", 200*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("Unable to acquire a free lease - %v", err)
+	}
+	if ok, err = r.AcquireLease("job", "host2", time.Minute); err != nil || ok {
+		t.Errorf("Expected the lease to be held by host1 - %v", err)
+	}
+	if ok, err = r.AcquireLease("job", "host1", 200*time.Millisecond); err != nil || !ok {
+		t.Errorf("Expected the owner to acquire its own lease again - %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if ok, err = r.AcquireLease("job", "host2", time.Minute); err != nil || !ok {
+		t.Errorf("Expected host2 to take over the expired lease - %v", err)
+	}
+	if ok, err = r.RenewLease("job", "host1", time.Minute); err != nil || ok {
+		t.Errorf("Expected host1 to lose the lease - %v", err)
+	}
+	if ok, err = r.RenewLease("job", "host2", time.Minute); err != nil || !ok {
+		t.Errorf("Expected host2 to renew the lease - %v", err)
+	}
+	if err = r.ReleaseLease("job", "host2"); err != nil {
+		t.Errorf("Unable to release the lease - %v", err)
+	}
+	if ok, err = r.AcquireLease("job", "host1", time.Minute); err != nil || !ok {
+		t.Errorf("Expected host1 to acquire the released lease - %v", err)
+	}
+}
+
+func TestLeaseRace(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	const instances = 10
+	results := make(chan bool, instances)
+	for i := 0; i < instances; i++ {
+		go func(owner string) {
+			ok, err := r.AcquireLease("race", owner, time.Minute)
+			if err != nil {
+				t.Errorf("Unable to acquire lease - %v", err)
+			}
+			results <- ok
+		}("host" + strconv.Itoa(i))
+	}
+	won := 0
+	for i := 0; i < instances; i++ {
+		if <-results {
+			won++
+		}
+	}
+	if won != 1 {
+		t.Errorf("Expected a single owner but got %d", won)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if hook, err := r.Webhook("xxx"); err != nil || hook != nil {
+		t.Fatalf("Expected no webhook but got %+v - %v", hook, err)
+	}
+	hook := &domain.Webhook{Team: "xxx", URL: "https://siem.example.com/alfred", Secret: "s3cr3t", Threshold: domain.ThresholdMalicious}
+	if err := r.SetWebhook(hook); err != nil {
+		t.Fatalf("Unable to store webhook - %v", err)
+	}
+	hook.Threshold = domain.ThresholdSuspicious
+	if err := r.SetWebhook(hook); err != nil {
+		t.Fatalf("Unable to update webhook - %v", err)
+	}
+	saved, err := r.Webhook("xxx")
+	if err != nil || saved == nil || *saved != *hook {
+		t.Fatalf("Expected %+v but got %+v - %v", hook, saved, err)
+	}
+	if err = r.DeleteWebhook("xxx"); err != nil {
+		t.Fatalf("Unable to delete webhook - %v", err)
+	}
+	if saved, err = r.Webhook("xxx"); err != nil || saved != nil {
+		t.Errorf("Expected the webhook to be deleted but got %+v - %v", saved, err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if s, err := r.Sandbox("xxx"); err != nil || s != nil {
+		t.Fatalf("Expected no sandbox but got %+v - %v", s, err)
+	}
+	s := &domain.Sandbox{Team: "xxx", URL: "https://cuckoo.example.com:8090", Key: "k3y", MaxSize: 1024, Enabled: true}
+	if err := r.SetSandbox(s); err != nil {
+		t.Fatalf("Unable to store sandbox - %v", err)
+	}
+	s.Enabled = false
+	if err := r.SetSandbox(s); err != nil {
+		t.Fatalf("Unable to update sandbox - %v", err)
+	}
+	saved, err := r.Sandbox("xxx")
+	if err != nil || saved == nil || *saved != *s {
+		t.Fatalf("Expected %+v but got %+v - %v", s, saved, err)
+	}
+	if err = r.DeleteSandbox("xxx"); err != nil {
+		t.Fatalf("Unable to delete sandbox - %v", err)
+	}
+	if saved, err = r.Sandbox("xxx"); err != nil || saved != nil {
+		t.Errorf("Expected the sandbox to be deleted but got %+v - %v", saved, err)
+	}
+}
+
+func TestSandboxRuns(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if run, err := r.StartSandboxRun("abc", time.Now().Add(time.Hour)); err != nil || run != nil {
+		t.Fatalf("Expected to claim the run but got %+v - %v", run, err)
+	}
+	if run, err := r.StartSandboxRun("abc", time.Now().Add(time.Hour)); err != nil || run == nil || run.Reply != nil {
+		t.Fatalf("Expected the running run but got %+v - %v", run, err)
+	}
+	if err := r.FinishSandboxRun("abc", &domain.SandboxReply{Result: domain.ResultDirty, Task: 7}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if run, err := r.StartSandboxRun("abc", time.Now().Add(time.Hour)); err != nil || run == nil || run.Reply == nil || run.Reply.Task != 7 {
+		t.Errorf("Expected the verdict of the run but got %+v - %v", run, err)
+	}
+	// Failed runs are released and expired ones taken over
+	if err := r.FinishSandboxRun("abc", nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if run, err := r.StartSandboxRun("abc", time.Now().Add(-time.Minute)); err != nil || run != nil {
+		t.Errorf("Expected to claim the released run but got %+v - %v", run, err)
+	}
+	if run, err := r.StartSandboxRun("abc", time.Now().Add(time.Hour)); err != nil || run != nil {
+		t.Errorf("Expected to take the expired run over but got %+v - %v", run, err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	request := &domain.WorkRequest{Type: "message", MessageID: "1.1", IPs: []string{"8.8.8.8"}, Attempts: 3,
+		Context: &domain.Context{Team: "yyy", Channel: "C1"}, Credentials: map[string]domain.Credentials{"vt": {Key: "secret"}}}
+	d, err := domain.NewDeadLetter(request, errors.New("boom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.AddDeadLetter(d); err != nil || d.ID == 0 {
+		t.Fatalf("Unable to store the dead letter - %v", err)
+	}
+	letters, err := r.DeadLetters("yyy", 10)
+	if err != nil || len(letters) != 1 || letters[0].ID != d.ID || letters[0].Error != "boom" || letters[0].Attempts != 3 {
+		t.Fatalf("Unexpected dead letters %+v - %v", letters, err)
+	}
+	// Other teams do not see it
+	if saved, err := r.DeadLetter("zzz", d.ID); err != nil || saved != nil {
+		t.Fatalf("Expected no dead letter for another team but got %+v - %v", saved, err)
+	}
+	saved, err := r.DeadLetter("yyy", d.ID)
+	if err != nil || saved == nil {
+		t.Fatalf("Unable to load the dead letter - %v", err)
+	}
+	again, err := saved.WorkRequest()
+	if err != nil || again.MessageID != "1.1" || again.Attempts != 0 || again.Credentials["vt"].Key != "secret" {
+		t.Fatalf("Unexpected request %+v - %v", again, err)
+	}
+	if err = r.DeleteDeadLetter("yyy", d.ID); err != nil {
+		t.Fatalf("Unable to delete the dead letter - %v", err)
+	}
+	if letters, err = r.DeadLetters("yyy", 10); err != nil || len(letters) != 0 {
+		t.Errorf("Expected the dead letter to be deleted but got %+v - %v", letters, err)
+	}
+}
+
+func TestBotsAndReplyQueues(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.BotHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.db.Exec("INSERT INTO bots (bot, ts) VALUES ('bot-old', ?)", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	bots, err := r.Bots(5 * time.Minute)
+	if err != nil || len(bots) != 2 || bots[0].Bot != "bot-old" || !bots[0].Stale || bots[1].Stale {
+		t.Fatalf("Unexpected bots %+v - %v", bots, err)
+	}
+	for _, m := range []*domain.DBQueueMessage{{Name: "bot-old", MessageType: "workr", Message: "reply"}, {Name: "bot-old", MessageType: "conf", Message: "T1"}} {
+		if err = r.PostMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if moved, err := r.MoveQueueMessages("bot-old", util.Hostname, "workr"); err != nil || moved != 1 {
+		t.Fatalf("Expected the reply to be moved but got %d - %v", moved, err)
+	}
+	if deleted, err := r.DeleteQueueMessages("bot-old"); err != nil || deleted != 1 {
+		t.Fatalf("Expected the configuration change to be deleted but got %d - %v", deleted, err)
+	}
+	if err = r.DeleteBot("bot-old"); err != nil {
+		t.Fatal(err)
+	}
+	if bots, err = r.Bots(5 * time.Minute); err != nil || len(bots) != 1 {
+		t.Errorf("Expected the old bot to be gone but got %+v - %v", bots, err)
+	}
+}
+
+func TestQueueLanes(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	for _, m := range []*domain.DBQueueMessage{{Name: "host1", MessageType: "work", Message: "first"}, {Name: "host1", MessageType: "work", Message: "second"},
+		{Name: "host1", MessageType: "workr", Message: "reply"}} {
+		if err := r.PostMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.db.Exec("UPDATE queue SET ts = ? WHERE message = 'first'", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReserveQueueMessages("work", "host1", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	lanes, err := r.QueueLanes()
+	if err != nil || len(lanes) != 2 {
+		t.Fatalf("Unexpected lanes %+v - %v", lanes, err)
+	}
+	// The reserved message is in flight so the oldest waiting one is the second
+	if work := lanes[0]; work.Lane != "work" || work.Depth != 1 || work.InFlight != 1 || work.Oldest > 60 {
+		t.Errorf("Unexpected work lane %+v", work)
+	}
+	if reply := lanes[1]; reply.Lane != "workr" || reply.Depth != 1 || reply.InFlight != 0 {
+		t.Errorf("Unexpected reply lane %+v", reply)
+	}
+}
+
+func TestSystemAdmin(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeamAndUser(&domain.Team{ID: "t1", Name: "test-team", ExternalID: "te1"}, &domain.User{ID: "u1", Team: "t1", Name: "test-user", ExternalID: "ue1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.db.Exec("UPDATE users SET is_system_admin = 1 WHERE id = 'u1'"); err != nil {
+		t.Fatal(err)
+	}
+	// Logging in again keeps the flag, it is only granted in the database
+	if err := r.SetUser(&domain.User{ID: "u1", Team: "t1", Name: "renamed", ExternalID: "ue1"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := r.User("u1"); err != nil || !u.IsSystemAdmin || u.Name != "renamed" {
+		t.Errorf("Expected the user to stay a system admin but got %+v - %v", u, err)
+	}
+}
+
+func TestQueueReservations(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	for _, m := range []string{"first", "second"} {
+		if err := r.PostMessage(&domain.DBQueueMessage{Name: "host1", MessageType: "work", Message: m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reserved, err := r.ReserveQueueMessages("work", "host1", 10, 200*time.Millisecond)
+	if err != nil || len(reserved) != 2 || reserved[0].Message != "first" {
+		t.Fatalf("Unexpected reserved messages %+v - %v", reserved, err)
+	}
+	// Another worker does not get them while they are reserved
+	if others, err := r.ReserveQueueMessages("work", "host2", 10, time.Minute); err != nil || len(others) != 0 {
+		t.Fatalf("Expected no messages for the other worker but got %+v - %v", others, err)
+	}
+	if err = r.AckQueueMessage(reserved[0].ID, "host2"); err != ErrNotFound {
+		t.Errorf("Expected the other worker not to acknowledge the message but got %v", err)
+	}
+	if err = r.AckQueueMessage(reserved[0].ID, "host1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.NackQueueMessage(reserved[1].ID, "host1", 0); err != nil {
+		t.Fatal(err)
+	}
+	// host2 takes the returned message and crashes so it goes back to the queue after its reservation
+	if reserved, err = r.ReserveQueueMessages("work", "host2", 10, 100*time.Millisecond); err != nil || len(reserved) != 1 || reserved[0].Message != "second" {
+		t.Fatalf("Expected the returned message but got %+v - %v", reserved, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if released, err := r.ReleaseExpiredQueueMessages(); err != nil || released != 1 {
+		t.Fatalf("Expected the expired reservation to be released but got %d - %v", released, err)
+	}
+	if ok, err := r.RenewQueueMessage(reserved[0].ID, "host2", time.Minute); err != nil || ok {
+		t.Errorf("Expected the crashed worker to lose the reservation but got %v - %v", ok, err)
+	}
+	if reserved, err = r.ReserveQueueMessages("work", "host1", 10, time.Minute); err != nil || len(reserved) != 1 || reserved[0].Attempts != 2 {
+		t.Fatalf("Expected the message of the crashed worker but got %+v - %v", reserved, err)
+	}
+	// A delayed message stays hidden until it is released
+	if err = r.NackQueueMessage(reserved[0].ID, "host1", 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if others, err := r.ReserveQueueMessages("work", "host2", 10, time.Minute); err != nil || len(others) != 0 {
+		t.Fatalf("Expected the delayed message to be hidden but got %+v - %v", others, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if released, err := r.ReleaseExpiredQueueMessages(); err != nil || released != 1 {
+		t.Fatalf("Expected the delayed message to be released but got %d - %v", released, err)
+	}
+	if reserved, err = r.ReserveQueueMessages("work", "host2", 10, time.Minute); err != nil || len(reserved) != 1 || reserved[0].Attempts != 3 {
+		t.Fatalf("Expected the delayed message but got %+v - %v", reserved, err)
+	}
+	// The dead message is not reserved again
+	if err = r.BuryQueueMessage(reserved[0].ID, "host2"); err != nil {
+		t.Fatal(err)
+	}
+	if others, err := r.ReserveQueueMessages("work", "host1", 10, time.Minute); err != nil || len(others) != 0 {
+		t.Errorf("Expected the dead message to stay but got %+v - %v", others, err)
+	}
+}
+
+func TestEmailAlerts(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	if alerts, err := r.EmailAlerts("xxx"); err != nil || alerts != nil {
+		t.Fatalf("Expected no alerts but got %+v - %v", alerts, err)
+	}
+	alerts := &domain.EmailAlerts{Team: "xxx", Recipients: []string{"ciso@example.com", "soc@example.com"}, Threshold: domain.ThresholdSuspicious}
+	if err := r.SetEmailAlerts(alerts); err != nil {
+		t.Fatalf("Unable to store alerts - %v", err)
+	}
+	saved, err := r.EmailAlerts("xxx")
+	if err != nil || saved == nil || len(saved.Recipients) != 2 || saved.Recipients[1] != "soc@example.com" || saved.Threshold != domain.ThresholdSuspicious {
+		t.Fatalf("Expected %+v but got %+v - %v", alerts, saved, err)
+	}
+	if err = r.DeleteEmailAlerts("xxx"); err != nil {
+		t.Fatalf("Unable to delete alerts - %v", err)
+	}
+	if saved, err = r.EmailAlerts("xxx"); err != nil || saved != nil {
+		t.Errorf("Expected the alerts to be deleted but got %+v - %v", saved, err)
+	}
+}
+
+func TestScanHistory(t *testing.T) {
+	r := getTestDB(t)
+	defer r.Close()
+	if err := r.SetTeam(&domain.Team{ID: "xxx", Name: "test", ExternalID: "yyy"}); err != nil {
+		t.Fatalf("Unable to create team - %v", err)
+	}
+	err := r.StoreScans([]domain.ScanRecord{
+		{Team: "xxx", Channel: "C1", User: "U1", Indicator: "8.8.8.8", IndicatorType: domain.ReplyTypeIP, Verdict: domain.ResultClean},
+		{Team: "xxx", Channel: "C2", User: "U1", Indicator: "evil.com", IndicatorType: domain.ReplyTypeURL, Verdict: domain.ResultDirty,
+			Scores: map[string]string{"vt": "10 / 70"}},
+	})
+	if err != nil {
+		t.Fatalf("Unable to store scans - %v", err)
+	}
+	records, total, err := r.ScanHistory("xxx", domain.ScanFilter{}, 0, 10)
+	if err != nil || total != 2 || len(records) != 2 {
+		t.Fatalf("Expected the two scans but got %d of %d - %v", len(records), total, err)
+	}
+	records, total, err = r.ScanHistory("xxx", domain.ScanFilter{Malicious: true, From: time.Now().Add(-time.Hour)}, 0, 10)
+	if err != nil || total != 1 || records[0].Indicator != "evil.com" || records[0].Scores["vt"] != "10 / 70" {
+		t.Errorf("Expected only the malicious scan but got %+v - %v", records, err)
+	}
+	if records, total, err = r.ScanHistory("xxx", domain.ScanFilter{To: time.Now().Add(-time.Hour)}, 0, 10); err != nil || total != 0 {
+		t.Errorf("Expected nothing before the range but got %+v - %v", records, err)
+	}
+	if err = r.StoreScans([]domain.ScanRecord{{Team: "xxx", Channel: "C1", User: "U2", Indicator: "Evil.com", Normalized: "evil.com",
+		IndicatorType: domain.ReplyTypeDomain, Verdict: domain.ResultDirty}}); err != nil {
+		t.Fatalf("Unable to store scans - %v", err)
+	}
+	records, total, err = r.Sightings("xxx", "evil.com", 10)
+	if err != nil || total != 1 || records[0].Indicator != "Evil.com" {
+		t.Errorf("Expected the sighting of the normalized indicator but got %+v - %v", records, err)
+	}
+	if _, total, err = r.Sightings("yyy", "evil.com", 10); err != nil || total != 0 {
+		t.Errorf("Expected no sightings of another team but got %d - %v", total, err)
+	}
+	if err = r.DeleteScansBefore(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Unable to delete scans - %v", err)
+	}
+	if _, total, err = r.ScanHistory("xxx", domain.ScanFilter{}, 0, 10); err != nil || total != 0 {
+		t.Errorf("Expected the scans to be pruned but got %d - %v", total, err)
+	}
+}
@@ -0,0 +1,1097 @@
+// Package repotest has an in-memory repository for the tests of the bot, the web and the workers
+package repotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo"
+	"github.com/demisto/alfred/util"
+)
+
+const (
+	// maxDigestFindings and maxBusiestChannels are the limits of the digest and the weekly report of MySQL
+	maxDigestFindings  = 10
+	maxBusiestChannels = 5
+	// storedReplyIDSize is the length of the IDs of the stored replies like MySQL makes them
+	storedReplyIDSize = 12
+	// day is the format of the days the statistics are kept by
+	day = "2006-01-02"
+)
+
+// lease of a job and when it expires
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+// convicted is a malicious indicator and when we convicted it
+type convicted struct {
+	content domain.MaliciousContent
+	ts      time.Time
+}
+
+// storedReply is the JSON of a reply like MySQL keeps it
+type storedReply struct {
+	team  string
+	reply []byte
+	ts    time.Time
+}
+
+// Fake keeps the repository in memory and behaves like MySQL as far as the callers can tell - the same ErrNotFound
+// and nil results, the same order of the lists and the same columns kept by the partial updates. Everything is
+// copied in and out so the callers never share what is stored. The times MySQL takes from the database come from Now.
+// It is safe for concurrent use.
+type Fake struct {
+	// Now is the clock of the database, time.Now if nil
+	Now func() time.Time
+
+	mux            sync.Mutex
+	lastID         int64
+	users          map[string]domain.User
+	teams          map[string]domain.Team
+	oauthStates    map[string]domain.OAuthState
+	invites        map[string]bool
+	configurations map[string]string // The JSON of the configuration of each team
+	webhooks       map[string]domain.Webhook
+	sandboxes      map[string]domain.Sandbox
+	sandboxRuns    map[string]domain.SandboxRun
+	emailAlerts    map[string]domain.EmailAlerts
+	bots           map[string]time.Time
+	leases         map[string]lease
+	greeted        map[string]bool
+	welcomed       map[string]bool
+	statistics     map[string]*domain.Statistics        // The running counters of each team
+	daily          map[string]*domain.Statistics        // By the team and the day
+	channelDaily   map[string]*domain.ChannelStatistics // By the team, the channel and the day
+	convicted      []convicted
+	digests        map[string]time.Time
+	weeklyReports  map[string]time.Time
+	replies        map[string]storedReply
+	falsePositives []domain.FalsePositive
+	scans          []domain.ScanRecord
+	breakers       map[string]domain.SourceBreaker // By the worker and the breaker
+	deadLetters    []domain.DeadLetter
+}
+
+var _ repo.Repo = (*Fake)(nil)
+
+// New returns an empty repository
+func New() *Fake {
+	return &Fake{
+		users:          make(map[string]domain.User),
+		teams:          make(map[string]domain.Team),
+		oauthStates:    make(map[string]domain.OAuthState),
+		invites:        make(map[string]bool),
+		configurations: make(map[string]string),
+		webhooks:       make(map[string]domain.Webhook),
+		sandboxes:      make(map[string]domain.Sandbox),
+		sandboxRuns:    make(map[string]domain.SandboxRun),
+		emailAlerts:    make(map[string]domain.EmailAlerts),
+		bots:           make(map[string]time.Time),
+		leases:         make(map[string]lease),
+		greeted:        make(map[string]bool),
+		welcomed:       make(map[string]bool),
+		statistics:     make(map[string]*domain.Statistics),
+		daily:          make(map[string]*domain.Statistics),
+		channelDaily:   make(map[string]*domain.ChannelStatistics),
+		digests:        make(map[string]time.Time),
+		weeklyReports:  make(map[string]time.Time),
+		replies:        make(map[string]storedReply),
+		breakers:       make(map[string]domain.SourceBreaker),
+	}
+}
+
+func (f *Fake) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+// nextID is the next auto increment ID, the caller holds the lock
+func (f *Fake) nextID() int64 {
+	f.lastID++
+	return f.lastID
+}
+
+// SeedTeam stores the team with its members, the members without a team are put in it
+func (f *Fake) SeedTeam(team *domain.Team, members ...*domain.User) *Fake {
+	if err := f.SetTeam(team); err != nil {
+		panic(err)
+	}
+	t := *team
+	f.mux.Lock()
+	stored := f.teams[team.ID]
+	stored.Locale, stored.XSOARURL, stored.XSOARKey, stored.XSOARIncidentType = t.Locale, t.XSOARURL, t.XSOARKey, t.XSOARIncidentType
+	stored.SourceKeys = copyKeys(t.SourceKeys)
+	stored.ConfigAdmins = append([]string(nil), t.ConfigAdmins...)
+	f.teams[team.ID] = stored
+	f.mux.Unlock()
+	for _, u := range members {
+		member := *u
+		if member.Team == "" {
+			member.Team = team.ID
+		}
+		f.mux.Lock()
+		f.users[member.ID] = member
+		f.mux.Unlock()
+	}
+	return f
+}
+
+// SeedConfiguration stores the configuration of the team
+func (f *Fake) SeedConfiguration(configuration *domain.Configuration) *Fake {
+	if err := f.SetChannelsAndGroups(configuration); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// SeedStatistics adds the statistics to the counters of the (UTC) day like UpdateStatistics does for today
+func (f *Fake) SeedStatistics(on time.Time, stats *domain.Statistics) *Fake {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.addStatistics(on, stats)
+	return f
+}
+
+// SeedScans adds the records to the scan history with their own times, the ones without a time get the clock
+func (f *Fake) SeedScans(records ...domain.ScanRecord) *Fake {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, rec := range records {
+		if rec.Created.IsZero() {
+			rec.Created = f.now()
+		}
+		f.storeScan(rec)
+	}
+	return f
+}
+
+// User ...
+func (f *Fake) User(id string) (*domain.User, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	u, ok := f.users[id]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return &u, nil
+}
+
+// UserByExternalID ...
+func (f *Fake) UserByExternalID(id string) (*domain.User, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, u := range f.users {
+		if u.ExternalID == id {
+			return &u, nil
+		}
+	}
+	return nil, repo.ErrNotFound
+}
+
+// TeamMembers ordered by the ID
+func (f *Fake) TeamMembers(team string) ([]domain.User, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var users []domain.User
+	for _, u := range f.users {
+		if u.Team == team {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// SetTeamAndUser keeps what the install does not set - the settings of the team and the system admin flag
+func (f *Fake) SetTeamAndUser(team *domain.Team, user *domain.User) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if team != nil {
+		for id, t := range f.teams {
+			if id != team.ID && t.ExternalID == team.ExternalID {
+				return fmt.Errorf("duplicate external ID %s of team %s", team.ExternalID, team.ID)
+			}
+		}
+	}
+	if user != nil {
+		for id, u := range f.users {
+			if id != user.ID && u.ExternalID == user.ExternalID {
+				return fmt.Errorf("duplicate external ID %s of user %s", user.ExternalID, user.ID)
+			}
+		}
+	}
+	if team != nil {
+		t := *team
+		stored := f.teams[team.ID]
+		t.Locale, t.XSOARURL, t.XSOARKey, t.XSOARIncidentType = stored.Locale, stored.XSOARURL, stored.XSOARKey, stored.XSOARIncidentType
+		t.SourceKeys, t.ConfigAdmins = stored.SourceKeys, stored.ConfigAdmins
+		f.teams[team.ID] = t
+	}
+	if user != nil {
+		u := *user
+		u.IsSystemAdmin = f.users[user.ID].IsSystemAdmin
+		f.users[user.ID] = u
+	}
+	return nil
+}
+
+// team returns a copy of the stored team
+func (f *Fake) team(t domain.Team) *domain.Team {
+	t.ConfigAdmins = append([]string(nil), t.ConfigAdmins...)
+	t.SourceKeys = copyKeys(t.SourceKeys)
+	return &t
+}
+
+// Team ...
+func (f *Fake) Team(id string) (*domain.Team, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	t, ok := f.teams[id]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+	return f.team(t), nil
+}
+
+// TeamByExternalID ...
+func (f *Fake) TeamByExternalID(id string) (*domain.Team, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, t := range f.teams {
+		if t.ExternalID == id {
+			return f.team(t), nil
+		}
+	}
+	return nil, repo.ErrNotFound
+}
+
+// Teams ordered by the ID
+func (f *Fake) Teams() ([]domain.Team, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var teams []domain.Team
+	for _, t := range f.teams {
+		teams = append(teams, *f.team(t))
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].ID < teams[j].ID })
+	return teams, nil
+}
+
+// SetTeam ...
+func (f *Fake) SetTeam(team *domain.Team) error {
+	return f.SetTeamAndUser(team, nil)
+}
+
+// updateTeam changes the stored team if there is one, like an UPDATE does
+func (f *Fake) updateTeam(id string, change func(t *domain.Team)) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if t, ok := f.teams[id]; ok {
+		change(&t)
+		f.teams[id] = t
+	}
+	return nil
+}
+
+// SetTeamStatus ...
+func (f *Fake) SetTeamStatus(team string, status domain.UserStatus) error {
+	return f.updateTeam(team, func(t *domain.Team) { t.Status = status })
+}
+
+// SetTeamLocale ...
+func (f *Fake) SetTeamLocale(team, locale string) error {
+	return f.updateTeam(team, func(t *domain.Team) { t.Locale = locale })
+}
+
+// SetTeamXSOAR ...
+func (f *Fake) SetTeamXSOAR(team *domain.Team) error {
+	return f.updateTeam(team.ID, func(t *domain.Team) {
+		t.XSOARURL, t.XSOARKey, t.XSOARIncidentType = team.XSOARURL, team.XSOARKey, team.XSOARIncidentType
+	})
+}
+
+// SetTeamCredentials ...
+func (f *Fake) SetTeamCredentials(team, source string, creds domain.Credentials) error {
+	if source != domain.SourceVT && source != domain.SourceXFE && !util.In(domain.KeyedSources, source) {
+		return fmt.Errorf("teams cannot set a key for %s", source)
+	}
+	return f.updateTeam(team, func(t *domain.Team) {
+		switch source {
+		case domain.SourceVT:
+			t.VTKey = creds.Key
+		case domain.SourceXFE:
+			t.XFEKey, t.XFEPass = creds.Key, creds.Password
+		default:
+			keys := copyKeys(t.SourceKeys)
+			if keys == nil {
+				keys = make(map[string]string)
+			}
+			keys[source] = creds.Key
+			if creds.Key == "" {
+				delete(keys, source)
+			}
+			t.SourceKeys = keys
+		}
+	})
+}
+
+// copyKeys so the stored team does not share the map of the caller
+func copyKeys(keys map[string]string) map[string]string {
+	if keys == nil {
+		return nil
+	}
+	res := make(map[string]string, len(keys))
+	for source, key := range keys {
+		res[source] = key
+	}
+	return res
+}
+
+// SetConfigAdmins ...
+func (f *Fake) SetConfigAdmins(team string, admins []string) error {
+	return f.updateTeam(team, func(t *domain.Team) { t.ConfigAdmins = append([]string(nil), admins...) })
+}
+
+// OAuthState returns an empty state with ErrNotFound like MySQL
+func (f *Fake) OAuthState(id string) (*domain.OAuthState, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	state, ok := f.oauthStates[id]
+	if !ok {
+		return &domain.OAuthState{}, repo.ErrNotFound
+	}
+	return &state, nil
+}
+
+// SetOAuthState ...
+func (f *Fake) SetOAuthState(state *domain.OAuthState) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.oauthStates[state.State] = *state
+	return nil
+}
+
+// JoinSlackChannel ...
+func (f *Fake) JoinSlackChannel(email string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.invites[email] = true
+	return nil
+}
+
+// ChannelsAndGroups returns an empty configuration for a team without one, the mutes that ended are gone
+func (f *Fake) ChannelsAndGroups(team string) (*domain.Configuration, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	res := &domain.Configuration{Team: team}
+	stored, ok := f.configurations[team]
+	if !ok {
+		return res, nil
+	}
+	if err := json.Unmarshal([]byte(stored), res); err != nil {
+		return nil, err
+	}
+	now := f.now()
+	for channel, until := range res.Muted {
+		if !now.Before(until) {
+			delete(res.Muted, channel)
+		}
+	}
+	if len(res.Muted) == 0 {
+		res.Muted = nil
+	}
+	return res, nil
+}
+
+// SetChannelsAndGroups ...
+func (f *Fake) SetChannelsAndGroups(configuration *domain.Configuration) error {
+	b, err := json.Marshal(configuration)
+	if err != nil {
+		return err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.configurations[configuration.Team] = string(b)
+	return nil
+}
+
+// Webhook ...
+func (f *Fake) Webhook(team string) (*domain.Webhook, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	hook, ok := f.webhooks[team]
+	if !ok {
+		return nil, nil
+	}
+	return &hook, nil
+}
+
+// SetWebhook ...
+func (f *Fake) SetWebhook(hook *domain.Webhook) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.webhooks[hook.Team] = *hook
+	return nil
+}
+
+// DeleteWebhook ...
+func (f *Fake) DeleteWebhook(team string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.webhooks, team)
+	return nil
+}
+
+// Sandbox ...
+func (f *Fake) Sandbox(team string) (*domain.Sandbox, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	s, ok := f.sandboxes[team]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// SetSandbox ...
+func (f *Fake) SetSandbox(s *domain.Sandbox) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.sandboxes[s.Team] = *s
+	return nil
+}
+
+// DeleteSandbox ...
+func (f *Fake) DeleteSandbox(team string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.sandboxes, team)
+	return nil
+}
+
+// StartSandboxRun ...
+func (f *Fake) StartSandboxRun(key string, until time.Time) (*domain.SandboxRun, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if run, ok := f.sandboxRuns[key]; ok && run.Expires.After(f.now()) {
+		return &run, nil
+	}
+	f.sandboxRuns[key] = domain.SandboxRun{Key: key, Worker: util.Hostname, Expires: until}
+	return nil, nil
+}
+
+// FinishSandboxRun ...
+func (f *Fake) FinishSandboxRun(key string, reply *domain.SandboxReply, until time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	run, ok := f.sandboxRuns[key]
+	if !ok || run.Worker != util.Hostname {
+		return nil
+	}
+	if reply == nil {
+		delete(f.sandboxRuns, key)
+		return nil
+	}
+	res := *reply
+	run.Reply, run.Expires = &res, until
+	f.sandboxRuns[key] = run
+	return nil
+}
+
+// EmailAlerts ...
+func (f *Fake) EmailAlerts(team string) (*domain.EmailAlerts, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	alerts, ok := f.emailAlerts[team]
+	if !ok {
+		return nil, nil
+	}
+	alerts.Recipients = append([]string(nil), alerts.Recipients...)
+	return &alerts, nil
+}
+
+// SetEmailAlerts ...
+func (f *Fake) SetEmailAlerts(alerts *domain.EmailAlerts) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	stored := *alerts
+	stored.Recipients = append([]string(nil), alerts.Recipients...)
+	f.emailAlerts[alerts.Team] = stored
+	return nil
+}
+
+// DeleteEmailAlerts ...
+func (f *Fake) DeleteEmailAlerts(team string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.emailAlerts, team)
+	return nil
+}
+
+// BotHeartbeat of util.Hostname
+func (f *Fake) BotHeartbeat() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.bots[util.Hostname] = f.now()
+	return nil
+}
+
+// Bots ordered by the name
+func (f *Fake) Bots(timeout time.Duration) ([]*domain.BotHeartbeat, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var bots []*domain.BotHeartbeat
+	stale := f.now().Add(-timeout)
+	for bot, ts := range f.bots {
+		bots = append(bots, &domain.BotHeartbeat{Bot: bot, Timestamp: ts, Stale: ts.Before(stale)})
+	}
+	sort.Slice(bots, func(i, j int) bool { return bots[i].Bot < bots[j].Bot })
+	return bots, nil
+}
+
+// DeleteBot ...
+func (f *Fake) DeleteBot(bot string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.bots, bot)
+	return nil
+}
+
+// AcquireLease succeeds if the owner already holds the lease or if it expired
+func (f *Fake) AcquireLease(job, owner string, ttl time.Duration) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	now := f.now()
+	if l, ok := f.leases[job]; ok && l.owner != owner && !l.expires.Before(now) {
+		return false, nil
+	}
+	f.leases[job] = lease{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// RenewLease returns false if the owner lost the lease
+func (f *Fake) RenewLease(job, owner string, ttl time.Duration) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	l, ok := f.leases[job]
+	if !ok || l.owner != owner {
+		return false, nil
+	}
+	f.leases[job] = lease{owner: owner, expires: f.now().Add(ttl)}
+	return true, nil
+}
+
+// ReleaseLease expires the lease if the owner holds it
+func (f *Fake) ReleaseLease(job, owner string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if l, ok := f.leases[job]; ok && l.owner == owner {
+		f.leases[job] = lease{owner: owner}
+	}
+	return nil
+}
+
+// mark the key in the set and return false if it was already there
+func (f *Fake) mark(set map[string]bool, key string) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if set[key] {
+		return false, nil
+	}
+	set[key] = true
+	return true, nil
+}
+
+// MarkGreeted ...
+func (f *Fake) MarkGreeted(team, channel string) (bool, error) {
+	return f.mark(f.greeted, team+"|"+channel)
+}
+
+// MarkWelcomed ...
+func (f *Fake) MarkWelcomed(team, user string) (bool, error) {
+	return f.mark(f.welcomed, team+"|"+user)
+}
+
+// add the counters of from to the counters of to
+func add(to, from *domain.Statistics) {
+	to.Messages += from.Messages
+	to.FilesClean += from.FilesClean
+	to.FilesDirty += from.FilesDirty
+	to.FilesUnknown += from.FilesUnknown
+	to.URLsClean += from.URLsClean
+	to.URLsDirty += from.URLsDirty
+	to.URLsUnknown += from.URLsUnknown
+	to.HashesClean += from.HashesClean
+	to.HashesDirty += from.HashesDirty
+	to.HashesUnknown += from.HashesUnknown
+	to.IPsClean += from.IPsClean
+	to.IPsDirty += from.IPsDirty
+	to.IPsUnknown += from.IPsUnknown
+	to.IPsSkipped += from.IPsSkipped
+	to.Whitelisted += from.Whitelisted
+	to.CacheHits += from.CacheHits
+	to.Truncated += from.Truncated
+	to.Muted += from.Muted
+	to.Dropped += from.Dropped
+	to.RateLimited += from.RateLimited
+	to.Expired += from.Expired
+}
+
+// addChannel adds the counters of from to the counters of to
+func addChannel(to, from *domain.ChannelStatistics) {
+	to.Messages += from.Messages
+	to.URLs += from.URLs
+	to.IPs += from.IPs
+	to.Hashes += from.Hashes
+	to.Files += from.Files
+	to.Malicious += from.Malicious
+}
+
+// addStatistics to the daily counters of the team and its channels, the caller holds the lock
+func (f *Fake) addStatistics(on time.Time, stats *domain.Statistics) {
+	key := stats.Team + "|" + on.UTC().Format(day)
+	daily, ok := f.daily[key]
+	if !ok {
+		daily = &domain.Statistics{Team: stats.Team}
+		f.daily[key] = daily
+	}
+	add(daily, stats)
+	for channel, c := range stats.Channels {
+		key := stats.Team + "|" + channel + "|" + on.UTC().Format(day)
+		daily, ok := f.channelDaily[key]
+		if !ok {
+			daily = &domain.ChannelStatistics{}
+			f.channelDaily[key] = daily
+		}
+		addChannel(daily, c)
+	}
+}
+
+// UpdateStatistics adds the statistics to the counters of the team and of today
+func (f *Fake) UpdateStatistics(stats *domain.Statistics) error {
+	if stats == nil || !stats.HasSomething() {
+		return nil
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	now := f.now()
+	f.addStatistics(now, stats)
+	total, ok := f.statistics[stats.Team]
+	if !ok {
+		total = &domain.Statistics{Team: stats.Team}
+		f.statistics[stats.Team] = total
+	}
+	add(total, stats)
+	total.Timestamp = now
+	return nil
+}
+
+// between sums the daily statistics of the team from the (UTC) day of from until the day of to, excluding it. The
+// caller holds the lock.
+func (f *Fake) between(team string, from, to time.Time) *domain.Statistics {
+	stats := &domain.Statistics{Team: team}
+	first, last := from.UTC().Format(day), to.UTC().Format(day)
+	for key, daily := range f.daily {
+		if on := key[len(key)-len(day):]; key[:len(key)-len(day)-1] == team && on >= first && on < last {
+			add(stats, daily)
+		}
+	}
+	return stats
+}
+
+// channelDays returns the daily statistics of the channels of the team from the (UTC) day of from until the day
+// of to, excluding it, by the channel. The caller holds the lock.
+func (f *Fake) channelDays(team string, from, to time.Time) map[string]*domain.ChannelStatistics {
+	channels := make(map[string]*domain.ChannelStatistics)
+	first, last := from.UTC().Format(day), to.UTC().Format(day)
+	prefix := team + "|"
+	for key, daily := range f.channelDaily {
+		if len(key) <= len(prefix)+len(day) || key[:len(prefix)] != prefix {
+			continue
+		}
+		channel, on := key[len(prefix):len(key)-len(day)-1], key[len(key)-len(day):]
+		if on < first || on >= last {
+			continue
+		}
+		c, ok := channels[channel]
+		if !ok {
+			c = &domain.ChannelStatistics{}
+			channels[channel] = c
+		}
+		addChannel(c, daily)
+	}
+	return channels
+}
+
+// TotalsSince sums what we checked for the team, or only in the channel if given, from the (UTC) day of since
+func (f *Fake) TotalsSince(team, channel string, since time.Time) (*domain.ChannelStatistics, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	tomorrow := f.now().AddDate(0, 0, 1)
+	if channel == "" {
+		return f.between(team, since, tomorrow).Totals(), nil
+	}
+	if c, ok := f.channelDays(team, since, tomorrow)[channel]; ok {
+		return c, nil
+	}
+	return &domain.ChannelStatistics{}, nil
+}
+
+// TotalMessages of all the teams
+func (f *Fake) TotalMessages() (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var sum int64
+	for _, stats := range f.statistics {
+		sum += stats.Messages
+	}
+	return int(sum), nil
+}
+
+// StoreMaliciousContent ...
+func (f *Fake) StoreMaliciousContent(content *domain.MaliciousContent) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	c := *content
+	c.Content = util.Substr(c.Content, 0, 128)
+	f.convicted = append(f.convicted, convicted{content: c, ts: f.now()})
+	return nil
+}
+
+// DigestForTeamSince aggregates the statistics and the most seen malicious indicators of the team
+func (f *Fake) DigestForTeamSince(team string, since time.Time) (*domain.Digest, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	digest := &domain.Digest{Stats: f.between(team, since, f.now().AddDate(0, 0, 1))}
+	seen := make(map[string]int)
+	// The newest message of each indicator is kept
+	for i := len(f.convicted) - 1; i >= 0; i-- {
+		c := f.convicted[i]
+		if c.content.Team != team || c.ts.Before(since) {
+			continue
+		}
+		key := strconv.Itoa(c.content.ContentType) + ":" + c.content.Content
+		if i, ok := seen[key]; ok {
+			digest.Malicious[i].Count++
+			continue
+		}
+		seen[key] = len(digest.Malicious)
+		digest.Malicious = append(digest.Malicious, domain.DigestFinding{ContentType: c.content.ContentType, Content: c.content.Content,
+			Channel: c.content.Channel, MessageID: c.content.MessageID, Count: 1})
+	}
+	sort.SliceStable(digest.Malicious, func(i, j int) bool { return digest.Malicious[i].Count > digest.Malicious[j].Count })
+	if len(digest.Malicious) > maxDigestFindings {
+		digest.Malicious = digest.Malicious[:maxDigestFindings]
+	}
+	return digest, nil
+}
+
+// last returns the time of the team in the map, zero time if never
+func (f *Fake) last(times map[string]time.Time, team string) (time.Time, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return times[team], nil
+}
+
+// setLast sets the time of the team in the map
+func (f *Fake) setLast(times map[string]time.Time, team string, ts time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	times[team] = ts.UTC()
+	return nil
+}
+
+// LastDigest ...
+func (f *Fake) LastDigest(team string) (time.Time, error) {
+	return f.last(f.digests, team)
+}
+
+// SetLastDigest ...
+func (f *Fake) SetLastDigest(team string, ts time.Time) error {
+	return f.setLast(f.digests, team, ts)
+}
+
+// WeeklyReportForTeam compares the week (7 UTC days) before the day of end with the week before it
+func (f *Fake) WeeklyReportForTeam(team string, end time.Time) (*domain.WeeklyReport, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	start := end.AddDate(0, 0, -7)
+	report := &domain.WeeklyReport{Current: f.between(team, start, end), Previous: f.between(team, start.AddDate(0, 0, -7), start)}
+	for channel, c := range f.channelDays(team, start, end) {
+		report.Busiest = append(report.Busiest, domain.ChannelActivity{Channel: channel, Messages: c.Messages})
+	}
+	sort.Slice(report.Busiest, func(i, j int) bool {
+		if report.Busiest[i].Messages != report.Busiest[j].Messages {
+			return report.Busiest[i].Messages > report.Busiest[j].Messages
+		}
+		return report.Busiest[i].Channel < report.Busiest[j].Channel
+	})
+	if len(report.Busiest) > maxBusiestChannels {
+		report.Busiest = report.Busiest[:maxBusiestChannels]
+	}
+	return report, nil
+}
+
+// LastWeeklyReport ...
+func (f *Fake) LastWeeklyReport(team string) (time.Time, error) {
+	return f.last(f.weeklyReports, team)
+}
+
+// SetLastWeeklyReport ...
+func (f *Fake) SetLastWeeklyReport(team string, ts time.Time) error {
+	return f.setLast(f.weeklyReports, team, ts)
+}
+
+// StoreReply ...
+func (f *Fake) StoreReply(team string, reply *domain.WorkReply) (string, error) {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return "", err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	id := util.SecureRandomString(storedReplyIDSize, false)
+	f.replies[id] = storedReply{team: team, reply: b, ts: f.now()}
+	return id, nil
+}
+
+// StoredReply returns ErrNotFound if the reply expired or belongs to another team
+func (f *Fake) StoredReply(team, id string) (*domain.WorkReply, error) {
+	f.mux.Lock()
+	stored, ok := f.replies[id]
+	f.mux.Unlock()
+	if !ok || stored.team != team {
+		return nil, repo.ErrNotFound
+	}
+	res := &domain.WorkReply{}
+	return res, json.Unmarshal(stored.reply, res)
+}
+
+// DeleteStoredReplies ...
+func (f *Fake) DeleteStoredReplies(before time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for id, stored := range f.replies {
+		if stored.ts.Before(before) {
+			delete(f.replies, id)
+		}
+	}
+	return nil
+}
+
+// StoreFalsePositive sets the ID of the false positive
+func (f *Fake) StoreFalsePositive(fp *domain.FalsePositive) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	fp.ID = f.nextID()
+	stored := *fp
+	stored.Indicator, stored.Comment, stored.Created = util.Substr(fp.Indicator, 0, 255), util.Substr(fp.Comment, 0, 512), f.now()
+	f.falsePositives = append(f.falsePositives, stored)
+	return nil
+}
+
+// page returns the bounds of the page from offset up to limit items
+func page(total, offset, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	if limit < 0 || offset+limit > total {
+		return offset, total
+	}
+	return offset, offset + limit
+}
+
+// FalsePositives of the team, newest first, with the total count for paging
+func (f *Fake) FalsePositives(team string, offset, limit int) ([]domain.FalsePositive, int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var matching []domain.FalsePositive
+	for i := len(f.falsePositives) - 1; i >= 0; i-- {
+		if f.falsePositives[i].Team == team {
+			matching = append(matching, f.falsePositives[i])
+		}
+	}
+	sort.SliceStable(matching, func(i, j int) bool { return matching[i].Created.After(matching[j].Created) })
+	from, to := page(len(matching), offset, limit)
+	return append(make([]domain.FalsePositive, 0), matching[from:to]...), len(matching), nil
+}
+
+// storeScan adds the record with its own time, the caller holds the lock
+func (f *Fake) storeScan(rec domain.ScanRecord) {
+	rec.ID = f.nextID()
+	scores := rec.Scores
+	rec.Scores = nil
+	for source, score := range scores {
+		if rec.Scores == nil {
+			rec.Scores = make(map[string]string)
+		}
+		rec.Scores[source] = score
+	}
+	f.scans = append(f.scans, rec)
+}
+
+// StoreScans ...
+func (f *Fake) StoreScans(records []domain.ScanRecord) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	now := f.now()
+	for _, rec := range records {
+		rec.Created = now
+		f.storeScan(rec)
+	}
+	return nil
+}
+
+// ScanHistory returns a page of the scan history of the team matching the filter, newest first, and the total that matches
+func (f *Fake) ScanHistory(team string, filter domain.ScanFilter, offset, limit int) ([]domain.ScanRecord, int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var matching []domain.ScanRecord
+	for i := len(f.scans) - 1; i >= 0; i-- {
+		rec := f.scans[i]
+		switch {
+		case rec.Team != team,
+			!filter.From.IsZero() && rec.Created.Before(filter.From),
+			!filter.To.IsZero() && !rec.Created.Before(filter.To),
+			filter.Channel != "" && rec.Channel != filter.Channel,
+			filter.Indicator != "" && rec.Indicator != filter.Indicator,
+			filter.Normalized != "" && rec.Normalized != filter.Normalized,
+			filter.Malicious && rec.Verdict != domain.ResultDirty:
+			continue
+		}
+		matching = append(matching, rec)
+	}
+	sort.SliceStable(matching, func(i, j int) bool { return matching[i].Created.After(matching[j].Created) })
+	from, to := page(len(matching), offset, limit)
+	records := make([]domain.ScanRecord, 0, to-from)
+	for _, rec := range matching[from:to] {
+		scores := rec.Scores
+		rec.Scores = nil
+		for source, score := range scores {
+			if rec.Scores == nil {
+				rec.Scores = make(map[string]string)
+			}
+			rec.Scores[source] = score
+		}
+		records = append(records, rec)
+	}
+	return records, len(matching), nil
+}
+
+// Sightings ...
+func (f *Fake) Sightings(team, normalized string, limit int) ([]domain.ScanRecord, int, error) {
+	return f.ScanHistory(team, domain.ScanFilter{Normalized: normalized}, 0, limit)
+}
+
+// DeleteScansBefore ...
+func (f *Fake) DeleteScansBefore(before time.Time) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	kept := f.scans[:0]
+	for _, rec := range f.scans {
+		if !rec.Created.Before(before) {
+			kept = append(kept, rec)
+		}
+	}
+	f.scans = kept
+	return nil
+}
+
+// SetSourceBreaker of util.Hostname
+func (f *Fake) SetSourceBreaker(b *domain.SourceBreaker) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	stored := *b
+	stored.Worker, stored.Error = util.Hostname, util.Substr(b.Error, 0, 512)
+	f.breakers[util.Hostname+"|"+b.Breaker] = stored
+	return nil
+}
+
+// DeleteSourceBreaker of util.Hostname
+func (f *Fake) DeleteSourceBreaker(breaker string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	delete(f.breakers, util.Hostname+"|"+breaker)
+	return nil
+}
+
+// SourceBreakers open since the given time ordered by the breaker and the worker
+func (f *Fake) SourceBreakers(since time.Time) ([]domain.SourceBreaker, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	var breakers []domain.SourceBreaker
+	for _, b := range f.breakers {
+		if b.OpenUntil.After(since) {
+			breakers = append(breakers, b)
+		}
+	}
+	sort.Slice(breakers, func(i, j int) bool {
+		if breakers[i].Breaker != breakers[j].Breaker {
+			return breakers[i].Breaker < breakers[j].Breaker
+		}
+		return breakers[i].Worker < breakers[j].Worker
+	})
+	return breakers, nil
+}
+
+// AddDeadLetter sets the ID of the letter
+func (f *Fake) AddDeadLetter(d *domain.DeadLetter) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	d.ID = f.nextID()
+	stored := *d
+	stored.MessageID, stored.Failed = util.Substr(d.MessageID, 0, 64), d.Failed.UTC()
+	f.deadLetters = append(f.deadLetters, stored)
+	return nil
+}
+
+// DeadLetters of the team, the latest first
+func (f *Fake) DeadLetters(team string, limit int) ([]domain.DeadLetter, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	letters := make([]domain.DeadLetter, 0)
+	for i := len(f.deadLetters) - 1; i >= 0; i-- {
+		if f.deadLetters[i].Team == team {
+			letters = append(letters, f.deadLetters[i])
+		}
+	}
+	sort.SliceStable(letters, func(i, j int) bool { return letters[i].Failed.After(letters[j].Failed) })
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+// DeadLetter of the team, nil if the team has no such letter
+func (f *Fake) DeadLetter(team string, id int64) (*domain.DeadLetter, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for _, d := range f.deadLetters {
+		if d.Team == team && d.ID == id {
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteDeadLetter ...
+func (f *Fake) DeleteDeadLetter(team string, id int64) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	for i, d := range f.deadLetters {
+		if d.Team == team && d.ID == id {
+			f.deadLetters = append(f.deadLetters[:i], f.deadLetters[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package repotest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo"
+)
+
+func TestFakeNotFound(t *testing.T) {
+	f := New()
+	if u, err := f.User("u1"); u != nil || err != repo.ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing user - %v", err)
+	}
+	if team, err := f.TeamByExternalID("T1"); team != nil || err != repo.ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing team - %v", err)
+	}
+	if state, err := f.OAuthState("s"); state == nil || err != repo.ErrNotFound {
+		t.Errorf("expected an empty state with ErrNotFound - %v", err)
+	}
+	if hook, err := f.Webhook("1"); hook != nil || err != nil {
+		t.Errorf("expected no webhook and no error - %v", err)
+	}
+	if c, err := f.ChannelsAndGroups("1"); err != nil || c == nil || c.Team != "1" {
+		t.Errorf("expected an empty configuration - %+v, %v", c, err)
+	}
+	if fps, total, err := f.FalsePositives("1", 0, 10); err != nil || fps == nil || total != 0 {
+		t.Errorf("expected an empty list - %v", err)
+	}
+}
+
+func TestFakeSetTeamKeepsSettings(t *testing.T) {
+	f := New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1", Name: "old", Locale: "de", SourceKeys: map[string]string{domain.SourceOTX: "otx"}, ConfigAdmins: []string{"U1"}},
+		&domain.User{ID: "u1", ExternalID: "U1", IsSystemAdmin: true})
+	if err := f.SetTeamAndUser(&domain.Team{ID: "1", ExternalID: "T1", Name: "new"}, &domain.User{ID: "u1", Team: "1", ExternalID: "U1", Name: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	team, err := f.Team("1")
+	if err != nil || team.Name != "new" || team.Locale != "de" || team.SourceKeys[domain.SourceOTX] != "otx" || !team.IsConfigAdmin("U1") {
+		t.Errorf("expected the install to keep the settings - %+v, %v", team, err)
+	}
+	if u, _ := f.User("u1"); u.Team != "1" || u.Name != "user" || !u.IsSystemAdmin {
+		t.Errorf("expected the install to keep the system admin - %+v", u)
+	}
+	// Changing what we got does not change the repo
+	team.ConfigAdmins[0] = "U2"
+	if team, _ = f.Team("1"); !team.IsConfigAdmin("U1") {
+		t.Error("expected a copy of the team")
+	}
+	if err = f.SetTeam(&domain.Team{ID: "2", ExternalID: "T1"}); err == nil {
+		t.Error("expected a duplicate external ID to fail")
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	f := New()
+	f.Now = func() time.Time { return now }
+	if ok, _ := f.AcquireLease("digest", "a", time.Minute); !ok {
+		t.Fatal("expected to acquire a free lease")
+	}
+	if ok, _ := f.AcquireLease("digest", "b", time.Minute); ok {
+		t.Error("expected the lease to be held")
+	}
+	f.SeedConfiguration(&domain.Configuration{Team: "1", Muted: map[string]time.Time{"C1": now.Add(time.Hour)}})
+	f.SeedStatistics(now.AddDate(0, 0, -1), &domain.Statistics{Team: "1", Messages: 2})
+	if err := f.UpdateStatistics(&domain.Statistics{Team: "1", Messages: 3}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	if ok, _ := f.AcquireLease("digest", "b", time.Minute); !ok {
+		t.Error("expected to take over the expired lease")
+	}
+	if c, _ := f.ChannelsAndGroups("1"); c.Muted != nil {
+		t.Errorf("expected the mute to end - %v", c.Muted)
+	}
+	if today, _ := f.TotalsSince("1", "", now); today.Messages != 3 {
+		t.Errorf("expected 3 messages today but got %d", today.Messages)
+	}
+	if week, _ := f.TotalsSince("1", "", now.AddDate(0, 0, -6)); week.Messages != 5 {
+		t.Errorf("expected 5 messages this week but got %d", week.Messages)
+	}
+}
@@ -0,0 +1,125 @@
+package slack
+
+import "errors"
+
+// Block is a Block Kit layout block - see https://api.slack.com/reference/block-kit/blocks
+type Block map[string]interface{}
+
+// Limits Slack puts on messages with blocks
+const (
+	MaxBlocks          = 50 // Blocks in a single message
+	maxHeaderLength    = 150
+	maxTextLength      = 3000 // Text of a section or a context element
+	maxContextElements = 10
+)
+
+// truncate the text to the given number of characters
+func truncate(text string, max int) string {
+	if r := []rune(text); len(r) > max {
+		return string(r[:max-3]) + "..."
+	}
+	return text
+}
+
+// HeaderBlock is a large plain text title. Emoji codes like :red_circle: are rendered.
+func HeaderBlock(text string) Block {
+	return Block{"type": "header", "text": map[string]interface{}{"type": "plain_text", "text": truncate(text, maxHeaderLength), "emoji": true}}
+}
+
+// SectionBlock is a block of mrkdwn text
+func SectionBlock(text string) Block {
+	return Block{"type": "section", "text": map[string]interface{}{"type": "mrkdwn", "text": truncate(text, maxTextLength)}}
+}
+
+// WithButton adds a button that opens the URL next to the text of a section
+func (b Block) WithButton(text, url string) Block {
+	b["accessory"] = map[string]interface{}{
+		"type": "button",
+		"text": map[string]interface{}{"type": "plain_text", "text": text},
+		"url":  url,
+	}
+	return b
+}
+
+// ContextBlock is a line of small mrkdwn elements. Slack allows up to 10 so the rest are joined into the last one.
+func ContextBlock(elements ...string) Block {
+	if len(elements) > maxContextElements {
+		last := elements[maxContextElements-1]
+		for _, e := range elements[maxContextElements:] {
+			last += " | " + e
+		}
+		elements = append(elements[:maxContextElements-1:maxContextElements-1], last)
+	}
+	var els []map[string]interface{}
+	for _, e := range elements {
+		els = append(els, map[string]interface{}{"type": "mrkdwn", "text": truncate(e, maxTextLength)})
+	}
+	return Block{"type": "context", "elements": els}
+}
+
+// ActionButton is a button that sends the action with the value to our interactions endpoint
+func ActionButton(text, actionID, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "button",
+		"text":      map[string]interface{}{"type": "plain_text", "text": text},
+		"action_id": actionID,
+		"value":     value,
+	}
+}
+
+// ActionsBlock holds interactive elements like buttons
+func ActionsBlock(elements ...map[string]interface{}) Block {
+	return Block{"type": "actions", "elements": elements}
+}
+
+// DividerBlock separates the blocks before and after it
+func DividerBlock() Block {
+	return Block{"type": "divider"}
+}
+
+// BlocksAttachment wraps the blocks in an attachment so they are shown with a colored bar.
+// The color is good, warning, danger or a hex code.
+func BlocksAttachment(color, fallback string, blocks []Block) map[string]interface{} {
+	return map[string]interface{}{"color": color, "fallback": fallback, "blocks": blocks}
+}
+
+// PostMessage posts the message with chat.postMessage.
+// A message with blocks must have a text as well since Slack shows it in notifications and on clients that cannot render the blocks.
+func (s *Client) PostMessage(message map[string]interface{}) (Response, error) {
+	if err := checkMessage(message); err != nil {
+		return nil, err
+	}
+	return s.Do("POST", "chat.postMessage", message)
+}
+
+// UpdateMessage replaces the message with chat.update, the message has the channel and the ts of the one it replaces.
+// It needs a fallback text like PostMessage.
+func (s *Client) UpdateMessage(message map[string]interface{}) (Response, error) {
+	if err := checkMessage(message); err != nil {
+		return nil, err
+	}
+	return s.Do("POST", "chat.update", message)
+}
+
+// checkMessage trims the blocks of the message and its attachments and checks it has a fallback text if it has blocks
+func checkMessage(message map[string]interface{}) error {
+	hasBlocks := trimBlocks(message)
+	if attachments, ok := message["attachments"].([]map[string]interface{}); ok {
+		for _, a := range attachments {
+			hasBlocks = trimBlocks(a) || hasBlocks
+		}
+	}
+	if text, _ := message["text"].(string); hasBlocks && text == "" {
+		return errors.New("a message with blocks must have a fallback text")
+	}
+	return nil
+}
+
+// trimBlocks of the message or attachment to what Slack allows and check if it has any
+func trimBlocks(m map[string]interface{}) bool {
+	blocks, ok := m["blocks"].([]Block)
+	if len(blocks) > MaxBlocks {
+		m["blocks"] = blocks[:MaxBlocks]
+	}
+	return ok && len(blocks) > 0
+}
@@ -1,5 +1,50 @@
 package slack
 
+// ConversationMessage returns the message with the given ts or nil if there is no such message.
+// Replies in a thread are only found with the ts of the thread.
+func (s *Client) ConversationMessage(channel, ts, threadTS string) (Response, error) {
+	method, args := "conversations.history", map[string]string{"channel": channel, "latest": ts, "oldest": ts, "inclusive": "true", "limit": "1"}
+	if threadTS != "" && threadTS != ts {
+		method, args["ts"] = "conversations.replies", threadTS
+		delete(args, "limit")
+	}
+	res, err := s.Do("GET", method, args)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := res["messages"].([]interface{}); ok {
+		for _, mm := range m {
+			if msg, ok := mm.(map[string]interface{}); ok && Response(msg).S("ts") == ts {
+				return Response(msg), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ConversationMembers returns the user IDs of the conversation members
+// Handle cursors as well
+func (s *Client) ConversationMembers(channel string) (members []string, err error) {
+	args := map[string]string{"channel": channel, "limit": "1000"}
+	for {
+		res, err := s.Do("GET", "conversations.members", args)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := res["members"]; ok {
+			for _, mm := range m.([]interface{}) {
+				members = append(members, mm.(string))
+			}
+		}
+		if res.S("response_metadata.next_cursor") == "" {
+			break
+		} else {
+			args["cursor"] = res.S("response_metadata.next_cursor")
+		}
+	}
+	return
+}
+
 // Conversations retrieval by type
 // Handle cursors as well
 func (s *Client) Conversations(t string) (channels []Response, err error) {
@@ -0,0 +1,68 @@
+package slack
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+)
+
+// Filetypes of the snippets we upload
+const (
+	SnippetMarkdown = "markdown"
+	SnippetText     = "text"
+)
+
+// Upload is a file we share with files.upload
+type Upload struct {
+	Channel  string // Where to share the file
+	ThreadTS string // Optional thread to share it in
+	Filename string
+	Filetype string // Turns the file into a snippet, e.g. SnippetMarkdown
+	Title    string
+	Comment  string // Optional message that goes with the file
+	Content  []byte
+}
+
+// multipart encodes the upload as a multipart form and returns it with its content type
+func (u *Upload) multipart() (string, []byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fields := [][2]string{
+		{"channels", u.Channel},
+		{"thread_ts", u.ThreadTS},
+		{"filetype", u.Filetype},
+		{"title", u.Title},
+		{"initial_comment", u.Comment},
+	}
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		if err := w.WriteField(f[0], f[1]); err != nil {
+			return "", nil, err
+		}
+	}
+	part, err := w.CreateFormFile("file", u.Filename)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = part.Write(u.Content); err != nil {
+		return "", nil, err
+	}
+	if err = w.Close(); err != nil {
+		return "", nil, err
+	}
+	return w.FormDataContentType(), buf.Bytes(), nil
+}
+
+// UploadFile shares the file in the channel with files.upload. The shared file is in the file field of the response.
+func (s *Client) UploadFile(u *Upload) (Response, error) {
+	if u.Channel == "" || u.Filename == "" {
+		return nil, errors.New("an upload must have a channel and a file name")
+	}
+	contentType, payload, err := u.multipart()
+	if err != nil {
+		return nil, err
+	}
+	return s.send("POST", "files.upload", contentType, payload)
+}
@@ -0,0 +1,13 @@
+package slack
+
+import "strings"
+
+// ReactionsAdd adds the emoji reaction to the message.
+// Reacting again with the same emoji is not considered an error.
+func (s *Client) ReactionsAdd(channel, timestamp, name string) error {
+	_, err := s.Do("POST", "reactions.add", map[string]string{"channel": channel, "timestamp": timestamp, "name": name})
+	if err != nil && strings.HasSuffix(err.Error(), ": already_reacted") {
+		return nil
+	}
+	return err
+}
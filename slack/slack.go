@@ -2,19 +2,27 @@ package slack
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
 
+// APIURL is where the Web API methods are. Replaced by the tests.
+var APIURL = "https://slack.com/api/"
+
 // client to the Slack API.
 type Client struct {
-	Token string // The token to use for requests. Required.
+	Token   string          // The token to use for requests. Required.
+	Context context.Context // Cancels the wait of rate limited requests, the background context if nil
 }
 
 // Response to Slack web-api calls
@@ -72,10 +80,12 @@ func (r Response) B(path string) bool {
 
 // I returns given path as int
 func (r Response) I(path string) int {
-	if d := r.Get(path); d != nil {
-		if db, ok := d.(int); ok {
-			return db
-		}
+	// Decoded JSON numbers are float64
+	switch d := r.Get(path).(type) {
+	case int:
+		return d
+	case float64:
+		return int(d)
 	}
 	return 0
 }
@@ -95,10 +105,35 @@ func (r Response) Warning() string {
 	return r.S("warning")
 }
 
+// maxRetries of a request that Slack rate limited
+const maxRetries = 3
+
+// maxRetryWait caps how long we wait in total for a rate limited request, a longer wait is left to the caller
+const maxRetryWait = 30 * time.Second
+
+// RateLimitError is returned when Slack asks us to wait longer than we hold a request
+type RateLimitError struct {
+	RetryAfter time.Duration // How long Slack asked us to wait
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Slack rate limited the request, retry after %v", e.RetryAfter)
+}
+
+// retryAfter returns how long Slack asked us to wait before retrying
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 // Do the given API request
 // Returns the response if the status code is between 200 and 299
+// Rate limited requests are retried after the time Slack asks for
 func (s *Client) Do(method, path string, body interface{}) (Response, error) {
-	var bodyReader io.Reader
+	var payload []byte
 	if method == "GET" {
 		if body != nil {
 			if bmap, ok := body.(map[string]string); ok {
@@ -115,30 +150,68 @@ func (s *Client) Do(method, path string, body interface{}) (Response, error) {
 			if err != nil {
 				return nil, err
 			}
-			bodyReader = bytes.NewReader(b)
+			payload = b
 		}
 	}
-	req, err := http.NewRequest(method, "https://slack.com/api/"+path, bodyReader)
-	if err != nil {
-		return nil, err
-	}
-	if method != "GET" {
-		req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	}
-	req.Header.Set("Accept", "application/json")
-	if s.Token != "" {
-		req.Header.Set("Authorization", "Bearer "+s.Token)
+	return s.send(method, path, "application/json; charset=utf-8", payload)
+}
+
+// send the request with the given content type, retrying if Slack rate limits us
+func (s *Client) send(method, path, contentType string, payload []byte) (Response, error) {
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		var bodyReader io.Reader
+		if payload != nil {
+			bodyReader = bytes.NewReader(payload)
+		}
+		req, err := http.NewRequest(method, APIURL+path, bodyReader)
+		if err != nil {
+			return nil, err
+		}
+		if method != "GET" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Accept", "application/json")
+		if s.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.Token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < maxRetries {
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			if waited+wait > maxRetryWait {
+				return nil, &RateLimitError{RetryAfter: wait}
+			}
+			logrus.Debugf("Slack rate limited %s, retrying in %v", path, wait)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			}
+			waited += wait
+			continue
+		}
+		return decodeResponse(resp)
 	}
+}
+
+// decodeResponse of a Slack API call and close it
+func decodeResponse(resp *http.Response) (Response, error) {
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return nil, errors.New("unexpected status code: [" + resp.Status + "]")
 	}
 	res := Response{}
-	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
 		return nil, err
 	}
 	if !res.OK() {
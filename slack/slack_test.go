@@ -1,8 +1,17 @@
 package slack
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bytes"
+	"context"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestResponse_Get(t *testing.T) {
@@ -14,4 +23,81 @@ func TestResponse_Get(t *testing.T) {
 	assert.Equal(t, "111", r.Get("c.y.z"))
 	r1 := r.R("c.y")
 	assert.Equal(t, "111", r1.Get("z"))
+	assert.Equal(t, 1, r.I("a"))
+	assert.Equal(t, 0, r.I("b"))
+	assert.Equal(t, 1024, Response{"size": float64(1024)}.I("size"))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryAfter("5"))
+	assert.Equal(t, time.Second, retryAfter(""))
+	assert.Equal(t, time.Second, retryAfter("soon"))
+	assert.Equal(t, time.Hour, retryAfter("3600"))
+}
+
+func TestSendRateLimited(t *testing.T) {
+	wait := "1"
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	defer func(saved string) { APIURL = saved }(APIURL)
+	APIURL = srv.URL + "/"
+	// Longer than we hold a request, the caller gets the wait
+	wait = "3600"
+	_, err := (&Client{}).Do("POST", "chat.postMessage", nil)
+	if assert.IsType(t, &RateLimitError{}, err) {
+		assert.Equal(t, time.Hour, err.(*RateLimitError).RetryAfter)
+	}
+	assert.Equal(t, 1, calls)
+	// Stopping cancels the wait
+	wait, calls = "20", 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = (&Client{Context: ctx}).Do("POST", "chat.postMessage", nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, 1, calls)
+}
+
+func TestBlocks(t *testing.T) {
+	header := HeaderBlock(strings.Repeat("a", 200))
+	assert.Equal(t, 150, len(header["text"].(map[string]interface{})["text"].(string)))
+	section := SectionBlock("text").WithButton("Details", "https://example.com")
+	assert.Equal(t, "https://example.com", section["accessory"].(map[string]interface{})["url"])
+	context := ContextBlock("1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12")
+	elements := context["elements"].([]map[string]interface{})
+	assert.Equal(t, 10, len(elements))
+	assert.Equal(t, "10 | 11 | 12", elements[9]["text"])
+}
+
+func TestPostMessageNeedsText(t *testing.T) {
+	_, err := (&Client{}).PostMessage(map[string]interface{}{"channel": "C1", "blocks": []Block{SectionBlock("text")}})
+	assert.Error(t, err)
+	attachment := BlocksAttachment("danger", "text", []Block{SectionBlock("text")})
+	_, err = (&Client{}).PostMessage(map[string]interface{}{"channel": "C1", "attachments": []map[string]interface{}{attachment}})
+	assert.Error(t, err)
+	_, err = (&Client{}).UpdateMessage(map[string]interface{}{"channel": "C1", "ts": "1.2", "blocks": []Block{SectionBlock("text")}})
+	assert.Error(t, err)
+}
+
+func TestUploadMultipart(t *testing.T) {
+	u := &Upload{Channel: "C1", ThreadTS: "1.2", Filename: "report.md", Filetype: SnippetMarkdown, Content: []byte("**report**")}
+	contentType, payload, err := u.multipart()
+	assert.NoError(t, err)
+	_, params, err := mime.ParseMediaType(contentType)
+	assert.NoError(t, err)
+	form, err := multipart.NewReader(bytes.NewReader(payload), params["boundary"]).ReadForm(1 << 20)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"C1"}, form.Value["channels"])
+	assert.Equal(t, []string{"1.2"}, form.Value["thread_ts"])
+	assert.Equal(t, []string{SnippetMarkdown}, form.Value["filetype"])
+	assert.Nil(t, form.Value["title"])
+	assert.Equal(t, "report.md", form.File["file"][0].Filename)
+	_, err = (&Client{}).UploadFile(&Upload{Filename: "report.md"})
+	assert.Error(t, err)
 }
@@ -0,0 +1,25 @@
+package slack
+
+// Users retrieval of the whole team
+// Handle cursors as well
+func (s *Client) Users() (users []Response, err error) {
+	args := map[string]string{"limit": "1000"}
+	users = make([]Response, 0)
+	for {
+		res, err := s.Do("GET", "users.list", args)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := res["members"]; ok {
+			for _, mm := range m.([]interface{}) {
+				users = append(users, Response(mm.(map[string]interface{})))
+			}
+		}
+		if res.S("response_metadata.next_cursor") == "" {
+			break
+		} else {
+			args["cursor"] = res.S("response_metadata.next_cursor")
+		}
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/conf"
+)
+
+var (
+	// ErrPrivateAddress is returned when a URL of a team resolves to an address inside our network
+	ErrPrivateAddress = errors.New("address is not public")
+	// ErrRedirect is returned when a URL of a team redirects, we do not follow it since it could point inside our network
+	ErrRedirect = errors.New("redirects are not followed")
+	// ErrUnreachable is what the team sees when we could not get an answer from its URL, the reason is only logged
+	ErrUnreachable = errors.New("unable to connect - the URL must be public and answer without redirects")
+)
+
+// publicTransport connects only to public addresses and skips the proxy of the environment since the proxy would connect for us
+var publicTransport = &http.Transport{
+	DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicAddress}).DialContext,
+	TLSHandshakeTimeout: 10 * time.Second,
+	MaxIdleConns:        100,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+// PublicURL checks the URL a team gives us (webhook, XSOAR server, sandbox) is http(s) and not a literal internal host.
+// Names are checked again when we connect since they can resolve to anything.
+func PublicURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if conf.Options.Security.PrivateURLs {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	return net.ParseIP(host) == nil || IsRoutableIP(host)
+}
+
+// publicAddress refuses to connect to an internal address. It runs after the DNS lookup on every connection
+// so a name that resolves to a public address when saved and to an internal one later is refused as well.
+func publicAddress(network, address string, _ syscall.RawConn) error {
+	if conf.Options.Security.PrivateURLs {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !IsRoutableIP(host) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// PublicClient returns a client for the URLs of the teams, it connects only to public addresses and does not follow redirects
+func PublicClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: publicTransport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return ErrRedirect
+		},
+	}
+}
+
+// DoPublic sends the request to the URL of a team. If there is no answer the team gets ErrUnreachable
+// so it cannot learn about our network, e.g. the internal address its name resolved to.
+func DoPublic(c *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		logrus.WithError(err).Infof("Unable to reach %s", req.URL.Host)
+		return nil, ErrUnreachable
+	}
+	return resp, nil
+}
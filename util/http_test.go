@@ -0,0 +1,58 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/demisto/alfred/conf"
+)
+
+func TestPublicURL(t *testing.T) {
+	for raw, public := range map[string]bool{
+		"https://siem.example.com/alfred":  true,
+		"http://8.8.8.8:8080/hook":         true,
+		"ftp://siem.example.com":           false,
+		"siem.example.com":                 false,
+		"http://localhost:8080":            false,
+		"http://metadata.localhost":        false,
+		"http://127.0.0.1/hook":            false,
+		"http://169.254.169.254/latest":    false,
+		"http://10.1.2.3":                  false,
+		"http://[::1]:8080":                false,
+		"http://[::ffff:192.168.1.1]/hook": false,
+	} {
+		if PublicURL(raw) != public {
+			t.Errorf("PublicURL(%s) expected %v", raw, public)
+		}
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+	// The name of the test server resolves to a loopback address when we connect
+	req, _ := http.NewRequest("GET", strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), nil)
+	if _, err := DoPublic(PublicClient(0), req); err != ErrUnreachable || calls != 0 {
+		t.Errorf("expected the loopback address to be refused but got %v after %d calls", err, calls)
+	}
+	if _, err := PublicClient(0).Do(req); err == nil || !strings.Contains(err.Error(), ErrPrivateAddress.Error()) {
+		t.Errorf("expected the private address error but got %v", err)
+	}
+}
+
+func TestPublicClientRedirect(t *testing.T) {
+	conf.Options.Security.PrivateURLs = true
+	defer func() { conf.Options.Security.PrivateURLs = false }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer srv.Close()
+	if _, err := PublicClient(0).Get(srv.URL); err == nil || !strings.Contains(err.Error(), ErrRedirect.Error()) {
+		t.Errorf("expected the redirect to be refused but got %v", err)
+	}
+}
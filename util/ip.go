@@ -0,0 +1,52 @@
+package util
+
+import "net"
+
+// nonRoutable holds the ranges that do not make sense to check for reputation
+var nonRoutable []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",       // "This" network
+		"10.0.0.0/8",      // RFC1918
+		"100.64.0.0/10",   // Carrier grade NAT
+		"127.0.0.0/8",     // Loopback
+		"169.254.0.0/16",  // Link local
+		"172.16.0.0/12",   // RFC1918
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // Documentation
+		"192.168.0.0/16",  // RFC1918
+		"198.18.0.0/15",   // Benchmarking
+		"198.51.100.0/24", // Documentation
+		"203.0.113.0/24",  // Documentation
+		"224.0.0.0/4",     // Multicast
+		"240.0.0.0/4",     // Reserved and broadcast
+		"::/128",          // Unspecified
+		"::1/128",         // Loopback
+		"fc00::/7",        // Unique local
+		"fe80::/10",       // Link local
+		"ff00::/8",        // Multicast
+		"2001:db8::/32",   // Documentation
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nonRoutable = append(nonRoutable, n)
+	}
+}
+
+// IsRoutableIP returns true if the IP is a valid public address.
+// Private, loopback, link-local, multicast and reserved ranges are not routable.
+func IsRoutableIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nonRoutable {
+		if n.Contains(parsed) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package util
+
+import "testing"
+
+func TestIsRoutableIP(t *testing.T) {
+	tests := []struct {
+		ip       string
+		routable bool
+	}{
+		{"8.8.8.8", true},
+		{"172.15.255.255", true},
+		{"172.32.0.1", true},
+		{"2606:4700:4700::1111", true},
+		{"10.0.0.5", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"224.0.0.251", false},
+		{"255.255.255.255", false},
+		{"0.0.0.0", false},
+		{"100.64.1.1", false},
+		{"192.0.2.10", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"999.1.1.1", false},
+		{"not an ip", false},
+	}
+	for _, test := range tests {
+		if res := IsRoutableIP(test.ip); res != test.routable {
+			t.Errorf("IsRoutableIP(%s) = %v, expected %v", test.ip, res, test.routable)
+		}
+	}
+}
@@ -7,9 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/asaskevich/govalidator"
+	"github.com/demisto/alfred/bot"
 	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
 	"github.com/demisto/alfred/util"
@@ -30,6 +34,65 @@ type infoResponse struct {
 	VerboseIM bool     `json:"verbose_im"`
 	Regexp    string   `json:"regexp"`
 	All       bool     `json:"all"`
+	// DisableRefang turns off normalization of defanged indicators
+	DisableRefang bool `json:"disable_refang"`
+	// DisableDomains turns off detection of bare domains
+	DisableDomains bool `json:"disable_domains"`
+	// InternalIPs reports private IPs instead of skipping them
+	InternalIPs bool `json:"internal_ips"`
+	// CustomPatterns and the webhook we forward their matches to
+	CustomPatterns []string `json:"custom_patterns"`
+	CustomWebhook  string   `json:"custom_webhook"`
+	// Whitelist of indicators and CIDRs
+	Whitelist []string `json:"whitelist"`
+	// InternalDomains whose URLs are never sent to the sources
+	InternalDomains []string `json:"internal_domains"`
+	// DisableAttachments turns off scanning of message attachments
+	DisableAttachments bool `json:"disable_attachments"`
+	// ReplyInThread lists the channels and groups where replies go to a thread
+	ReplyInThread []string `json:"reply_in_thread"`
+	// ScanBotMessages lists the channels and groups where messages of other bots are scanned
+	ScanBotMessages []string `json:"scan_bot_messages"`
+	// ScanEmails turns on the domain reputation of email addresses
+	ScanEmails bool `json:"scan_emails"`
+	// ScanCode lists the channels and groups where code blocks and quotes are scanned
+	ScanCode []string `json:"scan_code"`
+	// IgnoredUsers are never scanned
+	IgnoredUsers []string `json:"ignored_users"`
+	// ReplyThreshold per channel - all, suspicious or malicious
+	ReplyThreshold map[string]string `json:"reply_threshold"`
+	// ReplyMode per channel - message, reaction or both
+	ReplyMode map[string]string `json:"reply_mode"`
+	// Muted channels and until when
+	Muted map[string]time.Time `json:"muted"`
+	// DigestChannel gets a daily summary at DigestHour in DigestTimezone
+	DigestChannel  string `json:"digest_channel"`
+	DigestHour     int    `json:"digest_hour"`
+	DigestTimezone string `json:"digest_timezone"`
+	// DisableWeeklyReport stops the weekly trends we send the configuration admins
+	DisableWeeklyReport bool `json:"disable_weekly_report"`
+	// AllPublicChannels joins every public channel except the excluded ones
+	AllPublicChannels bool     `json:"all_public_channels"`
+	ExcludedChannels  []string `json:"excluded_channels"`
+	// ChannelPatterns are monitored in addition to the explicit channels, e.g. incident-*
+	ChannelPatterns []string `json:"channel_patterns"`
+	// AutoMonitorOnInvite adds the channels we are invited to to the configuration
+	AutoMonitorOnInvite bool `json:"auto_monitor_on_invite"`
+	// SeverityVTPositives and SeverityXFEScore are where indicators turn red, 0 for the defaults
+	SeverityVTPositives int     `json:"severity_vt_positives"`
+	SeverityXFEScore    float64 `json:"severity_xfe_score"`
+	// DisabledSources are the reputation sources we do not check the indicators with
+	DisabledSources []string `json:"disabled_sources"`
+	// EnabledSources are the opt-in sources the team checks the indicators with
+	EnabledSources []string `json:"enabled_sources"`
+	// Scoring is the weight of every source and the thresholds of the verdict, with the defaults filled in
+	Scoring domain.ScoringProfile `json:"scoring"`
+	// Locale is the language the bot replies in, English if empty
+	Locale string `json:"locale"`
+}
+
+type customPattern struct {
+	Pattern string `json:"pattern"`
 }
 
 type join struct {
@@ -73,6 +136,35 @@ func (ac *AppContext) info(w http.ResponseWriter, r *http.Request) {
 	res.VerboseIM = savedChannels.VerboseIM
 	res.Regexp = savedChannels.Regexp
 	res.All = savedChannels.All
+	res.DisableRefang = savedChannels.DisableRefang
+	res.DisableDomains = savedChannels.DisableDomains
+	res.InternalIPs = savedChannels.InternalIPs
+	res.CustomPatterns = savedChannels.CustomPatterns
+	res.CustomWebhook = savedChannels.CustomWebhook
+	res.Whitelist = savedChannels.Whitelist
+	res.InternalDomains = savedChannels.InternalDomains
+	res.DisableAttachments = savedChannels.DisableAttachments
+	res.ReplyInThread = savedChannels.ReplyInThread
+	res.ScanBotMessages = savedChannels.ScanBotMessages
+	res.ScanEmails = savedChannels.ScanEmails
+	res.ScanCode = savedChannels.ScanCode
+	res.IgnoredUsers = savedChannels.IgnoredUsers
+	res.ReplyThreshold = savedChannels.ReplyThreshold
+	res.ReplyMode = savedChannels.ReplyMode
+	res.Muted = savedChannels.Muted
+	res.DigestChannel, res.DigestHour, res.DigestTimezone = savedChannels.DigestChannel, savedChannels.DigestHour, savedChannels.DigestTimezone
+	res.DisableWeeklyReport = savedChannels.DisableWeeklyReport
+	res.AllPublicChannels, res.ExcludedChannels = savedChannels.AllPublicChannels, savedChannels.ExcludedChannels
+	res.ChannelPatterns = savedChannels.ChannelPatterns
+	res.AutoMonitorOnInvite = savedChannels.AutoMonitorOnInvite
+	res.SeverityVTPositives, res.SeverityXFEScore = savedChannels.SeverityVTPositives, savedChannels.SeverityXFEScore
+	res.DisabledSources, res.EnabledSources = savedChannels.DisabledSources, savedChannels.EnabledSources
+	res.Scoring = savedChannels.Scoring.Effective()
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	res.Locale = team.Locale
 	json.NewEncoder(w).Encode(res)
 }
 
@@ -133,21 +225,928 @@ func (ac *AppContext) save(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	err := ac.r.SetChannelsAndGroups(req)
+	if webErr := validateCustom(req); webErr != nil {
+		WriteError(w, webErr)
+		return
+	}
+	for ch, threshold := range req.ReplyThreshold {
+		if !domain.ValidThreshold(threshold) {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: fmt.Sprintf("Invalid reply threshold %s for %s - must be all, suspicious or malicious", threshold, ch)})
+			return
+		}
+	}
+	for ch, mode := range req.ReplyMode {
+		if !domain.ValidMode(mode) {
+			WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: fmt.Sprintf("Invalid reply mode %s for %s - must be message, reaction or both", mode, ch)})
+			return
+		}
+	}
+	if err := req.ValidateChannelPatterns(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := req.ValidDigest(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := req.ValidSeverity(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := req.ValidSources(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := req.ValidScoring(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := req.ValidInternalDomains(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	ac.saveConfiguration(req)
+	w.WriteHeader(http.StatusNoContent)
+	w.Write([]byte("\n"))
+}
+
+// validateCustom checks the custom patterns and webhook of the configuration
+func validateCustom(c *domain.Configuration) *Error {
+	if err := c.ValidateCustomPatterns(); err != nil {
+		return &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()}
+	}
+	if c.CustomWebhook != "" {
+		if len(c.CustomWebhook) > 254 || !util.PublicURL(c.CustomWebhook) {
+			return &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "Webhook must be a valid public http(s) URL of up to 254 characters"}
+		}
+	}
+	return nil
+}
+
+// saveConfiguration stores the configuration and notifies the bots to reload it
+func (ac *AppContext) saveConfiguration(c *domain.Configuration) {
+	err := ac.r.SetChannelsAndGroups(c)
+	if err != nil {
+		panic(err)
+	}
+	team, err := ac.r.Team(c.Team)
+	if err != nil {
+		panic(err)
+	}
+	if err = ac.q.PushConf(team.ExternalID); err != nil {
+		logrus.WithError(err).Warnf("Unable to push configuration reload for team [%s]", team.ExternalID)
+	}
+}
+
+func (ac *AppContext) addPattern(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*customPattern)
+	u := getRequestUser(r)
+	if _, err := domain.CompileCustomPattern(req.Pattern); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: fmt.Sprintf("Error parsing pattern - %v", err)})
+		return
+	}
+	c, err := ac.r.ChannelsAndGroups(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if !util.In(c.CustomPatterns, req.Pattern) {
+		c.CustomPatterns = append(c.CustomPatterns, req.Pattern)
+	}
+	if webErr := validateCustom(c); webErr != nil {
+		WriteError(w, webErr)
+		return
+	}
+	ac.saveConfiguration(c)
+	json.NewEncoder(w).Encode(c.CustomPatterns)
+}
+
+func (ac *AppContext) removePattern(w http.ResponseWriter, r *http.Request) {
+	pattern := r.FormValue("pattern")
+	u := getRequestUser(r)
+	c, err := ac.r.ChannelsAndGroups(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	index := util.Index(c.CustomPatterns, pattern)
+	if index < 0 {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	c.CustomPatterns = append(c.CustomPatterns[:index], c.CustomPatterns[index+1:]...)
+	ac.saveConfiguration(c)
+	json.NewEncoder(w).Encode(c.CustomPatterns)
+}
+
+type internalDomain struct {
+	Domain string `json:"domain"`
+}
+
+// internalDomains lists the domains whose URLs are never sent to the sources
+func (ac *AppContext) internalDomains(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	c, err := ac.r.ChannelsAndGroups(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	domains := make([]string, 0)
+	json.NewEncoder(w).Encode(append(domains, c.InternalDomains...))
+}
+
+func (ac *AppContext) addInternalDomain(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*internalDomain)
+	u := getRequestUser(r)
+	c, err := ac.r.ChannelsAndGroups(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	d := strings.ToLower(strings.Trim(strings.TrimSpace(req.Domain), "."))
+	if !util.In(c.InternalDomains, d) {
+		c.InternalDomains = append(c.InternalDomains, d)
+	}
+	if err = c.ValidInternalDomains(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	ac.saveConfiguration(c)
+	json.NewEncoder(w).Encode(c.InternalDomains)
+}
+
+func (ac *AppContext) removeInternalDomain(w http.ResponseWriter, r *http.Request) {
+	d := strings.ToLower(r.FormValue("domain"))
+	u := getRequestUser(r)
+	c, err := ac.r.ChannelsAndGroups(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	index := util.Index(c.InternalDomains, d)
+	if index < 0 {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	c.InternalDomains = append(c.InternalDomains[:index], c.InternalDomains[index+1:]...)
+	ac.saveConfiguration(c)
+	domains := make([]string, 0)
+	json.NewEncoder(w).Encode(append(domains, c.InternalDomains...))
+}
+
+type configAdmin struct {
+	User string `json:"user"`
+}
+
+// configAdmins lists the users that can change the configuration from Slack in addition to the workspace admins
+func (ac *AppContext) configAdmins(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	team, err := ac.r.Team(u.Team)
 	if err != nil {
 		panic(err)
 	}
+	admins := make([]string, 0)
+	json.NewEncoder(w).Encode(append(admins, team.ConfigAdmins...))
+}
+
+func (ac *AppContext) addConfigAdmin(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*configAdmin)
+	if req.User == "" || len(req.User) > 64 {
+		WriteError(w, ErrMissingPartRequest)
+		return
+	}
+	ac.changeConfigAdmins(w, r, func(admins []string) []string {
+		if !util.In(admins, req.User) {
+			admins = append(admins, req.User)
+		}
+		return admins
+	})
+}
+
+func (ac *AppContext) removeConfigAdmin(w http.ResponseWriter, r *http.Request) {
+	user := r.FormValue("user")
+	ac.changeConfigAdmins(w, r, func(admins []string) []string {
+		if index := util.Index(admins, user); index >= 0 {
+			admins = append(admins[:index], admins[index+1:]...)
+		}
+		return admins
+	})
+}
+
+// changeConfigAdmins applies the change if the user is a workspace admin and notifies the bots to reload the team
+func (ac *AppContext) changeConfigAdmins(w http.ResponseWriter, r *http.Request, change func([]string) []string) {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return
+	}
 	team, err := ac.r.Team(u.Team)
 	if err != nil {
 		panic(err)
 	}
+	team.ConfigAdmins = change(team.ConfigAdmins)
+	if err = ac.r.SetConfigAdmins(team.ID, team.ConfigAdmins); err != nil {
+		panic(err)
+	}
 	if err = ac.q.PushConf(team.ExternalID); err != nil {
 		logrus.WithError(err).Warnf("Unable to push configuration reload for team [%s]", team.ExternalID)
 	}
+	admins := make([]string, 0)
+	json.NewEncoder(w).Encode(append(admins, team.ConfigAdmins...))
+}
+
+type teamLocale struct {
+	Locale string `json:"locale"`
+}
+
+// setLocale changes the language the bot replies in for the team
+func (ac *AppContext) setLocale(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*teamLocale)
+	u := getRequestUser(r)
+	if !bot.ValidLocale(req.Locale) {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: fmt.Sprintf("Unknown locale %s", req.Locale)})
+		return
+	}
+	if err := ac.r.SetTeamLocale(u.Team, req.Locale); err != nil {
+		panic(err)
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if err = ac.q.PushConf(team.ExternalID); err != nil {
+		logrus.WithError(err).Warnf("Unable to push configuration reload for team [%s]", team.ExternalID)
+	}
+	json.NewEncoder(w).Encode(req)
+}
+
+// integrationAdmin returns the user if they are a workspace admin or owner, the integrations get all the verdicts of the team
+func integrationAdmin(w http.ResponseWriter, r *http.Request) *domain.User {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return nil
+	}
+	return u
+}
+
+// webhook returns the verdict webhook of the team without the secret
+func (ac *AppContext) webhook(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	hook, err := ac.r.Webhook(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if hook == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	hook.Secret = ""
+	json.NewEncoder(w).Encode(hook)
+}
+
+// setWebhook stores the verdict webhook of the team. An empty secret keeps the current one.
+func (ac *AppContext) setWebhook(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*domain.Webhook)
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if req.Secret == "" {
+		current, err := ac.r.Webhook(u.Team)
+		if err != nil {
+			panic(err)
+		}
+		if current != nil {
+			req.Secret = current.Secret
+		}
+	}
+	req.Team = u.Team
+	if err := req.Validate(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := ac.r.SetWebhook(req); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	req.Secret = ""
+	json.NewEncoder(w).Encode(req)
+}
+
+// removeWebhook stops pushing the verdicts of the team
+func (ac *AppContext) removeWebhook(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if err := ac.r.DeleteWebhook(u.Team); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
 	w.WriteHeader(http.StatusNoContent)
 	w.Write([]byte("\n"))
 }
 
+// webhookTest is the result of sending a test event
+type webhookTest struct {
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// testWebhook sends a test event to the webhook of the team so admins can verify their receiver
+func (ac *AppContext) testWebhook(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	hook, err := ac.r.Webhook(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if hook == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	res := webhookTest{Delivered: true}
+	if err = bot.TestWebhook(hook, team); err != nil {
+		res = webhookTest{Error: err.Error()}
+	}
+	json.NewEncoder(w).Encode(&res)
+}
+
+// emailAlerts returns who gets an email about the verdicts of the team
+func (ac *AppContext) emailAlerts(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	alerts, err := ac.r.EmailAlerts(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if alerts == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// setEmailAlerts stores who gets an email about the verdicts of the team
+func (ac *AppContext) setEmailAlerts(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*domain.EmailAlerts)
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	req.Team = u.Team
+	if err := req.Validate(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := ac.r.SetEmailAlerts(req); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	json.NewEncoder(w).Encode(req)
+}
+
+// removeEmailAlerts stops the emails about the verdicts of the team
+func (ac *AppContext) removeEmailAlerts(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if err := ac.r.DeleteEmailAlerts(u.Team); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	w.WriteHeader(http.StatusNoContent)
+	w.Write([]byte("\n"))
+}
+
+// sandbox returns the sandbox of the team without the key
+func (ac *AppContext) sandbox(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	s, err := ac.r.Sandbox(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if s == nil {
+		WriteError(w, ErrNotFound)
+		return
+	}
+	s.Key = ""
+	json.NewEncoder(w).Encode(s)
+}
+
+// setSandbox stores the sandbox of the team. An empty key keeps the current one.
+func (ac *AppContext) setSandbox(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*domain.Sandbox)
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if req.Key == "" {
+		current, err := ac.r.Sandbox(u.Team)
+		if err != nil {
+			panic(err)
+		}
+		if current != nil {
+			req.Key = current.Key
+		}
+	}
+	req.Team = u.Team
+	if err := req.Validate(); err != nil {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: err.Error()})
+		return
+	}
+	if err := ac.r.SetSandbox(req); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	req.Key = ""
+	json.NewEncoder(w).Encode(req)
+}
+
+// removeSandbox stops running the files of the team in its sandbox
+func (ac *AppContext) removeSandbox(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if err := ac.r.DeleteSandbox(u.Team); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	w.WriteHeader(http.StatusNoContent)
+	w.Write([]byte("\n"))
+}
+
+// xsoarSettings is the XSOAR server of the team, the API key is never returned
+type xsoarSettings struct {
+	URL          string `json:"url"`
+	Key          string `json:"key,omitempty"`
+	IncidentType string `json:"incident_type"`
+	HasKey       bool   `json:"has_key"`
+}
+
+// xsoar returns the XSOAR server we open incidents in for the team
+func (ac *AppContext) xsoar(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(&xsoarSettings{URL: team.XSOARURL, IncidentType: team.XSOARIncidentType, HasKey: team.XSOARKey != ""})
+}
+
+// setXSOAR stores the XSOAR server of the team. An empty key keeps the current one.
+func (ac *AppContext) setXSOAR(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*xsoarSettings)
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	if req.Key != "" {
+		team.XSOARKey = req.Key
+	}
+	if len(req.URL) > 254 || !util.PublicURL(req.URL) {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "XSOAR server must be a valid public http(s) URL of up to 254 characters"})
+		return
+	}
+	if team.XSOARKey == "" || len(team.XSOARKey) > 254 || len(req.IncidentType) > 128 {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "XSOAR needs an API key of up to 254 characters and an incident type of up to 128"})
+		return
+	}
+	team.XSOARURL, team.XSOARIncidentType = req.URL, req.IncidentType
+	if err = ac.r.SetTeamXSOAR(team); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	json.NewEncoder(w).Encode(&xsoarSettings{URL: team.XSOARURL, IncidentType: team.XSOARIncidentType, HasKey: true})
+}
+
+// removeXSOAR stops opening incidents for the team
+func (ac *AppContext) removeXSOAR(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if err := ac.r.SetTeamXSOAR(&domain.Team{ID: u.Team}); err != nil {
+		panic(err)
+	}
+	ac.reloadTeam(u.Team)
+	w.WriteHeader(http.StatusNoContent)
+	w.Write([]byte("\n"))
+}
+
+// teamKey is a reputation source key of the team, only the password of IBM X-Force Exchange is set
+type teamKey struct {
+	Source   string `json:"source"`
+	Key      string `json:"key"`
+	Password string `json:"password,omitempty"`
+}
+
+// teamKeys are the sources the team has its own key for, the keys are never returned
+type teamKeys struct {
+	VT        bool `json:"vt"`
+	XFE       bool `json:"xfe"`
+	AbuseIPDB bool `json:"abuseipdb"`
+	OTX       bool `json:"otx"`
+	HIBP      bool `json:"hibp"`
+}
+
+// teamKeysOf returns which keys the team set
+func teamKeysOf(team *domain.Team) *teamKeys {
+	creds := team.Credentials()
+	set := func(source string) bool { return creds[source].Key != "" }
+	return &teamKeys{VT: set(domain.SourceVT), XFE: set(domain.SourceXFE), AbuseIPDB: set(domain.SourceAbuseIPDB),
+		OTX: set(domain.SourceOTX), HIBP: set(domain.SourceHIBP)}
+}
+
+// keys returns which sources use the keys of the team
+func (ac *AppContext) keys(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(teamKeysOf(team))
+}
+
+// saveKey checks the source accepts the key and stores it for the team, an empty key clears it
+func (ac *AppContext) saveKey(team string, req *teamKey) *Error {
+	if len(req.Key) > 254 || len(req.Password) > 254 {
+		return &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "Keys can be up to 254 characters"}
+	}
+	if req.Source != domain.SourceVT && req.Source != domain.SourceXFE && !util.In(domain.KeyedSources, req.Source) {
+		return &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "Keys can be set for vt, xfe, abuseipdb, otx and hibp"}
+	}
+	if req.Source == domain.SourceXFE && (req.Key == "") != (req.Password == "") {
+		return &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "IBM X-Force Exchange needs both a key and a password"}
+	}
+	creds := domain.Credentials{Key: req.Key, Password: req.Password}
+	if req.Key != "" {
+		if err := ac.validateKey(req.Source, creds); err != nil {
+			logrus.WithError(err).Infof("Invalid %s key for team %s", req.Source, team)
+			return &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: fmt.Sprintf("%s did not accept the key", req.Source)}
+		}
+	}
+	if err := ac.r.SetTeamCredentials(team, req.Source, creds); err != nil {
+		panic(err)
+	}
+	return nil
+}
+
+// setKey stores the key of a source for the team
+func (ac *AppContext) setKey(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*teamKey)
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if req.Key == "" {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "Missing key"})
+		return
+	}
+	if e := ac.saveKey(u.Team, req); e != nil {
+		WriteError(w, e)
+		return
+	}
+	ac.reloadTeam(u.Team)
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(teamKeysOf(team))
+}
+
+// removeKey returns the source of the query to our key, or skips it if we have none
+func (ac *AppContext) removeKey(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if e := ac.saveKey(u.Team, &teamKey{Source: r.FormValue("source")}); e != nil {
+		WriteError(w, e)
+		return
+	}
+	ac.reloadTeam(u.Team)
+	w.WriteHeader(http.StatusNoContent)
+	w.Write([]byte("\n"))
+}
+
+// redrive is the dead letters to push to the workers again
+type redrive struct {
+	IDs []int64 `json:"ids"`
+}
+
+// deadLetters lists the latest work requests of the team the workers gave up on
+func (ac *AppContext) deadLetters(w http.ResponseWriter, r *http.Request) {
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	letters, err := ac.r.DeadLetters(team.ExternalID, defaultPageSize)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(letters)
+}
+
+// redriveDeadLetters pushes the dead letters to the workers again and removes them
+func (ac *AppContext) redriveDeadLetters(w http.ResponseWriter, r *http.Request) {
+	req := getRequestBody(r).(*redrive)
+	u := integrationAdmin(w, r)
+	if u == nil {
+		return
+	}
+	if len(req.IDs) == 0 {
+		WriteError(w, &Error{ID: "bad_request", Status: 400, Title: "Bad Request", Detail: "No dead letters to redrive"})
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	redriven := 0
+	for _, id := range req.IDs {
+		d, err := ac.r.DeadLetter(team.ExternalID, id)
+		if err != nil {
+			panic(err)
+		}
+		if d == nil {
+			continue
+		}
+		work, err := d.WorkRequest()
+		if err != nil {
+			logrus.WithError(err).Warnf("Unable to read dead letter %d of team [%s]", id, team.ExternalID)
+			continue
+		}
+		if err = ac.q.PushWork(work); err != nil {
+			panic(err)
+		}
+		if err = ac.r.DeleteDeadLetter(team.ExternalID, id); err != nil {
+			panic(err)
+		}
+		redriven++
+	}
+	json.NewEncoder(w).Encode(map[string]int{"redriven": redriven})
+}
+
+// reloadTeam notifies the bots to reload the team
+func (ac *AppContext) reloadTeam(teamID string) {
+	team, err := ac.r.Team(teamID)
+	if err != nil {
+		panic(err)
+	}
+	if err = ac.q.PushConf(team.ExternalID); err != nil {
+		logrus.WithError(err).Warnf("Unable to push configuration reload for team [%s]", team.ExternalID)
+	}
+}
+
+// Paging of the false positives list
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// falsePositivesPage is one page of the false positives the team reported
+type falsePositivesPage struct {
+	Total int                    `json:"total"`
+	Page  int                    `json:"page"`
+	Size  int                    `json:"size"`
+	Items []domain.FalsePositive `json:"items"`
+}
+
+// pageParams returns the 1 based page and the page size from the query with sane defaults
+func pageParams(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	size, err := strconv.Atoi(r.FormValue("size"))
+	if err != nil || size < 1 {
+		size = defaultPageSize
+	} else if size > maxPageSize {
+		size = maxPageSize
+	}
+	return page, size
+}
+
+// falsePositives lists the false positives the team reported for the workspace admins to review
+func (ac *AppContext) falsePositives(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return
+	}
+	page, size := pageParams(r)
+	fps, total, err := ac.r.FalsePositives(u.Team, (page-1)*size, size)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(&falsePositivesPage{Total: total, Page: page, Size: size, Items: fps})
+}
+
+// teamStats is what we checked for the team or a single channel today and in the last week
+type teamStats struct {
+	Channel string                    `json:"channel,omitempty"`
+	Today   *domain.ChannelStatistics `json:"today"`
+	Week    *domain.ChannelStatistics `json:"week"`
+}
+
+// stats returns the statistics of the team, or of the channel given in the channel query parameter
+func (ac *AppContext) stats(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	channel := r.URL.Query().Get("channel")
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	res := &teamStats{Channel: channel}
+	var err error
+	if res.Today, err = ac.r.TotalsSince(u.Team, channel, today); err != nil {
+		panic(err)
+	}
+	if res.Week, err = ac.r.TotalsSince(u.Team, channel, today.AddDate(0, 0, -6)); err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// replyLatency is how long the replies of the team took in the last hour, in milliseconds
+type replyLatency struct {
+	P50     int64 `json:"p50"`
+	P95     int64 `json:"p95"`
+	Replies int   `json:"replies"`
+}
+
+// latency shows the workspace admins how long it takes us to answer their messages
+func (ac *AppContext) latency(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	p50, p95, count := ac.b.ReplyLatency(team.ExternalID)
+	json.NewEncoder(w).Encode(&replyLatency{P50: int64(p50 / time.Millisecond), P95: int64(p95 / time.Millisecond), Replies: count})
+}
+
+// sourceStatus are the sources we do not check the indicators of the team with right now and why
+type sourceStatus struct {
+	Breakers []domain.SourceBreaker `json:"breakers"`
+}
+
+// sources shows the admins the sources that keep failing, the replies say they are unavailable
+func (ac *AppContext) sources(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return
+	}
+	team, err := ac.r.Team(u.Team)
+	if err != nil {
+		panic(err)
+	}
+	breakers, err := ac.b.SourceBreakers(team)
+	if err != nil {
+		panic(err)
+	}
+	if breakers == nil {
+		breakers = []domain.SourceBreaker{}
+	}
+	json.NewEncoder(w).Encode(&sourceStatus{Breakers: breakers})
+}
+
+// scanHistoryPage is one page of the scan history of the team
+type scanHistoryPage struct {
+	Total int                 `json:"total"`
+	Page  int                 `json:"page"`
+	Size  int                 `json:"size"`
+	Items []domain.ScanRecord `json:"items"`
+}
+
+// scanFilter reads the filter of the scan history from the query. Dates are RFC 3339 or YYYY-MM-DD, to is exclusive.
+func scanFilter(r *http.Request) (domain.ScanFilter, error) {
+	q := r.URL.Query()
+	filter := domain.ScanFilter{Channel: q.Get("channel"), Indicator: q.Get("indicator"), Malicious: q.Get("malicious") == "true"}
+	var err error
+	parse := func(v string) (time.Time, error) {
+		if t, e := time.Parse("2006-01-02", v); e == nil {
+			return t, nil
+		}
+		return time.Parse(time.RFC3339, v)
+	}
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = parse(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = parse(v); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// scanHistory lists what we checked for the team of the user, newest first. The history has the indicators of every
+// channel, including private ones, so only the workspace admins see it.
+func (ac *AppContext) scanHistory(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return
+	}
+	filter, err := scanFilter(r)
+	if err != nil {
+		WriteError(w, ErrBadContentRequest)
+		return
+	}
+	page, size := pageParams(r)
+	records, total, err := ac.r.ScanHistory(u.Team, filter, (page-1)*size, size)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(&scanHistoryPage{Total: total, Page: page, Size: size, Items: records})
+}
+
+// indicatorSightings is where and when we saw an indicator before
+type indicatorSightings struct {
+	Indicator  string              `json:"indicator"`
+	Normalized string              `json:"normalized"`
+	Total      int                 `json:"total"`
+	Items      []domain.ScanRecord `json:"items"`
+}
+
+// sightings lists the latest scans of the indicator in the path for the team of the user, newest first.
+// Like the history they cover private channels so only the workspace admins see them.
+func (ac *AppContext) sightings(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if !u.IsAdmin && !u.IsOwner {
+		WriteError(w, ErrForbidden)
+		return
+	}
+	value := strings.TrimPrefix(getRequestParams(r).ByName("value"), "/")
+	if value == "" {
+		WriteError(w, ErrBadContentRequest)
+		return
+	}
+	_, size := pageParams(r)
+	normalized := bot.NormalizeIndicator(value)
+	records, total, err := ac.r.Sightings(u.Team, normalized, size)
+	if err != nil {
+		panic(err)
+	}
+	json.NewEncoder(w).Encode(&indicatorSightings{Indicator: value, Normalized: normalized, Total: total, Items: records})
+}
+
+// queueHealth is the depth of the lanes of the queue
+type queueHealth struct {
+	Backend string              `json:"backend"`
+	Lanes   []*domain.QueueLane `json:"lanes"`
+}
+
+// queues reports the depth of the queue to the system admins, the workspace admins do not operate the service
+func (ac *AppContext) queues(w http.ResponseWriter, r *http.Request) {
+	u := getRequestUser(r)
+	if u == nil || !u.IsSystemAdmin {
+		WriteError(w, ErrForbidden)
+		return
+	}
+	lanes, err := ac.q.Lanes()
+	if err != nil {
+		panic(err)
+	}
+	backend := conf.Options.Queue.Backend
+	if backend == "" {
+		backend = "db"
+	}
+	json.NewEncoder(w).Encode(&queueHealth{Backend: backend, Lanes: lanes})
+}
+
 // Struct for parsing json in google's response
 type googleResponse struct {
 	Success    bool
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/queue"
+	"github.com/demisto/alfred/repo/repotest"
+	"github.com/demisto/alfred/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestPageParams(t *testing.T) {
+	tests := []struct {
+		query      string
+		page, size int
+	}{
+		{"", 1, defaultPageSize},
+		{"?page=3&size=20", 3, 20},
+		{"?page=0&size=-1", 1, defaultPageSize},
+		{"?page=x&size=100000", 1, maxPageSize},
+	}
+	for _, test := range tests {
+		page, size := pageParams(httptest.NewRequest("GET", "/falsepositives"+test.query, nil))
+		if page != test.page || size != test.size {
+			t.Errorf("pageParams(%s) = %d, %d, expected %d, %d", test.query, page, size, test.page, test.size)
+		}
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	f, err := scanFilter(httptest.NewRequest("GET", "/history?from=2020-01-02&to=2020-02-03T04:05:06Z&channel=C1&malicious=true", nil))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if f.From != time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC) || f.To != time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC) {
+		t.Errorf("unexpected range %v - %v", f.From, f.To)
+	}
+	if f.Channel != "C1" || !f.Malicious || f.Indicator != "" {
+		t.Errorf("unexpected filter %+v", f)
+	}
+	if _, err = scanFilter(httptest.NewRequest("GET", "/history?from=yesterday", nil)); err == nil {
+		t.Error("expected an error for a bad date")
+	}
+}
+
+func TestScanHistoryForAdmins(t *testing.T) {
+	r := repotest.New()
+	r.StoreScans([]domain.ScanRecord{{Team: "1", Channel: "G1", User: "U2", Indicator: "8.8.8.8"}})
+	ac := &AppContext{r: r}
+	w := httptest.NewRecorder()
+	ac.scanHistory(w, setRequestContext(httptest.NewRequest("GET", "/history", nil), contextUser, &domain.User{Team: "1"}))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the history of private channels to be forbidden to members but got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ac.scanHistory(w, setRequestContext(httptest.NewRequest("GET", "/history", nil), contextUser, &domain.User{Team: "1", IsAdmin: true}))
+	page := &scanHistoryPage{}
+	if err := json.NewDecoder(w.Body).Decode(page); err != nil || w.Code != http.StatusOK || page.Total != 1 {
+		t.Errorf("expected the history for the admin - %d, %+v, %v", w.Code, page, err)
+	}
+}
+
+func TestSightingsForAdmins(t *testing.T) {
+	r := repotest.New()
+	r.StoreScans([]domain.ScanRecord{{Team: "1", Channel: "G1", Indicator: "8.8.8.8", Normalized: "8.8.8.8"}})
+	ac := &AppContext{r: r}
+	request := func(u *domain.User) *http.Request {
+		req := httptest.NewRequest("GET", "/api/indicators/8.8.8.8", nil)
+		req = setRequestContext(req, contextParams, httprouter.Params{{Key: "value", Value: "/8.8.8.8"}})
+		return setRequestContext(req, contextUser, u)
+	}
+	w := httptest.NewRecorder()
+	ac.sightings(w, request(&domain.User{Team: "1"}))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the sightings in private channels to be forbidden to members but got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ac.sightings(w, request(&domain.User{Team: "1", IsOwner: true}))
+	res := &indicatorSightings{}
+	if err := json.NewDecoder(w.Body).Decode(res); err != nil || w.Code != http.StatusOK || res.Total != 1 {
+		t.Errorf("expected the sightings for the owner - %d, %+v, %v", w.Code, res, err)
+	}
+}
+
+func TestSetKeyValidates(t *testing.T) {
+	r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1"})
+	ac := &AppContext{r: r, q: queue.NewMemoryQueue(0), validateKey: func(source string, creds domain.Credentials) error {
+		if creds.Key != "good" {
+			return errors.New("unauthorized")
+		}
+		return nil
+	}}
+	request := func(key *teamKey) *http.Request {
+		req := setRequestContext(httptest.NewRequest("POST", "/api/keys", nil), contextBody, key)
+		return setRequestContext(req, contextUser, &domain.User{Team: "1", IsAdmin: true})
+	}
+	w := httptest.NewRecorder()
+	ac.setKey(w, request(&teamKey{Source: domain.SourceOTX, Key: "bad"}))
+	if team, _ := r.Team("1"); w.Code != http.StatusBadRequest || team.SourceKeys[domain.SourceOTX] != "" {
+		t.Errorf("expected a key the source refused to be rejected - %d, %+v", w.Code, team.SourceKeys)
+	}
+	w = httptest.NewRecorder()
+	ac.setKey(w, request(&teamKey{Source: domain.SourceOTX, Key: "good"}))
+	keys := &teamKeys{}
+	if err := json.NewDecoder(w.Body).Decode(keys); err != nil || w.Code != http.StatusOK || !keys.OTX {
+		t.Errorf("expected the key to be saved - %d, %+v, %v", w.Code, keys, err)
+	}
+}
+
+func TestQueues(t *testing.T) {
+	q := queue.NewMemoryQueue(0)
+	defer q.Close()
+	q.PushConf("T1")
+	ac := &AppContext{q: q}
+	// The workspace admins do not see the queue
+	w := httptest.NewRecorder()
+	ac.queues(w, setRequestContext(httptest.NewRequest("GET", "/api/admin/queues", nil), contextUser, &domain.User{IsAdmin: true}))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected forbidden but got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ac.queues(w, setRequestContext(httptest.NewRequest("GET", "/api/admin/queues", nil), contextUser, &domain.User{IsSystemAdmin: true}))
+	health := &queueHealth{}
+	if err := json.NewDecoder(w.Body).Decode(health); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d - %v", w.Code, err)
+	}
+	if len(health.Lanes) != 4 || health.Lanes[2].Lane != queue.LaneConf || health.Lanes[2].Depth != 1 {
+		t.Errorf("unexpected lanes %+v", health.Lanes)
+	}
+}
+
+func TestQueuesRoute(t *testing.T) {
+	saved := conf.Options.Security
+	defer func() { conf.Options.Security = saved }()
+	conf.Options.Security.SessionKey, conf.Options.Security.Timeout = "0123456789abcdef0123456789abcdef", 60
+	q := queue.NewMemoryQueue(0)
+	defer q.Close()
+	r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1"},
+		&domain.User{ID: "u1", ExternalID: "U1", Name: "admin", IsAdmin: true}, &domain.User{ID: "u2", ExternalID: "U2", Name: "system", IsSystemAdmin: true})
+	router := New(&AppContext{r: r, q: q})
+	tests := []struct {
+		name   string
+		user   string
+		status int
+	}{
+		{"no session", "", http.StatusUnauthorized},
+		{"workspace admin", "u1", http.StatusForbidden},
+		{"system admin", "u2", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/admin/queues", nil)
+		req.Header.Set("Accept", "application/json")
+		if test.user != "" {
+			val, err := util.EncryptJSON(&session{User: test.user, UserID: test.user, When: time.Now()}, conf.Options.Security.SessionKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(&http.Cookie{Name: sessionCookie, Value: val})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d but got %d", test.name, test.status, w.Code)
+		}
+	}
+}
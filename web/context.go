@@ -4,20 +4,23 @@ import (
 	"time"
 
 	"github.com/demisto/alfred/bot"
+	"github.com/demisto/alfred/domain"
 	"github.com/demisto/alfred/queue"
 	"github.com/demisto/alfred/repo"
 )
 
 // AppContext holds the web context for the handlers
 type AppContext struct {
-	r *repo.MySQL
+	r repo.Repo
 	q queue.Queue
 	b *bot.Bot
+	// validateKey checks a source accepts the key a team sets
+	validateKey func(source string, creds domain.Credentials) error
 }
 
 // NewContext creates a new context
-func NewContext(r *repo.MySQL, q queue.Queue, b *bot.Bot) *AppContext {
-	return &AppContext{r: r, q: q, b: b}
+func NewContext(r repo.Repo, q queue.Queue, b *bot.Bot) *AppContext {
+	return &AppContext{r: r, q: q, b: b, validateKey: bot.ValidateKey}
 }
 
 type session struct {
@@ -1,10 +1,17 @@
 package web
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -200,6 +207,50 @@ func csrfHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+const (
+	// slackSignatureMaxAge is how old a signed request from Slack can be so captured requests cannot be replayed
+	slackSignatureMaxAge = 5 * time.Minute
+	// maxSlackBody is the largest request we accept from Slack
+	maxSlackBody = 1 << 20
+)
+
+// validSlackSignature checks the signature Slack computes over the timestamp and the body with our signing secret
+func validSlackSignature(secret, timestamp, signature string, body []byte, now time.Time) bool {
+	if secret == "" || signature == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return hmac.Equal([]byte("v0="+hex.EncodeToString(mac.Sum(nil))), []byte(signature))
+}
+
+// slackSignatureHandler rejects requests that were not signed by Slack with our signing secret
+func slackSignatureHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSlackBody))
+		if err != nil {
+			WriteError(w, ErrBadRequest)
+			return
+		}
+		if !validSlackSignature(conf.Options.Slack.SigningSecret, r.Header.Get("X-Slack-Request-Timestamp"), r.Header.Get("X-Slack-Signature"), body, time.Now()) {
+			log.Warn("Request with an invalid Slack signature received")
+			WriteError(w, ErrAuth)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 const (
 	sessionCookie = `SES`
 )
@@ -226,7 +277,7 @@ func (ac *AppContext) authHandler(next http.Handler) http.Handler {
 			WriteError(w, ErrAuth)
 			return
 		}
-		setRequestContext(r, contextSession, &sess)
+		r = setRequestContext(r, contextSession, &sess)
 		log.Debugf("User %v in request", sess.User)
 		u, err := ac.r.User(sess.UserID)
 		if err != nil {
@@ -238,7 +289,7 @@ func (ac *AppContext) authHandler(next http.Handler) http.Handler {
 			WriteError(w, ErrAuth)
 			return
 		}
-		setRequestContext(r, contextUser, u)
+		r = setRequestContext(r, contextUser, u)
 		// Set the new cookie for the user with the new timeout
 		sess.When = time.Now()
 		secure := conf.Options.SSL.Key != ""
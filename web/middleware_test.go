@@ -0,0 +1,110 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/demisto/alfred/conf"
+	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/repo/repotest"
+	"github.com/demisto/alfred/util"
+)
+
+func TestValidSlackSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte("payload=%7B%7D")
+	sign := func(secret string, ts time.Time) (string, string) {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + timestamp + ":" + string(body)))
+		return timestamp, "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	ts, sig := sign("secret", now)
+	if !validSlackSignature("secret", ts, sig, body, now) {
+		t.Error("expected a valid signature")
+	}
+	if validSlackSignature("other", ts, sig, body, now) {
+		t.Error("expected a signature with another secret to fail")
+	}
+	if validSlackSignature("secret", ts, sig, []byte("payload=%7B%22a%22%7D"), now) {
+		t.Error("expected a signature of another body to fail")
+	}
+	if validSlackSignature("", ts, sig, body, now) {
+		t.Error("expected requests to fail without a signing secret")
+	}
+	ts, sig = sign("secret", now.Add(-10*time.Minute))
+	if validSlackSignature("secret", ts, sig, body, now) {
+		t.Error("expected an old request to fail")
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	saved := conf.Options.Security
+	defer func() { conf.Options.Security = saved }()
+	conf.Options.Security.SessionKey, conf.Options.Security.Timeout = "0123456789abcdef0123456789abcdef", 60
+	r := repotest.New().SeedTeam(&domain.Team{ID: "1", ExternalID: "T1"},
+		&domain.User{ID: "u1", ExternalID: "U1", Name: "active"}, &domain.User{ID: "u2", ExternalID: "U2", Name: "revoked", Status: domain.UserStatusInactive})
+	ac := &AppContext{r: r}
+	var user *domain.User
+	h := ac.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = getRequestUser(r)
+		if getRequestSession(r) == nil {
+			t.Error("expected the session in the request")
+		}
+	}))
+	cookie := func(sess session) *http.Cookie {
+		val, err := util.EncryptJSON(&sess, conf.Options.Security.SessionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: sessionCookie, Value: val}
+	}
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+		user   string
+	}{
+		{"no session", nil, http.StatusUnauthorized, ""},
+		{"bad session", &http.Cookie{Name: sessionCookie, Value: "garbage"}, http.StatusUnauthorized, ""},
+		{"timed out", cookie(session{User: "active", UserID: "u1", When: time.Now().Add(-2 * time.Hour)}), http.StatusUnauthorized, ""},
+		{"revoked", cookie(session{User: "revoked", UserID: "u2", When: time.Now()}), http.StatusUnauthorized, ""},
+		{"active", cookie(session{User: "active", UserID: "u1", When: time.Now().Add(-time.Minute)}), http.StatusOK, "u1"},
+	}
+	for _, test := range tests {
+		user = nil
+		req := httptest.NewRequest("GET", "/api/user", nil)
+		if test.cookie != nil {
+			req.AddCookie(test.cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d but got %d", test.name, test.status, w.Code)
+		}
+		switch {
+		case test.user == "" && user != nil:
+			t.Errorf("%s: the handler should not be called", test.name)
+		case test.user != "" && (user == nil || user.ID != test.user):
+			t.Errorf("%s: expected user %s in the request but got %+v", test.name, test.user, user)
+		}
+		if test.status == http.StatusOK && len(w.Result().Cookies()) != 1 {
+			t.Errorf("%s: expected the session to be renewed", test.name)
+		}
+	}
+	// A session of a user the repo does not know is a bug so it panics for the recovery handler
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a session of an unknown user to panic")
+		}
+	}()
+	req := httptest.NewRequest("GET", "/api/user", nil)
+	req.AddCookie(cookie(session{User: "gone", UserID: "u9", When: time.Now()}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
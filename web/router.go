@@ -10,6 +10,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
+	"github.com/demisto/alfred/metrics"
 	"github.com/demisto/alfred/slack"
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
@@ -121,10 +122,50 @@ func New(appC *AppContext) *Router {
 	r.Get("/info", authHandlers.ThenFunc(appC.info))
 	r.Post("/match", authHandlers.Append(contentTypeHandler, bodyHandler(regexpMatch{})).ThenFunc(appC.match))
 	r.Post("/save", authHandlers.Append(contentTypeHandler, bodyHandler(domain.Configuration{})).ThenFunc(appC.save))
+	r.Post("/patterns", authHandlers.Append(contentTypeHandler, bodyHandler(customPattern{})).ThenFunc(appC.addPattern))
+	r.Delete("/patterns", authHandlers.ThenFunc(appC.removePattern))
+	r.Get("/internaldomains", authHandlers.ThenFunc(appC.internalDomains))
+	r.Post("/internaldomains", authHandlers.Append(contentTypeHandler, bodyHandler(internalDomain{})).ThenFunc(appC.addInternalDomain))
+	r.Delete("/internaldomains", authHandlers.ThenFunc(appC.removeInternalDomain))
+	r.Post("/locale", authHandlers.Append(contentTypeHandler, bodyHandler(teamLocale{})).ThenFunc(appC.setLocale))
+	r.Get("/admins", authHandlers.ThenFunc(appC.configAdmins))
+	r.Post("/admins", authHandlers.Append(contentTypeHandler, bodyHandler(configAdmin{})).ThenFunc(appC.addConfigAdmin))
+	r.Delete("/admins", authHandlers.ThenFunc(appC.removeConfigAdmin))
+	r.Get("/falsepositives", authHandlers.ThenFunc(appC.falsePositives))
+	r.Get("/webhook", authHandlers.ThenFunc(appC.webhook))
+	r.Post("/webhook", authHandlers.Append(contentTypeHandler, bodyHandler(domain.Webhook{})).ThenFunc(appC.setWebhook))
+	r.Delete("/webhook", authHandlers.ThenFunc(appC.removeWebhook))
+	r.Post("/webhook/test", authHandlers.ThenFunc(appC.testWebhook))
+	r.Get("/emailalerts", authHandlers.ThenFunc(appC.emailAlerts))
+	r.Post("/emailalerts", authHandlers.Append(contentTypeHandler, bodyHandler(domain.EmailAlerts{})).ThenFunc(appC.setEmailAlerts))
+	r.Delete("/emailalerts", authHandlers.ThenFunc(appC.removeEmailAlerts))
+	r.Get("/sandbox", authHandlers.ThenFunc(appC.sandbox))
+	r.Post("/sandbox", authHandlers.Append(contentTypeHandler, bodyHandler(domain.Sandbox{})).ThenFunc(appC.setSandbox))
+	r.Delete("/sandbox", authHandlers.ThenFunc(appC.removeSandbox))
+	r.Get("/xsoar", authHandlers.ThenFunc(appC.xsoar))
+	r.Post("/xsoar", authHandlers.Append(contentTypeHandler, bodyHandler(xsoarSettings{})).ThenFunc(appC.setXSOAR))
+	r.Delete("/xsoar", authHandlers.ThenFunc(appC.removeXSOAR))
+	r.Get("/deadletters", authHandlers.ThenFunc(appC.deadLetters))
+	r.Post("/deadletters/redrive", authHandlers.Append(contentTypeHandler, bodyHandler(redrive{})).ThenFunc(appC.redriveDeadLetters))
+	r.Get("/keys", authHandlers.ThenFunc(appC.keys))
+	r.Post("/keys", authHandlers.Append(contentTypeHandler, bodyHandler(teamKey{})).ThenFunc(appC.setKey))
+	r.Delete("/keys", authHandlers.ThenFunc(appC.removeKey))
+	r.Get("/latency", authHandlers.ThenFunc(appC.latency))
+	r.Get("/sources", authHandlers.ThenFunc(appC.sources))
+	r.Get("/stats", authHandlers.ThenFunc(appC.stats))
+	r.Get("/history", authHandlers.ThenFunc(appC.scanHistory))
+	// The value is the rest of the path so URLs can be looked up as well
+	r.Get("/api/indicators/*value", authHandlers.ThenFunc(appC.sightings))
+	r.Get("/api/admin/queues", authHandlers.ThenFunc(appC.queues))
 	r.Get("/work", commonHandlers.ThenFunc(appC.work))
 	r.Post("/join", commonHandlers.Append(contentTypeHandler, bodyHandler(join{})).ThenFunc(appC.joinSlack))
 	r.Get("/messages", commonHandlers.ThenFunc(appC.totalMessages))
 	r.Post("/events", eventsHandler.Append(contentTypeHandler, bodyHandler(slack.Response{})).ThenFunc(appC.events))
+	r.Post("/interactions", eventsHandler.Append(slackSignatureHandler).ThenFunc(appC.interactions))
+	// Prometheus scrapes the web server unless the metrics have their own internal address
+	if conf.Options.Metrics.Address == "" {
+		r.Get("/metrics", eventsHandler.Then(metrics.Handler()))
+	}
 	// Static
 	r.Get("/", staticHandlers.ThenFunc(pageHandler("/index.html")))
 	r.Get("/conf", staticHandlers.ThenFunc(pageHandler("/conf.html")))
@@ -207,7 +248,6 @@ func (r *Router) Serve() {
 
 func wrapHandler(h http.Handler) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		setRequestContext(r, contextParams, ps)
-		h.ServeHTTP(w, r)
+		h.ServeHTTP(w, setRequestContext(r, contextParams, ps))
 	}
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/demisto/alfred/bot"
 	"github.com/demisto/alfred/conf"
 	"github.com/demisto/alfred/domain"
 	"github.com/demisto/alfred/slack"
@@ -69,7 +70,7 @@ func sendThanks(team *domain.Team, user *domain.User) {
 		"as_user": true,
 		"text": fmt.Sprintf(`Hi %s, thanks for inviting me to this team.
 If you want me to monitor conversations, please add me to the relevant channels and groups.
-`+conf.DefaultHelpMessage, user.Name),
+`+bot.HelpMessage(), user.Name),
 	})
 	if err != nil {
 		logrus.Warnf("Error posting welcome message - %v", err)
@@ -147,6 +148,10 @@ func (ac *AppContext) loginOAuth(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		logrus.Debugf("Got an existing team - %s", team.S("team.name"))
+		if !ourTeam.Installed() {
+			// A re-install activates the team with the configuration it had before the uninstall
+			logrus.Infof("Team %s re-installed us", ourTeam.ExternalID)
+		}
 		ourTeam.Name, ourTeam.EmailDomain, ourTeam.Domain, ourTeam.Plan, ourTeam.BotUserID, ourTeam.BotToken, ourTeam.Status =
 			team.S("team.name"), team.S("team.email_domain"), team.S("team.domain"), team.S("team.enterprise_id")+","+team.S("team.enterprise_name"),
 			oauthAccess.S("bot.bot_user_id"), oauthAccess.S("bot.bot_access_token"), domain.UserStatusActive
@@ -21,6 +21,19 @@ func (ac *AppContext) events(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// interactions handles the buttons users click on our messages. Slack sends the payload as a form value and waits
+// only 3 seconds for us so the bot handles it in the background.
+func (ac *AppContext) interactions(w http.ResponseWriter, r *http.Request) {
+	payload := slack.Response{}
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), &payload); err != nil {
+		logrus.WithError(err).Warn("Unable to parse interaction payload")
+		WriteError(w, ErrBadRequest)
+		return
+	}
+	go ac.b.HandleInteraction(payload)
+	w.WriteHeader(http.StatusOK)
+}
+
 func (ac *AppContext) work(w http.ResponseWriter, r *http.Request) {
 	team := r.FormValue("t")
 	file := r.FormValue("f")
@@ -41,6 +54,13 @@ func (ac *AppContext) work(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, ErrInternalServer)
 		return
 	}
+	// The sources the team disabled are not used for the details either
+	c, err := ac.r.ChannelsAndGroups(t.ID)
+	if err != nil {
+		logrus.Warnf("Error loading configuration - %v\n", err)
+		WriteError(w, ErrInternalServer)
+		return
+	}
 	uuid, err := uuid.NewRandom()
 	if err != nil {
 		panic(err)
@@ -50,15 +70,16 @@ func (ac *AppContext) work(w http.ResponseWriter, r *http.Request) {
 	// If we have the actual text to show details for
 	if file == "" {
 		workReq = &domain.WorkRequest{
-			MessageID:  message,
-			Type:       "message",
-			Text:       text,
-			ReplyQueue: replyQueue,
-			Online:     true,
-			VTKey:      t.VTKey,
-			XFEKey:     t.XFEKey,
-			XFEPass:    t.XFEPass,
-			Context:    &domain.Context{},
+			MessageID:       message,
+			Type:            "message",
+			Text:            text,
+			ReplyQueue:      replyQueue,
+			Online:          true,
+			Credentials:     t.Credentials(),
+			DisabledSources: c.SkippedSources(),
+			Scoring:         c.Scoring,
+			InternalDomains: c.InternalDomains,
+			Context:         &domain.Context{},
 		}
 	} else {
 		// Bot scope does not have file info and history permissions so we need to iterate users
@@ -79,14 +100,15 @@ func (ac *AppContext) work(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 				workReq = &domain.WorkRequest{
-					Type:       "file",
-					File:       domain.File{URL: info.S("file.url_private"), Name: info.S("file.name"), Size: info.I("file.size"), Token: t.BotToken},
-					ReplyQueue: replyQueue,
-					Context:    &domain.Context{},
-					Online:     true,
-					VTKey:      t.VTKey,
-					XFEKey:     t.XFEKey,
-					XFEPass:    t.XFEPass,
+					Type:            "file",
+					File:            domain.File{URL: info.S("file.url_private"), Name: info.S("file.name"), Size: info.I("file.size"), Token: t.BotToken},
+					ReplyQueue:      replyQueue,
+					Context:         &domain.Context{},
+					Online:          true,
+					Credentials:     t.Credentials(),
+					DisabledSources: c.SkippedSources(),
+					Scoring:         c.Scoring,
+					InternalDomains: c.InternalDomains,
 				}
 				break
 			}
@@ -94,15 +116,16 @@ func (ac *AppContext) work(w http.ResponseWriter, r *http.Request) {
 		// Just retrieve the details for the MD5
 		if workReq == nil {
 			workReq = &domain.WorkRequest{
-				MessageID:  "file-message",
-				Type:       "message",
-				Text:       text,
-				Context:    &domain.Context{},
-				ReplyQueue: replyQueue,
-				Online:     true,
-				VTKey:      t.VTKey,
-				XFEKey:     t.XFEKey,
-				XFEPass:    t.XFEPass,
+				MessageID:       "file-message",
+				Type:            "message",
+				Text:            text,
+				Context:         &domain.Context{},
+				ReplyQueue:      replyQueue,
+				Online:          true,
+				Credentials:     t.Credentials(),
+				DisabledSources: c.SkippedSources(),
+				Scoring:         c.Scoring,
+				InternalDomains: c.InternalDomains,
 			}
 		}
 	}
@@ -117,7 +140,7 @@ func (ac *AppContext) work(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, ErrInternalServer)
 		return
 	}
-	workReply, err := ac.q.PopWorkReply(replyQueue, 0)
+	workReply, err := ac.q.PopWorkReply(r.Context(), replyQueue)
 	json.NewEncoder(w).Encode(workReply)
 }
 